@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+var reAttribFieldName = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+// handleGetAttribFields returns all the subscriber attribute field definitions.
+func handleGetAttribFields(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out, err := app.core.GetAttribFields()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateAttribField creates a subscriber attribute field definition.
+func handleCreateAttribField(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	f, err := validateAttribFieldReq(c, app)
+	if err != nil {
+		return err
+	}
+
+	out, err := app.core.CreateAttribField(f)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateAttribField updates a subscriber attribute field definition.
+func handleUpdateAttribField(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	f, err := validateAttribFieldReq(c, app)
+	if err != nil {
+		return err
+	}
+
+	out, err := app.core.UpdateAttribField(id, f)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDeleteAttribField deletes a subscriber attribute field definition.
+func handleDeleteAttribField(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.core.DeleteAttribField(id); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+func validateAttribFieldReq(c echo.Context, app *App) (models.AttribField, error) {
+	var f models.AttribField
+	if err := c.Bind(&f); err != nil {
+		return f, err
+	}
+
+	f.Name = strings.TrimSpace(f.Name)
+	if !strHasLen(f.Name, 1, stdInputMaxLen) || !reAttribFieldName.MatchString(f.Name) {
+		return f, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "name"))
+	}
+
+	if !strSliceContains(f.Type, models.AttribFieldTypes) {
+		return f, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "type"))
+	}
+
+	f.Label = strings.TrimSpace(f.Label)
+	if f.Label == "" {
+		f.Label = f.Name
+	}
+	if !strHasLen(f.Label, 1, stdInputMaxLen) {
+		return f, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "label"))
+	}
+
+	// Only enums have options.
+	opts := pq.StringArray{}
+	if f.Type == models.AttribFieldEnum {
+		for _, o := range f.Options {
+			if o = strings.TrimSpace(o); o != "" && !strSliceContains(o, opts) {
+				opts = append(opts, o)
+			}
+		}
+		if len(opts) == 0 {
+			return f, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "options"))
+		}
+	}
+	f.Options = opts
+
+	// The default value has to be of the field's type.
+	if def, ok := f.DefaultValue(); ok {
+		if !f.ValidValue(def) {
+			return f, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "default"))
+		}
+
+		b, _ := json.Marshal(def)
+		f.Default = types.JSONText(b)
+	} else {
+		f.Default = types.JSONText("null")
+	}
+
+	return f, nil
+}
@@ -111,6 +111,37 @@ func handleDeleteBounces(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleGetBounceRules returns the bounce rules.
+func handleGetBounceRules(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out, err := app.core.GetBounceRules()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateBounceRules replaces the bounce rules. The rules are picked up by the
+// bounce rule worker on its next run and don't require a restart.
+func handleUpdateBounceRules(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		rules []models.BounceRule
+	)
+
+	if err := c.Bind(&rules); err != nil {
+		return err
+	}
+
+	if err := app.core.SetBounceRules(rules); err != nil {
+		return err
+	}
+
+	return handleGetBounceRules(c)
+}
+
 // handleBounceWebhook renders the HTML preview of a template.
 func handleBounceWebhook(c echo.Context) error {
 	var (
@@ -163,14 +194,25 @@ func handleBounceWebhook(c echo.Context) error {
 			}
 			break
 
-		// Bounce notification.
+		// Bounce, complaint, and delivery notifications.
 		case "Notification":
-			b, err := app.bounce.SES.ProcessBounce(rawReq)
+			bs, err := app.bounce.SES.ProcessBounce(rawReq)
 			if err != nil {
 				app.log.Printf("error processing SES notification: %v", err)
 				return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidData"))
 			}
-			bounces = append(bounces, b)
+
+			// Complaints are recorded right away and the subscribers are blocklisted.
+			for _, b := range bs {
+				if b.Type != models.BounceTypeComplaint {
+					bounces = append(bounces, b)
+					continue
+				}
+
+				if err := app.core.RecordComplaint(b); err != nil {
+					app.log.Printf("error recording SES complaint: %v", err)
+				}
+			}
 
 		default:
 			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidData"))
@@ -204,6 +246,20 @@ func handleBounceWebhook(c echo.Context) error {
 		}
 		bounces = append(bounces, bs...)
 
+	// SparkPost.
+	case service == "sparkpost" && app.constants.BounceSparkPostEnabled:
+		// SparkPost sends event batches.
+		bs, err := app.bounce.SparkPost.ProcessBounce(rawReq, c)
+		if err != nil {
+			app.log.Printf("error processing sparkpost notification: %v", err)
+			if _, ok := err.(*echo.HTTPError); ok {
+				return err
+			}
+
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidData"))
+		}
+		bounces = append(bounces, bs...)
+
 	default:
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("bounces.unknownService"))
 	}
@@ -218,6 +274,14 @@ func handleBounceWebhook(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleSESWebhook handles AWS SES (SNS) notifications posted to /webhooks/ses.
+func handleSESWebhook(c echo.Context) error {
+	c.SetParamNames("service")
+	c.SetParamValues("ses")
+
+	return handleBounceWebhook(c)
+}
+
 func validateBounceFields(b models.Bounce, app *App) (models.Bounce, error) {
 	if b.Email == "" && b.SubscriberUUID == "" {
 		return b, echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "email / subscriber_uuid"))
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/knadh/listmonk/internal/core"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 	"github.com/lib/pq"
@@ -37,6 +38,17 @@ type campaignReq struct {
 
 	// This is only relevant to campaign test requests.
 	SubscriberEmails pq.StringArray `json:"subscribers"`
+
+	// Optional subscriber query and lists for sending campaign tests to the
+	// first N (test_limit) matching subscribers instead of explicit e-mails.
+	TestQuery   string `json:"test_query"`
+	TestListIDs []int  `json:"test_lists"`
+	TestLimit   int    `json:"test_limit"`
+
+	// Optional revision of the campaign that an update is based on. This overrides
+	// Campaign.Revision so that updates from clients that don't send it, eg: older
+	// API clients, can be told apart and aren't checked for conflicts.
+	Revision null.Int `json:"revision"`
 }
 
 // campaignContentReq wraps params coming from API requests for converting
@@ -47,6 +59,14 @@ type campaignContentReq struct {
 	To   string `json:"to"`
 }
 
+const (
+	// Max number of subscribers a campaign test can be sent to via a query.
+	maxTestQuerySubscribers = 25
+
+	// Max number of buckets that can be requested in an analytics time series.
+	maxAnalyticsSeriesPoints = 24 * 90
+)
+
 var (
 	regexFromAddress = regexp.MustCompile(`((.+?)\s)?<(.+?)@(.+?)>`)
 	regexSlug        = regexp.MustCompile(`[^\p{L}\p{M}\p{N}]`)
@@ -114,11 +134,13 @@ func handleGetCampaign(c echo.Context) error {
 }
 
 // handlePreviewCampaign renders the HTML preview of a campaign body.
+// With ?format=amp, the AMP body is rendered instead.
 func handlePreviewCampaign(c echo.Context) error {
 	var (
 		app      = c.Get("app").(*App)
 		id, _    = strconv.Atoi(c.Param("id"))
 		tplID, _ = strconv.Atoi(c.FormValue("template_id"))
+		isAMP    = c.FormValue("format") == "amp"
 	)
 
 	if id < 1 {
@@ -134,6 +156,12 @@ func handlePreviewCampaign(c echo.Context) error {
 	if c.Request().Method == http.MethodPost {
 		camp.ContentType = c.FormValue("content_type")
 		camp.Body = c.FormValue("body")
+		if isAMP {
+			camp.AMPBody = null.NewString(c.FormValue("amp_body"), true)
+		}
+		if p, err := c.FormParams(); err == nil && p.Has("preheader") {
+			camp.Preheader = null.NewString(p.Get("preheader"), p.Get("preheader") != "")
+		}
 	}
 
 	// Use a dummy campaign ID to prevent views and clicks from {{ TrackView }}
@@ -153,6 +181,15 @@ func handlePreviewCampaign(c echo.Context) error {
 			app.i18n.Ts("templates.errorRendering", "error", err.Error()))
 	}
 
+	if isAMP {
+		b := msg.AMPBody()
+		if len(b) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "amp_body"))
+		}
+		return c.HTML(http.StatusOK, string(b))
+	}
+
 	if camp.ContentType == models.CampaignContentTypePlain {
 		return c.String(http.StatusOK, string(msg.Body()))
 	}
@@ -225,10 +262,122 @@ func handleCreateCampaign(c echo.Context) error {
 		o.ArchiveTemplateID = o.TemplateID
 	}
 
-	out, err := app.core.CreateCampaign(o.Campaign, o.ListIDs, o.MediaIDs)
+	var (
+		out models.Campaign
+		err error
+	)
+	if o.Recurrence.String != "" {
+		out, err = app.core.CreateRecurringCampaign(o.Campaign, o.ListIDs, o.MediaIDs, o.Recurrence.String)
+	} else {
+		out, err = app.core.CreateCampaign(o.Campaign, o.ListIDs, o.MediaIDs)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCloneCampaign clones a campaign into a new draft campaign, optionally
+// overriding its name, subject, lists, and template.
+func handleCloneCampaign(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		Name         string `json:"name"`
+		Subject      string `json:"subject"`
+		ListIDs      []int  `json:"list_ids"`
+		TemplateID   int    `json:"template_id"`
+		CopySchedule bool   `json:"copy_schedule"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if !strHasLen(req.Name, 0, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.fieldInvalidName"))
+	}
+	if !strHasLen(req.Subject, 0, 5000) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.fieldInvalidSubject"))
+	}
+
+	newID, err := app.core.CloneCampaign(id, core.CloneOpts{
+		Name:         req.Name,
+		Subject:      req.Subject,
+		ListIDs:      req.ListIDs,
+		TemplateID:   req.TemplateID,
+		CopySchedule: req.CopySchedule,
+	})
+	if err != nil {
+		return err
+	}
+
+	out, err := app.core.GetCampaign(newID, "", "")
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCloneCampaignTemplate clones the content of a campaign into a new partial
+// template that can be included in other campaigns and templates.
+func handleCloneCampaignTemplate(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	cm, err := app.core.GetCampaign(id, "", "")
+	if err != nil {
+		return err
+	}
+
+	// Markdown bodies are pre-rendered to HTML.
+	body := cm.Body
+	if cm.BodyHTML.Valid {
+		body = cm.BodyHTML.String
+	}
+
+	tpl := models.Template{
+		Name: strings.TrimSpace(req.Name),
+		Type: models.TemplateTypePartial,
+		Body: body,
+	}
+	if err := validateTemplate(tpl, app); err != nil {
+		return err
+	}
+	if err := tpl.Compile(app.manager.TemplateFuncs(nil)); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := validatePartial(0, tpl, app); err != nil {
+		return err
+	}
+
+	out, err := app.core.CreateTemplate(tpl.Name, tpl.Type, "", []byte(tpl.Body))
 	if err != nil {
 		return err
 	}
+	reloadPartials(app)
 
 	return c.JSON(http.StatusOK, okResp{out})
 }
@@ -269,7 +418,7 @@ func handleUpdateCampaign(c echo.Context) error {
 		o = c
 	}
 
-	out, err := app.core.UpdateCampaign(id, o.Campaign, o.ListIDs, o.MediaIDs, o.SendLater)
+	out, err := app.core.UpdateCampaign(id, o.Campaign, o.ListIDs, o.MediaIDs, o.SendLater, o.Revision, getAuthUser(c))
 	if err != nil {
 		return err
 	}
@@ -277,6 +426,44 @@ func handleUpdateCampaign(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
+// handleUpdateCampaignBody auto-saves the body of a campaign.
+func handleUpdateCampaignBody(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var o struct {
+		Body     string   `json:"body"`
+		Revision null.Int `json:"revision"`
+	}
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	cm, err := app.core.GetCampaign(id, "", "")
+	if err != nil {
+		return err
+	}
+
+	if isCampaignalMutable(cm.Status) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.cantUpdate"))
+	}
+
+	rev, err := app.core.UpdateCampaignBody(id, o.Body, o.Revision)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		Revision int `json:"revision"`
+	}{rev}})
+}
+
 // handleUpdateCampaignStatus handles campaign status modification.
 func handleUpdateCampaignStatus(c echo.Context) error {
 	var (
@@ -296,12 +483,24 @@ func handleUpdateCampaignStatus(c echo.Context) error {
 		return err
 	}
 
+	// Pause the campaign in the manager before its status changes as a campaign
+	// that's no longer running has no more subscribers to fetch and would end.
+	paused := o.Status == models.CampaignStatusPaused && app.manager.PauseCampaign(id)
+
 	out, err := app.core.UpdateCampaignStatus(id, o.Status)
 	if err != nil {
+		if paused {
+			app.manager.ResumeCampaign(id)
+		}
 		return err
 	}
 
-	if o.Status == models.CampaignStatusPaused || o.Status == models.CampaignStatusCancelled {
+	switch o.Status {
+	case models.CampaignStatusRunning:
+		// A paused campaign that's still in the manager continues from where it
+		// stopped. Otherwise, it's picked up from its checkpoint on the next scan.
+		app.manager.ResumeCampaign(id)
+	case models.CampaignStatusCancelled:
 		app.manager.StopCampaign(id)
 	}
 
@@ -342,9 +541,9 @@ func handleUpdateCampaignArchive(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{req})
 }
 
-// handleDeleteCampaign handles campaign deletion.
-// Only scheduled campaigns that have not started yet can be deleted.
-func handleDeleteCampaign(c echo.Context) error {
+// handleUpdateCampaignRecurrence sets or clears the cron expression of a recurring
+// campaign and (de)activates its recurrence.
+func handleUpdateCampaignRecurrence(c echo.Context) error {
 	var (
 		app   = c.Get("app").(*App)
 		id, _ = strconv.Atoi(c.Param("id"))
@@ -354,146 +553,674 @@ func handleDeleteCampaign(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
-	if err := app.core.DeleteCampaign(id); err != nil {
+	var req struct {
+		Recurrence string `json:"recurrence"`
+		Active     bool   `json:"active"`
+	}
+	if err := c.Bind(&req); err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, okResp{true})
+	out, err := app.core.UpdateCampaignRecurrence(id, strings.TrimSpace(req.Recurrence), req.Active)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
 }
 
-// handleGetRunningCampaignStats returns stats of a given set of campaign IDs.
-func handleGetRunningCampaignStats(c echo.Context) error {
+// handleTriggerCampaign launches a run of a draft campaign that's sent only to the
+// given recipient e-mails or the subscribers matching the given query.
+func handleTriggerCampaign(c echo.Context) error {
 	var (
-		app = c.Get("app").(*App)
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
 	)
 
-	out, err := app.core.GetRunningCampaignStats()
-	if err != nil {
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		Emails []string `json:"emails"`
+		Query  string   `json:"query"`
+	}
+	if err := c.Bind(&req); err != nil {
 		return err
 	}
 
-	if len(out) == 0 {
-		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	runID, n, err := app.core.TriggerCampaign(id, req.Emails, req.Query, app.constants.CampaignTriggerMaxRecipients)
+	if err != nil {
+		return err
 	}
 
-	// Compute rate.
-	for i, c := range out {
-		if c.Started.Valid && c.UpdatedAt.Valid {
-			diff := int(c.UpdatedAt.Time.Sub(c.Started.Time).Minutes())
-			if diff < 1 {
-				diff = 1
-			}
+	out := struct {
+		RunID      int `json:"run_id"`
+		Recipients int `json:"recipients"`
+	}{runID, n}
 
-			rate := c.Sent / diff
-			if rate > c.Sent || rate > c.ToSend {
-				rate = c.Sent
-			}
+	return c.JSON(http.StatusOK, okResp{out})
+}
 
-			// Rate since the starting of the campaign.
-			out[i].NetRate = rate
+// handleGetCampaignSendWindow returns the send window of a campaign.
+func handleGetCampaignSendWindow(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
 
-			// Realtime running rate over the last minute.
-			out[i].Rate = app.manager.GetCampaignStats(c.ID).SendRate
-		}
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out, err := app.core.GetCampaignSendWindow(id)
+	if err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
-// handleTestCampaign handles the sending of a campaign message to
-// arbitrary subscribers for testing.
-func handleTestCampaign(c echo.Context) error {
+// handleUpdateCampaignSendWindow sets or clears the send window of a campaign.
+func handleUpdateCampaignSendWindow(c echo.Context) error {
 	var (
-		app       = c.Get("app").(*App)
-		campID, _ = strconv.Atoi(c.Param("id"))
-		tplID, _  = strconv.Atoi(c.FormValue("template_id"))
-		req       campaignReq
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
 	)
 
-	if campID < 1 {
-		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.errorID"))
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
-	// Get and validate fields.
+	var req models.CampaignSendWindow
 	if err := c.Bind(&req); err != nil {
 		return err
 	}
 
-	// Validate.
-	if c, err := validateCampaignFields(req, app); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
-	} else {
-		req = c
-	}
-	if len(req.SubscriberEmails) == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.noSubsToTest"))
+	// Both the start and end hours should be set, or neither.
+	if req.Start.Valid != req.End.Valid {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": send window needs both start and end hours")
 	}
-
-	// Get the subscribers.
-	for i := 0; i < len(req.SubscriberEmails); i++ {
-		req.SubscriberEmails[i] = strings.ToLower(strings.TrimSpace(req.SubscriberEmails[i]))
+	if req.Start.Valid {
+		if req.Start.Int < 0 || req.Start.Int > 23 || req.End.Int < 1 || req.End.Int > 24 || req.Start.Int == req.End.Int {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": invalid send window hours")
+		}
 	}
 
-	subs, err := app.core.GetSubscribersByEmail(req.SubscriberEmails)
+	out, err := app.core.UpdateCampaignSendWindow(id, req)
 	if err != nil {
 		return err
 	}
 
-	// The campaign.
-	camp, err := app.core.GetCampaignForPreview(campID, tplID)
-	if err != nil {
-		return err
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateCampaignListGroup sets (or with list_group_id = 0, clears) the list
+// group that a campaign targets.
+func handleUpdateCampaignListGroup(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
-	// Override certain values from the DB with incoming values.
-	camp.Name = req.Name
-	camp.Subject = req.Subject
-	camp.FromEmail = req.FromEmail
-	camp.Body = req.Body
-	camp.AltBody = req.AltBody
-	camp.Messenger = req.Messenger
-	camp.ContentType = req.ContentType
-	camp.Headers = req.Headers
-	camp.TemplateID = req.TemplateID
-	for _, id := range req.MediaIDs {
-		if id > 0 {
-			camp.MediaIDs = append(camp.MediaIDs, int64(id))
-		}
+	var req struct {
+		ListGroupID int `json:"list_group_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
 	}
 
-	// Send the test messages.
-	for _, s := range subs {
-		sub := s
-		c := camp
-		if err := sendTestMessage(sub, &c, app); err != nil {
-			app.log.Printf("error sending test message: %v", err)
-			return echo.NewHTTPError(http.StatusInternalServerError,
-				app.i18n.Ts("campaigns.errorSendTest", "error", err.Error()))
-		}
+	out, err := app.core.UpdateCampaignListGroup(id, req.ListGroupID)
+	if err != nil {
+		return err
 	}
 
-	return c.JSON(http.StatusOK, okResp{true})
+	return c.JSON(http.StatusOK, okResp{out})
 }
 
-// handleGetCampaignViewAnalytics retrieves view counts for a campaign.
-func handleGetCampaignViewAnalytics(c echo.Context) error {
+// handleUpdateCampaignPriority sets the send priority of a campaign. If the campaign
+// is running, the new priority takes effect immediately.
+func handleUpdateCampaignPriority(c echo.Context) error {
 	var (
-		app = c.Get("app").(*App)
-
-		typ  = c.Param("type")
-		from = c.QueryParams().Get("from")
-		to   = c.QueryParams().Get("to")
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
 	)
 
-	ids, err := parseStringIDs(c.Request().URL.Query()["id"])
-	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest,
-			app.i18n.Ts("globals.messages.errorInvalidIDs", "error", err.Error()))
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
-	if len(ids) == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest,
-			app.i18n.Ts("globals.messages.missingFields", "name", "`id`"))
+	var req struct {
+		Priority int `json:"priority"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	out, err := app.core.SetCampaignPriority(id, req.Priority)
+	if err != nil {
+		return err
+	}
+	app.manager.SetCampaignPriority(id, req.Priority)
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateCampaignUnsubHeader sets whether the List-Unsubscribe headers are added
+// to a campaign's messages. A null value follows the global setting.
+func handleUpdateCampaignUnsubHeader(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		Enabled null.Bool `json:"enabled"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	out, err := app.core.UpdateCampaignUnsubHeader(id, req.Enabled)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateCampaignInlineCSS sets whether the CSS in a campaign's body is
+// inlined before sending. A null value follows the global setting.
+func handleUpdateCampaignInlineCSS(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		Enabled null.Bool `json:"enabled"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	out, err := app.core.UpdateCampaignInlineCSS(id, req.Enabled)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateCampaignTrackViews sets whether a campaign's views are tracked.
+func handleUpdateCampaignTrackViews(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	out, err := app.core.UpdateCampaignTrackViews(id, req.Enabled)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateCampaignNotify sets the e-mails and the webhook that are notified
+// when a campaign finishes or is cancelled.
+func handleUpdateCampaignNotify(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		Emails    []string `json:"emails"`
+		WebhookID int      `json:"webhook_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	emails := make([]string, 0, len(req.Emails))
+	for _, e := range req.Emails {
+		em, err := app.importer.ParseEmail(e)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "emails"))
+		}
+		if !strSliceContains(em, emails) {
+			emails = append(emails, em)
+		}
+	}
+
+	if req.WebhookID < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "webhook_id"))
+	}
+
+	out, err := app.core.UpdateCampaignNotify(id, emails, req.WebhookID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignDiagnostics runs the pre-send deliverability checks on a campaign.
+// Checks can be skipped with ?skip=links&skip=spf.
+func handleGetCampaignDiagnostics(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out, err := app.core.DiagnoseCampaign(id, c.QueryParams()["skip"]...)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignVersions returns the content version history of a campaign.
+func handleGetCampaignVersions(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out, err := app.core.GetCampaignVersions(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignApprovals returns the approval log of a campaign.
+func handleGetCampaignApprovals(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out, err := app.core.GetCampaignApprovals(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateCampaignApproval submits a campaign for approval, or approves or rejects it.
+func handleUpdateCampaignApproval(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var o struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	out, err := app.core.UpdateCampaignApproval(id, o.Status, o.Reason, getAuthUser(c))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleRestoreCampaignVersion restores the content of a campaign from one of its versions.
+func handleRestoreCampaignVersion(c echo.Context) error {
+	var (
+		app        = c.Get("app").(*App)
+		id, _      = strconv.Atoi(c.Param("id"))
+		version, _ = strconv.Atoi(c.Param("version"))
+	)
+
+	if id < 1 || version < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	cm, err := app.core.GetCampaign(id, "", "")
+	if err != nil {
+		return err
+	}
+
+	if isCampaignalMutable(cm.Status) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.cantUpdate"))
+	}
+
+	out, err := app.core.RestoreCampaignVersion(id, version, getAuthUser(c))
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignVariants returns the A/B subject variants of a campaign and their stats.
+func handleGetCampaignVariants(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out, err := app.core.GetCampaignVariants(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateCampaignVariants replaces the A/B subject variants of a campaign.
+// Variants can only be changed before a campaign has started.
+func handleUpdateCampaignVariants(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	cm, err := app.core.GetCampaign(id, "", "")
+	if err != nil {
+		return err
+	}
+
+	if cm.Status != models.CampaignStatusDraft && cm.Status != models.CampaignStatusScheduled {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.cantUpdate"))
+	}
+
+	var req struct {
+		Variants []models.CampaignVariant `json:"variants"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	// A test needs at least two variants. No variants disables testing.
+	if len(req.Variants) == 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": at least two variants are required")
+	}
+	for _, v := range req.Variants {
+		// Larger char limit for subject as it can contain {{ go templating }} logic.
+		if !strHasLen(v.Subject, 1, 5000) {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.fieldInvalidSubject"))
+		}
+		if err := v.CompileSubject(app.manager.TemplateFuncs(&cm)); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	out, err := app.core.CreateCampaignVariants(id, req.Variants)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDeleteCampaign handles campaign deletion.
+// Only scheduled campaigns that have not started yet can be deleted.
+func handleDeleteCampaign(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.core.DeleteCampaign(id); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleGetRunningCampaignStats returns stats of a given set of campaign IDs.
+func handleGetRunningCampaignStats(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+	)
+
+	out, err := app.core.GetRunningCampaignStats()
+	if err != nil {
+		return err
+	}
+
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	// Compute rate.
+	for i, c := range out {
+		if c.Started.Valid && c.UpdatedAt.Valid {
+			diff := int(c.UpdatedAt.Time.Sub(c.Started.Time).Minutes())
+			if diff < 1 {
+				diff = 1
+			}
+
+			rate := c.Sent / diff
+			if rate > c.Sent || rate > c.ToSend {
+				rate = c.Sent
+			}
+
+			// Rate since the starting of the campaign.
+			out[i].NetRate = rate
+
+			// Realtime running rate over the last minute.
+			out[i].Rate = app.manager.GetCampaignStats(c.ID).SendRate
+		}
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleTestCampaign handles the sending of a campaign message to
+// arbitrary subscribers for testing.
+func handleTestCampaign(c echo.Context) error {
+	var (
+		app       = c.Get("app").(*App)
+		campID, _ = strconv.Atoi(c.Param("id"))
+		tplID, _  = strconv.Atoi(c.FormValue("template_id"))
+		req       campaignReq
+	)
+
+	if campID < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.errorID"))
+	}
+
+	// Get and validate fields.
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	// Validate.
+	if c, err := validateCampaignFields(req, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	} else {
+		req = c
+	}
+	req.TestQuery = sanitizeSQLExp(req.TestQuery)
+	isQuery := req.TestQuery != "" || len(req.TestListIDs) > 0
+	if len(req.SubscriberEmails) == 0 && !isQuery {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.noSubsToTest"))
+	}
+	if isQuery && (req.TestLimit < 1 || req.TestLimit > maxTestQuerySubscribers) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidData")+fmt.Sprintf(": test_limit should be between 1 and %d", maxTestQuerySubscribers))
+	}
+
+	// The campaign.
+	camp, err := app.core.GetCampaignForPreview(campID, tplID)
+	if err != nil {
+		return err
+	}
+
+	// Override certain values from the DB with incoming values.
+	camp.Name = req.Name
+	camp.Subject = req.Subject
+	camp.FromEmail = req.FromEmail
+	camp.Body = req.Body
+	camp.AltBody = req.AltBody
+	camp.AMPBody = req.AMPBody
+	camp.Messenger = req.Messenger
+	camp.ContentType = req.ContentType
+	camp.Headers = req.Headers
+	camp.TemplateID = req.TemplateID
+	for _, id := range req.MediaIDs {
+		if id > 0 {
+			camp.MediaIDs = append(camp.MediaIDs, int64(id))
+		}
+	}
+
+	// Send the tests to the subscribers matching the query.
+	if isQuery {
+		if _, err := sendCampaignTestToQuery(camp, req.TestQuery, req.TestListIDs, req.TestLimit, app); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, okResp{true})
+	}
+
+	// Get the subscribers.
+	for i := 0; i < len(req.SubscriberEmails); i++ {
+		req.SubscriberEmails[i] = strings.ToLower(strings.TrimSpace(req.SubscriberEmails[i]))
+	}
+
+	subs, err := app.core.GetSubscribersByEmail(req.SubscriberEmails)
+	if err != nil {
+		return err
+	}
+
+	// Send the test messages.
+	if err := sendTestMessages(subs, camp, app); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// sendCampaignTestToQuery sends test messages of a campaign to the first N (limit)
+// subscribers matching the given query and lists, rendered with their actual data.
+// It returns the number of subscribers the test was sent to.
+func sendCampaignTestToQuery(camp models.Campaign, query string, listIDs []int, limit int, app *App) (int, error) {
+	if limit < 1 || limit > maxTestQuerySubscribers {
+		limit = maxTestQuerySubscribers
+	}
+
+	subs, _, err := app.core.QuerySubscribers(query, listIDs, "", core.SortAsc, "", 0, limit)
+	if err != nil {
+		return 0, err
+	}
+	if len(subs) == 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.noSubsToTest"))
+	}
+
+	// Guard against the query returning more than the limit.
+	if len(subs) > limit {
+		subs = subs[:limit]
+	}
+
+	if err := sendTestMessages(subs, camp, app); err != nil {
+		return 0, err
+	}
+
+	return len(subs), nil
+}
+
+// sendTestMessages sends test messages of a campaign to the given subscribers.
+func sendTestMessages(subs models.Subscribers, camp models.Campaign, app *App) error {
+	for _, s := range subs {
+		sub := s
+		c := camp
+		if err := sendTestMessage(sub, &c, app); err != nil {
+			app.log.Printf("error sending test message: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("campaigns.errorSendTest", "error", err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// handleGetCampaignViewAnalytics retrieves view counts for a campaign.
+func handleGetCampaignViewAnalytics(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+
+		typ  = c.Param("type")
+		from = c.QueryParams().Get("from")
+		to   = c.QueryParams().Get("to")
+	)
+
+	ids, err := parseStringIDs(c.Request().URL.Query()["id"])
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.errorInvalidIDs", "error", err.Error()))
+	}
+
+	if len(ids) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.missingFields", "name", "`id`"))
 	}
 
 	if !strHasLen(from, 10, 30) || !strHasLen(to, 10, 30) {
@@ -519,6 +1246,133 @@ func handleGetCampaignViewAnalytics(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
+// handleGetCampaignAnalyticsSeries retrieves the hourly or daily view or click
+// counts of a single campaign as a time series.
+func handleGetCampaignAnalyticsSeries(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+
+		typ      = c.QueryParam("type")
+		interval = c.QueryParam("interval")
+		tz       = c.QueryParam("tz")
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if typ == "" {
+		typ = "views"
+	}
+
+	var step time.Duration
+	switch interval {
+	case "", "hour":
+		interval = "hour"
+		step = time.Hour
+	case "day":
+		step = time.Hour * 24
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": interval should be hour or day")
+	}
+
+	if tz == "" {
+		tz = "UTC"
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": tz: "+err.Error())
+	}
+
+	// The range defaults to the last 100 intervals.
+	to := time.Now()
+	if v := c.QueryParam("to"); v != "" {
+		t, err := parseAnalyticsDate(v, loc)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("analytics.invalidDates"))
+		}
+		to = t
+	}
+
+	from := to.Add(-step * 100)
+	if v := c.QueryParam("from"); v != "" {
+		t, err := parseAnalyticsDate(v, loc)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("analytics.invalidDates"))
+		}
+		from = t
+	}
+
+	if !to.After(from) || to.Sub(from)/step > maxAnalyticsSeriesPoints {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("analytics.invalidDates"))
+	}
+
+	out, err := app.core.GetCampaignAnalyticsSeries(id, typ, from, to, interval, loc.String())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignLinkStats returns the per-URL click stats of a campaign.
+func handleGetCampaignLinkStats(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	out, err := app.core.GetCampaignLinkStats(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignReport returns a standalone report of a campaign's stats
+// that can be downloaded and shared.
+func handleGetCampaignReport(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		id, _  = strconv.Atoi(c.Param("id"))
+		format = c.QueryParam("format")
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if format == "" {
+		format = "html"
+	}
+
+	b, err := app.core.GenerateCampaignReport(id, format)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := c.QueryParams()["download"]; ok {
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="campaign-%d-report.html"`, id))
+	}
+
+	return c.Blob(http.StatusOK, "text/html; charset=utf-8", b)
+}
+
+// parseAnalyticsDate parses an RFC3339 timestamp or a YYYY-MM-DD date in the given location.
+func parseAnalyticsDate(s string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+
+	return time.ParseInLocation("2006-01-02", s, loc)
+}
+
 // sendTestMessage takes a campaign and a subscriber and sends out a sample campaign message.
 func sendTestMessage(sub models.Subscriber, camp *models.Campaign, app *App) error {
 	if err := camp.CompileTemplate(app.manager.TemplateFuncs(camp)); err != nil {
@@ -528,7 +1382,7 @@ func sendTestMessage(sub models.Subscriber, camp *models.Campaign, app *App) err
 	}
 
 	// Create a sample campaign message.
-	msg, err := app.manager.NewCampaignMessage(camp, sub)
+	msg, err := app.manager.NewTestCampaignMessage(camp, sub)
 	if err != nil {
 		app.log.Printf("error rendering message: %v", err)
 		return echo.NewHTTPError(http.StatusNotFound,
@@ -540,10 +1394,10 @@ func sendTestMessage(sub models.Subscriber, camp *models.Campaign, app *App) err
 
 // validateCampaignFields validates incoming campaign field values.
 func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
-	if c.FromEmail == "" {
-		c.FromEmail = app.constants.FromEmail
-	} else if !regexFromAddress.Match([]byte(c.FromEmail)) {
-		if _, err := app.importer.SanitizeEmail(c.FromEmail); err != nil {
+	// An empty from_email falls back to the list's sending identity (single-list
+	// campaigns) or the global from_email when the campaign is sent.
+	if c.FromEmail != "" && !regexFromAddress.Match([]byte(c.FromEmail)) {
+		if _, err := app.importer.ParseEmail(c.FromEmail); err != nil {
 			return c, errors.New(app.i18n.T("campaigns.fieldInvalidFromEmail"))
 		}
 	}
@@ -557,6 +1411,29 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 		return c, errors.New(app.i18n.T("campaigns.fieldInvalidSubject"))
 	}
 
+	// The preheader may have template expressions like the subject.
+	c.Preheader.String = strings.TrimSpace(c.Preheader.String)
+	c.Preheader.Valid = c.Preheader.String != ""
+	if !strHasLen(c.Preheader.String, 0, 5000) {
+		return c, errors.New(app.i18n.Ts("globals.messages.invalidFields", "name", "preheader"))
+	}
+
+	// The UTM params may also have template expressions.
+	c.UTM = models.CampaignUTM{
+		Source:   strings.TrimSpace(c.UTM.Source),
+		Medium:   strings.TrimSpace(c.UTM.Medium),
+		Campaign: strings.TrimSpace(c.UTM.Campaign),
+		Content:  strings.TrimSpace(c.UTM.Content),
+	}
+	for _, p := range c.UTM.Params() {
+		if !strHasLen(p[1], 0, stdInputMaxLen) {
+			return c, errors.New(app.i18n.Ts("globals.messages.invalidFields", "name", p[0]))
+		}
+	}
+	if _, err := c.UTM.Compile(app.manager.TemplateFuncs(&c.Campaign)); err != nil {
+		return c, errors.New(app.i18n.Ts("globals.messages.invalidFields", "name", "utm") + ": " + err.Error())
+	}
+
 	// If there's a "send_at" date, it should be in the future.
 	if c.SendAt.Valid {
 		if c.SendAt.Time.Before(time.Now()) {
@@ -572,6 +1449,18 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 		return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", c.Messenger))
 	}
 
+	// Lists and campaigns whose subscribers are excluded from the campaign.
+	for _, id := range c.ExcludeListIDs {
+		if id < 1 {
+			return c, errors.New(app.i18n.Ts("globals.messages.invalidFields", "name", "exclude_list_ids"))
+		}
+	}
+	for _, id := range c.ExcludeCampaignIDs {
+		if id < 1 || (c.ID > 0 && id == int64(c.ID)) {
+			return c, errors.New(app.i18n.Ts("globals.messages.invalidFields", "name", "exclude_campaign_ids"))
+		}
+	}
+
 	camp := models.Campaign{Body: c.Body, TemplateBody: tplTag}
 	if err := c.CompileTemplate(app.manager.TemplateFuncs(&camp)); err != nil {
 		return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidBody", "error", err.Error()))
@@ -580,6 +1469,17 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 	if len(c.Headers) == 0 {
 		c.Headers = make([]map[string]string, 0)
 	}
+	if err := c.Headers.Validate(app.constants.AllowProtectedHeaders); err != nil {
+		return c, errors.New(app.i18n.Ts("globals.messages.invalidFields", "name", "headers") + ": " + err.Error())
+	}
+
+	if strings.TrimSpace(c.AMPBody.String) != "" {
+		if err := models.ValidateAMP(c.AMPBody.String); err != nil {
+			return c, errors.New(app.i18n.Ts("globals.messages.invalidFields", "name", "amp_body") + ": " + err.Error())
+		}
+	} else {
+		c.AMPBody = null.String{}
+	}
 
 	if len(c.ArchiveMeta) == 0 {
 		c.ArchiveMeta = json.RawMessage("{}")
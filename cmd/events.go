@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 )
 
@@ -50,3 +54,78 @@ func handleEventStream(c echo.Context) error {
 
 	return nil
 }
+
+// handleCampaignProgressStream pushes the live send progress of a campaign
+// (text/event-stream) every second until the campaign stops being processed.
+// If the campaign isn't running, its progress is sent once from the DB.
+func handleCampaignProgressStream(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	camp, err := app.core.GetCampaign(id, "", "")
+	if err != nil {
+		return err
+	}
+
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "text/event-stream")
+	h.Set(echo.HeaderCacheControl, "no-store")
+	h.Set(echo.HeaderConnection, "keep-alive")
+
+	push := func(p manager.CampProgress) {
+		b, err := json.Marshal(p)
+		if err != nil {
+			app.log.Printf("error marshalling campaign progress: %v", err)
+			return
+		}
+
+		c.Response().Write([]byte(fmt.Sprintf("retry: 3000\ndata: %s\n\n", b)))
+		c.Response().Flush()
+	}
+
+	// Subscribe before checking the status so that the end of a campaign
+	// that finishes in between isn't missed.
+	sub, unsub := app.manager.SubscribeProgress(id)
+	defer unsub()
+
+	if camp.Status != models.CampaignStatusRunning && camp.Status != models.CampaignStatusScheduled {
+		remaining := camp.ToSend - camp.Sent
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		push(manager.CampProgress{
+			CampaignID: camp.ID,
+			Status:     camp.Status,
+			ToSend:     camp.ToSend,
+			Sent:       camp.Sent,
+			Remaining:  remaining,
+			Done:       true,
+		})
+		return nil
+	}
+
+	ctx := c.Request().Context()
+	for {
+		select {
+		case p, ok := <-sub:
+			if !ok {
+				return nil
+			}
+
+			push(p)
+			if p.Done {
+				return nil
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -3,13 +3,19 @@ package main
 import (
 	"bytes"
 	"crypto/subtle"
+	"math"
+	"net"
 	"net/http"
 	"path"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/knadh/paginator"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -86,6 +92,11 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	g.GET("/api/settings", handleGetSettings)
 	g.PUT("/api/settings", handleUpdateSettings)
 	g.POST("/api/settings/smtp/test", handleTestSMTPSettings)
+	g.GET("/api/settings/throttle", handleGetThrottle)
+	g.PUT("/api/settings/throttle", handleUpdateThrottle)
+	g.GET("/api/settings/domains", handleGetDomainRules)
+	g.PUT("/api/settings/domains", handleUpdateDomainRules)
+	g.GET("/api/settings/smtp/health", handleGetSMTPHealth)
 	g.POST("/api/admin/reload", handleReloadApp)
 	g.GET("/api/logs", handleGetLogs)
 	g.GET("/api/about", handleGetAboutInfo)
@@ -93,6 +104,7 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	g.GET("/api/subscribers/:id", handleGetSubscriber)
 	g.GET("/api/subscribers/:id/export", handleExportSubscriberData)
 	g.GET("/api/subscribers/:id/bounces", handleGetSubscriberBounces)
+	g.GET("/api/subscribers/:id/activity", handleGetSubscriberActivity)
 	g.DELETE("/api/subscribers/:id/bounces", handleDeleteSubscriberBounces)
 	g.POST("/api/subscribers", handleCreateSubscriber)
 	g.PUT("/api/subscribers/:id", handleUpdateSubscriber)
@@ -100,33 +112,75 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	g.PUT("/api/subscribers/blocklist", handleBlocklistSubscribers)
 	g.PUT("/api/subscribers/:id/blocklist", handleBlocklistSubscribers)
 	g.PUT("/api/subscribers/lists/:id", handleManageSubscriberLists)
+	g.PUT("/api/subscribers/archive", handleArchiveSubscribers)
+	g.PUT("/api/subscribers/:id/archive", handleArchiveSubscribers)
+	g.PUT("/api/subscribers/restore", handleArchiveSubscribers)
+	g.PUT("/api/subscribers/:id/restore", handleArchiveSubscribers)
+	g.GET("/api/subscribers/duplicates", handleGetDuplicateSubscribers)
+	g.PUT("/api/subscribers/:id/merge", handleMergeSubscribers)
+	g.POST("/api/subscribers/erase", handleEraseSubscriber)
 	g.PUT("/api/subscribers/lists", handleManageSubscriberLists)
 	g.DELETE("/api/subscribers/:id", handleDeleteSubscribers)
 	g.DELETE("/api/subscribers", handleDeleteSubscribers)
 
+	g.GET("/api/subscribers/attribs/fields", handleGetAttribFields)
+	g.POST("/api/subscribers/attribs/fields", handleCreateAttribField)
+	g.PUT("/api/subscribers/attribs/fields/:id", handleUpdateAttribField)
+	g.DELETE("/api/subscribers/attribs/fields/:id", handleDeleteAttribField)
+
 	g.GET("/api/bounces", handleGetBounces)
 	g.GET("/api/bounces/:id", handleGetBounces)
 	g.DELETE("/api/bounces", handleDeleteBounces)
 	g.DELETE("/api/bounces/:id", handleDeleteBounces)
+	g.GET("/api/settings/bounce-rules", handleGetBounceRules)
+	g.PUT("/api/settings/bounce-rules", handleUpdateBounceRules)
+
+	g.GET("/api/segments", handleGetSegments)
+	g.GET("/api/segments/:id", handleGetSegments)
+	g.POST("/api/segments", handleCreateSegment)
+	g.PUT("/api/segments/:id", handleUpdateSegment)
+	g.DELETE("/api/segments/:id", handleDeleteSegment)
+
+	g.GET("/api/webhooks", handleGetWebhooks)
+	g.POST("/api/webhooks", handleRegisterWebhook)
+	g.GET("/api/webhooks/failures", handleGetWebhookFailures)
+	g.DELETE("/api/webhooks/:id", handleDeleteWebhook)
 
 	// Subscriber operations based on arbitrary SQL queries.
 	// These aren't very REST-like.
+	g.POST("/api/subscribers/query/preview", handlePreviewSubscribersByQuery)
 	g.POST("/api/subscribers/query/delete", handleDeleteSubscribersByQuery)
 	g.PUT("/api/subscribers/query/blocklist", handleBlocklistSubscribersByQuery)
+	g.PUT("/api/subscribers/query/unblocklist", handleBlocklistSubscribersByQuery)
 	g.PUT("/api/subscribers/query/lists", handleManageSubscriberListsByQuery)
 	g.GET("/api/subscribers", handleQuerySubscribers)
+	g.POST("/api/subscribers/search", handleSearchSubscribers)
 	g.GET("/api/subscribers/export",
 		middleware.GzipWithConfig(middleware.GzipConfig{Level: 9})(handleExportSubscribers))
 
+	g.GET("/api/suppressions", handleGetSuppressionStats)
+	g.POST("/api/suppressions/import", handleImportSuppressions)
+	g.GET("/api/suppressions/export",
+		middleware.GzipWithConfig(middleware.GzipConfig{Level: 9})(handleExportSuppressions))
+
 	g.GET("/api/import/subscribers", handleGetImportSubscribers)
 	g.GET("/api/import/subscribers/logs", handleGetImportSubscriberStats)
 	g.POST("/api/import/subscribers", handleImportSubscribers)
+	g.POST("/api/import/subscribers/remote", handleImportRemoteSubscribers)
 	g.DELETE("/api/import/subscribers", handleStopImportSubscribers)
 
+	g.POST("/api/lists/counts/refresh", handleRefreshListCounts)
 	g.GET("/api/lists", handleGetLists)
+	g.GET("/api/lists/groups", handleGetListGroups)
 	g.GET("/api/lists/:id", handleGetLists)
 	g.POST("/api/lists", handleCreateList)
 	g.PUT("/api/lists/:id", handleUpdateList)
+	g.PUT("/api/lists/:id/template", handleUpdateListTemplate)
+	g.PUT("/api/lists/:id/track-views", handleUpdateListTrackViews)
+	g.PUT("/api/lists/:id/parent", handleUpdateListParent)
+	g.POST("/api/lists/:id/reconfirm", handleStartListReconfirmation)
+	g.PUT("/api/lists/:id/archive", handleArchiveList)
+	g.PUT("/api/lists/:id/unarchive", handleArchiveList)
 	g.DELETE("/api/lists/:id", handleDeleteLists)
 
 	g.GET("/api/campaigns", handleGetCampaigns)
@@ -139,19 +193,50 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	g.POST("/api/campaigns/:id/text", handlePreviewCampaign)
 	g.POST("/api/campaigns/:id/test", handleTestCampaign)
 	g.POST("/api/campaigns", handleCreateCampaign)
+	g.POST("/api/campaigns/:id/clone", handleCloneCampaign)
+	g.POST("/api/campaigns/:id/clone/template", handleCloneCampaignTemplate)
 	g.PUT("/api/campaigns/:id", handleUpdateCampaign)
 	g.PUT("/api/campaigns/:id/status", handleUpdateCampaignStatus)
+	g.GET("/api/campaigns/:id/progress", handleCampaignProgressStream)
 	g.PUT("/api/campaigns/:id/archive", handleUpdateCampaignArchive)
+	g.PUT("/api/campaigns/:id/recurrence", handleUpdateCampaignRecurrence)
+	g.POST("/api/campaigns/:id/trigger", handleTriggerCampaign)
+	g.PUT("/api/campaigns/:id/segment", handleUpdateCampaignSegment)
+	g.PUT("/api/campaigns/:id/list-group", handleUpdateCampaignListGroup)
+	g.PUT("/api/campaigns/:id/priority", handleUpdateCampaignPriority)
+	g.PUT("/api/campaigns/:id/unsubscribe-header", handleUpdateCampaignUnsubHeader)
+	g.PUT("/api/campaigns/:id/inline-css", handleUpdateCampaignInlineCSS)
+	g.GET("/api/campaigns/:id/diagnostics", handleGetCampaignDiagnostics)
+	g.PUT("/api/campaigns/:id/track-views", handleUpdateCampaignTrackViews)
+	g.PUT("/api/campaigns/:id/notify", handleUpdateCampaignNotify)
+	g.GET("/api/campaigns/:id/send-window", handleGetCampaignSendWindow)
+	g.PUT("/api/campaigns/:id/send-window", handleUpdateCampaignSendWindow)
+	g.GET("/api/campaigns/:id/analytics", handleGetCampaignAnalyticsSeries)
+	g.GET("/api/campaigns/:id/links", handleGetCampaignLinkStats)
+	g.GET("/api/campaigns/:id/report", handleGetCampaignReport)
+	g.GET("/api/campaigns/:id/versions", handleGetCampaignVersions)
+	g.PUT("/api/campaigns/:id/versions/:version/restore", handleRestoreCampaignVersion)
+	g.GET("/api/campaigns/:id/approvals", handleGetCampaignApprovals)
+	g.PUT("/api/campaigns/:id/approval", handleUpdateCampaignApproval)
+	g.PUT("/api/campaigns/:id/body", handleUpdateCampaignBody)
+	g.GET("/api/campaigns/:id/variants", handleGetCampaignVariants)
+	g.PUT("/api/campaigns/:id/variants", handleUpdateCampaignVariants)
 	g.DELETE("/api/campaigns/:id", handleDeleteCampaign)
 
 	g.GET("/api/media", handleGetMedia)
+	g.GET("/api/media/folders", handleGetMediaFolders)
+	g.POST("/api/media/folders", handleCreateMediaFolder)
+	g.DELETE("/api/media/folders/:id", handleDeleteMediaFolder)
+	g.PUT("/api/media/move", handleMoveMedia)
 	g.GET("/api/media/:id", handleGetMedia)
 	g.POST("/api/media", handleUploadMedia)
 	g.DELETE("/api/media/:id", handleDeleteMedia)
 
 	g.GET("/api/templates", handleGetTemplates)
+	g.GET("/api/templates/variables", handleGetTemplateVariables)
 	g.GET("/api/templates/:id", handleGetTemplates)
 	g.GET("/api/templates/:id/preview", handlePreviewTemplate)
+	g.POST("/api/templates/:id/preview", handlePreviewTemplateWithData)
 	g.POST("/api/templates/preview", handlePreviewTemplate)
 	g.POST("/api/templates", handleCreateTemplate)
 	g.PUT("/api/templates/:id", handleUpdateTemplate)
@@ -162,7 +247,9 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	g.DELETE("/api/maintenance/analytics/:type", handleGCCampaignAnalytics)
 	g.DELETE("/api/maintenance/subscriptions/unconfirmed", handleGCSubscriptions)
 
-	g.POST("/api/tx", handleSendTxMessage)
+	g.POST("/api/tx", txIdempotent(handleSendTxMessage))
+	g.POST("/api/tx/batch", txIdempotent(handleSendTxBatch))
+	g.GET("/api/tx/:uuid", handleGetTxStatus)
 
 	g.GET("/api/events", handleEventStream)
 
@@ -172,11 +259,14 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 
 		// Public bounce endpoints for webservices like SES.
 		e.POST("/webhooks/service/:service", handleBounceWebhook)
+		e.POST("/webhooks/ses", handleSESWebhook)
 	}
 
-	// Public API endpoints.
+	// Public API endpoints. The endpoints that mutate subscriptions are rate limited.
+	// Opt-in confirmations aren't, so that legitimate confirmation clicks are never blocked.
+	pubLimit := makePublicRateLimiter(app)
 	e.GET("/api/public/lists", handleGetPublicLists)
-	e.POST("/api/public/subscription", handlePublicSubscription)
+	e.POST("/api/public/subscription", handlePublicSubscription, pubLimit...)
 
 	if app.constants.EnablePublicArchive {
 		e.GET("/api/public/archive", handleGetCampaignArchives)
@@ -185,17 +275,20 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	// /public/static/* file server is registered in initHTTPServer().
 	// Public subscriber facing views.
 	e.GET("/subscription/form", handleSubscriptionFormPage)
-	e.POST("/subscription/form", handleSubscriptionForm)
+	e.POST("/subscription/form", handleSubscriptionForm, pubLimit...)
 	e.GET("/subscription/:campUUID/:subUUID", noIndex(validateUUID(subscriberExists(handleSubscriptionPage),
 		"campUUID", "subUUID")))
 	e.POST("/subscription/:campUUID/:subUUID", validateUUID(subscriberExists(handleSubscriptionPrefs),
+		"campUUID", "subUUID"), pubLimit...)
+	// One-click unsubscriptions are made by mailbox providers and aren't rate limited.
+	e.POST("/subscription/one-click/:campUUID/:subUUID", validateUUID(handleOneClickUnsubscribe,
 		"campUUID", "subUUID"))
 	e.GET("/subscription/optin/:subUUID", noIndex(validateUUID(subscriberExists(handleOptinPage), "subUUID")))
 	e.POST("/subscription/optin/:subUUID", validateUUID(subscriberExists(handleOptinPage), "subUUID"))
 	e.POST("/subscription/export/:subUUID", validateUUID(subscriberExists(handleSelfExportSubscriberData),
-		"subUUID"))
+		"subUUID"), pubLimit...)
 	e.POST("/subscription/wipe/:subUUID", validateUUID(subscriberExists(handleWipeSubscriberData),
-		"subUUID"))
+		"subUUID"), pubLimit...)
 	e.GET("/link/:linkUUID/:campUUID/:subUUID", noIndex(validateUUID(handleLinkRedirect,
 		"linkUUID", "campUUID", "subUUID")))
 	e.GET("/campaign/:campUUID/:subUUID", noIndex(validateUUID(handleViewCampaignMessage,
@@ -213,8 +306,9 @@ func initHTTPHandlers(e *echo.Echo, app *App) {
 	e.GET("/public/custom.css", serveCustomApperance("public.custom_css"))
 	e.GET("/public/custom.js", serveCustomApperance("public.custom_js"))
 
-	// Public health API endpoint.
+	// Public health API endpoints.
 	e.GET("/health", handleHealthCheck)
+	e.GET("/health/ready", handleReadyCheck)
 
 	// 404 pages.
 	e.RouteNotFound("/*", func(c echo.Context) error {
@@ -298,6 +392,13 @@ func basicAuth(username, password string, c echo.Context) (bool, error) {
 	return false, nil
 }
 
+// getAuthUser returns the username of the authenticated admin user
+// making the request, if any.
+func getAuthUser(c echo.Context) string {
+	user, _, _ := c.Request().BasicAuth()
+	return user
+}
+
 // validateUUID middleware validates the UUID string format for a given set of params.
 func validateUUID(next echo.HandlerFunc, params ...string) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -323,10 +424,18 @@ func subscriberExists(next echo.HandlerFunc, params ...string) echo.HandlerFunc
 			subUUID = c.Param("subUUID")
 		)
 
-		if _, err := app.core.GetSubscriber(0, subUUID, ""); err != nil {
-			if er, ok := err.(*echo.HTTPError); ok && er.Code == http.StatusBadRequest {
-				return c.Render(http.StatusNotFound, tplMessage,
-					makeMsgTpl(app.i18n.T("public.notFoundTitle"), "", er.Message.(string)))
+		if _, err := app.core.GetSubscriberByUUID(subUUID); err != nil {
+			if er, ok := err.(*echo.HTTPError); ok {
+				switch er.Code {
+				case http.StatusNotFound:
+					return c.Render(http.StatusNotFound, tplMessage,
+						makeMsgTpl(app.i18n.T("public.notFoundTitle"), "", er.Message.(string)))
+
+				// Invalid UUID.
+				case http.StatusBadRequest:
+					return c.Render(http.StatusBadRequest, tplMessage,
+						makeMsgTpl(app.i18n.T("public.errorTitle"), "", er.Message.(string)))
+				}
 			}
 
 			app.log.Printf("error checking subscriber existence: %v", err)
@@ -338,6 +447,60 @@ func subscriberExists(next echo.HandlerFunc, params ...string) echo.HandlerFunc
 	}
 }
 
+// makePublicRateLimiter returns a per-IP token bucket rate limiter middleware for the
+// public endpoints, or none if rate limiting is disabled. A bucket holds
+// security.public_rate_limit_requests tokens and is refilled at the same number of
+// tokens per security.public_rate_limit_window.
+func makePublicRateLimiter(app *App) []echo.MiddlewareFunc {
+	var (
+		sec    = app.constants.Security
+		num    = sec.PublicRateLimitRequests
+		window = sec.PublicRateLimitWindow
+	)
+	if !sec.PublicRateLimitEnabled || num < 1 || window < time.Second {
+		return nil
+	}
+
+	// Time to refill one token, which is the minimum wait before a denied request may be retried.
+	retry := strconv.Itoa(int(math.Ceil(window.Seconds() / float64(num))))
+
+	return []echo.MiddlewareFunc{middleware.RateLimiterWithConfig(middleware.RateLimiterConfig{
+		Store: middleware.NewRateLimiterMemoryStoreWithConfig(middleware.RateLimiterMemoryStoreConfig{
+			Rate:      rate.Limit(float64(num) / window.Seconds()),
+			Burst:     num,
+			ExpiresIn: window,
+		}),
+		IdentifierExtractor: func(c echo.Context) (string, error) {
+			return clientIP(c, sec.TrustedProxyHeader), nil
+		},
+		DenyHandler: func(c echo.Context, id string, err error) error {
+			c.Response().Header().Set("Retry-After", retry)
+			return echo.NewHTTPError(http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
+		},
+	})}
+}
+
+// clientIP returns the IP of the client making the request. If a trusted proxy header
+// is configured, the IP is taken from it. As proxies append to X-Forwarded-For style
+// headers, the last entry is the one recorded by the trusted proxy. The header is
+// ignored if it's absent so that direct requests are still keyed by their IP.
+func clientIP(c echo.Context, proxyHeader string) string {
+	if proxyHeader != "" {
+		if h := c.Request().Header.Get(proxyHeader); h != "" {
+			ips := strings.Split(h, ",")
+			if ip := strings.TrimSpace(ips[len(ips)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	ip, _, err := net.SplitHostPort(c.Request().RemoteAddr)
+	if err != nil {
+		return c.Request().RemoteAddr
+	}
+	return ip
+}
+
 // noIndex adds the HTTP header requesting robots to not crawl the page.
 func noIndex(next echo.HandlerFunc, params ...string) echo.HandlerFunc {
 	return func(c echo.Context) error {
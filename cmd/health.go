@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/media"
+	"github.com/knadh/listmonk/internal/messenger/email"
+	"github.com/labstack/echo/v4"
+)
+
+// depCheck represents the result of a dependency check in the readiness check.
+type depCheck struct {
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error"`
+	Duration int64  `json:"duration_ms"`
+}
+
+type readyResp struct {
+	Healthy bool                `json:"healthy"`
+	Checks  map[string]depCheck `json:"checks"`
+}
+
+// handleReadyCheck is the readiness check that checks the DB connection, the
+// media store, and that at least one SMTP server is in the rotation. It returns
+// a 503 if any of them are down. Unlike the /health liveness check, it
+// touches the dependencies.
+func handleReadyCheck(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+
+		checks = map[string]func(context.Context) error{
+			"db": app.db.PingContext,
+		}
+	)
+
+	if m, ok := app.media.(media.Checker); ok {
+		checks["media"] = m.Check
+	}
+
+	if e, ok := app.messengers[emailMsgr].(*email.Emailer); ok {
+		checks["smtp"] = func(context.Context) error {
+			return checkSMTPHealth(e.Health())
+		}
+	}
+
+	var (
+		out = readyResp{Healthy: true, Checks: make(map[string]depCheck, len(checks))}
+		mut sync.Mutex
+		wg  sync.WaitGroup
+	)
+	for name, fn := range checks {
+		wg.Add(1)
+		go func(name string, fn func(context.Context) error) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(c.Request().Context(), app.constants.HealthCheckTimeout)
+			defer cancel()
+
+			var (
+				start = time.Now()
+				err   = runCheck(ctx, fn)
+				res   = depCheck{Healthy: err == nil, Duration: time.Since(start).Milliseconds()}
+			)
+			if err != nil {
+				res.Error = err.Error()
+			}
+
+			mut.Lock()
+			out.Checks[name] = res
+			if err != nil {
+				out.Healthy = false
+			}
+			mut.Unlock()
+		}(name, fn)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	if !out.Healthy {
+		status = http.StatusServiceUnavailable
+	}
+
+	return c.JSON(status, okResp{out})
+}
+
+// runCheck runs a dependency check and returns the context's error if it
+// doesn't return before the context is done.
+func runCheck(ctx context.Context, fn func(context.Context) error) error {
+	ch := make(chan error, 1)
+	go func() {
+		ch <- fn(ctx)
+	}()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// checkSMTPHealth returns an error if none of the SMTP servers are in the rotation.
+func checkSMTPHealth(servers []email.ServerHealth) error {
+	if len(servers) == 0 {
+		return nil
+	}
+
+	for _, s := range servers {
+		if s.Healthy {
+			return nil
+		}
+	}
+
+	return errors.New("none of the SMTP servers are healthy")
+}
@@ -3,10 +3,13 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"html/template"
 	"net/http"
 	"sort"
+	"sync"
 
 	"github.com/knadh/listmonk/internal/i18n"
+	"github.com/knadh/listmonk/models"
 	"github.com/knadh/stuffbin"
 	"github.com/labstack/echo/v4"
 )
@@ -21,6 +24,111 @@ type i18nLangRaw struct {
 	Name string `json:"_.name"`
 }
 
+// The subscriber attribute that holds a subscriber's preferred language.
+const subLangAttrib = "language"
+
+// langs is a cache of the i18n languages, besides the instance's language,
+// that public pages and e-mails are rendered in for subscribers. Languages are
+// loaded on their first use.
+type langs struct {
+	def  *i18n.I18n
+	lang string
+	fs   stuffbin.FileSystem
+
+	m    map[string]*i18n.I18n
+	tpls map[*i18n.I18n]*template.Template
+	mu   sync.Mutex
+}
+
+// get returns the given language, or the instance's language if it's empty
+// or can't be loaded.
+func (l *langs) get(lang string) *i18n.I18n {
+	if lang == "" || lang == l.lang || len(lang) > 6 || reLangCode.MatchString(lang) {
+		return l.def
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if i, ok := l.m[lang]; ok {
+		return i
+	}
+
+	// Unknown languages fall back to the instance's language and are cached
+	// as such so that they aren't looked up again.
+	i, _, err := getI18nLang(lang, l.fs)
+	if err != nil {
+		lo.Printf("error loading subscriber language: %v", err)
+		i = l.def
+	}
+	l.m[lang] = i
+
+	return i
+}
+
+// notifTpls returns the e-mail notification templates compiled with the given language.
+func (l *langs) notifTpls(i *i18n.I18n, cs *constants) (*template.Template, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if t, ok := l.tpls[i]; ok {
+		return t, nil
+	}
+
+	t, err := stuffbin.ParseTemplatesGlob(initTplFuncs(i, cs), l.fs, "/static/email-templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	l.tpls[i] = t
+
+	return t, nil
+}
+
+// subscriberI18n returns the language to render a subscriber's pages and e-mails in:
+// the subscriber's language attribute, or the language of the first of the given lists
+// that has one, and the instance's language otherwise.
+func (app *App) subscriberI18n(attribs models.JSON, lists []models.List) *i18n.I18n {
+	if lang, ok := attribs[subLangAttrib].(string); ok && lang != "" {
+		return app.langs.get(lang)
+	}
+
+	for _, l := range lists {
+		if l.Language != "" {
+			return app.langs.get(l.Language)
+		}
+	}
+
+	return app.i18n
+}
+
+// setSubscriberI18n sets the subscriber's language on the request for the public
+// templates to be rendered in and returns it.
+func setSubscriberI18n(c echo.Context, sub models.Subscriber) *i18n.I18n {
+	var (
+		app   = c.Get("app").(*App)
+		lists []models.List
+	)
+	if len(sub.Lists) > 0 {
+		if err := sub.Lists.Unmarshal(&lists); err != nil {
+			app.log.Printf("error unmarshalling subscriber lists: %v", err)
+		}
+	}
+
+	// Lists that the subscriber has unsubscribed from don't count.
+	n := 0
+	for _, l := range lists {
+		if l.SubscriptionStatus != models.SubscriptionStatusUnsubscribed {
+			lists[n] = l
+			n++
+		}
+	}
+
+	i := app.subscriberI18n(sub.Attribs, lists[:n])
+	c.Set("i18n", i)
+
+	return i
+}
+
 // handleGetI18nLang returns the JSON language pack given the language code.
 func handleGetI18nLang(c echo.Context) error {
 	app := c.Get("app").(*App)
@@ -5,6 +5,7 @@ import (
 	"io"
 	"os"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/knadh/listmonk/internal/subimporter"
@@ -29,6 +30,11 @@ func handleImportSubscribers(c echo.Context) error {
 			app.i18n.Ts("import.invalidParams", "error", err.Error()))
 	}
 
+	if err := subimporter.ValidateMapping(opt.Mapping); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("import.invalidParams", "error", err.Error()))
+	}
+
 	// Validate mode.
 	if opt.Mode != subimporter.ModeSubscribe && opt.Mode != subimporter.ModeBlocklist {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.invalidMode"))
@@ -107,6 +113,79 @@ func handleImportSubscribers(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{app.importer.GetStats()})
 }
 
+// handleImportRemoteSubscribers handles the importing of a list and its subscribers
+// from another listmonk instance via its API. The list is created with the source
+// list's UUID if it doesn't exist already. Importing a list again resumes the
+// last import of it that was interrupted.
+func handleImportRemoteSubscribers(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	// Is an import already running?
+	if app.importer.GetStats().Status == subimporter.StatusImporting {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.alreadyRunning"))
+	}
+
+	var req struct {
+		subimporter.RemoteOpt
+		Overwrite bool `json:"overwrite"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("import.invalidParams", "error", err.Error()))
+	}
+
+	if req.SubStatus != "" &&
+		req.SubStatus != models.SubscriptionStatusUnconfirmed &&
+		req.SubStatus != models.SubscriptionStatusConfirmed {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("import.invalidSubStatus"))
+	}
+
+	src, err := subimporter.NewRemote(req.RemoteOpt)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("import.invalidParams", "error", err.Error()))
+	}
+
+	srcList, err := src.GetList()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("import.errorStarting", "error", err.Error()))
+	}
+
+	// Create the list if it hasn't been imported already.
+	list, err := app.core.GetList(0, srcList.UUID)
+	if err != nil {
+		list, err = app.core.CreateList(models.List{
+			UUID:        srcList.UUID,
+			Name:        srcList.Name,
+			Type:        srcList.Type,
+			Optin:       srcList.Optin,
+			Tags:        srcList.Tags,
+			Description: srcList.Description,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Start the importer session.
+	impSess, err := app.importer.NewSession(subimporter.SessionOpt{
+		Filename:  src.Name(),
+		Mode:      subimporter.ModeSubscribe,
+		SubStatus: models.SubscriptionStatusUnconfirmed,
+		Overwrite: req.Overwrite,
+		ListIDs:   []int{list.ID},
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("import.errorStarting", "error", err.Error()))
+	}
+	go impSess.Start()
+	go impSess.LoadRemote(src)
+
+	return c.JSON(http.StatusOK, okResp{app.importer.GetStats()})
+}
+
 // handleGetImportSubscribers returns import statistics.
 func handleGetImportSubscribers(c echo.Context) error {
 	var (
@@ -124,9 +203,14 @@ func handleGetImportSubscriberStats(c echo.Context) error {
 
 // handleStopImportSubscribers sends a stop signal to the importer.
 // If there's an ongoing import, it'll be stopped, and if an import
-// is finished, it's state is cleared.
+// is finished, it's state is cleared. With ?rollback=true, the subscribers
+// created by the stopped import are deleted. Otherwise, the records imported
+// so far are kept and re-importing the same file resumes from where it stopped.
 func handleStopImportSubscribers(c echo.Context) error {
-	app := c.Get("app").(*App)
-	app.importer.Stop()
+	var (
+		app         = c.Get("app").(*App)
+		rollback, _ = strconv.ParseBool(c.QueryParam("rollback"))
+	)
+	app.importer.Stop(rollback)
 	return c.JSON(http.StatusOK, okResp{app.importer.GetStats()})
 }
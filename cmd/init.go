@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 	"os"
 	"path"
@@ -33,17 +36,21 @@ import (
 	"github.com/knadh/listmonk/internal/captcha"
 	"github.com/knadh/listmonk/internal/core"
 	"github.com/knadh/listmonk/internal/i18n"
+	"github.com/knadh/listmonk/internal/logger"
 	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/internal/media"
 	"github.com/knadh/listmonk/internal/media/providers/filesystem"
 	"github.com/knadh/listmonk/internal/media/providers/s3"
 	"github.com/knadh/listmonk/internal/messenger/email"
 	"github.com/knadh/listmonk/internal/messenger/postback"
+	"github.com/knadh/listmonk/internal/messenger/sms"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/webhook"
 	"github.com/knadh/listmonk/models"
 	"github.com/knadh/stuffbin"
 	"github.com/labstack/echo/v4"
 	"github.com/lib/pq"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	flag "github.com/spf13/pflag"
 )
 
@@ -52,6 +59,65 @@ const (
 
 	// Root URI of the admin frontend.
 	adminRoot = "/admin"
+
+	// Interval at which unconfirmed subscriptions are scanned for opt-in reminders.
+	optinReminderScanInterval = time.Hour
+
+	// Interval at which archived subscribers past the retention period are purged.
+	archivePurgeInterval = time.Hour
+
+	// Interval at which stale unconfirmed and unsubscribed subscribers are purged,
+	// and the pause between the batches of a purge.
+	stalePurgeInterval  = time.Hour
+	stalePurgeBatchWait = time.Second
+
+	// Interval at which subscriber engagement scores are recomputed.
+	engagementScoreInterval = time.Hour
+
+	// Default timeout of each dependency check in the readiness check.
+	defaultHealthCheckTimeout = time.Second * 3
+
+	// Time given to close resources on shutting down in addition to the
+	// shutdown grace period for sending queued campaign messages.
+	shutdownTimeout = time.Second * 5
+
+	// Default time given to send the queued campaign messages on shutting down.
+	defaultShutdownGracePeriod = time.Second * 30
+
+	// Default time for which the responses of transactional API requests with
+	// idempotency keys are stored, and the interval at which expired keys are purged.
+	defaultTxIdempotencyTTL    = time.Hour * 24
+	txIdempotencyPurgeInterval = time.Hour
+
+	// Default time for which the delivery records (recipients) of campaigns that have
+	// ended are kept for excluding them from other campaigns, the interval at which
+	// older records are purged, and the pause between the batches of a purge.
+	defaultCampaignDeliveryRetention = time.Hour * 24 * 90
+	deliveryPurgeInterval            = time.Hour
+	deliveryPurgeBatchWait           = time.Second
+
+	// Interval at which bounce rules are evaluated against subscriber bounces.
+	bounceRulesInterval = time.Minute * 10
+
+	// Interval at which subscriptions that weren't re-confirmed by their deadline are unsubscribed.
+	reconfirmSweepInterval = time.Minute * 10
+
+	// Intervals at which the cached subscriber counts of lists with changed subscriptions
+	// are recomputed, and at which the counts of all lists are recomputed.
+	listCountsRefreshInterval     = time.Second * 5
+	listCountsFullRefreshInterval = time.Hour
+
+	// Interval at which recurring campaigns are scanned for due runs and the max
+	// number of missed runs that are caught up with the "all" catch-up policy.
+	recurringCampaignScanInterval = time.Minute
+	recurringCampaignMaxCatchup   = 50
+
+	// Catch-up policies for recurring campaign runs that were missed, eg: when the
+	// instance was down. "skip" skips missed runs, "once" runs the latest missed
+	// run once, and "all" runs every missed run.
+	recurringCatchupSkip = "skip"
+	recurringCatchupOnce = "once"
+	recurringCatchupAll  = "all"
 )
 
 // constants contains static, constant config values required by the app.
@@ -75,14 +141,81 @@ type constants struct {
 		AllowExport        bool            `koanf:"allow_export"`
 		AllowWipe          bool            `koanf:"allow_wipe"`
 		RecordOptinIP      bool            `koanf:"record_optin_ip"`
+		TrackViews         bool            `koanf:"track_views"`
+		PrivacyMode        bool            `koanf:"privacy_mode"`
 		Exportable         map[string]bool `koanf:"-"`
 		DomainBlocklist    []string        `koanf:"-"`
+		DomainAllowlist    []string        `koanf:"-"`
+		BlockDisposable    bool            `koanf:"block_disposable_domains"`
+
+		// Whether the unsubscribe link shows a confirmation page or unsubscribes
+		// immediately, and whether it unsubscribes from the campaign's lists or all lists.
+		UnsubConfirm  bool `koanf:"unsubscribe_confirm"`
+		UnsubAllLists bool `koanf:"unsubscribe_all_lists"`
 	} `koanf:"privacy"`
 	Security struct {
 		EnableCaptcha bool   `koanf:"enable_captcha"`
 		CaptchaKey    string `koanf:"captcha_key"`
 		CaptchaSecret string `koanf:"captcha_secret"`
+
+		// CAPTCHA provider (hcaptcha, turnstile). In the strict mode, submissions are
+		// rejected if the provider can't be reached, and accepted otherwise.
+		CaptchaProvider string `koanf:"captcha_provider"`
+		CaptchaStrict   bool   `koanf:"captcha_strict"`
+
+		// Per-IP rate limit (requests per window) on the public subscription endpoints.
+		PublicRateLimitEnabled  bool          `koanf:"public_rate_limit_enabled"`
+		PublicRateLimitRequests int           `koanf:"public_rate_limit_requests"`
+		PublicRateLimitWindow   time.Duration `koanf:"public_rate_limit_window"`
+
+		// Optional header (eg: X-Forwarded-For) set by a trusted reverse proxy
+		// that carries the client's IP.
+		TrustedProxyHeader string `koanf:"trusted_proxy_header"`
 	} `koanf:"security"`
+
+	OptinReminderInterval time.Duration `koanf:"optin_reminder_interval"`
+	OptinReminderMax      int           `koanf:"optin_reminder_max"`
+	OptinReminderPurge    bool          `koanf:"optin_reminder_purge"`
+
+	ArchivedSubscriberRetention time.Duration `koanf:"archived_subscriber_retention"`
+
+	UnconfirmedSubscriberRetention  time.Duration `koanf:"unconfirmed_subscriber_retention"`
+	UnsubscribedSubscriberRetention time.Duration `koanf:"unsubscribed_subscriber_retention"`
+
+	// Subscriber engagement score formula.
+	EngagementOpenWeight  float64       `koanf:"engagement_open_weight"`
+	EngagementClickWeight float64       `koanf:"engagement_click_weight"`
+	EngagementHalfLife    time.Duration `koanf:"engagement_half_life"`
+
+	// Max number of recipients of a triggered campaign run.
+	CampaignTriggerMaxRecipients int `koanf:"campaign_trigger_max_recipients"`
+
+	// Catch-up policy for missed recurring campaign runs: skip, once, all.
+	RecurringCampaignCatchup string `koanf:"recurring_campaign_catchup"`
+
+	// Allow custom message headers to override models.ProtectedHeaders.
+	AllowProtectedHeaders bool `koanf:"allow_protected_headers"`
+
+	// Timeout of each dependency check in the readiness check.
+	HealthCheckTimeout time.Duration `koanf:"health_check_timeout"`
+
+	// Time given to send the queued campaign messages on shutting down.
+	ShutdownGracePeriod time.Duration `koanf:"shutdown_grace_period"`
+
+	// Time for which the responses of transactional API requests with
+	// idempotency keys are stored for replaying.
+	TxIdempotencyTTL time.Duration `koanf:"tx_idempotency_ttl"`
+
+	// Time for which the delivery records of campaigns that have ended are kept.
+	CampaignDeliveryRetention time.Duration `koanf:"campaign_delivery_retention"`
+
+	// Catch-all address that all messages are sent to in the sandbox mode.
+	// Empty if the sandbox mode is off.
+	SandboxEmail string `koanf:"-"`
+
+	// Compiled app.subscriber_attribs_schema (nil if there's no schema).
+	AttribsSchema *jsonschema.Schema `koanf:"-"`
+
 	AdminUsername []byte `koanf:"admin_username"`
 	AdminPassword []byte `koanf:"admin_password"`
 
@@ -95,6 +228,13 @@ type constants struct {
 
 	UnsubURL     string
 	LinkTrackURL string
+
+	// One-click (RFC 8058) unsubscribe URL in the List-Unsubscribe header and the
+	// instant unsubscribe URL in messages that are signed with UnsubSecret.
+	OneClickUnsubURL string
+	SignedUnsubURL   string
+	UnsubSecret      []byte
+
 	ViewTrackURL string
 	OptinURL     string
 	MessageURL   string
@@ -104,12 +244,16 @@ type constants struct {
 	MediaUpload struct {
 		Provider   string
 		Extensions []string
+
+		// Widths (px) of the resized variants generated for uploaded images.
+		ImageVariantWidths []int
 	}
 
-	BounceWebhooksEnabled bool
-	BounceSESEnabled      bool
-	BounceSendgridEnabled bool
-	BouncePostmarkEnabled bool
+	BounceWebhooksEnabled  bool
+	BounceSESEnabled       bool
+	BounceSendgridEnabled  bool
+	BouncePostmarkEnabled  bool
+	BounceSparkPostEnabled bool
 }
 
 type notifTpls struct {
@@ -137,6 +281,7 @@ func initFlags() {
 	f.String("i18n-dir", "", "(optional) path to directory with i18n language files")
 	f.Bool("yes", false, "assume 'yes' to prompts during --install/upgrade")
 	f.Bool("passive", false, "run in passive mode where campaigns are not processed")
+	f.Bool("sandbox", false, "allow the sandbox mode (app.sandbox_enabled) where all messages are sent to a catch-all address")
 	if err := f.Parse(os.Args[1:]); err != nil {
 		lo.Fatalf("error loading flags: %v", err)
 	}
@@ -146,6 +291,40 @@ func initFlags() {
 	}
 }
 
+// initLogger initializes the leveled logger in the configured format (text or json)
+// and routes the standard logger through it. The log viewer in the admin always
+// receives text lines.
+func initLogger() *logger.Logger {
+	format := ko.String("app.log_format")
+	if format == "" {
+		format = logger.FormatText
+	}
+	if format != logger.FormatText && format != logger.FormatJSON {
+		lo.Fatalf("unknown app.log_format: %s", format)
+	}
+
+	lvl := logger.LevelInfo
+	if s := ko.String("app.log_level"); s != "" {
+		l, err := logger.ParseLevel(s)
+		if err != nil {
+			lo.Fatalf("error reading app.log_level: %v", err)
+		}
+		lvl = l
+	}
+
+	l := logger.New(logger.Opt{
+		Format:  format,
+		Level:   lvl,
+		Out:     os.Stdout,
+		TextOut: io.MultiWriter(bufLog, evStream.ErrWriter()),
+	})
+
+	lo.SetFlags(l.StdFlags())
+	lo.SetOutput(l.Writer())
+
+	return l
+}
+
 // initConfigFiles loads the given config files into the koanf instance.
 func initConfigFiles(files []string, ko *koanf.Koanf) {
 	for _, f := range files {
@@ -337,6 +516,14 @@ func prepareQueries(qMap goyesql.Queries, db *sqlx.DB, ko *koanf.Koanf) *models.
 		Query: fmt.Sprintf(qMap[countQuery].Query, "link_clicks"),
 		Tags:  map[string]string{"name": "get-campaign-click-counts"},
 	}
+	qMap["get-campaign-view-series"] = &goyesql.Query{
+		Query: fmt.Sprintf(qMap["get-campaign-analytics-series"].Query, "campaign_views"),
+		Tags:  map[string]string{"name": "get-campaign-view-series"},
+	}
+	qMap["get-campaign-click-series"] = &goyesql.Query{
+		Query: fmt.Sprintf(qMap["get-campaign-analytics-series"].Query, "link_clicks"),
+		Tags:  map[string]string{"name": "get-campaign-click-series"},
+	}
 	qMap["get-campaign-link-counts"].Query = fmt.Sprintf(qMap["get-campaign-link-counts"].Query, linkSel)
 
 	// Scan and prepare all queries.
@@ -390,16 +577,43 @@ func initConstants() *constants {
 	}
 
 	c.RootURL = strings.TrimRight(c.RootURL, "/")
+	if c.HealthCheckTimeout < time.Millisecond*100 {
+		c.HealthCheckTimeout = defaultHealthCheckTimeout
+	}
+	if c.ShutdownGracePeriod <= 0 {
+		c.ShutdownGracePeriod = defaultShutdownGracePeriod
+	}
+	if c.TxIdempotencyTTL < time.Minute {
+		c.TxIdempotencyTTL = defaultTxIdempotencyTTL
+	}
+	if c.CampaignDeliveryRetention < time.Hour {
+		c.CampaignDeliveryRetention = defaultCampaignDeliveryRetention
+	}
 	c.Lang = ko.String("app.lang")
 	c.Privacy.Exportable = maps.StringSliceToLookupMap(ko.Strings("privacy.exportable"))
 	c.MediaUpload.Provider = ko.String("upload.provider")
 	c.MediaUpload.Extensions = ko.Strings("upload.extensions")
+	c.MediaUpload.ImageVariantWidths = ko.Ints("upload.image_variant_widths")
 	c.Privacy.DomainBlocklist = ko.Strings("privacy.domain_blocklist")
+	c.Privacy.DomainAllowlist = ko.Strings("privacy.domain_allowlist")
+
+	// Compile the optional subscriber attribute schema once and cache it.
+	sc, err := compileAttribsSchema(ko.String("app.subscriber_attribs_schema"))
+	if err != nil {
+		lo.Fatalf("error compiling app.subscriber_attribs_schema: %v", err)
+	}
+	c.AttribsSchema = sc
 
 	// Static URLS.
 	// url.com/subscription/{campaign_uuid}/{subscriber_uuid}
 	c.UnsubURL = fmt.Sprintf("%s/subscription/%%s/%%s", c.RootURL)
 
+	// url.com/subscription/one-click/{campaign_uuid}/{subscriber_uuid}?sig={signature}
+	c.OneClickUnsubURL = fmt.Sprintf("%s/subscription/one-click/%%s/%%s?sig=%%s", c.RootURL)
+
+	// url.com/subscription/{campaign_uuid}/{subscriber_uuid}?sig={signature}
+	c.SignedUnsubURL = fmt.Sprintf("%s/subscription/%%s/%%s?sig=%%s", c.RootURL)
+
 	// url.com/subscription/optin/{subscriber_uuid}
 	c.OptinURL = fmt.Sprintf("%s/subscription/optin/%%s?%%s", c.RootURL)
 
@@ -419,6 +633,18 @@ func initConstants() *constants {
 	c.BounceSESEnabled = ko.Bool("bounce.ses_enabled")
 	c.BounceSendgridEnabled = ko.Bool("bounce.sendgrid_enabled")
 	c.BouncePostmarkEnabled = ko.Bool("bounce.postmark.enabled")
+	c.BounceSparkPostEnabled = ko.Bool("bounce.sparkpost.enabled")
+
+	// The sandbox setting is only honoured if listmonk is started with --sandbox
+	// so that a settings change can't turn it on accidentally in production.
+	if ko.Bool("app.sandbox_enabled") {
+		if ko.Bool("sandbox") {
+			c.SandboxEmail = ko.String("app.sandbox_email")
+			lo.Printf("WARNING: running in sandbox mode. All messages will be sent to %s", c.SandboxEmail)
+		} else {
+			lo.Println("WARNING: app.sandbox_enabled is ignored as listmonk wasn't started with --sandbox")
+		}
+	}
 
 	b := md5.Sum([]byte(time.Now().String()))
 	c.AssetVersion = fmt.Sprintf("%x", b)[0:10]
@@ -459,6 +685,64 @@ func initCampaignManager(q *models.Queries, cs *constants, app *App) *manager.Ma
 		lo.Println("running in passive mode. won't process campaigns.")
 	}
 
+	sendWindowLoc, err := time.LoadLocation(ko.String("app.send_window_timezone"))
+	if err != nil {
+		lo.Printf("invalid app.send_window_timezone. using UTC: %v", err)
+		sendWindowLoc = time.UTC
+	}
+
+	oneClickUnsubURL := func(campUUID, subUUID string) string {
+		return fmt.Sprintf(cs.OneClickUnsubURL, campUUID, subUUID, signUnsubURL(cs.UnsubSecret, campUUID, subUUID))
+	}
+
+	// Without the confirmation, the unsubscribe links in messages are signed
+	// so that they unsubscribe immediately.
+	var signedUnsubURL func(campUUID, subUUID string) string
+	if !cs.Privacy.UnsubConfirm {
+		signedUnsubURL = func(campUUID, subUUID string) string {
+			return fmt.Sprintf(cs.SignedUnsubURL, campUUID, subUUID, signUnsubURL(cs.UnsubSecret, campUUID, subUUID))
+		}
+	}
+
+	// Notify the campaign's end to the webhooks subscribed to campaign.ended and the
+	// campaign's own webhook and e-mails. The global notification e-mails are sent
+	// campaign status notifications by the manager.
+	onCampaignEnd := func(c *models.Campaign, e models.CampaignEnd) {
+		if app.webhooks != nil {
+			app.webhooks.Emit(models.EventCampaignEnded, e, c.NotifyWebhookID.Int)
+		}
+
+		var to []string
+		for _, em := range c.NotifyEmails {
+			if !strSliceContains(em, cs.NotifyEmails) {
+				to = append(to, em)
+			}
+		}
+		if len(to) == 0 {
+			return
+		}
+
+		subject := fmt.Sprintf("%s: %s", strings.Title(e.Status), c.Name)
+		_ = app.sendNotification(to, subject, notifTplCampaign, map[string]interface{}{
+			"ID":       c.ID,
+			"Name":     c.Name,
+			"Status":   e.Status,
+			"Sent":     e.Sent,
+			"ToSend":   e.ToSend,
+			"Failed":   e.Failed,
+			"Duration": time.Duration(e.Duration * float64(time.Second)).Round(time.Second).String(),
+			"Reason":   "",
+		})
+	}
+
+	// Default UTM params for campaign links.
+	utm := models.CampaignUTM{
+		Source:   ko.String("app.utm_source"),
+		Medium:   ko.String("app.utm_medium"),
+		Campaign: ko.String("app.utm_campaign"),
+		Content:  ko.String("app.utm_content"),
+	}
+
 	return manager.New(manager.Config{
 		BatchSize:             ko.Int("app.batch_size"),
 		Concurrency:           ko.Int("app.concurrency"),
@@ -474,18 +758,60 @@ func initCampaignManager(q *models.Queries, cs *constants, app *App) *manager.Ma
 		ArchiveURL:            cs.ArchiveURL,
 		RootURL:               cs.RootURL,
 		UnsubHeader:           ko.Bool("privacy.unsubscribe_header"),
+		InlineCSS:             ko.Bool("app.inline_css"),
+		TrackViews:            ko.Bool("privacy.track_views"),
+		DomainRules:           app.domains,
+		OneClickUnsubURL:      oneClickUnsubURL,
+		SignedUnsubURL:        signedUnsubURL,
+		OnCampaignEnd:         onCampaignEnd,
+		MediaURLs:             app.media,
 		SlidingWindow:         ko.Bool("app.message_sliding_window"),
 		SlidingWindowDuration: ko.Duration("app.message_sliding_window_duration"),
 		SlidingWindowRate:     ko.Int("app.message_sliding_window_rate"),
+		MaxSubscriberMessages: ko.Int("app.max_subscriber_messages"),
+		MessageThrottle:       ko.Int("app.message_throttle"),
+		VariantSampleSize:     ko.Int("app.campaign_variant_sample_size"),
+		VariantSampleWindow:   ko.Duration("app.campaign_variant_sample_window"),
+		SendWindowLocation:    sendWindowLoc,
+		UTM:                   utm,
 		ScanInterval:          time.Second * 5,
 		ScanCampaigns:         !ko.Bool("passive"),
-	}, newManagerStore(q, app.core, app.media), campNotifCB, app.i18n, lo)
+		SandboxEmail:          cs.SandboxEmail,
+	}, newManagerStore(q, app.core, app.media), campNotifCB, app.i18n, logs.With("component", "manager"))
+}
+
+// initUnsubSecret returns the secret with which the one-click unsubscribe URLs are
+// signed. On the first run, a random secret is generated and saved to the settings.
+func initUnsubSecret(q *models.Queries) []byte {
+	if s := ko.String("security.unsubscribe_secret"); s != "" {
+		return []byte(s)
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		lo.Fatalf("error generating unsubscribe secret: %v", err)
+	}
+	secret := hex.EncodeToString(b)
+
+	j, _ := json.Marshal(map[string]string{"security.unsubscribe_secret": secret})
+	if _, err := q.UpdateSettings.Exec(j); err != nil {
+		lo.Fatalf("error saving unsubscribe secret: %v", err)
+	}
+
+	return []byte(secret)
 }
 
 func initTxTemplates(m *manager.Manager, app *App) {
+	if err := loadTxTemplates(m, app); err != nil {
+		lo.Fatalf("error loading transactional templates: %v", err)
+	}
+}
+
+// loadTxTemplates compiles and caches all transactional templates in the manager.
+func loadTxTemplates(m *manager.Manager, app *App) error {
 	tpls, err := app.core.GetTemplates(models.TemplateTypeTx, false)
 	if err != nil {
-		lo.Fatalf("error loading transactional templates: %v", err)
+		return err
 	}
 
 	for _, t := range tpls {
@@ -496,16 +822,59 @@ func initTxTemplates(m *manager.Manager, app *App) {
 		}
 		m.CacheTpl(tpl.ID, &tpl)
 	}
+
+	return nil
+}
+
+// initPartials loads all template partials from the DB into the global
+// partial set that's used when compiling templates.
+func initPartials(app *App) {
+	if err := loadPartials(app); err != nil {
+		lo.Fatalf("error loading template partials: %v", err)
+	}
+}
+
+// loadPartials loads all template partials from the DB and sets them
+// as the global partial set.
+func loadPartials(app *App) error {
+	p, err := getPartials(app)
+	if err != nil {
+		return err
+	}
+
+	return models.SetPartials(p)
+}
+
+// getPartials returns all template partials from the DB as a name => body map.
+func getPartials(app *App) (map[string]string, error) {
+	tpls, err := app.core.GetTemplates(models.TemplateTypePartial, false)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]string, len(tpls))
+	for _, t := range tpls {
+		out[t.Name] = t.Body
+	}
+
+	return out, nil
 }
 
 // initImporter initializes the bulk subscriber importer.
 func initImporter(q *models.Queries, db *sqlx.DB, core *core.Core, app *App) *subimporter.Importer {
 	return subimporter.New(
 		subimporter.Options{
-			DomainBlocklist:    app.constants.Privacy.DomainBlocklist,
+			DomainRules:        app.domains,
 			UpsertStmt:         q.UpsertSubscriber.Stmt,
 			BlocklistStmt:      q.UpsertBlocklistSubscriber.Stmt,
 			UpdateListDateStmt: q.UpdateListsDate.Stmt,
+			DeleteSubsStmt:     q.DeleteSubscribers.Stmt,
+			AttribsSchema:      app.constants.AttribsSchema,
+
+			GetCheckpointStmt:          q.GetImportCheckpoint.Stmt,
+			UpsertCheckpointStmt:       q.UpsertImportCheckpoint.Stmt,
+			DeleteCheckpointStmt:       q.DeleteImportCheckpoint.Stmt,
+			DeleteStaleCheckpointsStmt: q.DeleteStaleImportCheckpoints.Stmt,
 			NotifCB: func(subject string, data interface{}) error {
 				// Refresh cached subscriber counts and stats.
 				core.RefreshMatViews(true)
@@ -516,6 +885,17 @@ func initImporter(q *models.Queries, db *sqlx.DB, core *core.Core, app *App) *su
 		}, db.DB, app.i18n)
 }
 
+// compileAttribsSchema compiles the given subscriber attribute JSON schema.
+// An empty schema returns nil which disables attribute validation.
+func compileAttribsSchema(schema string) (*jsonschema.Schema, error) {
+	schema = strings.TrimSpace(schema)
+	if schema == "" {
+		return nil, nil
+	}
+
+	return jsonschema.CompileString("subscriber_attribs.json", schema)
+}
+
 // initSMTPMessenger initializes the SMTP messenger.
 func initSMTPMessenger(m *manager.Manager) manager.Messenger {
 	var (
@@ -554,6 +934,18 @@ func initSMTPMessenger(m *manager.Manager) manager.Messenger {
 		lo.Fatalf("error loading e-mail messenger: %v", err)
 	}
 
+	// Load the DKIM signing keys.
+	if ko.Bool("dkim.enabled") {
+		var keys []email.DKIMKey
+		if err := ko.UnmarshalWithConf("dkim.keys", &keys, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading DKIM config: %v", err)
+		}
+		if err := msgr.SetDKIMKeys(keys...); err != nil {
+			lo.Fatalf("error loading DKIM keys: %v", err)
+		}
+		lo.Printf("loaded %d DKIM signing key(s)", len(keys))
+	}
+
 	return msgr
 }
 
@@ -593,6 +985,31 @@ func initPostbackMessengers(m *manager.Manager) []manager.Messenger {
 	return out
 }
 
+// initSMSMessenger initializes the SMS gateway messenger if it's enabled.
+// Messages that the gateway rejects are recorded as hard bounces against the subscribers.
+func initSMSMessenger(app *App) manager.Messenger {
+	if !ko.Bool("sms.enabled") {
+		return nil
+	}
+
+	var o sms.Options
+	if err := ko.UnmarshalWithConf("sms", &o, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+		lo.Fatalf("error reading SMS config: %v", err)
+	}
+
+	m, err := sms.New(o, func(b models.Bounce) {
+		if err := app.core.RecordBounce(b); err != nil {
+			lo.Printf("error recording SMS bounce: %v", err)
+		}
+	})
+	if err != nil {
+		lo.Fatalf("error initializing SMS messenger: %v", err)
+	}
+
+	lo.Printf("loaded SMS messenger: %s", o.Name)
+	return m
+}
+
 // initMediaStore initializes Upload manager with a custom backend.
 func initMediaStore() media.Store {
 	switch provider := ko.String("upload.provider"); provider {
@@ -605,6 +1022,12 @@ func initMediaStore() media.Store {
 			lo.Fatalf("error initializing s3 upload provider %s", err)
 		}
 		lo.Println("media upload provider: s3")
+
+		// Presigned URLs in sent e-mails can't be renewed.
+		if c := up.(*s3.Client); c.Presigned() {
+			lo.Printf("WARNING: S3 media URLs are presigned and the media in sent e-mails will stop loading after %v. "+
+				"Set upload.s3.url_mode to public with a public URL for permanent links", c.Expiry())
+		}
 		return up
 
 	case "filesystem":
@@ -679,6 +1102,15 @@ func initBounceManager(app *App) *bounce.Manager {
 			ko.String("bounce.postmark.username"),
 			ko.String("bounce.postmark.password"),
 		},
+		SparkPost: struct {
+			Enabled  bool
+			Username string
+			Password string
+		}{
+			ko.Bool("bounce.sparkpost.enabled"),
+			ko.String("bounce.sparkpost.username"),
+			ko.String("bounce.sparkpost.password"),
+		},
 		RecordBounceCB: app.core.RecordBounce,
 	}
 
@@ -806,8 +1238,40 @@ func initHTTPServer(app *App) *echo.Echo {
 	return srv
 }
 
-func initCaptcha() *captcha.Captcha {
+// initMetricsServer starts an HTTP server that serves Prometheus metrics on /metrics
+// on a separate address so that it can be bound to an internal interface.
+// It's disabled if the address isn't set.
+func initMetricsServer(app *App) *http.Server {
+	addr := ko.String("app.metrics_address")
+	if addr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleGetMetrics(app))
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * 10,
+	}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil {
+			if errors.Is(err, http.ErrServerClosed) {
+				lo.Println("metrics server shut down")
+			} else {
+				lo.Fatalf("error starting metrics server: %v", err)
+			}
+		}
+	}()
+
+	lo.Printf("serving metrics on %s/metrics", addr)
+	return srv
+}
+
+func initCaptcha() captcha.Verifier {
 	return captcha.New(captcha.Opt{
+		Provider:      ko.String("security.captcha_provider"),
 		CaptchaSecret: ko.String("security.captcha_secret"),
 	})
 }
@@ -828,7 +1292,308 @@ func initCron(core *core.Core) {
 	lo.Printf("IMPORTANT: database slow query caching is enabled. Aggregate numbers and stats will not be realtime. Next refresh at: %v", c.Entries()[0].Next)
 }
 
-func awaitReload(sigChan chan os.Signal, closerWait chan bool, closer func()) chan bool {
+// initOptinReminders starts a background worker that periodically re-sends opt-in
+// confirmation e-mails to unconfirmed double opt-in subscriptions and optionally
+// deletes the ones that remain unconfirmed after the final reminder.
+func initOptinReminders(app *App) {
+	var (
+		interval = app.constants.OptinReminderInterval
+		max      = app.constants.OptinReminderMax
+	)
+
+	if interval < time.Hour {
+		lo.Printf("app.optin_reminder_interval should be at least 1h. Opt-in reminders are disabled.")
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(optinReminderScanInterval)
+		defer t.Stop()
+
+		for range t.C {
+			before := time.Now().Add(-interval)
+
+			n, err := app.core.SendOptinReminders(before, max, app.constants.DBBatchSize)
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				lo.Printf("sent opt-in reminders to %d subscriber(s)", n)
+			}
+
+			if app.constants.OptinReminderPurge {
+				n, err := app.core.DeleteExpiredOptinSubscriptions(before, max)
+				if err != nil {
+					continue
+				}
+				if n > 0 {
+					lo.Printf("deleted %d expired unconfirmed subscription(s)", n)
+				}
+			}
+		}
+	}()
+}
+
+// initArchivePurge starts a background worker that periodically and permanently
+// deletes subscribers who were archived (soft deleted) before the retention period.
+func initArchivePurge(app *App) {
+	ret := app.constants.ArchivedSubscriberRetention
+	if ret < time.Hour {
+		lo.Printf("app.archived_subscriber_retention should be at least 1h. Archived subscribers will not be purged.")
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(archivePurgeInterval)
+		defer t.Stop()
+
+		for range t.C {
+			n, err := app.core.DeleteArchivedSubscribers(time.Now().Add(-ret))
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				lo.Printf("purged %d archived subscriber(s)", n)
+			}
+		}
+	}()
+}
+
+// initTxIdempotencyPurge starts a background worker that periodically deletes the
+// idempotency keys of transactional API requests that have expired.
+func initTxIdempotencyPurge(app *App) {
+	go func() {
+		t := time.NewTicker(txIdempotencyPurgeInterval)
+		defer t.Stop()
+
+		for range t.C {
+			// Errors are logged by core and the purge is retried on the next tick.
+			app.core.DeleteExpiredTxIdempotencyKeys(time.Now().Add(-app.constants.TxIdempotencyTTL))
+		}
+	}()
+}
+
+// initCampaignDeliveryPurge starts a background worker that periodically deletes the
+// delivery records of campaigns that ended before the retention period.
+func initCampaignDeliveryPurge(app *App) {
+	ret := app.constants.CampaignDeliveryRetention
+
+	go func() {
+		t := time.NewTicker(deliveryPurgeInterval)
+		defer t.Stop()
+
+		for range t.C {
+			n, err := app.core.DeleteCampaignDeliveries(time.Now().Add(-ret), app.constants.DBBatchSize, deliveryPurgeBatchWait)
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				lo.Printf("purged %d campaign delivery record(s)", n)
+			}
+		}
+	}()
+}
+
+// initStaleSubscriberPurge starts a background worker that periodically deletes
+// subscribers who have remained unconfirmed or have unsubscribed beyond the retention
+// periods and don't have any other active subscriptions.
+func initStaleSubscriberPurge(app *App) {
+	var (
+		unconf = app.constants.UnconfirmedSubscriberRetention
+		unsub  = app.constants.UnsubscribedSubscriberRetention
+	)
+	if unconf <= 0 && unsub <= 0 {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(stalePurgeInterval)
+		defer t.Stop()
+
+		for range t.C {
+			nUnconf, nUnsub, err := app.core.PurgeStaleSubscribers(unconf, unsub, app.constants.DBBatchSize, stalePurgeBatchWait)
+			if err != nil {
+				continue
+			}
+			if nUnconf > 0 || nUnsub > 0 {
+				lo.Printf("purged %d unconfirmed and %d unsubscribed subscriber(s)", nUnconf, nUnsub)
+			}
+		}
+	}()
+}
+
+// initEngagementScores starts a background worker that periodically recomputes
+// the engagement scores of subscribers from their views and clicks.
+func initEngagementScores(app *App) {
+	var (
+		openW  = app.constants.EngagementOpenWeight
+		clickW = app.constants.EngagementClickWeight
+		hl     = app.constants.EngagementHalfLife
+	)
+	if hl < time.Hour {
+		lo.Printf("app.engagement_half_life should be at least 1h. Engagement scores will not be computed.")
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(engagementScoreInterval)
+		defer t.Stop()
+
+		for range t.C {
+			n, err := app.core.RefreshEngagementScores(openW, clickW, hl, app.constants.DBBatchSize)
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				lo.Printf("updated engagement scores of %d subscriber(s)", n)
+			}
+		}
+	}()
+}
+
+// initListCounts starts a background worker that recomputes the cached subscriber
+// counts of lists whose subscriptions have changed. The counts of all lists are
+// recomputed on start and periodically to correct any drift.
+func initListCounts(app *App) {
+	go func() {
+		if err := app.core.RefreshListCounts(true); err != nil {
+			lo.Printf("error computing list subscriber counts: %v", err)
+		}
+
+		var (
+			t    = time.NewTicker(listCountsRefreshInterval)
+			full = time.NewTicker(listCountsFullRefreshInterval)
+		)
+		defer t.Stop()
+		defer full.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				_ = app.core.RefreshListCounts(false)
+			case <-full.C:
+				_ = app.core.RefreshListCounts(true)
+			}
+		}
+	}()
+}
+
+// initReconfirmations starts a background worker that periodically unsubscribes
+// subscriptions that weren't re-confirmed by their deadline.
+func initReconfirmations(app *App) {
+	go func() {
+		t := time.NewTicker(reconfirmSweepInterval)
+		defer t.Stop()
+
+		for range t.C {
+			n, err := app.core.ExpireReconfirmations()
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				lo.Printf("unsubscribed %d subscription(s) that weren't re-confirmed", n)
+			}
+		}
+	}()
+}
+
+// initBounceRules starts a background worker that periodically evaluates the
+// bounce rules and blocklists or removes subscribers whose bounces exceed them.
+func initBounceRules(app *App) {
+	go func() {
+		t := time.NewTicker(bounceRulesInterval)
+		defer t.Stop()
+
+		for range t.C {
+			n, err := app.core.ProcessBounceRules()
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				lo.Printf("bounce rules acted on %d subscriber(s)", n)
+			}
+		}
+	}()
+}
+
+// initRecurringCampaigns starts a background worker that periodically clones due
+// recurring campaigns into new scheduled campaigns.
+func initRecurringCampaigns(app *App) {
+	go func() {
+		t := time.NewTicker(recurringCampaignScanInterval)
+		defer t.Stop()
+
+		for range t.C {
+			runRecurringCampaigns(app, time.Now())
+		}
+	}()
+}
+
+// runRecurringCampaigns runs all recurring campaigns that are due at the given time.
+// Trigger times are computed by the cron schedule in its time zone (CRON_TZ=) which
+// accounts for DST changes. Runs that were missed are handled as per the catch-up policy.
+func runRecurringCampaigns(app *App, now time.Time) {
+	camps, err := app.core.GetDueRecurringCampaigns(now)
+	if err != nil {
+		return
+	}
+
+	for _, c := range camps {
+		sched, err := cron.ParseStandard(c.Recurrence.String)
+		if err != nil {
+			lo.Printf("error parsing recurrence of campaign (%s): %v", c.Name, err)
+			continue
+		}
+
+		// Collect the due trigger times. There's more than one if runs were missed.
+		var runs []time.Time
+		for r := c.RecurrenceNextAt.Time; !r.After(now) && len(runs) < recurringCampaignMaxCatchup; r = sched.Next(r) {
+			runs = append(runs, r)
+		}
+
+		if len(runs) > 0 {
+			last := runs[len(runs)-1]
+
+			switch app.constants.RecurringCampaignCatchup {
+			case recurringCatchupAll:
+			case recurringCatchupSkip:
+				// Only run the latest trigger if it's current and not a missed one.
+				runs = nil
+				if now.Sub(last) <= recurringCampaignScanInterval*2 {
+					runs = []time.Time{last}
+				}
+			default:
+				runs = []time.Time{last}
+			}
+		}
+
+		next := sched.Next(now)
+		if len(runs) == 0 {
+			lo.Printf("skipping missed runs of recurring campaign (%s). next run at %s", c.Name, next.Format(time.RFC822Z))
+			_ = app.core.SetRecurringCampaignNextRun(c.ID, next)
+			continue
+		}
+
+		for i, r := range runs {
+			// Advance the next trigger time run by run so that a failure midway
+			// resumes from the failed run.
+			nextAt := next
+			if i < len(runs)-1 {
+				nextAt = runs[i+1]
+			}
+
+			id, err := app.core.RunRecurringCampaign(c.ID, r, nextAt)
+			if err != nil {
+				break
+			}
+			if id > 0 {
+				lo.Printf("created campaign %d from recurring campaign (%s) for %s", id, c.Name, r.Format(time.RFC822Z))
+			}
+		}
+	}
+}
+
+func awaitReload(sigChan chan os.Signal, closerWait chan bool, timeout time.Duration, closer func()) chan bool {
 	// The blocking signal handler that main() waits on.
 	out := make(chan bool)
 
@@ -850,7 +1615,7 @@ func awaitReload(sigChan chan os.Signal, closerWait chan bool, closer func()) ch
 			case <-closerWait:
 				// Wait for the closer to finish.
 				respawn()
-			case <-time.After(time.Second * 3):
+			case <-time.After(timeout):
 				// Or timeout and force close.
 				respawn()
 			}
@@ -900,3 +1665,16 @@ func initTplFuncs(i *i18n.I18n, cs *constants) template.FuncMap {
 
 	return funcs
 }
+
+// initWebhooks initializes the outbound webhook manager and loads the webhooks.
+func initWebhooks(app *App) *webhook.Manager {
+	m := webhook.New(webhook.Opt{}, app.core, app.log)
+
+	hooks, err := app.core.GetWebhooks()
+	if err != nil {
+		lo.Fatalf("error loading webhooks: %v", err)
+	}
+	m.Load(hooks)
+
+	return m
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
@@ -15,14 +17,15 @@ func handleGetLists(c echo.Context) error {
 		app = c.Get("app").(*App)
 		pg  = app.paginator.NewFromURL(c.Request().URL.Query())
 
-		query      = strings.TrimSpace(c.FormValue("query"))
-		tags       = c.QueryParams()["tag"]
-		orderBy    = c.FormValue("order_by")
-		typ        = c.FormValue("type")
-		optin      = c.FormValue("optin")
-		order      = c.FormValue("order")
-		minimal, _ = strconv.ParseBool(c.FormValue("minimal"))
-		listID, _  = strconv.Atoi(c.Param("id"))
+		query       = strings.TrimSpace(c.FormValue("query"))
+		tags        = c.QueryParams()["tag"]
+		orderBy     = c.FormValue("order_by")
+		typ         = c.FormValue("type")
+		optin       = c.FormValue("optin")
+		order       = c.FormValue("order")
+		minimal, _  = strconv.ParseBool(c.FormValue("minimal"))
+		archived, _ = strconv.ParseBool(c.FormValue("archived"))
+		listID, _   = strconv.Atoi(c.Param("id"))
 
 		out models.PageResults
 	)
@@ -43,7 +46,7 @@ func handleGetLists(c echo.Context) error {
 
 	// Minimal query simply returns the list of all lists without JOIN subscriber counts. This is fast.
 	if !single && minimal {
-		res, err := app.core.GetLists("")
+		res, err := app.core.GetLists("", archived)
 		if err != nil {
 			return err
 		}
@@ -61,7 +64,7 @@ func handleGetLists(c echo.Context) error {
 	}
 
 	// Full list query.
-	res, total, err := app.core.QueryLists(query, typ, optin, tags, orderBy, order, pg.Offset, pg.Limit)
+	res, total, err := app.core.QueryLists(query, typ, optin, tags, archived, orderBy, order, pg.Offset, pg.Limit)
 	if err != nil {
 		return err
 	}
@@ -94,11 +97,18 @@ func handleCreateList(c echo.Context) error {
 	if err := c.Bind(&l); err != nil {
 		return err
 	}
+	l.UUID = ""
 
 	// Validate.
 	if !strHasLen(l.Name, 1, stdInputMaxLen) {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidName"))
 	}
+	if err := validateListFrom(&l, app); err != nil {
+		return err
+	}
+	if err := validateListLang(&l, app); err != nil {
+		return err
+	}
 
 	out, err := app.core.CreateList(l)
 	if err != nil {
@@ -129,6 +139,12 @@ func handleUpdateList(c echo.Context) error {
 	if !strHasLen(l.Name, 1, stdInputMaxLen) {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidName"))
 	}
+	if err := validateListFrom(&l, app); err != nil {
+		return err
+	}
+	if err := validateListLang(&l, app); err != nil {
+		return err
+	}
 
 	out, err := app.core.UpdateList(id, l)
 	if err != nil {
@@ -138,6 +154,165 @@ func handleUpdateList(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
+// handleUpdateListTemplate sets the default campaign template of a list.
+func handleUpdateListTemplate(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		TemplateID int `json:"template_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	out, err := app.core.SetListTemplate(id, req.TemplateID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateListTrackViews sets whether views of campaigns sent to a list are tracked.
+func handleUpdateListTrackViews(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	out, err := app.core.SetListTrackViews(id, req.Enabled)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetListGroups returns the lists that have child lists along with their children.
+func handleGetListGroups(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out, err := app.core.GetListGroups()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateListParent adds a list to (or with parent_id = 0, removes it from) a list group.
+func handleUpdateListParent(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		ParentID int `json:"parent_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	out, err := app.core.SetListParent(id, req.ParentID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleStartListReconfirmation marks the confirmed subscriptions of a list as pending
+// re-confirmation and sends the subscribers opt-in e-mails in the background.
+func handleStartListReconfirmation(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		Deadline time.Time `json:"deadline"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if !req.Deadline.After(time.Now()) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "deadline"))
+	}
+
+	n, err := app.core.StartListReconfirmation(id, req.Deadline)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		n, err := app.core.SendListReconfirmations(id, app.constants.DBBatchSize)
+		if err != nil {
+			return
+		}
+		app.log.Printf("sent re-confirmation e-mails to %d subscriber(s) of list %d", n, id)
+	}()
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		Count int `json:"count"`
+	}{n}})
+}
+
+// handleArchiveList archives or unarchives a list.
+func handleArchiveList(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var (
+		out models.List
+		err error
+	)
+	if strings.HasSuffix(c.Path(), "/unarchive") {
+		out, err = app.core.UnarchiveList(id)
+	} else {
+		out, err = app.core.ArchiveList(id)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
 // handleDeleteLists handles list deletion, either a single one (ID in the URI), or a list.
 func handleDeleteLists(c echo.Context) error {
 	var (
@@ -160,3 +335,53 @@ func handleDeleteLists(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
+
+// handleRefreshListCounts recomputes the cached subscriber counts of all lists.
+func handleRefreshListCounts(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if err := app.core.RefreshListCounts(true); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validateListFrom validates and sanitizes the optional sending identity of a list.
+func validateListFrom(l *models.List, app *App) error {
+	l.FromName = strings.TrimSpace(l.FromName)
+	l.FromEmail = strings.TrimSpace(l.FromEmail)
+	if l.FromEmail == "" {
+		l.FromName = ""
+		return nil
+	}
+
+	em, err := app.importer.ParseEmail(l.FromEmail)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "from_email"))
+	}
+	l.FromEmail = em
+
+	if !strHasLen(l.FromName, 0, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "from_name"))
+	}
+
+	return nil
+}
+
+// validateListLang validates the optional language of a list against the available i18n languages.
+func validateListLang(l *models.List, app *App) error {
+	l.Language = strings.TrimSpace(l.Language)
+	if l.Language == "" {
+		return nil
+	}
+
+	if len(l.Language) > 6 || reLangCode.MatchString(l.Language) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "language"))
+	}
+	if _, err := app.fs.Read(fmt.Sprintf("/i18n/%s.json", l.Language)); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "language"))
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"html/template"
 	"io"
 	"log"
 	"os"
@@ -19,11 +20,15 @@ import (
 	"github.com/knadh/listmonk/internal/buflog"
 	"github.com/knadh/listmonk/internal/captcha"
 	"github.com/knadh/listmonk/internal/core"
+	"github.com/knadh/listmonk/internal/domains"
 	"github.com/knadh/listmonk/internal/events"
 	"github.com/knadh/listmonk/internal/i18n"
+	"github.com/knadh/listmonk/internal/idempotency"
+	"github.com/knadh/listmonk/internal/logger"
 	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/internal/media"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/webhook"
 	"github.com/knadh/listmonk/models"
 	"github.com/knadh/paginator"
 	"github.com/knadh/stuffbin"
@@ -43,18 +48,24 @@ type App struct {
 	constants  *constants
 	manager    *manager.Manager
 	importer   *subimporter.Importer
+	domains    *domains.Rules
 	messengers map[string]manager.Messenger
 	media      media.Store
 	i18n       *i18n.I18n
+	langs      *langs
 	bounce     *bounce.Manager
+	webhooks   *webhook.Manager
 	paginator  *paginator.Paginator
-	captcha    *captcha.Captcha
+	captcha    captcha.Verifier
 	events     *events.Events
 	notifTpls  *notifTpls
 	about      about
 	log        *log.Logger
 	bufLog     *buflog.BufLog
 
+	// Idempotency keys of transactional API requests.
+	txKeys *idempotency.Keys
+
 	// Channel for passing reload signals.
 	chReload chan os.Signal
 
@@ -74,6 +85,10 @@ var (
 	lo       = log.New(io.MultiWriter(os.Stdout, bufLog, evStream.ErrWriter()), "",
 		log.Ldate|log.Ltime|log.Lshortfile)
 
+	// Leveled logger that's set up in the configured format once the config is loaded.
+	// lo writes through it.
+	logs *logger.Logger
+
 	ko      = koanf.New(".")
 	fs      stuffbin.FileSystem
 	db      *sqlx.DB
@@ -123,6 +138,9 @@ func init() {
 		lo.Fatalf("error loading config from env: %v", err)
 	}
 
+	// Set up the logger in the configured format.
+	logs = initLogger()
+
 	// Connect to the database, load the filesystem to read SQL queries.
 	db = initDB()
 	fs = initFS(appDir, frontendDir, ko.String("static-dir"), ko.String("i18n-dir"))
@@ -188,29 +206,82 @@ func main() {
 
 	// Load i18n language map.
 	app.i18n = initI18n(app.constants.Lang, fs)
+	app.langs = &langs{
+		def:  app.i18n,
+		lang: app.constants.Lang,
+		fs:   fs,
+		m:    make(map[string]*i18n.I18n),
+		tpls: make(map[*i18n.I18n]*template.Template),
+	}
 	cOpt := &core.Opt{
 		Constants: core.Constants{
 			SendOptinConfirmation: app.constants.SendOptinConfirmation,
 			CacheSlowQueries:      ko.Bool("app.cache_slow_queries"),
+			AttribsSchema:         app.constants.AttribsSchema,
+			MaxCampaignVersions:   ko.Int("app.max_campaign_versions"),
+			CampaignApproval:      ko.Bool("app.campaign_approval"),
+			Sandbox:               app.constants.SandboxEmail != "",
+			TrackViews:            app.constants.Privacy.TrackViews,
+			FromEmail:             app.constants.FromEmail,
 		},
 		Queries: queries,
 		DB:      db,
 		I18n:    app.i18n,
-		Log:     lo,
+		Log:     logs.With("component", "core"),
 	}
 
 	if err := ko.Unmarshal("bounce.actions", &cOpt.Constants.BounceActions); err != nil {
 		lo.Fatalf("error unmarshalling bounce config: %v", err)
 	}
 
+	if ko.Bool("dkim.enabled") {
+		var keys []struct {
+			Domain   string `json:"domain"`
+			Selector string `json:"selector"`
+		}
+		if err := ko.UnmarshalWithConf("dkim.keys", &keys, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading DKIM config: %v", err)
+		}
+
+		cOpt.Constants.DKIMSelectors = make(map[string]string, len(keys))
+		for _, k := range keys {
+			cOpt.Constants.DKIMSelectors[strings.ToLower(strings.TrimSpace(k.Domain))] = strings.TrimSpace(k.Selector)
+		}
+	}
+
 	app.core = core.New(cOpt, &core.Hooks{
 		SendOptinConfirmation: sendOptinConfirmationHook(app),
+		EmitEvent: func(event string, data interface{}) {
+			if app.webhooks != nil {
+				app.webhooks.Emit(event, data)
+			}
+		},
+		ExcludeSubscribers: func(subIDs []int) {
+			if app.manager != nil {
+				app.manager.ExcludeSubscribers(subIDs)
+			}
+		},
 	})
 
+	app.webhooks = initWebhooks(app)
+	app.webhooks.Run()
+
+	app.txKeys = idempotency.New(idempotency.Opt{
+		TTL:        app.constants.TxIdempotencyTTL,
+		StaleAfter: txIdempotencyKeyStale,
+	}, app.core)
+
 	app.queries = queries
+	app.constants.UnsubSecret = initUnsubSecret(app.queries)
+	app.domains = domains.New(models.DomainRules{
+		Blocklist:       app.constants.Privacy.DomainBlocklist,
+		Allowlist:       app.constants.Privacy.DomainAllowlist,
+		BlockDisposable: app.constants.Privacy.BlockDisposable,
+	})
 	app.manager = initCampaignManager(app.queries, app.constants, app)
 	app.importer = initImporter(app.queries, db, app.core, app)
 	app.notifTpls = initNotifTemplates("/email-templates/*.html", fs, app.i18n, app.constants)
+	initPartials(app)
 	initTxTemplates(app.manager, app)
 
 	if ko.Bool("bounce.enabled") {
@@ -226,6 +297,11 @@ func main() {
 		app.messengers[m.Name()] = m
 	}
 
+	// Initialize the optional SMS messenger.
+	if m := initSMSMessenger(app); m != nil {
+		app.messengers[m.Name()] = m
+	}
+
 	// Attach all messengers to the campaign manager.
 	for _, m := range app.messengers {
 		app.manager.AddMessenger(m)
@@ -239,6 +315,26 @@ func main() {
 		initCron(app.core)
 	}
 
+	// Start the opt-in reminder worker. Like campaigns, only non-passive instances process reminders.
+	if app.constants.OptinReminderMax > 0 && !ko.Bool("passive") {
+		initOptinReminders(app)
+	}
+
+	// Start the archived and stale subscriber purge, recurring campaign, bounce rule,
+	// list count, re-confirmation, engagement score, tx idempotency key, and campaign
+	// delivery purge workers.
+	if !ko.Bool("passive") {
+		initArchivePurge(app)
+		initStaleSubscriberPurge(app)
+		initRecurringCampaigns(app)
+		initBounceRules(app)
+		initListCounts(app)
+		initReconfirmations(app)
+		initEngagementScores(app)
+		initTxIdempotencyPurge(app)
+		initCampaignDeliveryPurge(app)
+	}
+
 	// Start the campaign workers. The campaign batches (fetch from DB, push out
 	// messages) get processed at the specified interval.
 	go app.manager.Run()
@@ -246,25 +342,27 @@ func main() {
 	// Start the app server.
 	srv := initHTTPServer(app)
 
+	// Start the optional metrics server.
+	metricsSrv := initMetricsServer(app)
+
 	// Star the update checker.
 	if ko.Bool("app.check_updates") {
 		go checkUpdates(versionString, time.Hour*24, app)
 	}
 
-	// Wait for the reload signal with a callback to gracefully shut down resources.
-	// The `wait` channel is passed to awaitReload to wait for the callback to finish
-	// within N seconds, or do a force reload.
-	app.chReload = make(chan os.Signal)
-	signal.Notify(app.chReload, syscall.SIGHUP)
-
-	closerWait := make(chan bool)
-	<-awaitReload(app.chReload, closerWait, func() {
+	// Gracefully shut down resources on reloading and exiting.
+	shutdown := func() {
 		// Stop the HTTP server.
 		ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 		defer cancel()
 		srv.Shutdown(ctx)
+		if metricsSrv != nil {
+			metricsSrv.Shutdown(ctx)
+		}
 
-		// Close the campaign manager.
+		// Finish sending the queued campaign messages within the grace period,
+		// save the campaigns' progress, and close the campaign manager.
+		app.manager.Shutdown(app.constants.ShutdownGracePeriod)
 		app.manager.Close()
 
 		// Close the DB pool.
@@ -274,6 +372,27 @@ func main() {
 		for _, m := range app.messengers {
 			m.Close()
 		}
+	}
+
+	// Shut down and exit on SIGTERM and SIGINT.
+	chStop := make(chan os.Signal, 1)
+	signal.Notify(chStop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-chStop
+		lo.Println("shutting down on signal ...")
+		shutdown()
+		os.Exit(0)
+	}()
+
+	// Wait for the reload signal with a callback to gracefully shut down resources.
+	// The `wait` channel is passed to awaitReload to wait for the callback to finish
+	// within the grace period, or do a force reload.
+	app.chReload = make(chan os.Signal)
+	signal.Notify(app.chReload, syscall.SIGHUP)
+
+	closerWait := make(chan bool)
+	<-awaitReload(app.chReload, closerWait, app.constants.ShutdownGracePeriod+shutdownTimeout, func() {
+		shutdown()
 
 		// Signal the close.
 		closerWait <- true
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/json"
 	"net/http"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
 	"github.com/knadh/listmonk/internal/core"
@@ -9,6 +11,7 @@ import (
 	"github.com/knadh/listmonk/internal/media"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
+	"gopkg.in/volatiletech/null.v6"
 )
 
 // store implements DataSource over the primary
@@ -42,8 +45,18 @@ func (s *store) NextCampaigns(currentIDs []int64, sentCounts []int64) ([]*models
 // and every batch takes the last ID of the last batch and fetches the next
 // batch above that.
 func (s *store) NextSubscribers(campID, limit int) ([]models.Subscriber, error) {
+	// Campaigns targeting a segment evaluate the segment on every batch so that
+	// its membership is current.
+	seg, err := s.core.GetCampaignSegment(campID)
+	if err != nil {
+		return nil, err
+	}
+	if seg != nil {
+		return s.core.NextSegmentSubscribers(campID, *seg, limit)
+	}
+
 	var out []models.Subscriber
-	err := s.queries.NextCampaignSubscribers.Select(&out, campID, limit)
+	err = s.queries.NextCampaignSubscribers.Select(&out, campID, limit)
 	return out, err
 }
 
@@ -54,10 +67,27 @@ func (s *store) GetCampaign(campID int) (*models.Campaign, error) {
 	return out, err
 }
 
-// UpdateCampaignStatus updates a campaign's status.
+// UpdateCampaignStatus updates a campaign's status. When a campaign finishes,
+// the campaign.sent event is emitted.
 func (s *store) UpdateCampaignStatus(campID int, status string) error {
-	_, err := s.queries.UpdateCampaignStatus.Exec(campID, status)
-	return err
+	if _, err := s.queries.UpdateCampaignStatus.Exec(campID, status); err != nil {
+		return err
+	}
+
+	if status == models.CampaignStatusFinished {
+		if c, err := s.GetCampaign(campID); err == nil {
+			s.core.Emit(models.EventCampaignSent, map[string]interface{}{
+				"id":      c.ID,
+				"uuid":    c.UUID,
+				"name":    c.Name,
+				"subject": c.Subject,
+				"to_send": c.ToSend,
+				"sent":    c.Sent,
+			})
+		}
+	}
+
+	return nil
 }
 
 // UpdateCampaignCounts updates a campaign's status.
@@ -66,6 +96,129 @@ func (s *store) UpdateCampaignCounts(campID int, toSend int, sent int, lastSubID
 	return err
 }
 
+// UpdateCampaignCheckpoint updates the ID of the subscriber up to whom a campaign
+// has been processed.
+func (s *store) UpdateCampaignCheckpoint(campID int, lastSubID int) error {
+	_, err := s.queries.UpdateCampaignCheckpoint.Exec(campID, lastSubID)
+	return err
+}
+
+// GetCampaignMessageCap returns the rolling per-subscriber message cap applicable to
+// a campaign given the global cap, and whether subscriber sends have to be recorded.
+func (s *store) GetCampaignMessageCap(campID int, max int) (int, bool, error) {
+	var out struct {
+		Num   int  `db:"num"`
+		Track bool `db:"track"`
+	}
+	err := s.queries.GetCampaignMessageCap.Get(&out, campID, max)
+	return out.Num, out.Track, err
+}
+
+// GetSubscriberSendCounts returns the number of campaign messages sent to the given
+// subscribers in the rolling 24 hour window.
+func (s *store) GetSubscriberSendCounts(subIDs []int) ([]models.SubscriberSendCount, error) {
+	var out []models.SubscriberSendCount
+	err := s.queries.GetSubscriberSendCounts.Select(&out, pq.Array(subIDs))
+	return out, err
+}
+
+// GetExcludedSubscribers returns the given subscribers who are on any of the given
+// exclusion lists or who are recipients of any of the given campaigns.
+func (s *store) GetExcludedSubscribers(subIDs []int, listIDs, campIDs []int64) ([]int, error) {
+	var out []int
+	err := s.queries.GetExcludedSubscribers.Select(&out, pq.Array(subIDs), listIDs, campIDs)
+	return out, err
+}
+
+// RecordSubscriberSends records campaign messages sent to the given subscribers.
+func (s *store) RecordSubscriberSends(campID int, subIDs []int) error {
+	_, err := s.queries.RecordSubscriberSends.Exec(campID, pq.Array(subIDs))
+	return err
+}
+
+// RecordCampaignDeliveries records the subscribers to whom a campaign's messages have been sent.
+func (s *store) RecordCampaignDeliveries(campID int, subIDs []int) error {
+	_, err := s.queries.RecordCampaignDeliveries.Exec(campID, pq.Array(subIDs))
+	return err
+}
+
+// DeferCampaignSubscribers defers a campaign's messages to the given subscribers.
+func (s *store) DeferCampaignSubscribers(campID int, d []models.CampaignDeferral) error {
+	var (
+		ids    = make([]int64, len(d))
+		copies = make([]int64, len(d))
+		times  = make([]int64, len(d))
+	)
+	for i, v := range d {
+		ids[i] = int64(v.SubscriberID)
+		copies[i] = int64(v.Copies)
+		times[i] = v.RetryAt.Unix()
+	}
+
+	_, err := s.queries.DeferCampaignSubscribers.Exec(campID, pq.Int64Array(ids), pq.Int64Array(copies), pq.Int64Array(times))
+	return err
+}
+
+// NextDeferredSubscribers leases and returns a batch of a campaign's deferred subscribers
+// who are due to be retried. Subscribers get retried again after the lease unless
+// their deferrals are deleted.
+func (s *store) NextDeferredSubscribers(campID, limit int, lease time.Duration) ([]models.Subscriber, error) {
+	var out []models.Subscriber
+	err := s.queries.NextCampaignDeferrals.Select(&out, campID, limit, lease.Seconds())
+	return out, err
+}
+
+// GetCampaignNextDeferral returns the earliest retry time of a campaign's deferred
+// subscribers. It's zero if there are none.
+func (s *store) GetCampaignNextDeferral(campID int) (time.Time, error) {
+	var out null.Time
+	err := s.queries.GetCampaignNextDeferral.Get(&out, campID)
+	return out.Time, err
+}
+
+// DeleteCampaignDeferrals deletes the deferrals of the given subscribers in a campaign.
+func (s *store) DeleteCampaignDeferrals(campID int, subIDs []int) error {
+	_, err := s.queries.DeleteCampaignDeferrals.Exec(campID, pq.Array(subIDs))
+	return err
+}
+
+// GetCampaignVariants returns the A/B subject variants of a campaign.
+func (s *store) GetCampaignVariants(campID int) ([]models.CampaignVariant, error) {
+	var out []models.CampaignVariant
+	err := s.queries.GetCampaignVariants.Select(&out, campID)
+	return out, err
+}
+
+// UpdateCampaignVariantCounts increments the sent counts of a campaign's variants
+// given a map of variantID:sentCount.
+func (s *store) UpdateCampaignVariantCounts(campID int, counts map[int]int) error {
+	var (
+		ids  = make([]int, 0, len(counts))
+		nums = make([]int, 0, len(counts))
+	)
+	for id, n := range counts {
+		ids = append(ids, id)
+		nums = append(nums, n)
+	}
+
+	_, err := s.queries.UpdateCampaignVariantCounts.Exec(campID, pq.Array(ids), pq.Array(nums))
+	return err
+}
+
+// EndCampaignVariantSample records the time at which the A/B variant sample window
+// of a campaign ends.
+func (s *store) EndCampaignVariantSample(campID int, endsAt time.Time) error {
+	_, err := s.queries.EndCampaignVariantSample.Exec(campID, endsAt)
+	return err
+}
+
+// PickCampaignVariantWinner picks the winning A/B variant of a campaign by open rate.
+func (s *store) PickCampaignVariantWinner(campID int) (models.CampaignVariant, error) {
+	var out models.CampaignVariant
+	err := s.queries.PickCampaignVariantWinner.Get(&out, campID)
+	return out, err
+}
+
 // GetAttachment fetches a media attachment blob.
 func (s *store) GetAttachment(mediaID int) (models.Attachment, error) {
 	m, err := s.core.GetMedia(mediaID, "", s.media)
@@ -125,6 +278,40 @@ func (s *store) BlocklistSubscriber(id int64) error {
 	return err
 }
 
+// InsertTxMessage records a queued tx message.
+func (s *store) InsertTxMessage(msg models.Message, tplID int, retryAt time.Time) error {
+	return s.core.InsertTxMessage(msg, tplID, retryAt)
+}
+
+// UpdateTxMessage updates the delivery status of a queued tx message.
+func (s *store) UpdateTxMessage(uuid, status string, attempts int, errMsg string, retryAt time.Time) error {
+	return s.core.UpdateTxMessage(uuid, status, attempts, errMsg, retryAt)
+}
+
+// NextTxMessages leases and returns a batch of queued tx messages that are due to be
+// retried. Messages get retried again after the lease unless their status is updated.
+func (s *store) NextTxMessages(limit int, lease time.Duration) ([]models.QueuedTxMessage, error) {
+	var res []struct {
+		UUID     string          `db:"uuid"`
+		Attempts int             `db:"attempts"`
+		Message  json.RawMessage `db:"message"`
+	}
+	if err := s.queries.NextTxMessages.Select(&res, limit, lease.Seconds()); err != nil {
+		return nil, err
+	}
+
+	out := make([]models.QueuedTxMessage, 0, len(res))
+	for _, r := range res {
+		m := models.QueuedTxMessage{UUID: r.UUID, Attempts: r.Attempts}
+		if err := json.Unmarshal(r.Message, &m.Message); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+
+	return out, nil
+}
+
 func (s *store) DeleteSubscriber(id int64) error {
 	_, err := s.queries.DeleteSubscribers.Exec(pq.Int64Array{id})
 	return err
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"fmt"
+	"image"
 	"mime/multipart"
 	"net/http"
 	"path/filepath"
@@ -9,13 +11,19 @@ import (
 	"strings"
 
 	"github.com/disintegration/imaging"
+	"github.com/knadh/listmonk/internal/media"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
+	"gopkg.in/volatiletech/null.v6"
 )
 
 const (
 	thumbPrefix   = "thumb_"
 	thumbnailSize = 250
+
+	// Max number of resized variants per image and the max width of a variant.
+	maxImageVariants     = 10
+	maxImageVariantWidth = 10000
 )
 
 var (
@@ -26,8 +34,9 @@ var (
 // handleUploadMedia handles media file uploads.
 func handleUploadMedia(c echo.Context) error {
 	var (
-		app     = c.Get("app").(*App)
-		cleanUp = false
+		app         = c.Get("app").(*App)
+		cleanUp     = false
+		folderID, _ = strconv.Atoi(c.FormValue("folder_id"))
 	)
 	file, err := c.FormFile("file")
 	if err != nil {
@@ -70,6 +79,7 @@ func handleUploadMedia(c echo.Context) error {
 		thumbfName = ""
 		width      = 0
 		height     = 0
+		variants   = media.Variants{}
 	)
 	defer func() {
 		// If any of the subroutines in this function fail,
@@ -80,13 +90,24 @@ func handleUploadMedia(c echo.Context) error {
 			if thumbfName != "" {
 				app.media.Delete(thumbfName)
 			}
+			for _, v := range variants {
+				app.media.Delete(v.Filename)
+			}
 		}
 	}()
 
 	// Create thumbnail from file for non-vector formats.
 	isImage := inArray(ext, imageExts)
 	if isImage {
-		thumbFile, w, h, err := processImage(file)
+		img, err := decodeImage(file)
+		if err != nil {
+			cleanUp = true
+			app.log.Printf("error resizing image: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("media.errorResizing", "error", err.Error()))
+		}
+
+		thumbFile, w, h, err := processImage(img)
 		if err != nil {
 			cleanUp = true
 			app.log.Printf("error resizing image: %v", err)
@@ -105,6 +126,30 @@ func handleUploadMedia(c echo.Context) error {
 				app.i18n.Ts("media.errorSavingThumbnail", "error", err.Error()))
 		}
 		thumbfName = tf
+
+		// Create and upload resized variants that are smaller than the original.
+		for _, vw := range app.constants.MediaUpload.ImageVariantWidths {
+			if vw >= width {
+				continue
+			}
+
+			b, err := resizeImage(img, vw, ext)
+			if err != nil {
+				cleanUp = true
+				app.log.Printf("error resizing image: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError,
+					app.i18n.Ts("media.errorResizing", "error", err.Error()))
+			}
+
+			vf, err := app.media.Put(fmt.Sprintf("%dw_%s", vw, fName), contentType, b)
+			if err != nil {
+				cleanUp = true
+				app.log.Printf("error saving image variant: %v", err)
+				return echo.NewHTTPError(http.StatusInternalServerError,
+					app.i18n.Ts("media.errorUploading", "error", err.Error()))
+			}
+			variants = append(variants, media.Variant{Width: vw, Filename: vf})
+		}
 	}
 	if inArray(ext, vectorExts) {
 		thumbfName = fName
@@ -118,7 +163,7 @@ func handleUploadMedia(c echo.Context) error {
 			"height": height,
 		}
 	}
-	m, err := app.core.InsertMedia(fName, thumbfName, contentType, meta, app.constants.MediaUpload.Provider, app.media)
+	m, err := app.core.InsertMedia(fName, thumbfName, contentType, meta, folderID, file.Size, variants, app.constants.MediaUpload.Provider, app.media)
 	if err != nil {
 		cleanUp = true
 		return err
@@ -144,7 +189,17 @@ func handleGetMedia(c echo.Context) error {
 		return c.JSON(http.StatusOK, okResp{out})
 	}
 
-	res, total, err := app.core.QueryMedia(app.constants.MediaUpload.Provider, app.media, query, pg.Offset, pg.Limit)
+	// Optional folder filter. 0 filters media that aren't in any folder.
+	var folderID null.Int
+	if v := c.FormValue("folder_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+		}
+		folderID = null.IntFrom(id)
+	}
+
+	res, total, err := app.core.QueryMedia(app.constants.MediaUpload.Provider, app.media, query, folderID, pg.Offset, pg.Limit)
 	if err != nil {
 		return err
 	}
@@ -170,31 +225,117 @@ func handleDeleteMedia(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
-	fname, err := app.core.DeleteMedia(id)
+	m, err := app.core.DeleteMedia(id)
 	if err != nil {
 		return err
 	}
 
-	app.media.Delete(fname)
-	app.media.Delete(thumbPrefix + fname)
+	app.media.Delete(m.Filename)
+	app.media.Delete(thumbPrefix + m.Filename)
+	for _, v := range m.Variants {
+		app.media.Delete(v.Filename)
+	}
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
-// processImage reads the image file and returns thumbnail bytes and
-// the original image's width, and height.
-func processImage(file *multipart.FileHeader) (*bytes.Reader, int, int, error) {
-	src, err := file.Open()
+// handleMoveMedia moves media items into a folder. Only the media records are
+// updated and the stored files are not touched.
+func handleMoveMedia(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req struct {
+			IDs      []int `json:"ids"`
+			FolderID int   `json:"folder_id"`
+		}
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if len(req.IDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.core.MoveMedia(req.IDs, req.FolderID); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleGetMediaFolders returns all media folders with their media counts and sizes.
+func handleGetMediaFolders(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out, err := app.core.GetMediaFolders(app.constants.MediaUpload.Provider)
 	if err != nil {
-		return nil, 0, 0, err
+		return err
 	}
-	defer src.Close()
 
-	img, err := imaging.Decode(src)
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateMediaFolder creates a new media folder.
+func handleCreateMediaFolder(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req struct {
+			Name string `json:"name"`
+		}
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if !strHasLen(req.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "name"))
+	}
+
+	out, err := app.core.CreateMediaFolder(req.Name, app.constants.MediaUpload.Provider)
 	if err != nil {
-		return nil, 0, 0, err
+		return err
 	}
 
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDeleteMediaFolder deletes a media folder. Media in it are moved out of it.
+func handleDeleteMediaFolder(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.core.DeleteMediaFolder(id); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// decodeImage reads and decodes the uploaded image file.
+func decodeImage(file *multipart.FileHeader) (image.Image, error) {
+	src, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	return imaging.Decode(src)
+}
+
+// processImage returns thumbnail bytes of the given image and
+// the original image's width, and height.
+func processImage(img image.Image) (*bytes.Reader, int, int, error) {
 	// Encode the image into a byte slice as PNG.
 	var (
 		thumb = imaging.Resize(img, thumbnailSize, 0, imaging.Lanczos)
@@ -207,3 +348,19 @@ func processImage(file *multipart.FileHeader) (*bytes.Reader, int, int, error) {
 	b := img.Bounds().Max
 	return bytes.NewReader(out.Bytes()), b.X, b.Y, nil
 }
+
+// resizeImage resizes the image to the given width preserving the aspect ratio
+// and encodes it in the format of the given file extension.
+func resizeImage(img image.Image, width int, ext string) (*bytes.Reader, error) {
+	format, err := imaging.FormatFromExtension(ext)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	if err := imaging.Encode(&out, imaging.Resize(img, width, 0, imaging.Lanczos), format); err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(out.Bytes()), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/knadh/listmonk/internal/messenger/email"
+	"github.com/knadh/listmonk/internal/metrics"
+)
+
+// handleGetMetrics returns the campaign manager, SMTP, and bounce metrics
+// in the Prometheus text exposition format.
+func handleGetMetrics(app *App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mw := metrics.NewWriter()
+
+		app.manager.WriteMetrics(mw)
+
+		// Per SMTP server counters. Servers are labelled by their host:port and
+		// the label values are bounded by the configured servers.
+		if e, ok := app.messengers[emailMsgr].(*email.Emailer); ok {
+			health := e.Health()
+			for _, h := range health {
+				mw.Counter("listmonk_smtp_sent_total", "Messages sent by SMTP server.", float64(h.Sent), "server", smtpServerLabel(h))
+			}
+			for _, h := range health {
+				mw.Counter("listmonk_smtp_failed_total", "Messages that failed to send by SMTP server.", float64(h.Failed), "server", smtpServerLabel(h))
+			}
+			for _, h := range health {
+				v := 0.0
+				if h.Healthy {
+					v = 1
+				}
+				mw.Gauge("listmonk_smtp_healthy", "Whether the SMTP server is in the rotation.", v, "server", smtpServerLabel(h))
+			}
+		}
+
+		if app.bounce != nil {
+			app.bounce.WriteMetrics(mw)
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(mw.Bytes())
+	}
+}
+
+func smtpServerLabel(h email.ServerHealth) string {
+	return fmt.Sprintf("%s:%d", h.Host, h.Port)
+}
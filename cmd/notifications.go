@@ -5,6 +5,7 @@ import (
 	"regexp"
 	"strings"
 
+	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/models"
 )
 
@@ -28,12 +29,28 @@ type notifData struct {
 
 // sendNotification sends out an e-mail notification to admins.
 func (app *App) sendNotification(toEmails []string, subject, tplName string, data interface{}) error {
+	return app.sendI18nNotification(toEmails, subject, tplName, data, app.i18n)
+}
+
+// sendI18nNotification sends out an e-mail notification with the template
+// rendered in the given language.
+func (app *App) sendI18nNotification(toEmails []string, subject, tplName string, data interface{}, i *i18n.I18n) error {
 	if len(toEmails) == 0 {
 		return nil
 	}
 
+	tpls := app.notifTpls.tpls
+	if i != app.i18n {
+		t, err := app.langs.notifTpls(i, app.constants)
+		if err != nil {
+			app.log.Printf("error compiling notification templates: %v", err)
+			return err
+		}
+		tpls = t
+	}
+
 	var buf bytes.Buffer
-	if err := app.notifTpls.tpls.ExecuteTemplate(&buf, tplName, data); err != nil {
+	if err := tpls.ExecuteTemplate(&buf, tplName, data); err != nil {
 		app.log.Printf("error compiling notification template '%s': %v", tplName, err)
 		return err
 	}
@@ -2,13 +2,17 @@ package main
 
 import (
 	"bytes"
-	"database/sql"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"html/template"
 	"image"
 	"image/png"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 
@@ -60,6 +64,7 @@ type unsubTpl struct {
 	publicTpl
 	Subscriber       models.Subscriber
 	Subscriptions    []models.Subscription
+	Topics           []prefTopic
 	SubUUID          string
 	AllowBlocklist   bool
 	AllowExport      bool
@@ -68,6 +73,21 @@ type unsubTpl struct {
 	ShowManage       bool
 }
 
+// prefTopic is a group of lists on the preference center. Lists are grouped
+// by their parent list (group), and the ones without one are in a topic without a name.
+type prefTopic struct {
+	Name  string
+	Lists []prefList
+}
+
+type prefList struct {
+	ID          int
+	UUID        string
+	Name        string
+	Description string
+	Subscribed  bool
+}
+
 type optinTpl struct {
 	publicTpl
 	SubUUID   string
@@ -83,8 +103,9 @@ type msgTpl struct {
 
 type subFormTpl struct {
 	publicTpl
-	Lists      []models.List
-	CaptchaKey string
+	Lists           []models.List
+	CaptchaKey      string
+	CaptchaProvider string
 }
 
 var (
@@ -103,10 +124,19 @@ func (t *tplRenderer) Render(w io.Writer, name string, data interface{}, c echo.
 		EnablePublicArchive: t.EnablePublicArchive,
 		IndividualTracking:  t.IndividualTracking,
 		Data:                data,
-		L:                   c.Get("app").(*App).i18n,
+		L:                   getI18n(c),
 	})
 }
 
+// getI18n returns the language that public pages of a request are rendered in,
+// which is either the subscriber's language set on the request, or the instance's.
+func getI18n(c echo.Context) *i18n.I18n {
+	if i, ok := c.Get("i18n").(*i18n.I18n); ok {
+		return i
+	}
+	return c.Get("app").(*App).i18n
+}
+
 // handleGetPublicLists returns the list of public lists with minimal fields
 // required to submit a subscription.
 func handleGetPublicLists(c echo.Context) error {
@@ -115,7 +145,7 @@ func handleGetPublicLists(c echo.Context) error {
 	)
 
 	// Get all public lists.
-	lists, err := app.core.GetLists(models.ListTypePublic)
+	lists, err := app.core.GetLists(models.ListTypePublic, false)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.errorFetchingLists"))
 	}
@@ -160,9 +190,9 @@ func handleViewCampaignMessage(c echo.Context) error {
 	}
 
 	// Get the subscriber.
-	sub, err := app.core.GetSubscriber(0, subUUID, "")
+	sub, err := app.core.GetSubscriberByUUID(subUUID)
 	if err != nil {
-		if err == sql.ErrNoRows {
+		if er, ok := err.(*echo.HTTPError); ok && er.Code == http.StatusNotFound {
 			return c.Render(http.StatusNotFound, tplMessage,
 				makeMsgTpl(app.i18n.T("public.notFoundTitle"), "", app.i18n.T("public.errorFetchingEmail")))
 		}
@@ -195,27 +225,48 @@ func handleViewCampaignMessage(c echo.Context) error {
 func handleSubscriptionPage(c echo.Context) error {
 	var (
 		app           = c.Get("app").(*App)
+		campUUID      = c.Param("campUUID")
 		subUUID       = c.Param("subUUID")
 		showManage, _ = strconv.ParseBool(c.FormValue("manage"))
 		out           = unsubTpl{}
 	)
 	out.SubUUID = subUUID
-	out.Title = app.i18n.T("public.unsubscribeTitle")
 	out.AllowBlocklist = app.constants.Privacy.AllowBlocklist
 	out.AllowExport = app.constants.Privacy.AllowExport
 	out.AllowWipe = app.constants.Privacy.AllowWipe
 	out.AllowPreferences = app.constants.Privacy.AllowPreferences
 
-	s, err := app.core.GetSubscriber(0, subUUID, "")
+	s, err := app.core.GetSubscriberByUUID(subUUID)
 	if err != nil {
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.Ts("public.errorProcessingRequest")))
 	}
 	out.Subscriber = s
 
+	i := setSubscriberI18n(c, s)
+	out.Title = i.T("public.unsubscribeTitle")
+
 	if s.Status == models.SubscriberStatusBlockListed {
 		return c.Render(http.StatusOK, tplMessage,
-			makeMsgTpl(app.i18n.T("public.noSubTitle"), "", app.i18n.Ts("public.blocklisted")))
+			makeMsgTpl(i.T("public.noSubTitle"), "", i.Ts("public.blocklisted")))
+	}
+
+	// Without the confirmation, signed unsubscribe links unsubscribe immediately.
+	// Unsigned ones (eg: in old messages) still show the confirmation page.
+	if !app.constants.Privacy.UnsubConfirm && !showManage && c.QueryParam("sig") != "" {
+		sig, err := hex.DecodeString(c.QueryParam("sig"))
+		if err != nil || !hmac.Equal(sig, unsubURLMAC(app.constants.UnsubSecret, campUUID, subUUID)) {
+			return c.Render(http.StatusForbidden, tplMessage,
+				makeMsgTpl(i.T("public.errorTitle"), "", i.T("globals.messages.invalidData")))
+		}
+
+		if err := app.core.UnsubscribeByCampaign(subUUID, campUUID, false, app.constants.Privacy.UnsubAllLists); err != nil {
+			return c.Render(http.StatusInternalServerError, tplMessage,
+				makeMsgTpl(i.T("public.errorTitle"), "", i.T("public.errorProcessingRequest")))
+		}
+
+		return c.Render(http.StatusOK, tplMessage,
+			makeMsgTpl(i.T("public.unsubbedTitle"), "", i.T("public.unsubbedInfo")))
 	}
 
 	// Only show preference management if it's enabled in settings.
@@ -226,7 +277,7 @@ func handleSubscriptionPage(c echo.Context) error {
 		// Get the subscriber's lists.
 		subs, err := app.core.GetSubscriptions(0, subUUID, false)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.errorFetchingLists"))
+			return echo.NewHTTPError(http.StatusBadRequest, i.T("public.errorFetchingLists"))
 		}
 
 		out.Subscriptions = make([]models.Subscription, 0, len(subs))
@@ -237,11 +288,52 @@ func handleSubscriptionPage(c echo.Context) error {
 
 			out.Subscriptions = append(out.Subscriptions, s)
 		}
+
+		lists, err := app.core.GetLists(models.ListTypePublic, false)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, i.T("public.errorFetchingLists"))
+		}
+		out.Topics = makePrefTopics(lists, subs)
 	}
 
 	return c.Render(http.StatusOK, "subscription", out)
 }
 
+// handleOneClickUnsubscribe handles one-click (RFC 8058) unsubscriptions made by
+// mailbox providers with the signed URL in the List-Unsubscribe header of campaign
+// messages. The subscriber is always unsubscribed without a confirmation irrespective
+// of the privacy.unsubscribe_confirm setting.
+func handleOneClickUnsubscribe(c echo.Context) error {
+	var (
+		app      = c.Get("app").(*App)
+		campUUID = c.Param("campUUID")
+		subUUID  = c.Param("subUUID")
+	)
+
+	sig, err := hex.DecodeString(c.QueryParam("sig"))
+	if err != nil || !hmac.Equal(sig, unsubURLMAC(app.constants.UnsubSecret, campUUID, subUUID)) {
+		return echo.NewHTTPError(http.StatusForbidden, app.i18n.T("globals.messages.invalidData"))
+	}
+
+	if err := app.core.UnsubscribeByCampaign(subUUID, campUUID, false, app.constants.Privacy.UnsubAllLists); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// signUnsubURL returns the hex signature of a one-click unsubscribe URL.
+func signUnsubURL(secret []byte, campUUID, subUUID string) string {
+	return hex.EncodeToString(unsubURLMAC(secret, campUUID, subUUID))
+}
+
+// unsubURLMAC returns the HMAC of a campaign and subscriber's one-click unsubscribe URL.
+func unsubURLMAC(secret []byte, campUUID, subUUID string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(campUUID + ":" + subUUID))
+	return h.Sum(nil)
+}
+
 // handleSubscriptionPrefs renders the subscription management page and
 // handles unsubscriptions. This is the view that {{ UnsubscribeURL }} in
 // campaigns link to.
@@ -259,54 +351,61 @@ func handleSubscriptionPrefs(c echo.Context) error {
 		}
 	)
 
+	// The pages are rendered in the subscriber's language, if the subscriber exists.
+	i := app.i18n
+	sub, subErr := app.core.GetSubscriberByUUID(subUUID)
+	if subErr == nil {
+		i = setSubscriberI18n(c, sub)
+	}
+
 	// Read the form.
 	if err := c.Bind(&req); err != nil {
 		return c.Render(http.StatusBadRequest, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("globals.messages.invalidData")))
+			makeMsgTpl(i.T("public.errorTitle"), "", i.T("globals.messages.invalidData")))
 	}
 
 	// Simple unsubscribe.
 	blocklist := app.constants.Privacy.AllowBlocklist && req.Blocklist
 	if !req.Manage || blocklist {
-		if err := app.core.UnsubscribeByCampaign(subUUID, campUUID, blocklist); err != nil {
+		if err := app.core.UnsubscribeByCampaign(subUUID, campUUID, blocklist, app.constants.Privacy.UnsubAllLists); err != nil {
 			return c.Render(http.StatusInternalServerError, tplMessage,
-				makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("public.errorProcessingRequest")))
+				makeMsgTpl(i.T("public.errorTitle"), "", i.T("public.errorProcessingRequest")))
 		}
 
 		return c.Render(http.StatusOK, tplMessage,
-			makeMsgTpl(app.i18n.T("public.unsubbedTitle"), "", app.i18n.T("public.unsubbedInfo")))
+			makeMsgTpl(i.T("public.unsubbedTitle"), "", i.T("public.unsubbedInfo")))
 	}
 
 	// Is preference management enabled?
 	if !app.constants.Privacy.AllowPreferences {
 		return c.Render(http.StatusBadRequest, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("public.invalidFeature")))
+			makeMsgTpl(i.T("public.errorTitle"), "", i.T("public.invalidFeature")))
 	}
 
 	// Manage preferences.
 	req.Name = strings.TrimSpace(req.Name)
 	if req.Name == "" || len(req.Name) > 256 {
 		return c.Render(http.StatusBadRequest, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("subscribers.invalidName")))
+			makeMsgTpl(i.T("public.errorTitle"), "", i.T("subscribers.invalidName")))
 	}
 
-	// Get the subscriber from the DB.
-	sub, err := app.core.GetSubscriber(0, subUUID, "")
-	if err != nil {
+	// The subscriber has to exist to manage preferences.
+	if subErr != nil {
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.Ts("globals.messages.pFound",
-				"name", app.i18n.T("globals.terms.subscriber"))))
+			makeMsgTpl(i.T("public.errorTitle"), "", i.Ts("globals.messages.pFound",
+				"name", i.T("globals.terms.subscriber"))))
 	}
 	sub.Name = req.Name
 
 	// Update name.
 	if _, err := app.core.UpdateSubscriber(sub.ID, sub); err != nil {
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("public.errorProcessingRequest")))
+			makeMsgTpl(i.T("public.errorTitle"), "", i.T("public.errorProcessingRequest")))
 	}
 
-	// Get the subscriber's lists and whatever is not sent in the request (unchecked),
-	// unsubscribe them.
+	// Diff the lists on the preference center against the ones checked in the request.
+	// Checked lists that the subscriber isn't on are subscribed to and the unchecked
+	// ones, unsubscribed from.
 	reqUUIDs := make(map[string]struct{})
 	for _, u := range req.ListUUIDs {
 		reqUUIDs[u] = struct{}{}
@@ -314,28 +413,138 @@ func handleSubscriptionPrefs(c echo.Context) error {
 
 	subs, err := app.core.GetSubscriptions(0, subUUID, false)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.errorFetchingLists"))
+		return echo.NewHTTPError(http.StatusBadRequest, i.T("public.errorFetchingLists"))
+	}
+
+	lists, err := app.core.GetLists(models.ListTypePublic, false)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, i.T("public.errorFetchingLists"))
+	}
+
+	var (
+		addIDs   []int
+		unsubIDs []int
+		checked  int
+	)
+	for _, t := range makePrefTopics(lists, subs) {
+		for _, l := range t.Lists {
+			_, ok := reqUUIDs[l.UUID]
+			if ok {
+				checked++
+			}
+
+			if ok && !l.Subscribed {
+				addIDs = append(addIDs, l.ID)
+			} else if !ok && l.Subscribed {
+				unsubIDs = append(unsubIDs, l.ID)
+			}
+		}
+	}
+
+	// If everything's been unchecked, it's a global unsubscription from all lists,
+	// including the private ones that aren't shown.
+	if checked == 0 && len(unsubIDs) > 0 {
+		unsubIDs = unsubIDs[:0]
+		for _, s := range subs {
+			if s.SubscriptionStatus.String != models.SubscriptionStatusUnsubscribed {
+				unsubIDs = append(unsubIDs, s.ID)
+			}
+		}
+	}
+
+	hasOptin, err := app.core.UpdateSubscriptionPrefs(sub, addIDs, unsubIDs)
+	if err != nil {
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl(i.T("public.errorTitle"), "", i.T("public.errorProcessingRequest")))
+	}
+
+	msg := "public.prefsSaved"
+	if hasOptin {
+		msg = "public.subOptinPending"
 	}
 
-	unsubUUIDs := make([]string, 0, len(req.ListUUIDs))
+	return c.Render(http.StatusOK, tplMessage,
+		makeMsgTpl(i.T("globals.messages.done"), "", i.T(msg)))
+}
+
+// makePrefTopics returns the lists to show on a subscriber's preference center
+// grouped into topics. These are the public lists and the subscriber's existing
+// non-private subscriptions (which may be to lists that are archived since).
+func makePrefTopics(lists []models.List, subs []models.Subscription) []prefTopic {
+	var (
+		all    = make([]models.List, 0, len(lists)+len(subs))
+		subbed = make(map[int]bool, len(subs))
+		seen   = make(map[int]bool, len(lists)+len(subs))
+		names  = make(map[int]string, len(lists))
+	)
 	for _, s := range subs {
 		if s.Type == models.ListTypePrivate {
 			continue
 		}
-		if _, ok := reqUUIDs[s.UUID]; !ok {
-			unsubUUIDs = append(unsubUUIDs, s.UUID)
+		subbed[s.ID] = s.SubscriptionStatus.String != models.SubscriptionStatusUnsubscribed
+		all = append(all, s.List)
+	}
+	all = append(all, lists...)
+
+	// Lists that are parents (groups) of other lists are shown in their own topic.
+	for _, l := range all {
+		names[l.ID] = l.Name
+	}
+	parents := make(map[int]bool)
+	for _, l := range all {
+		if l.ParentID.Valid {
+			parents[int(l.ParentID.Int)] = true
 		}
 	}
 
-	// Unsubscribe from lists.
-	if err := app.core.UnsubscribeLists([]int{sub.ID}, nil, unsubUUIDs); err != nil {
-		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("public.errorProcessingRequest")))
+	var (
+		out   = []prefTopic{{}}
+		index = map[int]int{}
+	)
+	for _, l := range all {
+		if seen[l.ID] {
+			continue
+		}
+		seen[l.ID] = true
 
+		// Archived lists are only shown if the subscriber's on them.
+		if l.Archived && !subbed[l.ID] {
+			continue
+		}
+
+		topic := 0
+		if l.ParentID.Valid {
+			topic = int(l.ParentID.Int)
+		} else if parents[l.ID] {
+			topic = l.ID
+		}
+
+		// The parent isn't visible to the subscriber.
+		if _, ok := names[topic]; !ok {
+			topic = 0
+		}
+
+		n, ok := index[topic]
+		if !ok && topic > 0 {
+			n = len(out)
+			index[topic] = n
+			out = append(out, prefTopic{Name: names[topic]})
+		}
+
+		out[n].Lists = append(out[n].Lists, prefList{
+			ID:          l.ID,
+			UUID:        l.UUID,
+			Name:        l.Name,
+			Description: l.Description,
+			Subscribed:  subbed[l.ID],
+		})
 	}
 
-	return c.Render(http.StatusOK, tplMessage,
-		makeMsgTpl(app.i18n.T("globals.messages.done"), "", app.i18n.T("public.prefsSaved")))
+	if len(out[0].Lists) == 0 {
+		out = out[1:]
+	}
+
+	return out
 }
 
 // handleOptinPage renders the double opt-in confirmation page that subscribers
@@ -349,8 +558,13 @@ func handleOptinPage(c echo.Context) error {
 		out        = optinTpl{}
 	)
 	out.SubUUID = subUUID
-	out.Title = app.i18n.T("public.confirmOptinSubTitle")
-	out.SubUUID = subUUID
+
+	// The pages are rendered in the subscriber's language, if the subscriber exists.
+	i := app.i18n
+	if sub, err := app.core.GetSubscriberByUUID(subUUID); err == nil {
+		i = setSubscriberI18n(c, sub)
+	}
+	out.Title = i.T("public.confirmOptinSubTitle")
 
 	// Get and validate fields.
 	if err := c.Bind(&out); err != nil {
@@ -362,7 +576,7 @@ func handleOptinPage(c echo.Context) error {
 		for _, l := range out.ListUUIDs {
 			if !reUUID.MatchString(l) {
 				return c.Render(http.StatusBadRequest, tplMessage,
-					makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.T("globals.messages.invalidUUID")))
+					makeMsgTpl(i.T("public.errorTitle"), "", i.T("globals.messages.invalidUUID")))
 			}
 		}
 	}
@@ -371,13 +585,13 @@ func handleOptinPage(c echo.Context) error {
 	lists, err := app.core.GetSubscriberLists(0, subUUID, nil, out.ListUUIDs, models.SubscriptionStatusUnconfirmed, "")
 	if err != nil {
 		return c.Render(http.StatusInternalServerError, tplMessage,
-			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.Ts("public.errorFetchingLists")))
+			makeMsgTpl(i.T("public.errorTitle"), "", i.Ts("public.errorFetchingLists")))
 	}
 
 	// There are no lists to confirm.
 	if len(lists) == 0 {
 		return c.Render(http.StatusOK, tplMessage,
-			makeMsgTpl(app.i18n.T("public.noSubTitle"), "", app.i18n.Ts("public.noSubInfo")))
+			makeMsgTpl(i.T("public.noSubTitle"), "", i.Ts("public.noSubInfo")))
 	}
 	out.Lists = lists
 
@@ -385,21 +599,30 @@ func handleOptinPage(c echo.Context) error {
 	if confirm {
 		meta := models.JSON{}
 		if app.constants.Privacy.RecordOptinIP {
+			ip := ""
 			if h := c.Request().Header.Get("X-Forwarded-For"); h != "" {
-				meta["optin_ip"] = h
+				ip = h
 			} else if h := c.Request().RemoteAddr; h != "" {
-				meta["optin_ip"] = strings.Split(h, ":")[0]
+				ip = strings.Split(h, ":")[0]
+			}
+
+			// In the privacy mode, only anonymized IPs are recorded.
+			if app.constants.Privacy.PrivacyMode {
+				ip = anonymizeIPs(ip)
+			}
+			if ip != "" {
+				meta["optin_ip"] = ip
 			}
 		}
 
 		if err := app.core.ConfirmOptionSubscription(subUUID, out.ListUUIDs, meta); err != nil {
 			app.log.Printf("error unsubscribing: %v", err)
 			return c.Render(http.StatusInternalServerError, tplMessage,
-				makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.Ts("public.errorProcessingRequest")))
+				makeMsgTpl(i.T("public.errorTitle"), "", i.Ts("public.errorProcessingRequest")))
 		}
 
 		return c.Render(http.StatusOK, tplMessage,
-			makeMsgTpl(app.i18n.T("public.subConfirmedTitle"), "", app.i18n.Ts("public.subConfirmed")))
+			makeMsgTpl(i.T("public.subConfirmedTitle"), "", i.Ts("public.subConfirmed")))
 	}
 
 	return c.Render(http.StatusOK, "optin", out)
@@ -418,7 +641,7 @@ func handleSubscriptionFormPage(c echo.Context) error {
 	}
 
 	// Get all public lists.
-	lists, err := app.core.GetLists(models.ListTypePublic)
+	lists, err := app.core.GetLists(models.ListTypePublic, false)
 	if err != nil {
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl(app.i18n.T("public.errorTitle"), "", app.i18n.Ts("public.errorFetchingLists")))
@@ -435,6 +658,7 @@ func handleSubscriptionFormPage(c echo.Context) error {
 
 	if app.constants.Security.EnableCaptcha {
 		out.CaptchaKey = app.constants.Security.CaptchaKey
+		out.CaptchaProvider = app.constants.Security.CaptchaProvider
 	}
 
 	return c.Render(http.StatusOK, "subscription-form", out)
@@ -454,9 +678,12 @@ func handleSubscriptionForm(c echo.Context) error {
 
 	// Process CAPTCHA.
 	if app.constants.Security.EnableCaptcha {
-		err, ok := app.captcha.Verify(c.FormValue("h-captcha-response"))
+		ok, err := app.captcha.Verify(c.FormValue(app.captcha.Field()))
 		if err != nil {
 			app.log.Printf("Captcha request failed: %v", err)
+
+			// The token couldn't be verified. Let it through in the lenient mode.
+			ok = !app.constants.Security.CaptchaStrict
 		}
 
 		if !ok {
@@ -521,12 +748,20 @@ func handleLinkRedirect(c echo.Context) error {
 		subUUID = ""
 	}
 
-	url, err := app.core.RegisterCampaignLinkClick(linkUUID, campUUID, subUUID)
+	// Optional A/B subject variant the subscriber was sent.
+	variantID, _ := strconv.Atoi(c.QueryParam("v"))
+
+	url, err := app.core.RegisterCampaignLinkClick(linkUUID, campUUID, subUUID, variantID)
 	if err != nil {
 		e := err.(*echo.HTTPError)
 		return c.Render(e.Code, tplMessage, makeMsgTpl(app.i18n.T("public.errorTitle"), "", e.Error()))
 	}
 
+	// In the privacy mode, strip click identifiers from the destination.
+	if app.constants.Privacy.PrivacyMode {
+		url = stripClickIDs(url)
+	}
+
 	return c.Redirect(http.StatusTemporaryRedirect, url)
 }
 
@@ -546,9 +781,13 @@ func handleRegisterCampaignView(c echo.Context) error {
 		subUUID = ""
 	}
 
-	// Exclude dummy hits from template previews.
-	if campUUID != dummyUUID && subUUID != dummyUUID {
-		if err := app.core.RegisterCampaignView(campUUID, subUUID); err != nil {
+	// Exclude dummy hits from template previews, and record nothing if
+	// view tracking is disabled globally.
+	if campUUID != dummyUUID && subUUID != dummyUUID && app.constants.Privacy.TrackViews {
+		// Optional A/B subject variant the subscriber was sent.
+		variantID, _ := strconv.Atoi(c.QueryParam("v"))
+
+		if err := app.core.RegisterCampaignView(campUUID, subUUID, variantID); err != nil {
 			app.log.Printf("error registering campaign view: %s", err)
 		}
 	}
@@ -557,6 +796,54 @@ func handleRegisterCampaignView(c echo.Context) error {
 	return c.Blob(http.StatusOK, "image/png", pixelPNG)
 }
 
+// Query params of ad and e-mail platforms' click identifiers
+// that are stripped from links in the privacy mode.
+var clickIDParams = []string{
+	"gclid", "gbraid", "wbraid", "dclid", "fbclid", "msclkid", "yclid", "twclid",
+	"ttclid", "li_fat_id", "igshid", "mc_cid", "mc_eid", "_hsenc", "_hsmi", "mkt_tok",
+}
+
+// stripClickIDs removes click identifier query params from a URL.
+func stripClickIDs(u string) string {
+	p, err := url.Parse(u)
+	if err != nil || p.RawQuery == "" {
+		return u
+	}
+
+	q := p.Query()
+	n := len(q)
+	for _, k := range clickIDParams {
+		q.Del(k)
+	}
+	if len(q) == n {
+		return u
+	}
+
+	p.RawQuery = q.Encode()
+	return p.String()
+}
+
+// anonymizeIPs anonymizes a comma separated list of IPs (eg: X-Forwarded-For) by
+// zeroing the last octet of IPv4 addresses and the last 80 bits of IPv6 addresses.
+// Values that aren't IPs are dropped.
+func anonymizeIPs(ips string) string {
+	var out []string
+	for _, s := range strings.Split(ips, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil {
+			continue
+		}
+
+		if v4 := ip.To4(); v4 != nil {
+			out = append(out, v4.Mask(net.CIDRMask(24, 32)).String())
+		} else {
+			out = append(out, ip.Mask(net.CIDRMask(48, 128)).String())
+		}
+	}
+
+	return strings.Join(out, ", ")
+}
+
 // handleSelfExportSubscriberData pulls the subscriber's profile, list subscriptions,
 // campaign views and clicks and produces a JSON report that is then e-mailed
 // to the subscriber. This is a privacy feature and the data that's exported
@@ -701,7 +988,25 @@ func processSubForm(c echo.Context) (bool, error) {
 		return false, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.invalidName"))
 	}
 
-	listUUIDs := pq.StringArray(req.FormListUUIDs)
+	// Archived lists can't be subscribed to.
+	lists, err := app.core.GetLists("", false)
+	if err != nil {
+		return false, err
+	}
+	active := make(map[string]bool, len(lists))
+	for _, l := range lists {
+		active[l.UUID] = true
+	}
+
+	listUUIDs := make(pq.StringArray, 0, len(req.FormListUUIDs))
+	for _, u := range req.FormListUUIDs {
+		if active[strings.ToLower(strings.TrimSpace(u))] {
+			listUUIDs = append(listUUIDs, u)
+		}
+	}
+	if len(listUUIDs) == 0 {
+		return false, echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.noListsSelected"))
+	}
 
 	// Insert the subscriber into the DB.
 	_, hasOptin, err := app.core.InsertSubscriber(models.Subscriber{
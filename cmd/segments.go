@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+type segmentReq struct {
+	Name    string `json:"name"`
+	Query   string `json:"query"`
+	ListIDs []int  `json:"list_ids"`
+}
+
+// handleGetSegments returns all saved segments or a single segment by :id.
+func handleGetSegments(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id > 0 {
+		out, err := app.core.GetSegment(id)
+		if err != nil {
+			return err
+		}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	out, err := app.core.GetSegments()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateSegment saves a new segment.
+func handleCreateSegment(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	req, err := validateSegmentReq(c, app)
+	if err != nil {
+		return err
+	}
+
+	out, err := app.core.CreateSegment(req.Name, req.Query, req.ListIDs)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateSegment updates a saved segment.
+func handleUpdateSegment(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	req, err := validateSegmentReq(c, app)
+	if err != nil {
+		return err
+	}
+
+	out, err := app.core.UpdateSegment(id, req.Name, req.Query, req.ListIDs)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDeleteSegment deletes a saved segment.
+func handleDeleteSegment(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.core.DeleteSegment(id); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleUpdateCampaignSegment sets (or with segment_id = 0, clears) the saved
+// segment that a campaign targets.
+func handleUpdateCampaignSegment(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req struct {
+		SegmentID int `json:"segment_id"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	out, err := app.core.UpdateCampaignSegment(id, req.SegmentID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+func validateSegmentReq(c echo.Context, app *App) (segmentReq, error) {
+	var req segmentReq
+	if err := c.Bind(&req); err != nil {
+		return req, err
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if !strHasLen(req.Name, 1, stdInputMaxLen) {
+		return req, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "name"))
+	}
+
+	if req.ListIDs == nil {
+		req.ListIDs = []int{}
+	}
+
+	return req, nil
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"regexp"
 	"runtime"
 	"strings"
@@ -17,6 +19,9 @@ import (
 	"github.com/knadh/koanf/parsers/json"
 	"github.com/knadh/koanf/providers/rawbytes"
 	"github.com/knadh/koanf/v2"
+	"github.com/knadh/listmonk/internal/captcha"
+	"github.com/knadh/listmonk/internal/domains"
+	"github.com/knadh/listmonk/internal/media/providers/s3"
 	"github.com/knadh/listmonk/internal/messenger/email"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
@@ -44,6 +49,11 @@ type about struct {
 	Host      aboutHost      `json:"host"`
 }
 
+// throttleResp is the global message throttle in messages per second. 0 is unlimited.
+type throttleResp struct {
+	Rate int `json:"rate"`
+}
+
 var (
 	reAlphaNum = regexp.MustCompile(`[^a-z0-9\-]`)
 )
@@ -71,6 +81,11 @@ func handleGetSettings(c echo.Context) error {
 	s.SendgridKey = strings.Repeat(pwdMask, utf8.RuneCountInString(s.SendgridKey))
 	s.SecurityCaptchaSecret = strings.Repeat(pwdMask, utf8.RuneCountInString(s.SecurityCaptchaSecret))
 	s.BouncePostmark.Password = strings.Repeat(pwdMask, utf8.RuneCountInString(s.BouncePostmark.Password))
+	s.BounceSparkPost.Password = strings.Repeat(pwdMask, utf8.RuneCountInString(s.BounceSparkPost.Password))
+	s.SMS.Password = strings.Repeat(pwdMask, utf8.RuneCountInString(s.SMS.Password))
+	for i := 0; i < len(s.DKIM.Keys); i++ {
+		s.DKIM.Keys[i].PrivateKey = strings.Repeat(pwdMask, utf8.RuneCountInString(s.DKIM.Keys[i].PrivateKey))
+	}
 
 	return c.JSON(http.StatusOK, okResp{s})
 }
@@ -108,6 +123,11 @@ func handleUpdateSettings(c echo.Context) error {
 			set.SMTP[i].UUID = uuid.Must(uuid.NewV4()).String()
 		}
 
+		if s.Weight < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "smtp.weight"))
+		}
+
 		// Ensure the HOST is trimmed of any whitespace.
 		// This is a common mistake when copy-pasting SMTP settings.
 		set.SMTP[i].Host = strings.TrimSpace(s.Host)
@@ -142,6 +162,10 @@ func handleUpdateSettings(c echo.Context) error {
 		// This is a common mistake when copy-pasting SMTP settings.
 		set.BounceBoxes[i].Host = strings.TrimSpace(s.Host)
 
+		if s.Type != "pop" && s.Type != "imap" {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": bounce mailbox type should be pop or imap")
+		}
+
 		if d, _ := time.ParseDuration(s.ScanInterval); d.Minutes() < 1 {
 			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.bounces.invalidScanInterval"))
 		}
@@ -188,6 +212,62 @@ func handleUpdateSettings(c echo.Context) error {
 		names[name] = true
 	}
 
+	// Validate the SMS messenger. Its name shares the namespace with the other messengers.
+	if set.SMS.Password == "" {
+		set.SMS.Password = cur.SMS.Password
+	}
+	if set.SMS.Enabled {
+		name := reAlphaNum.ReplaceAllString(strings.ToLower(set.SMS.Name), "")
+		if _, ok := names[name]; ok {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.duplicateMessengerName", "name", name))
+		}
+		if len(name) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.invalidMessengerName"))
+		}
+		set.SMS.Name = name
+
+		if u, err := url.Parse(set.SMS.GatewayURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "sms.gateway_url"))
+		}
+
+		if _, err := time.ParseDuration(set.SMS.Timeout); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "sms.timeout"))
+		}
+	}
+
+	// Validate the DKIM keys. If there's no private key coming in from the frontend,
+	// copy the existing key by matching the domain and selector.
+	dkimDomains := make(map[string]bool, len(set.DKIM.Keys))
+	for i, k := range set.DKIM.Keys {
+		k.Domain = strings.ToLower(strings.TrimSpace(k.Domain))
+		if dkimDomains[k.Domain] {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": duplicate DKIM domain "+k.Domain)
+		}
+		dkimDomains[k.Domain] = true
+
+		if k.PrivateKey == "" {
+			for _, c := range cur.DKIM.Keys {
+				if strings.EqualFold(c.Domain, k.Domain) && c.Selector == k.Selector {
+					k.PrivateKey = c.PrivateKey
+				}
+			}
+		}
+
+		if _, err := email.NewDKIMSigner(email.DKIMKey{
+			Domain:     k.Domain,
+			Selector:   k.Selector,
+			PrivateKey: k.PrivateKey,
+			Headers:    k.Headers,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": "+err.Error())
+		}
+
+		set.DKIM.Keys[i] = k
+	}
+
 	// S3 password?
 	if set.UploadS3AwsSecretAccessKey == "" {
 		set.UploadS3AwsSecretAccessKey = cur.UploadS3AwsSecretAccessKey
@@ -198,6 +278,9 @@ func handleUpdateSettings(c echo.Context) error {
 	if set.BouncePostmark.Password == "" {
 		set.BouncePostmark.Password = cur.BouncePostmark.Password
 	}
+	if set.BounceSparkPost.Password == "" {
+		set.BounceSparkPost.Password = cur.BounceSparkPost.Password
+	}
 	if set.SecurityCaptchaSecret == "" {
 		set.SecurityCaptchaSecret = cur.SecurityCaptchaSecret
 	}
@@ -206,15 +289,143 @@ func handleUpdateSettings(c echo.Context) error {
 		set.UploadExtensions[n] = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(v), "."))
 	}
 
-	// Domain blocklist.
-	doms := make([]string, 0)
-	for _, d := range set.DomainBlocklist {
-		d = strings.TrimSpace(strings.ToLower(d))
-		if d != "" {
-			doms = append(doms, d)
+	// Domain blocklist and allowlist.
+	set.DomainBlocklist = domains.Clean(set.DomainBlocklist)
+	set.DomainAllowlist = domains.Clean(set.DomainAllowlist)
+
+	// Validate the CAPTCHA provider.
+	switch set.SecurityCaptchaProvider {
+	case captcha.ProviderHCaptcha, captcha.ProviderTurnstile:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": captcha provider should be hcaptcha or turnstile")
+	}
+
+	// Validate the public rate limit.
+	set.SecurityTrustedProxyHeader = strings.TrimSpace(set.SecurityTrustedProxyHeader)
+	if set.SecurityPublicRateLimitEnabled {
+		if set.SecurityPublicRateLimitRequests < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": public rate limit requests should be at least 1")
+		}
+		if d, err := time.ParseDuration(set.SecurityPublicRateLimitWindow); err != nil || d < time.Second {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": public rate limit window should be at least 1s")
+		}
+	}
+
+	// Validate the opt-in reminder interval.
+	if set.AppOptinReminderMax > 0 {
+		if d, err := time.ParseDuration(set.AppOptinReminderInterval); err != nil || d < time.Hour {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": opt-in reminder interval should be at least 1h")
+		}
+	}
+
+	// Validate the archived subscriber retention period.
+	if d, err := time.ParseDuration(set.AppArchivedSubscriberRetention); err != nil || d < time.Hour {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": archived subscriber retention should be at least 1h")
+	}
+
+	// Validate the stale subscriber retention periods.
+	for _, r := range []string{set.AppUnconfirmedSubscriberRetention, set.AppUnsubscribedSubscriberRetention} {
+		if d, err := time.ParseDuration(r); err != nil || (d != 0 && d < time.Hour) {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": stale subscriber retention should be 0 (disabled) or at least 1h")
+		}
+	}
+
+	// Validate the engagement score formula.
+	if set.AppEngagementOpenWeight < 0 || set.AppEngagementClickWeight < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": engagement weights should be 0 or more")
+	}
+	if d, err := time.ParseDuration(set.AppEngagementHalfLife); err != nil || d < time.Hour {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": engagement half-life should be at least 1h")
+	}
+
+	if set.AppCampaignTriggerMaxRecipients < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": max campaign trigger recipients should be at least 1")
+	}
+
+	// Validate the subscriber attribute JSON schema.
+	set.AppSubscriberAttribsSchema = strings.TrimSpace(set.AppSubscriberAttribsSchema)
+	if _, err := compileAttribsSchema(set.AppSubscriberAttribsSchema); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": attribute schema: "+err.Error())
+	}
+
+	// Validate the A/B campaign variant sample settings.
+	if set.AppCampaignVariantSampleSize < 0 || set.AppCampaignVariantSampleSize > 100 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": variant sample size should be between 0 and 100")
+	}
+	if _, err := time.ParseDuration(set.AppCampaignVariantSampleWindow); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": variant sample window: "+err.Error())
+	}
+
+	// Validate the recurring campaign catch-up policy.
+	switch set.AppRecurringCampaignCatchup {
+	case recurringCatchupSkip, recurringCatchupOnce, recurringCatchupAll:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": recurring campaign catch-up should be skip, once, or all")
+	}
+
+	// Validate the default send window time zone.
+	if _, err := time.LoadLocation(set.AppSendWindowTimezone); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": send window time zone: "+err.Error())
+	}
+
+	if set.AppMessageThrottle < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": message throttle should be >= 0")
+	}
+
+	if set.AppMaxCampaignVersions < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": max campaign versions should be >= 0")
+	}
+
+	// Validate the default UTM params that may have template expressions.
+	utm := models.CampaignUTM{
+		Source:   strings.TrimSpace(set.AppUTMSource),
+		Medium:   strings.TrimSpace(set.AppUTMMedium),
+		Campaign: strings.TrimSpace(set.AppUTMCampaign),
+		Content:  strings.TrimSpace(set.AppUTMContent),
+	}
+	if _, err := utm.Compile(app.manager.GenericTemplateFuncs()); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": UTM params: "+err.Error())
+	}
+	set.AppUTMSource, set.AppUTMMedium, set.AppUTMCampaign, set.AppUTMContent = utm.Source, utm.Medium, utm.Campaign, utm.Content
+
+	// The sandbox mode can only be turned on if listmonk was started with --sandbox.
+	if set.AppSandboxEnabled {
+		if !ko.Bool("sandbox") {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": sandbox mode requires listmonk to be started with --sandbox")
+		}
+
+		em, err := app.importer.ParseEmail(set.AppSandboxEmail)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": sandbox e-mail: "+err.Error())
+		}
+		set.AppSandboxEmail = em
+	}
+
+	if set.UploadS3URLMode == "" {
+		set.UploadS3URLMode = s3.URLModeAuto
+	}
+	switch set.UploadS3URLMode {
+	case s3.URLModeAuto, s3.URLModePublic, s3.URLModePresigned:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+": S3 URL mode should be auto, public, or presigned")
+	}
+
+	if err := app.core.ValidateBounceRules(set.BounceRules); err != nil {
+		return err
+	}
+	if set.BounceRules == nil {
+		set.BounceRules = []models.BounceRule{}
+	}
+
+	// Validate image variant widths.
+	if len(set.UploadImageVariantWidths) > maxImageVariants {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+fmt.Sprintf(": max %d image variant widths are allowed", maxImageVariants))
+	}
+	for _, w := range set.UploadImageVariantWidths {
+		if w < 1 || w > maxImageVariantWidth {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidData")+fmt.Sprintf(": image variant widths should be between 1 and %d", maxImageVariantWidth))
 		}
 	}
-	set.DomainBlocklist = doms
 
 	// Validate slow query caching cron.
 	if set.CacheSlowQueries {
@@ -249,12 +460,84 @@ func handleUpdateSettings(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleGetThrottle returns the global message throttle that's currently in effect.
+func handleGetThrottle(c echo.Context) error {
+	app := c.Get("app").(*App)
+	return c.JSON(http.StatusOK, okResp{throttleResp{Rate: app.manager.GetMessageThrottle()}})
+}
+
+// handleUpdateThrottle changes the global message throttle on the fly, without
+// restarting the app, and saves it to the settings.
+func handleUpdateThrottle(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	var req throttleResp
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.Rate < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "rate"))
+	}
+
+	if err := app.core.SetMessageThrottle(req.Rate); err != nil {
+		return err
+	}
+	app.manager.SetMessageThrottle(req.Rate)
+
+	return handleGetThrottle(c)
+}
+
+// handleGetDomainRules returns the domain block and allow rules that are in effect.
+func handleGetDomainRules(c echo.Context) error {
+	app := c.Get("app").(*App)
+	return c.JSON(http.StatusOK, okResp{app.domains.Get()})
+}
+
+// handleUpdateDomainRules changes the domain block and allow rules on the fly,
+// without restarting the app, and saves them to the settings.
+func handleUpdateDomainRules(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	var req models.DomainRules
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	req.Blocklist = domains.Clean(req.Blocklist)
+	req.Allowlist = domains.Clean(req.Allowlist)
+	for _, d := range append(req.Blocklist, req.Allowlist...) {
+		if strings.Contains(strings.TrimPrefix(d, "*."), "*") || strings.ContainsAny(d, "@ ") {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", d))
+		}
+	}
+
+	if err := app.core.SetDomainRules(req); err != nil {
+		return err
+	}
+	app.domains.Load(req)
+
+	return handleGetDomainRules(c)
+}
+
 // handleGetLogs returns the log entries stored in the log buffer.
 func handleGetLogs(c echo.Context) error {
 	app := c.Get("app").(*App)
 	return c.JSON(http.StatusOK, okResp{app.bufLog.Lines()})
 }
 
+// handleGetSMTPHealth returns the health of the SMTP servers in the rotation.
+func handleGetSMTPHealth(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	e, ok := app.messengers[emailMsgr].(*email.Emailer)
+	if !ok {
+		return c.JSON(http.StatusOK, okResp{[]email.ServerHealth{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{e.Health()})
+}
+
 // handleTestSMTPSettings returns the log entries stored in the log buffer.
 func handleTestSMTPSettings(c echo.Context) error {
 	app := c.Get("app").(*App)
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,7 +8,9 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/knadh/listmonk/internal/core"
 	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
@@ -17,6 +18,9 @@ import (
 
 const (
 	dummyUUID = "00000000-0000-0000-0000-000000000000"
+
+	// Pause between the batches of a bulk blocklist or unblocklist by query.
+	bulkActionBatchWait = time.Millisecond * 100
 )
 
 // subQueryReq is a "catch all" struct for reading various
@@ -28,6 +32,10 @@ type subQueryReq struct {
 	SubscriberIDs []int  `json:"ids"`
 	Action        string `json:"action"`
 	Status        string `json:"status"`
+
+	// If set, bulk blocklisting by query only returns the number of subscribers
+	// that would be affected along with a sample of them.
+	DryRun bool `json:"dry_run"`
 }
 
 // subProfileData represents a subscriber's collated data in JSON
@@ -81,6 +89,35 @@ func handleGetSubscriber(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
+// handleGetSubscriberActivity retrieves the paginated activity timeline of a subscriber
+// optionally filtered by one or more event types.
+func handleGetSubscriberActivity(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		pg    = app.paginator.NewFromURL(c.Request().URL.Query())
+		types = c.QueryParams()["type"]
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	res, total, err := app.core.GetSubscriberActivity(id, types, pg.Offset, pg.Limit)
+	if err != nil {
+		return err
+	}
+
+	out := models.PageResults{
+		Results: res,
+		Total:   total,
+		Page:    pg.Page,
+		PerPage: pg.PerPage,
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
 // handleQuerySubscribers handles querying subscribers based on an arbitrary SQL expression.
 func handleQuerySubscribers(c echo.Context) error {
 	var (
@@ -101,6 +138,15 @@ func handleQuerySubscribers(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
+	// Limit the subscribers to all the lists in a list group?
+	if groupID, _ := strconv.Atoi(c.FormValue("list_group_id")); groupID > 0 {
+		ids, err := app.core.GetListGroupIDs(groupID)
+		if err != nil {
+			return err
+		}
+		listIDs = append(listIDs, ids...)
+	}
+
 	res, total, err := app.core.QuerySubscribers(query, listIDs, subStatus, order, orderBy, pg.Offset, pg.Limit)
 	if err != nil {
 		return err
@@ -115,7 +161,37 @@ func handleQuerySubscribers(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
+// handleSearchSubscribers handles structured subscriber searches by field filters,
+// a safer alternative to querying subscribers by arbitrary SQL expressions.
+func handleSearchSubscribers(c echo.Context) error {
+	var (
+		app     = c.Get("app").(*App)
+		pg      = app.paginator.NewFromURL(c.Request().URL.Query())
+		orderBy = c.QueryParam("order_by")
+		order   = c.QueryParam("order")
+		out     models.PageResults
+	)
+
+	var req models.SubscriberSearch
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	res, total, err := app.core.SearchSubscribers(req, order, orderBy, pg.Offset, pg.Limit)
+	if err != nil {
+		return err
+	}
+
+	out.Results = res
+	out.Total = total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
 // handleExportSubscribers handles querying subscribers based on an arbitrary SQL expression.
+// If an ?email= is given, the complete data of that single subscriber is exported instead.
 func handleExportSubscribers(c echo.Context) error {
 	var (
 		app = c.Get("app").(*App)
@@ -124,6 +200,10 @@ func handleExportSubscribers(c echo.Context) error {
 		query = sanitizeSQLExp(c.FormValue("query"))
 	)
 
+	if email := c.QueryParam("email"); email != "" {
+		return handleExportSubscriberDossier(c, email)
+	}
+
 	// Limit the subscribers to specific lists?
 	listIDs, err := getQueryInts("list_id", c.QueryParams())
 	if err != nil {
@@ -139,45 +219,36 @@ func handleExportSubscribers(c echo.Context) error {
 	// Filter by subscription status
 	subStatus := c.QueryParam("subscription_status")
 
+	// Export format. The lightweight format is the default.
+	format := c.QueryParam("format")
+	if format == "" {
+		format = core.ExportFormatLite
+	}
+	if format != core.ExportFormatLite && format != core.ExportFormatFull {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "format"))
+	}
+
 	// Get the batched export iterator.
-	exp, err := app.core.ExportSubscribers(query, subIDs, listIDs, subStatus, app.constants.DBBatchSize)
+	exp, err := app.core.ExportSubscribers(query, subIDs, listIDs, subStatus, format, app.constants.DBBatchSize)
 	if err != nil {
 		return err
 	}
 
-	var (
-		h  = c.Response().Header()
-		wr = csv.NewWriter(c.Response())
-	)
-
-	h.Set(echo.HeaderContentType, echo.MIMEOctetStream)
-	h.Set("Content-type", "text/csv")
+	// There's no Content-Length as the rows are streamed in batches,
+	// which makes the response use chunked transfer encoding.
+	h := c.Response().Header()
+	h.Set(echo.HeaderContentType, "text/csv; charset=utf-8")
 	h.Set(echo.HeaderContentDisposition, "attachment; filename="+"subscribers.csv")
-	h.Set("Content-Transfer-Encoding", "binary")
 	h.Set("Cache-Control", "no-cache")
-	wr.Write([]string{"uuid", "email", "name", "attributes", "status", "created_at", "updated_at"})
+	c.Response().WriteHeader(http.StatusOK)
 
-loop:
-	// Iterate in batches until there are no more subscribers to export.
-	for {
-		out, err := exp()
-		if err != nil {
+	if err := core.WriteSubscribersCSV(c.Response(), format, exp, c.Response().Flush); err != nil {
+		// Errors fetching the subscribers are returned as is. The rest are errors
+		// writing to the client, eg: on disconnecting.
+		if _, ok := err.(*echo.HTTPError); ok {
 			return err
 		}
-		if out == nil || len(out) == 0 {
-			break
-		}
-
-		for _, r := range out {
-			if err = wr.Write([]string{r.UUID, r.Email, r.Name, r.Attribs, r.Status,
-				r.CreatedAt.Time.String(), r.UpdatedAt.Time.String()}); err != nil {
-				app.log.Printf("error streaming CSV export: %v", err)
-				break loop
-			}
-		}
-
-		// Flush CSV to stream after each batch.
-		wr.Flush()
+		app.log.Printf("error streaming CSV export: %v", err)
 	}
 
 	return nil
@@ -396,6 +467,15 @@ func handleDeleteSubscribers(c echo.Context) error {
 		subIDs = i
 	}
 
+	// Archive (soft delete) the subscribers instead of deleting them permanently?
+	if archive, _ := strconv.ParseBool(c.QueryParam("archive")); archive {
+		if _, err := app.core.ArchiveSubscribers(subIDs); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, okResp{true})
+	}
+
 	if err := app.core.DeleteSubscribers(subIDs, nil); err != nil {
 		return err
 	}
@@ -403,6 +483,128 @@ func handleDeleteSubscribers(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleArchiveSubscribers handles archiving (soft deleting) and restoring subscribers,
+// either a single one (ID in the URI), or a list of IDs in the request body.
+func handleArchiveSubscribers(c echo.Context) error {
+	var (
+		app     = c.Get("app").(*App)
+		pID     = c.Param("id")
+		restore = strings.HasSuffix(c.Path(), "/restore")
+		subIDs  []int
+	)
+
+	// Is it a /:id call?
+	if pID != "" {
+		id, _ := strconv.Atoi(pID)
+		if id < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+		}
+
+		subIDs = append(subIDs, id)
+	} else {
+		// Multiple IDs.
+		var req subQueryReq
+		if err := c.Bind(&req); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.errorInvalidIDs", "error", err.Error()))
+		}
+		if len(req.SubscriberIDs) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.errorNoIDs"))
+		}
+
+		subIDs = req.SubscriberIDs
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if restore {
+		n, err = app.core.RestoreSubscribers(subIDs)
+	} else {
+		n, err = app.core.ArchiveSubscribers(subIDs)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		Count int `json:"count"`
+	}{n}})
+}
+
+// handleGetDuplicateSubscribers returns groups of subscribers that share the same
+// value at a given attribs key (?key=customer.id).
+func handleGetDuplicateSubscribers(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		key = strings.TrimSpace(c.QueryParam("key"))
+	)
+
+	if key == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "key"))
+	}
+
+	out, err := app.core.FindDuplicateSubscribers(key)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleMergeSubscribers merges the given duplicate subscribers into the subscriber :id.
+func handleMergeSubscribers(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var req subQueryReq
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.errorInvalidIDs", "error", err.Error()))
+	}
+	if len(req.SubscriberIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("subscribers.errorNoIDs"))
+	}
+
+	out, err := app.core.MergeSubscribers(id, req.SubscriberIDs)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleEraseSubscriber permanently erases a subscriber and their data by e-mail
+// (right to be forgotten) and returns the number of related records removed or anonymized.
+func handleEraseSubscriber(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(req.Email) == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "email"))
+	}
+
+	out, err := app.core.EraseSubscriber(req.Email)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
 // handleDeleteSubscribersByQuery bulk deletes based on an
 // arbitrary SQL expression.
 func handleDeleteSubscribersByQuery(c echo.Context) error {
@@ -422,9 +624,54 @@ func handleDeleteSubscribersByQuery(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
-// handleBlocklistSubscribersByQuery bulk blocklists subscribers
+// handleBlocklistSubscribersByQuery bulk blocklists or unblocklists subscribers
 // based on an arbitrary SQL expression.
 func handleBlocklistSubscribersByQuery(c echo.Context) error {
+	var (
+		app       = c.Get("app").(*App)
+		blocklist = !strings.HasSuffix(c.Path(), "/unblocklist")
+		req       subQueryReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	// Dry run.
+	if req.DryRun {
+		total, res, err := app.core.PreviewBlocklistByQuery(req.Query, req.ListIDs, blocklist)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, okResp{struct {
+			Total   int                `json:"total"`
+			Results models.Subscribers `json:"results"`
+		}{total, res}})
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if blocklist {
+		n, err = app.core.BlocklistSubscribersByQuery(req.Query, req.ListIDs, app.constants.DBBatchSize, bulkActionBatchWait)
+	} else {
+		n, err = app.core.UnblocklistSubscribersByQuery(req.Query, req.ListIDs, app.constants.DBBatchSize, bulkActionBatchWait)
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		Total int `json:"total"`
+	}{n}})
+}
+
+// handlePreviewSubscribersByQuery does a dry run of an arbitrary SQL expression
+// and returns the number of subscribers that a query based bulk action would
+// affect along with a sample of them.
+func handlePreviewSubscribersByQuery(c echo.Context) error {
 	var (
 		app = c.Get("app").(*App)
 		req subQueryReq
@@ -434,11 +681,15 @@ func handleBlocklistSubscribersByQuery(c echo.Context) error {
 		return err
 	}
 
-	if err := app.core.BlocklistSubscribersByQuery(req.Query, req.ListIDs); err != nil {
+	total, res, err := app.core.PreviewSubscriberQuery(req.Query, req.ListIDs)
+	if err != nil {
 		return err
 	}
 
-	return c.JSON(http.StatusOK, okResp{true})
+	return c.JSON(http.StatusOK, okResp{struct {
+		Total   int                `json:"total"`
+		Results models.Subscribers `json:"results"`
+	}{total, res}})
 }
 
 // handleManageSubscriberListsByQuery bulk adds/removes/unsubscribes subscribers
@@ -527,6 +778,21 @@ func handleExportSubscriberData(c echo.Context) error {
 	return c.Blob(http.StatusOK, "application/json", b)
 }
 
+// handleExportSubscriberDossier exports the complete data of the subscriber with
+// the given e-mail for data subject access (GDPR) requests.
+func handleExportSubscriberDossier(c echo.Context, email string) error {
+	app := c.Get("app").(*App)
+
+	b, err := app.core.ExportSubscriberData(email)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().Header().Set("Content-Disposition", `attachment; filename="data.json"`)
+	return c.Blob(http.StatusOK, "application/json", b)
+}
+
 // exportSubscriberData collates the data of a subscriber including profile,
 // subscriptions, campaign_views, link_clicks (if they're enabled in the config)
 // and returns a formatted, indented JSON payload. Either takes a numeric id
@@ -622,8 +888,9 @@ func sendOptinConfirmationHook(app *App) func(sub models.Subscriber, listIDs []i
 		out.OptinURL = fmt.Sprintf(app.constants.OptinURL, sub.UUID, qListIDs.Encode())
 		out.UnsubURL = fmt.Sprintf(app.constants.UnsubURL, dummyUUID, sub.UUID)
 
-		// Send the e-mail.
-		if err := app.sendNotification([]string{sub.Email}, app.i18n.T("subscribers.optinSubject"), notifSubscriberOptin, out); err != nil {
+		// Send the e-mail in the subscriber's language.
+		i := app.subscriberI18n(sub.Attribs, lists)
+		if err := app.sendI18nNotification([]string{sub.Email}, i.T("subscribers.optinSubject"), notifSubscriberOptin, out, i); err != nil {
 			app.log.Printf("error sending opt-in e-mail for subscriber %d (%s): %s", sub.ID, sub.UUID, err)
 			return 0, err
 		}
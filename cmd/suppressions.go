@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// handleGetSuppressionStats returns the size of the global suppression list and
+// the number of subscriber insertions it has blocked.
+func handleGetSuppressionStats(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out, err := app.core.GetSuppressionStats()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleImportSuppressions adds the e-mails in an uploaded CSV or newline separated
+// file (`file`), or in the `emails` form field, to the global suppression list.
+// The first field of every CSV row that's an e-mail is picked, which skips headers.
+func handleImportSuppressions(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	var src io.Reader
+	if file, err := c.FormFile("file"); err == nil {
+		f, err := file.Open()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("import.invalidFile", "error", err.Error()))
+		}
+		defer f.Close()
+		src = f
+	} else if s := c.FormValue("emails"); s != "" {
+		src = strings.NewReader(s)
+	} else {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("globals.messages.invalidFields", "name", "file"))
+	}
+
+	rd := csv.NewReader(src)
+	rd.FieldsPerRecord = -1
+	rd.LazyQuotes = true
+	rd.TrimLeadingSpace = true
+
+	var emails []string
+	for {
+		row, err := rd.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("import.invalidFile", "error", err.Error()))
+		}
+
+		for _, f := range row {
+			if strings.Contains(f, "@") {
+				emails = append(emails, f)
+				break
+			}
+		}
+	}
+
+	added, invalid, err := app.core.ImportSuppressions(emails)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		Added   int `json:"added"`
+		Invalid int `json:"invalid"`
+	}{added, invalid}})
+}
+
+// handleExportSuppressions streams the global suppression list as a CSV.
+func handleExportSuppressions(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		exp = app.core.ExportSuppressions(app.constants.DBBatchSize)
+
+		h  = c.Response().Header()
+		wr = csv.NewWriter(c.Response())
+	)
+
+	h.Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	h.Set(echo.HeaderContentDisposition, "attachment; filename="+"suppressions.csv")
+	h.Set("Cache-Control", "no-cache")
+	c.Response().WriteHeader(http.StatusOK)
+	wr.Write([]string{"email", "blocked", "created_at"})
+
+loop:
+	for {
+		out, err := exp()
+		if err != nil {
+			return err
+		}
+		if len(out) == 0 {
+			break
+		}
+
+		for _, r := range out {
+			if err := wr.Write([]string{r.Email, strconv.Itoa(r.Blocked), r.CreatedAt.Time.String()}); err != nil {
+				app.log.Printf("error streaming CSV export: %v", err)
+				break loop
+			}
+		}
+
+		wr.Flush()
+		if err := wr.Error(); err != nil {
+			app.log.Printf("error streaming CSV export: %v", err)
+			break
+		}
+		c.Response().Flush()
+	}
+
+	return nil
+}
@@ -29,6 +29,11 @@ const (
 
 var (
 	regexpTplTag = regexp.MustCompile(`{{(\s+)?template\s+?"content"(\s+)?\.(\s+)?}}`)
+
+	regexpPartialName = regexp.MustCompile(`^[a-zA-Z0-9_\-]+$`)
+
+	// Matches the position in Go template errors, eg: template: base:3:12: msg
+	regexpTplErrPos = regexp.MustCompile(`^(.*?)template: [^:]+:(\d+):(?:(\d+):)? (.+)$`)
 )
 
 // handleGetTemplates handles retrieval of templates.
@@ -58,6 +63,19 @@ func handleGetTemplates(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
+// handleGetTemplateVariables returns the variables and functions that are
+// available in campaign templates, eg: for autocompletion in editors.
+func handleGetTemplateVariables(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out, err := app.core.GetTemplateVariables()
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
 // handlePreviewTemplate renders the HTML preview of a template.
 func handlePreviewTemplate(c echo.Context) error {
 	var (
@@ -94,45 +112,39 @@ func handlePreviewTemplate(c echo.Context) error {
 		tpl = t
 	}
 
-	// Compile the campaign template.
-	var out []byte
-	if tpl.Type == models.TemplateTypeCampaign {
-		camp := models.Campaign{
-			UUID:         dummyUUID,
-			Name:         app.i18n.T("templates.dummyName"),
-			Subject:      app.i18n.T("templates.dummySubject"),
-			FromEmail:    "dummy-campaign@listmonk.app",
-			TemplateBody: tpl.Body,
-			Body:         dummyTpl,
-		}
+	out, err := renderTemplatePreview(tpl, dummySubscriber, app)
+	if err != nil {
+		return err
+	}
 
-		if err := camp.CompileTemplate(app.manager.TemplateFuncs(&camp)); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest,
-				app.i18n.Ts("templates.errorCompiling", "error", err.Error()))
-		}
+	return c.HTML(http.StatusOK, string(out))
+}
 
-		// Render the message body.
-		msg, err := app.manager.NewCampaignMessage(&camp, dummySubscriber)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest,
-				app.i18n.Ts("templates.errorRendering", "error", err.Error()))
-		}
-		out = msg.Body()
-	} else {
-		// Compile transactional template.
-		if err := tpl.Compile(app.manager.GenericTemplateFuncs()); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
-		}
+// handlePreviewTemplateWithData renders a template against a sample subscriber
+// posted as JSON. Fields that aren't posted are taken from a dummy subscriber.
+func handlePreviewTemplateWithData(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
 
-		m := models.TxMessage{
-			Subject: tpl.Subject,
-		}
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
 
-		// Render the message.
-		if err := m.Render(dummySubscriber, &tpl); err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
-		}
-		out = m.Body
+	var sub models.Subscriber
+	if err := c.Bind(&sub); err != nil {
+		return err
+	}
+
+	tpl, err := app.core.GetTemplate(id, false)
+	if err != nil {
+		return err
+	}
+
+	out, err := renderTemplatePreview(tpl, withDummySubscriber(sub), app)
+	if err != nil {
+		return err
 	}
 
 	return c.HTML(http.StatusOK, string(out))
@@ -157,7 +169,7 @@ func handleCreateTemplate(c echo.Context) error {
 
 	// Subject is only relevant for fixed tx templates. For campaigns,
 	// the subject changes per campaign and is on models.Campaign.
-	if o.Type == models.TemplateTypeCampaign {
+	if o.Type == models.TemplateTypeCampaign || o.Type == models.TemplateTypePartial {
 		o.Subject = ""
 		f = app.manager.TemplateFuncs(nil)
 	} else {
@@ -169,12 +181,22 @@ func handleCreateTemplate(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
+	if o.Type == models.TemplateTypePartial {
+		if err := validatePartial(0, o, app); err != nil {
+			return err
+		}
+	}
+
 	// Create the template the in the DB.
 	out, err := app.core.CreateTemplate(o.Name, o.Type, o.Subject, []byte(o.Body))
 	if err != nil {
 		return err
 	}
 
+	if o.Type == models.TemplateTypePartial {
+		reloadPartials(app)
+	}
+
 	// If it's a transactional template, cache it in the manager
 	// to be used for arbitrary incoming tx message pushes.
 	if o.Type == models.TemplateTypeTx {
@@ -200,6 +222,13 @@ func handleUpdateTemplate(c echo.Context) error {
 		return err
 	}
 
+	// The type of a template can't be changed.
+	cur, err := app.core.GetTemplate(id, true)
+	if err != nil {
+		return err
+	}
+	o.Type = cur.Type
+
 	if err := validateTemplate(o, app); err != nil {
 		return err
 	}
@@ -208,7 +237,7 @@ func handleUpdateTemplate(c echo.Context) error {
 
 	// Subject is only relevant for fixed tx templates. For campaigns,
 	// the subject changes per campaign and is on models.Campaign.
-	if o.Type == models.TemplateTypeCampaign {
+	if o.Type == models.TemplateTypeCampaign || o.Type == models.TemplateTypePartial {
 		o.Subject = ""
 		f = app.manager.TemplateFuncs(nil)
 	} else {
@@ -220,11 +249,22 @@ func handleUpdateTemplate(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
+	if o.Type == models.TemplateTypePartial {
+		if err := validatePartial(id, o, app); err != nil {
+			return err
+		}
+	}
+
 	out, err := app.core.UpdateTemplate(id, o.Name, o.Subject, []byte(o.Body))
 	if err != nil {
 		return err
 	}
 
+	// Changes to a partial apply to all templates that include it.
+	if o.Type == models.TemplateTypePartial {
+		reloadPartials(app)
+	}
+
 	// If it's a transactional template, cache it.
 	if o.Type == models.TemplateTypeTx {
 		app.manager.CacheTpl(out.ID, &o)
@@ -263,6 +303,11 @@ func handleDeleteTemplate(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
+	tpl, err := app.core.GetTemplate(id, true)
+	if err != nil {
+		return err
+	}
+
 	if err := app.core.DeleteTemplate(id); err != nil {
 		return err
 	}
@@ -270,9 +315,93 @@ func handleDeleteTemplate(c echo.Context) error {
 	// Delete cached template.
 	app.manager.DeleteTpl(id)
 
+	if tpl.Type == models.TemplateTypePartial {
+		reloadPartials(app)
+	}
+
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// renderTemplatePreview compiles a template and renders it with dummy content
+// (for campaign templates) against the given subscriber.
+func renderTemplatePreview(tpl models.Template, sub models.Subscriber, app *App) ([]byte, error) {
+	// Compile the campaign template.
+	if tpl.Type == models.TemplateTypeCampaign {
+		camp := models.Campaign{
+			UUID:         dummyUUID,
+			Name:         app.i18n.T("templates.dummyName"),
+			Subject:      app.i18n.T("templates.dummySubject"),
+			FromEmail:    "dummy-campaign@listmonk.app",
+			TemplateBody: tpl.Body,
+			Body:         dummyTpl,
+		}
+
+		if err := camp.CompileTemplate(app.manager.TemplateFuncs(&camp)); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("templates.errorCompiling", "error", fmtTemplateErr(err)))
+		}
+
+		// Render the message body.
+		msg, err := app.manager.NewCampaignMessage(&camp, sub)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("templates.errorRendering", "error", fmtTemplateErr(err)))
+		}
+		return msg.Body(), nil
+	}
+
+	// Compile transactional template.
+	if err := tpl.Compile(app.manager.GenericTemplateFuncs()); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmtTemplateErr(err))
+	}
+
+	m := models.TxMessage{
+		Subject: tpl.Subject,
+	}
+
+	// Render the message.
+	if err := m.Render(sub, &tpl); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmtTemplateErr(err))
+	}
+
+	return m.Body, nil
+}
+
+// withDummySubscriber fills the empty fields of a sample subscriber with
+// those of the dummy subscriber.
+func withDummySubscriber(sub models.Subscriber) models.Subscriber {
+	if sub.UUID == "" {
+		sub.UUID = dummySubscriber.UUID
+	}
+	if sub.Email == "" {
+		sub.Email = dummySubscriber.Email
+	}
+	if sub.Name == "" {
+		sub.Name = dummySubscriber.Name
+	}
+	if sub.Attribs == nil {
+		sub.Attribs = dummySubscriber.Attribs
+	}
+
+	return sub
+}
+
+// fmtTemplateErr rewrites Go template errors of the form
+// "template: name:line:col: msg" to "line N, column N: msg".
+func fmtTemplateErr(err error) string {
+	m := regexpTplErrPos.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err.Error()
+	}
+
+	pos := "line " + m[2]
+	if m[3] != "" {
+		pos += ", column " + m[3]
+	}
+
+	return m[1] + pos + ": " + m[4]
+}
+
 // compileTemplate validates template fields.
 func validateTemplate(o models.Template, app *App) error {
 	if !strHasLen(o.Name, 1, stdInputMaxLen) {
@@ -289,5 +418,52 @@ func validateTemplate(o models.Template, app *App) error {
 			app.i18n.Ts("globals.messages.missingFields", "name", "subject"))
 	}
 
+	// Partials are referenced by their names in other templates.
+	if o.Type == models.TemplateTypePartial && !regexpPartialName.MatchString(o.Name) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidData")+": partial names can only have letters, numbers, dashes, and underscores")
+	}
+
+	return nil
+}
+
+// validatePartial checks a new or modified partial (id = 0 for new) for
+// conflicting names and circular includes against the existing partials.
+func validatePartial(id int, o models.Template, app *App) error {
+	tpls, err := app.core.GetTemplates(models.TemplateTypePartial, false)
+	if err != nil {
+		return err
+	}
+
+	p := make(map[string]string, len(tpls)+1)
+	for _, t := range tpls {
+		if t.ID == id {
+			continue
+		}
+		if t.Name == o.Name {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidData")+": a partial with the name already exists")
+		}
+		p[t.Name] = t.Body
+	}
+	p[o.Name] = o.Body
+
+	if err := models.ValidatePartials(p); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
 	return nil
 }
+
+// reloadPartials reloads the partial set from the DB and recompiles the cached
+// transactional templates so that they pick up changes to partials.
+func reloadPartials(app *App) {
+	if err := loadPartials(app); err != nil {
+		app.log.Printf("error loading template partials: %v", err)
+		return
+	}
+
+	if err := loadTxTemplates(app.manager, app); err != nil {
+		app.log.Printf("error loading transactional templates: %v", err)
+	}
+}
@@ -2,22 +2,54 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/gofrs/uuid/v5"
+	"github.com/knadh/listmonk/internal/idempotency"
 	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/urlfetch"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	// Max number of recipients in a single tx batch.
+	txBatchMaxRecipients = 1000
+
+	// Max size of an attachment fetched from a URL or the media library and
+	// the timeout for fetching it.
+	txAttachmentMaxSize = 20 * 1024 * 1024
+	txAttachmentTimeout = time.Second * 30
+
+	// Max length of an Idempotency-Key header and the time after which a key
+	// whose request is still being processed, eg: on a crash, is considered
+	// abandoned and can be claimed again.
+	txIdempotencyKeyMaxLen = 255
+	txIdempotencyKeyStale  = time.Minute * 10
+)
+
+// HTTP client for fetching tx attachments by URL that doesn't connect to
+// private and internal addresses.
+var txAttachmentClient = urlfetch.NewClient(txAttachmentTimeout)
+
 // handleSendTxMessage handles the sending of a transactional message.
+// By default, messages are pushed to the messenger right away. With ?queue=true,
+// messages are queued, retried on transient errors, and the message IDs
+// whose status can be polled with handleGetTxStatus are returned.
 func handleSendTxMessage(c echo.Context) error {
 	var (
-		app = c.Get("app").(*App)
-		m   models.TxMessage
+		app      = c.Get("app").(*App)
+		queue, _ = strconv.ParseBool(c.QueryParam("queue"))
+		m        models.TxMessage
 	)
 
 	// If it's a multipart form, there may be file attachments.
@@ -73,6 +105,15 @@ func handleSendTxMessage(c echo.Context) error {
 		m = r
 	}
 
+	// Fetch the attachments referenced by URL or media ID.
+	for _, a := range m.AttachmentRefs {
+		att, err := makeTxAttachment(a, app)
+		if err != nil {
+			return err
+		}
+		m.Attachments = append(m.Attachments, att)
+	}
+
 	// Get the cached tx template.
 	tpl, err := app.manager.GetTpl(m.TemplateID)
 	if err != nil {
@@ -89,7 +130,10 @@ func handleSendTxMessage(c echo.Context) error {
 		isEmails = false
 	}
 
-	notFound := []string{}
+	var (
+		notFound = []string{}
+		msgIDs   = []string{}
+	)
 	for n := 0; n < num; n++ {
 		var (
 			subID    int
@@ -115,49 +159,364 @@ func handleSendTxMessage(c echo.Context) error {
 		}
 
 		// Render the message.
-		if err := m.Render(sub, tpl); err != nil {
+		msg, err := makeTxMessage(m, sub, tpl)
+		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest,
 				app.i18n.Ts("globals.messages.errorFetching", "name"))
 		}
 
-		// Prepare the final message.
-		msg := models.Message{}
-		msg.Subscriber = sub
-		msg.To = []string{sub.Email}
-		msg.From = m.FromEmail
-		msg.Subject = m.Subject
-		msg.ContentType = m.ContentType
-		msg.Messenger = m.Messenger
-		msg.Body = m.Body
-		for _, a := range m.Attachments {
-			msg.Attachments = append(msg.Attachments, models.Attachment{
-				Name:    a.Name,
-				Header:  a.Header,
-				Content: a.Content,
-			})
+		id, err := sendTxMessage(msg, m.TemplateID, queue, app)
+		if err != nil {
+			return err
 		}
+		idempotency.Commit(c)
 
-		// Optional headers.
-		if len(m.Headers) != 0 {
-			msg.Headers = make(textproto.MIMEHeader, len(m.Headers))
-			for _, set := range m.Headers {
-				for hdr, val := range set {
-					msg.Headers.Add(hdr, val)
-				}
-			}
+		if queue {
+			msgIDs = append(msgIDs, id)
+		}
+	}
+
+	if len(notFound) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, strings.Join(notFound, "; "))
+	}
+
+	if queue {
+		return c.JSON(http.StatusOK, okResp{msgIDs})
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleSendTxBatch handles the sending of a transactional message to multiple
+// recipients where every recipient has their own template data and attachments.
+// All recipients are validated before any message is sent and the result of
+// every recipient is returned in the order of the recipients. Like
+// handleSendTxMessage, ?queue=true queues the messages.
+func handleSendTxBatch(c echo.Context) error {
+	var (
+		app      = c.Get("app").(*App)
+		queue, _ = strconv.ParseBool(c.QueryParam("queue"))
+		b        models.TxBatch
+	)
+
+	if err := c.Bind(&b); err != nil {
+		return err
+	}
+
+	// Validate input.
+	if r, err := validateTxBatch(b, app); err != nil {
+		return err
+	} else {
+		b = r
+	}
+
+	// Get the cached tx template.
+	tpl, err := app.manager.GetTpl(b.TemplateID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", fmt.Sprintf("template %d", b.TemplateID)))
+	}
+
+	out := make([]models.TxBatchResult, 0, len(b.Recipients))
+	for _, r := range b.Recipients {
+		res := models.TxBatchResult{SubscriberEmail: r.SubscriberEmail}
+
+		// Get the subscriber.
+		sub, err := app.core.GetSubscriber(0, "", r.SubscriberEmail)
+		if err != nil {
+			res.Error = errMessage(err)
+			out = append(out, res)
+			continue
+		}
+
+		m := models.TxMessage{
+			TemplateID:  b.TemplateID,
+			Data:        r.Data,
+			FromEmail:   b.FromEmail,
+			Headers:     b.Headers,
+			ContentType: b.ContentType,
+			Messenger:   b.Messenger,
+			Attachments: r.Files,
+		}
+
+		// Render the message with the recipient's data.
+		msg, err := makeTxMessage(m, sub, tpl)
+		if err != nil {
+			res.Error = err.Error()
+			out = append(out, res)
+			continue
 		}
 
+		id, err := sendTxMessage(msg, b.TemplateID, queue, app)
+		if err != nil {
+			res.Error = errMessage(err)
+			out = append(out, res)
+			continue
+		}
+		idempotency.Commit(c)
+
+		res.Success = true
+		res.MessageID = id
+		out = append(out, res)
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetTxStatus returns the delivery status of a transactional message
+// that was sent in the queued mode.
+func handleGetTxStatus(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		id  = c.Param("uuid")
+	)
+
+	if !reUUID.MatchString(id) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidUUID"))
+	}
+
+	out, err := app.core.GetTxStatus(id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// makeTxMessage renders a tx message for a subscriber and prepares the final message.
+func makeTxMessage(m models.TxMessage, sub models.Subscriber, tpl *models.Template) (models.Message, error) {
+	if err := m.Render(sub, tpl); err != nil {
+		return models.Message{}, err
+	}
+
+	msg := models.Message{}
+	msg.Subscriber = sub
+	msg.To = []string{sub.Email}
+	msg.From = m.FromEmail
+	msg.Subject = m.Subject
+	msg.ContentType = m.ContentType
+	msg.Messenger = m.Messenger
+	msg.Body = m.Body
+	for _, a := range m.Attachments {
+		msg.Attachments = append(msg.Attachments, models.Attachment{
+			Name:    a.Name,
+			Header:  a.Header,
+			Content: a.Content,
+		})
+	}
+
+	// Optional headers.
+	if len(m.Headers) != 0 {
+		msg.Headers = make(textproto.MIMEHeader, len(m.Headers))
+		m.Headers.Merge(msg.Headers)
+	}
+
+	return msg, nil
+}
+
+// sendTxMessage pushes a tx message to the messenger. If queue is true, the message
+// is recorded for tracking its delivery status and queued instead, and its message
+// ID is returned.
+func sendTxMessage(msg models.Message, tplID int, queue bool, app *App) (string, error) {
+	if !queue {
 		if err := app.manager.PushMessage(msg); err != nil {
 			app.log.Printf("error sending message (%s): %v", msg.Subject, err)
-			return err
+			return "", err
 		}
+		return "", nil
 	}
 
-	if len(notFound) > 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, strings.Join(notFound, "; "))
+	msg.TxUUID = uuid.Must(uuid.NewV4()).String()
+	if err := app.manager.QueueTxMessage(msg, tplID); err != nil {
+		app.log.Printf("error queueing message (%s): %v", msg.Subject, err)
+		return "", err
 	}
 
-	return c.JSON(http.StatusOK, okResp{true})
+	return msg.TxUUID, nil
+}
+
+// validateTxBatch validates a tx batch and all its recipients, and decodes the
+// recipients' attachments.
+func validateTxBatch(b models.TxBatch, app *App) (models.TxBatch, error) {
+	if len(b.Recipients) == 0 || len(b.Recipients) > txBatchMaxRecipients {
+		return b, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidData")+fmt.Sprintf(": send 1 - %d recipients", txBatchMaxRecipients))
+	}
+
+	// Attachments referenced by multiple recipients are only fetched once.
+	files := txAttachments{}
+
+	for n, r := range b.Recipients {
+		em, err := app.importer.SanitizeEmail(r.SubscriberEmail)
+		if err != nil {
+			return b, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidData")+fmt.Sprintf(": recipient %d: %v", n, err))
+		}
+		b.Recipients[n].SubscriberEmail = em
+
+		for _, a := range r.Attachments {
+			att, err := files.get(a, app)
+			if err != nil {
+				return b, echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("globals.messages.invalidData")+fmt.Sprintf(": recipient %d: %s", n, errMessage(err)))
+			}
+			b.Recipients[n].Files = append(b.Recipients[n].Files, att)
+		}
+	}
+
+	if b.FromEmail == "" {
+		b.FromEmail = app.constants.FromEmail
+	}
+
+	if err := b.Headers.Validate(app.constants.AllowProtectedHeaders); err != nil {
+		return b, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "headers")+": "+err.Error())
+	}
+
+	if b.Messenger == "" {
+		b.Messenger = emailMsgr
+	} else if !app.manager.HasMessenger(b.Messenger) {
+		return b, echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", b.Messenger))
+	}
+
+	return b, nil
+}
+
+// txAttachments caches the attachments that are fetched by URL or media ID in a tx request.
+type txAttachments map[string]models.Attachment
+
+// get returns an attachment, fetching the file referenced by URL or media ID only
+// once per request.
+func (t txAttachments) get(a models.TxAttachment, app *App) (models.Attachment, error) {
+	var key string
+	switch {
+	case a.MediaID > 0:
+		key = "media:" + strconv.Itoa(a.MediaID)
+	case a.URL != "":
+		key = "url:" + a.URL
+	default:
+		return makeTxAttachment(a, app)
+	}
+	key += "\x00" + a.Name + "\x00" + a.ContentType
+
+	if att, ok := t[key]; ok {
+		return att, nil
+	}
+
+	att, err := makeTxAttachment(a, app)
+	if err != nil {
+		return att, err
+	}
+	t[key] = att
+
+	return att, nil
+}
+
+// makeTxAttachment prepares an attachment from a JSON tx request. The file is
+// looked up from the media library, fetched from the URL, or taken inline, in
+// that order. Fetched files should not exceed txAttachmentMaxSize.
+func makeTxAttachment(a models.TxAttachment, app *App) (models.Attachment, error) {
+	var (
+		name  = a.Name
+		ctype = a.ContentType
+		b     = a.Content
+	)
+
+	switch {
+	case a.MediaID > 0:
+		m, err := app.core.GetMedia(a.MediaID, "", app.media)
+		if err != nil {
+			return models.Attachment{}, err
+		}
+		if m.Size > txAttachmentMaxSize {
+			return models.Attachment{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidData")+fmt.Sprintf(": attachment %s exceeds the size limit of %d bytes", m.Filename, txAttachmentMaxSize))
+		}
+
+		blob, err := app.media.GetBlob(m.URL)
+		if err != nil {
+			app.log.Printf("error fetching attachment media %d: %v", a.MediaID, err)
+			return models.Attachment{}, echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.media}", "error", err.Error()))
+		}
+
+		b = blob
+		if name == "" {
+			name = m.Filename
+		}
+		if ctype == "" {
+			ctype = m.ContentType
+		}
+
+	case a.URL != "":
+		blob, hdrType, err := fetchTxAttachment(a.URL)
+		if err != nil {
+			return models.Attachment{}, echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidData")+fmt.Sprintf(": attachment %s: %v", a.URL, err))
+		}
+
+		b = blob
+		if name == "" {
+			u, _ := url.Parse(a.URL)
+			name = path.Base(u.Path)
+		}
+		if ctype == "" {
+			ctype = hdrType
+		}
+	}
+
+	if name == "" || name == "/" || name == "." {
+		return models.Attachment{}, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidData")+": attachment name is empty")
+	}
+
+	return models.Attachment{
+		Name:    name,
+		Header:  manager.MakeAttachmentHeader(name, "base64", ctype),
+		Content: b,
+	}, nil
+}
+
+// fetchTxAttachment fetches an http(s) URL and returns the body and its content type.
+func fetchTxAttachment(u string) ([]byte, string, error) {
+	pu, err := url.Parse(u)
+	if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+		return nil, "", errors.New("invalid URL. Only http(s) URLs are allowed")
+	}
+
+	resp, err := txAttachmentClient.Get(pu.String())
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("non 200 response: %d", resp.StatusCode)
+	}
+
+	if resp.ContentLength > txAttachmentMaxSize {
+		return nil, "", fmt.Errorf("exceeds the size limit of %d bytes", txAttachmentMaxSize)
+	}
+
+	// Read one byte more than the limit to find out if the body exceeds it.
+	b, err := io.ReadAll(io.LimitReader(resp.Body, txAttachmentMaxSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(b) > txAttachmentMaxSize {
+		return nil, "", fmt.Errorf("exceeds the size limit of %d bytes", txAttachmentMaxSize)
+	}
+
+	return b, resp.Header.Get("Content-Type"), nil
+}
+
+// errMessage returns the message of an echo.HTTPError or the error string of other errors.
+func errMessage(err error) string {
+	if e, ok := err.(*echo.HTTPError); ok {
+		return fmt.Sprintf("%v", e.Message)
+	}
+
+	return err.Error()
 }
 
 func validateTxMessage(m models.TxMessage, app *App) (models.TxMessage, error) {
@@ -197,6 +556,11 @@ func validateTxMessage(m models.TxMessage, app *App) (models.TxMessage, error) {
 		m.FromEmail = app.constants.FromEmail
 	}
 
+	if err := m.Headers.Validate(app.constants.AllowProtectedHeaders); err != nil {
+		return m, echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "headers")+": "+err.Error())
+	}
+
 	if m.Messenger == "" {
 		m.Messenger = emailMsgr
 	} else if !app.manager.HasMessenger(m.Messenger) {
@@ -205,3 +569,35 @@ func validateTxMessage(m models.TxMessage, app *App) (models.TxMessage, error) {
 
 	return m, nil
 }
+
+// txIdempotent middleware makes a transactional API request with an Idempotency-Key
+// header idempotent. The response of the first request with a key, scoped to the
+// authenticated user, is stored for app.tx_idempotency_ttl and returned on repeats
+// without the messages being sent again. Concurrent requests with the same key are
+// serialized. Server errors (5xx) are not stored so that the request can be retried,
+// unless some of the request's messages were sent before the error.
+func txIdempotent(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := strings.TrimSpace(c.Request().Header.Get("Idempotency-Key"))
+		if key == "" {
+			return next(c)
+		}
+
+		app := c.Get("app").(*App)
+		if len(key) > txIdempotencyKeyMaxLen {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "Idempotency-Key"))
+		}
+
+		err := app.txKeys.Handle(c, getAuthUser(c), key, next)
+		switch err {
+		case idempotency.ErrKeyReused:
+			return echo.NewHTTPError(http.StatusUnprocessableEntity,
+				app.i18n.Ts("globals.messages.invalidFields", "name", "Idempotency-Key"))
+		case idempotency.ErrInProgress:
+			return echo.NewHTTPError(http.StatusConflict, http.StatusText(http.StatusConflict))
+		}
+
+		return err
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+const webhookSecretLen = 32
+
+// handleGetWebhooks returns all outbound webhooks. Secrets are not returned.
+func handleGetWebhooks(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out, err := app.core.GetWebhooks()
+	if err != nil {
+		return err
+	}
+
+	for i := range out {
+		out[i].Secret = ""
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleRegisterWebhook registers a new outbound webhook. If no secret is given,
+// a random one is generated. The secret is only returned in this response.
+func handleRegisterWebhook(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		o   models.Webhook
+	)
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	o.Name = strings.TrimSpace(o.Name)
+	if !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "name"))
+	}
+
+	if u, err := url.Parse(o.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "url"))
+	}
+
+	if len(o.Events) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.invalidFields", "name", "events"))
+	}
+	for _, e := range o.Events {
+		if !strSliceContains(e, models.WebhookEvents) {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.invalidData")+": unknown event: "+e)
+		}
+	}
+
+	if o.Secret == "" {
+		s, err := generateRandomString(webhookSecretLen)
+		if err != nil {
+			app.log.Printf("error generating webhook secret: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, app.i18n.Ts("globals.messages.internalError"))
+		}
+		o.Secret = s
+	}
+
+	out, err := app.core.RegisterWebhook(o)
+	if err != nil {
+		return err
+	}
+
+	if err := reloadWebhooks(app); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDeleteWebhook deletes an outbound webhook.
+func handleDeleteWebhook(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.core.DeleteWebhook(id); err != nil {
+		return err
+	}
+
+	if err := reloadWebhooks(app); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleGetWebhookFailures returns the dead-letter log of webhook deliveries that
+// failed after all retries, optionally filtered by ?webhook_id.
+func handleGetWebhookFailures(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		pg    = app.paginator.NewFromURL(c.Request().URL.Query())
+		id, _ = strconv.Atoi(c.QueryParam("webhook_id"))
+	)
+
+	res, total, err := app.core.QueryWebhookFailures(id, pg.Offset, pg.Limit)
+	if err != nil {
+		return err
+	}
+
+	out := models.PageResults{
+		Results: res,
+		Total:   total,
+		Page:    pg.Page,
+		PerPage: pg.PerPage,
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// reloadWebhooks loads the webhooks from the DB into the webhook manager.
+func reloadWebhooks(app *App) error {
+	hooks, err := app.core.GetWebhooks()
+	if err != nil {
+		return err
+	}
+
+	app.webhooks.Load(hooks)
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/listmonk/internal/bounce/mailbox"
 	"github.com/knadh/listmonk/internal/bounce/webhooks"
+	"github.com/knadh/listmonk/internal/metrics"
 	"github.com/knadh/listmonk/models"
 )
 
@@ -16,6 +17,9 @@ const (
 	// bounced e-mails.
 	subID  = "X-Listmonk-Subscriber"
 	campID = "X-Listmonk-Campaign"
+
+	// Maximum number of distinct bounce sources that are counted individually.
+	maxMetricsSources = 20
 )
 
 // Mailbox represents a POP/IMAP mailbox client that can scan messages and pass
@@ -38,20 +42,29 @@ type Opt struct {
 		Username string
 		Password string
 	}
+	SparkPost struct {
+		Enabled  bool
+		Username string
+		Password string
+	}
 
 	RecordBounceCB func(models.Bounce) error
 }
 
 // Manager handles e-mail bounces.
 type Manager struct {
-	queue    chan models.Bounce
-	mailbox  Mailbox
-	SES      *webhooks.SES
-	Sendgrid *webhooks.Sendgrid
-	Postmark *webhooks.Postmark
-	queries  *Queries
-	opt      Opt
-	log      *log.Logger
+	queue     chan models.Bounce
+	mailbox   Mailbox
+	SES       *webhooks.SES
+	Sendgrid  *webhooks.Sendgrid
+	Postmark  *webhooks.Postmark
+	SparkPost *webhooks.SparkPost
+	queries   *Queries
+	opt       Opt
+	log       *log.Logger
+
+	// Bounces recorded by source.
+	recorded *metrics.CounterVec
 }
 
 // Queries contains the queries.
@@ -63,10 +76,11 @@ type Queries struct {
 // New returns a new instance of the bounce manager.
 func New(opt Opt, q *Queries, lo *log.Logger) (*Manager, error) {
 	m := &Manager{
-		opt:     opt,
-		queries: q,
-		queue:   make(chan models.Bounce, 1000),
-		log:     lo,
+		opt:      opt,
+		queries:  q,
+		queue:    make(chan models.Bounce, 1000),
+		log:      lo,
+		recorded: metrics.NewCounterVec(maxMetricsSources),
 	}
 
 	// Is there a mailbox?
@@ -74,6 +88,8 @@ func New(opt Opt, q *Queries, lo *log.Logger) (*Manager, error) {
 		switch opt.MailboxType {
 		case "pop":
 			m.mailbox = mailbox.NewPOP(opt.Mailbox)
+		case "imap":
+			m.mailbox = mailbox.NewIMAP(opt.Mailbox)
 		default:
 			return nil, errors.New("unknown bounce mailbox type")
 		}
@@ -96,6 +112,10 @@ func New(opt Opt, q *Queries, lo *log.Logger) (*Manager, error) {
 		if opt.Postmark.Enabled {
 			m.Postmark = webhooks.NewPostmark(opt.Postmark.Username, opt.Postmark.Password)
 		}
+
+		if opt.SparkPost.Enabled {
+			m.SparkPost = webhooks.NewSparkPost(opt.SparkPost.Username, opt.SparkPost.Password)
+		}
 	}
 
 	return m, nil
@@ -122,6 +142,7 @@ func (m *Manager) Run() {
 			if err := m.opt.RecordBounceCB(b); err != nil {
 				continue
 			}
+			m.recorded.Inc(b.Source)
 		}
 	}
 }
@@ -144,3 +165,9 @@ func (m *Manager) Record(b models.Bounce) error {
 	}
 	return nil
 }
+
+// WriteMetrics writes the bounce queue and ingestion metrics.
+func (m *Manager) WriteMetrics(w *metrics.Writer) {
+	w.Gauge("listmonk_bounce_queue_depth", "Number of bounces waiting to be recorded.", float64(len(m.queue)))
+	w.CounterVec("listmonk_bounces_total", "Bounces recorded by source.", "source", m.recorded)
+}
@@ -0,0 +1,233 @@
+package mailbox
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	imapDefaultFolder = "INBOX"
+	imapTimeout       = time.Second * 30
+)
+
+var reIMAPLiteral = regexp.MustCompile(`\{(\d+)\}$`)
+
+// IMAP represents an IMAP mailbox.
+type IMAP struct {
+	opt Opt
+}
+
+// imapConn is a minimal IMAP4rev1 (RFC 3501) client connection that supports
+// the handful of commands required for scanning bounces.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResp is the response to an IMAP command. Lines are the untagged response
+// lines and Literals are the literal strings ({n} prefixed data) in the response.
+type imapResp struct {
+	Lines    []string
+	Literals [][]byte
+}
+
+// NewIMAP returns a new instance of the IMAP mailbox client.
+func NewIMAP(opt Opt) *IMAP {
+	if opt.Folder == "" {
+		opt.Folder = imapDefaultFolder
+	}
+
+	return &IMAP{opt: opt}
+}
+
+// Scan scans the mailbox folder for unseen messages and pushes the bounces into
+// the given channel. The scanned messages are marked as seen on the server.
+// If limit > 0, at most limit messages are scanned.
+func (m *IMAP) Scan(limit int, ch chan models.Bounce) error {
+	c, err := m.connect()
+	if err != nil {
+		return err
+	}
+	defer c.close()
+
+	// Authenticate.
+	if m.opt.AuthProtocol != "none" {
+		if _, err := c.cmd("LOGIN %s %s", imapQuote(m.opt.Username), imapQuote(m.opt.Password)); err != nil {
+			return err
+		}
+	}
+
+	if _, err := c.cmd("SELECT %s", imapQuote(m.opt.Folder)); err != nil {
+		return err
+	}
+
+	// Get the UIDs of unseen messages.
+	res, err := c.cmd("UID SEARCH UNSEEN")
+	if err != nil {
+		return err
+	}
+
+	var uids []int
+	for _, l := range res.Lines {
+		if !strings.HasPrefix(l, "* SEARCH") {
+			continue
+		}
+
+		for _, f := range strings.Fields(strings.TrimPrefix(l, "* SEARCH")) {
+			if id, err := strconv.Atoi(f); err == nil {
+				uids = append(uids, id)
+			}
+		}
+	}
+
+	if limit > 0 && len(uids) > limit {
+		uids = uids[:limit]
+	}
+
+	for _, uid := range uids {
+		// PEEK doesn't set the \Seen flag. It's set explicitly after the message is processed.
+		res, err := c.cmd("UID FETCH %d BODY.PEEK[]", uid)
+		if err != nil {
+			return err
+		}
+		if len(res.Literals) == 0 {
+			continue
+		}
+
+		b, err := parseBounce(res.Literals[0], m.opt.Host)
+		if err == nil {
+			select {
+			case ch <- b:
+			default:
+			}
+		} else if err != errNotBounce {
+			return err
+		}
+
+		if _, err := c.cmd(`UID STORE %d +FLAGS.SILENT (\Seen)`, uid); err != nil {
+			return err
+		}
+	}
+
+	_, _ = c.cmd("LOGOUT")
+	return nil
+}
+
+// connect connects to the IMAP server and reads the server greeting.
+func (m *IMAP) connect() (*imapConn, error) {
+	var (
+		addr = net.JoinHostPort(m.opt.Host, strconv.Itoa(m.opt.Port))
+		d    = &net.Dialer{Timeout: imapTimeout}
+
+		conn net.Conn
+		err  error
+	)
+	if m.opt.TLSEnabled {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, &tls.Config{
+			ServerName:         m.opt.Host,
+			InsecureSkipVerify: m.opt.TLSSkipVerify,
+		})
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+
+	conn.SetDeadline(time.Now().Add(imapTimeout))
+	l, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(l, "* OK") && !strings.HasPrefix(l, "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected IMAP greeting: %s", l)
+	}
+
+	return c, nil
+}
+
+// cmd sends a command to the server and reads the response until the tagged
+// completion response. A completion response other than OK is returned as an error.
+func (c *imapConn) cmd(format string, args ...interface{}) (imapResp, error) {
+	c.tag++
+	tag := fmt.Sprintf("L%04d", c.tag)
+
+	c.conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return imapResp{}, err
+	}
+
+	var out imapResp
+	for {
+		l, err := c.readLine()
+		if err != nil {
+			return out, err
+		}
+
+		// A line ending with {n} is followed by n bytes of literal data and the
+		// remainder of the line.
+		for {
+			m := reIMAPLiteral.FindStringSubmatch(l)
+			if m == nil {
+				break
+			}
+
+			n, _ := strconv.Atoi(m[1])
+			b := make([]byte, n)
+			if _, err := io.ReadFull(c.r, b); err != nil {
+				return out, err
+			}
+			out.Literals = append(out.Literals, b)
+
+			rest, err := c.readLine()
+			if err != nil {
+				return out, err
+			}
+			l = l[:len(l)-len(m[0])] + rest
+		}
+
+		if strings.HasPrefix(l, tag+" ") {
+			st := strings.TrimPrefix(l, tag+" ")
+			if !strings.HasPrefix(st, "OK") {
+				return out, errors.New("IMAP error: " + st)
+			}
+			return out, nil
+		}
+
+		out.Lines = append(out.Lines, l)
+	}
+}
+
+// readLine reads a CRLF terminated line without the CRLF.
+func (c *imapConn) readLine() (string, error) {
+	l, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(l, "\r\n"), nil
+}
+
+func (c *imapConn) close() error {
+	return c.conn.Close()
+}
+
+// imapQuote returns s as an IMAP quoted string.
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
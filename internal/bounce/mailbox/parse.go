@@ -0,0 +1,206 @@
+package mailbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-message"
+	_ "github.com/emersion/go-message/charset"
+	"github.com/knadh/listmonk/models"
+)
+
+type bounceHeaders struct {
+	Header string
+	Regexp *regexp.Regexp
+}
+
+var (
+	// List of header to look for in the e-mail body, regexp to fall back to if the header is empty.
+	headerLookups = []bounceHeaders{
+		{models.EmailHeaderCampaignUUID, regexp.MustCompile(`(?m)(?:^` + models.EmailHeaderCampaignUUID + `:\s+?)([a-z0-9\-]{36})`)},
+		{models.EmailHeaderSubscriberUUID, regexp.MustCompile(`(?m)(?:^` + models.EmailHeaderSubscriberUUID + `:\s+?)([a-z0-9\-]{36})`)},
+		{models.EmailHeaderDate, regexp.MustCompile(`(?m)(?:^` + models.EmailHeaderDate + `:\s+?)([\w,\,\ ,:,+,-]*(?:\(?:\w*\))?)`)},
+		{models.EmailHeaderFrom, regexp.MustCompile(`(?m)(?:^` + models.EmailHeaderFrom + `:\s+?)(.*)`)},
+		{models.EmailHeaderSubject, regexp.MustCompile(`(?m)(?:^` + models.EmailHeaderSubject + `:\s+?)(.*)`)},
+		{models.EmailHeaderMessageId, regexp.MustCompile(`(?m)(?:^` + models.EmailHeaderMessageId + `:\s+?)(.*)`)},
+		{models.EmailHeaderDeliveredTo, regexp.MustCompile(`(?m)(?:^` + models.EmailHeaderDeliveredTo + `:\s+?)(.*)`)},
+	}
+
+	reHdrReceived = regexp.MustCompile(`(?m)(?:^` + models.EmailHeaderReceived + `:\s+?)(.*)`)
+
+	// RFC 3464 delivery status notification (DSN) fields.
+	reDSNRecipient = regexp.MustCompile(`(?mi)^(?:Final|Original)-Recipient:\s*(?:rfc822\s*;)?\s*<?([^\s<>]+@[^\s<>]+)>?`)
+	reDSNAction    = regexp.MustCompile(`(?mi)^Action:\s*([a-z]+)`)
+	reDSNStatus    = regexp.MustCompile(`(?mi)^Status:\s*([245]\.\d{1,3}\.\d{1,3})`)
+
+	// Exim and other MTAs that don't send DSNs add the failed recipients as a header.
+	reHdrFailedRecipients = regexp.MustCompile(`(?mi)^X-Failed-Recipients:\s*<?([^\s<>,]+@[^\s<>,]+)>?`)
+
+	// Fallback for plain text bounces from common providers, eg:
+	// "550 5.1.1 The email account that you tried to reach does not exist."
+	reSMTPStatus = regexp.MustCompile(`\b[45]\d\d[\s\-]+([45]\.\d{1,3}\.\d{1,3})\b`)
+
+	errNotBounce = errors.New("not a bounce")
+)
+
+// dsn represents the relevant fields of a delivery status notification.
+type dsn struct {
+	Recipient string
+	Action    string
+	Status    string
+}
+
+// parseBounce parses a raw bounce e-mail and returns a bounce. The campaign and
+// subscriber are identified by the listmonk headers in the original message, and
+// the failed recipient and the bounce type (soft or hard) are picked up from the
+// RFC 3464 delivery status or from the common plain text formats. Delivery
+// notifications that aren't failures (eg: "delivered" or "relayed") return errNotBounce.
+func parseBounce(b []byte, source string) (models.Bounce, error) {
+	m, err := message.Read(bytes.NewReader(b))
+	if err != nil && !message.IsUnknownCharset(err) {
+		return models.Bounce{}, err
+	}
+
+	var (
+		h = m
+		d dsn
+	)
+
+	// If this is a multipart message, find the last part and the delivery status part if any.
+	if mr := m.MultipartReader(); mr != nil {
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return models.Bounce{}, err
+			}
+			h = part
+
+			if t, _, _ := part.Header.ContentType(); t == "message/delivery-status" {
+				body, _ := io.ReadAll(part.Body)
+				d = parseDSN(body)
+			}
+		}
+	}
+
+	// Not a multipart/report. Look for DSN fields in the whole message.
+	if d.Status == "" && d.Action == "" {
+		d = parseDSN(b)
+	}
+
+	// Lookup headers in the e-mail. If a header isn't found, fall back to regexp lookups.
+	hdr := make(map[string]string, 7)
+	for _, l := range headerLookups {
+		v := h.Header.Get(l.Header)
+
+		// Not in the header. Try regexp.
+		if v == "" {
+			if m := l.Regexp.FindAllSubmatch(b, -1); m != nil {
+				v = string(m[len(m)-1][1])
+			}
+		}
+
+		hdr[l.Header] = strings.TrimSpace(v)
+	}
+
+	// Received is a []string header.
+	msgReceived := h.Header.Map()[models.EmailHeaderReceived]
+	if len(msgReceived) == 0 {
+		if u := reHdrReceived.FindAllSubmatch(b, -1); u != nil {
+			for i := 0; i < len(u); i++ {
+				msgReceived = append(msgReceived, string(u[i][1]))
+			}
+		}
+	}
+
+	date, _ := time.Parse("Mon, 02 Jan 2006 15:04:05 -0700", hdr[models.EmailHeaderDate])
+	if date.IsZero() {
+		date = time.Now()
+	}
+
+	// Failed recipient.
+	email := d.Recipient
+	if email == "" {
+		if r := reHdrFailedRecipients.FindSubmatch(b); r != nil {
+			email = string(r[1])
+		}
+	}
+
+	// Bounce type.
+	typ := models.BounceTypeHard
+	switch strings.ToLower(d.Action) {
+	case "delivered", "relayed", "expanded":
+		return models.Bounce{}, errNotBounce
+	case "delayed":
+		typ = models.BounceTypeSoft
+	default:
+		status := d.Status
+		if status == "" {
+			if s := reSMTPStatus.FindSubmatch(b); s != nil {
+				status = string(s[1])
+			}
+		}
+
+		// 4.x.x are persistent transient failures.
+		if strings.HasPrefix(status, "4.") {
+			typ = models.BounceTypeSoft
+		}
+	}
+
+	// Additional bounce e-mail metadata.
+	meta, _ := json.Marshal(struct {
+		From        string   `json:"from"`
+		Subject     string   `json:"subject"`
+		MessageID   string   `json:"message_id"`
+		DeliveredTo string   `json:"delivered_to"`
+		Received    []string `json:"received"`
+		Recipient   string   `json:"recipient,omitempty"`
+		Status      string   `json:"status,omitempty"`
+	}{
+		From:        hdr[models.EmailHeaderFrom],
+		Subject:     hdr[models.EmailHeaderSubject],
+		MessageID:   hdr[models.EmailHeaderMessageId],
+		DeliveredTo: hdr[models.EmailHeaderDeliveredTo],
+		Received:    msgReceived,
+		Recipient:   email,
+		Status:      d.Status,
+	})
+
+	out := models.Bounce{
+		Type:           typ,
+		CampaignUUID:   hdr[models.EmailHeaderCampaignUUID],
+		SubscriberUUID: hdr[models.EmailHeaderSubscriberUUID],
+		Source:         source,
+		CreatedAt:      date,
+		Meta:           meta,
+	}
+
+	// The subscriber is looked up by the e-mail only if there's no UUID.
+	if out.SubscriberUUID == "" {
+		out.Email = strings.ToLower(email)
+	}
+
+	return out, nil
+}
+
+// parseDSN parses the per-recipient fields of an RFC 3464 delivery status.
+func parseDSN(b []byte) dsn {
+	var d dsn
+	if m := reDSNRecipient.FindSubmatch(b); m != nil {
+		d.Recipient = string(m[1])
+	}
+	if m := reDSNAction.FindSubmatch(b); m != nil {
+		d.Action = string(m[1])
+	}
+	if m := reDSNStatus.FindSubmatch(b); m != nil {
+		d.Status = string(m[1])
+	}
+
+	return d
+}
@@ -42,9 +42,7 @@ type Postmark struct {
 
 func NewPostmark(username, password string) *Postmark {
 	return &Postmark{
-		authHandler: middleware.BasicAuth(makePostmarkAuthHandler(username, password))(func(c echo.Context) error {
-			return nil
-		}),
+		authHandler: makeBasicAuthHandler(username, password),
 	}
 }
 
@@ -60,8 +58,8 @@ func (p *Postmark) ProcessBounce(b []byte, c echo.Context) ([]models.Bounce, err
 		return nil, fmt.Errorf("error unmarshalling postmark notification: %v", err)
 	}
 
-	// Ignore non-bounce messages.
-	if n.RecordType != "Bounce" {
+	// Ignore non-bounce messages. Spam complaints have their own record type.
+	if n.RecordType != "Bounce" && n.RecordType != "SpamComplaint" {
 		return nil, nil
 	}
 
@@ -98,6 +96,21 @@ func (p *Postmark) ProcessBounce(b []byte, c echo.Context) ([]models.Bounce, err
 	}}, nil
 }
 
+// makeBasicAuthHandler returns a handler that checks the basic auth credentials of
+// webhook requests. If the configured credentials are empty, requests are not
+// authenticated, as the BasicAuth middleware rejects requests without credentials.
+func makeBasicAuthHandler(username, password string) echo.HandlerFunc {
+	if username == "" || password == "" {
+		return func(c echo.Context) error {
+			return nil
+		}
+	}
+
+	return middleware.BasicAuth(makePostmarkAuthHandler(username, password))(func(c echo.Context) error {
+		return nil
+	})
+}
+
 func makePostmarkAuthHandler(cfgUser, cfgPassword string) func(username, password string, c echo.Context) (bool, error) {
 	var (
 		u = []byte(cfgUser)
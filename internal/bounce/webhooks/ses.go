@@ -51,9 +51,15 @@ type sesMail struct {
 	Bounce    struct {
 		BounceType        string `json:"bounceType"`
 		BouncedRecipients []struct {
-			Status string `json:"status"`
+			EmailAddress string `json:"emailAddress"`
+			Status       string `json:"status"`
 		} `json:"bouncedRecipients"`
 	} `json:"bounce"`
+	Complaint struct {
+		ComplainedRecipients []struct {
+			EmailAddress string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
 	Mail struct {
 		Timestamp        sesTimestamp        `json:"timestamp"`
 		HeadersTruncated bool                `json:"headersTruncated"`
@@ -104,45 +110,69 @@ func (s *SES) ProcessSubscription(b []byte) error {
 	return nil
 }
 
-// ProcessBounce processes an SES bounce notification and returns a Bounce object.
-func (s *SES) ProcessBounce(b []byte) (models.Bounce, error) {
-	var (
-		bounce models.Bounce
-		n      sesNotif
-	)
+// ProcessBounce processes an SES notification and returns a Bounce object for
+// every bounced or complained recipient. Delivery notifications are verified and
+// acknowledged but no bounces are returned for them.
+func (s *SES) ProcessBounce(b []byte) ([]models.Bounce, error) {
+	var n sesNotif
 	if err := json.Unmarshal(b, &n); err != nil {
-		return bounce, fmt.Errorf("error unmarshalling SES notification: %v", err)
+		return nil, fmt.Errorf("error unmarshalling SES notification: %v", err)
 	}
 	if err := s.verifyNotif(n); err != nil {
-		return bounce, err
+		return nil, err
 	}
 
 	var m sesMail
 	if err := json.Unmarshal([]byte(n.Message), &m); err != nil {
-		return bounce, fmt.Errorf("error unmarshalling SES notification: %v", err)
+		return nil, fmt.Errorf("error unmarshalling SES notification: %v", err)
 	}
 
-	if (m.EventType != "" && m.EventType != "Bounce") ||
-		(m.NotifType != "" && (m.NotifType != "Bounce" && m.NotifType != "Complaint")) {
-		return bounce, errors.New("notification type is not bounce")
+	// notificationType is set by SES notifications and eventType by SES event publishing.
+	notifType := m.NotifType
+	if notifType == "" {
+		notifType = m.EventType
 	}
 
-	if len(m.Mail.Destination) == 0 {
-		return bounce, errors.New("no destination e-mails found in SES notification")
-	}
+	var (
+		typ    string
+		emails []string
+	)
+	switch notifType {
+	case "Delivery":
+		return nil, nil
 
-	typ := models.BounceTypeSoft
-	if m.Bounce.BounceType == "Permanent" {
-		typ = models.BounceTypeHard
-	}
-	if m.Bounce.BounceType == "Transient" && len(m.Bounce.BouncedRecipients) > 0 {
-		// "Invalid domain" bounce.
-		if m.Bounce.BouncedRecipients[0].Status == "5.4.4" {
+	case "Bounce":
+		typ = models.BounceTypeSoft
+		if m.Bounce.BounceType == "Permanent" {
 			typ = models.BounceTypeHard
 		}
-	}
-	if m.NotifType == "Complaint" {
+		if m.Bounce.BounceType == "Transient" && len(m.Bounce.BouncedRecipients) > 0 {
+			// "Invalid domain" bounce.
+			if m.Bounce.BouncedRecipients[0].Status == "5.4.4" {
+				typ = models.BounceTypeHard
+			}
+		}
+
+		for _, r := range m.Bounce.BouncedRecipients {
+			emails = append(emails, r.EmailAddress)
+		}
+
+	case "Complaint":
 		typ = models.BounceTypeComplaint
+		for _, r := range m.Complaint.ComplainedRecipients {
+			emails = append(emails, r.EmailAddress)
+		}
+
+	default:
+		return nil, errors.New("notification type is not bounce")
+	}
+
+	// Older notifications may not have the recipients. Fall back to the destination.
+	if len(emails) == 0 {
+		if len(m.Mail.Destination) == 0 {
+			return nil, errors.New("no destination e-mails found in SES notification")
+		}
+		emails = m.Mail.Destination[:1]
 	}
 
 	// Look for the campaign ID in headers.
@@ -162,14 +192,23 @@ func (s *SES) ProcessBounce(b []byte) (models.Bounce, error) {
 		}
 	}
 
-	return models.Bounce{
-		Email:        strings.ToLower(m.Mail.Destination[0]),
-		CampaignUUID: campUUID,
-		Type:         typ,
-		Source:       "ses",
-		Meta:         json.RawMessage(n.Message),
-		CreatedAt:    time.Time(m.Mail.Timestamp),
-	}, nil
+	out := make([]models.Bounce, 0, len(emails))
+	for _, e := range emails {
+		if e == "" {
+			continue
+		}
+
+		out = append(out, models.Bounce{
+			Email:        strings.ToLower(e),
+			CampaignUUID: campUUID,
+			Type:         typ,
+			Source:       "ses",
+			Meta:         json.RawMessage(n.Message),
+			CreatedAt:    time.Time(m.Mail.Timestamp),
+		})
+	}
+
+	return out, nil
 }
 
 func (s *SES) buildSignature(n sesNotif) []byte {
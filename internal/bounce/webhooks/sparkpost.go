@@ -0,0 +1,119 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// sparkPostEvent is an individual event in a SparkPost webhook event batch.
+type sparkPostEvent struct {
+	Msys struct {
+		MessageEvent *sparkPostMsg `json:"message_event"`
+	} `json:"msys"`
+}
+
+type sparkPostMsg struct {
+	Type        string            `json:"type"`
+	BounceClass string            `json:"bounce_class"`
+	FBLType     string            `json:"fbl_type"`
+	RcptTo      string            `json:"rcpt_to"`
+	RawRcptTo   string            `json:"raw_rcpt_to"`
+	Reason      string            `json:"reason"`
+	Timestamp   string            `json:"timestamp"`
+	CampaignID  string            `json:"campaign_id"`
+	RcptMeta    map[string]string `json:"rcpt_meta"`
+}
+
+// SparkPost bounce classification codes.
+// https://support.sparkpost.com/docs/deliverability/bounce-classification-codes
+var (
+	sparkPostHardClasses = map[string]bool{"10": true, "30": true, "90": true}
+	sparkPostSoftClasses = map[string]bool{
+		// Soft and transient failures.
+		"20": true, "21": true, "22": true, "23": true, "24": true, "40": true, "70": true, "100": true,
+		// Admin failures and blocks.
+		"25": true, "50": true, "51": true, "52": true, "53": true, "54": true,
+	}
+)
+
+// SparkPost handles SparkPost webhook event batches.
+type SparkPost struct {
+	authHandler echo.HandlerFunc
+}
+
+// NewSparkPost returns a new SparkPost instance. SparkPost webhooks authenticate
+// with the basic auth credentials configured on the webhook. If the credentials
+// are empty, requests are not authenticated.
+func NewSparkPost(username, password string) *SparkPost {
+	return &SparkPost{
+		authHandler: makeBasicAuthHandler(username, password),
+	}
+}
+
+// ProcessBounce processes a SparkPost event batch and returns bounces for
+// bounce, out of band bounce, and spam complaint events. Other events are ignored.
+func (s *SparkPost) ProcessBounce(b []byte, c echo.Context) ([]models.Bounce, error) {
+	// Do basicauth.
+	if err := s.authHandler(c); err != nil {
+		return nil, err
+	}
+
+	var events []sparkPostEvent
+	if err := json.Unmarshal(b, &events); err != nil {
+		return nil, fmt.Errorf("error unmarshalling sparkpost notification: %v", err)
+	}
+
+	out := make([]models.Bounce, 0, len(events))
+	for _, e := range events {
+		m := e.Msys.MessageEvent
+		if m == nil || m.RcptTo == "" {
+			continue
+		}
+
+		var typ string
+		switch m.Type {
+		case "bounce", "out_of_band":
+			if sparkPostHardClasses[m.BounceClass] {
+				typ = models.BounceTypeHard
+			} else if sparkPostSoftClasses[m.BounceClass] {
+				typ = models.BounceTypeSoft
+			}
+		case "spam_complaint":
+			typ = models.BounceTypeComplaint
+		}
+
+		// Not a bounce (eg: deliveries, auto-replies, or undetermined bounces).
+		if typ == "" {
+			continue
+		}
+
+		// Look for the campaign ID in the recipient metadata.
+		campUUID := ""
+		if v, ok := m.RcptMeta[models.EmailHeaderCampaignUUID]; ok {
+			campUUID = v
+		}
+
+		ts := time.Now()
+		if t, err := strconv.ParseInt(m.Timestamp, 10, 64); err == nil {
+			ts = time.Unix(t, 0)
+		}
+
+		meta, _ := json.Marshal(m)
+		out = append(out, models.Bounce{
+			Email:        strings.ToLower(m.RcptTo),
+			CampaignUUID: campUUID,
+			Type:         typ,
+			Source:       "sparkpost",
+			Meta:         json.RawMessage(meta),
+			CreatedAt:    ts,
+		})
+	}
+
+	return out, nil
+}
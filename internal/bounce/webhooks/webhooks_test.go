@@ -0,0 +1,190 @@
+package webhooks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// newTestContext returns an echo context of a webhook request with the given
+// basic auth credentials, if any.
+func newTestContext(body, username, password string) echo.Context {
+	req := httptest.NewRequest(http.MethodPost, "/webhooks/service", strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if username != "" || password != "" {
+		req.SetBasicAuth(username, password)
+	}
+
+	return echo.New().NewContext(req, httptest.NewRecorder())
+}
+
+// A SparkPost event batch with bounces of every class, an undetermined bounce,
+// a delivery, an open, and a spam complaint.
+const sparkPostBatch = `[
+  {"msys": {"message_event": {"type": "bounce", "bounce_class": "10", "rcpt_to": "Hard10@Example.org", "raw_rcpt_to": "Hard10@Example.org",
+    "reason": "550 5.1.1 <hard10@example.org>: Recipient address rejected: User unknown", "timestamp": "1700000000",
+    "campaign_id": "newsletter", "rcpt_meta": {"X-Listmonk-Campaign": "camp-uuid", "X-Listmonk-Subscriber": "sub-uuid"},
+    "message_id": "0001a2b3c4d5e6f70001", "transmission_id": "84144428322694392"}}},
+  {"msys": {"message_event": {"type": "bounce", "bounce_class": "30", "rcpt_to": "hard30@example.org", "timestamp": "1700000001"}}},
+  {"msys": {"message_event": {"type": "out_of_band", "bounce_class": "90", "rcpt_to": "hard90@example.org", "timestamp": "1700000002"}}},
+  {"msys": {"message_event": {"type": "bounce", "bounce_class": "20", "rcpt_to": "soft20@example.org", "timestamp": "1700000003"}}},
+  {"msys": {"message_event": {"type": "out_of_band", "bounce_class": "21", "rcpt_to": "soft21@example.org", "timestamp": "1700000004"}}},
+  {"msys": {"message_event": {"type": "bounce", "bounce_class": "22", "rcpt_to": "soft22@example.org", "timestamp": "1700000005",
+    "reason": "452 4.2.2 Mailbox full"}}},
+  {"msys": {"message_event": {"type": "bounce", "bounce_class": "1", "rcpt_to": "undetermined@example.org", "timestamp": "1700000006"}}},
+  {"msys": {"message_event": {"type": "delivery", "rcpt_to": "delivered@example.org", "timestamp": "1700000007",
+    "queue_time": "3240", "num_retries": "0"}}},
+  {"msys": {"track_event": {"type": "open", "rcpt_to": "opened@example.org", "timestamp": "1700000007"}}},
+  {"msys": {"message_event": {"type": "spam_complaint", "fbl_type": "abuse", "rcpt_to": "Complaint@Example.org", "timestamp": "1700000008",
+    "rcpt_meta": {"X-Listmonk-Campaign": "camp-uuid"}, "report_by": "server.email.com", "user_agent": "SomeFBLReporter"}}}
+]`
+
+func TestSparkPost(t *testing.T) {
+	s := NewSparkPost("", "")
+
+	bounces, err := s.ProcessBounce([]byte(sparkPostBatch), newTestContext(sparkPostBatch, "", ""))
+	if err != nil {
+		t.Fatalf("error processing sparkpost batch: %v", err)
+	}
+
+	exp := []struct {
+		email string
+		typ   string
+		camp  string
+		ts    int64
+	}{
+		{"hard10@example.org", models.BounceTypeHard, "camp-uuid", 1700000000},
+		{"hard30@example.org", models.BounceTypeHard, "", 1700000001},
+		{"hard90@example.org", models.BounceTypeHard, "", 1700000002},
+		{"soft20@example.org", models.BounceTypeSoft, "", 1700000003},
+		{"soft21@example.org", models.BounceTypeSoft, "", 1700000004},
+		{"soft22@example.org", models.BounceTypeSoft, "", 1700000005},
+		{"complaint@example.org", models.BounceTypeComplaint, "camp-uuid", 1700000008},
+	}
+	if len(bounces) != len(exp) {
+		t.Fatalf("expected %d bounces, got %d: %+v", len(exp), len(bounces), bounces)
+	}
+
+	for i, e := range exp {
+		b := bounces[i]
+		if b.Email != e.email || b.Type != e.typ || b.CampaignUUID != e.camp || b.Source != "sparkpost" {
+			t.Errorf("%s: expected %s bounce of campaign %q, got %+v", e.email, e.typ, e.camp, b)
+		}
+		if !b.CreatedAt.Equal(time.Unix(e.ts, 0)) {
+			t.Errorf("%s: expected the bounce at %v, got %v", e.email, time.Unix(e.ts, 0), b.CreatedAt)
+		}
+		if len(b.Meta) == 0 {
+			t.Errorf("%s: expected the event in the bounce meta", e.email)
+		}
+	}
+}
+
+func TestPostmark(t *testing.T) {
+	cases := []struct {
+		name  string
+		body  string
+		typ   string
+		email string
+		camp  string
+	}{
+		{"hard bounce", `{
+  "RecordType": "Bounce", "MessageStream": "broadcast", "ID": 4323372036854775807, "Type": "HardBounce", "TypeCode": 1,
+  "Name": "Hard bounce", "Tag": "Newsletter", "MessageID": "883953f4-6105-42a2-a16a-77a8eac79483",
+  "Metadata": {"X-Listmonk-Campaign": "camp-uuid", "X-Listmonk-Subscriber": "sub-uuid"}, "ServerID": 23,
+  "Description": "The server was unable to deliver your message (ex: unknown user, mailbox not found).",
+  "Details": "Test bounce details", "Email": "John@Example.com", "From": "sender@example.com",
+  "BouncedAt": "2019-11-05T16:33:54.9070259Z", "DumpAvailable": true, "Inactive": true, "CanActivate": true,
+  "Subject": "Test subject", "Content": "<Full dump of bounce>"}`, models.BounceTypeHard, "john@example.com", "camp-uuid"},
+
+		{"soft bounce", `{
+  "RecordType": "Bounce", "MessageStream": "broadcast", "ID": 4323372036854775808, "Type": "SoftBounce", "TypeCode": 4096,
+  "Name": "Soft bounce", "MessageID": "883953f4-6105-42a2-a16a-77a8eac79484", "ServerID": 23,
+  "Description": "Unable to temporarily deliver this email.", "Email": "jane@example.com",
+  "BouncedAt": "2019-11-05T16:33:54.9070259Z", "Inactive": false}`, models.BounceTypeSoft, "jane@example.com", ""},
+
+		{"spam complaint", `{
+  "RecordType": "SpamComplaint", "MessageStream": "broadcast", "ID": 42, "Type": "SpamComplaint", "TypeCode": 512,
+  "Name": "Spam complaint", "Tag": "Newsletter", "MessageID": "00000000-0000-0000-0000-000000000000",
+  "Metadata": {"X-Listmonk-Campaign": "camp-uuid"}, "ServerID": 1234,
+  "Description": "The subscriber explicitly marked this message as spam.", "Details": "Test spam complaint details",
+  "Email": "Complainer@Example.com", "From": "sender@example.com", "BouncedAt": "2019-11-05T16:33:54.9070259Z",
+  "DumpAvailable": true, "Inactive": true, "CanActivate": false, "Subject": "Test subject"}`, models.BounceTypeComplaint, "complainer@example.com", "camp-uuid"},
+	}
+
+	p := NewPostmark("", "")
+	for _, c := range cases {
+		bounces, err := p.ProcessBounce([]byte(c.body), newTestContext(c.body, "", ""))
+		if err != nil {
+			t.Fatalf("%s: error processing postmark notification: %v", c.name, err)
+		}
+		if len(bounces) != 1 {
+			t.Fatalf("%s: expected 1 bounce, got %d", c.name, len(bounces))
+		}
+
+		b := bounces[0]
+		if b.Email != c.email || b.Type != c.typ || b.CampaignUUID != c.camp || b.Source != "postmark" {
+			t.Errorf("%s: expected %s bounce of %s of campaign %q, got %+v", c.name, c.typ, c.email, c.camp, b)
+		}
+		if exp := time.Date(2019, 11, 5, 16, 33, 54, 907025900, time.UTC); !b.CreatedAt.Equal(exp) {
+			t.Errorf("%s: expected the bounce at %v, got %v", c.name, exp, b.CreatedAt)
+		}
+	}
+
+	// Deliveries aren't bounces.
+	body := `{"RecordType": "Delivery", "ServerID": 23, "MessageStream": "outbound", "MessageID": "883953f4-6105-42a2-a16a-77a8eac79483",
+  "Recipient": "john@example.com", "Tag": "welcome-email", "DeliveredAt": "2019-11-05T16:33:54.9070259Z",
+  "Details": "Test delivery webhook details", "Metadata": {"X-Listmonk-Campaign": "camp-uuid"}}`
+	bounces, err := p.ProcessBounce([]byte(body), newTestContext(body, "", ""))
+	if err != nil || len(bounces) != 0 {
+		t.Errorf("expected deliveries to be ignored, got %+v, %v", bounces, err)
+	}
+}
+
+func TestWebhookAuthAndErrors(t *testing.T) {
+	type processor interface {
+		ProcessBounce([]byte, echo.Context) ([]models.Bounce, error)
+	}
+
+	providers := []struct {
+		name string
+		new  func(username, password string) processor
+		body string
+	}{
+		{"sparkpost", func(u, p string) processor { return NewSparkPost(u, p) }, sparkPostBatch},
+		{"postmark", func(u, p string) processor { return NewPostmark(u, p) },
+			`{"RecordType": "Bounce", "Type": "HardBounce", "Email": "john@example.com", "BouncedAt": "2019-11-05T16:33:54Z"}`},
+	}
+
+	for _, pr := range providers {
+		p := pr.new("listmonk", "secret")
+
+		for _, c := range []struct {
+			name, user, pass string
+			ok               bool
+		}{
+			{"valid credentials", "listmonk", "secret", true},
+			{"wrong password", "listmonk", "wrong", false},
+			{"wrong username", "admin", "secret", false},
+			{"missing credentials", "", "", false},
+		} {
+			bounces, err := p.ProcessBounce([]byte(pr.body), newTestContext(pr.body, c.user, c.pass))
+			if c.ok && (err != nil || len(bounces) == 0) {
+				t.Errorf("%s: %s: expected the bounces, got %v, %v", pr.name, c.name, bounces, err)
+			}
+			if !c.ok && (err == nil || bounces != nil) {
+				t.Errorf("%s: %s: expected the request to be rejected, got %v", pr.name, c.name, bounces)
+			}
+		}
+
+		// Malformed JSON.
+		body := `{"RecordType": "Bounce", [`
+		if _, err := pr.new("", "").ProcessBounce([]byte(body), newTestContext(body, "", "")); err == nil {
+			t.Errorf("%s: expected an error on malformed JSON", pr.name)
+		}
+	}
+}
@@ -11,66 +11,126 @@ import (
 )
 
 const (
-	rootURL = "https://hcaptcha.com/siteverify"
+	ProviderHCaptcha  = "hcaptcha"
+	ProviderTurnstile = "turnstile"
+
+	hCaptchaURL  = "https://hcaptcha.com/siteverify"
+	turnstileURL = "https://challenges.cloudflare.com/turnstile/v0/siteverify"
 )
 
+// Verifier verifies CAPTCHA response tokens submitted by clients with a provider.
+type Verifier interface {
+	// Verify returns whether the token passed the challenge. A non-nil error
+	// indicates that the token couldn't be verified, eg: the provider timed out.
+	Verify(token string) (bool, error)
+
+	// Field returns the name of the form field in which the provider's
+	// client-side widget submits the response token.
+	Field() string
+}
+
 type captchaResp struct {
 	Success    bool     `json:"success"`
-	ErrorCodes []string `json:"error_codes"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// Opt represents the CAPTCHA verifier options.
+type Opt struct {
+	Provider      string        `json:"provider"`
+	CaptchaSecret string        `json:"captcha_secret"`
+	Timeout       time.Duration `json:"timeout"`
+}
+
+// HCaptcha verifies hcaptcha.com tokens.
+type HCaptcha struct {
+	siteVerify
 }
 
-// Captcha is a simple Captcha client.
-// It currently implements hcaptcha.com
-type Captcha struct {
-	o      Opt
+// Turnstile verifies Cloudflare Turnstile tokens.
+type Turnstile struct {
+	siteVerify
+}
+
+// siteVerify is a client for the "siteverify" API that's common to hCaptcha and Turnstile.
+type siteVerify struct {
+	url    string
+	secret string
 	client *http.Client
 }
 
-type Opt struct {
-	CaptchaSecret string `json:"captcha_secret"`
+// New returns a new CAPTCHA verifier for the given provider. hCaptcha is the default.
+func New(o Opt) Verifier {
+	if o.Timeout < time.Second {
+		o.Timeout = time.Second * 5
+	}
+
+	client := &http.Client{
+		Timeout: o.Timeout,
+		Transport: &http.Transport{
+			MaxIdleConnsPerHost:   10,
+			MaxConnsPerHost:       100,
+			ResponseHeaderTimeout: o.Timeout,
+			IdleConnTimeout:       o.Timeout,
+		},
+	}
+
+	if o.Provider == ProviderTurnstile {
+		return &Turnstile{siteVerify{url: turnstileURL, secret: o.CaptchaSecret, client: client}}
+	}
+
+	return &HCaptcha{siteVerify{url: hCaptchaURL, secret: o.CaptchaSecret, client: client}}
 }
 
-// New returns a new instance of the HTTP CAPTCHA client.
-func New(o Opt) *Captcha {
-	timeout := time.Second * 5
-
-	return &Captcha{
-		o: o,
-		client: &http.Client{
-			Timeout: timeout,
-			Transport: &http.Transport{
-				MaxIdleConnsPerHost:   10,
-				MaxConnsPerHost:       100,
-				ResponseHeaderTimeout: timeout,
-				IdleConnTimeout:       timeout,
-			},
-		}}
+// Field returns the form field of the hCaptcha widget.
+func (h *HCaptcha) Field() string {
+	return "h-captcha-response"
 }
 
-// Verify verifies a CAPTCHA request.
-func (c *Captcha) Verify(token string) (error, bool) {
-	resp, err := c.client.PostForm(rootURL, url.Values{
-		"secret":   {c.o.CaptchaSecret},
+// Field returns the form field of the Turnstile widget.
+func (t *Turnstile) Field() string {
+	return "cf-turnstile-response"
+}
+
+// Verify verifies a CAPTCHA token.
+func (s *siteVerify) Verify(token string) (bool, error) {
+	// An empty token can never pass and doesn't have to be sent to the provider.
+	if token == "" {
+		return false, nil
+	}
+
+	resp, err := s.client.PostForm(s.url, url.Values{
+		"secret":   {s.secret},
 		"response": {token},
 	})
 	if err != nil {
-		return err, false
+		return false, err
 	}
 
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err, false
+		return false, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("captcha verification returned status %d", resp.StatusCode)
 	}
 
 	var r captchaResp
-	if json.Unmarshal(body, &r); err != nil {
-		return err, true
+	if err := json.Unmarshal(body, &r); err != nil {
+		return false, err
 	}
 
-	if r.Success != true {
-		return fmt.Errorf("captcha failed: %s", strings.Join(r.ErrorCodes, ",")), false
+	// A failed challenge isn't an error unless it failed because of the
+	// (misconfigured) secret, as opposed to the client's response.
+	if !r.Success {
+		for _, c := range r.ErrorCodes {
+			if strings.Contains(c, "secret") {
+				return false, fmt.Errorf("captcha verification failed: %s", strings.Join(r.ErrorCodes, ","))
+			}
+		}
+		return false, nil
 	}
 
-	return nil, true
+	return true, nil
 }
@@ -0,0 +1,124 @@
+package core
+
+import (
+	"net/http"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// GetAttribFields returns all the subscriber attribute field definitions.
+func (c *Core) GetAttribFields() ([]models.AttribField, error) {
+	out := []models.AttribField{}
+	if err := c.q.GetAttribFields.Select(&out, 0); err != nil {
+		c.log.Error("error fetching attribute fields", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "attribute fields", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// GetAttribField returns a subscriber attribute field definition.
+func (c *Core) GetAttribField(id int) (models.AttribField, error) {
+	var out []models.AttribField
+	if err := c.q.GetAttribFields.Select(&out, id); err != nil {
+		c.log.Error("error fetching attribute field", "error", err)
+		return models.AttribField{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "attribute field", "error", pqErrMsg(err)))
+	}
+
+	if len(out) == 0 {
+		return models.AttribField{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "attribute field"))
+	}
+
+	return out[0], nil
+}
+
+// CreateAttribField creates a subscriber attribute field definition.
+func (c *Core) CreateAttribField(f models.AttribField) (models.AttribField, error) {
+	var newID int
+	if err := c.q.CreateAttribField.Get(&newID, f.Name, f.Type, f.Label, f.Required, f.Options, f.Default); err != nil {
+		c.log.Error("error inserting attribute field", "error", err)
+		return models.AttribField{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "attribute field", "error", pqErrMsg(err)))
+	}
+
+	return c.GetAttribField(newID)
+}
+
+// UpdateAttribField updates a subscriber attribute field definition. Existing
+// attributes of subscribers aren't revalidated.
+func (c *Core) UpdateAttribField(id int, f models.AttribField) (models.AttribField, error) {
+	res, err := c.q.UpdateAttribField.Exec(id, f.Name, f.Type, f.Label, f.Required, f.Options, f.Default)
+	if err != nil {
+		c.log.Error("error updating attribute field", "error", err)
+		return models.AttribField{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "attribute field", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.AttribField{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "attribute field"))
+	}
+
+	return c.GetAttribField(id)
+}
+
+// DeleteAttribField deletes a subscriber attribute field definition. The
+// attributes of subscribers are retained as freeform attributes.
+func (c *Core) DeleteAttribField(id int) error {
+	res, err := c.q.DeleteAttribField.Exec(id)
+	if err != nil {
+		c.log.Error("error deleting attribute field", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "attribute field", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "attribute field"))
+	}
+
+	return nil
+}
+
+// applyAttribFields validates subscriber attributes against the attribute field
+// definitions and sets the defaults of absent attributes. Attributes that don't
+// have definitions are freeform and are left as they are.
+func (c *Core) applyAttribFields(attribs models.JSON) (models.JSON, error) {
+	fields, err := c.GetAttribFields()
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return attribs, nil
+	}
+
+	if attribs == nil {
+		attribs = models.JSON{}
+	}
+	for _, f := range fields {
+		v, ok := attribs[f.Name]
+		if !ok || v == nil {
+			if def, ok := f.DefaultValue(); ok {
+				attribs[f.Name] = def
+				continue
+			}
+
+			if f.Required {
+				return nil, echo.NewHTTPError(http.StatusBadRequest,
+					c.i18n.Ts("globals.messages.invalidFields", "name", "attribs."+f.Name))
+			}
+			continue
+		}
+
+		if !f.ValidValue(v) {
+			return nil, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.invalidFields", "name", "attribs."+f.Name+" ("+f.Type+")"))
+		}
+	}
+
+	return attribs, nil
+}
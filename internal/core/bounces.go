@@ -1,9 +1,12 @@
 package core
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
@@ -25,7 +28,7 @@ func (c *Core) QueryBounces(campID, subID int, source, orderBy, order string, of
 	out := []models.Bounce{}
 	stmt := strings.ReplaceAll(c.q.QueryBounces, "%order%", orderBy+" "+order)
 	if err := c.db.Select(&out, stmt, 0, campID, subID, source, offset, limit); err != nil {
-		c.log.Printf("error fetching bounces: %v", err)
+		c.log.Error("error fetching bounces", "error", err)
 		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.bounce}", "error", pqErrMsg(err)))
 	}
@@ -43,7 +46,7 @@ func (c *Core) GetBounce(id int) (models.Bounce, error) {
 	var out []models.Bounce
 	stmt := fmt.Sprintf(c.q.QueryBounces, "id", SortAsc)
 	if err := c.db.Select(&out, stmt, id, 0, 0, "", 0, 1); err != nil {
-		c.log.Printf("error fetching bounces: %v", err)
+		c.log.Error("error fetching bounces", "error", err)
 		return models.Bounce{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.bounce}", "error", pqErrMsg(err)))
 	}
@@ -64,6 +67,23 @@ func (c *Core) RecordBounce(b models.Bounce) error {
 		return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": "+b.Type)
 	}
 
+	return c.recordBounce(b, action.Count, action.Action)
+}
+
+// RecordComplaint records a complaint bounce and blocklists the subscriber
+// irrespective of the configured complaint bounce action.
+func (c *Core) RecordComplaint(b models.Bounce) error {
+	b.Type = models.BounceTypeComplaint
+	return c.recordBounce(b, 1, models.BounceRuleActionBlocklist)
+}
+
+// recordBounce records a bounce and applies the action if the subscriber's
+// number of bounces of the type reaches count.
+func (c *Core) recordBounce(b models.Bounce, count int, action string) error {
+	if c.consts.Sandbox {
+		action = "none"
+	}
+
 	_, err := c.q.RecordBounce.Exec(b.SubscriberUUID,
 		b.Email,
 		b.CampaignUUID,
@@ -71,20 +91,29 @@ func (c *Core) RecordBounce(b models.Bounce) error {
 		b.Source,
 		b.Meta,
 		b.CreatedAt,
-		action.Count,
-		action.Action)
+		count,
+		action)
 
 	if err != nil {
 		// Ignore the error if it complained of no subscriber.
 		if pqErr, ok := err.(*pq.Error); ok && pqErr.Column == "subscriber_id" {
-			c.log.Printf("bounced subscriber (%s / %s) not found", b.SubscriberUUID, b.Email)
+			c.log.Warn(fmt.Sprintf("bounced subscriber (%s / %s) not found", b.SubscriberUUID, b.Email), "subscriber_uuid", b.SubscriberUUID)
 			return nil
 		}
 
-		c.log.Printf("error recording bounce: %v", err)
+		c.log.Error("error recording bounce", "error", err)
+		return err
 	}
 
-	return err
+	c.Emit(models.EventSubscriberBounced, map[string]interface{}{
+		"subscriber_uuid": b.SubscriberUUID,
+		"email":           b.Email,
+		"campaign_uuid":   b.CampaignUUID,
+		"type":            b.Type,
+		"source":          b.Source,
+	})
+
+	return nil
 }
 
 // DeleteBounce deletes a list.
@@ -95,9 +124,217 @@ func (c *Core) DeleteBounce(id int) error {
 // DeleteBounces deletes multiple lists.
 func (c *Core) DeleteBounces(ids []int) error {
 	if _, err := c.q.DeleteBounces.Exec(pq.Array(ids)); err != nil {
-		c.log.Printf("error deleting lists: %v", err)
+		c.log.Error("error deleting lists", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
 	}
 	return nil
 }
+
+// GetBounceRules returns the bounce rules from the settings.
+func (c *Core) GetBounceRules() ([]models.BounceRule, error) {
+	s, err := c.GetSettings()
+	if err != nil {
+		return nil, err
+	}
+
+	if s.BounceRules == nil {
+		return []models.BounceRule{}, nil
+	}
+
+	return s.BounceRules, nil
+}
+
+// SetBounceRules validates and saves the bounce rules in the settings.
+func (c *Core) SetBounceRules(rules []models.BounceRule) error {
+	if err := c.ValidateBounceRules(rules); err != nil {
+		return err
+	}
+
+	if rules == nil {
+		rules = []models.BounceRule{}
+	}
+
+	b, err := json.Marshal(map[string]interface{}{"bounce.rules": rules})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("settings.errorEncoding", "error", err.Error()))
+	}
+
+	if _, err := c.q.UpdateSettings.Exec(b); err != nil {
+		c.log.Error("error updating bounce rules", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.settings}", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// ValidateBounceRules validates the given bounce rules.
+func (c *Core) ValidateBounceRules(rules []models.BounceRule) error {
+	for _, r := range rules {
+		switch r.Type {
+		case models.BounceTypeHard, models.BounceTypeSoft, models.BounceTypeComplaint:
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": bounce rule type: "+r.Type)
+		}
+
+		if r.Count < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": bounce rule count should be >= 1")
+		}
+
+		if d, err := time.ParseDuration(r.Window); err != nil || d < time.Minute {
+			return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": bounce rule window should be a duration >= 1m")
+		}
+
+		if r.Action != models.BounceRuleActionBlocklist && r.Action != models.BounceRuleActionRemove {
+			return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": bounce rule action should be blocklist or remove")
+		}
+	}
+
+	return nil
+}
+
+// ProcessBounceRules evaluates the bounce rules against each subscriber's bounces
+// and blocklists them or removes them from the lists of the bounced campaigns.
+// It returns the number of subscribers that were acted upon.
+func (c *Core) ProcessBounceRules() (int, error) {
+	if c.consts.Sandbox {
+		return 0, nil
+	}
+
+	rules, err := c.GetBounceRules()
+	if err != nil {
+		return 0, err
+	}
+
+	// Fetch the bounces within the longest window of the rules.
+	var win time.Duration
+	for _, r := range rules {
+		if d, err := time.ParseDuration(r.Window); err == nil && d > win {
+			win = d
+		}
+	}
+	if win == 0 {
+		return 0, nil
+	}
+
+	var (
+		bounces []ruleBounce
+		acts    []ruleAction
+	)
+	if err := c.q.GetBounceRuleBounces.Select(&bounces, win.Seconds()); err != nil {
+		c.log.Error("error fetching bounces for bounce rules", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.bounces}", "error", pqErrMsg(err)))
+	}
+	if err := c.q.GetBounceRuleActions.Select(&acts, win.Seconds()); err != nil {
+		c.log.Error("error fetching bounce rule actions", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.bounces}", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	for _, a := range evalBounceRules(rules, bounces, acts, time.Now()) {
+		var n int
+		if err := c.q.ApplyBounceRule.Get(&n, a.SubscriberID, a.Type, a.Action, a.Count, pq.Array(a.CampaignIDs)); err != nil {
+			c.log.Error(fmt.Sprintf("error applying bounce rule (%s, %s) on subscriber %d", a.Type, a.Action, a.SubscriberID), "error", err)
+			return total, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.bounces}", "error", pqErrMsg(err)))
+		}
+		total += n
+	}
+
+	return total, nil
+}
+
+// ruleBounce is a bounce that the bounce rules are evaluated against.
+type ruleBounce struct {
+	SubscriberID int       `db:"subscriber_id"`
+	Type         string    `db:"type"`
+	CampaignID   *int      `db:"campaign_id"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+// ruleAction is the last action of a bounce rule of a type on a subscriber.
+type ruleAction struct {
+	SubscriberID int       `db:"subscriber_id"`
+	Type         string    `db:"type"`
+	Action       string    `db:"action"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+// bounceAction is an action of a bounce rule to be taken on a subscriber who has
+// Count bounces of Type on the campaigns CampaignIDs.
+type bounceAction struct {
+	SubscriberID int
+	Type         string
+	Action       string
+	Count        int
+	CampaignIDs  []int
+}
+
+// evalBounceRules evaluates the bounce rules against the bounces of every subscriber
+// and returns the actions to be taken, ordered by subscriber. A rule applies to a
+// subscriber who has at least Count bounces of the rule's type within its window.
+// Bounces from before the last action of the same rule type and action on the
+// subscriber have already been acted upon and aren't counted again.
+func evalBounceRules(rules []models.BounceRule, bounces []ruleBounce, acts []ruleAction, now time.Time) []bounceAction {
+	type actKey struct {
+		subID       int
+		typ, action string
+	}
+	last := make(map[actKey]time.Time, len(acts))
+	for _, a := range acts {
+		last[actKey{a.SubscriberID, a.Type, a.Action}] = a.CreatedAt
+	}
+
+	var (
+		out  []bounceAction
+		done = make(map[actKey]bool)
+	)
+	for _, r := range rules {
+		win, err := time.ParseDuration(r.Window)
+		if err != nil {
+			continue
+		}
+
+		// Aggregate the subscribers' bounces of the rule's type.
+		var (
+			subs  = make(map[int]*bounceAction)
+			camps = make(map[int]map[int]bool)
+		)
+		for _, b := range bounces {
+			k := actKey{b.SubscriberID, r.Type, r.Action}
+			if b.Type != r.Type || !b.CreatedAt.After(now.Add(-win)) || !b.CreatedAt.After(last[k]) || done[k] {
+				continue
+			}
+
+			a, ok := subs[b.SubscriberID]
+			if !ok {
+				a = &bounceAction{SubscriberID: b.SubscriberID, Type: r.Type, Action: r.Action}
+				subs[b.SubscriberID] = a
+				camps[b.SubscriberID] = make(map[int]bool)
+			}
+			a.Count++
+
+			if b.CampaignID != nil && !camps[b.SubscriberID][*b.CampaignID] {
+				camps[b.SubscriberID][*b.CampaignID] = true
+				a.CampaignIDs = append(a.CampaignIDs, *b.CampaignID)
+			}
+		}
+
+		for id, a := range subs {
+			if a.Count >= r.Count {
+				done[actKey{id, r.Type, r.Action}] = true
+				out = append(out, *a)
+			}
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].SubscriberID < out[j].SubscriberID
+	})
+
+	return out
+}
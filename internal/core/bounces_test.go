@@ -0,0 +1,63 @@
+package core
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+func testBounces(subID int, typ string, campIDs ...int) []ruleBounce {
+	out := make([]ruleBounce, len(campIDs))
+	for i := range campIDs {
+		out[i] = ruleBounce{SubscriberID: subID, Type: typ, CampaignID: &campIDs[i], CreatedAt: time.Now().Add(-time.Minute)}
+	}
+	return out
+}
+
+func TestEvalBounceRules(t *testing.T) {
+	rules := []models.BounceRule{
+		{Type: models.BounceTypeHard, Count: 3, Window: "24h", Action: models.BounceRuleActionBlocklist},
+		{Type: models.BounceTypeSoft, Count: 5, Window: "24h", Action: models.BounceRuleActionBlocklist},
+	}
+
+	// 3 hard bounces trigger the blocklist, but 3 soft bounces don't.
+	var bounces []ruleBounce
+	bounces = append(bounces, testBounces(1, models.BounceTypeHard, 10, 11, 10)...)
+	bounces = append(bounces, testBounces(2, models.BounceTypeSoft, 10, 11, 12)...)
+
+	got := evalBounceRules(rules, bounces, nil, time.Now())
+	exp := []bounceAction{{SubscriberID: 1, Type: models.BounceTypeHard, Action: models.BounceRuleActionBlocklist, Count: 3, CampaignIDs: []int{10, 11}}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Fatalf("expected %+v, got %+v", exp, got)
+	}
+
+	// Bounces that were acted upon aren't counted again.
+	acts := []ruleAction{{SubscriberID: 1, Type: models.BounceTypeHard, Action: models.BounceRuleActionBlocklist, CreatedAt: time.Now()}}
+	if got := evalBounceRules(rules, bounces, acts, time.Now()); len(got) != 0 {
+		t.Errorf("expected no actions on bounces that were acted upon, got %+v", got)
+	}
+
+	// Bounces outside the rule's window aren't counted.
+	if got := evalBounceRules(rules, bounces, nil, time.Now().Add(time.Hour*25)); len(got) != 0 {
+		t.Errorf("expected no actions on bounces outside the window, got %+v", got)
+	}
+}
+
+func TestEvalBounceRulesMatchingType(t *testing.T) {
+	rules := []models.BounceRule{
+		{Type: models.BounceTypeSoft, Count: 3, Window: "1h", Action: models.BounceRuleActionRemove},
+	}
+
+	// Hard bounces don't count towards a soft bounce rule.
+	var bounces []ruleBounce
+	bounces = append(bounces, testBounces(1, models.BounceTypeHard, 10, 11, 12)...)
+	bounces = append(bounces, testBounces(2, models.BounceTypeSoft, 10, 10, 10)...)
+
+	got := evalBounceRules(rules, bounces, nil, time.Now())
+	exp := []bounceAction{{SubscriberID: 2, Type: models.BounceTypeSoft, Action: models.BounceRuleActionRemove, Count: 3, CampaignIDs: []int{10}}}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected %+v, got %+v", exp, got)
+	}
+}
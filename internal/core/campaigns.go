@@ -1,15 +1,20 @@
 package core
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/gdgvda/cron"
 	"github.com/gofrs/uuid/v5"
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
 )
 
 const (
@@ -21,6 +26,20 @@ const (
 	campaignTplArchive = "archive"
 )
 
+// CloneOpts are the optional overrides of a cloned campaign.
+type CloneOpts struct {
+	Name    string
+	Subject string
+
+	// The lists that replace the campaign's lists and list group.
+	ListIDs []int
+
+	TemplateID int
+
+	// Copy the send time and send window of the campaign.
+	CopySchedule bool
+}
+
 // QueryCampaigns retrieves paginated campaigns optionally filtering them by the given arbitrary
 // query expression. It also returns the total number of records in the DB.
 func (c *Core) QueryCampaigns(searchStr string, statuses, tags []string, orderBy, order string, offset, limit int) (models.Campaigns, int, error) {
@@ -37,7 +56,7 @@ func (c *Core) QueryCampaigns(searchStr string, statuses, tags []string, orderBy
 	// Unsafe to ignore scanning fields not present in models.Campaigns.
 	var out models.Campaigns
 	if err := c.db.Select(&out, stmt, 0, pq.StringArray(statuses), pq.StringArray(tags), queryStr, offset, limit); err != nil {
-		c.log.Printf("error fetching campaigns: %v", err)
+		c.log.Error("error fetching campaigns", "error", err)
 		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
@@ -51,10 +70,11 @@ func (c *Core) QueryCampaigns(searchStr string, statuses, tags []string, orderBy
 
 	// Lazy load stats.
 	if err := out.LoadStats(c.q.GetCampaignStats); err != nil {
-		c.log.Printf("error fetching campaign stats: %v", err)
+		c.log.Error("error fetching campaign stats", "error", err)
 		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaigns}", "error", pqErrMsg(err)))
 	}
+	c.applyViewTracking(out)
 
 	total := 0
 	if len(out) > 0 {
@@ -97,7 +117,7 @@ func (c *Core) getCampaign(id int, uuid, archiveSlug string, tplType string) (mo
 	var out models.Campaigns
 	if err := c.q.GetCampaign.Select(&out, id, uu, archiveSlug, tplType); err != nil {
 		// if err := c.db.Select(&out, stmt, 0, pq.Array([]string{}), queryStr, 0, 1); err != nil {
-		c.log.Printf("error fetching campaign: %v", err)
+		c.log.Error("error fetching campaign", "error", err)
 		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
@@ -116,14 +136,26 @@ func (c *Core) getCampaign(id int, uuid, archiveSlug string, tplType string) (mo
 
 	// Lazy load stats.
 	if err := out.LoadStats(c.q.GetCampaignStats); err != nil {
-		c.log.Printf("error fetching campaign stats: %v", err)
+		c.log.Error("error fetching campaign stats", "error", err)
 		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
+	c.applyViewTracking(out)
 
 	return out[0], nil
 }
 
+// applyViewTracking turns off the effective view tracking of campaigns
+// if it's disabled globally.
+func (c *Core) applyViewTracking(camps models.Campaigns) {
+	if c.consts.TrackViews {
+		return
+	}
+	for i := range camps {
+		camps[i].ViewsTracked = false
+	}
+}
+
 // GetCampaignForPreview retrieves a campaign with a template body.
 func (c *Core) GetCampaignForPreview(id, tplID int) (models.Campaign, error) {
 	var out models.Campaign
@@ -133,7 +165,7 @@ func (c *Core) GetCampaignForPreview(id, tplID int) (models.Campaign, error) {
 				c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
 		}
 
-		c.log.Printf("error fetching campaign: %v", err)
+		c.log.Error("error fetching campaign", "error", err)
 		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
@@ -145,7 +177,7 @@ func (c *Core) GetCampaignForPreview(id, tplID int) (models.Campaign, error) {
 func (c *Core) GetArchivedCampaigns(offset, limit int) (models.Campaigns, int, error) {
 	var out models.Campaigns
 	if err := c.q.GetArchivedCampaigns.Select(&out, offset, limit, campaignTplArchive); err != nil {
-		c.log.Printf("error fetching public campaigns: %v", err)
+		c.log.Error("error fetching public campaigns", "error", err)
 		return models.Campaigns{}, 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
@@ -162,11 +194,20 @@ func (c *Core) GetArchivedCampaigns(offset, limit int) (models.Campaigns, int, e
 func (c *Core) CreateCampaign(o models.Campaign, listIDs []int, mediaIDs []int) (models.Campaign, error) {
 	uu, err := uuid.NewV4()
 	if err != nil {
-		c.log.Printf("error generating UUID: %v", err)
+		c.log.Error("error generating UUID", "error", err)
 		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
 	}
 
+	// Without a template, the campaign uses the default template of its lists, if any.
+	if o.TemplateID == 0 && len(listIDs) > 0 {
+		lists, err := c.GetListsByOptin(listIDs, "")
+		if err != nil {
+			return models.Campaign{}, err
+		}
+		o.TemplateID = campaignTemplateID(o.TemplateID, listIDs, lists)
+	}
+
 	// Insert and read ID.
 	var newID int
 	if err := c.q.CreateCampaign.Get(&newID,
@@ -189,16 +230,26 @@ func (c *Core) CreateCampaign(o models.Campaign, listIDs []int, mediaIDs []int)
 		o.ArchiveTemplateID,
 		o.ArchiveMeta,
 		pq.Array(mediaIDs),
+		o.AMPBody,
+		o.ExcludeListIDs,
+		o.ExcludeCampaignIDs,
+		o.PerListCopies,
+		o.Preheader,
+		o.UTM,
 	); err != nil {
 		if err == sql.ErrNoRows {
 			return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("campaigns.noSubs"))
 		}
 
-		c.log.Printf("error creating campaign: %v", err)
+		c.log.Error("error creating campaign", "error", err)
 		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
 
+	if err := c.renderCampaignBody(newID, o.ContentType, o.Body); err != nil {
+		return models.Campaign{}, err
+	}
+
 	out, err := c.GetCampaign(newID, "", "")
 	if err != nil {
 		return models.Campaign{}, err
@@ -207,9 +258,86 @@ func (c *Core) CreateCampaign(o models.Campaign, listIDs []int, mediaIDs []int)
 	return out, nil
 }
 
-// UpdateCampaign updates a campaign.
-func (c *Core) UpdateCampaign(id int, o models.Campaign, listIDs []int, mediaIDs []int, sendLater bool) (models.Campaign, error) {
-	_, err := c.q.UpdateCampaign.Exec(id,
+// campaignTemplateID resolves the template of a campaign: the campaign's own
+// template > the default template of the first of its lists (in the given order)
+// that has one > 0, which is the global default template.
+func campaignTemplateID(tplID int, listIDs []int, lists []models.List) int {
+	if tplID > 0 {
+		return tplID
+	}
+
+	tpls := make(map[int]int, len(lists))
+	for _, l := range lists {
+		if l.TemplateID.Valid {
+			tpls[l.ID] = int(l.TemplateID.Int)
+		}
+	}
+	for _, id := range listIDs {
+		if t, ok := tpls[id]; ok {
+			return t
+		}
+	}
+
+	return 0
+}
+
+// CloneCampaign clones a campaign into a new draft campaign with the given overrides
+// and returns the ID of the new campaign. The stats of the campaign are not copied.
+func (c *Core) CloneCampaign(id int, o CloneOpts) (int, error) {
+	cm, err := c.GetCampaign(id, "", "")
+	if err != nil {
+		return 0, err
+	}
+
+	if o.TemplateID > 0 {
+		tpl, err := c.GetTemplate(o.TemplateID, true)
+		if err != nil {
+			return 0, err
+		}
+
+		if tpl.Type != models.TemplateTypeCampaign {
+			return 0, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
+		}
+	}
+
+	if o.Name == "" {
+		o.Name = c.i18n.Ts("campaigns.copyOf", "name", cm.Name)
+	}
+	if o.ListIDs == nil {
+		o.ListIDs = []int{}
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		c.log.Error("error generating UUID", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
+	}
+
+	var newID int
+	if err := c.q.CloneCampaign.Get(&newID, id, uu, o.Name, o.Subject, o.TemplateID, pq.Array(o.ListIDs), o.CopySchedule); err != nil {
+		c.log.Error("error cloning campaign", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return newID, nil
+}
+
+// UpdateCampaign updates a campaign. If the content of the campaign changes,
+// the previous and the new content are recorded in the version history.
+//
+// If the update is based on a revision of the campaign and the campaign has been
+// changed since, the update is rejected with a 409 error that carries the campaign's
+// current state. Updates without a revision aren't checked.
+func (c *Core) UpdateCampaign(id int, o models.Campaign, listIDs []int, mediaIDs []int, sendLater bool, revision null.Int, author string) (models.Campaign, error) {
+	// Snapshot the existing content in case it was never versioned (eg: campaigns
+	// created before versioning was enabled).
+	c.snapshotCampaign(id, author)
+
+	var updID int
+	err := c.q.UpdateCampaign.Get(&updID, id,
 		o.Name,
 		o.Subject,
 		o.FromEmail,
@@ -227,13 +355,30 @@ func (c *Core) UpdateCampaign(id int, o models.Campaign, listIDs []int, mediaIDs
 		o.ArchiveSlug,
 		o.ArchiveTemplateID,
 		o.ArchiveMeta,
-		pq.Array(mediaIDs))
+		pq.Array(mediaIDs),
+		o.AMPBody,
+		o.ExcludeListIDs,
+		o.ExcludeCampaignIDs,
+		o.PerListCopies,
+		o.Preheader,
+		c.consts.CampaignApproval,
+		revision,
+		o.UTM)
+	if err == sql.ErrNoRows {
+		return models.Campaign{}, c.campaignConflict(id)
+	}
 	if err != nil {
-		c.log.Printf("error updating campaign: %v", err)
+		c.log.Error("error updating campaign", "error", err)
 		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
 
+	if err := c.renderCampaignBody(id, o.ContentType, o.Body); err != nil {
+		return models.Campaign{}, err
+	}
+
+	c.snapshotCampaign(id, author)
+
 	out, err := c.GetCampaign(id, "", "")
 	if err != nil {
 		return models.Campaign{}, err
@@ -242,6 +387,125 @@ func (c *Core) UpdateCampaign(id int, o models.Campaign, listIDs []int, mediaIDs
 	return out, nil
 }
 
+// UpdateCampaignBody auto-saves the body of a campaign based on the given revision
+// and returns the new revision. Unlike UpdateCampaign, the change isn't recorded in
+// the version history. If the campaign has been changed since the revision, a 409
+// error that carries the campaign's current state is returned. Without a revision,
+// the body is saved unconditionally.
+func (c *Core) UpdateCampaignBody(id int, body string, revision null.Int) (int, error) {
+	var rev int
+	if err := c.q.UpdateCampaignBody.Get(&rev, id, body, revision, c.consts.CampaignApproval); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, c.campaignConflict(id)
+		}
+
+		c.log.Error("error updating campaign body", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	cm, err := c.GetCampaign(id, "", "")
+	if err != nil {
+		return 0, err
+	}
+	if err := c.renderCampaignBody(id, cm.ContentType, cm.Body); err != nil {
+		return 0, err
+	}
+
+	return rev, nil
+}
+
+// campaignConflict returns the error for an update of a campaign that's based on
+// a stale revision. The error's body has the campaign's current state under data
+// so that the client can show or merge the changes.
+func (c *Core) campaignConflict(id int) error {
+	cm, err := c.GetCampaign(id, "", "")
+	if err != nil {
+		return err
+	}
+
+	return echo.NewHTTPError(http.StatusConflict, struct {
+		Message string          `json:"message"`
+		Data    models.Campaign `json:"data"`
+	}{c.i18n.T("campaigns.updateConflict"), cm})
+}
+
+// GetCampaignVersions retrieves the content version history of a campaign, latest first.
+func (c *Core) GetCampaignVersions(campID int) ([]models.CampaignVersion, error) {
+	out := []models.CampaignVersion{}
+	if err := c.q.GetCampaignVersions.Select(&out, campID); err != nil {
+		c.log.Error("error fetching campaign versions", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// RestoreCampaignVersion restores the subject and body of a campaign from one of
+// its versions. The campaign's status and stats are not changed.
+func (c *Core) RestoreCampaignVersion(campID, version int, author string) (models.Campaign, error) {
+	res, err := c.q.RestoreCampaignVersion.Exec(campID, version, c.consts.CampaignApproval)
+	if err != nil {
+		c.log.Error("error restoring campaign version", "error", err)
+		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+	}
+
+	// The restored content becomes the latest version.
+	c.snapshotCampaign(campID, author)
+
+	out, err := c.GetCampaign(campID, "", "")
+	if err != nil {
+		return models.Campaign{}, err
+	}
+
+	if err := c.renderCampaignBody(campID, out.ContentType, out.Body); err != nil {
+		return models.Campaign{}, err
+	}
+
+	return c.GetCampaign(campID, "", "")
+}
+
+// renderCampaignBody renders and stores the HTML of a Markdown campaign's body.
+// For other content types, the stored HTML is cleared.
+func (c *Core) renderCampaignBody(campID int, contentType, body string) error {
+	var out null.String
+	if contentType == models.CampaignContentTypeMarkdown {
+		h, err := models.MarkdownToHTML(body)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": "+err.Error())
+		}
+		out = null.StringFrom(h)
+	}
+
+	if _, err := c.q.UpdateCampaignBodyHTML.Exec(campID, out); err != nil {
+		c.log.Error("error updating campaign body", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// snapshotCampaign records the current content of a campaign as a new version
+// if it differs from the last version. Errors are only logged as a failure to
+// record history shouldn't block the campaign from being saved.
+func (c *Core) snapshotCampaign(campID int, author string) {
+	if c.consts.MaxCampaignVersions < 1 {
+		return
+	}
+
+	if _, err := c.q.InsertCampaignVersion.Exec(campID, author, c.consts.MaxCampaignVersions); err != nil {
+		c.log.Error("error recording campaign version", "error", err)
+	}
+}
+
 // UpdateCampaignStatus updates a campaign's status, eg: draft to running.
 func (c *Core) UpdateCampaignStatus(id int, status string) (models.Campaign, error) {
 	cm, err := c.GetCampaign(id, "", "")
@@ -277,13 +541,20 @@ func (c *Core) UpdateCampaignStatus(id int, status string) (models.Campaign, err
 		}
 	}
 
+	// Draft campaigns can only be started or scheduled once approved.
+	if errMsg == "" && c.consts.CampaignApproval && cm.Status == models.CampaignStatusDraft &&
+		(status == models.CampaignStatusRunning || status == models.CampaignStatusScheduled) &&
+		cm.ApprovalStatus != models.CampaignApprovalApproved {
+		errMsg = c.i18n.T("campaigns.approvalRequired")
+	}
+
 	if len(errMsg) > 0 {
 		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest, errMsg)
 	}
 
 	res, err := c.q.UpdateCampaignStatus.Exec(cm.ID, status)
 	if err != nil {
-		c.log.Printf("error updating campaign status: %v", err)
+		c.log.Error("error updating campaign status", "error", err)
 
 		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
@@ -298,11 +569,173 @@ func (c *Core) UpdateCampaignStatus(id int, status string) (models.Campaign, err
 	return cm, nil
 }
 
+// UpdateCampaignApproval moves a campaign through the approval workflow. A draft
+// or scheduled campaign is submitted for approval (pending) and is then approved
+// or rejected with a reason. Every change is recorded in the campaign's approval
+// log with the user who made it.
+func (c *Core) UpdateCampaignApproval(id int, status, reason, user string) (models.Campaign, error) {
+	cm, err := c.GetCampaign(id, "", "")
+	if err != nil {
+		return models.Campaign{}, err
+	}
+
+	reason = strings.TrimSpace(reason)
+
+	var (
+		errMsg string
+		from   []string
+	)
+	switch status {
+	case models.CampaignApprovalPending:
+		if cm.Status != models.CampaignStatusDraft && cm.Status != models.CampaignStatusScheduled {
+			errMsg = c.i18n.T("campaigns.approvalOnlyDraft")
+		}
+		from = []string{models.CampaignApprovalNone, models.CampaignApprovalRejected}
+
+	case models.CampaignApprovalApproved, models.CampaignApprovalRejected:
+		if cm.ApprovalStatus != models.CampaignApprovalPending {
+			errMsg = c.i18n.T("campaigns.approvalOnlyPending")
+		}
+		if status == models.CampaignApprovalRejected && reason == "" {
+			errMsg = c.i18n.Ts("globals.messages.invalidFields", "name", "reason")
+		}
+		from = []string{models.CampaignApprovalPending}
+
+	default:
+		errMsg = c.i18n.Ts("globals.messages.invalidFields", "name", "status")
+	}
+
+	if len(errMsg) > 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest, errMsg)
+	}
+
+	res, err := c.q.UpdateCampaignApproval.Exec(cm.ID, status, reason, user, pq.StringArray(from))
+	if err != nil {
+		c.log.Error("error updating campaign approval", "error", err)
+		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	// The approval status changed in the meantime.
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("campaigns.approvalOnlyPending"))
+	}
+
+	return c.GetCampaign(id, "", "")
+}
+
+// GetCampaignApprovals retrieves the approval log of a campaign, latest first.
+func (c *Core) GetCampaignApprovals(campID int) ([]models.CampaignApproval, error) {
+	out := []models.CampaignApproval{}
+	if err := c.q.GetCampaignApprovals.Select(&out, campID); err != nil {
+		c.log.Error("error fetching campaign approvals", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
 // UpdateCampaignArchive updates a campaign's archive properties.
 func (c *Core) UpdateCampaignArchive(id int, enabled bool, tplID int, meta models.JSON, archiveSlug string) error {
 	if _, err := c.q.UpdateCampaignArchive.Exec(id, enabled, archiveSlug, tplID, meta); err != nil {
-		c.log.Printf("error updating campaign: %v", err)
+		c.log.Error("error updating campaign", "error", err)
+
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
 
+	return nil
+}
+
+// CreateRecurringCampaign creates a recurring campaign which acts as a template that is
+// cloned into a new campaign at every trigger of the given cron expression.
+func (c *Core) CreateRecurringCampaign(o models.Campaign, listIDs []int, mediaIDs []int, cronExp string) (models.Campaign, error) {
+	if _, err := c.nextRecurrence(cronExp, time.Now()); err != nil {
+		return models.Campaign{}, err
+	}
+
+	out, err := c.CreateCampaign(o, listIDs, mediaIDs)
+	if err != nil {
+		return models.Campaign{}, err
+	}
+
+	return c.UpdateCampaignRecurrence(out.ID, cronExp, true)
+}
+
+// UpdateCampaignRecurrence sets or clears (empty cronExp) the cron expression of a
+// recurring campaign and (de)activates the recurrence. The next trigger time is
+// computed from the current time.
+func (c *Core) UpdateCampaignRecurrence(id int, cronExp string, active bool) (models.Campaign, error) {
+	var nextAt null.Time
+	if cronExp != "" {
+		t, err := c.nextRecurrence(cronExp, time.Now())
+		if err != nil {
+			return models.Campaign{}, err
+		}
+		nextAt = null.TimeFrom(t)
+	} else {
+		active = false
+	}
+
+	res, err := c.q.UpdateCampaignRecurrence.Exec(id, cronExp, active, nextAt)
+	if err != nil {
+		c.log.Error("error updating campaign recurrence", "error", err)
+		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+	}
+
+	return c.GetCampaign(id, "", "")
+}
+
+// GetDueRecurringCampaigns retrieves active recurring campaigns whose next trigger
+// time is at or before the given time.
+func (c *Core) GetDueRecurringCampaigns(now time.Time) ([]models.Campaign, error) {
+	out := []models.Campaign{}
+	if err := c.q.GetDueRecurringCampaigns.Select(&out, now); err != nil {
+		c.log.Error("error fetching recurring campaigns", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaigns}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// RunRecurringCampaign clones a recurring campaign into a new campaign that's scheduled
+// to be sent at runAt and sets the campaign's next trigger time to nextAt. It returns
+// the ID of the new campaign, or 0 if the trigger time has already been run.
+func (c *Core) RunRecurringCampaign(id int, runAt, nextAt time.Time) (int, error) {
+	uu, err := uuid.NewV4()
+	if err != nil {
+		c.log.Error("error generating UUID", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
+	}
+
+	var newID int
+	if err := c.q.CloneRecurringCampaign.Get(&newID, id, uu, runAt, nextAt, c.consts.CampaignApproval); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+
+		c.log.Error("error cloning recurring campaign", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return newID, nil
+}
+
+// SetRecurringCampaignNextRun sets the next trigger time of a recurring campaign
+// without running it, for instance, when missed runs are skipped.
+func (c *Core) SetRecurringCampaignNextRun(id int, nextAt time.Time) error {
+	if _, err := c.q.SetCampaignRecurrenceNext.Exec(id, nextAt); err != nil {
+		c.log.Error("error updating campaign recurrence", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
@@ -310,11 +743,349 @@ func (c *Core) UpdateCampaignArchive(id int, enabled bool, tplID int, meta model
 	return nil
 }
 
+// TriggerCampaign launches a new run of a draft campaign that's sent only to the
+// subscribers on its lists who match the given e-mails, if any, and the query
+// expression, if any. It returns the ID of the run and its number of recipients.
+// If there are more than max recipients, the campaign isn't triggered.
+func (c *Core) TriggerCampaign(id int, emails []string, query string, max int) (int, int, error) {
+	cm, err := c.GetCampaign(id, "", "")
+	if err != nil {
+		return 0, 0, err
+	}
+	if cm.Status != models.CampaignStatusDraft {
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidData")+": only draft campaigns can be triggered")
+	}
+	if c.consts.CampaignApproval && cm.ApprovalStatus != models.CampaignApprovalApproved {
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("campaigns.approvalRequired"))
+	}
+
+	// Normalize and dedupe the e-mails.
+	var (
+		seen = make(map[string]struct{}, len(emails))
+		ems  = make([]string, 0, len(emails))
+	)
+	for _, e := range emails {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if _, ok := seen[e]; ok {
+			continue
+		}
+		seen[e] = struct{}{}
+		ems = append(ems, e)
+	}
+
+	query = sanitizeSQLExp(query)
+	if len(ems) == 0 && query == "" {
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidFields", "name", "emails / query"))
+	}
+	if len(ems) > max {
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidData")+fmt.Sprintf(": too many recipients (max %d)", max))
+	}
+	if query == "" {
+		query = "TRUE"
+	}
+
+	// Resolve the recipients. The query is arbitrary and runs in a readonly transaction.
+	tx, err := c.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		c.log.Error("error preparing subscriber query", "error", err)
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	var subIDs []int
+	stmt := strings.ReplaceAll(c.q.GetCampaignTriggerRecipients, "%query%", query)
+	if err := tx.Select(&subIDs, stmt, id, pq.Array(ems), max+1); err != nil {
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
+	}
+
+	if len(subIDs) == 0 {
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("campaigns.noSubsToTest"))
+	}
+	if len(subIDs) > max {
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidData")+fmt.Sprintf(": too many recipients (max %d)", max))
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		c.log.Error("error generating UUID", "error", err)
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
+	}
+
+	var runID int
+	if err := c.q.CloneTriggeredCampaign.Get(&runID, id, uu, pq.Array(subIDs)); err != nil {
+		// The campaign's status changed in the meantime.
+		if err == sql.ErrNoRows {
+			return 0, 0, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.invalidData")+": only draft campaigns can be triggered")
+		}
+
+		c.log.Error("error triggering campaign", "error", err)
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return runID, len(subIDs), nil
+}
+
+// nextRecurrence parses a cron expression (optionally prefixed with CRON_TZ=Zone/Name)
+// and returns the next trigger time after the given time.
+func (c *Core) nextRecurrence(cronExp string, from time.Time) (time.Time, error) {
+	sched, err := cron.ParseStandard(cronExp)
+	if err != nil {
+		return time.Time{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidData")+": recurrence: "+err.Error())
+	}
+
+	return sched.Next(from), nil
+}
+
+// GetCampaignSendWindow retrieves the send window of a campaign.
+func (c *Core) GetCampaignSendWindow(campID int) (models.CampaignSendWindow, error) {
+	var out models.CampaignSendWindow
+	if err := c.q.GetCampaignSendWindow.Get(&out, campID); err != nil {
+		if err == sql.ErrNoRows {
+			return out, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+		}
+
+		c.log.Error("error fetching campaign send window", "error", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// UpdateCampaignSendWindow sets or clears (null start and end) the send window of a campaign.
+func (c *Core) UpdateCampaignSendWindow(campID int, w models.CampaignSendWindow) (models.CampaignSendWindow, error) {
+	if _, err := c.q.UpdateCampaignSendWindow.Exec(campID, w.Start, w.End, c.consts.CampaignApproval); err != nil {
+		c.log.Error("error updating campaign send window", "error", err)
+		return models.CampaignSendWindow{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return c.GetCampaignSendWindow(campID)
+}
+
+// SetCampaignPriority sets the send priority (0 - models.MaxCampaignPriority) of a campaign.
+func (c *Core) SetCampaignPriority(campID, priority int) (models.Campaign, error) {
+	if priority < 0 || priority > models.MaxCampaignPriority {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidFields", "name", "priority"))
+	}
+
+	res, err := c.q.UpdateCampaignPriority.Exec(campID, priority, c.consts.CampaignApproval)
+	if err != nil {
+		c.log.Error("error updating campaign priority", "error", err)
+		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+	}
+
+	return c.GetCampaign(campID, "", "")
+}
+
+// UpdateCampaignUnsubHeader sets whether the List-Unsubscribe headers are added to a
+// campaign's messages. An invalid (null) value follows the global setting.
+func (c *Core) UpdateCampaignUnsubHeader(campID int, enabled null.Bool) (models.Campaign, error) {
+	res, err := c.q.UpdateCampaignUnsubHeader.Exec(campID, enabled, c.consts.CampaignApproval)
+	if err != nil {
+		c.log.Error("error updating campaign unsubscribe header", "error", err)
+		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+	}
+
+	return c.GetCampaign(campID, "", "")
+}
+
+// UpdateCampaignInlineCSS sets whether the CSS in a campaign's body is inlined
+// before sending. An invalid (null) value follows the global setting.
+func (c *Core) UpdateCampaignInlineCSS(campID int, enabled null.Bool) (models.Campaign, error) {
+	res, err := c.q.UpdateCampaignInlineCSS.Exec(campID, enabled, c.consts.CampaignApproval)
+	if err != nil {
+		c.log.Error("error updating campaign CSS inlining", "error", err)
+		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+	}
+
+	return c.GetCampaign(campID, "", "")
+}
+
+// UpdateCampaignTrackViews sets whether a campaign's views are tracked.
+func (c *Core) UpdateCampaignTrackViews(campID int, enabled bool) (models.Campaign, error) {
+	res, err := c.q.UpdateCampaignTrackViews.Exec(campID, enabled)
+	if err != nil {
+		c.log.Error("error updating campaign view tracking", "error", err)
+		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+	}
+
+	return c.GetCampaign(campID, "", "")
+}
+
+// UpdateCampaignNotify sets the e-mails and the webhook that are notified when a
+// campaign finishes or is cancelled. webhookID = 0 clears the webhook.
+func (c *Core) UpdateCampaignNotify(campID int, emails []string, webhookID int) (models.Campaign, error) {
+	if webhookID > 0 {
+		var hooks []models.Webhook
+		if err := c.q.GetWebhooks.Select(&hooks, webhookID); err != nil {
+			c.log.Error("error fetching webhook", "error", err)
+			return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorFetching", "name", "webhook", "error", pqErrMsg(err)))
+		}
+		if len(hooks) == 0 {
+			return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.notFound", "name", "webhook"))
+		}
+	}
+
+	res, err := c.q.UpdateCampaignNotify.Exec(campID, pq.StringArray(emails), webhookID)
+	if err != nil {
+		c.log.Error("error updating campaign notifications", "error", err)
+		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+	}
+
+	return c.GetCampaign(campID, "", "")
+}
+
+// UpdateCampaignListGroup sets the list group that a campaign targets in addition to its
+// lists. The group's lists are resolved at the time of sending. groupID = 0 clears it.
+func (c *Core) UpdateCampaignListGroup(campID, groupID int) (models.Campaign, error) {
+	if groupID > 0 {
+		l, err := c.GetList(groupID, "")
+		if err != nil {
+			return models.Campaign{}, err
+		}
+		if l.ParentID.Valid {
+			return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.invalidFields", "name", "list_group_id"))
+		}
+	}
+
+	res, err := c.q.UpdateCampaignListGroup.Exec(campID, groupID, c.consts.CampaignApproval)
+	if err != nil {
+		c.log.Error("error updating campaign list group", "error", err)
+		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+	}
+
+	return c.GetCampaign(campID, "", "")
+}
+
+// GetCampaignVariants retrieves the A/B subject variants of a campaign along with their stats.
+func (c *Core) GetCampaignVariants(campID int) ([]models.CampaignVariant, error) {
+	out := []models.CampaignVariant{}
+	if err := c.q.GetCampaignVariants.Select(&out, campID); err != nil {
+		c.log.Error("error fetching campaign variants", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// CreateCampaignVariants replaces the A/B subject variants of a campaign with the given
+// variants. An empty list of variants disables A/B testing on the campaign.
+func (c *Core) CreateCampaignVariants(campID int, variants []models.CampaignVariant) ([]models.CampaignVariant, error) {
+	for i := range variants {
+		if variants[i].Weight < 1 {
+			variants[i].Weight = 1
+		}
+	}
+
+	// Changed variants have to be approved again.
+	prev, err := c.GetCampaignVariants(campID)
+	if err != nil {
+		return nil, err
+	}
+	changed := len(prev) != len(variants)
+	for i := 0; !changed && i < len(prev); i++ {
+		changed = prev[i].Subject != variants[i].Subject || prev[i].Weight != variants[i].Weight
+	}
+
+	tx, err := c.db.Beginx()
+	if err != nil {
+		c.log.Error("error creating campaign variants", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmtx(c.q.DeleteCampaignVariants).Exec(campID); err != nil {
+		c.log.Error("error deleting campaign variants", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	for _, v := range variants {
+		var id int
+		if err := tx.Stmtx(c.q.InsertCampaignVariant).Get(&id, campID, v.Subject, v.Weight); err != nil {
+			c.log.Error("error creating campaign variant", "error", err)
+			return nil, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+		}
+	}
+
+	if changed {
+		if _, err := tx.Stmtx(c.q.ResetCampaignApproval).Exec(campID, c.consts.CampaignApproval); err != nil {
+			c.log.Error("error resetting campaign approval", "error", err)
+			return nil, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.log.Error("error creating campaign variants", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	return c.GetCampaignVariants(campID)
+}
+
 // DeleteCampaign deletes a campaign.
 func (c *Core) DeleteCampaign(id int) error {
 	res, err := c.q.DeleteCampaign.Exec(id)
 	if err != nil {
-		c.log.Printf("error deleting campaign: %v", err)
+		c.log.Error("error deleting campaign", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 
@@ -328,15 +1099,42 @@ func (c *Core) DeleteCampaign(id int) error {
 	return nil
 }
 
+// DeleteCampaignDeliveries deletes the delivery records of campaigns that ended before
+// the given date in batches, pausing for wait between them, and returns the number of
+// records deleted. The records of campaigns that are excluded by campaigns that are yet
+// to end are kept.
+func (c *Core) DeleteCampaignDeliveries(before time.Time, batchSize int, wait time.Duration) (int, error) {
+	total := 0
+	for {
+		var n int
+		if err := c.q.DeleteCampaignDeliveries.Get(&n, before, batchSize); err != nil {
+			c.log.Error("error purging campaign deliveries", "error", err)
+			return total, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorDeleting", "name", "campaign deliveries", "error", pqErrMsg(err)))
+		}
+
+		total += n
+		if n < batchSize {
+			break
+		}
+
+		time.Sleep(wait)
+	}
+
+	return total, nil
+}
+
 // GetRunningCampaignStats returns the progress stats of running campaigns.
 func (c *Core) GetRunningCampaignStats() ([]models.CampaignStats, error) {
 	out := []models.CampaignStats{}
-	if err := c.q.GetCampaignStatus.Select(&out, models.CampaignStatusRunning); err != nil {
+	// Paused campaigns are included as they're resumed from where they stopped.
+	statuses := pq.StringArray{models.CampaignStatusRunning, models.CampaignStatusPaused}
+	if err := c.q.GetCampaignStatus.Select(&out, statuses); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
 
-		c.log.Printf("error fetching campaign stats: %v", err)
+		c.log.Error("error fetching campaign stats", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	} else if len(out) == 0 {
@@ -366,7 +1164,38 @@ func (c *Core) GetCampaignAnalyticsCounts(campIDs []int, typ, fromDate, toDate s
 
 	out := []models.CampaignAnalyticsCount{}
 	if err := stmt.Select(&out, pq.Array(campIDs), fromDate, toDate); err != nil {
-		c.log.Printf("error fetching campaign %s: %v", typ, err)
+		c.log.Error("error fetching campaign "+typ, "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.analytics}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// GetCampaignAnalyticsSeries returns the view or click counts of a campaign bucketed
+// into hourly or daily intervals of the given time zone between from and to.
+func (c *Core) GetCampaignAnalyticsSeries(campID int, typ string, from, to time.Time, interval, tz string) ([]models.AnalyticsPoint, error) {
+	var stmt *sqlx.Stmt
+	switch typ {
+	case "views":
+		stmt = c.q.GetCampaignViewSeries
+	case "clicks":
+		stmt = c.q.GetCampaignClickSeries
+	default:
+		return nil, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("globals.messages.invalidData"))
+	}
+
+	if interval != "hour" && interval != "day" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("globals.messages.invalidData"))
+	}
+
+	if !to.After(from) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("analytics.invalidDates"))
+	}
+
+	out := []models.AnalyticsPoint{}
+	if err := stmt.Select(&out, campID, from, to, interval, tz); err != nil {
+		c.log.Error("error fetching campaign "+typ+" series", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.analytics}", "error", pqErrMsg(err)))
 	}
@@ -378,7 +1207,20 @@ func (c *Core) GetCampaignAnalyticsCounts(campIDs []int, typ, fromDate, toDate s
 func (c *Core) GetCampaignAnalyticsLinks(campIDs []int, typ, fromDate, toDate string) ([]models.CampaignAnalyticsLink, error) {
 	out := []models.CampaignAnalyticsLink{}
 	if err := c.q.GetCampaignLinkCounts.Select(&out, pq.Array(campIDs), fromDate, toDate); err != nil {
-		c.log.Printf("error fetching campaign %s: %v", typ, err)
+		c.log.Error("error fetching campaign "+typ, "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.analytics}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// GetCampaignLinkStats returns the tracked URLs of a campaign with their total
+// and unique click counts ordered by clicks.
+func (c *Core) GetCampaignLinkStats(campID int) ([]models.LinkStat, error) {
+	out := []models.LinkStat{}
+	if err := c.q.GetCampaignLinkStats.Select(&out, campID); err != nil {
+		c.log.Error("error fetching campaign link stats", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.analytics}", "error", pqErrMsg(err)))
 	}
@@ -387,13 +1229,14 @@ func (c *Core) GetCampaignAnalyticsLinks(campIDs []int, typ, fromDate, toDate st
 }
 
 // RegisterCampaignView registers a subscriber's view on a campaign.
-func (c *Core) RegisterCampaignView(campUUID, subUUID string) error {
-	if _, err := c.q.RegisterCampaignView.Exec(campUUID, subUUID); err != nil {
+// variantID is the optional ID of the A/B subject variant that the subscriber was sent.
+func (c *Core) RegisterCampaignView(campUUID, subUUID string, variantID int) error {
+	if _, err := c.q.RegisterCampaignView.Exec(campUUID, subUUID, variantID); err != nil {
 		if pqErr, ok := err.(*pq.Error); ok && pqErr.Column == "campaign_id" {
 			return nil
 		}
 
-		c.log.Printf("error registering campaign view: %s", err)
+		c.log.Error("error registering campaign view", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
@@ -401,14 +1244,15 @@ func (c *Core) RegisterCampaignView(campUUID, subUUID string) error {
 }
 
 // RegisterCampaignLinkClick registers a subscriber's link click on a campaign.
-func (c *Core) RegisterCampaignLinkClick(linkUUID, campUUID, subUUID string) (string, error) {
+// variantID is the optional ID of the A/B subject variant that the subscriber was sent.
+func (c *Core) RegisterCampaignLinkClick(linkUUID, campUUID, subUUID string, variantID int) (string, error) {
 	var url string
-	if err := c.q.RegisterLinkClick.Get(&url, linkUUID, campUUID, subUUID); err != nil {
+	if err := c.q.RegisterLinkClick.Get(&url, linkUUID, campUUID, subUUID, variantID); err != nil {
 		if pqErr, ok := err.(*pq.Error); ok && pqErr.Column == "link_id" {
 			return "", echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("public.invalidLink"))
 		}
 
-		c.log.Printf("error registering link click: %s", err)
+		c.log.Error("error registering link click", "error", err)
 		return "", echo.NewHTTPError(http.StatusInternalServerError, c.i18n.Ts("public.errorProcessingRequest"))
 	}
 
@@ -418,7 +1262,7 @@ func (c *Core) RegisterCampaignLinkClick(linkUUID, campUUID, subUUID string) (st
 // DeleteCampaignViews deletes campaign views older than a given date.
 func (c *Core) DeleteCampaignViews(before time.Time) error {
 	if _, err := c.q.DeleteCampaignViews.Exec(before); err != nil {
-		c.log.Printf("error deleting campaign views: %s", err)
+		c.log.Error("error deleting campaign views", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, c.i18n.Ts("public.errorProcessingRequest"))
 	}
 
@@ -428,7 +1272,7 @@ func (c *Core) DeleteCampaignViews(before time.Time) error {
 // DeleteCampaignLinkClicks deletes campaign views older than a given date.
 func (c *Core) DeleteCampaignLinkClicks(before time.Time) error {
 	if _, err := c.q.DeleteCampaignLinkClicks.Exec(before); err != nil {
-		c.log.Printf("error deleting campaign link clicks: %s", err)
+		c.log.Error("error deleting campaign link clicks", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError, c.i18n.Ts("public.errorProcessingRequest"))
 	}
 
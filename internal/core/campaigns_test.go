@@ -0,0 +1,35 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/knadh/listmonk/models"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+func TestCampaignTemplateID(t *testing.T) {
+	lists := []models.List{
+		{Base: models.Base{ID: 1}},
+		{Base: models.Base{ID: 2}, TemplateID: null.IntFrom(20)},
+		{Base: models.Base{ID: 3}, TemplateID: null.IntFrom(30)},
+	}
+
+	cases := []struct {
+		name    string
+		tplID   int
+		listIDs []int
+		exp     int
+	}{
+		{"campaign template over list defaults", 5, []int{2, 3}, 5},
+		{"first list with a default in the given order", 0, []int{3, 2}, 30},
+		{"lists without a default are skipped", 0, []int{1, 2}, 20},
+		{"global default without list defaults", 0, []int{1}, 0},
+		{"global default without lists", 0, nil, 0},
+	}
+
+	for _, c := range cases {
+		if got := campaignTemplateID(c.tplID, c.listIDs, lists); got != c.exp {
+			t.Errorf("%s: expected template %d, got %d", c.name, c.exp, got)
+		}
+	}
+}
@@ -7,23 +7,35 @@ package core
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/listmonk/internal/i18n"
+	"github.com/knadh/listmonk/internal/logger"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
 const (
 	SortAsc  = "asc"
 	SortDesc = "desc"
 
+	// Subscriber export formats. The full format includes every list subscription
+	// of the subscribers with their statuses.
+	ExportFormatLite = "lite"
+	ExportFormatFull = "full"
+
 	matDashboardCharts = "mat_dashboard_charts"
 	matDashboardCounts = "mat_dashboard_counts"
 	matListSubStats    = "mat_list_subscriber_stats"
+
+	// Max number of sample subscribers returned and the max query
+	// execution time for subscriber query previews.
+	subQueryPreviewSize    = 10
+	subQueryPreviewTimeout = time.Second * 10
 )
 
 // Core represents the listmonk core with all shared, global functions.
@@ -34,7 +46,10 @@ type Core struct {
 	i18n   *i18n.I18n
 	db     *sqlx.DB
 	q      *models.Queries
-	log    *log.Logger
+	log    *logger.Logger
+
+	// Cached DNS lookups of the campaign diagnostics.
+	dns *dnsCache
 }
 
 // Constants represents constant config.
@@ -45,11 +60,38 @@ type Constants struct {
 		Action string
 	}
 	CacheSlowQueries bool
+
+	// Optional compiled JSON schema that subscriber attributes are validated against.
+	AttribsSchema *jsonschema.Schema
+
+	// Max number of content versions retained per campaign. 0 disables versioning.
+	MaxCampaignVersions int
+
+	// Whether campaigns have to be approved before they're started or scheduled.
+	CampaignApproval bool
+
+	// In the sandbox mode, bounces are recorded but no actions (eg: blocklisting) are taken.
+	Sandbox bool
+
+	// Global view tracking (privacy.track_views).
+	TrackViews bool
+
+	// DKIM key selectors by signing domain, checked by the campaign diagnostics.
+	DKIMSelectors map[string]string
+
+	// Global From address of campaigns (app.from_email).
+	FromEmail string
 }
 
 // Hooks contains external function hooks that are required by the core package.
 type Hooks struct {
 	SendOptinConfirmation func(models.Subscriber, []int) (int, error)
+
+	// Optional. Emits lifecycle events (eg: subscriber.created) to outbound webhooks.
+	EmitEvent func(event string, data interface{})
+
+	// Optional. Drops the queued campaign messages of subscribers who have been blocklisted.
+	ExcludeSubscribers func(subIDs []int)
 }
 
 // Opt contains the controllers required to start the core.
@@ -58,7 +100,7 @@ type Opt struct {
 	I18n      *i18n.I18n
 	DB        *sqlx.DB
 	Queries   *models.Queries
-	Log       *log.Logger
+	Log       *logger.Logger
 }
 
 var (
@@ -78,6 +120,7 @@ func New(o *Opt, h *Hooks) *Core {
 		db:     o.DB,
 		q:      o.Queries,
 		log:    o.Log,
+		dns:    &dnsCache{recs: make(map[string]dnsRec)},
 	}
 }
 
@@ -99,7 +142,7 @@ func (c *Core) RefreshMatView(name string, concurrent bool) error {
 	}
 
 	if _, err := c.db.Exec(q); err != nil {
-		c.log.Printf("error refreshing materialized view: %s: %v", name, err)
+		c.log.Error("error refreshing materialized view: "+name, "error", err)
 		return err
 	}
 
@@ -0,0 +1,547 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/html"
+)
+
+const (
+	// Duration for which DNS lookups of the diagnostics are cached.
+	diagDNSCacheTTL = time.Minute * 5
+	diagDNSTimeout  = time.Second * 5
+
+	// Max number of unique links that are checked, the number that are checked
+	// concurrently, and the timeout for each.
+	diagMaxLinks        = 50
+	diagLinkConcurrency = 5
+	diagLinkTimeout     = time.Second * 10
+
+	// Spam words found beyond which the spam word check fails.
+	diagMaxSpamWords = 5
+
+	// Min visible text characters per image below which the image check warns.
+	diagMinTextPerImage = 200
+)
+
+var (
+	// Common spam filter trigger phrases that are matched against the subject and body.
+	diagSpamWords = []string{
+		"100% free", "100% satisfied", "act now", "amazing deal", "apply now", "best price",
+		"buy now", "cash bonus", "click here", "congratulations", "dear friend", "double your",
+		"earn money", "extra cash", "free gift", "free money", "guaranteed", "limited time",
+		"lowest price", "make money", "miracle", "no cost", "no obligation", "not spam",
+		"once in a lifetime", "order now", "risk-free", "risk free", "special promotion",
+		"this isn't spam", "urgent", "winner", "you have been selected", "$$$",
+	}
+
+	// {{ TrackLink "url" }} and url@TrackLink, which are replaced with their URLs.
+	regexpDiagTrackLink   = regexp.MustCompile(`{{\s*TrackLink\s+"([^"]+)"[^}]*}}`)
+	regexpDiagTrackLinkSh = regexp.MustCompile(`(https?://[^\s"'<>]+?)@TrackLink`)
+	regexpDiagTplTag      = regexp.MustCompile(`{{[^}]*}}`)
+	regexpDiagUnsub       = regexp.MustCompile(`{{[^}]*UnsubscribeURL[^}]*}}|@UnsubscribeURL`)
+	regexpDiagURL         = regexp.MustCompile(`https?://[^\s"'<>()\[\]]+`)
+)
+
+// dnsCache caches TXT lookups for the diagnostics for diagDNSCacheTTL.
+type dnsCache struct {
+	sync.Mutex
+	recs map[string]dnsRec
+}
+
+type dnsRec struct {
+	txt    []string
+	err    error
+	expiry time.Time
+}
+
+// DiagnoseCampaign runs pre-send deliverability checks on a campaign: SPF, DKIM, and
+// DMARC records of the From domain, a spam word scan of the subject and body, broken
+// links, the image to text ratio, and the presence of an unsubscribe link. Checks
+// named in skip (models.DiagChecks) are not run.
+func (c *Core) DiagnoseCampaign(id int, skip ...string) (models.DiagnosticReport, error) {
+	skipped := make(map[string]bool, len(skip))
+	for _, s := range skip {
+		if !isDiagCheck(s) {
+			return models.DiagnosticReport{}, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.invalidFields", "name", "skip"))
+		}
+		skipped[s] = true
+	}
+
+	camp, err := c.GetCampaign(id, "", "")
+	if err != nil {
+		return models.DiagnosticReport{}, err
+	}
+
+	// The campaign body and the template it's wrapped in, with the partials they include.
+	bodies := []string{camp.Body, camp.TemplateBody}
+	if p, err := models.PartialBodies(camp.TemplateBody, camp.Body); err == nil {
+		bodies = append(bodies, p...)
+	}
+	content, err := diagContent(camp, bodies)
+	if err != nil {
+		c.log.Error("error parsing campaign body for diagnostics", "error", err)
+		return models.DiagnosticReport{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidFields", "name", "body"))
+	}
+
+	domain := ""
+	if a, err := mail.ParseAddress(camp.From(c.consts.FromEmail)); err == nil {
+		if _, d, ok := strings.Cut(a.Address, "@"); ok {
+			domain = strings.ToLower(d)
+		}
+	}
+
+	out := models.DiagnosticReport{CampaignID: camp.ID, Status: models.DiagStatusPass}
+	for _, name := range models.DiagChecks {
+		if skipped[name] {
+			out.Checks = append(out.Checks, models.DiagnosticCheck{Name: name, Status: models.DiagStatusSkipped})
+			continue
+		}
+
+		var chk models.DiagnosticCheck
+		switch name {
+		case models.DiagCheckSPF:
+			chk = c.diagSPF(domain)
+		case models.DiagCheckDKIM:
+			chk = c.diagDKIM(domain)
+		case models.DiagCheckDMARC:
+			chk = c.diagDMARC(domain)
+		case models.DiagCheckSpamWords:
+			chk = diagSpamWordsCheck(camp.Subject, content.text)
+		case models.DiagCheckLinks:
+			chk = diagLinks(content.links)
+		case models.DiagCheckImages:
+			chk = diagImages(content.images, content.text)
+		case models.DiagCheckUnsubscribe:
+			chk = diagUnsubscribe(bodies)
+		}
+		chk.Name = name
+
+		if diagWorse(chk.Status, out.Status) {
+			out.Status = chk.Status
+		}
+		out.Checks = append(out.Checks, chk)
+	}
+
+	return out, nil
+}
+
+// diagBody is the visible text, images, and links extracted from a campaign.
+type diagBody struct {
+	text   string
+	images int
+	links  []string
+}
+
+// diagContent extracts the visible text, the number of images, and the http(s) links
+// from a campaign's body and template.
+func diagContent(camp models.Campaign, bodies []string) (diagBody, error) {
+	var out diagBody
+
+	// Replace TrackLink expressions with their URLs and drop all other template expressions.
+	clean := func(s string) string {
+		s = regexpDiagTrackLink.ReplaceAllString(s, "$1")
+		s = regexpDiagTrackLinkSh.ReplaceAllString(s, "$1")
+		return regexpDiagTplTag.ReplaceAllString(s, "")
+	}
+
+	if camp.ContentType == models.CampaignContentTypePlain {
+		out.text = clean(camp.Body)
+		out.links = regexpDiagURL.FindAllString(out.text, -1)
+		return out, nil
+	}
+
+	body := camp.Body
+	if camp.ContentType == models.CampaignContentTypeMarkdown {
+		b, err := models.MarkdownToHTML(body)
+		if err != nil {
+			return out, err
+		}
+		body = b
+	}
+
+	// The body and the remaining template bodies are all run through the tokenizer.
+	docs := append([]string{body}, bodies[1:]...)
+
+	var (
+		text strings.Builder
+		seen = map[string]bool{}
+	)
+	for _, d := range docs {
+		var (
+			z    = html.NewTokenizer(strings.NewReader(clean(d)))
+			skip int
+		)
+		for {
+			tt := z.Next()
+			if tt == html.ErrorToken {
+				break
+			}
+
+			t := z.Token()
+			switch tt {
+			case html.StartTagToken, html.SelfClosingTagToken:
+				switch t.Data {
+				case "style", "script", "head", "title":
+					if tt == html.StartTagToken {
+						skip++
+					}
+				case "img":
+					out.images++
+				}
+
+				for _, a := range t.Attr {
+					if (a.Key == "href" && (t.Data == "a" || t.Data == "area")) || (a.Key == "src" && t.Data == "img") {
+						u := strings.TrimSpace(a.Val)
+						if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+							if !seen[u] {
+								seen[u] = true
+								out.links = append(out.links, u)
+							}
+						}
+					}
+				}
+
+			case html.EndTagToken:
+				switch t.Data {
+				case "style", "script", "head", "title":
+					if skip > 0 {
+						skip--
+					}
+				}
+
+			case html.TextToken:
+				if skip == 0 {
+					text.WriteString(t.Data)
+					text.WriteString(" ")
+				}
+			}
+		}
+	}
+	out.text = strings.Join(strings.Fields(text.String()), " ")
+
+	return out, nil
+}
+
+// diagSPF checks that the domain has a single SPF record.
+func (c *Core) diagSPF(domain string) models.DiagnosticCheck {
+	if domain == "" {
+		return models.DiagnosticCheck{Status: models.DiagStatusFail, Message: "invalid from address"}
+	}
+
+	txt, err := c.lookupTXT(domain)
+	if err != nil {
+		return models.DiagnosticCheck{Status: models.DiagStatusWarn, Message: "error looking up SPF record: " + err.Error()}
+	}
+
+	var recs []string
+	for _, t := range txt {
+		if strings.HasPrefix(strings.ToLower(t), "v=spf1") {
+			recs = append(recs, t)
+		}
+	}
+
+	switch {
+	case len(recs) == 0:
+		return models.DiagnosticCheck{Status: models.DiagStatusFail, Message: "no SPF record found for " + domain}
+	case len(recs) > 1:
+		return models.DiagnosticCheck{Status: models.DiagStatusFail, Message: "multiple SPF records found for " + domain, Details: recs}
+	case strings.HasSuffix(strings.ToLower(recs[0]), "+all"):
+		return models.DiagnosticCheck{Status: models.DiagStatusWarn, Message: "SPF record allows any server to send (+all)", Details: recs}
+	}
+
+	return models.DiagnosticCheck{Status: models.DiagStatusPass, Message: "SPF record found", Details: recs}
+}
+
+// diagDKIM checks that a DKIM key is configured for the domain and that its
+// public key is published.
+func (c *Core) diagDKIM(domain string) models.DiagnosticCheck {
+	if domain == "" {
+		return models.DiagnosticCheck{Status: models.DiagStatusFail, Message: "invalid from address"}
+	}
+
+	sel, ok := c.consts.DKIMSelectors[domain]
+	if !ok {
+		return models.DiagnosticCheck{Status: models.DiagStatusWarn,
+			Message: "no DKIM key configured for " + domain + ". Messages are signed only if the mail server signs them."}
+	}
+
+	name := sel + "._domainkey." + domain
+	txt, err := c.lookupTXT(name)
+	if err != nil {
+		return models.DiagnosticCheck{Status: models.DiagStatusWarn, Message: "error looking up DKIM record: " + err.Error()}
+	}
+
+	for _, t := range txt {
+		tags := diagTags(t)
+		p, ok := tags["p"]
+		if !ok {
+			continue
+		}
+		if p == "" {
+			return models.DiagnosticCheck{Status: models.DiagStatusFail, Message: "DKIM key at " + name + " is revoked (empty p=)"}
+		}
+		return models.DiagnosticCheck{Status: models.DiagStatusPass, Message: "DKIM key published at " + name}
+	}
+
+	return models.DiagnosticCheck{Status: models.DiagStatusFail, Message: "no DKIM record found at " + name}
+}
+
+// diagDMARC checks the DMARC policy of the domain, falling back to the parent
+// (organizational) domain for subdomains.
+func (c *Core) diagDMARC(domain string) models.DiagnosticCheck {
+	if domain == "" {
+		return models.DiagnosticCheck{Status: models.DiagStatusFail, Message: "invalid from address"}
+	}
+
+	names := []string{domain}
+	if p := strings.Split(domain, "."); len(p) > 2 {
+		names = append(names, strings.Join(p[len(p)-2:], "."))
+	}
+
+	for _, d := range names {
+		txt, err := c.lookupTXT("_dmarc." + d)
+		if err != nil {
+			return models.DiagnosticCheck{Status: models.DiagStatusWarn, Message: "error looking up DMARC record: " + err.Error()}
+		}
+
+		for _, t := range txt {
+			if !strings.HasPrefix(strings.ToLower(t), "v=dmarc1") {
+				continue
+			}
+
+			if p := strings.ToLower(diagTags(t)["p"]); p == "none" || p == "" {
+				return models.DiagnosticCheck{Status: models.DiagStatusWarn,
+					Message: "DMARC policy for " + d + " is not enforced (p=none)", Details: []string{t}}
+			}
+			return models.DiagnosticCheck{Status: models.DiagStatusPass, Message: "DMARC policy found for " + d, Details: []string{t}}
+		}
+	}
+
+	return models.DiagnosticCheck{Status: models.DiagStatusFail, Message: "no DMARC record found for " + domain}
+}
+
+// diagSpamWordsCheck scans the subject and text for common spam trigger phrases,
+// an all caps subject, and excessive exclamation marks.
+func diagSpamWordsCheck(subject, text string) models.DiagnosticCheck {
+	var (
+		s     = strings.ToLower(strings.Join(strings.Fields(subject+" "+text), " "))
+		found []string
+	)
+	for _, w := range diagSpamWords {
+		if strings.Contains(s, w) {
+			found = append(found, w)
+		}
+	}
+
+	var notes []string
+	if utf8.RuneCountInString(subject) >= 5 && strings.ToUpper(subject) == subject && strings.IndexFunc(subject, unicode.IsLetter) >= 0 {
+		notes = append(notes, "subject is in all caps")
+	}
+	if strings.Count(subject, "!") > 1 {
+		notes = append(notes, "subject has multiple exclamation marks")
+	}
+
+	chk := models.DiagnosticCheck{Status: models.DiagStatusPass, Message: "no spam words found", Details: append(found, notes...)}
+	switch {
+	case len(found) >= diagMaxSpamWords:
+		chk.Status = models.DiagStatusFail
+		chk.Message = fmt.Sprintf("%d spam words found", len(found))
+	case len(found) > 0 || len(notes) > 0:
+		chk.Status = models.DiagStatusWarn
+		chk.Message = fmt.Sprintf("%d spam words found", len(found))
+	}
+
+	return chk
+}
+
+// diagLinks checks that the links respond without an error status.
+func diagLinks(links []string) models.DiagnosticCheck {
+	if len(links) == 0 {
+		return models.DiagnosticCheck{Status: models.DiagStatusPass, Message: "no links found"}
+	}
+
+	checked := links
+	if len(checked) > diagMaxLinks {
+		checked = checked[:diagMaxLinks]
+	}
+
+	var (
+		client = &http.Client{Timeout: diagLinkTimeout}
+		errs   = make([]string, len(checked))
+		sem    = make(chan struct{}, diagLinkConcurrency)
+		wg     sync.WaitGroup
+	)
+	for i, u := range checked {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, u string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := checkLink(client, u); err != nil {
+				errs[i] = u + ": " + err.Error()
+			}
+		}(i, u)
+	}
+	wg.Wait()
+
+	var broken []string
+	for _, e := range errs {
+		if e != "" {
+			broken = append(broken, e)
+		}
+	}
+
+	if len(broken) > 0 {
+		return models.DiagnosticCheck{Status: models.DiagStatusFail,
+			Message: fmt.Sprintf("%d of %d links are broken", len(broken), len(checked)), Details: broken}
+	}
+
+	chk := models.DiagnosticCheck{Status: models.DiagStatusPass, Message: fmt.Sprintf("%d links checked", len(checked))}
+	if len(links) > len(checked) {
+		chk.Status = models.DiagStatusWarn
+		chk.Message = fmt.Sprintf("only the first %d of %d links were checked", len(checked), len(links))
+	}
+
+	return chk
+}
+
+// checkLink requests a URL with HEAD, falling back to GET for servers that
+// don't support HEAD, and returns an error if the response is an error.
+func checkLink(client *http.Client, u string) error {
+	resp, err := client.Head(u)
+	if err == nil {
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusMethodNotAllowed, http.StatusForbidden, http.StatusNotImplemented:
+		default:
+			if resp.StatusCode >= 400 {
+				return errors.New(resp.Status)
+			}
+			return nil
+		}
+	}
+
+	resp, err = client.Get(u)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return errors.New(resp.Status)
+	}
+
+	return nil
+}
+
+// diagImages checks the ratio of visible text to images.
+func diagImages(images int, text string) models.DiagnosticCheck {
+	n := utf8.RuneCountInString(text)
+	switch {
+	case images == 0:
+		return models.DiagnosticCheck{Status: models.DiagStatusPass, Message: "no images found"}
+	case n == 0:
+		return models.DiagnosticCheck{Status: models.DiagStatusFail, Message: fmt.Sprintf("%d images and no text", images)}
+	case n/images < diagMinTextPerImage:
+		return models.DiagnosticCheck{Status: models.DiagStatusWarn,
+			Message: fmt.Sprintf("%d images with only %d characters of text", images, n)}
+	}
+
+	return models.DiagnosticCheck{Status: models.DiagStatusPass, Message: fmt.Sprintf("%d images with %d characters of text", images, n)}
+}
+
+// diagUnsubscribe checks that the body, template, or partials have an unsubscribe link.
+func diagUnsubscribe(bodies []string) models.DiagnosticCheck {
+	for _, b := range bodies {
+		if regexpDiagUnsub.MatchString(b) {
+			return models.DiagnosticCheck{Status: models.DiagStatusPass, Message: "unsubscribe link found"}
+		}
+	}
+
+	return models.DiagnosticCheck{Status: models.DiagStatusFail,
+		Message: "no {{ UnsubscribeURL }} link found in the campaign body or template"}
+}
+
+// lookupTXT returns the TXT records of a name, caching them for diagDNSCacheTTL.
+// Non-existent names return no records and no error.
+func (c *Core) lookupTXT(name string) ([]string, error) {
+	name = strings.ToLower(name)
+
+	c.dns.Lock()
+	if r, ok := c.dns.recs[name]; ok && time.Now().Before(r.expiry) {
+		c.dns.Unlock()
+		return r.txt, r.err
+	}
+	c.dns.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), diagDNSTimeout)
+	defer cancel()
+
+	txt, err := net.DefaultResolver.LookupTXT(ctx, name)
+	if err != nil {
+		var dErr *net.DNSError
+		if errors.As(err, &dErr) && dErr.IsNotFound {
+			txt, err = nil, nil
+		}
+	}
+
+	c.dns.Lock()
+	now := time.Now()
+	for k, r := range c.dns.recs {
+		if now.After(r.expiry) {
+			delete(c.dns.recs, k)
+		}
+	}
+	c.dns.recs[name] = dnsRec{txt: txt, err: err, expiry: now.Add(diagDNSCacheTTL)}
+	c.dns.Unlock()
+
+	return txt, err
+}
+
+// diagTags parses a DKIM/DMARC style tag=value; record.
+func diagTags(s string) map[string]string {
+	out := map[string]string{}
+	for _, t := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(t, "=")
+		if !ok {
+			continue
+		}
+		out[strings.ToLower(strings.TrimSpace(k))] = strings.Join(strings.Fields(v), "")
+	}
+	return out
+}
+
+// diagWorse returns true if the status a is worse than b.
+func diagWorse(a, b string) bool {
+	rank := map[string]int{models.DiagStatusPass: 0, models.DiagStatusWarn: 1, models.DiagStatusFail: 2}
+	return rank[a] > rank[b]
+}
+
+func isDiagCheck(s string) bool {
+	for _, c := range models.DiagChecks {
+		if c == s {
+			return true
+		}
+	}
+	return false
+}
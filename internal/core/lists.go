@@ -9,12 +9,13 @@ import (
 	"github.com/lib/pq"
 )
 
-// GetLists gets all lists optionally filtered by type.
-func (c *Core) GetLists(typ string) ([]models.List, error) {
+// GetLists gets all lists optionally filtered by type. Archived lists are
+// only included if includeArchived is true.
+func (c *Core) GetLists(typ string, includeArchived bool) ([]models.List, error) {
 	out := []models.List{}
 
-	if err := c.q.GetLists.Select(&out, typ, "id"); err != nil {
-		c.log.Printf("error fetching lists: %v", err)
+	if err := c.q.GetLists.Select(&out, typ, "id", includeArchived); err != nil {
+		c.log.Error("error fetching lists", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.lists}", "error", pqErrMsg(err)))
 	}
@@ -35,10 +36,9 @@ func (c *Core) GetLists(typ string) ([]models.List, error) {
 }
 
 // QueryLists gets multiple lists based on multiple query params. Along with the  paginated and sliced
-// results, the total number of lists in the DB is returned.
-func (c *Core) QueryLists(searchStr, typ, optin string, tags []string, orderBy, order string, offset, limit int) ([]models.List, int, error) {
-	_ = c.refreshCache(matListSubStats, false)
-
+// results, the total number of lists in the DB is returned. Archived lists are only included
+// if includeArchived is true.
+func (c *Core) QueryLists(searchStr, typ, optin string, tags []string, includeArchived bool, orderBy, order string, offset, limit int) ([]models.List, int, error) {
 	if tags == nil {
 		tags = []string{}
 	}
@@ -47,8 +47,8 @@ func (c *Core) QueryLists(searchStr, typ, optin string, tags []string, orderBy,
 		out            = []models.List{}
 		queryStr, stmt = makeSearchQuery(searchStr, orderBy, order, c.q.QueryLists, listQuerySortFields)
 	)
-	if err := c.db.Select(&out, stmt, 0, "", queryStr, typ, optin, pq.StringArray(tags), offset, limit); err != nil {
-		c.log.Printf("error fetching lists: %v", err)
+	if err := c.db.Select(&out, stmt, 0, "", queryStr, typ, optin, pq.StringArray(tags), offset, limit, includeArchived); err != nil {
+		c.log.Error("error fetching lists", "error", err)
 		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.lists}", "error", pqErrMsg(err)))
 	}
@@ -82,8 +82,8 @@ func (c *Core) GetList(id int, uuid string) (models.List, error) {
 
 	var res []models.List
 	queryStr, stmt := makeSearchQuery("", "", "", c.q.QueryLists, nil)
-	if err := c.db.Select(&res, stmt, id, uu, queryStr, "", "", pq.StringArray{}, 0, 1); err != nil {
-		c.log.Printf("error fetching lists: %v", err)
+	if err := c.db.Select(&res, stmt, id, uu, queryStr, "", "", pq.StringArray{}, 0, 1, true); err != nil {
+		c.log.Error("error fetching lists", "error", err)
 		return models.List{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.lists}", "error", pqErrMsg(err)))
 	}
@@ -105,11 +105,37 @@ func (c *Core) GetList(id int, uuid string) (models.List, error) {
 	return out, nil
 }
 
+// RefreshListCounts recomputes the cached subscriber counts of the lists whose
+// subscriptions have changed since they were last computed, or of all lists if all
+// is true.
+func (c *Core) RefreshListCounts(all bool) error {
+	// The queued lists are dequeued before the counts are computed in a separate
+	// statement so that the counts include the changes that queued them.
+	var ids []int
+	if err := c.q.GetQueuedListCounts.Select(&ids); err != nil {
+		c.log.Error("error fetching queued list counts", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.lists}", "error", pqErrMsg(err)))
+	}
+
+	if !all && len(ids) == 0 {
+		return nil
+	}
+
+	if _, err := c.q.RefreshListSubscriberCounts.Exec(all, pq.Array(ids)); err != nil {
+		c.log.Error("error refreshing list subscriber counts", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.lists}", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
 // GetListsByOptin returns lists by optin type.
 func (c *Core) GetListsByOptin(ids []int, optinType string) ([]models.List, error) {
 	out := []models.List{}
 	if err := c.q.GetListsByOptin.Select(&out, optinType, pq.Array(ids), nil); err != nil {
-		c.log.Printf("error fetching lists for opt-in: %s", pqErrMsg(err))
+		c.log.Error("error fetching lists for opt-in", "error", pqErrMsg(err))
 		return nil, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
 	}
@@ -121,7 +147,7 @@ func (c *Core) GetListsByOptin(ids []int, optinType string) ([]models.List, erro
 func (c *Core) CreateList(l models.List) (models.List, error) {
 	uu, err := uuid.NewV4()
 	if err != nil {
-		c.log.Printf("error generating UUID: %v", err)
+		c.log.Error("error generating UUID", "error", err)
 		return models.List{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
 	}
@@ -133,11 +159,20 @@ func (c *Core) CreateList(l models.List) (models.List, error) {
 		l.Optin = models.ListOptinSingle
 	}
 
-	// Insert and read ID.
+	if l.ParentID.Int > 0 {
+		if err := c.validateListParent(0, int(l.ParentID.Int)); err != nil {
+			return models.List{}, err
+		}
+	}
+
+	// Insert and read ID. Lists migrated from another instance retain their UUIDs
+	// so that the list UUIDs in existing subscription forms continue to work.
 	var newID int
-	l.UUID = uu.String()
-	if err := c.q.CreateList.Get(&newID, l.UUID, l.Name, l.Type, l.Optin, pq.StringArray(normalizeTags(l.Tags)), l.Description); err != nil {
-		c.log.Printf("error creating list: %v", err)
+	if l.UUID == "" {
+		l.UUID = uu.String()
+	}
+	if err := c.q.CreateList.Get(&newID, l.UUID, l.Name, l.Type, l.Optin, pq.StringArray(normalizeTags(l.Tags)), l.Description, l.MaxSubscriberMessages, l.ParentID.Int, l.FromEmail, l.FromName, l.Language); err != nil {
+		c.log.Error("error creating list", "error", err)
 		return models.List{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
 	}
@@ -147,9 +182,181 @@ func (c *Core) CreateList(l models.List) (models.List, error) {
 
 // UpdateList updates a given list.
 func (c *Core) UpdateList(id int, l models.List) (models.List, error) {
-	res, err := c.q.UpdateList.Exec(id, l.Name, l.Type, l.Optin, pq.StringArray(normalizeTags(l.Tags)), l.Description)
+	res, err := c.q.UpdateList.Exec(id, l.Name, l.Type, l.Optin, pq.StringArray(normalizeTags(l.Tags)), l.Description, l.MaxSubscriberMessages, l.FromEmail, l.FromName, l.Language)
+	if err != nil {
+		c.log.Error("error updating list", "error", err)
+		return models.List{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.List{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.list}"))
+	}
+
+	return c.GetList(id, "")
+}
+
+// SetListTrackViews sets whether views of campaigns sent to a list are tracked.
+func (c *Core) SetListTrackViews(listID int, enabled bool) (models.List, error) {
+	res, err := c.q.UpdateListTrackViews.Exec(listID, enabled)
+	if err != nil {
+		c.log.Error("error updating list view tracking", "error", err)
+		return models.List{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.List{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.list}"))
+	}
+
+	return c.GetList(listID, "")
+}
+
+// SetListTemplate sets the default campaign template of a list that's used by
+// campaigns on the list that don't specify a template. 0 clears the template.
+func (c *Core) SetListTemplate(listID, templateID int) (models.List, error) {
+	if templateID > 0 {
+		tpl, err := c.GetTemplate(templateID, true)
+		if err != nil {
+			return models.List{}, err
+		}
+
+		if tpl.Type != models.TemplateTypeCampaign {
+			return models.List{}, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
+		}
+	}
+
+	res, err := c.q.UpdateListTemplate.Exec(listID, templateID)
+	if err != nil {
+		c.log.Error("error updating list template", "error", err)
+		return models.List{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.List{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.list}"))
+	}
+
+	return c.GetList(listID, "")
+}
+
+// SetListParent adds a list to the group of the given parent list. 0 removes it from its group.
+func (c *Core) SetListParent(id, parentID int) (models.List, error) {
+	if parentID > 0 {
+		if err := c.validateListParent(id, parentID); err != nil {
+			return models.List{}, err
+		}
+	}
+
+	res, err := c.q.UpdateListParent.Exec(id, parentID)
+	if err != nil {
+		c.log.Error("error updating list parent", "error", err)
+		return models.List{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.List{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.list}"))
+	}
+
+	return c.GetList(id, "")
+}
+
+// GetListGroups returns the (non-archived) lists that have child lists along with their children.
+func (c *Core) GetListGroups() ([]models.ListGroup, error) {
+	lists, err := c.GetLists("", false)
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[int][]models.List{}
+	for _, l := range lists {
+		if l.ParentID.Valid {
+			p := int(l.ParentID.Int)
+			children[p] = append(children[p], l)
+		}
+	}
+
+	out := []models.ListGroup{}
+	for _, l := range lists {
+		if ch, ok := children[l.ID]; ok && !l.ParentID.Valid {
+			out = append(out, models.ListGroup{List: l, Lists: ch})
+		}
+	}
+
+	return out, nil
+}
+
+// GetListGroupIDs returns the IDs of the lists in a list group, that is, the list
+// itself and its child lists.
+func (c *Core) GetListGroupIDs(id int) ([]int, error) {
+	var out []int
+	if err := c.q.GetListGroupIDs.Select(&out, id); err != nil {
+		c.log.Error("error fetching list group", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.lists}", "error", pqErrMsg(err)))
+	}
+
+	if len(out) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.list}"))
+	}
+
+	return out, nil
+}
+
+// validateListParent checks that the list (id, 0 for a new list) can be added to the
+// group of the parent list. Groups are one level deep, so the parent can't
+// itself be in a group and the list can't have children of its own.
+func (c *Core) validateListParent(id, parentID int) error {
+	if id == parentID {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidFields", "name", "parent_id"))
+	}
+
+	parent, err := c.GetList(parentID, "")
+	if err != nil {
+		return err
+	}
+	if parent.ParentID.Valid {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidData")+": list groups can't be nested")
+	}
+
+	if id > 0 {
+		ids, err := c.GetListGroupIDs(id)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 1 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.invalidData")+": list groups can't be nested")
+		}
+	}
+
+	return nil
+}
+
+// ArchiveList archives a list, hiding it from list pickers and public subscription
+// forms. Its subscriptions and campaign history are retained.
+func (c *Core) ArchiveList(id int) (models.List, error) {
+	return c.setListArchived(id, true)
+}
+
+// UnarchiveList restores an archived list.
+func (c *Core) UnarchiveList(id int) (models.List, error) {
+	return c.setListArchived(id, false)
+}
+
+func (c *Core) setListArchived(id int, archived bool) (models.List, error) {
+	res, err := c.q.UpdateListArchived.Exec(id, archived)
 	if err != nil {
-		c.log.Printf("error updating list: %v", err)
+		c.log.Error("error updating list archive status", "error", err)
 		return models.List{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
 	}
@@ -170,7 +377,7 @@ func (c *Core) DeleteList(id int) error {
 // DeleteLists deletes multiple lists.
 func (c *Core) DeleteLists(ids []int) error {
 	if _, err := c.q.DeleteLists.Exec(pq.Array(ids)); err != nil {
-		c.log.Printf("error deleting lists: %v", err)
+		c.log.Error("error deleting lists", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.list}", "error", pqErrMsg(err)))
 	}
@@ -9,18 +9,21 @@ import (
 	"github.com/knadh/listmonk/internal/media"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
 	"gopkg.in/volatiletech/null.v6"
 )
 
-// QueryMedia returns media entries optionally filtered by a query string.
-func (c *Core) QueryMedia(provider string, s media.Store, query string, offset, limit int) ([]media.Media, int, error) {
+// QueryMedia returns media entries optionally filtered by a query string and a folder.
+// If folderID is not valid, media from all folders are returned, and if it's 0,
+// media that aren't in any folder are returned.
+func (c *Core) QueryMedia(provider string, s media.Store, query string, folderID null.Int, offset, limit int) ([]media.Media, int, error) {
 	out := []media.Media{}
 
 	if query != "" {
 		query = strings.ToLower(query)
 	}
 
-	if err := c.q.QueryMedia.Select(&out, fmt.Sprintf("%%%s%%", query), provider, offset, limit); err != nil {
+	if err := c.q.QueryMedia.Select(&out, fmt.Sprintf("%%%s%%", query), provider, offset, limit, folderID); err != nil {
 		return out, 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching",
 				"name", "{globals.terms.media}", "error", pqErrMsg(err)))
@@ -31,11 +34,7 @@ func (c *Core) QueryMedia(provider string, s media.Store, query string, offset,
 		total = out[0].Total
 
 		for i := 0; i < len(out); i++ {
-			out[i].URL = s.GetURL(out[i].Filename)
-
-			if out[i].Thumb != "" {
-				out[i].ThumbURL = null.String{Valid: true, String: s.GetURL(out[i].Thumb)}
-			}
+			out[i].SetURLs(s)
 		}
 	}
 
@@ -55,27 +54,25 @@ func (c *Core) GetMedia(id int, uuid string, s media.Store) (media.Media, error)
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.media}", "error", pqErrMsg(err)))
 	}
 
-	out.URL = s.GetURL(out.Filename)
-	if out.Thumb != "" {
-		out.ThumbURL = null.String{Valid: true, String: s.GetURL(out.Thumb)}
-	}
+	out.SetURLs(s)
 
 	return out, nil
 }
 
-// InsertMedia inserts a new media file into the DB.
-func (c *Core) InsertMedia(fileName, thumbName, contentType string, meta models.JSON, provider string, s media.Store) (media.Media, error) {
+// InsertMedia inserts a new media file into the DB, optionally into a folder (folderID > 0).
+// variants are the optional resized variants of an image that have already been stored.
+func (c *Core) InsertMedia(fileName, thumbName, contentType string, meta models.JSON, folderID int, size int64, variants media.Variants, provider string, s media.Store) (media.Media, error) {
 	uu, err := uuid.NewV4()
 	if err != nil {
-		c.log.Printf("error generating UUID: %v", err)
+		c.log.Error("error generating UUID", "error", err)
 		return media.Media{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
 	}
 
 	// Write to the DB.
 	var newID int
-	if err := c.q.InsertMedia.Get(&newID, uu, fileName, thumbName, contentType, provider, meta); err != nil {
-		c.log.Printf("error inserting uploaded file to db: %v", err)
+	if err := c.q.InsertMedia.Get(&newID, uu, fileName, thumbName, contentType, provider, meta, folderID, size, variants); err != nil {
+		c.log.Error("error inserting uploaded file to db", "error", err)
 		return media.Media{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.media}", "error", pqErrMsg(err)))
 	}
@@ -83,14 +80,80 @@ func (c *Core) InsertMedia(fileName, thumbName, contentType string, meta models.
 	return c.GetMedia(newID, "", s)
 }
 
-// DeleteMedia deletes a given media item and returns the filename of the deleted item.
-func (c *Core) DeleteMedia(id int) (string, error) {
-	var fname string
-	if err := c.q.DeleteMedia.Get(&fname, id); err != nil {
-		c.log.Printf("error inserting uploaded file to db: %v", err)
-		return "", echo.NewHTTPError(http.StatusInternalServerError,
+// DeleteMedia deletes a given media item and returns the deleted item so that
+// its stored files (original, thumbnail, and variants) can be removed.
+func (c *Core) DeleteMedia(id int) (media.Media, error) {
+	var out media.Media
+	if err := c.q.DeleteMedia.Get(&out, id); err != nil {
+		c.log.Error("error inserting uploaded file to db", "error", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.media}", "error", pqErrMsg(err)))
 	}
 
-	return fname, nil
+	return out, nil
+}
+
+// MoveMedia moves the given media items into a folder (0 removes them from their folders).
+// Only the DB records are changed and the stored files are not touched.
+func (c *Core) MoveMedia(ids []int, folderID int) error {
+	if _, err := c.q.MoveMedia.Exec(pq.Array(ids), folderID); err != nil {
+		c.log.Error("error moving media", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.media}", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// GetMediaFolders returns all media folders with the number and total size of the media in them.
+func (c *Core) GetMediaFolders(provider string) ([]media.Folder, error) {
+	out := []media.Folder{}
+	if err := c.q.GetMediaFolders.Select(&out, provider, 0); err != nil {
+		c.log.Error("error fetching media folders", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.media}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// CreateMediaFolder creates a new media folder.
+func (c *Core) CreateMediaFolder(name, provider string) (media.Folder, error) {
+	var newID int
+	if err := c.q.CreateMediaFolder.Get(&newID, name); err != nil {
+		c.log.Error("error creating media folder", "error", err)
+		return media.Folder{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.media}", "error", pqErrMsg(err)))
+	}
+
+	var out []media.Folder
+	if err := c.q.GetMediaFolders.Select(&out, provider, newID); err != nil {
+		c.log.Error("error fetching media folder", "error", err)
+		return media.Folder{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.media}", "error", pqErrMsg(err)))
+	}
+
+	if len(out) == 0 {
+		return media.Folder{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.media}"))
+	}
+
+	return out[0], nil
+}
+
+// DeleteMediaFolder deletes a media folder. Media in the folder are moved out of it.
+func (c *Core) DeleteMediaFolder(id int) error {
+	res, err := c.q.DeleteMediaFolder.Exec(id)
+	if err != nil {
+		c.log.Error("error deleting media folder", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.media}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.media}"))
+	}
+
+	return nil
 }
@@ -0,0 +1,424 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// Max duration from the start of a campaign that's charted in its report,
+	// and the duration below which the chart is bucketed hourly instead of daily.
+	reportMaxRange    = time.Hour * 24 * 30
+	reportHourlyRange = time.Hour * 24 * 3
+
+	// Number of most clicked links listed in the report.
+	reportTopLinks = 10
+
+	// Dimensions (px) of the report's charts.
+	reportChartWidth  = 640
+	reportChartHeight = 220
+	reportChartPadX   = 40
+	reportChartPadY   = 20
+	reportBarWidth    = 200
+)
+
+// campaignReport is the data the campaign report template is rendered with.
+type campaignReport struct {
+	Camp        models.Campaign
+	GeneratedAt time.Time
+	From        time.Time
+	To          time.Time
+	Interval    string
+
+	OpenRate   string
+	ClickRate  string
+	BounceRate string
+
+	Chart   reportChart
+	Links   []reportBar
+	Bounces []reportBar
+}
+
+// reportChart is an SVG line chart of the views and clicks of a campaign.
+type reportChart struct {
+	Width   int
+	Height  int
+	Left    int
+	Right   int
+	Bottom  int
+	Views   string
+	Clicks  string
+	XLabels []reportLabel
+	YLabels []reportLabel
+}
+
+type reportLabel struct {
+	X    float64
+	Y    float64
+	Text string
+}
+
+// reportBar is a row of a bar table in the report.
+type reportBar struct {
+	Label string
+	URL   string
+	Count int
+	Width float64
+}
+
+var reportTpl = template.Must(template.New("report").Funcs(template.FuncMap{
+	"num": formatReportNum,
+	"date": func(t time.Time) string {
+		return t.UTC().Format("02 Jan 2006 15:04 MST")
+	},
+}).Parse(campaignReportTpl))
+
+// GenerateCampaignReport generates a shareable summary of a campaign with its send
+// totals, views and clicks over time, top links, and bounces by type. The only
+// supported format is html, which is a standalone document with inline styles and
+// SVG charts that can be e-mailed as is.
+func (c *Core) GenerateCampaignReport(id int, format string) ([]byte, error) {
+	if format != "html" {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidFields", "name", "format"))
+	}
+
+	camp, err := c.GetCampaign(id, "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Chart the campaign from its start for up to reportMaxRange.
+	now := time.Now()
+	from := camp.CreatedAt.Time
+	if camp.StartedAt.Valid {
+		from = camp.StartedAt.Time
+	}
+	to := now
+	if to.Sub(from) > reportMaxRange {
+		to = from.Add(reportMaxRange)
+	}
+
+	interval, step := "day", time.Hour*24
+	if to.Sub(from) <= reportHourlyRange {
+		interval, step = "hour", time.Hour
+	}
+	from = from.UTC().Truncate(step)
+	to = to.UTC().Truncate(step).Add(step)
+
+	views, err := c.GetCampaignAnalyticsSeries(id, "views", from, to, interval, "UTC")
+	if err != nil {
+		return nil, err
+	}
+	clicks, err := c.GetCampaignAnalyticsSeries(id, "clicks", from, to, interval, "UTC")
+	if err != nil {
+		return nil, err
+	}
+
+	links, err := c.GetCampaignLinkStats(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(links) > reportTopLinks {
+		links = links[:reportTopLinks]
+	}
+
+	bounces := []models.BounceTypeCount{}
+	if err := c.q.GetCampaignBounceTypes.Select(&bounces, id); err != nil {
+		c.log.Error("error fetching campaign bounces", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.bounces}", "error", pqErrMsg(err)))
+	}
+
+	out := campaignReport{
+		Camp:        camp,
+		GeneratedAt: now,
+		From:        from,
+		To:          to,
+		Interval:    interval,
+		OpenRate:    formatReportRate(camp.Views, camp.Sent),
+		ClickRate:   formatReportRate(camp.Clicks, camp.Sent),
+		BounceRate:  formatReportRate(camp.Bounces, camp.Sent),
+		Chart:       makeReportChart(fillReportSeries(views, from, to, step), fillReportSeries(clicks, from, to, step), from, step),
+	}
+
+	var (
+		linkCounts   = make([]int, len(links))
+		bounceCounts = make([]int, len(bounces))
+	)
+	for i, l := range links {
+		linkCounts[i] = l.Clicks
+	}
+	for i, b := range bounces {
+		bounceCounts[i] = b.Count
+	}
+	for i, w := range reportBarWidths(linkCounts) {
+		out.Links = append(out.Links, reportBar{Label: links[i].URL, URL: links[i].URL, Count: links[i].Clicks, Width: w})
+	}
+	for i, w := range reportBarWidths(bounceCounts) {
+		out.Bounces = append(out.Bounces, reportBar{Label: bounces[i].Type, Count: bounces[i].Count, Width: w})
+	}
+
+	var b bytes.Buffer
+	if err := reportTpl.Execute(&b, out); err != nil {
+		c.log.Error("error rendering campaign report", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, c.i18n.T("globals.messages.internalError"))
+	}
+
+	return b.Bytes(), nil
+}
+
+// fillReportSeries spreads the sparse points of an analytics series over the
+// intervals between from and to, with zeroes for the intervals without any.
+func fillReportSeries(pts []models.AnalyticsPoint, from, to time.Time, step time.Duration) []int {
+	out := make([]int, int(to.Sub(from)/step))
+	for _, p := range pts {
+		if i := int(p.Timestamp.Sub(from) / step); i >= 0 && i < len(out) {
+			out[i] += p.Count
+		}
+	}
+
+	return out
+}
+
+// makeReportChart plots the views and clicks series as SVG polylines that share
+// the x (time) and y (count) axes.
+func makeReportChart(views, clicks []int, from time.Time, step time.Duration) reportChart {
+	ch := reportChart{
+		Width:  reportChartWidth,
+		Height: reportChartHeight,
+		Left:   reportChartPadX,
+		Right:  reportChartWidth - reportChartPadX/2,
+		Bottom: reportChartHeight - reportChartPadY,
+	}
+
+	max := 1
+	for _, s := range [][]int{views, clicks} {
+		for _, v := range s {
+			if v > max {
+				max = v
+			}
+		}
+	}
+
+	var (
+		plotW = float64(ch.Right - ch.Left)
+		plotH = float64(ch.Bottom - reportChartPadY)
+		n     = len(views)
+	)
+	x := func(i int) float64 {
+		if n < 2 {
+			return float64(ch.Left) + plotW/2
+		}
+		return float64(ch.Left) + plotW*float64(i)/float64(n-1)
+	}
+	y := func(v int) float64 {
+		return float64(ch.Bottom) - plotH*float64(v)/float64(max)
+	}
+
+	points := func(s []int) string {
+		p := make([]string, len(s))
+		for i, v := range s {
+			p[i] = fmt.Sprintf("%.1f,%.1f", x(i), y(v))
+		}
+		return strings.Join(p, " ")
+	}
+	ch.Views = points(views)
+	ch.Clicks = points(clicks)
+
+	layout := "02 Jan"
+	if step < time.Hour*24 {
+		layout = "02 Jan 15:04"
+	}
+	for _, i := range []int{0, n / 2, n - 1} {
+		// Skip duplicate labels of short series.
+		if len(ch.XLabels) > 0 && ch.XLabels[len(ch.XLabels)-1].X == x(i) {
+			continue
+		}
+		ch.XLabels = append(ch.XLabels, reportLabel{
+			X:    x(i),
+			Y:    float64(ch.Height - 4),
+			Text: from.Add(step * time.Duration(i)).Format(layout),
+		})
+	}
+	for _, v := range []int{0, max / 2, max} {
+		if v == 0 && len(ch.YLabels) > 0 {
+			continue
+		}
+		ch.YLabels = append(ch.YLabels, reportLabel{X: float64(ch.Left - 6), Y: y(v) + 4, Text: formatReportNum(v)})
+	}
+
+	return ch
+}
+
+// reportBarWidths returns the widths of the bars of the given counts relative
+// to the largest one.
+func reportBarWidths(counts []int) []float64 {
+	max := 0
+	for _, n := range counts {
+		if n > max {
+			max = n
+		}
+	}
+
+	out := make([]float64, len(counts))
+	for i, n := range counts {
+		if max > 0 {
+			out[i] = float64(reportBarWidth) * float64(n) / float64(max)
+		}
+	}
+
+	return out
+}
+
+// formatReportRate returns n as a percentage of total.
+func formatReportRate(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return strconv.FormatFloat(float64(n)*100/float64(total), 'f', 1, 64) + "%"
+}
+
+// formatReportNum formats n with thousands separators, eg: 12,345.
+func formatReportNum(n int) string {
+	if n < 0 {
+		return "-" + formatReportNum(-n)
+	}
+	s := strconv.Itoa(n)
+
+	var b strings.Builder
+	for i, r := range s {
+		if i > 0 && (len(s)-i)%3 == 0 {
+			b.WriteByte(',')
+		}
+		b.WriteRune(r)
+	}
+
+	return b.String()
+}
+
+// campaignReportTpl is the HTML campaign report. Styles are inline so that the
+// report renders as is in e-mail clients.
+const campaignReportTpl = `<!doctype html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{ .Camp.Name }}</title>
+</head>
+<body style="margin:0; padding:30px 15px; background:#f4f6f8; font-family:Helvetica, Arial, sans-serif; font-size:14px; color:#333;">
+<div style="max-width:700px; margin:0 auto; background:#fff; border-radius:5px; padding:30px;">
+	<h1 style="margin:0 0 5px 0; font-size:22px; color:#111;">{{ .Camp.Name }}</h1>
+	<p style="margin:0 0 20px 0; color:#666;">{{ .Camp.Subject }}</p>
+
+	<table cellpadding="0" cellspacing="0" style="width:100%; margin-bottom:25px; color:#666; font-size:13px;">
+		<tr>
+			<td style="padding:3px 0;">Status</td>
+			<td style="padding:3px 0; color:#333;">{{ .Camp.Status }}</td>
+		</tr>
+		{{- if .Camp.StartedAt.Valid }}
+		<tr>
+			<td style="padding:3px 0;">Started</td>
+			<td style="padding:3px 0; color:#333;">{{ date .Camp.StartedAt.Time }}</td>
+		</tr>
+		{{- end }}
+		<tr>
+			<td style="padding:3px 0;">Generated</td>
+			<td style="padding:3px 0; color:#333;">{{ date .GeneratedAt }}</td>
+		</tr>
+	</table>
+
+	<h2 style="margin:0 0 10px 0; font-size:16px; color:#111;">Totals</h2>
+	<table cellpadding="0" cellspacing="0" style="width:100%; margin-bottom:25px; border-collapse:collapse; text-align:center;">
+		<tr>
+			<td style="padding:12px 5px; border:1px solid #eee;">
+				<div style="font-size:20px; color:#111;">{{ num .Camp.Sent }}</div>
+				<div style="color:#888; font-size:12px;">Sent of {{ num .Camp.ToSend }}</div>
+			</td>
+			<td style="padding:12px 5px; border:1px solid #eee;">
+				{{- if .Camp.ViewsTracked }}
+				<div style="font-size:20px; color:#0055d4;">{{ num .Camp.Views }}</div>
+				<div style="color:#888; font-size:12px;">Views ({{ .OpenRate }})</div>
+				{{- else }}
+				<div style="font-size:20px; color:#aaa;">-</div>
+				<div style="color:#888; font-size:12px;">Views (not tracked)</div>
+				{{- end }}
+			</td>
+			<td style="padding:12px 5px; border:1px solid #eee;">
+				<div style="font-size:20px; color:#10b981;">{{ num .Camp.Clicks }}</div>
+				<div style="color:#888; font-size:12px;">Clicks ({{ .ClickRate }})</div>
+			</td>
+			<td style="padding:12px 5px; border:1px solid #eee;">
+				<div style="font-size:20px; color:#e0475f;">{{ num .Camp.Bounces }}</div>
+				<div style="color:#888; font-size:12px;">Bounces ({{ .BounceRate }})</div>
+			</td>
+		</tr>
+	</table>
+
+	<h2 style="margin:0 0 5px 0; font-size:16px; color:#111;">Views and clicks</h2>
+	<p style="margin:0 0 10px 0; color:#888; font-size:12px;">
+		{{ date .From }} to {{ date .To }}, by {{ .Interval }}.
+		<span style="color:#0055d4;">&#9632;</span> Views
+		<span style="color:#10b981;">&#9632;</span> Clicks
+	</p>
+	<svg xmlns="http://www.w3.org/2000/svg" width="100%" viewBox="0 0 {{ .Chart.Width }} {{ .Chart.Height }}" style="margin-bottom:25px; font-family:Helvetica, Arial, sans-serif;">
+		<line x1="{{ .Chart.Left }}" y1="{{ .Chart.Bottom }}" x2="{{ .Chart.Right }}" y2="{{ .Chart.Bottom }}" stroke="#ddd" stroke-width="1" />
+		{{- range .Chart.YLabels }}
+		<text x="{{ .X }}" y="{{ .Y }}" text-anchor="end" font-size="10" fill="#888">{{ .Text }}</text>
+		{{- end }}
+		{{- range .Chart.XLabels }}
+		<text x="{{ .X }}" y="{{ .Y }}" text-anchor="middle" font-size="10" fill="#888">{{ .Text }}</text>
+		{{- end }}
+		{{- if .Camp.ViewsTracked }}
+		<polyline points="{{ .Chart.Views }}" fill="none" stroke="#0055d4" stroke-width="2" />
+		{{- end }}
+		<polyline points="{{ .Chart.Clicks }}" fill="none" stroke="#10b981" stroke-width="2" />
+	</svg>
+
+	<h2 style="margin:0 0 10px 0; font-size:16px; color:#111;">Top links</h2>
+	{{- if .Links }}
+	<table cellpadding="0" cellspacing="0" style="width:100%; margin-bottom:25px; border-collapse:collapse; font-size:13px;">
+		{{- range .Links }}
+		<tr>
+			<td style="padding:6px 10px 6px 0; border-bottom:1px solid #eee; word-break:break-all;">
+				<a href="{{ .URL }}" style="color:#0055d4; text-decoration:none;">{{ .Label }}</a>
+			</td>
+			<td style="padding:6px 0; border-bottom:1px solid #eee; width:210px;">
+				<svg xmlns="http://www.w3.org/2000/svg" width="200" height="10"><rect width="{{ .Width }}" height="10" fill="#10b981" /></svg>
+			</td>
+			<td style="padding:6px 0 6px 10px; border-bottom:1px solid #eee; text-align:right;">{{ num .Count }}</td>
+		</tr>
+		{{- end }}
+	</table>
+	{{- else }}
+	<p style="margin:0 0 25px 0; color:#888;">No link clicks.</p>
+	{{- end }}
+
+	<h2 style="margin:0 0 10px 0; font-size:16px; color:#111;">Bounces</h2>
+	{{- if .Bounces }}
+	<table cellpadding="0" cellspacing="0" style="width:100%; border-collapse:collapse; font-size:13px;">
+		{{- range .Bounces }}
+		<tr>
+			<td style="padding:6px 10px 6px 0; border-bottom:1px solid #eee;">{{ .Label }}</td>
+			<td style="padding:6px 0; border-bottom:1px solid #eee; width:210px;">
+				<svg xmlns="http://www.w3.org/2000/svg" width="200" height="10"><rect width="{{ .Width }}" height="10" fill="#e0475f" /></svg>
+			</td>
+			<td style="padding:6px 0 6px 10px; border-bottom:1px solid #eee; text-align:right;">{{ num .Count }}</td>
+		</tr>
+		{{- end }}
+	</table>
+	{{- else }}
+	<p style="margin:0; color:#888;">No bounces.</p>
+	{{- end }}
+</div>
+</body>
+</html>
+`
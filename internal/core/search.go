@@ -0,0 +1,222 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// Max number of attribute filters in a structured subscriber search.
+const maxSearchAttribFilters = 20
+
+// Escapes LIKE wildcards in search strings.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// searchQuery accumulates the conditions of a structured subscriber search
+// and the args of their placeholders.
+type searchQuery struct {
+	conds []string
+	args  []interface{}
+}
+
+// arg adds an arg and returns its placeholder, eg: $3.
+func (s *searchQuery) arg(v interface{}) string {
+	s.args = append(s.args, v)
+	return "$" + strconv.Itoa(len(s.args))
+}
+
+func (s *searchQuery) where(cond string) {
+	s.conds = append(s.conds, cond)
+}
+
+// SearchSubscribers returns the subscribers matching a structured search. Unlike
+// QuerySubscribers, no SQL is accepted. The filters are mapped to fixed conditions
+// whose values are query args: email and status filters use the subscribers'
+// email and status indexes, created date ranges the created_at index, list filters
+// the subscriber_lists indexes, and attribute equality, the GIN attribs index.
+func (c *Core) SearchSubscribers(s models.SubscriberSearch, order, orderBy string, offset, limit int) (models.Subscribers, int, error) {
+	q, err := c.makeSubscriberSearch(s)
+	if err != nil {
+		return nil, 0, err
+	}
+	cond := ""
+	if len(q.conds) > 0 {
+		cond = " AND " + strings.Join(q.conds, " AND ")
+	}
+
+	// Sort params.
+	if !strSliceContains(orderBy, subQuerySortFields) {
+		orderBy = "subscribers.id"
+	}
+	if order != SortAsc && order != SortDesc {
+		order = SortDesc
+	}
+
+	total := 0
+	if err := c.db.Get(&total, strings.ReplaceAll(c.q.SearchSubscribersCount, "%query%", cond), q.args...); err != nil {
+		c.log.Error("error counting subscribers", "error", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	// No results.
+	if total == 0 {
+		return models.Subscribers{}, 0, nil
+	}
+
+	stmt := strings.ReplaceAll(c.q.SearchSubscribers, "%query%", cond)
+	stmt = strings.ReplaceAll(stmt, "%order%", orderBy+" "+order)
+	stmt = strings.ReplaceAll(stmt, "%offset%", q.arg(offset))
+	stmt = strings.ReplaceAll(stmt, "%limit%", q.arg(limit))
+
+	var out models.Subscribers
+	if err := c.db.Select(&out, stmt, q.args...); err != nil {
+		c.log.Error("error searching subscribers", "error", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	// Lazy load lists for each subscriber.
+	if err := out.LoadLists(c.q.GetSubscriberListsLazy); err != nil {
+		c.log.Error("error fetching subscriber lists", "error", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	return out, total, nil
+}
+
+// makeSubscriberSearch validates a structured subscriber search and maps its filters
+// to SQL conditions. Only field names and operators are written into the conditions,
+// and all the values are passed as args.
+func (c *Core) makeSubscriberSearch(s models.SubscriberSearch) (*searchQuery, error) {
+	q := &searchQuery{}
+	invalid := func(name string) error {
+		return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidFields", "name", name))
+	}
+
+	if v := strings.TrimSpace(s.Email); v != "" {
+		q.where("LOWER(subscribers.email) LIKE " + q.arg("%"+likeEscaper.Replace(strings.ToLower(v))+"%"))
+	}
+	if v := strings.TrimSpace(s.Name); v != "" {
+		q.where("subscribers.name ILIKE " + q.arg("%"+likeEscaper.Replace(v)+"%"))
+	}
+
+	switch s.Status {
+	case "":
+	case models.SubscriberStatusEnabled, models.SubscriberStatusDisabled, models.SubscriberStatusBlockListed:
+		q.where("subscribers.status = " + q.arg(s.Status) + "::subscriber_status")
+	default:
+		return nil, invalid("status")
+	}
+
+	if len(s.ListIDs) > 0 {
+		for _, id := range s.ListIDs {
+			if id < 1 {
+				return nil, invalid("list_ids")
+			}
+		}
+
+		cond := "EXISTS (SELECT 1 FROM subscriber_lists WHERE subscriber_lists.subscriber_id = subscribers.id" +
+			" AND subscriber_lists.list_id = ANY(" + q.arg(pq.Array(s.ListIDs)) + "::INT[])"
+		switch s.SubscriptionStatus {
+		case "":
+		case models.SubscriptionStatusUnconfirmed, models.SubscriptionStatusConfirmed, models.SubscriptionStatusUnsubscribed:
+			cond += " AND subscriber_lists.status = " + q.arg(s.SubscriptionStatus) + "::subscription_status"
+		default:
+			return nil, invalid("subscription_status")
+		}
+		q.where(cond + ")")
+	} else if s.SubscriptionStatus != "" {
+		return nil, invalid("list_ids")
+	}
+
+	if s.CreatedFrom.Valid {
+		q.where("subscribers.created_at >= " + q.arg(s.CreatedFrom.Time))
+	}
+	if s.CreatedTo.Valid {
+		if s.CreatedFrom.Valid && !s.CreatedTo.Time.After(s.CreatedFrom.Time) {
+			return nil, invalid("created_to")
+		}
+		q.where("subscribers.created_at < " + q.arg(s.CreatedTo.Time))
+	}
+
+	if len(s.Attribs) > maxSearchAttribFilters {
+		return nil, invalid("attribs")
+	}
+	for i, f := range s.Attribs {
+		name := fmt.Sprintf("attribs[%d]", i)
+
+		path := strings.Split(strings.TrimSpace(f.Key), ".")
+		for _, p := range path {
+			if p == "" {
+				return nil, invalid(name + ".key")
+			}
+		}
+
+		switch f.Op {
+		case models.AttribOpEq, models.AttribOpNeq:
+			switch f.Value.(type) {
+			case string, float64, bool, nil:
+			default:
+				return nil, invalid(name + ".value")
+			}
+
+			// Match with JSON containment, eg: {"location": {"city": "x"}},
+			// so that the GIN index on attribs is used.
+			var v interface{} = f.Value
+			for j := len(path) - 1; j >= 0; j-- {
+				v = map[string]interface{}{path[j]: v}
+			}
+			b, _ := json.Marshal(v)
+
+			cond := "subscribers.attribs @> " + q.arg(string(b)) + "::JSONB"
+			if f.Op == models.AttribOpNeq {
+				cond = "NOT (" + cond + ")"
+			}
+			q.where(cond)
+
+		case models.AttribOpGt, models.AttribOpGte, models.AttribOpLt, models.AttribOpLte:
+			n, ok := f.Value.(float64)
+			if !ok {
+				return nil, invalid(name + ".value")
+			}
+
+			op := map[string]string{
+				models.AttribOpGt:  ">",
+				models.AttribOpGte: ">=",
+				models.AttribOpLt:  "<",
+				models.AttribOpLte: "<=",
+			}[f.Op]
+
+			// Non-numeric values are NULL, which don't match, instead of failing the cast.
+			p := q.arg(pq.Array(path))
+			q.where("(CASE WHEN JSONB_TYPEOF(subscribers.attribs #> " + p + "::TEXT[]) = 'number'" +
+				" THEN (subscribers.attribs #>> " + p + "::TEXT[])::NUMERIC END) " + op + " " + q.arg(n) + "::NUMERIC")
+
+		case models.AttribOpContains:
+			v, ok := f.Value.(string)
+			if !ok || v == "" {
+				return nil, invalid(name + ".value")
+			}
+			q.where("subscribers.attribs #>> " + q.arg(pq.Array(path)) + "::TEXT[] ILIKE " + q.arg("%"+likeEscaper.Replace(v)+"%"))
+
+		case models.AttribOpExists:
+			q.where("subscribers.attribs #> " + q.arg(pq.Array(path)) + "::TEXT[] IS NOT NULL")
+
+		case models.AttribOpNotExists:
+			q.where("subscribers.attribs #> " + q.arg(pq.Array(path)) + "::TEXT[] IS NULL")
+
+		default:
+			return nil, invalid(name + ".op")
+		}
+	}
+
+	return q, nil
+}
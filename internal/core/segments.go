@@ -0,0 +1,193 @@
+package core
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// GetSegments returns all the saved segments.
+func (c *Core) GetSegments() ([]models.Segment, error) {
+	out := []models.Segment{}
+	if err := c.q.GetSegments.Select(&out, 0); err != nil {
+		c.log.Error("error fetching segments", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "segments", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// GetSegment returns a saved segment.
+func (c *Core) GetSegment(id int) (models.Segment, error) {
+	var out []models.Segment
+	if err := c.q.GetSegments.Select(&out, id); err != nil {
+		c.log.Error("error fetching segment", "error", err)
+		return models.Segment{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "segment", "error", pqErrMsg(err)))
+	}
+
+	if len(out) == 0 {
+		return models.Segment{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "segment"))
+	}
+
+	return out[0], nil
+}
+
+// CreateSegment saves a new segment. The query is validated by doing a dry run.
+func (c *Core) CreateSegment(name, query string, listIDs []int) (models.Segment, error) {
+	query, err := c.validateSegmentQuery(query)
+	if err != nil {
+		return models.Segment{}, err
+	}
+
+	var newID int
+	if err := c.q.InsertSegment.Get(&newID, name, query, pq.Array(listIDs)); err != nil {
+		c.log.Error("error inserting segment", "error", err)
+		return models.Segment{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "segment", "error", pqErrMsg(err)))
+	}
+
+	return c.GetSegment(newID)
+}
+
+// UpdateSegment updates a saved segment. Campaigns targeting the segment pick up
+// the changes from their next batch of subscribers.
+func (c *Core) UpdateSegment(id int, name, query string, listIDs []int) (models.Segment, error) {
+	query, err := c.validateSegmentQuery(query)
+	if err != nil {
+		return models.Segment{}, err
+	}
+
+	res, err := c.q.UpdateSegment.Exec(id, name, query, pq.Array(listIDs))
+	if err != nil {
+		c.log.Error("error updating segment", "error", err)
+		return models.Segment{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "segment", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Segment{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "segment"))
+	}
+
+	return c.GetSegment(id)
+}
+
+// DeleteSegment deletes a saved segment. Segments targeted by campaigns that
+// haven't finished can't be deleted.
+func (c *Core) DeleteSegment(id int) error {
+	if _, err := c.GetSegment(id); err != nil {
+		return err
+	}
+
+	res, err := c.q.DeleteSegment.Exec(id)
+	if err != nil {
+		c.log.Error("error deleting segment", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "segment", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidData")+": segment is targeted by active campaigns")
+	}
+
+	return nil
+}
+
+// UpdateCampaignSegment sets the segment that a campaign targets. segID = 0 clears it.
+func (c *Core) UpdateCampaignSegment(campID, segID int) (models.Campaign, error) {
+	if segID > 0 {
+		if _, err := c.GetSegment(segID); err != nil {
+			return models.Campaign{}, err
+		}
+	}
+
+	res, err := c.q.UpdateCampaignSegment.Exec(campID, segID, c.consts.CampaignApproval)
+	if err != nil {
+		c.log.Error("error updating campaign segment", "error", err)
+		return models.Campaign{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return models.Campaign{}, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+	}
+
+	return c.GetCampaign(campID, "", "")
+}
+
+// GetCampaignSegment returns the segment that a campaign targets, or nil if it doesn't.
+func (c *Core) GetCampaignSegment(campID int) (*models.Segment, error) {
+	var out models.Segment
+	if err := c.q.GetCampaignSegment.Get(&out, campID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+
+		c.log.Error("error fetching campaign segment", "error", err)
+		return nil, err
+	}
+
+	return &out, nil
+}
+
+// NextSegmentSubscribers returns the next batch of subscribers of a campaign that
+// match the segment the campaign targets. The segment's arbitrary SQL expression
+// is run in a read-only transaction.
+func (c *Core) NextSegmentSubscribers(campID int, seg models.Segment, limit int) ([]models.Subscriber, error) {
+	stmt := strings.ReplaceAll(c.q.NextCampaignSegmentSubscribers, "%query%", sanitizeSQLExp(seg.Query))
+
+	listIDs := seg.ListIDs
+	if listIDs == nil {
+		listIDs = pq.Int64Array{}
+	}
+
+	tx, err := c.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		c.log.Error("error preparing segment query", "error", err, "campaign_id", campID)
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var out []models.Subscriber
+	if err := tx.Select(&out, stmt, campID, limit, listIDs); err != nil {
+		c.log.Error("error fetching segment subscribers for campaign", "error", err, "campaign_id", campID)
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// validateSegmentQuery sanitizes a segment's query and validates it by running
+// it with LIMIT 0 in a read-only transaction.
+func (c *Core) validateSegmentQuery(query string) (string, error) {
+	query = sanitizeSQLExp(query)
+	if query == "" {
+		return "", echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidFields", "name", "query"))
+	}
+
+	tx, err := c.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		c.log.Error("error preparing segment query", "error", err)
+		return "", echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(strings.ReplaceAll(c.q.CheckSegmentQuery, "%query%", query)); err != nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
+	}
+
+	return query, nil
+}
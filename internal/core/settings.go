@@ -31,6 +31,65 @@ func (c *Core) GetSettings() (models.Settings, error) {
 	return out, nil
 }
 
+// SetMessageThrottle saves the global message throttle (messages per second) to the settings.
+func (c *Core) SetMessageThrottle(rate int) error {
+	b, err := json.Marshal(map[string]interface{}{"app.message_throttle": rate})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("settings.errorEncoding", "error", err.Error()))
+	}
+
+	if _, err := c.q.UpdateSettings.Exec(b); err != nil {
+		c.log.Error("error updating message throttle", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.settings}", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// GetDomainRules returns the domain block and allow rules from the settings.
+func (c *Core) GetDomainRules() (models.DomainRules, error) {
+	s, err := c.GetSettings()
+	if err != nil {
+		return models.DomainRules{}, err
+	}
+
+	return models.DomainRules{
+		Blocklist:       s.DomainBlocklist,
+		Allowlist:       s.DomainAllowlist,
+		BlockDisposable: s.BlockDisposableDomains,
+	}, nil
+}
+
+// SetDomainRules saves the domain block and allow rules to the settings.
+func (c *Core) SetDomainRules(r models.DomainRules) error {
+	if r.Blocklist == nil {
+		r.Blocklist = []string{}
+	}
+	if r.Allowlist == nil {
+		r.Allowlist = []string{}
+	}
+
+	b, err := json.Marshal(map[string]interface{}{
+		"privacy.domain_blocklist":         r.Blocklist,
+		"privacy.domain_allowlist":         r.Allowlist,
+		"privacy.block_disposable_domains": r.BlockDisposable,
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("settings.errorEncoding", "error", err.Error()))
+	}
+
+	if _, err := c.q.UpdateSettings.Exec(b); err != nil {
+		c.log.Error("error updating domain rules", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.settings}", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
 // UpdateSettings updates settings.
 func (c *Core) UpdateSettings(s models.Settings) error {
 	// Marshal settings.
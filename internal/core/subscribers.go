@@ -1,17 +1,27 @@
 package core
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
+	"github.com/jmoiron/sqlx"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
 	"github.com/lib/pq"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	null "gopkg.in/volatiletech/null.v6"
 )
 
 // GetSubscriber fetches a subscriber by one of the given params.
@@ -23,7 +33,7 @@ func (c *Core) GetSubscriber(id int, uuid, email string) (models.Subscriber, err
 
 	var out models.Subscribers
 	if err := c.q.GetSubscriber.Select(&out, id, uu, email); err != nil {
-		c.log.Printf("error fetching subscriber: %v", err)
+		c.log.Error("error fetching subscriber", "error", err)
 		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching",
 				"name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
@@ -34,7 +44,69 @@ func (c *Core) GetSubscriber(id int, uuid, email string) (models.Subscriber, err
 				fmt.Sprintf("{globals.terms.subscriber} (%d: %s%s)", id, uuid, email)))
 	}
 	if err := out.LoadLists(c.q.GetSubscriberListsLazy); err != nil {
-		c.log.Printf("error loading subscriber lists: %v", err)
+		c.log.Error("error loading subscriber lists", "error", err)
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.lists}", "error", pqErrMsg(err)))
+	}
+
+	return out[0], nil
+}
+
+// GetSubscriberActivity retrieves a subscriber's activity events of the given types
+// (all if empty), latest first, along with the total number of events.
+func (c *Core) GetSubscriberActivity(id int, types []string, offset, limit int) ([]models.ActivityEvent, int, error) {
+	for _, t := range types {
+		if !strSliceContains(t, models.ActivityTypes) {
+			return nil, 0, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.invalidFields", "name", "type"))
+		}
+	}
+	if len(types) == 0 {
+		types = models.ActivityTypes
+	}
+
+	// Ensure that the subscriber exists.
+	if _, err := c.GetSubscriber(id, "", ""); err != nil {
+		return nil, 0, err
+	}
+
+	out := []models.ActivityEvent{}
+	if err := c.q.GetSubscriberActivity.Select(&out, id, pq.Array(types), offset, limit); err != nil {
+		c.log.Error("error fetching subscriber activity", "error", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	if len(out) > 0 {
+		total = out[0].Total
+	}
+
+	return out, total, nil
+}
+
+// GetSubscriberByUUID fetches a subscriber and their list subscriptions by UUID.
+// This is used on public pages where subscribers are identified by their UUIDs.
+func (c *Core) GetSubscriberByUUID(subUUID string) (models.Subscriber, error) {
+	if _, err := uuid.FromString(subUUID); err != nil {
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("globals.messages.invalidUUID"))
+	}
+
+	var out models.Subscribers
+	if err := c.q.GetSubscriber.Select(&out, 0, subUUID, ""); err != nil {
+		c.log.Error("error fetching subscriber", "error", err)
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+	if len(out) == 0 {
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusNotFound,
+			c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.subscriber}"))
+	}
+
+	if err := out.LoadLists(c.q.GetSubscriberListsLazy); err != nil {
+		c.log.Error("error loading subscriber lists", "error", err)
 		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching",
 				"name", "{globals.terms.lists}", "error", pqErrMsg(err)))
@@ -48,7 +120,7 @@ func (c *Core) GetSubscribersByEmail(emails []string) (models.Subscribers, error
 	var out models.Subscribers
 
 	if err := c.q.GetSubscribersByEmails.Select(&out, pq.Array(emails)); err != nil {
-		c.log.Printf("error fetching subscriber: %v", err)
+		c.log.Error("error fetching subscriber", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
 	}
@@ -57,7 +129,7 @@ func (c *Core) GetSubscribersByEmail(emails []string) (models.Subscribers, error
 	}
 
 	if err := out.LoadLists(c.q.GetSubscriberListsLazy); err != nil {
-		c.log.Printf("error loading subscriber lists: %v", err)
+		c.log.Error("error loading subscriber lists", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.lists}", "error", pqErrMsg(err)))
 	}
@@ -106,7 +178,7 @@ func (c *Core) QuerySubscribers(query string, listIDs []int, subStatus string, o
 
 	tx, err := c.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
-		c.log.Printf("error preparing subscriber query: %v", err)
+		c.log.Error("error preparing subscriber query", "error", err)
 		return nil, 0, echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
 	}
 	defer tx.Rollback()
@@ -118,7 +190,7 @@ func (c *Core) QuerySubscribers(query string, listIDs []int, subStatus string, o
 
 	// Lazy load lists for each subscriber.
 	if err := out.LoadLists(c.q.GetSubscriberListsLazy); err != nil {
-		c.log.Printf("error fetching subscriber lists: %v", err)
+		c.log.Error("error fetching subscriber lists", "error", err)
 		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
@@ -126,6 +198,62 @@ func (c *Core) QuerySubscribers(query string, listIDs []int, subStatus string, o
 	return out, total, nil
 }
 
+// PreviewSubscriberQuery does a dry run of an arbitrary subscriber query expression
+// (that's used for query based bulk actions) and returns the number of matching
+// subscribers along with a small sample of them. The queries run in a readonly
+// transaction with a statement timeout and never mutate data.
+func (c *Core) PreviewSubscriberQuery(query string, listIDs []int) (int, models.Subscribers, error) {
+	cond := ""
+	if q := sanitizeSQLExp(query); q != "" {
+		cond = " AND " + q
+	}
+
+	// Required for pq.Array()
+	if listIDs == nil {
+		listIDs = []int{}
+	}
+
+	tx, err := c.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		c.log.Error("error preparing subscriber query", "error", err)
+		return 0, nil, echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(fmt.Sprintf("SET LOCAL statement_timeout = %d", subQueryPreviewTimeout.Milliseconds())); err != nil {
+		c.log.Error("error preparing subscriber query", "error", err)
+		return 0, nil, echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	if err := tx.Get(&total, fmt.Sprintf(c.q.QuerySubscribersCount, cond), pq.Array(listIDs), ""); err != nil {
+		return 0, nil, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	if total == 0 {
+		return 0, models.Subscribers{}, nil
+	}
+
+	stmt := strings.ReplaceAll(c.q.QuerySubscribers, "%query%", cond)
+	stmt = strings.ReplaceAll(stmt, "%order%", "subscribers.id "+SortAsc)
+
+	var out models.Subscribers
+	if err := tx.Select(&out, stmt, pq.Array(listIDs), "", 0, subQueryPreviewSize); err != nil {
+		return 0, nil, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	// Lazy load lists for each subscriber.
+	if err := out.LoadLists(c.q.GetSubscriberListsLazy); err != nil {
+		c.log.Error("error fetching subscriber lists", "error", err)
+		return 0, nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	return total, out, nil
+}
+
 // GetSubscriberLists returns a subscriber's lists based on the given conditions.
 func (c *Core) GetSubscriberLists(subID int, uuid string, listIDs []int, listUUIDs []string, subStatus string, listType string) ([]models.List, error) {
 	if listIDs == nil {
@@ -144,7 +272,7 @@ func (c *Core) GetSubscriberLists(subID int, uuid string, listIDs []int, listUUI
 	// Get the list of subscription lists where the subscriber hasn't confirmed.
 	out := []models.List{}
 	if err := c.q.GetSubscriberLists.Select(&out, subID, uu, pq.Array(listIDs), pq.Array(listUUIDs), subStatus, listType); err != nil {
-		c.log.Printf("error fetching lists for opt-in: %s", pqErrMsg(err))
+		c.log.Error("error fetching lists for opt-in", "error", pqErrMsg(err))
 		return nil, err
 	}
 
@@ -162,7 +290,7 @@ func (c *Core) GetSubscriberProfileForExport(id int, uuid string) (models.Subscr
 
 	var out models.SubscriberExportProfile
 	if err := c.q.ExportSubscriberData.Get(&out, id, uu); err != nil {
-		c.log.Printf("error fetching subscriber export data: %v", err)
+		c.log.Error("error fetching subscriber export data", "error", err)
 
 		return models.SubscriberExportProfile{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", err.Error()))
@@ -171,34 +299,62 @@ func (c *Core) GetSubscriberProfileForExport(id int, uuid string) (models.Subscr
 	return out, nil
 }
 
+// ExportSubscriberData returns the complete data of a subscriber as a JSON dossier for
+// data subject access requests: the profile, list subscriptions, campaigns received,
+// campaign views, link clicks, and bounces. Unlike GetSubscriberProfileForExport, it's
+// not subject to the privacy export settings and includes private lists.
+func (c *Core) ExportSubscriberData(email string) ([]byte, error) {
+	var out json.RawMessage
+	if err := c.q.ExportSubscriberDossier.Get(&out, strings.TrimSpace(email)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.subscriber}"))
+		}
+
+		c.log.Error("error fetching subscriber export data", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	var b bytes.Buffer
+	if err := json.Indent(&b, out, "", "  "); err != nil {
+		return out, nil
+	}
+
+	return b.Bytes(), nil
+}
+
 // ExportSubscribers returns an iterator function that provides lists of subscribers based
 // on the given criteria in an exportable form. The iterator function returned can be called
 // repeatedly until there are nil subscribers. It's an iterator because exports can be extremely
 // large and may have to be fetched in batches from the DB and streamed somewhere.
-func (c *Core) ExportSubscribers(query string, subIDs, listIDs []int, subStatus string, batchSize int) (func() ([]models.SubscriberExport, error), error) {
+// In the full format (ExportFormatFull), every subscriber carries all their list subscriptions
+// along with the subscription statuses and timestamps.
+func (c *Core) ExportSubscribers(query string, subIDs, listIDs []int, subStatus, format string, batchSize int) (func() ([]models.SubscriberExport, error), error) {
 	// There's an arbitrary query condition.
 	cond := ""
 	if query != "" {
 		cond = " AND " + query
 	}
 
-	stmt := fmt.Sprintf(c.q.QuerySubscribersForExport, cond)
-	stmt = strings.ReplaceAll(c.q.QuerySubscribersForExport, "%query%", cond)
+	stmt := strings.ReplaceAll(c.q.QuerySubscribersForExport, "%query%", cond)
 
 	// Verify that the arbitrary SQL search expression is read only.
 	if cond != "" {
 		tx, err := c.db.Unsafe().BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
 		if err != nil {
-			c.log.Printf("error preparing subscriber query: %v", err)
+			c.log.Error("error preparing subscriber query", "error", err)
 			return nil, echo.NewHTTPError(http.StatusBadRequest,
 				c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
 		}
 		defer tx.Rollback()
 
-		if _, err := tx.Query(stmt, nil, 0, nil, 1); err != nil {
+		rows, err := tx.Query(stmt, nil, 0, nil, 1)
+		if err != nil {
 			return nil, echo.NewHTTPError(http.StatusBadRequest,
 				c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
 		}
+		rows.Close()
 	}
 
 	if subIDs == nil {
@@ -208,19 +364,14 @@ func (c *Core) ExportSubscribers(query string, subIDs, listIDs []int, subStatus
 		listIDs = []int{}
 	}
 
-	// Prepare the actual query statement.
-	tx, err := c.db.Preparex(stmt)
-	if err != nil {
-		c.log.Printf("error preparing subscriber query: %v", err)
-		return nil, echo.NewHTTPError(http.StatusBadRequest,
-			c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
-	}
-
+	// Every call fetches the next batch of subscribers above the last seen ID (keyset pagination)
+	// so that only one batch is ever held in memory. The statement isn't prepared as the
+	// iterator may be abandoned midway (eg: client disconnects) leaving it dangling.
 	id := 0
 	return func() ([]models.SubscriberExport, error) {
 		var out []models.SubscriberExport
-		if err := tx.Select(&out, pq.Array(listIDs), id, pq.Array(subIDs), subStatus, batchSize); err != nil {
-			c.log.Printf("error exporting subscribers by query: %v", err)
+		if err := c.db.Select(&out, stmt, pq.Array(listIDs), id, pq.Array(subIDs), subStatus, batchSize); err != nil {
+			c.log.Error("error exporting subscribers by query", "error", err)
 			return nil, echo.NewHTTPError(http.StatusInternalServerError,
 				c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 		}
@@ -229,22 +380,119 @@ func (c *Core) ExportSubscribers(query string, subIDs, listIDs []int, subStatus
 		}
 
 		id = out[len(out)-1].ID
+
+		if format == ExportFormatFull {
+			if err := c.getSubscriptionsForExport(out); err != nil {
+				return nil, err
+			}
+		}
+
 		return out, nil
 	}, nil
 }
 
+// WriteSubscribersCSV writes the subscribers returned by an export iterator (see
+// ExportSubscribers) to w as CSV rows, calling flush after every batch so that
+// the rows are streamed out and only one batch is held in memory at a time.
+func WriteSubscribersCSV(w io.Writer, format string, next func() ([]models.SubscriberExport, error), flush func()) error {
+	wr := csv.NewWriter(w)
+
+	hdr := []string{"uuid", "email", "name", "attributes", "status", "created_at", "updated_at"}
+	if format == ExportFormatFull {
+		hdr = append(hdr, "lists")
+	}
+	wr.Write(hdr)
+
+	// Iterate in batches until there are no more subscribers to export.
+	for {
+		out, err := next()
+		if err != nil {
+			return err
+		}
+		if len(out) == 0 {
+			break
+		}
+
+		for _, r := range out {
+			row := []string{r.UUID, r.Email, r.Name, r.Attribs, r.Status,
+				r.CreatedAt.Time.String(), r.UpdatedAt.Time.String()}
+			if format == ExportFormatFull {
+				row = append(row, string(r.Lists))
+			}
+
+			if err := wr.Write(row); err != nil {
+				return err
+			}
+		}
+
+		// Flush CSV to stream after each batch.
+		wr.Flush()
+		if err := wr.Error(); err != nil {
+			return err
+		}
+		flush()
+	}
+
+	wr.Flush()
+	return wr.Error()
+}
+
+// getSubscriptionsForExport fetches the list subscriptions of the given batch of
+// exported subscribers and sets them on the records.
+func (c *Core) getSubscriptionsForExport(subs []models.SubscriberExport) error {
+	ids := make([]int, len(subs))
+	for i, s := range subs {
+		ids[i] = s.ID
+	}
+
+	var res []struct {
+		SubscriberID int             `db:"subscriber_id"`
+		Lists        json.RawMessage `db:"lists"`
+	}
+	if err := c.q.GetSubscriptionsForExport.Select(&res, pq.Array(ids)); err != nil {
+		c.log.Error("error fetching subscriptions for export", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscriptions}", "error", pqErrMsg(err)))
+	}
+
+	lists := make(map[int]json.RawMessage, len(res))
+	for _, r := range res {
+		lists[r.SubscriberID] = r.Lists
+	}
+
+	for i, s := range subs {
+		if l, ok := lists[s.ID]; ok {
+			subs[i].Lists = l
+		} else {
+			subs[i].Lists = json.RawMessage(`[]`)
+		}
+	}
+
+	return nil
+}
+
 // InsertSubscriber inserts a subscriber and returns the ID. The first bool indicates if
 // it was a new subscriber, and the second bool indicates if the subscriber was sent an optin confirmation.
 // bool = optinSent?
 func (c *Core) InsertSubscriber(sub models.Subscriber, listIDs []int, listUUIDs []string, preconfirm bool) (models.Subscriber, bool, error) {
 	uu, err := uuid.NewV4()
 	if err != nil {
-		c.log.Printf("error generating UUID: %v", err)
+		c.log.Error("error generating UUID", "error", err)
 		return models.Subscriber{}, false, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
 	}
 	sub.UUID = uu.String()
 
+	if a, err := c.applyAttribFields(sub.Attribs); err != nil {
+		return models.Subscriber{}, false, err
+	} else {
+		sub.Attribs = a
+	}
+
+	if err := c.validateAttribs(sub.Attribs); err != nil {
+		return models.Subscriber{}, false, err
+	}
+
 	subStatus := models.SubscriptionStatusUnconfirmed
 	if preconfirm {
 		subStatus = models.SubscriptionStatusConfirmed
@@ -274,7 +522,7 @@ func (c *Core) InsertSubscriber(sub models.Subscriber, listIDs []int, listUUIDs
 			return models.Subscriber{}, false, echo.NewHTTPError(http.StatusConflict, c.i18n.T("subscribers.emailExists"))
 		} else {
 			// return sub.Subscriber, errSubscriberExists
-			c.log.Printf("error inserting subscriber: %v", err)
+			c.log.Error("error inserting subscriber", "error", err)
 			return models.Subscriber{}, false, echo.NewHTTPError(http.StatusInternalServerError,
 				c.i18n.Ts("globals.messages.errorCreating", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
 		}
@@ -287,6 +535,10 @@ func (c *Core) InsertSubscriber(sub models.Subscriber, listIDs []int, listUUIDs
 		return models.Subscriber{}, false, err
 	}
 
+	if sub.ID > 0 {
+		c.Emit(models.EventSubscriberCreated, out)
+	}
+
 	hasOptin := false
 	if !preconfirm && c.consts.SendOptinConfirmation {
 		// Send a confirmation e-mail (if there are any double opt-in lists).
@@ -299,6 +551,16 @@ func (c *Core) InsertSubscriber(sub models.Subscriber, listIDs []int, listUUIDs
 
 // UpdateSubscriber updates a subscriber's properties.
 func (c *Core) UpdateSubscriber(id int, sub models.Subscriber) (models.Subscriber, error) {
+	if a, err := c.applyAttribFields(sub.Attribs); err != nil {
+		return models.Subscriber{}, err
+	} else {
+		sub.Attribs = a
+	}
+
+	if err := c.validateAttribs(sub.Attribs); err != nil {
+		return models.Subscriber{}, err
+	}
+
 	// Format raw JSON attributes.
 	attribs := []byte("{}")
 	if len(sub.Attribs) > 0 {
@@ -318,7 +580,7 @@ func (c *Core) UpdateSubscriber(id int, sub models.Subscriber) (models.Subscribe
 		json.RawMessage(attribs),
 	)
 	if err != nil {
-		c.log.Printf("error updating subscriber: %v", err)
+		c.log.Error("error updating subscriber", "error", err)
 		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
 	}
@@ -335,6 +597,16 @@ func (c *Core) UpdateSubscriber(id int, sub models.Subscriber) (models.Subscribe
 // If deleteLists is set to true, all existing subscriptions are deleted and only
 // the ones provided are added or retained.
 func (c *Core) UpdateSubscriberWithLists(id int, sub models.Subscriber, listIDs []int, listUUIDs []string, preconfirm, deleteLists bool) (models.Subscriber, bool, error) {
+	if a, err := c.applyAttribFields(sub.Attribs); err != nil {
+		return models.Subscriber{}, false, err
+	} else {
+		sub.Attribs = a
+	}
+
+	if err := c.validateAttribs(sub.Attribs); err != nil {
+		return models.Subscriber{}, false, err
+	}
+
 	subStatus := models.SubscriptionStatusUnconfirmed
 	if preconfirm {
 		subStatus = models.SubscriptionStatusConfirmed
@@ -362,7 +634,7 @@ func (c *Core) UpdateSubscriberWithLists(id int, sub models.Subscriber, listIDs
 		subStatus,
 		deleteLists)
 	if err != nil {
-		c.log.Printf("error updating subscriber: %v", err)
+		c.log.Error("error updating subscriber", "error", err)
 		return models.Subscriber{}, false, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
 	}
@@ -385,23 +657,89 @@ func (c *Core) UpdateSubscriberWithLists(id int, sub models.Subscriber, listIDs
 // BlocklistSubscribers blocklists the given list of subscribers.
 func (c *Core) BlocklistSubscribers(subIDs []int) error {
 	if _, err := c.q.BlocklistSubscribers.Exec(pq.Array(subIDs)); err != nil {
-		c.log.Printf("error blocklisting subscribers: %v", err)
+		c.log.Error("error blocklisting subscribers", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("subscribers.errorBlocklisting", "error", err.Error()))
 	}
 
+	if c.h.ExcludeSubscribers != nil {
+		c.h.ExcludeSubscribers(subIDs)
+	}
+
 	return nil
 }
 
-// BlocklistSubscribersByQuery blocklists the given list of subscribers.
-func (c *Core) BlocklistSubscribersByQuery(query string, listIDs []int) error {
-	if err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), c.q.BlocklistSubscribersByQuery, listIDs, c.db); err != nil {
-		c.log.Printf("error blocklisting subscribers: %v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError,
+// ArchiveSubscribers soft deletes (archives) the given subscribers. Archived subscribers
+// are excluded from campaigns and list counts until they are restored or purged.
+func (c *Core) ArchiveSubscribers(subIDs []int) (int, error) {
+	res, err := c.q.ArchiveSubscribers.Exec(pq.Array(subIDs))
+	if err != nil {
+		c.log.Error("error archiving subscribers", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// RestoreSubscribers restores the given archived subscribers.
+func (c *Core) RestoreSubscribers(subIDs []int) (int, error) {
+	res, err := c.q.RestoreSubscribers.Exec(pq.Array(subIDs))
+	if err != nil {
+		c.log.Error("error restoring subscribers", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// BlocklistSubscribersByQuery blocklists subscribers by a given arbitrary query
+// expression and unsubscribes them from their lists. Subscribers are blocklisted in
+// batches of batchSize with a pause of wait between them, and the messages of active
+// campaigns that are already queued for them are dropped. It returns the number of
+// subscribers blocklisted.
+func (c *Core) BlocklistSubscribersByQuery(query string, listIDs []int, batchSize int, wait time.Duration) (int, error) {
+	n, err := c.q.ExecSubQueryTplBatches(sanitizeSQLExp(query), c.q.BlocklistSubscribersByQuery, listIDs, c.db, batchSize, wait, c.h.ExcludeSubscribers)
+	if err != nil {
+		c.log.Error("error blocklisting subscribers", "error", err)
+		return n, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("subscribers.errorBlocklisting", "error", pqErrMsg(err)))
 	}
 
-	return nil
+	return n, nil
+}
+
+// UnblocklistSubscribersByQuery enables blocklisted subscribers by a given arbitrary
+// query expression in batches of batchSize with a pause of wait between them. Their
+// subscriptions remain unsubscribed, and subscribers on the suppression list remain
+// blocklisted. It returns the number of subscribers unblocklisted.
+func (c *Core) UnblocklistSubscribersByQuery(query string, listIDs []int, batchSize int, wait time.Duration) (int, error) {
+	n, err := c.q.ExecSubQueryTplBatches(sanitizeSQLExp(query), c.q.UnblocklistSubscribersByQuery, listIDs, c.db, batchSize, wait, nil)
+	if err != nil {
+		c.log.Error("error unblocklisting subscribers", "error", err)
+		return n, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	return n, nil
+}
+
+// PreviewBlocklistByQuery does a dry run of BlocklistSubscribersByQuery (or
+// UnblocklistSubscribersByQuery if blocklist is false) and returns the number
+// of subscribers it would change along with a small sample of them.
+func (c *Core) PreviewBlocklistByQuery(query string, listIDs []int, blocklist bool) (int, models.Subscribers, error) {
+	cond := "subscribers.status = 'blocklisted'"
+	if blocklist {
+		cond = "subscribers.status != 'blocklisted'"
+	}
+	if q := sanitizeSQLExp(query); q != "" {
+		cond = "(" + q + ") AND " + cond
+	}
+
+	return c.PreviewSubscriberQuery(cond, listIDs)
 }
 
 // DeleteSubscribers deletes the given list of subscribers.
@@ -414,7 +752,7 @@ func (c *Core) DeleteSubscribers(subIDs []int, subUUIDs []string) error {
 	}
 
 	if _, err := c.q.DeleteSubscribers.Exec(pq.Array(subIDs), pq.Array(subUUIDs)); err != nil {
-		c.log.Printf("error deleting subscribers: %v", err)
+		c.log.Error("error deleting subscribers", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
@@ -426,7 +764,7 @@ func (c *Core) DeleteSubscribers(subIDs []int, subUUIDs []string) error {
 func (c *Core) DeleteSubscribersByQuery(query string, listIDs []int) error {
 	err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), c.q.DeleteSubscribersByQuery, listIDs, c.db)
 	if err != nil {
-		c.log.Printf("error deleting subscribers: %v", err)
+		c.log.Error("error deleting subscribers", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
@@ -434,14 +772,22 @@ func (c *Core) DeleteSubscribersByQuery(query string, listIDs []int) error {
 	return err
 }
 
-// UnsubscribeByCampaign unsubscribes a given subscriber from lists in a given campaign.
-func (c *Core) UnsubscribeByCampaign(subUUID, campUUID string, blocklist bool) error {
-	if _, err := c.q.UnsubscribeByCampaign.Exec(campUUID, subUUID, blocklist); err != nil {
-		c.log.Printf("error unsubscribing: %v", err)
+// UnsubscribeByCampaign unsubscribes a given subscriber from lists in a given campaign,
+// or from all lists if allLists is set.
+func (c *Core) UnsubscribeByCampaign(subUUID, campUUID string, blocklist, allLists bool) error {
+	if _, err := c.q.UnsubscribeByCampaign.Exec(campUUID, subUUID, blocklist, allLists); err != nil {
+		c.log.Error("error unsubscribing", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
 
+	c.Emit(models.EventSubscriberUnsubscribed, map[string]interface{}{
+		"subscriber_uuid": subUUID,
+		"campaign_uuid":   campUUID,
+		"blocklisted":     blocklist,
+		"all_lists":       allLists,
+	})
+
 	return nil
 }
 
@@ -452,11 +798,16 @@ func (c *Core) ConfirmOptionSubscription(subUUID string, listUUIDs []string, met
 	}
 
 	if _, err := c.q.ConfirmSubscriptionOptin.Exec(subUUID, pq.Array(listUUIDs), meta); err != nil {
-		c.log.Printf("error confirming subscription: %v", err)
+		c.log.Error("error confirming subscription", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
 
+	c.Emit(models.EventSubscriberConfirmed, map[string]interface{}{
+		"subscriber_uuid": subUUID,
+		"list_uuids":      listUUIDs,
+	})
+
 	return nil
 }
 
@@ -468,7 +819,7 @@ func (c *Core) DeleteSubscriberBounces(id int, uuid string) error {
 	}
 
 	if _, err := c.q.DeleteBouncesBySubscriber.Exec(id, uu); err != nil {
-		c.log.Printf("error deleting bounces: %v", err)
+		c.log.Error("error deleting bounces", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.bounces}", "error", pqErrMsg(err)))
 	}
@@ -480,7 +831,7 @@ func (c *Core) DeleteSubscriberBounces(id int, uuid string) error {
 func (c *Core) DeleteOrphanSubscribers() (int, error) {
 	res, err := c.q.DeleteOrphanSubscribers.Exec()
 	if err != nil {
-		c.log.Printf("error deleting orphan subscribers: %v", err)
+		c.log.Error("error deleting orphan subscribers", "error", err)
 		return 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
@@ -493,7 +844,20 @@ func (c *Core) DeleteOrphanSubscribers() (int, error) {
 func (c *Core) DeleteBlocklistedSubscribers() (int, error) {
 	res, err := c.q.DeleteBlocklistedSubscribers.Exec()
 	if err != nil {
-		c.log.Printf("error deleting blocklisted subscribers: %v", err)
+		c.log.Error("error deleting blocklisted subscribers", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// DeleteArchivedSubscribers permanently deletes subscribers archived before the given date.
+func (c *Core) DeleteArchivedSubscribers(beforeDate time.Time) (int, error) {
+	res, err := c.q.DeleteArchivedSubscribers.Exec(beforeDate)
+	if err != nil {
+		c.log.Error("error deleting archived subscribers", "error", err)
 		return 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
@@ -502,6 +866,293 @@ func (c *Core) DeleteBlocklistedSubscribers() (int, error) {
 	return int(n), nil
 }
 
+// PurgeStaleSubscribers deletes subscribers whose double opt-in subscriptions have
+// remained unconfirmed for unconfirmedAge, or who unsubscribed unsubscribedAge ago,
+// and who have no other active subscriptions. A zero age disables the respective rule.
+// Subscribers are deleted in batches of batchSize with a pause of wait between them
+// to not hold locks on the tables for long. It returns the number of unconfirmed and
+// unsubscribed subscribers deleted.
+func (c *Core) PurgeStaleSubscribers(unconfirmedAge, unsubscribedAge time.Duration, batchSize int, wait time.Duration) (int, int, error) {
+	if unconfirmedAge <= 0 && unsubscribedAge <= 0 {
+		return 0, 0, nil
+	}
+
+	var unconfBefore, unsubBefore null.Time
+	if unconfirmedAge > 0 {
+		unconfBefore = null.TimeFrom(time.Now().Add(-unconfirmedAge))
+	}
+	if unsubscribedAge > 0 {
+		unsubBefore = null.TimeFrom(time.Now().Add(-unsubscribedAge))
+	}
+
+	var (
+		numUnconf, numUnsub int
+		lastID              = 0
+	)
+	for {
+		var res struct {
+			Unconfirmed  int `db:"unconfirmed"`
+			Unsubscribed int `db:"unsubscribed"`
+			LastID       int `db:"last_id"`
+		}
+		if err := c.q.DeleteStaleSubscribers.Get(&res, unconfBefore, unsubBefore, lastID, batchSize); err != nil {
+			c.log.Error("error purging stale subscribers", "error", err)
+			return numUnconf, numUnsub, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+		}
+
+		numUnconf += res.Unconfirmed
+		numUnsub += res.Unsubscribed
+
+		if res.Unconfirmed+res.Unsubscribed < batchSize {
+			break
+		}
+		lastID = res.LastID
+
+		time.Sleep(wait)
+	}
+
+	return numUnconf, numUnsub, nil
+}
+
+// RefreshEngagementScores recomputes the engagement scores of all subscribers
+// from their views and clicks, weighted by openWeight and clickWeight, with the
+// weights decaying by half every halfLife. It returns the number of subscribers
+// whose scores changed.
+func (c *Core) RefreshEngagementScores(openWeight, clickWeight float64, halfLife time.Duration, batchSize int) (int, error) {
+	// Events older than ten half-lives (< 0.1% of their weight) are ignored.
+	win := (halfLife * engagementHalfLives).Seconds()
+
+	// Score the subscribers who have events in batches.
+	var (
+		total = 0
+		subID = 0
+	)
+	for {
+		var events []engagementEvent
+		if err := c.q.GetEngagementEvents.Select(&events, subID, batchSize, win); err != nil {
+			c.log.Error("error fetching engagement events", "error", err)
+			return total, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+		}
+		if len(events) == 0 {
+			break
+		}
+		subID = events[len(events)-1].SubscriberID
+
+		ids, scores := engagementScores(events, openWeight, clickWeight, halfLife, time.Now())
+		res, err := c.q.UpdateEngagementScores.Exec(pq.Array(ids), pq.Array(scores))
+		if err != nil {
+			c.log.Error("error updating engagement scores", "error", err)
+			return total, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+		}
+		n, _ := res.RowsAffected()
+		total += int(n)
+	}
+
+	// The rest have no recent events and score 0.
+	res, err := c.q.ResetEngagementScores.Exec(win)
+	if err != nil {
+		c.log.Error("error resetting engagement scores", "error", err)
+		return total, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+	n, _ := res.RowsAffected()
+
+	return total + int(n), nil
+}
+
+// engagementEvent is a view or a click of a subscriber.
+type engagementEvent struct {
+	SubscriberID int       `db:"subscriber_id"`
+	Type         string    `db:"type"`
+	CreatedAt    time.Time `db:"created_at"`
+}
+
+// Number of half-lives after which engagement events are ignored.
+const engagementHalfLives = 10
+
+// engagementScores computes the engagement scores of the subscribers of the given
+// events, which are ordered by subscriber. Every view and click carries its weight
+// that halves every halfLife. The sum of the decayed weights of a subscriber's events
+// is mapped to 0-100 as 100 * (1 - e^-sum), rounded to two decimals. It returns the
+// subscriber IDs and their scores.
+func engagementScores(events []engagementEvent, openWeight, clickWeight float64, halfLife time.Duration, now time.Time) ([]int, []float32) {
+	var (
+		ids    []int
+		scores []float32
+		sum    float64
+	)
+	for i, e := range events {
+		w := openWeight
+		if e.Type == "click" {
+			w = clickWeight
+		}
+
+		age := now.Sub(e.CreatedAt)
+		if age < 0 {
+			age = 0
+		}
+		if age < halfLife*engagementHalfLives {
+			sum += w * math.Pow(0.5, age.Seconds()/halfLife.Seconds())
+		}
+
+		// The last event of the subscriber.
+		if i == len(events)-1 || events[i+1].SubscriberID != e.SubscriberID {
+			ids = append(ids, e.SubscriberID)
+			scores = append(scores, float32(math.Round(100*(1-math.Exp(-sum))*100)/100))
+			sum = 0
+		}
+	}
+
+	return ids, scores
+}
+
+// FindDuplicateSubscribers returns groups of subscribers that share the same value
+// at the given attribs JSON path (eg: customer.id). Each group is ordered by created_at.
+func (c *Core) FindDuplicateSubscribers(attribKey string) ([][]models.Subscriber, error) {
+	path := strings.Split(strings.TrimSpace(attribKey), ".")
+	for _, p := range path {
+		if p == "" {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidFields", "name", "attribute key"))
+		}
+	}
+
+	var res []struct {
+		models.Subscriber
+		DedupeKey string `db:"dedupe_key"`
+	}
+	if err := c.q.GetDuplicateSubscribers.Select(&res, pq.Array(path)); err != nil {
+		c.log.Error("error fetching duplicate subscribers", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	// The results are ordered by the key. Group consecutive rows with the same key.
+	out := [][]models.Subscriber{}
+	for i, r := range res {
+		if i == 0 || r.DedupeKey != res[i-1].DedupeKey {
+			out = append(out, []models.Subscriber{})
+		}
+		out[len(out)-1] = append(out[len(out)-1], r.Subscriber)
+	}
+
+	return out, nil
+}
+
+// MergeSubscribers merges the given duplicate subscribers into the primary subscriber.
+// List subscriptions are merged, attribs are unioned (with the primary's keys taking
+// precedence), the earliest created_at is retained, and campaign views and link clicks
+// are reassigned to the primary before the duplicates are deleted.
+func (c *Core) MergeSubscribers(primaryID int, duplicateIDs []int) (models.Subscriber, error) {
+	ids := make([]int, 0, len(duplicateIDs))
+	for _, id := range duplicateIDs {
+		if id != primaryID {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidID"))
+	}
+
+	// Ensure that the primary subscriber exists.
+	if _, err := c.GetSubscriber(primaryID, "", ""); err != nil {
+		return models.Subscriber{}, err
+	}
+
+	tx, err := c.db.Beginx()
+	if err != nil {
+		c.log.Error("error merging subscribers", "error", err)
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range []*sqlx.Stmt{c.q.MergeSubscriberLists, c.q.MergeSubscriberActivity, c.q.MergeSubscriberAttribs} {
+		if _, err := tx.Stmtx(stmt).Exec(primaryID, pq.Array(ids)); err != nil {
+			c.log.Error("error merging subscribers", "error", err)
+			return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+		}
+	}
+
+	if _, err := tx.Stmtx(c.q.DeleteSubscribers).Exec(pq.Array(ids), pq.Array([]string{})); err != nil {
+		c.log.Error("error deleting merged subscribers", "error", err)
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.log.Error("error merging subscribers", "error", err)
+		return models.Subscriber{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+
+	return c.GetSubscriber(primaryID, "", "")
+}
+
+// EraseSubscriber permanently deletes the subscriber with the given e-mail along with
+// their subscriptions and bounces, and detaches their campaign views, link clicks, and
+// transactional messages from them. A tombstone with the hash of the e-mail (see
+// HashEmail) is recorded. Everything is done in a single transaction.
+func (c *Core) EraseSubscriber(email string) (models.SubscriberErasure, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	tx, err := c.db.Beginx()
+	if err != nil {
+		c.log.Error("error erasing subscriber", "error", err)
+		return models.SubscriberErasure{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	var out models.SubscriberErasure
+	if err := tx.Stmtx(c.q.GetSubscriberForErasure).Get(&out.SubscriberID, email); err != nil {
+		if err == sql.ErrNoRows {
+			return out, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.subscriber}"))
+		}
+
+		c.log.Error("error erasing subscriber", "error", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+
+	if err := tx.Stmtx(c.q.AnonymizeSubscriberActivity).Get(&out, out.SubscriberID); err != nil {
+		c.log.Error("error anonymizing subscriber activity", "error", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+
+	if err := tx.Stmtx(c.q.EraseSubscriberData).Get(&out, out.SubscriberID, HashEmail(email)); err != nil {
+		c.log.Error("error erasing subscriber data", "error", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+
+	if _, err := tx.Stmtx(c.q.DeleteSubscribers).Exec(pq.Array([]int{out.SubscriberID}), pq.Array([]string{})); err != nil {
+		c.log.Error("error erasing subscriber", "error", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.log.Error("error erasing subscriber", "error", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscriber}", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// HashEmail returns the hex encoded SHA-256 hash of the lowercased e-mail
+// that erased subscribers' tombstones are recorded with.
+func HashEmail(email string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(h[:])
+}
+
 func (c *Core) getSubscriberCount(cond, subStatus string, listIDs []int) (int, error) {
 	// If there's no condition, it's a "get all" call which can probably be optionally pulled from cache.
 	if cond == "" {
@@ -521,7 +1172,7 @@ func (c *Core) getSubscriberCount(cond, subStatus string, listIDs []int) (int, e
 	stmt := fmt.Sprintf(c.q.QuerySubscribersCount, cond)
 	tx, err := c.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
 	if err != nil {
-		c.log.Printf("error preparing subscriber query: %v", err)
+		c.log.Error("error preparing subscriber query", "error", err)
 		return 0, echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("subscribers.errorPreparingQuery", "error", pqErrMsg(err)))
 	}
 	defer tx.Rollback()
@@ -535,3 +1186,57 @@ func (c *Core) getSubscriberCount(cond, subStatus string, listIDs []int) (int, e
 
 	return total, nil
 }
+
+// validateAttribs validates subscriber attributes against the attribute JSON schema,
+// if one is configured, and returns an error listing the failing attribute paths.
+func (c *Core) validateAttribs(attribs models.JSON) error {
+	if c.consts.AttribsSchema == nil {
+		return nil
+	}
+
+	if attribs == nil {
+		attribs = models.JSON{}
+	}
+
+	// Round trip the attributes through JSON so that the values are of
+	// the types that the validator expects.
+	b, err := json.Marshal(attribs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": "+err.Error())
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": "+err.Error())
+	}
+
+	if err := c.consts.AttribsSchema.Validate(v); err != nil {
+		vErr, ok := err.(*jsonschema.ValidationError)
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": "+err.Error())
+		}
+
+		// Collect the leaf errors which point to the actual failing paths.
+		var (
+			errs []string
+			walk func(*jsonschema.ValidationError)
+		)
+		walk = func(e *jsonschema.ValidationError) {
+			if len(e.Causes) == 0 {
+				path := e.InstanceLocation
+				if path == "" {
+					path = "/"
+				}
+				errs = append(errs, fmt.Sprintf("attribs%s: %s", path, e.Message))
+				return
+			}
+			for _, c := range e.Causes {
+				walk(c)
+			}
+		}
+		walk(vErr)
+
+		return echo.NewHTTPError(http.StatusBadRequest, c.i18n.Ts("globals.messages.invalidData")+": "+strings.Join(errs, "; "))
+	}
+
+	return nil
+}
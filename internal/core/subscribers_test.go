@@ -0,0 +1,160 @@
+package core
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// testExport returns an export iterator that generates num synthetic subscribers
+// in batches as ExportSubscribers does.
+func testExport(num, batchSize int) func() ([]models.SubscriberExport, error) {
+	var (
+		id  = 0
+		now = null.TimeFrom(time.Now())
+	)
+	return func() ([]models.SubscriberExport, error) {
+		n := num - id
+		if n > batchSize {
+			n = batchSize
+		}
+		if n <= 0 {
+			return nil, nil
+		}
+
+		out := make([]models.SubscriberExport, n)
+		for i := range out {
+			id++
+			out[i] = models.SubscriberExport{
+				Base:    models.Base{ID: id, CreatedAt: now, UpdatedAt: now},
+				UUID:    "9ad0a0b8-7b21-4c1c-9b6e-4b7e1e0f2d3a",
+				Email:   fmt.Sprintf("subscriber%d@listmonk.app", id),
+				Name:    "Subscriber",
+				Attribs: `{"city": "Bengaluru"}`,
+				Status:  models.SubscriberStatusEnabled,
+			}
+		}
+		return out, nil
+	}
+}
+
+func TestWriteSubscribersCSV(t *testing.T) {
+	var (
+		b       bytes.Buffer
+		flushes int
+	)
+	if err := WriteSubscribersCSV(&b, ExportFormatLite, testExport(25, 10), func() { flushes++ }); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 26 {
+		t.Fatalf("expected a header and 25 rows, got %d", len(rows))
+	}
+	if rows[0][1] != "email" || rows[25][1] != "subscriber25@listmonk.app" {
+		t.Errorf("unexpected rows: %v, %v", rows[0], rows[25])
+	}
+	if flushes != 3 {
+		t.Errorf("expected a flush after each of the 3 batches, got %d", flushes)
+	}
+
+	// Errors fetching a batch are returned.
+	errFetch := errors.New("error fetching")
+	err = WriteSubscribersCSV(io.Discard, ExportFormatLite, func() ([]models.SubscriberExport, error) {
+		return nil, errFetch
+	}, func() {})
+	if err != errFetch {
+		t.Errorf("expected the fetch error, got %v", err)
+	}
+}
+
+// BenchmarkWriteSubscribersCSV exports synthetic subscribers and reports the peak
+// heap in use, sampled after every batch, which stays flat regardless of the
+// number of rows as only one batch is held in memory.
+func BenchmarkWriteSubscribersCSV(b *testing.B) {
+	for _, num := range []int{100000, 1000000} {
+		b.Run(fmt.Sprintf("rows=%d", num), func(b *testing.B) {
+			var peak uint64
+			sample := func() {
+				var ms runtime.MemStats
+				runtime.ReadMemStats(&ms)
+				if ms.HeapInuse > peak {
+					peak = ms.HeapInuse
+				}
+			}
+
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				runtime.GC()
+				if err := WriteSubscribersCSV(io.Discard, ExportFormatLite, testExport(num, 1000), sample); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(peak)/(1<<20), "peak-heap-MB")
+		})
+	}
+}
+
+func TestEngagementScores(t *testing.T) {
+	var (
+		now = time.Now()
+		day = time.Hour * 24
+		hl  = day * 30
+	)
+	ev := func(subID int, typ string, age time.Duration) engagementEvent {
+		return engagementEvent{SubscriberID: subID, Type: typ, CreatedAt: now.Add(-age)}
+	}
+
+	ids, scores := engagementScores([]engagementEvent{
+		// A click today.
+		ev(1, "click", 0),
+		// Three views a year ago.
+		ev(2, "view", day*365), ev(2, "view", day*365), ev(2, "view", day*365),
+		// A view today and a view a half-life ago.
+		ev(3, "view", 0), ev(3, "view", hl),
+		// Lots of recent clicks.
+		ev(4, "click", 0), ev(4, "click", day), ev(4, "click", day*2), ev(4, "click", day*3), ev(4, "click", day*4),
+		// A click outside the window.
+		ev(5, "click", hl*engagementHalfLives+day),
+	}, 0.5, 1, hl, now)
+
+	if len(ids) != 5 || len(scores) != 5 {
+		t.Fatalf("expected 5 scores, got %v %v", ids, scores)
+	}
+	got := map[int]float32{}
+	for i, id := range ids {
+		got[id] = scores[i]
+	}
+
+	// 100 * (1 - e^-1)
+	if got[1] != 63.21 {
+		t.Errorf("expected a click today to score 63.21, got %v", got[1])
+	}
+	if got[1] <= got[2] {
+		t.Errorf("expected a recent click to beat old views, got %v <= %v", got[1], got[2])
+	}
+
+	// 0.5 + 0.25 after a half-life: 100 * (1 - e^-0.75)
+	if got[3] != 52.76 {
+		t.Errorf("expected a view's weight to halve after a half-life and score 52.76, got %v", got[3])
+	}
+
+	if got[4] <= got[1] || got[4] >= 100 {
+		t.Errorf("expected more clicks to score higher but below 100, got %v", got[4])
+	}
+
+	if got[5] != 0 {
+		t.Errorf("expected events outside the window to be ignored, got %v", got[5])
+	}
+}
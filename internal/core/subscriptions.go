@@ -14,7 +14,7 @@ func (c *Core) GetSubscriptions(subID int, subUUID string, allLists bool) ([]mod
 	var out []models.Subscription
 	err := c.q.GetSubscriptions.Select(&out, subID, subUUID, allLists)
 	if err != nil {
-		c.log.Printf("error getting subscriptions: %v", err)
+		c.log.Error("error getting subscriptions", "error", err)
 		return nil, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscribers}", "error", err.Error()))
 	}
@@ -25,7 +25,7 @@ func (c *Core) GetSubscriptions(subID int, subUUID string, allLists bool) ([]mod
 // AddSubscriptions adds list subscriptions to subscribers.
 func (c *Core) AddSubscriptions(subIDs, listIDs []int, status string) error {
 	if _, err := c.q.AddSubscribersToLists.Exec(pq.Array(subIDs), pq.Array(listIDs), status); err != nil {
-		c.log.Printf("error adding subscriptions: %v", err)
+		c.log.Error("error adding subscriptions", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", err.Error()))
 	}
@@ -42,7 +42,7 @@ func (c *Core) AddSubscriptionsByQuery(query string, sourceListIDs, targetListID
 
 	err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), c.q.AddSubscribersToListsByQuery, sourceListIDs, c.db, pq.Array(targetListIDs), status)
 	if err != nil {
-		c.log.Printf("error adding subscriptions by query: %v", err)
+		c.log.Error("error adding subscriptions by query", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
@@ -53,7 +53,7 @@ func (c *Core) AddSubscriptionsByQuery(query string, sourceListIDs, targetListID
 // DeleteSubscriptions delete list subscriptions from subscribers.
 func (c *Core) DeleteSubscriptions(subIDs, listIDs []int) error {
 	if _, err := c.q.DeleteSubscriptions.Exec(pq.Array(subIDs), pq.Array(listIDs)); err != nil {
-		c.log.Printf("error deleting subscriptions: %v", err)
+		c.log.Error("error deleting subscriptions", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", err.Error()))
 
@@ -71,7 +71,7 @@ func (c *Core) DeleteSubscriptionsByQuery(query string, sourceListIDs, targetLis
 
 	err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), c.q.DeleteSubscriptionsByQuery, sourceListIDs, c.db, pq.Array(targetListIDs))
 	if err != nil {
-		c.log.Printf("error deleting subscriptions by query: %v", err)
+		c.log.Error("error deleting subscriptions by query", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
@@ -82,14 +82,53 @@ func (c *Core) DeleteSubscriptionsByQuery(query string, sourceListIDs, targetLis
 // UnsubscribeLists sets list subscriptions to 'unsubscribed'.
 func (c *Core) UnsubscribeLists(subIDs, listIDs []int, listUUIDs []string) error {
 	if _, err := c.q.UnsubscribeSubscribersFromLists.Exec(pq.Array(subIDs), pq.Array(listIDs), pq.StringArray(listUUIDs)); err != nil {
-		c.log.Printf("error unsubscribing from lists: %v", err)
+		c.log.Error("error unsubscribing from lists", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", err.Error()))
 	}
 
+	c.Emit(models.EventSubscriberUnsubscribed, map[string]interface{}{
+		"subscriber_ids": subIDs,
+		"list_ids":       listIDs,
+		"list_uuids":     listUUIDs,
+	})
+
 	return nil
 }
 
+// UpdateSubscriptionPrefs applies the list subscription changes that a subscriber has
+// made on the public preference center. New subscriptions to addIDs are unconfirmed and
+// an opt-in confirmation is sent for the double opt-in lists among them, and subscriptions
+// to unsubIDs are unsubscribed. It returns true if an opt-in confirmation was sent.
+func (c *Core) UpdateSubscriptionPrefs(sub models.Subscriber, addIDs, unsubIDs []int) (bool, error) {
+	if len(addIDs) > 0 && sub.Status == models.SubscriberStatusBlockListed {
+		return false, echo.NewHTTPError(http.StatusBadRequest, c.i18n.T("public.blocklisted"))
+	}
+
+	if len(unsubIDs) > 0 {
+		if err := c.UnsubscribeLists([]int{sub.ID}, unsubIDs, nil); err != nil {
+			return false, err
+		}
+	}
+
+	if len(addIDs) == 0 {
+		return false, nil
+	}
+
+	if err := c.AddSubscriptions([]int{sub.ID}, addIDs, models.SubscriptionStatusUnconfirmed); err != nil {
+		return false, err
+	}
+
+	hasOptin := false
+	if c.consts.SendOptinConfirmation {
+		// Send a confirmation e-mail (if there are any double opt-in lists).
+		num, _ := c.h.SendOptinConfirmation(sub, addIDs)
+		hasOptin = num > 0
+	}
+
+	return hasOptin, nil
+}
+
 // UnsubscribeListsByQuery sets list subscriptions to 'unsubscribed' by a given arbitrary query expression.
 // sourceListIDs is the list of list IDs to filter the subscriber query with.
 func (c *Core) UnsubscribeListsByQuery(query string, sourceListIDs, targetListIDs []int) error {
@@ -99,7 +138,7 @@ func (c *Core) UnsubscribeListsByQuery(query string, sourceListIDs, targetListID
 
 	err := c.q.ExecSubQueryTpl(sanitizeSQLExp(query), c.q.UnsubscribeSubscribersFromListsByQuery, sourceListIDs, c.db, pq.Array(targetListIDs))
 	if err != nil {
-		c.log.Printf("error unsubscribing from lists by query: %v", err)
+		c.log.Error("error unsubscribing from lists by query", "error", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
@@ -112,7 +151,7 @@ func (c *Core) UnsubscribeListsByQuery(query string, sourceListIDs, targetListID
 func (c *Core) DeleteUnconfirmedSubscriptions(beforeDate time.Time) (int, error) {
 	res, err := c.q.DeleteUnconfirmedSubscriptions.Exec(beforeDate)
 	if err != nil {
-		c.log.Printf("error deleting unconfirmed subscribers: %v", err)
+		c.log.Error("error deleting unconfirmed subscribers", "error", err)
 		return 0, echo.NewHTTPError(http.StatusInternalServerError,
 			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscribers}", "error", pqErrMsg(err)))
 	}
@@ -120,3 +159,148 @@ func (c *Core) DeleteUnconfirmedSubscriptions(beforeDate time.Time) (int, error)
 	n, _ := res.RowsAffected()
 	return int(n), nil
 }
+
+// SendOptinReminders re-sends opt-in confirmation e-mails to subscribers with unconfirmed
+// double opt-in subscriptions that haven't been updated (subscribed or last reminded) since
+// beforeDate and have received fewer than maxReminders reminders. It returns the number of
+// subscribers who were sent reminders.
+func (c *Core) SendOptinReminders(beforeDate time.Time, maxReminders, batchSize int) (int, error) {
+	var (
+		lastID = 0
+		num    = 0
+	)
+	for {
+		var res []struct {
+			SubscriberID int           `db:"subscriber_id"`
+			ListIDs      pq.Int64Array `db:"list_ids"`
+		}
+		if err := c.q.GetOptinReminderSubscriptions.Select(&res, beforeDate, maxReminders, lastID, batchSize); err != nil {
+			c.log.Error("error fetching opt-in reminder subscriptions", "error", err)
+			return num, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscriptions}", "error", pqErrMsg(err)))
+		}
+
+		for _, r := range res {
+			lastID = r.SubscriberID
+
+			sub, err := c.GetSubscriber(r.SubscriberID, "", "")
+			if err != nil {
+				continue
+			}
+
+			listIDs := make([]int, 0, len(r.ListIDs))
+			for _, id := range r.ListIDs {
+				listIDs = append(listIDs, int(id))
+			}
+
+			// The hook logs errors. Move on to the next subscriber.
+			if n, err := c.h.SendOptinConfirmation(sub, listIDs); err != nil || n == 0 {
+				continue
+			}
+
+			if _, err := c.q.UpdateOptinReminders.Exec(sub.ID, pq.Array(listIDs)); err != nil {
+				c.log.Error("error updating opt-in reminders for subscriber", "error", err, "subscriber_id", sub.ID)
+				continue
+			}
+			num++
+		}
+
+		if len(res) < batchSize {
+			break
+		}
+	}
+
+	return num, nil
+}
+
+// DeleteExpiredOptinSubscriptions deletes unconfirmed double opt-in subscriptions that have
+// received maxReminders reminders and remain unconfirmed since the last one (beforeDate).
+func (c *Core) DeleteExpiredOptinSubscriptions(beforeDate time.Time, maxReminders int) (int, error) {
+	res, err := c.q.DeleteExpiredOptinSubscriptions.Exec(beforeDate, maxReminders)
+	if err != nil {
+		c.log.Error("error deleting expired opt-in subscriptions", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "{globals.terms.subscriptions}", "error", pqErrMsg(err)))
+	}
+
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// StartListReconfirmation marks the confirmed subscriptions of a double opt-in list as
+// pending re-confirmation. Subscriptions that aren't confirmed again (via the opt-in link
+// sent by SendListReconfirmations) by the deadline are unsubscribed by ExpireReconfirmations.
+// It returns the number of subscriptions marked.
+func (c *Core) StartListReconfirmation(listID int, deadline time.Time) (int, error) {
+	list, err := c.GetList(listID, "")
+	if err != nil {
+		return 0, err
+	}
+
+	if list.Optin != models.ListOptinDouble {
+		return 0, echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.invalidData")+": re-confirmation requires a double opt-in list")
+	}
+
+	res, err := c.q.StartListReconfirmation.Exec(listID, deadline)
+	if err != nil {
+		c.log.Error("error starting list re-confirmation", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscriptions}", "error", pqErrMsg(err)))
+	}
+
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// SendListReconfirmations sends opt-in confirmation e-mails to the subscribers of a list
+// whose subscriptions are pending re-confirmation. It returns the number of e-mails sent.
+func (c *Core) SendListReconfirmations(listID, batchSize int) (int, error) {
+	var (
+		lastID = 0
+		num    = 0
+	)
+	for {
+		var ids []int
+		if err := c.q.GetListReconfirmationSubscribers.Select(&ids, listID, lastID, batchSize); err != nil {
+			c.log.Error("error fetching re-confirmation subscribers", "error", err)
+			return num, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorFetching", "name", "{globals.terms.subscriptions}", "error", pqErrMsg(err)))
+		}
+
+		for _, id := range ids {
+			lastID = id
+
+			sub, err := c.GetSubscriber(id, "", "")
+			if err != nil {
+				continue
+			}
+
+			// The hook logs errors. Move on to the next subscriber.
+			if n, err := c.h.SendOptinConfirmation(sub, []int{listID}); err != nil || n == 0 {
+				continue
+			}
+			num++
+		}
+
+		if len(ids) < batchSize {
+			break
+		}
+	}
+
+	return num, nil
+}
+
+// ExpireReconfirmations unsubscribes subscriptions pending re-confirmation whose
+// deadline has passed. It returns the number of subscriptions unsubscribed.
+func (c *Core) ExpireReconfirmations() (int, error) {
+	res, err := c.q.ExpireReconfirmations.Exec()
+	if err != nil {
+		c.log.Error("error expiring re-confirmations", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "{globals.terms.subscriptions}", "error", pqErrMsg(err)))
+	}
+
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	"github.com/lib/pq"
+)
+
+// Max number of e-mails inserted into the suppression list per query.
+const suppressionBatchSize = 10000
+
+// ImportSuppressions adds e-mails to the global suppression list. Existing subscribers
+// with the e-mails are blocklisted and unsubscribed from all lists, and subscribers
+// that are inserted with them in the future are blocklisted. It returns the number
+// of e-mails that were added and the number of invalid e-mails that were skipped.
+func (c *Core) ImportSuppressions(emails []string) (int, int, error) {
+	var (
+		valid   = make([]string, 0, len(emails))
+		invalid = 0
+	)
+	for _, e := range emails {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+
+		if a, err := mail.ParseAddress(e); err != nil || a.Address != e {
+			invalid++
+			continue
+		}
+		valid = append(valid, e)
+	}
+
+	added := 0
+	for i := 0; i < len(valid); i += suppressionBatchSize {
+		end := i + suppressionBatchSize
+		if end > len(valid) {
+			end = len(valid)
+		}
+
+		var n int
+		if err := c.q.InsertSuppressions.Get(&n, pq.Array(valid[i:end])); err != nil {
+			c.log.Error("error importing suppressions", "error", err)
+			return added, invalid, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorCreating", "name", "suppressions", "error", pqErrMsg(err)))
+		}
+		added += n
+	}
+
+	return added, invalid, nil
+}
+
+// ExportSuppressions returns an iterator that returns the global suppression list,
+// the suppressed e-mails and the e-mails of blocklisted subscribers, in batches
+// ordered by e-mail. An empty batch indicates the end of the list.
+func (c *Core) ExportSuppressions(batchSize int) func() ([]models.Suppression, error) {
+	last := ""
+	return func() ([]models.Suppression, error) {
+		var out []models.Suppression
+		if err := c.q.GetSuppressions.Select(&out, last, batchSize); err != nil {
+			c.log.Error("error exporting suppressions", "error", err)
+			return nil, echo.NewHTTPError(http.StatusInternalServerError,
+				c.i18n.Ts("globals.messages.errorFetching", "name", "suppressions", "error", pqErrMsg(err)))
+		}
+		if len(out) > 0 {
+			last = out[len(out)-1].Email
+		}
+
+		return out, nil
+	}
+}
+
+// GetSuppressionStats returns the size of the global suppression list and the
+// number of subscriber insertions it has blocklisted.
+func (c *Core) GetSuppressionStats() (models.SuppressionStats, error) {
+	var out models.SuppressionStats
+	if err := c.q.GetSuppressionStats.Get(&out); err != nil {
+		c.log.Error("error fetching suppression stats", "error", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "suppressions", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
@@ -2,7 +2,9 @@ package core
 
 import (
 	"database/sql"
+	"fmt"
 	"net/http"
+	"regexp"
 
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo/v4"
@@ -85,3 +87,67 @@ func (c *Core) DeleteTemplate(id int) error {
 
 	return nil
 }
+
+// tplVars are the documented fields and functions available in campaign templates.
+var tplVars = []models.TemplateVar{
+	{Name: "Subscriber.UUID", Expr: "{{ .Subscriber.UUID }}", Group: "subscriber", Type: "string", Description: "The randomly generated unique ID of the subscriber"},
+	{Name: "Subscriber.Email", Expr: "{{ .Subscriber.Email }}", Group: "subscriber", Type: "string", Description: "E-mail ID of the subscriber"},
+	{Name: "Subscriber.Name", Expr: "{{ .Subscriber.Name }}", Group: "subscriber", Type: "string", Description: "Name of the subscriber"},
+	{Name: "Subscriber.FirstName", Expr: "{{ .Subscriber.FirstName }}", Group: "subscriber", Type: "string", Description: "First name of the subscriber (automatically extracted from the name)"},
+	{Name: "Subscriber.LastName", Expr: "{{ .Subscriber.LastName }}", Group: "subscriber", Type: "string", Description: "Last name of the subscriber (automatically extracted from the name)"},
+	{Name: "Subscriber.Status", Expr: "{{ .Subscriber.Status }}", Group: "subscriber", Type: "string", Description: "Status of the subscriber (enabled, disabled, blocklisted)"},
+	{Name: "Subscriber.Attribs", Expr: "{{ .Subscriber.Attribs }}", Group: "subscriber", Type: "object", Description: "Map of arbitrary attributes. Fields can be accessed with `.`, eg: `.Subscriber.Attribs.city`"},
+	{Name: "Subscriber.CreatedAt", Expr: "{{ .Subscriber.CreatedAt }}", Group: "subscriber", Type: "timestamp", Description: "Timestamp when the subscriber was first added"},
+	{Name: "Subscriber.UpdatedAt", Expr: "{{ .Subscriber.UpdatedAt }}", Group: "subscriber", Type: "timestamp", Description: "Timestamp when the subscriber was modified"},
+
+	{Name: "Campaign.UUID", Expr: "{{ .Campaign.UUID }}", Group: "campaign", Type: "string", Description: "The randomly generated unique ID of the campaign"},
+	{Name: "Campaign.Name", Expr: "{{ .Campaign.Name }}", Group: "campaign", Type: "string", Description: "Internal name of the campaign"},
+	{Name: "Campaign.Subject", Expr: "{{ .Campaign.Subject }}", Group: "campaign", Type: "string", Description: "E-mail subject of the campaign"},
+	{Name: "Campaign.FromEmail", Expr: "{{ .Campaign.FromEmail }}", Group: "campaign", Type: "string", Description: "The e-mail address from which the campaign is being sent"},
+
+	{Name: "UnsubscribeURL", Expr: "{{ UnsubscribeURL }}", Group: "func", Type: "string", Description: "Unsubscription URL. Ideal for use in the template footer"},
+	{Name: "ManageURL", Expr: "{{ ManageURL }}", Group: "func", Type: "string", Description: "URL to the subscriber's subscription preferences page"},
+	{Name: "MessageURL", Expr: "{{ MessageURL }}", Group: "func", Type: "string", Description: "URL to view the hosted version of an e-mail message"},
+	{Name: "OptinURL", Expr: "{{ OptinURL }}", Group: "func", Type: "string", Description: "URL to the double-optin confirmation page"},
+	{Name: "ArchiveURL", Expr: "{{ ArchiveURL }}", Group: "func", Type: "string", Description: "URL to the public campaign archive"},
+	{Name: "RootURL", Expr: "{{ RootURL }}", Group: "func", Type: "string", Description: "Root URL of the listmonk installation"},
+	{Name: "TrackLink", Expr: `{{ TrackLink "https://link.com" }}`, Group: "func", Type: "string", Description: "Takes a URL and generates a tracking URL over it"},
+	{Name: "TrackView", Expr: "{{ TrackView }}", Group: "func", Type: "html", Description: "Inserts a single tracking pixel. Should only be used once, ideally in the template footer"},
+	{Name: "Date", Expr: `{{ Date "2006-01-02" }}`, Group: "func", Type: "string", Description: "Prints the current datetime for the given format expressed as a Go date layout"},
+	{Name: "MediaURL", Expr: `{{ MediaURL "filename.jpg" }}`, Group: "func", Type: "string", Description: "URL of a file in the media library"},
+	{Name: "Safe", Expr: `{{ Safe "<!-- comment -->" }}`, Group: "func", Type: "html", Description: "Add any HTML code as it is"},
+}
+
+// Attribute names that can be accessed with a ., eg: .Subscriber.Attribs.city.
+// Others have to be accessed with index.
+var reTplIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// GetTemplateVariables returns the variables and functions that are available in
+// campaign templates along with the subscriber attributes from the attribute
+// field definitions.
+func (c *Core) GetTemplateVariables() ([]models.TemplateVar, error) {
+	fields, err := c.GetAttribFields()
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]models.TemplateVar, 0, len(tplVars)+len(fields))
+	out = append(out, tplVars...)
+
+	for _, f := range fields {
+		expr := "{{ .Subscriber.Attribs." + f.Name + " }}"
+		if !reTplIdent.MatchString(f.Name) {
+			expr = fmt.Sprintf("{{ index .Subscriber.Attribs %q }}", f.Name)
+		}
+
+		out = append(out, models.TemplateVar{
+			Name:        "Subscriber.Attribs." + f.Name,
+			Expr:        expr,
+			Group:       "attrib",
+			Type:        f.Type,
+			Description: f.Label,
+		})
+	}
+
+	return out, nil
+}
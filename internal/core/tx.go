@@ -0,0 +1,130 @@
+package core
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// InsertTxMessage records a queued transactional message for tracking its delivery status.
+// The rendered message is stored to be retried from retryAt if it isn't sent by then.
+func (c *Core) InsertTxMessage(msg models.Message, tplID int, retryAt time.Time) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		c.log.Error("error encoding tx message", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "tx message", "error", err.Error()))
+	}
+
+	if _, err := c.q.InsertTxMessage.Exec(msg.TxUUID, msg.Subscriber.ID, tplID, msg.Subject, b, retryAt.Unix()); err != nil {
+		c.log.Error("error inserting tx message", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "tx message", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// UpdateTxMessage updates the delivery status of a queued transactional message. A queued
+// message is retried from retryAt.
+func (c *Core) UpdateTxMessage(uuid, status string, attempts int, errMsg string, retryAt time.Time) error {
+	if _, err := c.q.UpdateTxMessage.Exec(uuid, status, attempts, errMsg, null.NewTime(retryAt, !retryAt.IsZero())); err != nil {
+		c.log.Error("error updating tx message", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "tx message", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// GetTxStatus returns the delivery status of a queued transactional message.
+func (c *Core) GetTxStatus(messageID string) (models.TxMessageStatus, error) {
+	var out models.TxMessageStatus
+	if err := c.q.GetTxMessage.Get(&out, messageID); err != nil {
+		if err == sql.ErrNoRows {
+			return out, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.notFound", "name", "tx message"))
+		}
+
+		c.log.Error("error fetching tx message", "error", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "tx message", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// ClaimTxIdempotencyKey claims an idempotency key for processing a request. Keys
+// created before expiredBefore, and keys still being processed that were created
+// before staleBefore, are reclaimed. It returns false if the key is held.
+func (c *Core) ClaimTxIdempotencyKey(scope, key, reqHash string, expiredBefore, staleBefore time.Time) (bool, error) {
+	var ok bool
+	if err := c.q.ClaimTxIdempotencyKey.Get(&ok, scope, key, reqHash, expiredBefore, staleBefore); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+
+		c.log.Error("error claiming tx idempotency key", "error", err)
+		return false, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "idempotency key", "error", pqErrMsg(err)))
+	}
+
+	return ok, nil
+}
+
+// GetTxIdempotencyKey returns an idempotency key with its stored response.
+func (c *Core) GetTxIdempotencyKey(scope, key string) (models.TxIdempotencyKey, error) {
+	var out models.TxIdempotencyKey
+	if err := c.q.GetTxIdempotencyKey.Get(&out, scope, key); err != nil {
+		if err == sql.ErrNoRows {
+			return out, echo.NewHTTPError(http.StatusBadRequest,
+				c.i18n.Ts("globals.messages.notFound", "name", "idempotency key"))
+		}
+
+		c.log.Error("error fetching tx idempotency key", "error", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "idempotency key", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// UpdateTxIdempotencyKey stores the response of the request that claimed an idempotency key.
+func (c *Core) UpdateTxIdempotencyKey(scope, key string, status int, resp []byte) error {
+	if _, err := c.q.UpdateTxIdempotencyKey.Exec(scope, key, status, resp); err != nil {
+		c.log.Error("error updating tx idempotency key", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorUpdating", "name", "idempotency key", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// DeleteTxIdempotencyKey deletes an idempotency key, releasing it for a retry.
+func (c *Core) DeleteTxIdempotencyKey(scope, key string) error {
+	if _, err := c.q.DeleteTxIdempotencyKey.Exec(scope, key); err != nil {
+		c.log.Error("error deleting tx idempotency key", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "idempotency key", "error", pqErrMsg(err)))
+	}
+
+	return nil
+}
+
+// DeleteExpiredTxIdempotencyKeys deletes idempotency keys created before the given date.
+func (c *Core) DeleteExpiredTxIdempotencyKeys(beforeDate time.Time) (int, error) {
+	res, err := c.q.DeleteExpiredTxIdempotencyKeys.Exec(beforeDate)
+	if err != nil {
+		c.log.Error("error deleting expired tx idempotency keys", "error", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "idempotency keys", "error", pqErrMsg(err)))
+	}
+
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
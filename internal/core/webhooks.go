@@ -0,0 +1,90 @@
+package core
+
+import (
+	"net/http"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// GetWebhooks returns all the outbound webhooks.
+func (c *Core) GetWebhooks() ([]models.Webhook, error) {
+	out := []models.Webhook{}
+	if err := c.q.GetWebhooks.Select(&out, 0); err != nil {
+		c.log.Error("error fetching webhooks", "error", err)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "webhooks", "error", pqErrMsg(err)))
+	}
+
+	return out, nil
+}
+
+// RegisterWebhook registers a new outbound webhook.
+func (c *Core) RegisterWebhook(w models.Webhook) (models.Webhook, error) {
+	var newID int
+	if err := c.q.InsertWebhook.Get(&newID, w.Name, w.URL, w.Secret, w.Events, w.Enabled); err != nil {
+		c.log.Error("error inserting webhook", "error", err)
+		return models.Webhook{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorCreating", "name", "webhook", "error", pqErrMsg(err)))
+	}
+
+	var out []models.Webhook
+	if err := c.q.GetWebhooks.Select(&out, newID); err != nil || len(out) == 0 {
+		c.log.Error("error fetching webhook", "error", err)
+		return models.Webhook{}, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "webhook", "error", "not found"))
+	}
+
+	return out[0], nil
+}
+
+// DeleteWebhook deletes an outbound webhook.
+func (c *Core) DeleteWebhook(id int) error {
+	res, err := c.q.DeleteWebhook.Exec(id)
+	if err != nil {
+		c.log.Error("error deleting webhook", "error", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorDeleting", "name", "webhook", "error", pqErrMsg(err)))
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			c.i18n.Ts("globals.messages.notFound", "name", "webhook"))
+	}
+
+	return nil
+}
+
+// RecordWebhookFailure records a webhook delivery that failed permanently in the dead-letter log.
+func (c *Core) RecordWebhookFailure(f models.WebhookFailure) error {
+	if _, err := c.q.InsertWebhookFailure.Exec(f.WebhookID, f.Event, f.Payload, f.Error, f.Attempts); err != nil {
+		c.log.Error("error recording webhook failure", "error", err)
+		return err
+	}
+
+	return nil
+}
+
+// QueryWebhookFailures returns the failed webhook deliveries, optionally of a webhook (webhookID > 0).
+func (c *Core) QueryWebhookFailures(webhookID, offset, limit int) ([]models.WebhookFailure, int, error) {
+	out := []models.WebhookFailure{}
+	if err := c.q.QueryWebhookFailures.Select(&out, webhookID, offset, limit); err != nil {
+		c.log.Error("error fetching webhook failures", "error", err)
+		return nil, 0, echo.NewHTTPError(http.StatusInternalServerError,
+			c.i18n.Ts("globals.messages.errorFetching", "name", "webhooks", "error", pqErrMsg(err)))
+	}
+
+	total := 0
+	if len(out) > 0 {
+		total = out[0].Total
+	}
+
+	return out, total, nil
+}
+
+// Emit emits an event to the outbound webhooks.
+func (c *Core) Emit(event string, data interface{}) {
+	if c.h.EmitEvent != nil {
+		c.h.EmitEvent(event, data)
+	}
+}
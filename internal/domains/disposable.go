@@ -0,0 +1,25 @@
+package domains
+
+// disposable is the built-in list of common disposable (temporary) e-mail domains,
+// including their subdomains.
+var disposable = toRules([]string{
+	"10minutemail.com", "10minutemail.net", "20minutemail.com", "33mail.com", "burnermail.io",
+	"discard.email", "dispostable.com", "dropmail.me", "emailfake.com", "emailondeck.com",
+	"fakeinbox.com", "getairmail.com", "getnada.com", "grr.la", "guerrillamail.biz",
+	"guerrillamail.com", "guerrillamail.de", "guerrillamail.info", "guerrillamail.net",
+	"guerrillamail.org", "guerrillamailblock.com", "inboxkitten.com", "incognitomail.org",
+	"mail.tm", "mailcatch.com", "maildrop.cc", "mailinator.com", "mailinator.net",
+	"mailnesia.com", "mailpoof.com", "mintemail.com", "moakt.com", "mohmal.com",
+	"mytemp.email", "pokemail.net", "sharklasers.com", "spam4.me", "spambox.us",
+	"spamgourmet.com", "temp-mail.io", "temp-mail.org", "tempail.com", "tempinbox.com",
+	"tempmail.net", "tempmailo.com", "tempr.email", "throwawaymail.com", "trashmail.com",
+	"trashmail.de", "trashmail.net", "trbvm.com", "yopmail.com", "yopmail.fr", "yopmail.net",
+})
+
+func toRules(domains []string) map[string]bool {
+	out := make(map[string]bool, len(domains))
+	for _, d := range domains {
+		out["*."+d] = true
+	}
+	return out
+}
@@ -0,0 +1,132 @@
+// Package domains matches e-mail domains against block and allow rules.
+// A rule is either an exact domain (example.com) or a wildcard (*.example.com)
+// that matches the domain and all of its subdomains.
+package domains
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/knadh/listmonk/models"
+)
+
+var (
+	// ErrBlocked is returned for domains that match a block rule or the built-in
+	// disposable domains list.
+	ErrBlocked = errors.New("domain is blocklisted")
+
+	// ErrNotAllowed is returned for domains that don't match any allow rule
+	// when there are allow rules.
+	ErrNotAllowed = errors.New("domain is not allowlisted")
+)
+
+// Rules is a set of domain rules that's safe for concurrent use and that can be
+// replaced on the fly with Load().
+type Rules struct {
+	mu    sync.RWMutex
+	rules models.DomainRules
+	block map[string]bool
+	allow map[string]bool
+}
+
+// New returns a new set of domain rules.
+func New(r models.DomainRules) *Rules {
+	d := &Rules{}
+	d.Load(r)
+	return d
+}
+
+// Load replaces the rules.
+func (d *Rules) Load(r models.DomainRules) {
+	r.Blocklist = Clean(r.Blocklist)
+	r.Allowlist = Clean(r.Allowlist)
+
+	block := make(map[string]bool, len(r.Blocklist))
+	for _, s := range r.Blocklist {
+		block[s] = true
+	}
+	allow := make(map[string]bool, len(r.Allowlist))
+	for _, s := range r.Allowlist {
+		allow[s] = true
+	}
+
+	d.mu.Lock()
+	d.rules = r
+	d.block = block
+	d.allow = allow
+	d.mu.Unlock()
+}
+
+// Get returns the rules.
+func (d *Rules) Get() models.DomainRules {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.rules
+}
+
+// Check returns ErrBlocked if the domain of the e-mail is blocked and ErrNotAllowed
+// if there are allow rules that it doesn't match. Block rules take precedence.
+// A nil Rules allows everything.
+func (d *Rules) Check(email string) error {
+	if d == nil {
+		return nil
+	}
+
+	domain := strings.ToLower(email)
+	if i := strings.LastIndexByte(domain, '@'); i >= 0 {
+		domain = domain[i+1:]
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if match(d.block, domain) || (d.rules.BlockDisposable && match(disposable, domain)) {
+		return ErrBlocked
+	}
+	if len(d.allow) > 0 && !match(d.allow, domain) {
+		return ErrNotAllowed
+	}
+
+	return nil
+}
+
+// match returns true if the domain matches an exact rule or if the domain or
+// one of its parent domains matches a wildcard rule.
+func match(rules map[string]bool, domain string) bool {
+	if rules[domain] {
+		return true
+	}
+
+	for d := domain; d != ""; {
+		if rules["*."+d] {
+			return true
+		}
+
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+		d = d[i+1:]
+	}
+
+	return false
+}
+
+// Clean lowercases and trims a list of rules and drops empty and duplicate ones.
+func Clean(rules []string) []string {
+	var (
+		out  = make([]string, 0, len(rules))
+		seen = make(map[string]bool, len(rules))
+	)
+	for _, r := range rules {
+		r = strings.ToLower(strings.TrimSpace(r))
+		if r == "" || seen[r] {
+			continue
+		}
+		seen[r] = true
+		out = append(out, r)
+	}
+
+	return out
+}
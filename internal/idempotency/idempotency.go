@@ -0,0 +1,191 @@
+// Package idempotency makes HTTP requests with an Idempotency-Key idempotent by
+// storing the response of the first request with a key and replaying it on
+// repeats of the request.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// Context key that's set when a request has had side effects, eg: messages
+// have been sent, which can't be undone.
+const ctxCommitted = "idempotency_committed"
+
+var (
+	// ErrKeyReused is returned when a key is reused for a different request.
+	ErrKeyReused = errors.New("idempotency key reused for a different request")
+
+	// ErrInProgress is returned when the request for a key is still being processed.
+	ErrInProgress = errors.New("request with the idempotency key is in progress")
+)
+
+// Store stores idempotency keys and the responses of their requests.
+type Store interface {
+	ClaimTxIdempotencyKey(scope, key, reqHash string, expiredBefore, staleBefore time.Time) (bool, error)
+	GetTxIdempotencyKey(scope, key string) (models.TxIdempotencyKey, error)
+	UpdateTxIdempotencyKey(scope, key string, status int, resp []byte) error
+	DeleteTxIdempotencyKey(scope, key string) error
+}
+
+// Opt represents the options of Keys.
+type Opt struct {
+	// Duration for which the response of a key is stored.
+	TTL time.Duration
+
+	// Duration after which a key whose request is still being processed,
+	// eg: on a crash, is considered abandoned and can be claimed again.
+	StaleAfter time.Duration
+}
+
+// Keys processes requests with idempotency keys.
+type Keys struct {
+	opt   Opt
+	store Store
+	locks keyMutex
+}
+
+// New returns a new instance of Keys.
+func New(o Opt, s Store) *Keys {
+	return &Keys{
+		opt:   o,
+		store: s,
+		locks: keyMutex{locks: make(map[string]*keyLock)},
+	}
+}
+
+// Commit marks a request as having had side effects, after which a server error
+// in the rest of the request doesn't release its key for a retry.
+func Commit(c echo.Context) {
+	c.Set(ctxCommitted, true)
+}
+
+// Handle processes a request with an idempotency key scoped to eg: a user. The
+// response of the first request with a key is stored and returned on repeats
+// without next being called again. Concurrent requests with the same key are
+// serialized.
+//
+// Server errors (5xx) are not stored so that the request can be retried, unless
+// the request has committed side effects (see Commit), eg: a failure after some
+// messages in a request were sent, in which case, the error is stored and replayed
+// so that the messages that were sent aren't sent again.
+func (k *Keys) Handle(c echo.Context, scope, key string, next echo.HandlerFunc) error {
+	// Hash the request to detect the reuse of a key for a different request.
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+	h := sha256.New()
+	h.Write([]byte(c.Path() + "?" + c.QueryString() + "\n"))
+	h.Write(body)
+	reqHash := hex.EncodeToString(h.Sum(nil))
+
+	// Serialize the requests with the same key on this instance. Requests on
+	// other instances are serialized by the key claim in the store.
+	unlock := k.locks.lock(scope + "\x00" + key)
+	defer unlock()
+
+	now := time.Now()
+	ok, err := k.store.ClaimTxIdempotencyKey(scope, key, reqHash, now.Add(-k.opt.TTL), now.Add(-k.opt.StaleAfter))
+	if err != nil {
+		return err
+	}
+
+	// The key has been used already. Replay the stored response.
+	if !ok {
+		r, err := k.store.GetTxIdempotencyKey(scope, key)
+		if err != nil {
+			return err
+		}
+
+		if r.RequestHash != reqHash {
+			return ErrKeyReused
+		}
+
+		// The request is still being processed, possibly by another instance.
+		if r.Status == 0 {
+			return ErrInProgress
+		}
+
+		c.Response().Header().Set("Idempotent-Replayed", "true")
+		return c.Blob(r.Status, echo.MIMEApplicationJSONCharsetUTF8, r.Response)
+	}
+
+	// Process the request, recording its response, including errors which
+	// are written by the error handler.
+	var (
+		resp = c.Response()
+		rec  = &respRecorder{ResponseWriter: resp.Writer}
+	)
+	resp.Writer = rec
+	if err := next(c); err != nil {
+		c.Error(err)
+	}
+	resp.Writer = rec.ResponseWriter
+
+	if committed, _ := c.Get(ctxCommitted).(bool); resp.Status >= http.StatusInternalServerError && !committed {
+		k.store.DeleteTxIdempotencyKey(scope, key)
+		return nil
+	}
+	k.store.UpdateTxIdempotencyKey(scope, key, resp.Status, rec.buf.Bytes())
+
+	return nil
+}
+
+// respRecorder is an http.ResponseWriter that records the body written to it.
+type respRecorder struct {
+	http.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (r *respRecorder) Write(b []byte) (int, error) {
+	r.buf.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// keyMutex is a set of mutexes by key that are created and released on demand.
+type keyMutex struct {
+	locks map[string]*keyLock
+	mut   sync.Mutex
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the mutex of the given key and returns the function that unlocks it.
+func (k *keyMutex) lock(key string) func() {
+	k.mut.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mut.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		k.mut.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.mut.Unlock()
+	}
+}
@@ -0,0 +1,212 @@
+package idempotency
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo/v4"
+)
+
+// testStore is an in-memory Store that claims keys as the DB does.
+type testStore struct {
+	keys map[string]*models.TxIdempotencyKey
+	mut  sync.Mutex
+}
+
+func (s *testStore) ClaimTxIdempotencyKey(scope, key, reqHash string, expiredBefore, staleBefore time.Time) (bool, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	k, ok := s.keys[scope+key]
+	if ok && k.CreatedAt.Time.After(expiredBefore) && (k.Status != 0 || k.CreatedAt.Time.After(staleBefore)) {
+		return false, nil
+	}
+
+	s.keys[scope+key] = &models.TxIdempotencyKey{Scope: scope, Key: key, RequestHash: reqHash}
+	s.keys[scope+key].CreatedAt.Time = time.Now()
+	s.keys[scope+key].CreatedAt.Valid = true
+	return true, nil
+}
+
+func (s *testStore) GetTxIdempotencyKey(scope, key string) (models.TxIdempotencyKey, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	k, ok := s.keys[scope+key]
+	if !ok {
+		return models.TxIdempotencyKey{}, errors.New("key not found")
+	}
+	return *k, nil
+}
+
+func (s *testStore) UpdateTxIdempotencyKey(scope, key string, status int, resp []byte) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if k, ok := s.keys[scope+key]; ok {
+		k.Status = status
+		k.Response = resp
+	}
+	return nil
+}
+
+func (s *testStore) DeleteTxIdempotencyKey(scope, key string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	delete(s.keys, scope+key)
+	return nil
+}
+
+// newTestServer returns an echo instance with the handler behind Handle on /tx.
+func newTestServer(k *Keys, h echo.HandlerFunc) *echo.Echo {
+	e := echo.New()
+	e.POST("/tx", func(c echo.Context) error {
+		return k.Handle(c, "user", c.Request().Header.Get("Idempotency-Key"), h)
+	})
+	return e
+}
+
+func send(e *echo.Echo, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/tx", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func newTestKeys() (*Keys, *testStore) {
+	s := &testStore{keys: make(map[string]*models.TxIdempotencyKey)}
+	return New(Opt{TTL: time.Hour, StaleAfter: time.Minute}, s), s
+}
+
+func TestConcurrent(t *testing.T) {
+	var (
+		k, _ = newTestKeys()
+		sent atomic.Int32
+	)
+	e := newTestServer(k, func(c echo.Context) error {
+		n := sent.Add(1)
+		time.Sleep(time.Millisecond * 50)
+		Commit(c)
+		return c.JSON(http.StatusOK, map[string]int32{"sent": n})
+	})
+
+	const num = 10
+	var (
+		wg   sync.WaitGroup
+		recs = make([]*httptest.ResponseRecorder, num)
+	)
+	for i := 0; i < num; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i] = send(e, "abc", `{"to": "subscriber@listmonk.app"}`)
+		}(i)
+	}
+	wg.Wait()
+
+	if n := sent.Load(); n != 1 {
+		t.Fatalf("expected the message to be sent once, got %d", n)
+	}
+
+	replayed := 0
+	for _, r := range recs {
+		if r.Code != http.StatusOK || strings.TrimSpace(r.Body.String()) != `{"sent":1}` {
+			t.Errorf("expected the first response, got %d: %s", r.Code, r.Body.String())
+		}
+		if r.Header().Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+	if replayed != num-1 {
+		t.Errorf("expected %d replayed responses, got %d", num-1, replayed)
+	}
+}
+
+func TestPartialSend(t *testing.T) {
+	var (
+		k, s = newTestKeys()
+		sent int
+	)
+	e := newTestServer(k, func(c echo.Context) error {
+		// The first message is sent and the second fails.
+		sent++
+		Commit(c)
+		return echo.NewHTTPError(http.StatusInternalServerError, "error sending message")
+	})
+
+	if r := send(e, "abc", "batch"); r.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", r.Code)
+	}
+	if _, ok := s.keys["userabc"]; !ok {
+		t.Fatal("expected the key of a partially sent request to be kept")
+	}
+
+	// A retry replays the error without sending the messages again.
+	r := send(e, "abc", "batch")
+	if r.Code != http.StatusInternalServerError || r.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("expected the error to be replayed, got %d", r.Code)
+	}
+	if sent != 1 {
+		t.Errorf("expected the messages to be sent once, got %d", sent)
+	}
+}
+
+func TestServerError(t *testing.T) {
+	var (
+		k, s = newTestKeys()
+		sent int
+	)
+	e := newTestServer(k, func(c echo.Context) error {
+		sent++
+		if sent == 1 {
+			return echo.NewHTTPError(http.StatusInternalServerError, "error fetching template")
+		}
+		return c.JSON(http.StatusOK, true)
+	})
+
+	if r := send(e, "abc", "msg"); r.Code != http.StatusInternalServerError {
+		t.Fatalf("expected 500, got %d", r.Code)
+	}
+	if _, ok := s.keys["userabc"]; ok {
+		t.Fatal("expected the key to be released on an error before anything was sent")
+	}
+
+	// A retry is processed afresh.
+	r := send(e, "abc", "msg")
+	if r.Code != http.StatusOK || r.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("expected the retry to be processed, got %d", r.Code)
+	}
+	if sent != 2 {
+		t.Errorf("expected the handler to be called twice, got %d", sent)
+	}
+}
+
+func TestKeyReused(t *testing.T) {
+	k, _ := newTestKeys()
+	e := echo.New()
+
+	var errs []error
+	e.POST("/tx", func(c echo.Context) error {
+		err := k.Handle(c, "user", "abc", func(c echo.Context) error {
+			return c.JSON(http.StatusOK, true)
+		})
+		errs = append(errs, err)
+		return err
+	})
+
+	send(e, "abc", "one")
+	send(e, "abc", "two")
+
+	if len(errs) != 2 || errs[0] != nil || errs[1] != ErrKeyReused {
+		t.Errorf("expected the reused key to fail with ErrKeyReused, got %v", errs)
+	}
+}
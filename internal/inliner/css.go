@@ -0,0 +1,537 @@
+package inliner
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// rule is a CSS rule whose selectors can all be inlined.
+type rule struct {
+	selectors []selector
+	decls     []decl
+	order     int
+}
+
+// specificity represents a selector's (ids, classes and attributes, types) specificity.
+type specificity [3]int
+
+func (s specificity) less(o specificity) bool {
+	for i := range s {
+		if s[i] != o[i] {
+			return s[i] < o[i]
+		}
+	}
+	return false
+}
+
+// selector is a parsed complex selector, with its compound selectors
+// in reverse order (the subject first).
+type selector struct {
+	parts []compound
+	spec  specificity
+}
+
+// compound is a compound selector, eg: div.a#b[c], and the combinator
+// that joins it to the compound on its left (' ' or '>').
+type compound struct {
+	tag     string
+	id      string
+	classes []string
+	attrs   []attrSel
+	comb    byte
+}
+
+type attrSel struct {
+	key string
+	op  string
+	val string
+}
+
+// parseCSS parses a stylesheet into the rules that can be inlined,
+// numbering them from order, and returns them with the rest of the
+// stylesheet that has to be retained.
+func parseCSS(css string, order int) ([]rule, string) {
+	css = stripComments(css)
+
+	var (
+		rules    []rule
+		retained strings.Builder
+	)
+	for {
+		css = strings.TrimSpace(css)
+		if css == "" {
+			break
+		}
+
+		// At-rules (eg: @media, @font-face, @import) are retained as they are.
+		if css[0] == '@' {
+			end := atRuleEnd(css)
+			retained.WriteString(strings.TrimSpace(css[:end]))
+			retained.WriteString("\n")
+			css = css[end:]
+			continue
+		}
+
+		start := indexTop(css, '{')
+		if start < 0 {
+			break
+		}
+		end := blockEnd(css, start)
+
+		var (
+			prelude = strings.TrimSpace(css[:start])
+			body    = css[start+1 : end]
+			decls   = parseDecls(body)
+			sels    []selector
+			keep    []string
+		)
+		if end < len(css) {
+			end++
+		}
+		css = css[end:]
+
+		for _, s := range splitTop(prelude, ',') {
+			s = strings.TrimSpace(s)
+			if s == "" {
+				continue
+			}
+			if sel, ok := parseSelector(s); ok {
+				sels = append(sels, sel)
+			} else {
+				keep = append(keep, s)
+			}
+		}
+
+		if len(sels) > 0 && len(decls) > 0 {
+			rules = append(rules, rule{selectors: sels, decls: decls, order: order})
+			order++
+		}
+		if len(keep) > 0 {
+			retained.WriteString(strings.Join(keep, ", ") + " {" + body + "}\n")
+		}
+	}
+
+	return rules, strings.TrimSpace(retained.String())
+}
+
+// parseDecls parses the declarations in a rule's body or a style attribute.
+func parseDecls(s string) []decl {
+	var out []decl
+	for _, d := range splitTop(s, ';') {
+		prop, val, ok := strings.Cut(d, ":")
+		if !ok {
+			continue
+		}
+
+		prop = strings.ToLower(strings.TrimSpace(prop))
+		val = strings.TrimSpace(val)
+
+		// !important, with optional whitespace after the !.
+		important := false
+		if i := strings.LastIndexByte(val, '!'); i >= 0 && strings.EqualFold(strings.TrimSpace(val[i+1:]), "important") {
+			important = true
+			val = strings.TrimSpace(val[:i])
+		}
+
+		if prop == "" || val == "" {
+			continue
+		}
+		out = append(out, decl{prop: prop, value: val, important: important})
+	}
+
+	return out
+}
+
+// parseSelector parses a complex selector. Selectors with pseudo-classes,
+// pseudo-elements, namespaces, or sibling combinators are not supported.
+func parseSelector(s string) (selector, bool) {
+	var (
+		sel  selector
+		cur  compound
+		comb byte
+		have bool
+	)
+
+	push := func() {
+		cur.comb = comb
+		sel.parts = append([]compound{cur}, sel.parts...)
+		cur = compound{}
+		have = false
+	}
+
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '>':
+			// Combinator.
+			j := i
+			next := byte(' ')
+			for j < len(s) && strings.IndexByte(" \t\n\r>", s[j]) >= 0 {
+				if s[j] == '>' {
+					if next == '>' {
+						return sel, false
+					}
+					next = '>'
+				}
+				j++
+			}
+			if !have || j == len(s) {
+				return sel, false
+			}
+			push()
+			comb = next
+			i = j
+
+		case c == '*':
+			if have {
+				return sel, false
+			}
+			have = true
+			i++
+
+		case c == '#' || c == '.':
+			name, n := readIdent(s[i+1:])
+			if name == "" {
+				return sel, false
+			}
+			if c == '#' {
+				cur.id = name
+				sel.spec[0]++
+			} else {
+				cur.classes = append(cur.classes, name)
+				sel.spec[1]++
+			}
+			have = true
+			i += n + 1
+
+		case c == '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return sel, false
+			}
+			a, ok := parseAttrSel(s[i+1 : i+end])
+			if !ok {
+				return sel, false
+			}
+			cur.attrs = append(cur.attrs, a)
+			sel.spec[1]++
+			have = true
+			i += end + 1
+
+		default:
+			name, n := readIdent(s[i:])
+			if name == "" || have {
+				// Pseudo-classes, sibling combinators etc.
+				return sel, false
+			}
+			cur.tag = strings.ToLower(name)
+			sel.spec[2]++
+			have = true
+			i += n
+		}
+	}
+	if !have {
+		return sel, false
+	}
+	push()
+
+	return sel, true
+}
+
+// parseAttrSel parses the inside of an attribute selector, eg: href^="https".
+func parseAttrSel(s string) (attrSel, bool) {
+	i := strings.IndexAny(s, "=~^$*|")
+	if i < 0 {
+		key, _ := readIdent(strings.TrimSpace(s))
+		return attrSel{key: strings.ToLower(key)}, key != "" && key == strings.TrimSpace(s)
+	}
+
+	var (
+		key = strings.ToLower(strings.TrimSpace(s[:i]))
+		op  = "="
+		val string
+	)
+	if s[i] != '=' {
+		if i+1 >= len(s) || s[i+1] != '=' || s[i] == '|' {
+			return attrSel{}, false
+		}
+		op = s[i : i+2]
+		val = s[i+2:]
+	} else {
+		val = s[i+1:]
+	}
+
+	val = strings.TrimSpace(val)
+	if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+		val = val[1 : len(val)-1]
+	}
+	if key == "" {
+		return attrSel{}, false
+	}
+
+	return attrSel{key: key, op: op, val: val}, true
+}
+
+// match returns true if the selector matches the element.
+func (s selector) match(n *html.Node) bool {
+	return matchParts(s.parts, n)
+}
+
+func matchParts(parts []compound, n *html.Node) bool {
+	if !parts[0].match(n) {
+		return false
+	}
+	if len(parts) == 1 {
+		return true
+	}
+
+	switch parts[0].comb {
+	case '>':
+		p := n.Parent
+		return p != nil && p.Type == html.ElementNode && matchParts(parts[1:], p)
+	default:
+		for p := n.Parent; p != nil && p.Type == html.ElementNode; p = p.Parent {
+			if matchParts(parts[1:], p) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c compound) match(n *html.Node) bool {
+	if n.Type != html.ElementNode {
+		return false
+	}
+	if c.tag != "" && c.tag != n.Data {
+		return false
+	}
+	if c.id != "" && attr(n, "id") != c.id {
+		return false
+	}
+
+	if len(c.classes) > 0 {
+		cls := strings.Fields(attr(n, "class"))
+		for _, want := range c.classes {
+			found := false
+			for _, have := range cls {
+				if have == want {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+
+	for _, a := range c.attrs {
+		if !hasAttr(n, a.key) {
+			return false
+		}
+
+		v := attr(n, a.key)
+		switch a.op {
+		case "":
+		case "=":
+			if v != a.val {
+				return false
+			}
+		case "~=":
+			found := false
+			for _, f := range strings.Fields(v) {
+				if f == a.val {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		case "^=":
+			if a.val == "" || !strings.HasPrefix(v, a.val) {
+				return false
+			}
+		case "$=":
+			if a.val == "" || !strings.HasSuffix(v, a.val) {
+				return false
+			}
+		case "*=":
+			if a.val == "" || !strings.Contains(v, a.val) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// readIdent reads a CSS identifier from the beginning of s and returns it with its length.
+func readIdent(s string) (string, int) {
+	i := 0
+	for i < len(s) {
+		c := s[i]
+		if c == '-' || c == '_' || c >= 0x80 ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			i++
+			continue
+		}
+		break
+	}
+	return s[:i], i
+}
+
+// stripComments removes /* */ comments outside of strings.
+func stripComments(s string) string {
+	var (
+		b     strings.Builder
+		quote byte
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			b.WriteByte(c)
+			if c == '\\' && i+1 < len(s) {
+				i++
+				b.WriteByte(s[i])
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		if c == '"' || c == '\'' {
+			quote = c
+		} else if c == '/' && i+1 < len(s) && s[i+1] == '*' {
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				break
+			}
+			i += end + 3
+			continue
+		}
+		b.WriteByte(c)
+	}
+
+	return b.String()
+}
+
+// scan calls fn for every byte of s that's not inside a string or parentheses,
+// along with the current brace depth, till fn returns false.
+func scan(s string, fn func(i int, depth int) bool) {
+	var (
+		quote  byte
+		parens int
+		depth  int
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		switch c {
+		case '"', '\'':
+			quote = c
+			continue
+		case '(':
+			parens++
+			continue
+		case ')':
+			if parens > 0 {
+				parens--
+			}
+			continue
+		}
+		if parens > 0 {
+			continue
+		}
+
+		if c == '}' {
+			depth--
+		}
+		if !fn(i, depth) {
+			return
+		}
+		if c == '{' {
+			depth++
+		}
+	}
+}
+
+// indexTop returns the index of the first c outside of strings, parentheses, and blocks.
+func indexTop(s string, c byte) int {
+	idx := -1
+	scan(s, func(i, depth int) bool {
+		if depth == 0 && s[i] == c {
+			idx = i
+			return false
+		}
+		return true
+	})
+	return idx
+}
+
+// blockEnd returns the index of the } closing the block opened at start, or len(s).
+func blockEnd(s string, start int) int {
+	end := len(s)
+	scan(s[start:], func(i, depth int) bool {
+		if depth == 0 && s[start+i] == '}' {
+			end = start + i
+			return false
+		}
+		return true
+	})
+	return end
+}
+
+// atRuleEnd returns the index after the end of the at-rule at the beginning of s,
+// which is either a statement ending in ; or a block.
+func atRuleEnd(s string) int {
+	end := len(s)
+	scan(s, func(i, depth int) bool {
+		if depth == 0 && s[i] == ';' {
+			end = i + 1
+			return false
+		}
+		if depth == 0 && s[i] == '}' {
+			end = i + 1
+			return false
+		}
+		return true
+	})
+	return end
+}
+
+// splitTop splits s by sep outside of strings, parentheses, and brackets.
+func splitTop(s string, sep byte) []string {
+	var (
+		out      []string
+		last     int
+		brackets int
+	)
+	scan(s, func(i, depth int) bool {
+		switch s[i] {
+		case '[':
+			brackets++
+		case ']':
+			brackets--
+		case sep:
+			if brackets == 0 && depth == 0 {
+				out = append(out, s[last:i])
+				last = i + 1
+			}
+		}
+		return true
+	})
+
+	return append(out, s[last:])
+}
@@ -0,0 +1,283 @@
+// Package inliner inlines the CSS rules in the <style> blocks of HTML documents
+// onto the style attributes of the elements they match, as many e-mail clients
+// strip <style> blocks.
+package inliner
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// Elements that are never styled.
+var skipElems = map[atom.Atom]bool{
+	atom.Head: true, atom.Title: true, atom.Meta: true, atom.Link: true,
+	atom.Style: true, atom.Script: true, atom.Base: true,
+}
+
+// Max number of distinct stylesheets that an Inliner caches.
+const maxCachedSheets = 32
+
+// Inliner inlines CSS into HTML documents and caches the parsed stylesheets.
+// The messages of a campaign are rendered from the same template and usually
+// have the same stylesheets, which are then only parsed once. It's safe for
+// concurrent use.
+type Inliner struct {
+	sheets map[string][]sheet
+	mut    sync.RWMutex
+}
+
+// sheet is a parsed <style> block.
+type sheet struct {
+	rules    []rule
+	retained string
+}
+
+// decl is a declaration matched against an element.
+type decl struct {
+	prop      string
+	value     string
+	important bool
+	inline    bool
+	spec      specificity
+	order     int
+}
+
+// New returns a new Inliner.
+func New() *Inliner {
+	return &Inliner{sheets: make(map[string][]sheet)}
+}
+
+// Inline moves the rules in the <style> blocks of an HTML document onto the style
+// attributes of the elements they match, honouring the cascade: !important, inline
+// styles, selector specificity, and source order, in that order.
+//
+// Rules that can't be inlined, that is, @media queries and other at-rules, and
+// rules with pseudo-classes, pseudo-elements, or sibling combinators, are
+// retained in their <style> blocks. Blocks with nothing left are removed.
+// <style data-inline="false"> blocks are left untouched.
+func (in *Inliner) Inline(b []byte) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect and parse the stylesheets.
+	var (
+		rules  []rule
+		styles []*html.Node
+	)
+	walk(doc, func(n *html.Node) {
+		if n.Type != html.ElementNode || n.DataAtom != atom.Style || attr(n, "data-inline") == "false" {
+			return
+		}
+
+		// Only stylesheets for screens can be inlined.
+		if m := strings.ToLower(strings.TrimSpace(attr(n, "media"))); m != "" && m != "all" && m != "screen" {
+			return
+		}
+
+		styles = append(styles, n)
+	})
+	if len(styles) == 0 {
+		return b, nil
+	}
+
+	css := make([]string, len(styles))
+	for i, n := range styles {
+		var s strings.Builder
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.TextNode {
+				s.WriteString(c.Data)
+			}
+		}
+		css[i] = s.String()
+	}
+
+	sheets := in.parse(css)
+	for i, n := range styles {
+		rules = append(rules, sheets[i].rules...)
+
+		// Retain the rules that can't be inlined in the block.
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			n.RemoveChild(c)
+			c = next
+		}
+		if sheets[i].retained == "" {
+			n.Parent.RemoveChild(n)
+		} else {
+			n.AppendChild(&html.Node{Type: html.TextNode, Data: sheets[i].retained})
+		}
+	}
+
+	// Apply the rules to the elements.
+	walk(doc, func(n *html.Node) {
+		if n.Type != html.ElementNode || skipElems[n.DataAtom] {
+			return
+		}
+
+		var decls []decl
+		for _, r := range rules {
+			var (
+				matched bool
+				spec    specificity
+			)
+			for _, s := range r.selectors {
+				if s.match(n) && (!matched || spec.less(s.spec)) {
+					matched = true
+					spec = s.spec
+				}
+			}
+			if !matched {
+				continue
+			}
+
+			for _, d := range r.decls {
+				d.spec = spec
+				d.order = r.order
+				decls = append(decls, d)
+			}
+		}
+		if len(decls) == 0 {
+			return
+		}
+
+		// Existing inline styles.
+		for _, d := range parseDecls(attr(n, "style")) {
+			d.inline = true
+			decls = append(decls, d)
+		}
+
+		setAttr(n, "style", cascade(decls))
+	})
+
+	var out bytes.Buffer
+	if err := html.Render(&out, doc); err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// parse parses the stylesheets of a document, numbering the rules in the order
+// of their appearance across the stylesheets, or returns them from the cache.
+// The parsed rules are read-only and are shared by the documents.
+func (in *Inliner) parse(css []string) []sheet {
+	key := strings.Join(css, "\x00")
+
+	in.mut.RLock()
+	out, ok := in.sheets[key]
+	in.mut.RUnlock()
+	if ok {
+		return out
+	}
+
+	out = make([]sheet, len(css))
+	order := 0
+	for i, s := range css {
+		r, retained := parseCSS(s, order)
+		order += len(r)
+		out[i] = sheet{rules: r, retained: retained}
+	}
+
+	// Documents with stylesheets that differ per message, eg: with template
+	// expressions, aren't cached beyond the limit.
+	in.mut.Lock()
+	if len(in.sheets) < maxCachedSheets {
+		in.sheets[key] = out
+	}
+	in.mut.Unlock()
+
+	return out
+}
+
+// cascade resolves the declarations of an element into a style attribute
+// value with one declaration per property, ordered by their first appearance.
+func cascade(decls []decl) string {
+	var (
+		props []string
+		win   = make(map[string]decl, len(decls))
+	)
+	for _, d := range decls {
+		w, ok := win[d.prop]
+		if !ok {
+			props = append(props, d.prop)
+			win[d.prop] = d
+			continue
+		}
+
+		if w.less(d) {
+			win[d.prop] = d
+		}
+	}
+
+	out := make([]string, 0, len(props))
+	for _, p := range props {
+		d := win[p]
+		s := d.prop + ": " + d.value
+		if d.important {
+			s += " !important"
+		}
+		out = append(out, s)
+	}
+
+	return strings.Join(out, "; ")
+}
+
+// less returns true if the declaration d is overridden by o in the cascade.
+func (d decl) less(o decl) bool {
+	if d.important != o.important {
+		return o.important
+	}
+	if d.inline != o.inline {
+		return o.inline
+	}
+	if d.spec != o.spec {
+		return d.spec.less(o.spec)
+	}
+
+	// With everything else being equal, the later declaration wins.
+	return d.order <= o.order
+}
+
+func walk(n *html.Node, fn func(*html.Node)) {
+	fn(n)
+	for c := n.FirstChild; c != nil; {
+		// The callback may remove the node.
+		next := c.NextSibling
+		walk(c, fn)
+		c = next
+	}
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+func setAttr(n *html.Node, key, val string) {
+	for i, a := range n.Attr {
+		if a.Namespace == "" && a.Key == key {
+			n.Attr[i].Val = val
+			return
+		}
+	}
+	n.Attr = append(n.Attr, html.Attribute{Key: key, Val: val})
+}
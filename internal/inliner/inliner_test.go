@@ -0,0 +1,157 @@
+package inliner
+
+import (
+	"strings"
+	"testing"
+)
+
+// styleOf inlines a document and returns the style attribute of the element with the id.
+func styleOf(t *testing.T, in *Inliner, doc, id string) string {
+	t.Helper()
+
+	b, err := in.Inline([]byte(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := string(b)
+	i := strings.Index(out, `id="`+id+`"`)
+	if i < 0 {
+		t.Fatalf("element %s not found in %s", id, out)
+	}
+
+	// The style attribute of the element's tag.
+	tag := out[strings.LastIndex(out[:i], "<"):]
+	tag = tag[:strings.IndexByte(tag, '>')]
+	j := strings.Index(tag, `style="`)
+	if j < 0 {
+		return ""
+	}
+	s := tag[j+len(`style="`):]
+	return s[:strings.IndexByte(s, '"')]
+}
+
+func doc(css, body string) string {
+	return "<html><head><style>" + css + "</style></head><body>" + body + "</body></html>"
+}
+
+func TestSpecificity(t *testing.T) {
+	cases := []struct {
+		name string
+		css  string
+		body string
+		exp  string
+	}{
+		{"id over class over type",
+			"#x { color: green } .a { color: blue } p { color: red }",
+			`<p id="x" class="a">hi</p>`, "color: green"},
+		{"class over type regardless of order",
+			".a { color: blue } p { color: red }",
+			`<p id="x" class="a">hi</p>`, "color: blue"},
+		{"attribute equals class",
+			"[title] { color: red } .a { color: blue }",
+			`<p id="x" class="a" title="t">hi</p>`, "color: blue"},
+		{"two classes over one",
+			".a.b { color: green } .a { color: blue }",
+			`<p id="x" class="a b">hi</p>`, "color: green"},
+		{"descendant adds specificity",
+			"div p { color: green } p { color: red }",
+			`<div><p id="x">hi</p></div>`, "color: green"},
+		{"later rule wins with equal specificity",
+			".a { color: blue } .b { color: green }",
+			`<p id="x" class="b a">hi</p>`, "color: green"},
+		{"highest specificity of a selector list",
+			"p, #x { color: green } .a { color: blue }",
+			`<p id="x" class="a">hi</p>`, "color: green"},
+		{"child combinator",
+			"div > p { color: green } section > p { color: red }",
+			`<section><div><p id="x">hi</p></div></section>`, "color: green"},
+		{"inline style over id",
+			"#x { color: green }",
+			`<p id="x" style="color: red">hi</p>`, "color: red"},
+		{"properties merge in order",
+			"p { margin: 0 } .a { color: blue }",
+			`<p id="x" class="a" style="padding: 1px">hi</p>`, "margin: 0; color: blue; padding: 1px"},
+	}
+
+	in := New()
+	for _, c := range cases {
+		if got := styleOf(t, in, doc(c.css, c.body), "x"); got != c.exp {
+			t.Errorf("%s: expected %q, got %q", c.name, c.exp, got)
+		}
+	}
+}
+
+func TestImportant(t *testing.T) {
+	cases := []struct {
+		name string
+		css  string
+		body string
+		exp  string
+	}{
+		{"important over id",
+			"p { color: red !important } #x { color: green }",
+			`<p id="x">hi</p>`, "color: red !important"},
+		{"important over inline style",
+			".a { color: red !important }",
+			`<p id="x" class="a" style="color: green">hi</p>`, "color: red !important"},
+		{"important inline style over important rule",
+			"#x { color: red !important }",
+			`<p id="x" style="color: green !important">hi</p>`, "color: green !important"},
+		{"specificity between important rules",
+			"#x { color: green !important } p { color: red !important }",
+			`<p id="x">hi</p>`, "color: green !important"},
+		{"whitespace after !",
+			"p { color: red ! important } #x { color: green }",
+			`<p id="x">hi</p>`, "color: red !important"},
+	}
+
+	in := New()
+	for _, c := range cases {
+		if got := styleOf(t, in, doc(c.css, c.body), "x"); got != c.exp {
+			t.Errorf("%s: expected %q, got %q", c.name, c.exp, got)
+		}
+	}
+}
+
+func TestRetained(t *testing.T) {
+	b, err := New().Inline([]byte(doc("p { color: red } a:hover { color: blue } @media (max-width: 600px) { p { color: green } }",
+		`<p id="x"><a href="https://listmonk.app">link</a></p>`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := string(b)
+	if !strings.Contains(out, `<p id="x" style="color: red">`) {
+		t.Errorf("expected the rule to be inlined, got %s", out)
+	}
+	if !strings.Contains(out, "@media (max-width: 600px)") || !strings.Contains(out, "a:hover") {
+		t.Errorf("expected the media query and pseudo-class to be retained, got %s", out)
+	}
+	if !strings.Contains(out, `href="https://listmonk.app"`) {
+		t.Errorf("expected the links to be untouched, got %s", out)
+	}
+}
+
+func TestCache(t *testing.T) {
+	in := New()
+
+	// Messages from the same template with different content share the parsed stylesheet.
+	css := "p { color: red } .a { color: blue }"
+	for _, name := range []string{"Jane", "John"} {
+		if got := styleOf(t, in, doc(css, `<p id="x" class="a">`+name+`</p>`), "x"); got != "color: blue" {
+			t.Fatalf("expected the cached rules to apply, got %q", got)
+		}
+	}
+	if len(in.sheets) != 1 {
+		t.Fatalf("expected 1 cached stylesheet, got %d", len(in.sheets))
+	}
+
+	// The cache is bounded.
+	for i := 0; i < maxCachedSheets*2; i++ {
+		styleOf(t, in, doc(strings.Repeat(" ", i)+css, `<p id="x">hi</p>`), "x")
+	}
+	if len(in.sheets) != maxCachedSheets {
+		t.Errorf("expected the cache to be limited to %d, got %d", maxCachedSheets, len(in.sheets))
+	}
+}
@@ -0,0 +1,322 @@
+// Package logger implements a leveled logger that writes either plain text lines
+// in the format of the standard logger, or structured JSON lines for log aggregators.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Level is the severity of a log entry.
+type Level int
+
+// Log levels.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// Matches the file:line: prefix written by standard loggers with log.Lshortfile.
+var reCaller = regexp.MustCompile(`^([^\s:]+\.go:\d+): `)
+
+// Opt represents the logger options.
+type Opt struct {
+	// text or json.
+	Format string
+
+	// Minimum level of the entries that are logged.
+	Level Level
+
+	// Out receives log lines in the configured format.
+	Out io.Writer
+
+	// TextOut, if set, additionally receives log lines in the text format
+	// irrespective of Format, eg: for the log viewer in the admin.
+	TextOut io.Writer
+}
+
+// Logger is a leveled logger with optional bound fields.
+type Logger struct {
+	opt    Opt
+	text   *log.Logger
+	fields []interface{}
+}
+
+// ParseLevel parses a level name.
+func ParseLevel(s string) (Level, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "warning" {
+		s = "warn"
+	}
+	for l, name := range levelNames {
+		if name == s {
+			return l, nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level: %s", s)
+}
+
+// String returns the level's name.
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// New returns a new Logger.
+func New(o Opt) *Logger {
+	if o.Format != FormatJSON {
+		o.Format = FormatText
+	}
+
+	var tw io.Writer
+	if o.Format == FormatText {
+		tw = o.Out
+		if o.TextOut != nil {
+			tw = io.MultiWriter(o.Out, o.TextOut)
+		}
+	} else {
+		tw = o.TextOut
+	}
+
+	// The caller is written by the logger itself as the standard logger's
+	// log.Lshortfile lookup would point to this package.
+	l := &Logger{opt: o}
+	if tw != nil {
+		l.text = log.New(tw, "", log.Ldate|log.Ltime)
+	}
+
+	return l
+}
+
+// With returns a copy of the logger with the given key value pairs bound to
+// all its entries. In the text format, bound fields are not written.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	f := make([]interface{}, 0, len(l.fields)+len(kv))
+	f = append(f, l.fields...)
+	f = append(f, kv...)
+
+	return &Logger{opt: l.opt, text: l.text, fields: f}
+}
+
+// Debug logs a debug entry with the given key value pairs.
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, "", msg, kv)
+}
+
+// Info logs an info entry with the given key value pairs.
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, "", msg, kv)
+}
+
+// Warn logs a warning entry with the given key value pairs.
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, "", msg, kv)
+}
+
+// Error logs an error entry with the given key value pairs. The error
+// itself is conventionally passed as the "error" pair.
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, "", msg, kv)
+}
+
+// Printf logs an unstructured entry like the standard logger. The level is
+// inferred from the message.
+func (l *Logger) Printf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	l.log(inferLevel(msg), "", msg, nil)
+}
+
+// Writer returns an io.Writer that logs every line written to it, so that a
+// standard logger can write through the logger. Standard loggers should
+// only have the log.Lshortfile flag set, the file:line prefix of which is
+// recorded as the caller.
+func (l *Logger) Writer() io.Writer {
+	return &writer{l: l}
+}
+
+// StdFlags returns the flags that standard loggers writing to Writer() should use.
+func (l *Logger) StdFlags() int {
+	if l.opt.Format == FormatJSON {
+		return log.Lshortfile
+	}
+	return log.Ldate | log.Ltime | log.Lshortfile
+}
+
+// log writes an entry. caller, if empty, is the caller of the exported logging method.
+func (l *Logger) log(lvl Level, caller, msg string, kv []interface{}) {
+	if lvl < l.opt.Level {
+		return
+	}
+
+	if caller == "" {
+		if _, file, line, ok := runtime.Caller(2); ok {
+			caller = filepath.Base(file) + ":" + strconv.Itoa(line)
+		}
+	}
+
+	if l.opt.Format == FormatJSON {
+		l.writeJSON(lvl, caller, msg, kv)
+	}
+
+	if l.text != nil {
+		line := textLine(msg, kv)
+		if caller != "" {
+			line = caller + ": " + line
+		}
+		l.text.Print(line)
+	}
+}
+
+func (l *Logger) writeJSON(lvl Level, caller, msg string, kv []interface{}) {
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSONVal(&b, time.Now().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSONVal(&b, lvl.String())
+	if caller != "" {
+		b.WriteString(`,"caller":`)
+		writeJSONVal(&b, caller)
+	}
+	b.WriteString(`,"msg":`)
+	writeJSONVal(&b, msg)
+
+	writePairs := func(pairs []interface{}) {
+		for i := 0; i < len(pairs); i += 2 {
+			b.WriteByte(',')
+			writeJSONVal(&b, fmt.Sprint(pairs[i]))
+			b.WriteByte(':')
+			if i+1 < len(pairs) {
+				writeJSONVal(&b, pairs[i+1])
+			} else {
+				b.WriteString("null")
+			}
+		}
+	}
+	writePairs(l.fields)
+	writePairs(kv)
+	b.WriteString("}\n")
+
+	l.opt.Out.Write(b.Bytes())
+}
+
+func writeJSONVal(b *bytes.Buffer, v interface{}) {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+
+	j, err := json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(j)
+}
+
+// textLine renders an entry in the text format: the message followed by the
+// error, if any, as in "msg: error", and the rest of the pairs as key=value.
+func textLine(msg string, kv []interface{}) string {
+	var (
+		errVal interface{}
+		rest   []string
+	)
+	for i := 0; i < len(kv); i += 2 {
+		var (
+			k = fmt.Sprint(kv[i])
+			v interface{}
+		)
+		if i+1 < len(kv) {
+			v = kv[i+1]
+		}
+
+		if k == "error" && errVal == nil {
+			errVal = v
+			continue
+		}
+		rest = append(rest, k+"="+fmt.Sprint(v))
+	}
+
+	if errVal != nil {
+		msg += ": " + fmt.Sprint(errVal)
+	}
+	if len(rest) > 0 {
+		msg += " " + strings.Join(rest, " ")
+	}
+
+	return msg
+}
+
+// inferLevel infers the level of an unstructured message from its prefix.
+func inferLevel(msg string) Level {
+	m := strings.ToLower(msg)
+	switch {
+	case strings.HasPrefix(m, "error"), strings.HasPrefix(m, "fatal"):
+		return LevelError
+	case strings.HasPrefix(m, "warn"):
+		return LevelWarn
+	}
+	return LevelInfo
+}
+
+// writer logs the lines written by a standard logger.
+type writer struct {
+	l *Logger
+}
+
+func (w *writer) Write(b []byte) (int, error) {
+	for _, ln := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		// In the text format, the line is written as is with the date, time,
+		// and file prefix of the standard logger.
+		if w.l.opt.Format == FormatText {
+			if inferLevel(trimPrefix(ln)) >= w.l.opt.Level {
+				w.l.text.Writer().Write([]byte(ln + "\n"))
+			}
+			continue
+		}
+
+		var (
+			msg    = ln
+			caller string
+		)
+		if m := reCaller.FindStringSubmatch(ln); m != nil {
+			caller = m[1]
+			msg = ln[len(m[0]):]
+		}
+		w.l.log(inferLevel(msg), caller, msg, nil)
+	}
+
+	return len(b), nil
+}
+
+// trimPrefix removes the "2006/01/02 15:04:05 file.go:1: " prefix of standard log lines.
+func trimPrefix(ln string) string {
+	if len(ln) > 20 && ln[4] == '/' && ln[13] == ':' {
+		ln = ln[20:]
+	}
+	if m := reCaller.FindStringSubmatch(ln); m != nil {
+		ln = ln[len(m[0]):]
+	}
+	return ln
+}
@@ -1,18 +1,26 @@
 package manager
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"html/template"
-	"log"
 	"net/textproto"
+	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Masterminds/sprig/v3"
+	"github.com/knadh/listmonk/internal/domains"
 	"github.com/knadh/listmonk/internal/i18n"
+	"github.com/knadh/listmonk/internal/inliner"
+	"github.com/knadh/listmonk/internal/logger"
+	"github.com/knadh/listmonk/internal/media"
+	"github.com/knadh/listmonk/internal/metrics"
 	"github.com/knadh/listmonk/models"
+	"golang.org/x/time/rate"
 )
 
 const (
@@ -23,6 +31,22 @@ const (
 	ContentTpl = "content"
 
 	dummyUUID = "00000000-0000-0000-0000-000000000000"
+
+	// Max number of attempts for queued tx messages, and the delay before the
+	// first retry, which is doubled after every attempt.
+	txMaxAttempts  = 5
+	txRetryBackoff = time.Second * 5
+
+	// Queued tx messages are stored and the ones that are due to be retried, or
+	// that weren't sent within the lease, eg: on a crash, are fetched every
+	// txScanInterval in batches of txScanBatch.
+	txScanInterval = time.Second * 5
+	txScanBatch    = 100
+	txLease        = time.Minute
+
+	// Subscriber attribute that holds the subscriber's IANA time zone name
+	// (eg: Asia/Kolkata) used for campaign send windows.
+	SendWindowTimezoneAttrib = "timezone"
 )
 
 // Store represents a data backend, such as a database,
@@ -34,9 +58,26 @@ type Store interface {
 	GetAttachment(mediaID int) (models.Attachment, error)
 	UpdateCampaignStatus(campID int, status string) error
 	UpdateCampaignCounts(campID int, toSend int, sent int, lastSubID int) error
+	UpdateCampaignCheckpoint(campID int, lastSubID int) error
+	GetCampaignMessageCap(campID int, max int) (int, bool, error)
+	GetSubscriberSendCounts(subIDs []int) ([]models.SubscriberSendCount, error)
+	GetExcludedSubscribers(subIDs []int, listIDs, campIDs []int64) ([]int, error)
+	RecordSubscriberSends(campID int, subIDs []int) error
+	RecordCampaignDeliveries(campID int, subIDs []int) error
+	DeferCampaignSubscribers(campID int, d []models.CampaignDeferral) error
+	NextDeferredSubscribers(campID, limit int, lease time.Duration) ([]models.Subscriber, error)
+	GetCampaignNextDeferral(campID int) (time.Time, error)
+	DeleteCampaignDeferrals(campID int, subIDs []int) error
+	GetCampaignVariants(campID int) ([]models.CampaignVariant, error)
+	UpdateCampaignVariantCounts(campID int, counts map[int]int) error
+	EndCampaignVariantSample(campID int, endsAt time.Time) error
+	PickCampaignVariantWinner(campID int) (models.CampaignVariant, error)
 	CreateLink(url string) (string, error)
 	BlocklistSubscriber(id int64) error
 	DeleteSubscriber(id int64) error
+	InsertTxMessage(msg models.Message, tplID int, retryAt time.Time) error
+	UpdateTxMessage(uuid, status string, attempts int, errMsg string, retryAt time.Time) error
+	NextTxMessages(limit int, lease time.Duration) ([]models.QueuedTxMessage, error)
 }
 
 // Messenger is an interface for a generic messaging backend,
@@ -51,6 +92,7 @@ type Messenger interface {
 // CampStats contains campaign stats like per minute send rate.
 type CampStats struct {
 	SendRate int
+	Paused   bool
 }
 
 // Manager handles the scheduling, processing, and queuing of campaigns
@@ -61,7 +103,7 @@ type Manager struct {
 	i18n       *i18n.I18n
 	messengers map[string]Messenger
 	notifCB    models.AdminNotifCallback
-	log        *log.Logger
+	log        *logger.Logger
 
 	// Campaigns that are currently running.
 	pipes    map[int]*pipe
@@ -76,9 +118,14 @@ type Manager struct {
 	links    map[string]string
 	linksMut sync.RWMutex
 
+	// Subscribers to the live progress of campaigns by campaign ID.
+	progSubs    map[int]map[chan CampProgress]struct{}
+	progSubsMut sync.Mutex
+
 	nextPipes chan *pipe
 	campMsgQ  chan CampaignMessage
 	msgQ      chan models.Message
+	txQ       chan txMessage
 
 	// Sliding window keeps track of the total number of messages sent in a period
 	// and on reaching the specified limit, waits until the window is over before
@@ -86,6 +133,28 @@ type Manager struct {
 	slidingCount int
 	slidingStart time.Time
 
+	// Campaign messages to subscribers, across campaigns, that have been queued but whose
+	// sends are yet to be recorded in the store. They count towards the per-subscriber
+	// message cap along with the recorded sends.
+	pendingSends    map[int]int
+	pendingSendsMut sync.Mutex
+
+	// Global rate limiter shared by all workers that's adjustable at runtime.
+	throttle     *rate.Limiter
+	throttleRate atomic.Int64
+
+	// Set on shutdown to stop fetching subscribers, and after the grace period,
+	// to drop the campaign messages that are still queued.
+	draining atomic.Bool
+	dropping atomic.Bool
+	fetching atomic.Bool
+
+	// Send metrics across all messages.
+	activeWorkers atomic.Int64
+	msgSent       *metrics.CounterVec
+	msgFailed     *metrics.CounterVec
+	sendLatency   *metrics.Histogram
+
 	tplFuncs template.FuncMap
 }
 
@@ -100,8 +169,27 @@ type CampaignMessage struct {
 	subject  string
 	body     []byte
 	altBody  []byte
+	ampBody  []byte
 	unsubURL string
 
+	// The A/B subject variant assigned to the message, if any.
+	variant *models.CampaignVariant
+
+	// Test messages are not tracked and don't count towards campaign stats.
+	test bool
+
+	// Whether the CSS in the rendered body is inlined, and the campaign's inliner.
+	inlineCSS bool
+	css       *inliner.Inliner
+
+	// UTM params added to the message's tracked links, rendered on first use.
+	utm       url.Values
+	utmLoaded bool
+
+	// Whether the message is to a deferred subscriber who's being retried. Their IDs are
+	// below the campaign's checkpoint and don't move it.
+	deferred bool
+
 	pipe *pipe
 }
 
@@ -115,6 +203,7 @@ type Config struct {
 	SlidingWindow         bool
 	SlidingWindowDuration time.Duration
 	SlidingWindowRate     int
+	MaxSubscriberMessages int
 	RequeueOnError        bool
 	FromEmail             string
 	IndividualTracking    bool
@@ -127,9 +216,58 @@ type Config struct {
 	RootURL               string
 	UnsubHeader           bool
 
+	// Inline the CSS in the <style> blocks of campaign bodies after they're
+	// rendered. Campaign.InlineCSS, if set, overrides it.
+	InlineCSS bool
+
+	// Global view tracking. If it's off, or if it's off on a campaign or its
+	// lists (Campaign.ViewsTracked), {{ TrackView }} renders nothing.
+	TrackViews bool
+
+	// Optional. Campaign messages aren't sent to subscribers whose e-mail
+	// domains are blocked by the rules.
+	DomainRules *domains.Rules
+
+	// Optional. Returns the signed one-click (RFC 8058) unsubscribe URL of a
+	// subscriber that's set in the List-Unsubscribe header.
+	OneClickUnsubURL func(campUUID, subUUID string) string
+
+	// Optional. Returns the signed unsubscribe URL of a subscriber that
+	// replaces UnsubURL in campaign messages to unsubscribe without a confirmation.
+	SignedUnsubURL func(campUUID, subUUID string) string
+
+	// Optional. Called with the final stats of a campaign when it finishes or
+	// is cancelled while it's being processed.
+	OnCampaignEnd func(c *models.Campaign, e models.CampaignEnd)
+
+	// Global messages per second across all workers on top of the per-worker
+	// MessageRate. 0 disables the throttle. It can be changed with SetMessageThrottle().
+	MessageThrottle int
+
+	// Resolves the URLs of media files referenced in templates with MediaURL
+	// when messages are rendered so that signed URLs are fresh at send time.
+	MediaURLs media.MediaURLResolver
+
+	// Percentage of a campaign's subscribers that are sent A/B subject variants
+	// before the winning variant is picked and sent to the remaining subscribers
+	// after VariantSampleWindow.
+	VariantSampleSize   int
+	VariantSampleWindow time.Duration
+
+	// Default time zone for campaign send windows for subscribers who don't
+	// have a valid time zone in their attribs (SendWindowTimezoneAttrib).
+	SendWindowLocation *time.Location
+
+	// Default UTM params added to the tracked links of campaigns that don't set them.
+	UTM models.CampaignUTM
+
 	// Interval to scan the DB for active campaign checkpoints.
 	ScanInterval time.Duration
 
+	// If set, all messages are sent to this catch-all address instead of the
+	// actual recipients (sandbox mode).
+	SandboxEmail string
+
 	// ScanCampaigns indicates whether this instance of manager will scan the DB
 	// for active campaigns and process them.
 	// This can be used to run multiple instances of listmonk
@@ -138,6 +276,12 @@ type Config struct {
 	ScanCampaigns bool
 }
 
+// txMessage is a queued transactional message that's retried on transient failures.
+type txMessage struct {
+	msg     models.Message
+	attempt int
+}
+
 type msgError struct {
 	st  *pipe
 	err error
@@ -146,7 +290,7 @@ type msgError struct {
 var pushTimeout = time.Second * 3
 
 // New returns a new instance of Mailer.
-func New(cfg Config, store Store, notifCB models.AdminNotifCallback, i *i18n.I18n, l *log.Logger) *Manager {
+func New(cfg Config, store Store, notifCB models.AdminNotifCallback, i *i18n.I18n, l *logger.Logger) *Manager {
 	if cfg.BatchSize < 1 {
 		cfg.BatchSize = 1000
 	}
@@ -156,6 +300,9 @@ func New(cfg Config, store Store, notifCB models.AdminNotifCallback, i *i18n.I18
 	if cfg.MessageRate < 1 {
 		cfg.MessageRate = 1
 	}
+	if cfg.SendWindowLocation == nil {
+		cfg.SendWindowLocation = time.UTC
+	}
 
 	m := &Manager{
 		cfg:          cfg,
@@ -167,12 +314,20 @@ func New(cfg Config, store Store, notifCB models.AdminNotifCallback, i *i18n.I18
 		pipes:        make(map[int]*pipe),
 		tpls:         make(map[int]*models.Template),
 		links:        make(map[string]string),
+		progSubs:     make(map[int]map[chan CampProgress]struct{}),
+		pendingSends: make(map[int]int),
 		nextPipes:    make(chan *pipe, 1000),
 		campMsgQ:     make(chan CampaignMessage, cfg.Concurrency*cfg.MessageRate*2),
 		msgQ:         make(chan models.Message, cfg.Concurrency*cfg.MessageRate*2),
+		txQ:          make(chan txMessage, cfg.Concurrency*cfg.MessageRate*2),
 		slidingStart: time.Now(),
+		throttle:     rate.NewLimiter(rate.Inf, 1),
+		msgSent:      metrics.NewCounterVec(maxMetricsMessengers),
+		msgFailed:    metrics.NewCounterVec(maxMetricsMessengers),
+		sendLatency:  metrics.NewHistogram(sendLatencyBuckets...),
 	}
 	m.tplFuncs = m.makeGnericFuncMap()
+	m.SetMessageThrottle(cfg.MessageThrottle)
 
 	return m
 }
@@ -187,6 +342,27 @@ func (m *Manager) AddMessenger(msg Messenger) error {
 	return nil
 }
 
+// SetMessageThrottle sets the global number of messages sent per second across
+// all workers. 0 disables the throttle. It takes effect immediately.
+func (m *Manager) SetMessageThrottle(n int) {
+	if n < 0 {
+		n = 0
+	}
+
+	if n == 0 {
+		m.throttle.SetLimit(rate.Inf)
+	} else {
+		m.throttle.SetBurst(n)
+		m.throttle.SetLimit(rate.Limit(n))
+	}
+	m.throttleRate.Store(int64(n))
+}
+
+// GetMessageThrottle returns the global number of messages sent per second. 0 is unlimited.
+func (m *Manager) GetMessageThrottle() int {
+	return int(m.throttleRate.Load())
+}
+
 // PushMessage pushes an arbitrary non-campaign Message to be sent out by the workers.
 // It times out if the queue is busy.
 func (m *Manager) PushMessage(msg models.Message) error {
@@ -196,7 +372,38 @@ func (m *Manager) PushMessage(msg models.Message) error {
 	select {
 	case m.msgQ <- msg:
 	case <-t.C:
-		m.log.Printf("message push timed out: '%s'", msg.Subject)
+		m.log.Warn("message push timed out: '" + msg.Subject + "'")
+		return errors.New("message push timed out")
+	}
+	return nil
+}
+
+// QueueTxMessage queues a transactional message to be sent out by the workers.
+// Unlike PushMessage, the message is subject to the message rate, is retried with
+// backoff on transient errors, and its delivery status is recorded against msg.TxUUID
+// in the store. The message is stored so that it's picked up again if it isn't
+// sent, eg: on a crash. It times out if the queue is busy.
+func (m *Manager) QueueTxMessage(msg models.Message, tplID int) error {
+	if err := m.store.InsertTxMessage(msg, tplID, time.Now().Add(txLease)); err != nil {
+		return err
+	}
+
+	if err := m.pushTx(txMessage{msg: msg, attempt: 1}); err != nil {
+		_ = m.store.UpdateTxMessage(msg.TxUUID, models.TxStatusFailed, 0, err.Error(), time.Time{})
+		return err
+	}
+
+	return nil
+}
+
+func (m *Manager) pushTx(tx txMessage) error {
+	t := time.NewTicker(pushTimeout)
+	defer t.Stop()
+
+	select {
+	case m.txQ <- tx:
+	case <-t.C:
+		m.log.Warn("tx message push timed out: '" + tx.msg.Subject + "'")
 		return errors.New("message push timed out")
 	}
 	return nil
@@ -216,7 +423,7 @@ func (m *Manager) PushCampaignMessage(msg CampaignMessage) error {
 	select {
 	case m.campMsgQ <- msg:
 	case <-t.C:
-		m.log.Printf("message push timed out: '%s'", msg.Subject())
+		m.log.Warn("message push timed out: '" + msg.Subject() + "'")
 		return errors.New("message push timed out")
 	}
 	return nil
@@ -239,13 +446,16 @@ func (m *Manager) HasRunningCampaigns() bool {
 func (m *Manager) GetCampaignStats(id int) CampStats {
 	n := 0
 
+	paused := false
+
 	m.pipesMut.Lock()
 	if c, ok := m.pipes[id]; ok {
 		n = int(c.rate.Rate())
+		paused = c.isPaused()
 	}
 	m.pipesMut.Unlock()
 
-	return CampStats{SendRate: n}
+	return CampStats{SendRate: n, Paused: paused}
 }
 
 // Run is a blocking function (that should be invoked as a goroutine)
@@ -266,12 +476,37 @@ func (m *Manager) Run() {
 		go m.worker()
 	}
 
+	go m.pushProgress()
+	go m.scanTxMessages(txScanInterval)
+
 	// Indefinitely wait on the pipe queue to fetch the next set of subscribers
-	// for any active campaigns.
+	// for any active campaigns. The pipes are rotated and on every turn, a pipe
+	// fetches priority + 1 batches. That is, higher priority campaigns get a bigger
+	// share of the message queue while the lower priority ones still progress.
 	for p := range m.nextPipes {
-		has, err := p.NextSubscribers()
+		// No further subscribers are fetched on shutdown.
+		if m.draining.Load() {
+			continue
+		}
+
+		// Paused pipes are taken out of the rotation till they're resumed.
+		if p.park() {
+			continue
+		}
+
+		var (
+			has bool
+			err error
+		)
+		m.fetching.Store(true)
+		for n := p.priority.Load(); n >= 0; n-- {
+			if has, err = p.NextSubscribers(); err != nil || !has {
+				break
+			}
+		}
+		m.fetching.Store(false)
 		if err != nil {
-			m.log.Printf("error processing campaign batch (%s): %v", p.camp.Name, err)
+			p.log.Error("error processing campaign batch ("+p.camp.Name+")", "error", err)
 			continue
 		}
 
@@ -281,9 +516,19 @@ func (m *Manager) Run() {
 			case m.nextPipes <- p:
 			default:
 			}
-		} else {
-			// Mark the pseudo counter that's added in makePipe() that is used
-			// to force a wait on a pipe.
+		} else if !p.park() {
+			// A pipe that was paused while fetching finds no subscribers as the
+			// campaign isn't running and stays parked.
+			//
+			// A pipe with deferred subscribers who aren't due yet is taken out of the
+			// rotation and re-queued when they're due.
+			if !p.retryAt.IsZero() {
+				p.waitRetry(time.Until(p.retryAt))
+				continue
+			}
+
+			// Otherwise, it's done. Mark the pseudo counter that's added in makePipe()
+			// that is used to force a wait on a pipe.
 			p.wg.Done()
 		}
 	}
@@ -319,23 +564,43 @@ func (m *Manager) GetTpl(id int) (*models.Template, error) {
 // TemplateFuncs returns the template functions to be applied into
 // compiled campaign templates.
 func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
+	// UTM params that are added to the campaign's tracked links. They're compiled
+	// once the function map is ready as they may use the functions themselves.
+	var utm []models.UTMParamTpl
+
 	f := template.FuncMap{
 		"TrackLink": func(url string, msg *CampaignMessage) string {
+			if len(utm) > 0 {
+				url = addURLParams(strings.ReplaceAll(url, "&amp;", "&"), msg.utmParams(utm))
+			}
+
+			if msg.test {
+				return url
+			}
+
 			subUUID := msg.Subscriber.UUID
 			if !m.cfg.IndividualTracking {
 				subUUID = dummyUUID
 			}
 
-			return m.trackLink(url, msg.Campaign.UUID, subUUID)
+			return m.trackLink(url, msg.Campaign.UUID, subUUID, msg.variantID())
 		},
 		"TrackView": func(msg *CampaignMessage) template.HTML {
+			if msg.test || !m.cfg.TrackViews || !msg.Campaign.ViewsTracked {
+				return ""
+			}
+
 			subUUID := msg.Subscriber.UUID
 			if !m.cfg.IndividualTracking {
 				subUUID = dummyUUID
 			}
 
-			return template.HTML(fmt.Sprintf(`<img src="%s" alt="" />`,
-				fmt.Sprintf(m.cfg.ViewTrackURL, msg.Campaign.UUID, subUUID)))
+			u := fmt.Sprintf(m.cfg.ViewTrackURL, msg.Campaign.UUID, subUUID)
+			if id := msg.variantID(); id > 0 {
+				u += fmt.Sprintf("?v=%d", id)
+			}
+
+			return template.HTML(fmt.Sprintf(`<img src="%s" alt="" />`, u))
 		},
 		"UnsubscribeURL": func(msg *CampaignMessage) string {
 			return msg.unsubURL
@@ -363,6 +628,15 @@ func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
 		f[k] = v
 	}
 
+	// Templates and partials get the functions without a campaign.
+	if c != nil {
+		if u, err := c.UTM.WithDefaults(m.cfg.UTM).Compile(f); err != nil {
+			m.log.Error("error compiling UTM params of campaign ("+c.Name+")", "error", err)
+		} else {
+			utm = u
+		}
+	}
+
 	return f
 }
 
@@ -379,6 +653,76 @@ func (m *Manager) StopCampaign(id int) {
 	m.pipesMut.RUnlock()
 }
 
+// ExcludeSubscribers drops the messages of the given subscribers that are already
+// queued for the running campaigns, for instance, after they've been blocklisted.
+func (m *Manager) ExcludeSubscribers(subIDs []int) {
+	m.pipesMut.RLock()
+	for _, p := range m.pipes {
+		p.exclude(subIDs)
+	}
+	m.pipesMut.RUnlock()
+}
+
+// SetCampaignPriority changes the send priority of a running campaign
+// from its next turn onwards.
+func (m *Manager) SetCampaignPriority(id, priority int) {
+	m.pipesMut.RLock()
+	if p, ok := m.pipes[id]; ok {
+		p.priority.Store(int32(priority))
+	}
+	m.pipesMut.RUnlock()
+}
+
+// PauseCampaign pauses a running campaign. No further subscribers are fetched
+// and the campaign's messages that are already queued are held, instead of being
+// dropped, till the campaign is resumed. The campaign's checkpoint in the store
+// is rewound to exclude the held messages so that they aren't lost if the campaign
+// is resumed after a restart. It returns false if the campaign isn't being processed.
+func (m *Manager) PauseCampaign(id int) bool {
+	m.pipesMut.RLock()
+	p, ok := m.pipes[id]
+	m.pipesMut.RUnlock()
+
+	if !ok || !p.pause() {
+		return false
+	}
+
+	if err := m.store.UpdateCampaignCheckpoint(id, p.checkpoint()); err != nil {
+		p.log.Error("error updating campaign ("+p.camp.Name+") checkpoint", "error", err)
+	}
+
+	p.log.Info("paused campaign (" + p.camp.Name + ")")
+	return true
+}
+
+// ResumeCampaign resumes a campaign paused with PauseCampaign() from where it
+// stopped. It returns false if the campaign isn't paused in the manager, for
+// instance, after a restart, in which case the campaign is picked up from its
+// checkpoint on the next scan once it's running.
+func (m *Manager) ResumeCampaign(id int) bool {
+	m.pipesMut.RLock()
+	p, ok := m.pipes[id]
+	m.pipesMut.RUnlock()
+
+	if !ok || !p.isPaused() {
+		return false
+	}
+
+	// Restore the checkpoint to skip the subscribers whose messages are held.
+	if id := p.queuedID.Load(); id > 0 {
+		if err := m.store.UpdateCampaignCheckpoint(p.camp.ID, int(id)); err != nil {
+			p.log.Error("error updating campaign ("+p.camp.Name+") checkpoint", "error", err)
+		}
+	}
+
+	if !p.resume() {
+		return false
+	}
+
+	p.log.Info("resumed campaign (" + p.camp.Name + ")")
+	return true
+}
+
 // Close closes and exits the campaign manager.
 func (m *Manager) Close() {
 	close(m.nextPipes)
@@ -396,10 +740,14 @@ func (m *Manager) scanCampaigns(tick time.Duration) {
 		select {
 		// Periodically scan the data source for campaigns to process.
 		case <-t.C:
+			if m.draining.Load() {
+				continue
+			}
+
 			ids, counts := m.getCurrentCampaigns()
 			campaigns, err := m.store.NextCampaigns(ids, counts)
 			if err != nil {
-				m.log.Printf("error fetching campaigns: %v", err)
+				m.log.Error("error fetching campaigns", "error", err)
 				continue
 			}
 
@@ -407,10 +755,10 @@ func (m *Manager) scanCampaigns(tick time.Duration) {
 				// Create a new pipe that'll handle this campaign's states.
 				p, err := m.newPipe(c)
 				if err != nil {
-					m.log.Printf("error processing campaign (%s): %v", c.Name, err)
+					m.log.Error("error processing campaign ("+c.Name+")", "error", err, "campaign_id", c.ID)
 					continue
 				}
-				m.log.Printf("start processing campaign (%s)", c.Name)
+				m.log.With("campaign_id", c.ID).Info("start processing campaign (" + c.Name + ")")
 
 				// If subscriber processing is busy, move on. Blocking and waiting
 				// can end up in a race condition where the waiting campaign's
@@ -424,6 +772,45 @@ func (m *Manager) scanCampaigns(tick time.Duration) {
 	}
 }
 
+// scanTxMessages is a blocking function that periodically queues the stored tx
+// messages that are due to be retried. On startup, this picks up the messages
+// that were queued but not sent before a shutdown or crash.
+func (m *Manager) scanTxMessages(tick time.Duration) {
+	t := time.NewTicker(tick)
+	defer t.Stop()
+
+	for {
+		if !m.draining.Load() {
+			m.requeueTxMessages()
+		}
+		<-t.C
+	}
+}
+
+// requeueTxMessages leases the stored tx messages that are due and queues them.
+// Messages that can't be queued, eg: when the queue is busy, are retried after
+// their lease.
+func (m *Manager) requeueTxMessages() {
+	for {
+		msgs, err := m.store.NextTxMessages(txScanBatch, txLease)
+		if err != nil {
+			m.log.Error("error fetching queued tx messages", "error", err)
+			return
+		}
+
+		for _, q := range msgs {
+			q.Message.TxUUID = q.UUID
+			if err := m.pushTx(txMessage{msg: q.Message, attempt: q.Attempts + 1}); err != nil {
+				return
+			}
+		}
+
+		if len(msgs) < txScanBatch {
+			return
+		}
+	}
+}
+
 // worker is a blocking function that perpetually listents to events (message) on different
 // queues and processes them.
 func (m *Manager) worker() {
@@ -437,18 +824,33 @@ func (m *Manager) worker() {
 				return
 			}
 
-			// If the campaign has ended, ignore the message.
-			if msg.pipe != nil && msg.pipe.stopped.Load() {
+			// On shutdown, after the grace period, the remaining messages are dropped.
+			// They stay outstanding in their pipes and are sent when the campaigns resume.
+			if msg.pipe != nil && m.dropping.Load() {
+				continue
+			}
+
+			// If the campaign has ended or the subscriber has since been
+			// blocklisted, ignore the message.
+			if msg.pipe != nil && (msg.pipe.stopped.Load() || msg.pipe.isExcluded(msg.Subscriber.ID)) {
+				msg.pipe.ack(msg.Subscriber.ID, false)
 				msg.pipe.wg.Done()
 				continue
 			}
 
+			// If the campaign is paused, hold the message till it's resumed.
+			// This doesn't count towards the message rate.
+			if msg.pipe != nil && msg.pipe.hold(msg) {
+				continue
+			}
+
 			// Pause on hitting the message rate.
 			if numMsg >= m.cfg.MessageRate {
 				time.Sleep(time.Second)
 				numMsg = 0
 			}
 			numMsg++
+			_ = m.throttle.Wait(context.Background())
 
 			// Outgoing message.
 			out := models.Message{
@@ -458,51 +860,35 @@ func (m *Manager) worker() {
 				ContentType: msg.Campaign.ContentType,
 				Body:        msg.body,
 				AltBody:     msg.altBody,
+				AMPBody:     msg.ampBody,
 				Subscriber:  msg.Subscriber,
 				Campaign:    msg.Campaign,
 				Attachments: msg.Campaign.Attachments,
 			}
 
-			h := textproto.MIMEHeader{}
-			h.Set(models.EmailHeaderCampaignUUID, msg.Campaign.UUID)
-			h.Set(models.EmailHeaderSubscriberUUID, msg.Subscriber.UUID)
-
-			// Attach List-Unsubscribe headers?
-			if m.cfg.UnsubHeader {
-				h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
-				h.Set("List-Unsubscribe", `<`+msg.unsubURL+`>`)
-			}
-
-			// Attach any custom headers.
-			if len(msg.Campaign.Headers) > 0 {
-				for _, set := range msg.Campaign.Headers {
-					for hdr, val := range set {
-						h.Add(hdr, val)
-					}
-				}
-			}
+			out.Headers = m.campaignHeaders(msg)
 
-			out.Headers = h
-
-			err := m.messengers[msg.Campaign.Messenger].Push(out)
+			err := m.push(msg.Campaign.Messenger, m.sandbox(out))
 			if err != nil {
-				m.log.Printf("error sending message in campaign %s: subscriber %d: %v", msg.Campaign.Name, msg.Subscriber.ID, err)
+				m.log.With("campaign_id", msg.Campaign.ID, "subscriber_id", msg.Subscriber.ID).Error(fmt.Sprintf("error sending message in campaign %s: subscriber %d", msg.Campaign.Name, msg.Subscriber.ID), "error", err)
 			}
 
 			// Increment the send rate or the error counter if there was an error.
 			if msg.pipe != nil {
 				// Mark the message as done.
+				msg.pipe.ack(msg.Subscriber.ID, err == nil)
 				msg.pipe.wg.Done()
 
 				if err != nil {
 					msg.pipe.OnError()
 				} else {
 					id := uint64(msg.Subscriber.ID)
-					if id > msg.pipe.lastID.Load() {
+					if id > msg.pipe.lastID.Load() && !msg.deferred {
 						msg.pipe.lastID.Store(uint64(msg.Subscriber.ID))
 					}
 					msg.pipe.rate.Incr(1)
 					msg.pipe.sent.Add(1)
+					msg.pipe.totalSent.Add(1)
 				}
 			}
 
@@ -512,12 +898,127 @@ func (m *Manager) worker() {
 				return
 			}
 
-			err := m.messengers[msg.Messenger].Push(msg)
+			err := m.push(msg.Messenger, m.sandbox(msg))
 			if err != nil {
-				m.log.Printf("error sending message '%s': %v", msg.Subject, err)
+				m.log.Error("error sending message '"+msg.Subject+"'", "error", err)
 			}
+
+		// Queued transactional message.
+		case tx, ok := <-m.txQ:
+			if !ok {
+				return
+			}
+
+			// Pause on hitting the message rate.
+			if numMsg >= m.cfg.MessageRate {
+				time.Sleep(time.Second)
+				numMsg = 0
+			}
+			numMsg++
+			_ = m.throttle.Wait(context.Background())
+
+			m.sendTx(tx)
+		}
+	}
+}
+
+// sendTx sends a queued tx message and records its status. On transient errors,
+// the message is retried with exponential backoff until it runs out of attempts.
+// The retries are picked up from the store by scanTxMessages.
+func (m *Manager) sendTx(tx txMessage) {
+	err := m.push(tx.msg.Messenger, m.sandbox(tx.msg))
+	if err == nil {
+		if err := m.store.UpdateTxMessage(tx.msg.TxUUID, models.TxStatusSent, tx.attempt, "", time.Time{}); err != nil {
+			m.log.Error("error updating tx message status ("+tx.msg.TxUUID+")", "error", err)
 		}
+		return
+	}
+
+	m.log.Error(fmt.Sprintf("error sending tx message '%s' (attempt %d)", tx.msg.Subject, tx.attempt), "error", err, "attempt", tx.attempt)
+
+	var (
+		status  = models.TxStatusFailed
+		retryAt time.Time
+	)
+	if tx.attempt < txMaxAttempts && isTransientErr(err) {
+		status = models.TxStatusQueued
+		retryAt = time.Now().Add(txRetryBackoff * time.Duration(1<<(tx.attempt-1)))
+	}
+
+	if err := m.store.UpdateTxMessage(tx.msg.TxUUID, status, tx.attempt, err.Error(), retryAt); err != nil {
+		m.log.Error("error updating tx message status ("+tx.msg.TxUUID+")", "error", err)
+	}
+}
+
+// campaignHeaders returns the headers of a campaign message with the campaign's
+// custom headers merged in.
+func (m *Manager) campaignHeaders(msg CampaignMessage) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	if msg.test {
+		// Leave out the campaign header so that bounces on test
+		// messages aren't recorded against the campaign.
+		h.Set(models.EmailHeaderTest, "true")
+	} else {
+		h.Set(models.EmailHeaderCampaignUUID, msg.Campaign.UUID)
+	}
+	h.Set(models.EmailHeaderSubscriberUUID, msg.Subscriber.UUID)
+
+	// Attach List-Unsubscribe headers? The campaign's setting, if any,
+	// overrides the global one.
+	unsubHeader := m.cfg.UnsubHeader
+	if msg.Campaign.UnsubscribeHeader.Valid {
+		unsubHeader = msg.Campaign.UnsubscribeHeader.Bool
+	}
+	if unsubHeader {
+		u := msg.unsubURL
+		if m.cfg.OneClickUnsubURL != nil && !msg.test {
+			u = m.cfg.OneClickUnsubURL(msg.Campaign.UUID, msg.Subscriber.UUID)
+		}
+
+		h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		h.Set("List-Unsubscribe", `<`+u+`>`)
+	}
+
+	// Attach any custom headers.
+	msg.Campaign.Headers.Merge(h)
+
+	return h
+}
+
+// sandbox rewrites the recipient of a message to the sandbox address if the
+// sandbox mode is on. The original recipients are preserved in the X-Original-To
+// header. Cc and Bcc headers, and the subscriber's attributes (which may have
+// recipients like phone numbers for other messengers) are dropped.
+func (m *Manager) sandbox(msg models.Message) models.Message {
+	if m.cfg.SandboxEmail == "" {
+		return msg
+	}
+
+	h := make(textproto.MIMEHeader, len(msg.Headers)+1)
+	for k, v := range msg.Headers {
+		h[k] = v
+	}
+	h.Del("Cc")
+	h.Del("Bcc")
+	h.Set("X-Original-To", strings.Join(msg.To, ", "))
+	msg.Headers = h
+
+	msg.To = []string{m.cfg.SandboxEmail}
+	msg.Subscriber.Email = m.cfg.SandboxEmail
+	msg.Subscriber.Attribs = nil
+
+	return msg
+}
+
+// isTransientErr checks if a message push error is worth retrying. Permanent
+// SMTP failures (5xx) are not. All other errors (eg: network errors, 4xx) are.
+func isTransientErr(err error) bool {
+	var e *textproto.Error
+	if errors.As(err, &e) {
+		return e.Code < 500
 	}
+
+	return true
 }
 
 // getRunningCampaignIDs returns the IDs of campaigns currently being processed.
@@ -565,20 +1066,21 @@ func (m *Manager) isCampaignProcessing(id int) bool {
 
 // trackLink register a URL and return its UUID to be used in message templates
 // for tracking links.
-func (m *Manager) trackLink(url, campUUID, subUUID string) string {
+// If the message was sent an A/B subject variant, the variant ID is appended to the URL.
+func (m *Manager) trackLink(url, campUUID, subUUID string, variantID int) string {
 	url = strings.ReplaceAll(url, "&amp;", "&")
 
 	m.linksMut.RLock()
 	if uu, ok := m.links[url]; ok {
 		m.linksMut.RUnlock()
-		return fmt.Sprintf(m.cfg.LinkTrackURL, uu, campUUID, subUUID)
+		return makeLinkTrackURL(m.cfg.LinkTrackURL, uu, campUUID, subUUID, variantID)
 	}
 	m.linksMut.RUnlock()
 
 	// Register link.
 	uu, err := m.store.CreateLink(url)
 	if err != nil {
-		m.log.Printf("error registering tracking for link '%s': %v", url, err)
+		m.log.Error("error registering tracking for link '"+url+"'", "error", err)
 
 		// If the registration fails, fail over to the original URL.
 		return url
@@ -588,22 +1090,78 @@ func (m *Manager) trackLink(url, campUUID, subUUID string) string {
 	m.links[url] = uu
 	m.linksMut.Unlock()
 
-	return fmt.Sprintf(m.cfg.LinkTrackURL, uu, campUUID, subUUID)
+	return makeLinkTrackURL(m.cfg.LinkTrackURL, uu, campUUID, subUUID, variantID)
+}
+
+// addURLParams adds query params to an http(s) URL. Params that the URL already
+// has aren't overwritten, and its existing query and fragment are retained as is.
+func addURLParams(link string, params url.Values) string {
+	if len(params) == 0 {
+		return link
+	}
+	if l := strings.ToLower(link); !strings.HasPrefix(l, "http://") && !strings.HasPrefix(l, "https://") {
+		return link
+	}
+
+	// The fragment goes after the query.
+	base, frag := link, ""
+	if i := strings.IndexByte(link, '#'); i >= 0 {
+		base, frag = link[:i], link[i:]
+	}
+
+	var (
+		sep      = "?"
+		existing url.Values
+	)
+	if i := strings.IndexByte(base, '?'); i >= 0 {
+		existing, _ = url.ParseQuery(base[i+1:])
+		sep = "&"
+		if i == len(base)-1 || strings.HasSuffix(base, "&") {
+			sep = ""
+		}
+	}
+
+	add := url.Values{}
+	for k, v := range params {
+		if _, ok := existing[k]; !ok {
+			add[k] = v
+		}
+	}
+	if len(add) == 0 {
+		return link
+	}
+
+	return base + sep + add.Encode() + frag
+}
+
+// makeLinkTrackURL returns a link tracking URL with the optional variant ID.
+func makeLinkTrackURL(tpl, linkUUID, campUUID, subUUID string, variantID int) string {
+	u := fmt.Sprintf(tpl, linkUUID, campUUID, subUUID)
+	if variantID > 0 {
+		u += fmt.Sprintf("?v=%d", variantID)
+	}
+	return u
 }
 
 // sendNotif sends a notification to registered admin e-mails.
-func (m *Manager) sendNotif(c *models.Campaign, status, reason string) error {
+func (m *Manager) sendNotif(c *models.Campaign, status, reason string, failed int) error {
 	var (
 		subject = fmt.Sprintf("%s: %s", strings.Title(status), c.Name)
 		data    = map[string]interface{}{
-			"ID":     c.ID,
-			"Name":   c.Name,
-			"Status": status,
-			"Sent":   c.Sent,
-			"ToSend": c.ToSend,
-			"Reason": reason,
+			"ID":       c.ID,
+			"Name":     c.Name,
+			"Status":   status,
+			"Sent":     c.Sent,
+			"ToSend":   c.ToSend,
+			"Failed":   failed,
+			"Duration": "",
+			"Reason":   reason,
 		}
 	)
+	if c.StartedAt.Valid {
+		data["Duration"] = time.Since(c.StartedAt.Time).Round(time.Second).String()
+	}
+
 	return m.notifCB(subject, data)
 }
 
@@ -621,6 +1179,12 @@ func (m *Manager) makeGnericFuncMap() template.FuncMap {
 		"Safe": func(safeHTML string) template.HTML {
 			return template.HTML(safeHTML)
 		},
+		"MediaURL": func(name string) string {
+			if m.cfg.MediaURLs == nil {
+				return ""
+			}
+			return m.cfg.MediaURLs.GetURL(name)
+		},
 	}
 
 	for k, v := range sprig.GenericFuncMap() {
@@ -0,0 +1,191 @@
+package manager
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/internal/logger"
+	"github.com/knadh/listmonk/models"
+)
+
+func newTestManager(cfg Config) *Manager {
+	return New(cfg, nil, nil, nil, logger.New(logger.Opt{Out: io.Discard}))
+}
+
+func TestAddURLParams(t *testing.T) {
+	utm := url.Values{"utm_source": {"listmonk"}, "utm_medium": {"email"}}
+
+	cases := []struct {
+		name string
+		link string
+		exp  string
+	}{
+		{"no query", "https://site.com/page", "https://site.com/page?utm_medium=email&utm_source=listmonk"},
+		{"existing query", "https://site.com/page?id=1", "https://site.com/page?id=1&utm_medium=email&utm_source=listmonk"},
+		{"trailing ?", "https://site.com/page?", "https://site.com/page?utm_medium=email&utm_source=listmonk"},
+		{"trailing &", "https://site.com/page?id=1&", "https://site.com/page?id=1&utm_medium=email&utm_source=listmonk"},
+		{"fragment", "https://site.com/page#top", "https://site.com/page?utm_medium=email&utm_source=listmonk#top"},
+		{"query and fragment", "http://site.com/?a=b#x?y", "http://site.com/?a=b&utm_medium=email&utm_source=listmonk#x?y"},
+		{"existing param kept", "https://site.com/?utm_source=blog", "https://site.com/?utm_source=blog&utm_medium=email"},
+		{"all params exist", "https://site.com/?utm_source=a&utm_medium=b", "https://site.com/?utm_source=a&utm_medium=b"},
+		{"mailto", "mailto:hello@site.com", "mailto:hello@site.com"},
+		{"template tag", "{{ UnsubscribeURL }}", "{{ UnsubscribeURL }}"},
+		{"relative", "/page", "/page"},
+	}
+
+	for _, c := range cases {
+		if got := addURLParams(c.link, utm); got != c.exp {
+			t.Errorf("%s: expected %s, got %s", c.name, c.exp, got)
+		}
+	}
+
+	if got := addURLParams("https://site.com/?a=1", nil); got != "https://site.com/?a=1" {
+		t.Errorf("no params: got %s", got)
+	}
+}
+
+func TestTemplateFuncsUTM(t *testing.T) {
+	m := newTestManager(Config{UTM: models.CampaignUTM{Source: "listmonk", Medium: "email", Campaign: "default"}})
+
+	// Templates and partials are compiled without a campaign.
+	if f := m.TemplateFuncs(nil); f["TrackLink"] == nil {
+		t.Fatal("expected TrackLink in the funcs without a campaign")
+	}
+
+	camp := &models.Campaign{Name: "test", UTM: models.CampaignUTM{Campaign: "spring-sale", Content: "{{ .Subscriber.Name }}"}}
+	f := m.TemplateFuncs(camp)
+	track := f["TrackLink"].(func(string, *CampaignMessage) string)
+
+	msg := &CampaignMessage{Campaign: camp, Subscriber: models.Subscriber{Name: "Jane"}, test: true}
+	got := track("https://site.com/?ref=x#top", msg)
+
+	// The campaign's values override the defaults and the rest are the defaults.
+	exp := "https://site.com/?ref=x&utm_campaign=spring-sale&utm_content=Jane&utm_medium=email&utm_source=listmonk#top"
+	if got != exp {
+		t.Errorf("expected %s, got %s", exp, got)
+	}
+}
+
+func TestCampaignUTMWithDefaults(t *testing.T) {
+	d := models.CampaignUTM{Source: "listmonk", Medium: "email", Campaign: "default", Content: "c"}
+	got := models.CampaignUTM{Source: "newsletter", Content: ""}.WithDefaults(d)
+
+	exp := models.CampaignUTM{Source: "newsletter", Medium: "email", Campaign: "default", Content: "c"}
+	if got != exp {
+		t.Errorf("expected %+v, got %+v", exp, got)
+	}
+}
+
+func TestMessageThrottle(t *testing.T) {
+	var (
+		st   = newTestStore()
+		msgr = &testMessenger{}
+	)
+	m := newTestManager(Config{Concurrency: 4, MessageRate: 1000, MessageThrottle: 20})
+	m.store = st
+	if err := m.AddMessenger(msgr); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 500; i++ {
+		if err := m.QueueTxMessage(testTxMsg(fmt.Sprintf("tx-%d", i)), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go m.Run()
+
+	// sent returns the number of messages sent in a second after the given warmup
+	// in which the throttle's burst is used up.
+	sent := func(warmup time.Duration) int {
+		time.Sleep(warmup)
+
+		msgr.mut.Lock()
+		n := len(msgr.msgs)
+		msgr.mut.Unlock()
+
+		time.Sleep(time.Second)
+
+		msgr.mut.Lock()
+		defer msgr.mut.Unlock()
+		return len(msgr.msgs) - n
+	}
+
+	if n := sent(time.Millisecond * 500); n < 15 || n > 25 {
+		t.Errorf("expected ~20 messages a second, got %d", n)
+	}
+
+	// Raising the limit mid-run takes effect right away.
+	m.SetMessageThrottle(100)
+	if n := sent(time.Millisecond * 200); n < 80 || n > 120 {
+		t.Errorf("expected ~100 messages a second after raising the throttle, got %d", n)
+	}
+
+	// Lowering it too.
+	m.SetMessageThrottle(10)
+	if n := sent(time.Millisecond * 200); n < 5 || n > 15 {
+		t.Errorf("expected ~10 messages a second after lowering the throttle, got %d", n)
+	}
+	if m.GetMessageThrottle() != 10 {
+		t.Errorf("expected the throttle to be 10, got %d", m.GetMessageThrottle())
+	}
+}
+
+func TestCampaignHeaders(t *testing.T) {
+	m := newTestManager(Config{UnsubHeader: true})
+
+	c := testCampaign(1)
+	c.Headers = models.Headers{
+		{"X-SES-CONFIGURATION-SET": "marketing"},
+		{"List-ID": "<news.listmonk.app>"},
+		{"List-Unsubscribe": "<mailto:unsub@listmonk.app>"},
+	}
+	msg := CampaignMessage{Campaign: c, Subscriber: testSubscriber(1), unsubURL: "https://listmonk.app/unsub"}
+
+	h := m.campaignHeaders(msg)
+	for k, v := range map[string]string{
+		"X-Ses-Configuration-Set":        "marketing",
+		"List-Id":                        "<news.listmonk.app>",
+		"List-Unsubscribe":               "<mailto:unsub@listmonk.app>",
+		"List-Unsubscribe-Post":          "List-Unsubscribe=One-Click",
+		models.EmailHeaderCampaignUUID:   "camp-uuid",
+		models.EmailHeaderSubscriberUUID: "sub-uuid",
+	} {
+		if got := h.Values(k); len(got) != 1 || got[0] != v {
+			t.Errorf("expected header %s: %s, got %v", k, v, got)
+		}
+	}
+
+	// Without custom headers, the default List-Unsubscribe is used.
+	c.Headers = nil
+	if u := m.campaignHeaders(msg).Get("List-Unsubscribe"); u != "<https://listmonk.app/unsub>" {
+		t.Errorf("expected the default List-Unsubscribe header, got %s", u)
+	}
+}
+
+func TestCampaignMessageFrom(t *testing.T) {
+	m := newTestManager(Config{FromEmail: "listmonk <noreply@listmonk.app>", UnsubURL: "%s/%s"})
+
+	c := testCampaign(1)
+	c.FromEmail = ""
+	c.ListFromEmail = "brand@listmonk.app"
+	c.ListFromName = "Brand"
+	if err := c.CompileTemplate(m.TemplateFuncs(c)); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := m.NewCampaignMessage(c, testSubscriber(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.from != `"Brand" <brand@listmonk.app>` {
+		t.Errorf("expected the list's sending identity, got %q", msg.from)
+	}
+
+	c.ListFromEmail = ""
+	if msg, _ = m.NewCampaignMessage(c, testSubscriber(1)); msg.from != m.cfg.FromEmail {
+		t.Errorf("expected the global from_email, got %q", msg.from)
+	}
+}
@@ -3,22 +3,63 @@ package manager
 import (
 	"bytes"
 	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
 
+	"github.com/knadh/listmonk/internal/inliner"
 	"github.com/knadh/listmonk/models"
 )
 
+// The hidden span that a preheader is wrapped in. The styles hide it across
+// clients, including Outlook (mso-hide).
+const (
+	preheaderStart = `<span style="display: none !important; visibility: hidden; mso-hide: all; font-size: 1px; line-height: 1px; max-height: 0; max-width: 0; opacity: 0; overflow: hidden;">`
+	preheaderEnd   = `</span>`
+)
+
+var reBodyTag = regexp.MustCompile(`(?i)<body(\s[^>]*)?>`)
+
 // NewCampaignMessage creates and returns a CampaignMessage that is made available
 // to message templates while they're compiled. It represents a message from
 // a campaign that's bound to a single Subscriber.
 func (m *Manager) NewCampaignMessage(c *models.Campaign, s models.Subscriber) (CampaignMessage, error) {
+	return m.newCampaignMessage(c, s, nil, false, nil)
+}
+
+// NewTestCampaignMessage creates a CampaignMessage for a test send. Links and views
+// in test messages are not tracked and bounces aren't recorded against the campaign.
+func (m *Manager) NewTestCampaignMessage(c *models.Campaign, s models.Subscriber) (CampaignMessage, error) {
+	return m.newCampaignMessage(c, s, nil, true, nil)
+}
+
+// newCampaignMessage creates a CampaignMessage with an optional A/B subject variant
+// whose subject replaces the campaign's subject. css is the campaign's inliner that
+// caches its parsed stylesheets, and if it's nil, the message's CSS is inlined afresh.
+func (m *Manager) newCampaignMessage(c *models.Campaign, s models.Subscriber, v *models.CampaignVariant, test bool, css *inliner.Inliner) (CampaignMessage, error) {
 	msg := CampaignMessage{
 		Campaign:   c,
 		Subscriber: s,
 
 		subject:  c.Subject,
-		from:     c.FromEmail,
+		from:     c.From(m.cfg.FromEmail),
 		to:       s.Email,
 		unsubURL: fmt.Sprintf(m.cfg.UnsubURL, c.UUID, s.UUID),
+		variant:  v,
+		test:     test,
+
+		inlineCSS: m.cfg.InlineCSS,
+		css:       css,
+	}
+	if v != nil {
+		msg.subject = v.Subject
+	}
+	if m.cfg.SignedUnsubURL != nil && !test {
+		msg.unsubURL = m.cfg.SignedUnsubURL(c.UUID, s.UUID)
+	}
+	if c.InlineCSS.Valid {
+		msg.inlineCSS = c.InlineCSS.Bool
 	}
 
 	if err := msg.render(); err != nil {
@@ -28,28 +69,95 @@ func (m *Manager) NewCampaignMessage(c *models.Campaign, s models.Subscriber) (C
 	return msg, nil
 }
 
+// utmParams returns the message's UTM params with the template values rendered.
+// Params whose templates fail to render are left out.
+func (m *CampaignMessage) utmParams(tpls []models.UTMParamTpl) url.Values {
+	if m.utmLoaded {
+		return m.utm
+	}
+	m.utmLoaded = true
+
+	m.utm = url.Values{}
+	b := bytes.Buffer{}
+	for _, p := range tpls {
+		v := p.Value
+		if p.Tpl != nil {
+			b.Reset()
+			if err := p.Tpl.ExecuteTemplate(&b, models.ContentTpl, m); err != nil {
+				continue
+			}
+			v = strings.TrimSpace(b.String())
+		}
+		if v != "" {
+			m.utm.Set(p.Name, v)
+		}
+	}
+
+	return m.utm
+}
+
 // render takes a Message, executes its pre-compiled Campaign.Tpl
 // and applies the resultant bytes to Message.body to be used in messages.
 func (m *CampaignMessage) render() error {
 	out := bytes.Buffer{}
 
 	// Render the subject if it's a template.
-	if m.Campaign.SubjectTpl != nil {
-		if err := m.Campaign.SubjectTpl.ExecuteTemplate(&out, models.ContentTpl, m); err != nil {
+	subjTpl := m.Campaign.SubjectTpl
+	if m.variant != nil {
+		subjTpl = m.variant.SubjectTpl
+	}
+	if subjTpl != nil {
+		if err := subjTpl.ExecuteTemplate(&out, models.ContentTpl, m); err != nil {
 			return err
 		}
 		m.subject = out.String()
 		out.Reset()
 	}
 
+	// Render the preheader if it's a template.
+	preheader := m.Campaign.Preheader.String
+	if m.Campaign.PreheaderTpl != nil {
+		if err := m.Campaign.PreheaderTpl.ExecuteTemplate(&out, models.ContentTpl, m); err != nil {
+			return err
+		}
+		preheader = out.String()
+		out.Reset()
+	}
+	preheader = strings.TrimSpace(preheader)
+
 	// Compile the main template.
 	if err := m.Campaign.Tpl.ExecuteTemplate(&out, models.BaseTpl, m); err != nil {
 		return err
 	}
 	m.body = out.Bytes()
 
+	// Inline the CSS after the template is rendered, by when the tracking
+	// links have already been rendered into the body.
+	if m.inlineCSS && m.Campaign.ContentType != models.CampaignContentTypePlain {
+		css := m.css
+		if css == nil {
+			css = inliner.New()
+		}
+
+		b, err := css.Inline(m.body)
+		if err != nil {
+			return fmt.Errorf("error inlining CSS: %v", err)
+		}
+		m.body = b
+	}
+
+	// Insert the preheader at the top of the body, which for plain text
+	// messages is its opening line.
+	if preheader != "" {
+		if m.Campaign.ContentType == models.CampaignContentTypePlain {
+			m.body = append([]byte(preheader+"\n\n"), m.body...)
+		} else {
+			m.body = insertPreheader(m.body, preheader)
+		}
+	}
+
 	// Is there an alt body?
-	if m.Campaign.ContentType != models.CampaignContentTypePlain && m.Campaign.AltBody.Valid {
+	if m.Campaign.ContentType != models.CampaignContentTypePlain && (m.Campaign.AltBody.Valid || m.Campaign.AltBodyTpl != nil) {
 		if m.Campaign.AltBodyTpl != nil {
 			b := bytes.Buffer{}
 			if err := m.Campaign.AltBodyTpl.ExecuteTemplate(&b, models.ContentTpl, m); err != nil {
@@ -59,11 +167,48 @@ func (m *CampaignMessage) render() error {
 		} else {
 			m.altBody = []byte(m.Campaign.AltBody.String)
 		}
+
+		if preheader != "" {
+			m.altBody = append([]byte(preheader+"\n\n"), m.altBody...)
+		}
+	}
+
+	// Is there an AMP body?
+	if m.Campaign.ContentType != models.CampaignContentTypePlain && m.Campaign.AMPTpl != nil {
+		b := bytes.Buffer{}
+		if err := m.Campaign.AMPTpl.ExecuteTemplate(&b, models.ContentTpl, m); err != nil {
+			return err
+		}
+		m.ampBody = b.Bytes()
 	}
 
 	return nil
 }
 
+// insertPreheader inserts the preheader as hidden text right after the <body> tag
+// of an HTML body, or if there's none, at the beginning of the body.
+func insertPreheader(body []byte, preheader string) []byte {
+	span := []byte(preheaderStart + html.EscapeString(preheader) + preheaderEnd)
+
+	pos := 0
+	if loc := reBodyTag.FindIndex(body); loc != nil {
+		pos = loc[1]
+	}
+
+	out := make([]byte, 0, len(body)+len(span))
+	out = append(out, body[:pos]...)
+	out = append(out, span...)
+	return append(out, body[pos:]...)
+}
+
+// variantID returns the ID of the message's A/B subject variant, if any.
+func (m *CampaignMessage) variantID() int {
+	if m.variant == nil {
+		return 0
+	}
+	return m.variant.ID
+}
+
 // Subject returns a copy of the message subject
 func (m *CampaignMessage) Subject() string {
 	return m.subject
@@ -82,3 +227,10 @@ func (m *CampaignMessage) AltBody() []byte {
 	copy(out, m.altBody)
 	return out
 }
+
+// AMPBody returns a copy of the message's AMP body.
+func (m *CampaignMessage) AMPBody() []byte {
+	out := make([]byte, len(m.ampBody))
+	copy(out, m.ampBody)
+	return out
+}
@@ -0,0 +1,52 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/knadh/listmonk/internal/metrics"
+	"github.com/knadh/listmonk/models"
+)
+
+// Maximum number of distinct messengers that counters are labelled by.
+const maxMetricsMessengers = 50
+
+// Send latency histogram buckets in seconds.
+var sendLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// push pushes a message via the given messenger and records its latency and result.
+func (m *Manager) push(messenger string, msg models.Message) error {
+	m.activeWorkers.Add(1)
+	defer m.activeWorkers.Add(-1)
+
+	start := time.Now()
+	err := m.messengers[messenger].Push(msg)
+	m.sendLatency.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		m.msgFailed.Inc(messenger)
+	} else {
+		m.msgSent.Inc(messenger)
+	}
+
+	return err
+}
+
+// WriteMetrics writes the manager's current queue and worker metrics.
+// Campaigns are deliberately not used as labels as there may be any number of them.
+func (m *Manager) WriteMetrics(w *metrics.Writer) {
+	w.Gauge("listmonk_queue_depth", "Number of messages waiting in the queue.", float64(len(m.campMsgQ)), "queue", "campaign")
+	w.Gauge("listmonk_queue_depth", "", float64(len(m.msgQ)), "queue", "message")
+	w.Gauge("listmonk_queue_depth", "", float64(len(m.txQ)), "queue", "tx")
+
+	m.pipesMut.RLock()
+	numCamps := len(m.pipes)
+	m.pipesMut.RUnlock()
+	w.Gauge("listmonk_running_campaigns", "Number of campaigns being processed.", float64(numCamps))
+
+	w.Gauge("listmonk_workers", "Number of message workers.", float64(m.cfg.Concurrency))
+	w.Gauge("listmonk_active_workers", "Number of message workers currently sending a message.", float64(m.activeWorkers.Load()))
+
+	w.CounterVec("listmonk_messages_sent_total", "Messages sent by messenger.", "messenger", m.msgSent)
+	w.CounterVec("listmonk_messages_failed_total", "Messages that failed to send by messenger.", "messenger", m.msgFailed)
+	w.Histogram("listmonk_send_duration_seconds", "Time taken by messengers to send a message.", m.sendLatency)
+}
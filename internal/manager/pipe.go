@@ -2,24 +2,108 @@ package manager
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
+	"net/mail"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/knadh/listmonk/internal/inliner"
+	"github.com/knadh/listmonk/internal/logger"
 	"github.com/knadh/listmonk/models"
 	"github.com/paulbellamy/ratecounter"
 )
 
+const (
+	// Minimum interval after which deferred subscribers are retried.
+	deferRetryInterval = time.Minute
+
+	// Duration for which deferred subscribers who are being retried are leased. If
+	// their messages aren't processed by then, eg: on a shutdown, they're retried again.
+	deferLease = time.Minute * 10
+)
+
 type pipe struct {
 	camp       *models.Campaign
+	log        *logger.Logger
 	rate       *ratecounter.RateCounter
 	wg         *sync.WaitGroup
 	sent       atomic.Int64
+	totalSent  atomic.Int64
 	lastID     atomic.Uint64
 	errors     atomic.Uint64
 	stopped    atomic.Bool
 	withErrors atomic.Bool
 
+	// Send priority of the campaign that can be changed while it's running.
+	priority atomic.Int32
+
+	// IDs of the first and the last subscribers whose messages were queued.
+	firstID  atomic.Uint64
+	queuedID atomic.Uint64
+
+	// Subscribers whose queued messages are yet to be sent (by the number of
+	// messages with per-list copies), and the subscribers who have been sent
+	// messages that are yet to be recorded in the store.
+	outstanding map[int]int
+	delivered   []int
+
+	// Deferred subscribers whose messages have been queued on retrying them (by the
+	// number of copies), and the ones whose messages have been processed and whose
+	// deferrals are yet to be deleted from the store.
+	retrying   map[int]int
+	undeferred []int
+	outMut     sync.Mutex
+
+	// Serializes the writes of the delivery records so that a message on whose
+	// ack a write is in progress is recorded by the next one.
+	flushMut sync.Mutex
+
+	// Subscribers who have been blocklisted while the campaign is running and
+	// whose queued messages are dropped.
+	excluded map[int]struct{}
+	exclMut  sync.RWMutex
+
+	// Lowercased address of the campaign's From e-mail.
+	fromEmail string
+
+	// CSS inliner that caches the campaign's parsed stylesheets across messages.
+	css *inliner.Inliner
+
+	// A paused pipe stops fetching subscribers and holds the messages that are
+	// dequeued for it till it's resumed. parked indicates that the pipe has been
+	// taken out of nextPipes by Run() and has to be re-queued on resuming.
+	paused   bool
+	parked   bool
+	held     []CampaignMessage
+	pauseMut sync.Mutex
+
+	// The rolling per-subscriber message cap of the campaign (0 disables it), and
+	// whether the campaign's sends are recorded, for its own cap or other campaigns'.
+	msgCap     int
+	trackSends bool
+
+	// When the earliest of the campaign's deferred subscribers are due to be retried
+	// if all of them aren't yet. This is only accessed by NextSubscribers() and Run().
+	// retryTimer re-queues the pipe that has been waiting for them.
+	retryAt    time.Time
+	retryTimer *time.Timer
+
+	// A/B subject variants that are assigned to messages by weight. In the sampling
+	// phase, the pipe ends once sampleSize subscribers have been sent the variants,
+	// after which the winner is picked and sent to the rest of the subscribers.
+	// These are only accessed by NextSubscribers() and cleanup().
+	variants    []models.CampaignVariant
+	variantSent map[int]int
+	sampleSize  int
+	sampled     int
+	sampleDone  bool
+
+	// Cache of subscriber time zones for the campaign's send window.
+	locations map[string]*time.Location
+
 	m *Manager
 }
 
@@ -44,9 +128,32 @@ func (m *Manager) newPipe(c *models.Campaign) (*pipe, error) {
 	// Add the campaign to the active map.
 	p := &pipe{
 		camp: c,
+		log:  m.log.With("campaign_id", c.ID),
 		rate: ratecounter.NewRateCounter(time.Minute),
 		wg:   &sync.WaitGroup{},
 		m:    m,
+
+		outstanding: make(map[int]int),
+		retrying:    make(map[int]int),
+		css:         inliner.New(),
+	}
+
+	// The campaign isn't sent to its own From address.
+	if a, err := mail.ParseAddress(c.From(m.cfg.FromEmail)); err == nil {
+		p.fromEmail = strings.ToLower(a.Address)
+	}
+	p.priority.Store(int32(c.Priority))
+
+	// Get the per-subscriber message cap applicable to the campaign's lists.
+	msgCap, track, err := m.store.GetCampaignMessageCap(c.ID, m.cfg.MaxSubscriberMessages)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching campaign message cap (%s): %v", c.Name, err)
+	}
+	p.msgCap, p.trackSends = msgCap, track
+
+	// Load any A/B subject variants.
+	if err := p.loadVariants(); err != nil {
+		return nil, err
 	}
 
 	// Increment the waitgroup so that Wait() blocks immediately. This is necessary
@@ -75,15 +182,110 @@ func (m *Manager) newPipe(c *models.Campaign) (*pipe, error) {
 // in the current batch or not. A false indicates that all subscribers
 // have been processed, or that a campaign has been paused or cancelled.
 func (p *pipe) NextSubscribers() (bool, error) {
+	p.retryAt = time.Time{}
+	limit := p.m.cfg.BatchSize
+
+	// In the A/B variant sampling phase, only fetch as many subscribers as
+	// there are left in the sample.
+	if p.sampleSize > 0 {
+		if p.sampled >= p.sampleSize {
+			p.sampleDone = true
+			return false, nil
+		}
+
+		if n := p.sampleSize - p.sampled; n < limit {
+			limit = n
+		}
+	}
+
 	// Fetch a batch of subscribers.
-	subs, err := p.m.store.NextSubscribers(p.camp.ID, p.m.cfg.BatchSize)
+	subs, err := p.m.store.NextSubscribers(p.camp.ID, limit)
 	if err != nil {
 		return false, fmt.Errorf("error fetching campaign subscribers (%s): %v", p.camp.Name, err)
 	}
 
-	// There are no subscribers.
+	// There are no subscribers. Retry the deferred subscribers who are due.
+	retry := false
 	if len(subs) == 0 {
-		return false, nil
+		if p.stopped.Load() {
+			return false, nil
+		}
+
+		// Record the processed messages of deferred subscribers first so that they're
+		// not retried again.
+		p.flushDeliveries()
+
+		if subs, err = p.m.store.NextDeferredSubscribers(p.camp.ID, limit, deferLease); err != nil {
+			return false, fmt.Errorf("error fetching deferred campaign subscribers (%s): %v", p.camp.Name, err)
+		}
+
+		// None are due. If there are deferred subscribers left, the pipe waits for them.
+		if len(subs) == 0 {
+			at, err := p.m.store.GetCampaignNextDeferral(p.camp.ID)
+			if err != nil {
+				return false, fmt.Errorf("error fetching campaign deferrals (%s): %v", p.camp.Name, err)
+			}
+			if !at.IsZero() {
+				// The retried subscribers whose messages are still queued are leased and
+				// the pipe checks back on them sooner.
+				if p.isRetrying() {
+					at = time.Time{}
+				}
+				p.retryAt = maxTime(at, time.Now().Add(deferRetryInterval))
+			}
+
+			return false, nil
+		}
+		retry = true
+	}
+	// A subscriber on multiple target lists is sent a single message unless the
+	// campaign sends per-list copies.
+	if !p.camp.PerListCopies {
+		subs = dedupeSubscribers(subs)
+	}
+	fetched := subs
+
+	// Skip the campaign's own From address.
+	if p.fromEmail != "" {
+		subs = p.filterSelf(subs)
+	}
+
+	// Skip subscribers whose e-mail domains are blocked by the domain rules.
+	if p.m.cfg.DomainRules != nil {
+		subs = p.filterDomains(subs)
+	}
+
+	// Skip the subscribers on the campaign's exclusion lists and the recipients
+	// of its excluded campaigns.
+	if len(p.camp.ExcludeListIDs) > 0 || len(p.camp.ExcludeCampaignIDs) > 0 {
+		if subs, err = p.filterExcluded(subs); err != nil {
+			return false, fmt.Errorf("error checking campaign exclusions (%s): %v", p.camp.Name, err)
+		}
+	}
+
+	// Deferred subscribers who are skipped aren't retried again.
+	if retry && len(subs) < len(fetched) {
+		p.undefer(fetched, subs)
+	}
+
+	// Defer subscribers for whom it's currently outside the campaign's send window
+	// and the ones who have hit the per-subscriber message cap.
+	var (
+		now = time.Now()
+		def = newDeferrals()
+	)
+	if p.camp.CampaignSendWindow.IsSet() {
+		subs = p.filterSendWindow(subs, now, def)
+	}
+	if p.msgCap > 0 {
+		if subs, err = p.filterCapped(subs, now, def); err != nil {
+			return false, fmt.Errorf("error checking subscriber message caps (%s): %v", p.camp.Name, err)
+		}
+	}
+	if len(def.items) > 0 {
+		if err := p.m.store.DeferCampaignSubscribers(p.camp.ID, def.items); err != nil {
+			return false, fmt.Errorf("error deferring campaign subscribers (%s): %v", p.camp.Name, err)
+		}
 	}
 
 	// Is there a sliding window limit configured?
@@ -93,15 +295,40 @@ func (p *pipe) NextSubscribers() (bool, error) {
 
 	// Push messages.
 	for _, s := range subs {
+		// Stop queuing on shutdown. The subscribers that aren't queued are
+		// fetched again when the campaign resumes.
+		if p.m.draining.Load() {
+			break
+		}
+
 		msg, err := p.newMessage(s)
 		if err != nil {
-			p.m.log.Printf("error rendering message (%s) (%s): %v", p.camp.Name, s.Email, err)
+			p.log.With("subscriber_id", s.ID).Error("error rendering message ("+p.camp.Name+") ("+s.Email+")", "error", err)
+			if retry {
+				p.undefer([]models.Subscriber{s}, nil)
+			}
 			continue
 		}
 
 		// Push the message to the queue while blocking and waiting until
 		// the queue is drained.
-		p.m.campMsgQ <- msg
+		if p.trackSends {
+			p.m.reserveSends([]int{s.ID})
+		}
+		if retry {
+			msg.deferred = true
+			p.trackRetry(s.ID)
+			p.m.campMsgQ <- msg
+		} else {
+			p.track(s.ID)
+			p.m.campMsgQ <- msg
+
+			id := uint64(s.ID)
+			p.firstID.CompareAndSwap(0, id)
+			if id > p.queuedID.Load() {
+				p.queuedID.Store(id)
+			}
+		}
 
 		// Check if the sliding window is active.
 		if hasSliding {
@@ -119,11 +346,11 @@ func (p *pipe) NextSubscribers() (bool, error) {
 			if p.m.slidingCount >= p.m.cfg.SlidingWindowRate {
 				wait := p.m.cfg.SlidingWindowDuration - diff
 
-				p.m.log.Printf("messages exceeded (%d) for the window (%v since %s). Sleeping for %s.",
+				p.log.Info(fmt.Sprintf("messages exceeded (%d) for the window (%v since %s). Sleeping for %s.",
 					p.m.slidingCount,
 					p.m.cfg.SlidingWindowDuration,
 					p.m.slidingStart.Format(time.RFC822Z),
-					wait.Round(time.Second)*1)
+					wait.Round(time.Second)*1))
 
 				p.m.slidingCount = 0
 				time.Sleep(wait)
@@ -134,6 +361,278 @@ func (p *pipe) NextSubscribers() (bool, error) {
 	return true, nil
 }
 
+// filterCapped returns the subscribers who can be sent a message and defers the ones
+// who have hit the rolling message cap. Along with the sends recorded in the store,
+// the messages in any campaign that are queued or whose sends are yet to be recorded
+// count towards the cap. Capped subscribers are retried when the earliest of their
+// sends falls out of the 24 hour window.
+func (p *pipe) filterCapped(subs []models.Subscriber, now time.Time, def *deferrals) ([]models.Subscriber, error) {
+	ids := make([]int, 0, len(subs))
+	for _, s := range subs {
+		ids = append(ids, s.ID)
+	}
+
+	counts, err := p.m.store.GetSubscriberSendCounts(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	sent := make(map[int]models.SubscriberSendCount, len(counts))
+	for _, c := range counts {
+		sent[c.SubscriberID] = c
+	}
+	pending := p.m.getPendingSends(ids)
+
+	out := make([]models.Subscriber, 0, len(subs))
+	for _, s := range subs {
+		c := sent[s.ID]
+		if c.Count+pending[s.ID] < p.msgCap {
+			out = append(out, s)
+			continue
+		}
+
+		retryAt := now.Add(deferRetryInterval)
+		if c.Count > 0 {
+			retryAt = maxTime(retryAt, c.FirstAt.Add(time.Hour*24))
+		}
+		def.add(s.ID, retryAt)
+	}
+
+	return out, nil
+}
+
+// filterDomains returns the subscribers whose e-mail domains are allowed by the
+// domain rules and logs the ones that are skipped.
+func (p *pipe) filterDomains(subs []models.Subscriber) []models.Subscriber {
+	out := make([]models.Subscriber, 0, len(subs))
+	for _, s := range subs {
+		if err := p.m.cfg.DomainRules.Check(s.Email); err != nil {
+			p.log.With("subscriber_id", s.ID).Info("skipping subscriber ("+s.Email+") in campaign ("+p.camp.Name+")", "error", err)
+			continue
+		}
+
+		out = append(out, s)
+	}
+
+	return out
+}
+
+// filterExcluded removes the subscribers who are on the campaign's exclusion lists or
+// who are recipients of its excluded campaigns. With per-list copies, all the copies
+// of an excluded subscriber are removed.
+func (p *pipe) filterExcluded(subs []models.Subscriber) ([]models.Subscriber, error) {
+	ids := make([]int, 0, len(subs))
+	for _, s := range subs {
+		ids = append(ids, s.ID)
+	}
+
+	exIDs, err := p.m.store.GetExcludedSubscribers(ids, p.camp.ExcludeListIDs, p.camp.ExcludeCampaignIDs)
+	if err != nil {
+		return nil, err
+	}
+	if len(exIDs) == 0 {
+		return subs, nil
+	}
+
+	ex := make(map[int]bool, len(exIDs))
+	for _, id := range exIDs {
+		ex[id] = true
+	}
+
+	out := make([]models.Subscriber, 0, len(subs))
+	for _, s := range subs {
+		if !ex[s.ID] {
+			out = append(out, s)
+		}
+	}
+
+	return out, nil
+}
+
+// dedupeSubscribers removes the repeated rows of subscribers, which are consecutive
+// as subscribers are fetched ordered by ID.
+func dedupeSubscribers(subs []models.Subscriber) []models.Subscriber {
+	out := make([]models.Subscriber, 0, len(subs))
+	for i, s := range subs {
+		if i > 0 && subs[i-1].ID == s.ID {
+			continue
+		}
+
+		out = append(out, s)
+	}
+
+	return out
+}
+
+// filterSelf removes the subscriber whose e-mail is the campaign's From address.
+func (p *pipe) filterSelf(subs []models.Subscriber) []models.Subscriber {
+	out := make([]models.Subscriber, 0, len(subs))
+	for _, s := range subs {
+		if strings.EqualFold(s.Email, p.fromEmail) {
+			p.log.With("subscriber_id", s.ID).Info("skipping subscriber (" + s.Email + ") who is the from address of campaign (" + p.camp.Name + ")")
+			continue
+		}
+
+		out = append(out, s)
+	}
+
+	return out
+}
+
+// filterSendWindow returns the subscribers for whom the given time is within the
+// campaign's send window in their time zones and defers the rest till the window
+// next opens in their time zones.
+func (p *pipe) filterSendWindow(subs []models.Subscriber, now time.Time, def *deferrals) []models.Subscriber {
+	out := make([]models.Subscriber, 0, len(subs))
+	for _, s := range subs {
+		t := now.In(p.subLocation(s))
+		if p.camp.CampaignSendWindow.Contains(t) {
+			out = append(out, s)
+			continue
+		}
+
+		def.add(s.ID, p.camp.CampaignSendWindow.Next(t))
+	}
+
+	return out
+}
+
+// undefer deletes the deferrals of the fetched deferred subscribers who aren't in
+// subs, that is, who have been skipped and aren't to be retried again.
+func (p *pipe) undefer(fetched, subs []models.Subscriber) {
+	keep := make(map[int]struct{}, len(subs))
+	for _, s := range subs {
+		keep[s.ID] = struct{}{}
+	}
+
+	var ids []int
+	for _, s := range fetched {
+		if _, ok := keep[s.ID]; !ok {
+			keep[s.ID] = struct{}{}
+			ids = append(ids, s.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+
+	if err := p.m.store.DeleteCampaignDeferrals(p.camp.ID, ids); err != nil {
+		p.log.Error("error deleting campaign deferrals ("+p.camp.Name+")", "error", err)
+	}
+}
+
+// waitRetry takes the pipe out of the subscriber fetch rotation till its
+// deferred subscribers are due to be retried.
+func (p *pipe) waitRetry(d time.Duration) {
+	p.pauseMut.Lock()
+	p.retryTimer = time.AfterFunc(d, p.wake)
+	p.pauseMut.Unlock()
+}
+
+// wake re-queues the pipe if it's waiting for its deferred subscribers.
+func (p *pipe) wake() {
+	p.pauseMut.Lock()
+	t := p.retryTimer
+	p.retryTimer = nil
+	p.pauseMut.Unlock()
+
+	if t == nil {
+		return
+	}
+	t.Stop()
+	p.m.nextPipes <- p
+}
+
+// deferrals accumulates the deferrals of a batch of subscribers by the
+// number of message copies of each subscriber.
+type deferrals struct {
+	items []models.CampaignDeferral
+	idx   map[int]int
+}
+
+func newDeferrals() *deferrals {
+	return &deferrals{idx: make(map[int]int)}
+}
+
+func (d *deferrals) add(subID int, retryAt time.Time) {
+	if i, ok := d.idx[subID]; ok {
+		d.items[i].Copies++
+		return
+	}
+
+	d.idx[subID] = len(d.items)
+	d.items = append(d.items, models.CampaignDeferral{SubscriberID: subID, Copies: 1, RetryAt: retryAt})
+}
+
+// reserveSends counts queued campaign messages to the given subscribers
+// towards the per-subscriber message cap till they're processed.
+func (m *Manager) reserveSends(subIDs []int) {
+	m.pendingSendsMut.Lock()
+	for _, id := range subIDs {
+		m.pendingSends[id]++
+	}
+	m.pendingSendsMut.Unlock()
+}
+
+// releaseSends releases messages reserved by reserveSends() once
+// they've failed, or if they were sent, have been recorded in the store.
+func (m *Manager) releaseSends(subIDs []int) {
+	m.pendingSendsMut.Lock()
+	for _, id := range subIDs {
+		if m.pendingSends[id]--; m.pendingSends[id] <= 0 {
+			delete(m.pendingSends, id)
+		}
+	}
+	m.pendingSendsMut.Unlock()
+}
+
+// getPendingSends returns the number of reserved messages of the given subscribers.
+func (m *Manager) getPendingSends(subIDs []int) map[int]int {
+	out := make(map[int]int)
+
+	m.pendingSendsMut.Lock()
+	for _, id := range subIDs {
+		if n, ok := m.pendingSends[id]; ok {
+			out[id] = n
+		}
+	}
+	m.pendingSendsMut.Unlock()
+
+	return out
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// subLocation returns the time zone of a subscriber from their attribs,
+// falling back to the default send window time zone.
+func (p *pipe) subLocation(s models.Subscriber) *time.Location {
+	tz, _ := s.Attribs[SendWindowTimezoneAttrib].(string)
+	if tz == "" {
+		return p.m.cfg.SendWindowLocation
+	}
+
+	if loc, ok := p.locations[tz]; ok {
+		return loc
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		loc = p.m.cfg.SendWindowLocation
+	}
+
+	if p.locations == nil {
+		p.locations = make(map[string]*time.Location)
+	}
+	p.locations[tz] = loc
+
+	return loc
+}
+
 func (p *pipe) OnError() {
 	if p.m.cfg.MaxSendErrors < 1 {
 		return
@@ -146,7 +645,7 @@ func (p *pipe) OnError() {
 	}
 
 	p.Stop(true)
-	p.m.log.Printf("error count exceeded %d. pausing campaign %s", p.m.cfg.MaxSendErrors, p.camp.Name)
+	p.log.Error(fmt.Sprintf("error count exceeded %d. pausing campaign %s", p.m.cfg.MaxSendErrors, p.camp.Name))
 }
 
 // Stop "marks" a campaign as stopped. It doesn't actually stop the processing
@@ -163,14 +662,146 @@ func (p *pipe) Stop(withErrors bool) {
 	}
 
 	p.stopped.Store(true)
+
+	// Release the messages held by a paused pipe so that they're ignored, and
+	// end the wait for any deferred subscribers.
+	p.resume()
+	go p.wake()
+}
+
+// pause marks the pipe as paused. It returns false if the pipe
+// is already paused or stopped.
+func (p *pipe) pause() bool {
+	p.pauseMut.Lock()
+	defer p.pauseMut.Unlock()
+
+	if p.paused || p.stopped.Load() {
+		return false
+	}
+	p.paused = true
+
+	return true
+}
+
+// resume unpauses the pipe, re-queues the messages held while it was paused,
+// and if it was parked, re-queues the pipe to fetch further subscribers.
+// It returns false if the pipe isn't paused.
+func (p *pipe) resume() bool {
+	p.pauseMut.Lock()
+	if !p.paused {
+		p.pauseMut.Unlock()
+		return false
+	}
+
+	var (
+		msgs   = p.held
+		parked = p.parked
+	)
+	p.paused = false
+	p.parked = false
+	p.held = nil
+	p.pauseMut.Unlock()
+
+	// The queues may be full. Push in the background so that the caller doesn't block.
+	go func() {
+		for _, msg := range msgs {
+			p.m.campMsgQ <- msg
+		}
+		if parked {
+			p.m.nextPipes <- p
+		}
+	}()
+
+	return true
+}
+
+// isPaused returns whether the pipe is paused.
+func (p *pipe) isPaused() bool {
+	p.pauseMut.Lock()
+	defer p.pauseMut.Unlock()
+	return p.paused
+}
+
+// exclude marks the given subscribers as excluded from the campaign. Only the
+// subscribers whose messages may have already been queued are recorded as the rest
+// are no longer fetched from the store.
+func (p *pipe) exclude(subIDs []int) {
+	last := int(p.queuedID.Load())
+
+	p.exclMut.Lock()
+	for _, id := range subIDs {
+		if id > last {
+			continue
+		}
+		if p.excluded == nil {
+			p.excluded = make(map[int]struct{})
+		}
+		p.excluded[id] = struct{}{}
+	}
+	p.exclMut.Unlock()
+}
+
+// isExcluded returns true if the subscriber has been excluded from the campaign.
+func (p *pipe) isExcluded(subID int) bool {
+	p.exclMut.RLock()
+	_, ok := p.excluded[subID]
+	p.exclMut.RUnlock()
+	return ok
+}
+
+// hold holds a dequeued message if the pipe is paused. The message stays
+// pending in the pipe's waitgroup. It returns false if the pipe isn't paused.
+func (p *pipe) hold(msg CampaignMessage) bool {
+	p.pauseMut.Lock()
+	defer p.pauseMut.Unlock()
+
+	if !p.paused {
+		return false
+	}
+	p.held = append(p.held, msg)
+
+	return true
+}
+
+// park takes a paused pipe out of the subscriber fetch rotation. It returns
+// false if the pipe isn't paused.
+func (p *pipe) park() bool {
+	p.pauseMut.Lock()
+	defer p.pauseMut.Unlock()
+
+	if !p.paused {
+		return false
+	}
+	p.parked = true
+
+	return true
+}
+
+// checkpoint returns the ID of the subscriber up to whom the campaign has been
+// processed, that is, excluding the subscribers whose messages are still queued.
+func (p *pipe) checkpoint() int {
+	if id := p.lastID.Load(); id > 0 {
+		return int(id)
+	}
+	if id := p.firstID.Load(); id > 0 {
+		return int(id) - 1
+	}
+	return 0
 }
 
 func (p *pipe) newMessage(s models.Subscriber) (CampaignMessage, error) {
-	msg, err := p.m.NewCampaignMessage(p.camp, s)
+	v := p.pickVariant()
+
+	msg, err := p.m.newCampaignMessage(p.camp, s, v, false, p.css)
 	if err != nil {
 		return msg, err
 	}
 
+	if v != nil {
+		p.variantSent[v.ID]++
+		p.sampled++
+	}
+
 	msg.pipe = p
 	p.wg.Add(1)
 
@@ -178,48 +809,200 @@ func (p *pipe) newMessage(s models.Subscriber) (CampaignMessage, error) {
 }
 
 func (p *pipe) cleanup() {
+	// The campaign's status at the end of processing that's pushed to
+	// progress subscribers.
+	status := p.camp.Status
+
 	defer func() {
 		p.m.pipesMut.Lock()
 		delete(p.m.pipes, p.camp.ID)
 		p.m.pipesMut.Unlock()
+
+		p.m.endProgress(p.progress(status, true))
 	}()
 
+	p.flushDeliveries()
+
 	// Update campaign's "sent" count.
-	if err := p.m.store.UpdateCampaignCounts(p.camp.ID, 0, int(p.sent.Load()), int(p.lastID.Load())); err != nil {
-		p.m.log.Printf("error updating campaign counts (%s): %v", p.camp.Name, err)
+	if err := p.m.store.UpdateCampaignCounts(p.camp.ID, 0, int(p.sent.Swap(0)), int(p.lastID.Load())); err != nil {
+		p.log.Error("error updating campaign counts ("+p.camp.Name+")", "error", err)
+	}
+
+	// Update the sent counts of the A/B variants.
+	if len(p.variantSent) > 0 {
+		if err := p.m.store.UpdateCampaignVariantCounts(p.camp.ID, p.variantSent); err != nil {
+			p.log.Error("error updating campaign variant counts ("+p.camp.Name+")", "error", err)
+		}
 	}
 
 	// The campaign was auto-paused due to errors.
 	if p.withErrors.Load() {
+		status = models.CampaignStatusPaused
 		if err := p.m.store.UpdateCampaignStatus(p.camp.ID, models.CampaignStatusPaused); err != nil {
-			p.m.log.Printf("error updating campaign (%s) status to %s: %v", p.camp.Name, models.CampaignStatusPaused, err)
+			p.log.Error("error updating campaign ("+p.camp.Name+") status to "+models.CampaignStatusPaused, "error", err)
 		} else {
-			p.m.log.Printf("set campaign (%s) to %s", p.camp.Name, models.CampaignStatusPaused)
+			p.log.Info("set campaign (" + p.camp.Name + ") to " + models.CampaignStatusPaused)
 		}
 
-		_ = p.m.sendNotif(p.camp, models.CampaignStatusPaused, "Too many errors")
+		_ = p.m.sendNotif(p.camp, models.CampaignStatusPaused, "Too many errors", int(p.errors.Load()))
 		return
 	}
 
 	// Fetch the up-to-date campaign status from the DB.
 	c, err := p.m.store.GetCampaign(p.camp.ID)
 	if err != nil {
-		p.m.log.Printf("error fetching campaign (%s) for ending: %v", p.camp.Name, err)
+		p.log.Error("error fetching campaign ("+p.camp.Name+") for ending", "error", err)
+		return
+	}
+	status = c.Status
+
+	// The A/B variant sample has been sent. The campaign isn't picked up again
+	// till the sample window ends, after which the winner is sent to the rest.
+	if c.Status == models.CampaignStatusRunning && p.sampleDone {
+		endsAt := time.Now().Add(p.m.cfg.VariantSampleWindow)
+		if err := p.m.store.EndCampaignVariantSample(p.camp.ID, endsAt); err != nil {
+			p.log.Error("error ending campaign variant sample ("+p.camp.Name+")", "error", err)
+		} else {
+			p.log.Info("campaign (" + p.camp.Name + ") variant sample sent. picking the winner at " + endsAt.Format(time.RFC822Z))
+		}
 		return
 	}
 
 	// If a running campaign has exhausted subscribers, it's finished.
 	if c.Status == models.CampaignStatusRunning {
 		c.Status = models.CampaignStatusFinished
+		status = c.Status
 		if err := p.m.store.UpdateCampaignStatus(p.camp.ID, models.CampaignStatusFinished); err != nil {
-			p.m.log.Printf("error finishing campaign (%s): %v", p.camp.Name, err)
+			p.log.Error("error finishing campaign ("+p.camp.Name+")", "error", err)
 		} else {
-			p.m.log.Printf("campaign (%s) finished", p.camp.Name)
+			p.log.Info("campaign (" + p.camp.Name + ") finished")
 		}
 	} else {
-		p.m.log.Printf("stop processing campaign (%s)", p.camp.Name)
+		p.log.Info("stop processing campaign (" + p.camp.Name + ")")
 	}
 
 	// Notify the admin.
-	_ = p.m.sendNotif(c, c.Status, "")
+	_ = p.m.sendNotif(c, c.Status, "", int(p.errors.Load()))
+
+	// Notify the campaign's end.
+	if p.m.cfg.OnCampaignEnd != nil && (c.Status == models.CampaignStatusFinished || c.Status == models.CampaignStatusCancelled) {
+		p.m.cfg.OnCampaignEnd(c, p.endStats(c))
+	}
+}
+
+// endStats returns the final stats of the pipe's campaign that has ended.
+func (p *pipe) endStats(c *models.Campaign) models.CampaignEnd {
+	e := models.CampaignEnd{
+		ID:        c.ID,
+		UUID:      c.UUID,
+		Name:      c.Name,
+		Status:    models.CampaignEndCompleted,
+		ToSend:    c.ToSend,
+		Sent:      c.Sent,
+		Failed:    int(p.errors.Load()),
+		StartedAt: c.StartedAt,
+		EndedAt:   time.Now(),
+	}
+	if c.Status == models.CampaignStatusCancelled {
+		e.Status = models.CampaignEndCancelled
+	}
+	if c.StartedAt.Valid {
+		e.Duration = e.EndedAt.Sub(c.StartedAt.Time).Seconds()
+	}
+
+	return e
+}
+
+// loadVariants loads the campaign's A/B subject variants, if there are any, and
+// determines the phase of the test. If the sample window is over, the winning
+// variant is picked and is sent to the remaining subscribers.
+func (p *pipe) loadVariants() error {
+	vars, err := p.m.store.GetCampaignVariants(p.camp.ID)
+	if err != nil {
+		return fmt.Errorf("error fetching campaign variants (%s): %v", p.camp.Name, err)
+	}
+	if len(vars) < 2 {
+		return nil
+	}
+
+	var winner *models.CampaignVariant
+	for n := range vars {
+		if vars[n].Winner {
+			winner = &vars[n]
+			break
+		}
+	}
+
+	// The sample has been sent and the sample window is over. Pick the winner.
+	if winner == nil && p.camp.VariantSampleEndsAt.Valid {
+		w, err := p.m.store.PickCampaignVariantWinner(p.camp.ID)
+		if err != nil {
+			return fmt.Errorf("error picking campaign variant winner (%s): %v", p.camp.Name, err)
+		}
+		w.Winner = true
+		winner = &w
+
+		p.log.Info(fmt.Sprintf("picked variant %d (%s) as the winner of campaign (%s)", w.ID, w.Subject, p.camp.Name), "variant_id", w.ID)
+	}
+
+	if winner != nil {
+		// Send the winning variant to the remaining subscribers.
+		p.camp.Subject = winner.Subject
+		vars = []models.CampaignVariant{*winner}
+	} else if size := p.m.cfg.VariantSampleSize; size > 0 && size < 100 {
+		// Sampling phase. Get the up-to-date subscriber count to derive the sample size.
+		c, err := p.m.store.GetCampaign(p.camp.ID)
+		if err != nil {
+			return fmt.Errorf("error fetching campaign (%s): %v", p.camp.Name, err)
+		}
+
+		p.sampleSize = int(math.Ceil(float64(c.ToSend*size) / 100))
+		if p.sampleSize < len(vars) {
+			p.sampleSize = len(vars)
+		}
+
+		// Variants sent before the campaign was paused count towards the sample.
+		for _, v := range vars {
+			p.sampled += v.Sent
+		}
+	}
+
+	for n := range vars {
+		if err := vars[n].CompileSubject(p.m.TemplateFuncs(p.camp)); err != nil {
+			return err
+		}
+	}
+
+	p.variants = vars
+	p.variantSent = make(map[int]int, len(vars))
+	return nil
+}
+
+// pickVariant picks an A/B subject variant for a message by weight.
+func (p *pipe) pickVariant() *models.CampaignVariant {
+	switch len(p.variants) {
+	case 0:
+		return nil
+	case 1:
+		return &p.variants[0]
+	}
+
+	total := 0
+	for _, v := range p.variants {
+		total += v.Weight
+	}
+
+	if total < 1 {
+		return &p.variants[0]
+	}
+
+	n := rand.Intn(total)
+	for i := range p.variants {
+		n -= p.variants[i].Weight
+		if n < 0 {
+			return &p.variants[i]
+		}
+	}
+
+	return &p.variants[len(p.variants)-1]
 }
@@ -0,0 +1,354 @@
+package manager
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"gopkg.in/volatiletech/null.v6"
+)
+
+// runPipe fetches the subscribers of a pipe till there are none left and processes
+// the queued messages as sent, or as failed if fail is set, and returns the IDs of
+// the subscribers whose messages were queued.
+func runPipe(t *testing.T, p *pipe, fail bool) []int {
+	t.Helper()
+
+	var out []int
+	for {
+		has, err := p.NextSubscribers()
+		if err != nil {
+			t.Fatalf("error fetching subscribers: %v", err)
+		}
+
+		for len(p.m.campMsgQ) > 0 {
+			msg := <-p.m.campMsgQ
+			out = append(out, msg.Subscriber.ID)
+			p.ack(msg.Subscriber.ID, !fail)
+			p.wg.Done()
+		}
+
+		if !has {
+			break
+		}
+	}
+	p.flushDeliveries()
+
+	return out
+}
+
+func newCapTestManager(t *testing.T, st *testStore, max int) *Manager {
+	t.Helper()
+
+	m := newTestManager(Config{BatchSize: 10, MessageRate: 10, MaxSubscriberMessages: max, UnsubURL: "%s/%s"})
+	m.store = st
+	if err := m.AddMessenger(&testMessenger{}); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestMessageCap(t *testing.T) {
+	cases := []struct {
+		name    string
+		global  int
+		listCap int
+	}{
+		{"global cap", 2, -1},
+		{"list override", 0, 2},
+	}
+
+	for _, c := range cases {
+		st := newTestStore()
+		m := newCapTestManager(t, st, c.global)
+
+		// A subscriber on three campaigns on the same day.
+		pipes := make([]*pipe, 3)
+		for i := range pipes {
+			id := i + 1
+			st.subs[id] = append(st.subs[id], testSubscriber(1))
+			if c.listCap >= 0 {
+				st.listCaps[id] = c.listCap
+			}
+
+			p, err := m.newPipe(testCampaign(id))
+			if err != nil {
+				t.Fatalf("%s: error creating pipe: %v", c.name, err)
+			}
+			pipes[i] = p
+		}
+
+		for i, p := range pipes[:2] {
+			if got := runPipe(t, p, false); len(got) != 1 {
+				t.Fatalf("%s: expected campaign %d to be sent, got %v", c.name, i+1, got)
+			}
+		}
+
+		// The third campaign is deferred and waits for the subscriber's retry.
+		p := pipes[2]
+		if got := runPipe(t, p, false); len(got) != 0 {
+			t.Fatalf("%s: expected the third campaign to be deferred, got %v", c.name, got)
+		}
+		d, ok := st.deferrals[3][1]
+		if !ok {
+			t.Fatalf("%s: expected the subscriber to be deferred in the store", c.name)
+		}
+		if time.Until(d.RetryAt) < time.Hour*23 {
+			t.Errorf("%s: expected the retry after the sends leave the 24 hour window, got %v", c.name, d.RetryAt)
+		}
+		if p.retryAt.IsZero() {
+			t.Errorf("%s: expected the pipe to wait for the deferred subscriber", c.name)
+		}
+
+		// Once the earlier sends fall out of the window, the subscriber is retried.
+		for i := range st.sends[1] {
+			st.sends[1][i] = st.sends[1][i].Add(-time.Hour * 25)
+		}
+		d.RetryAt = time.Now().Add(-time.Second)
+
+		if got := runPipe(t, p, false); len(got) != 1 {
+			t.Fatalf("%s: expected the deferred subscriber to be retried, got %v", c.name, got)
+		}
+		if _, ok := st.deferrals[3][1]; ok {
+			t.Errorf("%s: expected the deferral to be deleted on sending", c.name)
+		}
+		if !p.retryAt.IsZero() {
+			t.Errorf("%s: expected the pipe to end with no deferred subscribers left", c.name)
+		}
+	}
+}
+
+func TestMessageCapDisabled(t *testing.T) {
+	st := newTestStore()
+	m := newCapTestManager(t, st, 0)
+
+	for id := 1; id <= 3; id++ {
+		st.subs[id] = append(st.subs[id], testSubscriber(1))
+		p, err := m.newPipe(testCampaign(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := runPipe(t, p, false); len(got) != 1 {
+			t.Fatalf("expected campaign %d to be sent, got %v", id, got)
+		}
+	}
+
+	if len(st.sends) != 0 {
+		t.Errorf("expected no sends to be recorded without a cap, got %v", st.sends)
+	}
+}
+
+func TestMessageCapFailedSends(t *testing.T) {
+	st := newTestStore()
+	m := newCapTestManager(t, st, 1)
+
+	// Failed messages don't count towards the cap.
+	st.subs[1] = append(st.subs[1], testSubscriber(1))
+	p, err := m.newPipe(testCampaign(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runPipe(t, p, true)
+
+	if len(st.sends[1]) != 0 || len(m.pendingSends) != 0 {
+		t.Fatalf("expected no sends to be counted, got %v, %v", st.sends, m.pendingSends)
+	}
+
+	st.subs[2] = append(st.subs[2], testSubscriber(1))
+	p, err = m.newPipe(testCampaign(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runPipe(t, p, false); len(got) != 1 {
+		t.Fatalf("expected the campaign to be sent, got %v", got)
+	}
+}
+
+func TestMessageCapPendingSends(t *testing.T) {
+	st := newTestStore()
+	m := newCapTestManager(t, st, 1)
+
+	// A message that's queued in another campaign, but not yet sent, counts towards the cap.
+	m.reserveSends([]int{1})
+
+	st.subs[1] = append(st.subs[1], testSubscriber(1))
+	p, err := m.newPipe(testCampaign(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runPipe(t, p, false); len(got) != 0 {
+		t.Fatalf("expected the subscriber to be deferred, got %v", got)
+	}
+	if d := st.deferrals[1][1]; d == nil || time.Until(d.RetryAt) > deferRetryInterval {
+		t.Fatalf("expected the subscriber to be retried after %v, got %+v", deferRetryInterval, d)
+	}
+}
+
+func TestSendWindow(t *testing.T) {
+	st := newTestStore()
+	m := newCapTestManager(t, st, 0)
+
+	camp := testCampaign(1)
+	camp.CampaignSendWindow = models.CampaignSendWindow{Start: null.IntFrom(8), End: null.IntFrom(20)}
+	p, err := m.newPipe(camp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone data is unavailable:", err)
+	}
+
+	// 11pm in New York, which is 1pm in Tokyo.
+	now := time.Date(2024, 3, 4, 23, 0, 0, 0, ny)
+
+	var (
+		late  = testSubscriber(1)
+		early = testSubscriber(2)
+	)
+	late.Attribs = models.JSON{SendWindowTimezoneAttrib: "America/New_York"}
+	early.Attribs = models.JSON{SendWindowTimezoneAttrib: "Asia/Tokyo"}
+
+	def := newDeferrals()
+	out := p.filterSendWindow([]models.Subscriber{late, early}, now, def)
+	if len(out) != 1 || out[0].ID != early.ID {
+		t.Fatalf("expected only the subscriber within the window, got %v", out)
+	}
+
+	// The recipient at 11pm local time is deferred till 8am the next morning.
+	if len(def.items) != 1 || def.items[0].SubscriberID != late.ID {
+		t.Fatalf("expected the subscriber outside the window to be deferred, got %+v", def.items)
+	}
+	if exp := time.Date(2024, 3, 5, 8, 0, 0, 0, ny); !def.items[0].RetryAt.Equal(exp) {
+		t.Errorf("expected the retry at %v, got %v", exp, def.items[0].RetryAt)
+	}
+
+	// And is sent the message once it's retried in the morning.
+	if out := p.filterSendWindow([]models.Subscriber{late}, def.items[0].RetryAt, newDeferrals()); len(out) != 1 {
+		t.Errorf("expected the subscriber to be within the window in the morning")
+	}
+}
+
+func TestSendWindowNext(t *testing.T) {
+	cases := []struct {
+		start, end int
+		now, exp   int
+		nextDay    bool
+	}{
+		{8, 20, 12, 12, false},
+		{8, 20, 5, 8, false},
+		{8, 20, 23, 8, true},
+		{8, 20, 20, 8, true},
+		{22, 6, 23, 23, false},
+		{22, 6, 12, 22, false},
+	}
+
+	for _, c := range cases {
+		w := models.CampaignSendWindow{Start: null.IntFrom(c.start), End: null.IntFrom(c.end)}
+		now := time.Date(2024, 3, 4, c.now, 0, 0, 0, time.UTC)
+
+		exp := time.Date(2024, 3, 4, c.exp, 0, 0, 0, time.UTC)
+		if c.nextDay {
+			exp = exp.AddDate(0, 0, 1)
+		}
+		if got := w.Next(now); !got.Equal(exp) {
+			t.Errorf("window %d-%d at %d: expected %v, got %v", c.start, c.end, c.now, exp, got)
+		}
+	}
+}
+
+func TestExclusions(t *testing.T) {
+	st := newTestStore()
+	m := newCapTestManager(t, st, 0)
+
+	// Subscribers 3 and 4 are on the exclusion list, and 1 and 3 were sent the
+	// excluded campaign. 3, who is on both and on two of the target lists with
+	// per-list copies, is excluded all the same.
+	st.listSubs[10] = []int{3, 4}
+	st.deliveries[1] = []int{1, 3}
+	for _, id := range []int{1, 2, 3, 3, 4, 5, 6} {
+		st.subs[2] = append(st.subs[2], testSubscriber(id))
+	}
+
+	c := testCampaign(2)
+	c.ExcludeListIDs = []int64{10}
+	c.ExcludeCampaignIDs = []int64{1}
+	c.PerListCopies = true
+	p, err := m.newPipe(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := runPipe(t, p, false)
+	if exp := []int{2, 5, 6}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("expected the messages to %v, got %v", exp, got)
+	}
+	if exp := []int{2, 5, 6}; !reflect.DeepEqual(st.deliveries[2], exp) {
+		t.Errorf("expected the deliveries to %v, got %v", exp, st.deliveries[2])
+	}
+
+	// Without exclusions, everyone is sent the campaign.
+	for _, id := range []int{1, 3, 4} {
+		st.subs[3] = append(st.subs[3], testSubscriber(id))
+	}
+	if p, err = m.newPipe(testCampaign(3)); err != nil {
+		t.Fatal(err)
+	}
+	if got := runPipe(t, p, false); len(got) != 3 {
+		t.Errorf("expected all the subscribers to be sent the campaign without exclusions, got %v", got)
+	}
+}
+
+func TestDedupeSubscribers(t *testing.T) {
+	cases := []struct {
+		name     string
+		perList  bool
+		expected []int
+	}{
+		{"a single message by default", false, []int{1, 2, 3}},
+		{"a message per list with per-list copies", true, []int{1, 2, 2, 3}},
+	}
+
+	for i, c := range cases {
+		st := newTestStore()
+		m := newCapTestManager(t, st, 0)
+
+		// Subscriber 2 is on two of the target lists.
+		id := i + 1
+		for _, subID := range []int{1, 2, 2, 3} {
+			st.subs[id] = append(st.subs[id], testSubscriber(subID))
+		}
+
+		camp := testCampaign(id)
+		camp.PerListCopies = c.perList
+		p, err := m.newPipe(camp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := runPipe(t, p, false); !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("%s: expected the messages to %v, got %v", c.name, c.expected, got)
+		}
+	}
+}
+
+func TestSkipFromAddress(t *testing.T) {
+	st := newTestStore()
+	m := newCapTestManager(t, st, 0)
+
+	self := testSubscriber(2)
+	self.Email = "NoReply@listmonk.app"
+	st.subs[1] = []models.Subscriber{testSubscriber(1), self, testSubscriber(3)}
+
+	p, err := m.newPipe(testCampaign(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runPipe(t, p, false); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("expected the campaign's From address to be skipped, got %v", got)
+	}
+}
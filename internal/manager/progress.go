@@ -0,0 +1,141 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// Interval at which the progress of running campaigns is pushed to subscribers.
+const progressInterval = time.Second
+
+// CampProgress represents the live send progress of a running campaign.
+type CampProgress struct {
+	CampaignID int    `json:"campaign_id"`
+	Status     string `json:"status"`
+	ToSend     int    `json:"to_send"`
+	Sent       int    `json:"sent"`
+	Failed     int    `json:"failed"`
+	Remaining  int    `json:"remaining"`
+
+	// Messages sent in the last minute.
+	SendRate int `json:"send_rate"`
+
+	// Done indicates that the campaign is no longer being processed, after which
+	// no further progress is pushed and the subscription channel is closed.
+	Done bool `json:"done"`
+}
+
+// SubscribeProgress subscribes to the live progress of a campaign that's pushed
+// every second while the campaign is processed. The returned function
+// unsubscribes and must be called when the subscriber is done.
+func (m *Manager) SubscribeProgress(campID int) (<-chan CampProgress, func()) {
+	ch := make(chan CampProgress, 10)
+
+	m.progSubsMut.Lock()
+	if m.progSubs[campID] == nil {
+		m.progSubs[campID] = make(map[chan CampProgress]struct{})
+	}
+	m.progSubs[campID][ch] = struct{}{}
+	m.progSubsMut.Unlock()
+
+	return ch, func() {
+		m.progSubsMut.Lock()
+		defer m.progSubsMut.Unlock()
+
+		subs, ok := m.progSubs[campID]
+		if !ok {
+			return
+		}
+
+		// The channel may have already been closed on the campaign ending.
+		if _, ok := subs[ch]; ok {
+			delete(subs, ch)
+			close(ch)
+		}
+		if len(subs) == 0 {
+			delete(m.progSubs, campID)
+		}
+	}
+}
+
+// GetCampaignProgress returns the live progress of a campaign and whether
+// it's currently being processed.
+func (m *Manager) GetCampaignProgress(campID int) (CampProgress, bool) {
+	m.pipesMut.RLock()
+	p, ok := m.pipes[campID]
+	m.pipesMut.RUnlock()
+
+	if !ok {
+		return CampProgress{}, false
+	}
+
+	status := models.CampaignStatusRunning
+	if p.isPaused() {
+		status = models.CampaignStatusPaused
+	}
+
+	return p.progress(status, false), true
+}
+
+// pushProgress periodically pushes the progress of the campaigns that have subscribers.
+func (m *Manager) pushProgress() {
+	t := time.NewTicker(progressInterval)
+	defer t.Stop()
+
+	for range t.C {
+		m.progSubsMut.Lock()
+		for id, subs := range m.progSubs {
+			prog, ok := m.GetCampaignProgress(id)
+			if !ok {
+				continue
+			}
+
+			for ch := range subs {
+				select {
+				case ch <- prog:
+				default:
+				}
+			}
+		}
+		m.progSubsMut.Unlock()
+	}
+}
+
+// endProgress pushes the final progress of a pipe to its subscribers
+// and closes their channels.
+func (m *Manager) endProgress(prog CampProgress) {
+	m.progSubsMut.Lock()
+	defer m.progSubsMut.Unlock()
+
+	for ch := range m.progSubs[prog.CampaignID] {
+		select {
+		case ch <- prog:
+		default:
+		}
+		close(ch)
+	}
+	delete(m.progSubs, prog.CampaignID)
+}
+
+// progress returns the current progress of the pipe's campaign.
+func (p *pipe) progress(status string, done bool) CampProgress {
+	var (
+		sent      = p.camp.Sent + int(p.totalSent.Load())
+		remaining = p.camp.ToSend - sent
+	)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	return CampProgress{
+		CampaignID: p.camp.ID,
+		Status:     status,
+		ToSend:     p.camp.ToSend,
+		Sent:       sent,
+		Failed:     int(p.errors.Load()),
+		Remaining:  remaining,
+		SendRate:   int(p.rate.Rate()),
+		Done:       done,
+	}
+}
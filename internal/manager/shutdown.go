@@ -0,0 +1,209 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+)
+
+// Max time to wait for the messages being sent after the shutdown grace period
+// for them to be recorded.
+const shutdownSendWait = time.Second * 2
+
+// Shutdown gracefully stops the processing of campaigns. No further subscribers
+// are fetched, and the messages that are already queued are sent till the
+// grace period runs out, after which the rest are dropped.
+//
+// The progress of every campaign being processed is then saved with its
+// checkpoint rewound to before the earliest subscriber whose message wasn't sent,
+// so that it resumes from there on the next start. The subscribers after that
+// who have already been sent the campaign are recorded in the store and skipped
+// on resumption so that they don't get the campaign twice.
+func (m *Manager) Shutdown(grace time.Duration) {
+	m.draining.Store(true)
+
+	if !m.waitIdle(grace) {
+		m.log.Warn("shutdown grace period exceeded. dropping queued campaign messages")
+		m.dropping.Store(true)
+		m.waitIdle(shutdownSendWait)
+	}
+
+	m.pipesMut.RLock()
+	pipes := make([]*pipe, 0, len(m.pipes))
+	for _, p := range m.pipes {
+		pipes = append(pipes, p)
+	}
+	m.pipesMut.RUnlock()
+
+	for _, p := range pipes {
+		p.save()
+	}
+}
+
+// waitIdle waits till no subscribers are being fetched, the queues are drained,
+// and no messages are being sent. It returns false if that doesn't happen
+// within the timeout.
+func (m *Manager) waitIdle(timeout time.Duration) bool {
+	var (
+		t   = time.NewTicker(time.Millisecond * 100)
+		end = time.After(timeout)
+	)
+	defer t.Stop()
+
+	for {
+		if !m.fetching.Load() && len(m.campMsgQ) == 0 && len(m.msgQ) == 0 && len(m.txQ) == 0 && m.activeWorkers.Load() == 0 {
+			return true
+		}
+
+		select {
+		case <-end:
+			return false
+		case <-t.C:
+		}
+	}
+}
+
+// track marks the message of a subscriber that's being queued as outstanding.
+func (p *pipe) track(subID int) {
+	p.outMut.Lock()
+	p.outstanding[subID]++
+	p.outMut.Unlock()
+}
+
+// trackRetry marks the message of a deferred subscriber who's being retried as queued.
+// These messages aren't outstanding as the subscribers are below the checkpoint.
+func (p *pipe) trackRetry(subID int) {
+	p.outMut.Lock()
+	p.retrying[subID]++
+	p.outMut.Unlock()
+}
+
+// isRetrying returns whether there are retried deferred subscribers whose
+// messages are still queued.
+func (p *pipe) isRetrying() bool {
+	p.outMut.Lock()
+	defer p.outMut.Unlock()
+	return len(p.retrying) > 0
+}
+
+// ack marks the message of a subscriber as processed and if it was sent, records
+// the delivery and the subscriber's send before returning, so that a crash at any
+// point doesn't lose the records of sent messages, which would be sent again on
+// resuming. Concurrent acks are written together (see flushDeliveries). The deferrals
+// of retried subscribers that are to be deleted are written in batches, and on
+// shutdown, immediately, as the process may exit any moment.
+func (p *pipe) ack(subID int, sent bool) {
+	p.outMut.Lock()
+	if n, ok := p.retrying[subID]; ok {
+		// The deferral is deleted once the messages of all of its copies are processed.
+		// The messages that are dropped as the campaign has stopped are retried after
+		// the lease when the campaign resumes.
+		if n > 1 {
+			p.retrying[subID] = n - 1
+		} else {
+			delete(p.retrying, subID)
+			if sent || !p.stopped.Load() {
+				p.undeferred = append(p.undeferred, subID)
+			}
+		}
+	} else if p.outstanding[subID]--; p.outstanding[subID] <= 0 {
+		delete(p.outstanding, subID)
+	}
+	if sent {
+		p.delivered = append(p.delivered, subID)
+	}
+	flush := sent || len(p.undeferred) >= p.m.cfg.BatchSize || p.m.draining.Load()
+	p.outMut.Unlock()
+
+	// A failed message no longer counts towards the subscriber's message cap.
+	if !sent && p.trackSends {
+		p.m.releaseSends([]int{subID})
+	}
+
+	if flush {
+		p.flushDeliveries()
+	}
+}
+
+// flushDeliveries writes the pending delivery records to the store. The writes are
+// serialized, and the records that pile up while one is in progress are written
+// together by the next one. Thus, when this returns, the records that were pending
+// when it was called have been written.
+func (p *pipe) flushDeliveries() {
+	p.flushMut.Lock()
+	defer p.flushMut.Unlock()
+
+	p.outMut.Lock()
+	ids, undeferred := p.delivered, p.undeferred
+	p.delivered, p.undeferred = nil, nil
+	p.outMut.Unlock()
+
+	p.recordDeliveries(ids, undeferred)
+}
+
+// recordDeliveries records the deliveries of the given subscribers, and if the
+// campaign's sends are tracked, the subscriber sends, and deletes the deferrals
+// of the retried subscribers whose messages have been processed.
+func (p *pipe) recordDeliveries(ids, undeferred []int) {
+	if len(ids) > 0 {
+		if err := p.m.store.RecordCampaignDeliveries(p.camp.ID, ids); err != nil {
+			p.log.Error("error recording campaign deliveries ("+p.camp.Name+")", "error", err)
+		}
+
+		if p.trackSends {
+			if err := p.m.store.RecordSubscriberSends(p.camp.ID, ids); err != nil {
+				p.log.Error("error recording subscriber sends ("+p.camp.Name+")", "error", err)
+			}
+			p.m.releaseSends(ids)
+		}
+	}
+
+	if len(undeferred) > 0 {
+		if err := p.m.store.DeleteCampaignDeferrals(p.camp.ID, undeferred); err != nil {
+			p.log.Error("error deleting campaign deferrals ("+p.camp.Name+")", "error", err)
+		}
+	}
+}
+
+// resumePoint returns the checkpoint from which the campaign should resume, that is,
+// before the earliest subscriber whose message is outstanding, or if there are none,
+// the last subscriber whose message was queued.
+func (p *pipe) resumePoint() int {
+	p.outMut.Lock()
+	defer p.outMut.Unlock()
+
+	min := 0
+	for id := range p.outstanding {
+		if min == 0 || id < min {
+			min = id
+		}
+	}
+	if min > 0 {
+		return min - 1
+	}
+
+	return int(p.queuedID.Load())
+}
+
+// save saves the pipe's sent count, deliveries, and checkpoint on shutdown.
+func (p *pipe) save() {
+	// Nothing has been queued in this run.
+	if p.queuedID.Load() == 0 {
+		return
+	}
+
+	p.flushDeliveries()
+
+	if n := int(p.sent.Swap(0)); n > 0 {
+		if err := p.m.store.UpdateCampaignCounts(p.camp.ID, 0, n, int(p.queuedID.Load())); err != nil {
+			p.log.Error("error updating campaign counts ("+p.camp.Name+")", "error", err)
+		}
+	}
+
+	cp := p.resumePoint()
+	if err := p.m.store.UpdateCampaignCheckpoint(p.camp.ID, cp); err != nil {
+		p.log.Error("error updating campaign ("+p.camp.Name+") checkpoint", "error", err)
+		return
+	}
+
+	p.log.Info(fmt.Sprintf("saved campaign (%s) progress at subscriber %d", p.camp.Name, cp))
+}
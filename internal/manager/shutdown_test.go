@@ -0,0 +1,123 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// slowMessenger is a Messenger that takes a while to send a message, and on every
+// push, checks that the deliveries of the messages sent before it are recorded,
+// that is, a crash at that point wouldn't have them sent again.
+type slowMessenger struct {
+	testMessenger
+
+	st         *testStore
+	delay      time.Duration
+	unrecorded int
+}
+
+func (s *slowMessenger) Push(m models.Message) error {
+	s.st.mut.Lock()
+	recorded := len(s.st.deliveries[m.Campaign.ID])
+	s.st.mut.Unlock()
+
+	s.mut.Lock()
+	if n := len(s.msgs) - recorded; n > s.unrecorded {
+		s.unrecorded = n
+	}
+	s.mut.Unlock()
+
+	time.Sleep(s.delay)
+	return s.testMessenger.Push(m)
+}
+
+func (s *slowMessenger) sent() []int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	out := make([]int, 0, len(s.msgs))
+	for _, m := range s.msgs {
+		out = append(out, m.Subscriber.ID)
+	}
+	return out
+}
+
+func TestShutdownMidSend(t *testing.T) {
+	const numSubs = 50
+
+	st := newTestStore()
+	for i := 1; i <= numSubs; i++ {
+		st.subs[1] = append(st.subs[1], testSubscriber(i))
+	}
+
+	msgr := &slowMessenger{st: st, delay: time.Millisecond * 10}
+	m := newTestManager(Config{BatchSize: 10, Concurrency: 1, MessageRate: 100, UnsubURL: "%s/%s"})
+	m.store = st
+	if err := m.AddMessenger(msgr); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := m.newPipe(testCampaign(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go m.Run()
+	m.nextPipes <- p
+
+	// Shut down with a grace period that's too short to send the queued messages.
+	for len(msgr.sent()) < 10 {
+		time.Sleep(time.Millisecond)
+	}
+	m.Shutdown(time.Millisecond * 50)
+
+	sent := msgr.sent()
+	if len(sent) == numSubs {
+		t.Fatal("expected the shutdown to stop the campaign mid-send")
+	}
+	if msgr.unrecorded > 0 {
+		t.Errorf("expected every sent message to be recorded before the next send, got %d unrecorded", msgr.unrecorded)
+	}
+
+	st.mut.Lock()
+	if len(st.deliveries[1]) != len(sent) {
+		t.Fatalf("expected the %d sent messages to be recorded, got %d", len(sent), len(st.deliveries[1]))
+	}
+
+	// Resume the campaign as the DB would, from after the checkpoint, skipping
+	// the subscribers who have been sent the campaign.
+	cp, ok := st.checkpoints[1]
+	if !ok {
+		t.Fatal("expected the campaign's checkpoint to be saved")
+	}
+	delivered := make(map[int]bool)
+	for _, id := range st.deliveries[1] {
+		delivered[id] = true
+	}
+	st.subs[1] = nil
+	for i := cp + 1; i <= numSubs; i++ {
+		if !delivered[i] {
+			st.subs[1] = append(st.subs[1], testSubscriber(i))
+		}
+	}
+	st.mut.Unlock()
+
+	m2 := newCapTestManager(t, st, 0)
+	p2, err := m2.newPipe(testCampaign(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent = append(sent, runPipe(t, p2, false)...)
+
+	// Every subscriber gets the campaign exactly once.
+	counts := make(map[int]int)
+	for _, id := range sent {
+		counts[id]++
+	}
+	for i := 1; i <= numSubs; i++ {
+		if counts[i] != 1 {
+			t.Errorf("expected subscriber %d to be sent 1 message, got %d", i, counts[i])
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// testStore is an in-memory Store for testing campaign processing.
+type testStore struct {
+	// Subscribers of campaigns that are yet to be fetched.
+	subs map[int][]models.Subscriber
+
+	// Per-subscriber message cap override on the lists of campaigns.
+	listCaps map[int]int
+
+	// Members of lists and recipients of (earlier) campaigns for exclusions.
+	listSubs map[int64][]int
+
+	sends      map[int][]time.Time
+	deliveries map[int][]int
+	deferrals  map[int]map[int]*models.CampaignDeferral
+	txMsgs     map[string]*testTxMessage
+
+	// Saved campaign checkpoints.
+	checkpoints map[int]int
+
+	mut sync.Mutex
+}
+
+func newTestStore() *testStore {
+	return &testStore{
+		subs:       make(map[int][]models.Subscriber),
+		listCaps:   make(map[int]int),
+		listSubs:   make(map[int64][]int),
+		sends:      make(map[int][]time.Time),
+		deliveries: make(map[int][]int),
+		deferrals:  make(map[int]map[int]*models.CampaignDeferral),
+		txMsgs:     make(map[string]*testTxMessage),
+
+		checkpoints: make(map[int]int),
+	}
+}
+
+func (s *testStore) NextCampaigns(currentIDs []int64, sentCounts []int64) ([]*models.Campaign, error) {
+	return nil, nil
+}
+
+func (s *testStore) NextSubscribers(campID, limit int) ([]models.Subscriber, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	out := s.subs[campID]
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	s.subs[campID] = s.subs[campID][len(out):]
+
+	return out, nil
+}
+
+func (s *testStore) GetCampaign(campID int) (*models.Campaign, error) {
+	return &models.Campaign{Base: models.Base{ID: campID}, Status: models.CampaignStatusRunning}, nil
+}
+
+func (s *testStore) GetAttachment(mediaID int) (models.Attachment, error) {
+	return models.Attachment{}, nil
+}
+
+func (s *testStore) UpdateCampaignStatus(campID int, status string) error { return nil }
+
+func (s *testStore) UpdateCampaignCounts(campID int, toSend int, sent int, lastSubID int) error {
+	return nil
+}
+
+func (s *testStore) UpdateCampaignCheckpoint(campID int, lastSubID int) error {
+	s.mut.Lock()
+	s.checkpoints[campID] = lastSubID
+	s.mut.Unlock()
+	return nil
+}
+
+func (s *testStore) GetCampaignMessageCap(campID int, max int) (int, bool, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	track := max > 0
+	for _, n := range s.listCaps {
+		if n > 0 {
+			track = true
+		}
+	}
+
+	if n, ok := s.listCaps[campID]; ok {
+		return n, track, nil
+	}
+	return max, track, nil
+}
+
+func (s *testStore) GetExcludedSubscribers(subIDs []int, listIDs, campIDs []int64) ([]int, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	ex := make(map[int]bool)
+	for _, id := range listIDs {
+		for _, subID := range s.listSubs[id] {
+			ex[subID] = true
+		}
+	}
+	for _, id := range campIDs {
+		for _, subID := range s.deliveries[int(id)] {
+			ex[subID] = true
+		}
+	}
+
+	var out []int
+	for _, id := range subIDs {
+		if ex[id] {
+			out = append(out, id)
+		}
+	}
+
+	return out, nil
+}
+
+func (s *testStore) GetSubscriberSendCounts(subIDs []int) ([]models.SubscriberSendCount, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var out []models.SubscriberSendCount
+	for _, id := range subIDs {
+		c := models.SubscriberSendCount{SubscriberID: id}
+		for _, t := range s.sends[id] {
+			if time.Since(t) > time.Hour*24 {
+				continue
+			}
+			if c.Count == 0 || t.Before(c.FirstAt) {
+				c.FirstAt = t
+			}
+			c.Count++
+		}
+		if c.Count > 0 {
+			out = append(out, c)
+		}
+	}
+
+	return out, nil
+}
+
+func (s *testStore) RecordSubscriberSends(campID int, subIDs []int) error {
+	s.mut.Lock()
+	for _, id := range subIDs {
+		s.sends[id] = append(s.sends[id], time.Now())
+	}
+	s.mut.Unlock()
+	return nil
+}
+
+func (s *testStore) RecordCampaignDeliveries(campID int, subIDs []int) error {
+	s.mut.Lock()
+	s.deliveries[campID] = append(s.deliveries[campID], subIDs...)
+	s.mut.Unlock()
+	return nil
+}
+
+func (s *testStore) DeferCampaignSubscribers(campID int, d []models.CampaignDeferral) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if s.deferrals[campID] == nil {
+		s.deferrals[campID] = make(map[int]*models.CampaignDeferral)
+	}
+	for _, v := range d {
+		v := v
+		s.deferrals[campID][v.SubscriberID] = &v
+	}
+
+	return nil
+}
+
+func (s *testStore) NextDeferredSubscribers(campID, limit int, lease time.Duration) ([]models.Subscriber, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var out []models.Subscriber
+	for id, d := range s.deferrals[campID] {
+		if d.RetryAt.After(time.Now()) || len(out) >= limit {
+			continue
+		}
+
+		d.RetryAt = time.Now().Add(lease)
+		for i := 0; i < d.Copies; i++ {
+			out = append(out, testSubscriber(id))
+		}
+	}
+
+	return out, nil
+}
+
+func (s *testStore) GetCampaignNextDeferral(campID int) (time.Time, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var out time.Time
+	for _, d := range s.deferrals[campID] {
+		if out.IsZero() || d.RetryAt.Before(out) {
+			out = d.RetryAt
+		}
+	}
+
+	return out, nil
+}
+
+func (s *testStore) DeleteCampaignDeferrals(campID int, subIDs []int) error {
+	s.mut.Lock()
+	for _, id := range subIDs {
+		delete(s.deferrals[campID], id)
+	}
+	s.mut.Unlock()
+	return nil
+}
+
+func (s *testStore) GetCampaignVariants(campID int) ([]models.CampaignVariant, error) {
+	return nil, nil
+}
+
+func (s *testStore) UpdateCampaignVariantCounts(campID int, counts map[int]int) error { return nil }
+
+func (s *testStore) EndCampaignVariantSample(campID int, endsAt time.Time) error { return nil }
+
+func (s *testStore) PickCampaignVariantWinner(campID int) (models.CampaignVariant, error) {
+	return models.CampaignVariant{}, nil
+}
+
+func (s *testStore) CreateLink(url string) (string, error) { return url, nil }
+
+func (s *testStore) BlocklistSubscriber(id int64) error { return nil }
+
+func (s *testStore) DeleteSubscriber(id int64) error { return nil }
+
+// testTxMessage is a stored tx message.
+type testTxMessage struct {
+	msg      models.Message
+	status   string
+	attempts int
+	retryAt  time.Time
+}
+
+func (s *testStore) InsertTxMessage(msg models.Message, tplID int, retryAt time.Time) error {
+	s.mut.Lock()
+	s.txMsgs[msg.TxUUID] = &testTxMessage{msg: msg, status: models.TxStatusQueued, retryAt: retryAt}
+	s.mut.Unlock()
+	return nil
+}
+
+func (s *testStore) UpdateTxMessage(uuid, status string, attempts int, errMsg string, retryAt time.Time) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	if tx, ok := s.txMsgs[uuid]; ok {
+		tx.status, tx.attempts, tx.retryAt = status, attempts, retryAt
+	}
+	return nil
+}
+
+func (s *testStore) NextTxMessages(limit int, lease time.Duration) ([]models.QueuedTxMessage, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+
+	var out []models.QueuedTxMessage
+	for uuid, tx := range s.txMsgs {
+		if tx.status != models.TxStatusQueued || tx.retryAt.After(time.Now()) || len(out) >= limit {
+			continue
+		}
+
+		tx.retryAt = time.Now().Add(lease)
+		out = append(out, models.QueuedTxMessage{UUID: uuid, Attempts: tx.attempts, Message: tx.msg})
+	}
+
+	return out, nil
+}
+
+// testMessenger is a Messenger that records the messages pushed to it.
+type testMessenger struct {
+	msgs []models.Message
+	err  error
+	mut  sync.Mutex
+}
+
+func (t *testMessenger) Name() string { return "email" }
+
+func (t *testMessenger) Push(m models.Message) error {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	if t.err != nil {
+		return t.err
+	}
+	t.msgs = append(t.msgs, m)
+	return nil
+}
+
+func (t *testMessenger) Flush() error { return nil }
+
+func (t *testMessenger) Close() error { return nil }
+
+func testSubscriber(id int) models.Subscriber {
+	return models.Subscriber{
+		Base:  models.Base{ID: id},
+		UUID:  "sub-uuid",
+		Email: "subscriber@listmonk.app",
+		Name:  "Subscriber",
+	}
+}
+
+func testCampaign(id int) *models.Campaign {
+	return &models.Campaign{
+		Base:         models.Base{ID: id},
+		UUID:         "camp-uuid",
+		Name:         "campaign",
+		Subject:      "Hello",
+		FromEmail:    "listmonk <noreply@listmonk.app>",
+		Body:         "Hello {{ .Subscriber.Name }}",
+		TemplateBody: `{{ template "content" . }}`,
+		ContentType:  models.CampaignContentTypeHTML,
+		Messenger:    "email",
+		Status:       models.CampaignStatusRunning,
+	}
+}
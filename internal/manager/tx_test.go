@@ -0,0 +1,131 @@
+package manager
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+func newTxTestManager(t *testing.T, st *testStore, msgr *testMessenger) *Manager {
+	t.Helper()
+
+	m := newTestManager(Config{MessageRate: 10})
+	m.store = st
+	if err := m.AddMessenger(msgr); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func testTxMsg(uuid string) models.Message {
+	return models.Message{
+		From:      "listmonk <noreply@listmonk.app>",
+		To:        []string{"subscriber@listmonk.app"},
+		Subject:   "Hello",
+		Body:      []byte("Hello"),
+		Messenger: "email",
+		TxUUID:    uuid,
+	}
+}
+
+// sendQueuedTx sends the tx messages in the queue as the workers would and
+// returns the number of messages sent.
+func sendQueuedTx(m *Manager) int {
+	n := 0
+	for len(m.txQ) > 0 {
+		m.sendTx(<-m.txQ)
+		n++
+	}
+	return n
+}
+
+func TestTxRetry(t *testing.T) {
+	var (
+		st   = newTestStore()
+		msgr = &testMessenger{err: errors.New("connection refused")}
+		m    = newTxTestManager(t, st, msgr)
+	)
+
+	if err := m.QueueTxMessage(testTxMsg("tx-1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := st.txMsgs["tx-1"]; got == nil || time.Until(got.retryAt) < txLease/2 {
+		t.Fatalf("expected the message to be stored with a lease, got %+v", got)
+	}
+	sendQueuedTx(m)
+
+	// The failed message is scheduled to be retried from the store and isn't
+	// requeued before its backoff.
+	tx := st.txMsgs["tx-1"]
+	if tx.status != models.TxStatusQueued || tx.attempts != 1 || time.Until(tx.retryAt) > txRetryBackoff {
+		t.Fatalf("expected the message to be retried after %v, got %+v", txRetryBackoff, tx)
+	}
+	m.requeueTxMessages()
+	if len(m.txQ) != 0 {
+		t.Fatal("expected the message to not be retried before its backoff")
+	}
+
+	// Once it's due, it's retried and sent.
+	msgr.err = nil
+	tx.retryAt = time.Now().Add(-time.Second)
+	m.requeueTxMessages()
+	if n := sendQueuedTx(m); n != 1 {
+		t.Fatalf("expected the message to be retried, got %d", n)
+	}
+	if tx.status != models.TxStatusSent || tx.attempts != 2 {
+		t.Fatalf("expected the message to be sent on the second attempt, got %+v", tx)
+	}
+	if len(msgr.msgs) != 1 || msgr.msgs[0].Subject != "Hello" {
+		t.Fatalf("expected the message to be sent, got %v", msgr.msgs)
+	}
+}
+
+func TestTxRetryMaxAttempts(t *testing.T) {
+	var (
+		st   = newTestStore()
+		msgr = &testMessenger{err: errors.New("connection refused")}
+		m    = newTxTestManager(t, st, msgr)
+	)
+
+	if err := m.QueueTxMessage(testTxMsg("tx-1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < txMaxAttempts+1; i++ {
+		sendQueuedTx(m)
+		st.txMsgs["tx-1"].retryAt = time.Now().Add(-time.Second)
+		m.requeueTxMessages()
+	}
+
+	if tx := st.txMsgs["tx-1"]; tx.status != models.TxStatusFailed || tx.attempts != txMaxAttempts {
+		t.Fatalf("expected the message to fail after %d attempts, got %+v", txMaxAttempts, tx)
+	}
+}
+
+func TestTxRequeueOnStartup(t *testing.T) {
+	var (
+		st   = newTestStore()
+		msgr = &testMessenger{}
+	)
+
+	// A message that was queued, but not sent before a crash, and whose lease has expired.
+	st.txMsgs["tx-1"] = &testTxMessage{msg: testTxMsg(""), status: models.TxStatusQueued, retryAt: time.Now().Add(-time.Second)}
+
+	// Another that's still leased, eg: by another instance.
+	st.txMsgs["tx-2"] = &testTxMessage{msg: testTxMsg(""), status: models.TxStatusQueued, retryAt: time.Now().Add(txLease)}
+
+	m := newTxTestManager(t, st, msgr)
+	m.requeueTxMessages()
+	if n := sendQueuedTx(m); n != 1 {
+		t.Fatalf("expected 1 message to be requeued, got %d", n)
+	}
+
+	if tx := st.txMsgs["tx-1"]; tx.status != models.TxStatusSent || tx.attempts != 1 {
+		t.Errorf("expected the pending message to be sent, got %+v", tx)
+	}
+	if tx := st.txMsgs["tx-2"]; tx.status != models.TxStatusQueued {
+		t.Errorf("expected the leased message to not be sent, got %+v", tx)
+	}
+}
@@ -1,7 +1,13 @@
 package media
 
 import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"strings"
 
 	"github.com/knadh/listmonk/models"
 	"gopkg.in/volatiletech/null.v6"
@@ -19,14 +25,102 @@ type Media struct {
 	Provider    string      `json:"provider"`
 	Meta        models.JSON `db:"meta" json:"meta"`
 	URL         string      `json:"url"`
+	FolderID    null.Int    `db:"folder_id" json:"folder_id"`
+	Size        int64       `db:"size" json:"size"`
+	Variants    Variants    `db:"variants" json:"variants"`
+
+	// Srcset is the HTML srcset value made from the image's variants.
+	Srcset string `json:"srcset"`
 
 	Total int `db:"total" json:"-"`
 }
 
+// Variant represents a resized variant of an uploaded image.
+type Variant struct {
+	Width    int    `json:"width"`
+	Filename string `json:"filename"`
+	URL      string `json:"url,omitempty"`
+}
+
+// Variants represents the resized variants of an image stored as JSONB in the DB.
+type Variants []Variant
+
+// Value returns the JSON marshalled Variants. URLs are not stored as they
+// depend on the store.
+func (v Variants) Value() (driver.Value, error) {
+	out := make(Variants, 0, len(v))
+	for _, vr := range v {
+		out = append(out, Variant{Width: vr.Width, Filename: vr.Filename})
+	}
+	return json.Marshal(out)
+}
+
+// Scan unmarshals JSONB from the DB.
+func (v *Variants) Scan(src interface{}) error {
+	if src == nil {
+		*v = Variants{}
+		return nil
+	}
+
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, v)
+	}
+	return errors.New("invalid media variants type")
+}
+
+// SetURLs sets the URLs of the media, its thumbnail, and its variants,
+// and the srcset of the variants, using the given resolver.
+func (m *Media) SetURLs(s MediaURLResolver) {
+	m.URL = s.GetURL(m.Filename)
+	if m.Thumb != "" {
+		m.ThumbURL = null.String{Valid: true, String: s.GetURL(m.Thumb)}
+	}
+
+	if m.Variants == nil {
+		m.Variants = Variants{}
+	}
+
+	srcset := make([]string, 0, len(m.Variants))
+	for i, v := range m.Variants {
+		m.Variants[i].URL = s.GetURL(v.Filename)
+		srcset = append(srcset, fmt.Sprintf("%s %dw", m.Variants[i].URL, v.Width))
+	}
+
+	// Include the original image as the largest candidate.
+	if len(srcset) > 0 {
+		if w, ok := m.Meta["width"]; ok {
+			srcset = append(srcset, fmt.Sprintf("%s %vw", m.URL, w))
+		}
+	}
+	m.Srcset = strings.Join(srcset, ", ")
+}
+
+// Folder represents a folder that media are organized into.
+type Folder struct {
+	ID        int       `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	NumMedia  int       `db:"num_media" json:"num_media"`
+	TotalSize int64     `db:"total_size" json:"total_size"`
+	CreatedAt null.Time `db:"created_at" json:"created_at"`
+}
+
+// MediaURLResolver resolves the URL of a stored media file by its name when
+// it's needed instead of the URL being stored. Stores that sign URLs
+// (eg: private S3 buckets) return a freshly signed URL on every call.
+type MediaURLResolver interface {
+	GetURL(string) string
+}
+
 // Store represents functions to store and retrieve media (files).
 type Store interface {
+	MediaURLResolver
+
 	Put(string, string, io.ReadSeeker) (string, error)
 	Delete(string) error
-	GetURL(string) string
 	GetBlob(string) ([]byte, error)
 }
+
+// Checker is implemented by stores that can check whether they're reachable.
+type Checker interface {
+	Check(context.Context) error
+}
@@ -1,6 +1,7 @@
 package filesystem
 
 import (
+	"context"
 	"crypto/rand"
 	"fmt"
 	"io"
@@ -59,6 +60,18 @@ func (c *Client) Put(filename string, cType string, src io.ReadSeeker) (string,
 	return filename, nil
 }
 
+// Check checks if the upload directory exists.
+func (c *Client) Check(ctx context.Context) error {
+	fi, err := os.Stat(getDir(c.opts.UploadPath))
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", c.opts.UploadPath)
+	}
+	return nil
+}
+
 // GetURL accepts a filename and retrieves the full path from disk.
 func (c *Client) GetURL(name string) string {
 	return fmt.Sprintf("%s%s/%s", c.opts.RootURL, c.opts.UploadURI, name)
@@ -1,8 +1,10 @@
 package s3
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"path/filepath"
 	"strings"
@@ -12,6 +14,25 @@ import (
 	"github.com/rhnvrm/simples3"
 )
 
+const (
+	// URLModeAuto generates presigned URLs for private buckets that don't
+	// have a public URL and public URLs otherwise.
+	URLModeAuto = "auto"
+
+	// URLModePublic always generates URLs with the public URL (eg: a CDN) or
+	// the bucket URL as the base.
+	URLModePublic = "public"
+
+	// URLModePresigned always generates time-limited presigned URLs.
+	URLModePresigned = "presigned"
+
+	// Max expiry of presigned URLs allowed by S3. The media URLs in e-mails are
+	// signed when the messages are sent and stop working after the expiry, and
+	// hence, the public mode with a public (CDN) URL should be used for media
+	// in campaigns that are read long after they're sent.
+	MaxExpiry = time.Hour * 24 * 7
+)
+
 // Opt represents AWS S3 specific params
 type Opt struct {
 	URL        string        `koanf:"url"`
@@ -23,6 +44,7 @@ type Opt struct {
 	BucketPath string        `koanf:"bucket_path"`
 	BucketType string        `koanf:"bucket_type"`
 	Expiry     time.Duration `koanf:"expiry"`
+	URLMode    string        `koanf:"url_mode"`
 }
 
 // Client implements `media.Store` for S3 provider
@@ -40,9 +62,19 @@ func NewS3Store(opt Opt) (media.Store, error) {
 	}
 	opt.URL = strings.TrimRight(opt.URL, "/")
 
+	switch opt.URLMode {
+	case URLModeAuto, URLModePublic, URLModePresigned:
+	case "":
+		opt.URLMode = URLModeAuto
+	default:
+		return nil, fmt.Errorf("unknown url_mode: %s", opt.URLMode)
+	}
+
 	// Default (and max S3 expiry) is 7 days.
 	if opt.Expiry.Seconds() < 1 {
 		opt.Expiry = time.Duration(167) * time.Hour
+	} else if opt.Expiry > MaxExpiry {
+		opt.Expiry = MaxExpiry
 	}
 
 	if opt.AccessKey == "" && opt.SecretKey == "" {
@@ -86,19 +118,12 @@ func (c *Client) Put(name string, cType string, file io.ReadSeeker) (string, err
 	return name, nil
 }
 
-// Get accepts the filename of the object stored and retrieves from S3.
+// GetURL accepts the filename of the object stored and returns its URL based
+// on the URL mode. Presigned URLs are signed afresh on every call and are valid
+// for the configured expiry.
 func (c *Client) GetURL(name string) string {
-	// Generate a private S3 pre-signed URL if it's a private bucket, and there
-	// is no public URL provided.
-	if c.opts.BucketType == "private" && c.opts.PublicURL == "" {
-		u := c.s3.GeneratePresignedURL(simples3.PresignedInput{
-			Bucket:        c.opts.Bucket,
-			ObjectKey:     c.makeBucketPath(name),
-			Method:        "GET",
-			Timestamp:     time.Now(),
-			ExpirySeconds: int(c.opts.Expiry.Seconds()),
-		})
-		return u
+	if c.Presigned() {
+		return c.presign(name, time.Now())
 	}
 
 	// Generate a public S3 URL if it's a public bucket or a public URL is
@@ -106,6 +131,31 @@ func (c *Client) GetURL(name string) string {
 	return c.makeFileURL(name)
 }
 
+// presign returns a presigned URL of a file that's signed at the given time
+// and is valid for the configured expiry from then.
+func (c *Client) presign(name string, t time.Time) string {
+	return c.s3.GeneratePresignedURL(simples3.PresignedInput{
+		Bucket:        c.opts.Bucket,
+		ObjectKey:     c.makeBucketPath(name),
+		Method:        "GET",
+		Timestamp:     t,
+		ExpirySeconds: int(c.opts.Expiry.Seconds()),
+	})
+}
+
+// Presigned returns true if the URLs of the files are time-limited presigned URLs.
+// That's when it's explicitly asked for, or when it's a private bucket and there is
+// no public URL provided.
+func (c *Client) Presigned() bool {
+	return c.opts.URLMode == URLModePresigned ||
+		(c.opts.URLMode == URLModeAuto && c.opts.BucketType == "private" && c.opts.PublicURL == "")
+}
+
+// Expiry returns the expiry of presigned URLs.
+func (c *Client) Expiry() time.Duration {
+	return c.opts.Expiry
+}
+
 // GetBlob reads a file from S3 and returns the raw bytes.
 func (c *Client) GetBlob(uurl string) ([]byte, error) {
 	if p, err := url.Parse(uurl); err != nil {
@@ -140,6 +190,26 @@ func (c *Client) Delete(name string) error {
 	return err
 }
 
+// Check checks if the S3 endpoint is reachable. Any HTTP response,
+// including an access denied, means that it is.
+func (c *Client) Check(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, c.opts.URL+"/"+c.opts.Bucket, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("S3 endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
 // makeBucketPath returns the file path inside the bucket. The path should not
 // start with a /.
 func (c *Client) makeBucketPath(name string) string {
@@ -0,0 +1,222 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mockS3 is a minimal S3 server that stores objects uploaded with PUT and serves
+// them with GET. Objects are addressed by path (/bucket/key) or by virtual host
+// (bucket.host/key), the latter being how presigned URLs are made. GET requests
+// without credentials are only allowed for public objects.
+type mockS3 struct {
+	srv  *httptest.Server
+	objs map[string][]byte
+	acls map[string]string
+	mut  sync.Mutex
+}
+
+func newMockS3(t *testing.T) *mockS3 {
+	t.Helper()
+
+	m := &mockS3{objs: make(map[string][]byte), acls: make(map[string]string)}
+	m.srv = httptest.NewTLSServer(http.HandlerFunc(m.handle))
+	t.Cleanup(m.srv.Close)
+
+	return m
+}
+
+func (m *mockS3) handle(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if host, _, _ := strings.Cut(r.Host, ":"); strings.HasSuffix(host, ".s3.amazonaws.com") {
+		key = strings.TrimSuffix(host, ".s3.amazonaws.com") + "/" + key
+	}
+
+	m.mut.Lock()
+	defer m.mut.Unlock()
+
+	switch r.Method {
+	case http.MethodPut:
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		b, _ := io.ReadAll(r.Body)
+		m.objs[key] = b
+		m.acls[key] = r.Header.Get("x-amz-acl")
+
+	case http.MethodGet:
+		b, ok := m.objs[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		if m.acls[key] != "public-read" {
+			q := r.URL.Query()
+			if q.Get("X-Amz-Signature") == "" || q.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			date, err := time.Parse("20060102T150405Z", q.Get("X-Amz-Date"))
+			exp, _ := strconv.Atoi(q.Get("X-Amz-Expires"))
+			if err != nil || exp < 1 || time.Now().After(date.Add(time.Duration(exp)*time.Second)) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+		w.Write(b)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// client returns an HTTP client that sends all requests, including those to
+// virtual hosts of buckets, to the mock server.
+func (m *mockS3) client() *http.Client {
+	var (
+		addr = m.srv.Listener.Addr().String()
+		tr   = m.srv.Client().Transport.(*http.Transport).Clone()
+	)
+	tr.TLSClientConfig.InsecureSkipVerify = true
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, addr)
+	}
+
+	return &http.Client{Transport: tr}
+}
+
+func newTestClient(t *testing.T, m *mockS3, opt Opt) *Client {
+	t.Helper()
+
+	opt.URL = m.srv.URL
+	opt.AccessKey = "key"
+	opt.SecretKey = "secret"
+	opt.Region = "ap-south-1"
+	opt.Bucket = "media"
+
+	st, err := NewS3Store(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := st.(*Client)
+	c.s3.SetClient(m.client())
+	return c
+}
+
+func fetch(t *testing.T, m *mockS3, u string) (int, []byte) {
+	t.Helper()
+
+	resp, err := m.client().Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, b
+}
+
+func TestPublicURLs(t *testing.T) {
+	m := newMockS3(t)
+	c := newTestClient(t, m, Opt{BucketType: "public", BucketPath: "/uploads", URLMode: URLModePublic})
+
+	if _, err := c.Put("logo.png", "image/png", bytes.NewReader([]byte("png"))); err != nil {
+		t.Fatalf("error uploading: %v", err)
+	}
+
+	u := c.GetURL("logo.png")
+	if exp := m.srv.URL + "/media/uploads/logo.png"; u != exp {
+		t.Fatalf("expected %s, got %s", exp, u)
+	}
+	if c.Presigned() {
+		t.Error("expected public URLs to not be presigned")
+	}
+	if code, b := fetch(t, m, u); code != http.StatusOK || string(b) != "png" {
+		t.Fatalf("expected the file from the public URL, got %d: %s", code, b)
+	}
+
+	// With a public (CDN) URL, that's the base of the URLs and they never expire.
+	c.opts.PublicURL = "https://cdn.listmonk.app"
+	if u := c.GetURL("logo.png"); u != "https://cdn.listmonk.app/uploads/logo.png" {
+		t.Errorf("expected the public URL, got %s", u)
+	}
+}
+
+func TestPresignedURLs(t *testing.T) {
+	m := newMockS3(t)
+	c := newTestClient(t, m, Opt{BucketType: "private", Expiry: time.Hour, URLMode: URLModePresigned})
+
+	if _, err := c.Put("logo.png", "image/png", bytes.NewReader([]byte("png"))); err != nil {
+		t.Fatalf("error uploading: %v", err)
+	}
+
+	// Private files can't be fetched without a signature.
+	if code, _ := fetch(t, m, m.srv.URL+"/media/logo.png"); code != http.StatusForbidden {
+		t.Fatalf("expected the private file to be forbidden, got %d", code)
+	}
+
+	u := c.GetURL("logo.png")
+	p, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Presigned() || p.Query().Get("X-Amz-Signature") == "" {
+		t.Fatalf("expected a presigned URL, got %s", u)
+	}
+	if exp := p.Query().Get("X-Amz-Expires"); exp != "3600" {
+		t.Errorf("expected the URL to expire in 3600 seconds, got %s", exp)
+	}
+	if code, b := fetch(t, m, u); code != http.StatusOK || string(b) != "png" {
+		t.Fatalf("expected the file from the presigned URL, got %d: %s", code, b)
+	}
+
+	// A URL signed earlier than the expiry is rejected. URLs are signed afresh on
+	// every call, which is when the messages are rendered on sending.
+	old := c.presign("logo.png", time.Now().Add(-time.Hour*2))
+	if code, _ := fetch(t, m, old); code != http.StatusForbidden {
+		t.Errorf("expected an expired URL to be forbidden, got %d", code)
+	}
+}
+
+func TestAutoURLMode(t *testing.T) {
+	m := newMockS3(t)
+
+	if c := newTestClient(t, m, Opt{BucketType: "private"}); !c.Presigned() {
+		t.Error("expected a private bucket without a public URL to be presigned")
+	}
+	if c := newTestClient(t, m, Opt{BucketType: "private", PublicURL: "https://cdn.listmonk.app"}); c.Presigned() {
+		t.Error("expected a private bucket with a public URL to not be presigned")
+	}
+	if c := newTestClient(t, m, Opt{BucketType: "public"}); c.Presigned() {
+		t.Error("expected a public bucket to not be presigned")
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	m := newMockS3(t)
+
+	if c := newTestClient(t, m, Opt{Expiry: time.Hour * 24 * 30}); c.Expiry() != MaxExpiry {
+		t.Errorf("expected the expiry to be limited to %v, got %v", MaxExpiry, c.Expiry())
+	}
+	if c := newTestClient(t, m, Opt{}); c.Expiry() <= 0 || c.Expiry() > MaxExpiry {
+		t.Errorf("expected a default expiry within %v, got %v", MaxExpiry, c.Expiry())
+	}
+
+	if _, err := NewS3Store(Opt{URLMode: "cdn"}); err == nil {
+		t.Error("expected an unknown URL mode to fail")
+	}
+}
@@ -0,0 +1,170 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/knadh/smtppool"
+)
+
+const ctAMP = "text/x-amp-html"
+
+// renderAMP renders a message with an AMP for Email body into a raw (CRLF) message.
+// smtppool can't render additional alternative parts, and hence, messages with
+// AMP bodies are rendered here with the parts in the order recommended by the
+// spec: text/plain, text/x-amp-html, and text/html last as the fallback.
+func renderAMP(em smtppool.Email, amp []byte) ([]byte, error) {
+	hdr, err := ampHeaders(em)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		body  bytes.Buffer
+		mixed *multipart.Writer
+		alt   *multipart.Writer
+	)
+	if len(em.Attachments) > 0 {
+		mixed = multipart.NewWriter(&body)
+		alt = multipart.NewWriter(&body)
+		hdr.Set("Content-Type", "multipart/mixed;\r\n boundary="+mixed.Boundary())
+
+		if _, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"multipart/alternative;\r\n boundary=" + alt.Boundary()},
+		}); err != nil {
+			return nil, err
+		}
+	} else {
+		alt = multipart.NewWriter(&body)
+		hdr.Set("Content-Type", "multipart/alternative;\r\n boundary="+alt.Boundary())
+	}
+
+	if len(em.Text) > 0 {
+		if err := writeQPPart(alt, "text/plain", em.Text); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeQPPart(alt, ctAMP, amp); err != nil {
+		return nil, err
+	}
+	if err := writeQPPart(alt, "text/html", em.HTML); err != nil {
+		return nil, err
+	}
+	if err := alt.Close(); err != nil {
+		return nil, err
+	}
+
+	if mixed != nil {
+		for _, a := range em.Attachments {
+			w, err := mixed.CreatePart(a.Header)
+			if err != nil {
+				return nil, err
+			}
+			writeBase64(w, a.Content)
+		}
+		if err := mixed.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, body.Len()+1024))
+	for field, vals := range hdr {
+		for _, v := range vals {
+			if field != "Content-Type" {
+				v = mime.QEncoding.Encode("UTF-8", v)
+			}
+			out.WriteString(field + ": " + v + "\r\n")
+		}
+	}
+	out.WriteString("\r\n")
+	out.Write(body.Bytes())
+
+	return out.Bytes(), nil
+}
+
+// ampHeaders returns the top level headers of a message.
+func ampHeaders(em smtppool.Email) (textproto.MIMEHeader, error) {
+	hdr := make(textproto.MIMEHeader, len(em.Headers)+8)
+	for k, v := range em.Headers {
+		hdr[k] = v
+	}
+
+	from, err := mail.ParseAddress(em.From)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Set("From", from.String())
+
+	for k, addrs := range map[string][]string{"To": em.To, "Cc": em.Cc, "Reply-To": em.ReplyTo} {
+		if len(addrs) == 0 || hdr.Get(k) != "" {
+			continue
+		}
+
+		list, err := mail.ParseAddressList(strings.Join(addrs, ","))
+		if err != nil {
+			return nil, err
+		}
+		s := make([]string, 0, len(list))
+		for _, a := range list {
+			s = append(s, a.String())
+		}
+		hdr.Set(k, strings.Join(s, ", "))
+	}
+
+	if em.Subject != "" && hdr.Get("Subject") == "" {
+		hdr.Set("Subject", em.Subject)
+	}
+	if hdr.Get("Message-Id") == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			host = "localhost"
+		}
+		hdr.Set("Message-Id", fmt.Sprintf("<%d.%d.%d@%s>", time.Now().UnixNano(), os.Getpid(), rand.Int63(), host))
+	}
+	if hdr.Get("Date") == "" {
+		hdr.Set("Date", time.Now().Format(time.RFC1123Z))
+	}
+	hdr.Set("Mime-Version", "1.0")
+
+	return hdr, nil
+}
+
+// writeQPPart writes a quoted-printable encoded part to a multipart writer.
+func writeQPPart(w *multipart.Writer, contentType string, b []byte) error {
+	p, err := w.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType + "; charset=UTF-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+
+	qp := quotedprintable.NewWriter(p)
+	if _, err := qp.Write(b); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// writeBase64 writes base64 encoded content wrapped at 76 characters (RFC 2045).
+func writeBase64(w io.Writer, b []byte) {
+	s := base64.StdEncoding.EncodeToString(b)
+	for len(s) > 76 {
+		w.Write([]byte(s[:76] + "\r\n"))
+		s = s[76:]
+	}
+	if len(s) > 0 {
+		w.Write([]byte(s + "\r\n"))
+	}
+}
@@ -0,0 +1,278 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// Headers that are signed when a DKIM key doesn't specify them.
+var dkimDefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "MIME-Version",
+	"Content-Type", "Content-Transfer-Encoding", "List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// DKIMKey represents a DKIM signing key for a sending domain.
+type DKIMKey struct {
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+
+	// PEM encoded RSA (PKCS#1 or PKCS#8) or Ed25519 (PKCS#8) private key.
+	PrivateKey string `json:"private_key"`
+
+	// Headers to sign. From is always signed.
+	Headers []string `json:"headers"`
+}
+
+// DKIMSigner signs messages with a DKIM key using relaxed/relaxed canonicalization.
+type DKIMSigner struct {
+	domain   string
+	selector string
+	algo     string
+	key      crypto.Signer
+	headers  []string
+}
+
+// NewDKIMSigner validates a DKIM key and returns a signer.
+func NewDKIMSigner(k DKIMKey) (*DKIMSigner, error) {
+	domain := strings.ToLower(strings.TrimSpace(k.Domain))
+	if domain == "" {
+		return nil, errors.New("invalid DKIM domain")
+	}
+
+	selector := strings.TrimSpace(k.Selector)
+	if selector == "" {
+		return nil, fmt.Errorf("invalid DKIM selector for %s", domain)
+	}
+
+	blk, _ := pem.Decode([]byte(strings.TrimSpace(k.PrivateKey)))
+	if blk == nil {
+		return nil, fmt.Errorf("invalid DKIM private key for %s: no PEM block", domain)
+	}
+
+	var key interface{}
+	if k, err := x509.ParsePKCS1PrivateKey(blk.Bytes); err == nil {
+		key = k
+	} else if k, err := x509.ParsePKCS8PrivateKey(blk.Bytes); err == nil {
+		key = k
+	} else {
+		return nil, fmt.Errorf("invalid DKIM private key for %s: %v", domain, err)
+	}
+
+	s := &DKIMSigner{domain: domain, selector: selector}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 1024 {
+			return nil, fmt.Errorf("DKIM RSA key for %s should be at least 1024 bits", domain)
+		}
+		s.algo = "rsa-sha256"
+		s.key = k
+	case ed25519.PrivateKey:
+		s.algo = "ed25519-sha256"
+		s.key = k
+	default:
+		return nil, fmt.Errorf("unsupported DKIM private key type for %s", domain)
+	}
+
+	// Headers to sign, deduplicated, with From.
+	hdrs := k.Headers
+	if len(hdrs) == 0 {
+		hdrs = dkimDefaultHeaders
+	}
+	seen := map[string]bool{"from": true}
+	s.headers = []string{"From"}
+	for _, h := range hdrs {
+		h = strings.TrimSpace(h)
+		if h == "" || seen[strings.ToLower(h)] {
+			continue
+		}
+		seen[strings.ToLower(h)] = true
+		s.headers = append(s.headers, h)
+	}
+
+	return s, nil
+}
+
+// Sign signs a raw (CRLF) message and returns it with the DKIM-Signature header prepended.
+func (s *DKIMSigner) Sign(msg []byte) ([]byte, error) {
+	hdr, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		return nil, errors.New("invalid message: no header and body separator")
+	}
+
+	// Body hash.
+	bh := sha256.Sum256(dkimRelaxedBody(body))
+
+	// Pick the headers to be signed that are present in the message. If a header
+	// occurs multiple times, the instances are signed from the bottom up.
+	var (
+		fields = dkimHeaderFields(hdr)
+		names  = make([]string, 0, len(s.headers))
+		signed bytes.Buffer
+		used   = make(map[int]bool)
+	)
+	for _, h := range s.headers {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fields[i].name, h) {
+				continue
+			}
+			used[i] = true
+			names = append(names, strings.ToLower(h))
+			signed.WriteString(dkimRelaxedHeader(fields[i].name, fields[i].value))
+			signed.WriteString("\r\n")
+			break
+		}
+	}
+
+	sig := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		s.algo, s.domain, s.selector, time.Now().Unix(), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bh[:]))
+
+	// The signature header itself (with an empty b=) is signed last, without the trailing CRLF.
+	signed.WriteString(dkimRelaxedHeader("DKIM-Signature", sig))
+
+	h := sha256.Sum256(signed.Bytes())
+
+	var (
+		b   []byte
+		err error
+	)
+	switch s.algo {
+	case "ed25519-sha256":
+		b, err = s.key.Sign(rand.Reader, h[:], crypto.Hash(0))
+	default:
+		b, err = s.key.Sign(rand.Reader, h[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing message: %v", err)
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(msg)+len(sig)+512))
+	out.WriteString("DKIM-Signature: ")
+	out.WriteString(sig)
+	dkimWrap(out, base64.StdEncoding.EncodeToString(b))
+	out.WriteString("\r\n")
+	out.Write(msg)
+
+	return out.Bytes(), nil
+}
+
+type dkimField struct {
+	name  string
+	value string
+}
+
+// dkimHeaderFields splits a raw header block into fields with their
+// (still folded) values.
+func dkimHeaderFields(hdr []byte) []dkimField {
+	var out []dkimField
+	for _, ln := range strings.Split(string(hdr), "\r\n") {
+		if ln == "" {
+			continue
+		}
+
+		// Continuation of a folded header.
+		if (ln[0] == ' ' || ln[0] == '\t') && len(out) > 0 {
+			out[len(out)-1].value += "\r\n" + ln
+			continue
+		}
+
+		name, val, ok := strings.Cut(ln, ":")
+		if !ok {
+			continue
+		}
+		out = append(out, dkimField{name: name, value: val})
+	}
+
+	return out
+}
+
+// dkimRelaxedHeader canonicalizes a header field with the "relaxed" algorithm (RFC 6376 3.4.2).
+func dkimRelaxedHeader(name, value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.Join(strings.Fields(value), " ")
+}
+
+// dkimRelaxedBody canonicalizes a message body with the "relaxed" algorithm (RFC 6376 3.4.4).
+func dkimRelaxedBody(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, ln := range lines {
+		// Reduce whitespace runs to a single space and remove trailing whitespace.
+		var b strings.Builder
+		ws := false
+		for _, r := range ln {
+			if r == ' ' || r == '\t' {
+				ws = true
+				continue
+			}
+			if ws {
+				b.WriteByte(' ')
+				ws = false
+			}
+			b.WriteRune(r)
+		}
+		lines[i] = b.String()
+	}
+
+	// Remove empty lines at the end of the body.
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// dkimWrap writes the signature folded into lines.
+func dkimWrap(w *bytes.Buffer, s string) {
+	const width = 72
+	for len(s) > width {
+		w.WriteString(s[:width])
+		w.WriteString("\r\n ")
+		s = s[width:]
+	}
+	w.WriteString(s)
+}
+
+// addrDomain returns the lowercased domain of an e-mail address.
+func addrDomain(addr string) string {
+	a, err := mail.ParseAddress(addr)
+	if err != nil {
+		return ""
+	}
+
+	_, domain, ok := strings.Cut(a.Address, "@")
+	if !ok {
+		return ""
+	}
+	return strings.ToLower(domain)
+}
+
+// parseAddrs parses a list of e-mail addresses into their bare addresses.
+func parseAddrs(lists ...[]string) ([]string, error) {
+	var out []string
+	for _, l := range lists {
+		for _, s := range l {
+			a, err := mail.ParseAddress(s)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, a.Address)
+		}
+	}
+
+	return out, nil
+}
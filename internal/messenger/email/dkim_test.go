@@ -0,0 +1,318 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/knadh/smtppool"
+)
+
+// testSMTPServer is a minimal SMTP server that records the messages sent to it.
+type testSMTPServer struct {
+	ln    net.Listener
+	conns int
+	msgs  [][]byte
+	mut   sync.Mutex
+}
+
+func newTestSMTPServer(t *testing.T) *testSMTPServer {
+	t.Helper()
+
+	return newTestSMTPServerAt(t, "127.0.0.1:0")
+}
+
+// newTestSMTPServerAt starts a test SMTP server on the given address.
+func newTestSMTPServerAt(t *testing.T, addr string) *testSMTPServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	s := &testSMTPServer{ln: ln}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			s.mut.Lock()
+			s.conns++
+			s.mut.Unlock()
+			go s.handle(c)
+		}
+	}()
+
+	return s
+}
+
+func (s *testSMTPServer) handle(c net.Conn) {
+	tp := textproto.NewConn(c)
+	defer tp.Close()
+
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		ln, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+
+		cmd, _, _ := strings.Cut(strings.ToUpper(ln), " ")
+		switch cmd {
+		case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 Go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+
+			s.mut.Lock()
+			s.msgs = append(s.msgs, bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n")))
+			s.mut.Unlock()
+			tp.PrintfLine("250 OK")
+		case "QUIT":
+			tp.PrintfLine("221 Bye")
+			return
+		default:
+			tp.PrintfLine("502 Not implemented")
+		}
+	}
+}
+
+func (s *testSMTPServer) port() int {
+	return s.ln.Addr().(*net.TCPAddr).Port
+}
+
+func testDKIMKeys(t *testing.T) map[string]crypto.Signer {
+	t.Helper()
+
+	r, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]crypto.Signer{"rsa": r, "ed25519": ed}
+}
+
+func pemKey(t *testing.T, k crypto.Signer) string {
+	t.Helper()
+
+	b, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: b}))
+}
+
+var (
+	reWSP  = regexp.MustCompile(`[ \t]+`)
+	reSigB = regexp.MustCompile(`(;\s*)b=[^;]*`)
+)
+
+// verifyDKIM verifies the DKIM-Signature (relaxed/relaxed) of a raw message with
+// a public key as a receiving server would.
+func verifyDKIM(msg []byte, pub crypto.PublicKey) error {
+	hdr, body, ok := bytes.Cut(msg, []byte("\r\n\r\n"))
+	if !ok {
+		return errors.New("no header and body separator")
+	}
+
+	// Unfold the header fields.
+	var fields []string
+	for _, ln := range strings.Split(string(hdr), "\r\n") {
+		if (strings.HasPrefix(ln, " ") || strings.HasPrefix(ln, "\t")) && len(fields) > 0 {
+			fields[len(fields)-1] += ln
+			continue
+		}
+		fields = append(fields, ln)
+	}
+	relaxed := func(f string) string {
+		name, val, _ := strings.Cut(f, ":")
+		return strings.ToLower(strings.TrimSpace(name)) + ":" + strings.TrimSpace(reWSP.ReplaceAllString(val, " "))
+	}
+
+	var sigField string
+	for _, f := range fields {
+		if strings.HasPrefix(strings.ToLower(f), "dkim-signature:") {
+			sigField = f
+			break
+		}
+	}
+	if sigField == "" {
+		return errors.New("no DKIM-Signature")
+	}
+
+	tags := map[string]string{}
+	_, val, _ := strings.Cut(sigField, ":")
+	for _, t := range strings.Split(val, ";") {
+		k, v, _ := strings.Cut(t, "=")
+		tags[strings.TrimSpace(k)] = strings.Join(strings.Fields(v), "")
+	}
+
+	// Body hash.
+	lines := strings.Split(string(body), "\r\n")
+	for i, ln := range lines {
+		lines[i] = strings.TrimRight(reWSP.ReplaceAllString(ln, " "), " ")
+	}
+	cb := strings.TrimRight(strings.Join(lines, "\r\n"), "\r\n")
+	if cb != "" {
+		cb += "\r\n"
+	}
+	bh := sha256.Sum256([]byte(cb))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	// Signed headers, picked from the bottom up, and the signature header with an empty b=.
+	var (
+		signed bytes.Buffer
+		used   = map[int]bool{}
+	)
+	for _, h := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			name, _, _ := strings.Cut(fields[i], ":")
+			if used[i] || !strings.EqualFold(strings.TrimSpace(name), h) {
+				continue
+			}
+			used[i] = true
+			signed.WriteString(relaxed(fields[i]) + "\r\n")
+			break
+		}
+	}
+	signed.WriteString(reSigB.ReplaceAllString(relaxed(sigField), "${1}b="))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256(signed.Bytes())
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, hash[:], sig) {
+			return errors.New("invalid ed25519 signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown key type %T", pub)
+}
+
+func TestDKIMSignVerify(t *testing.T) {
+	msg := []byte("From: Listmonk <noreply@listmonk.app>\r\n" +
+		"To: subscriber@example.org\r\n" +
+		"Subject:   Hello   there\r\n" +
+		"List-Unsubscribe: <https://listmonk.app/unsub>\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" +
+		"Hello  world \r\n" +
+		"\r\n" +
+		"\r\n")
+
+	for name, k := range testDKIMKeys(t) {
+		s, err := NewDKIMSigner(DKIMKey{Domain: "listmonk.app", Selector: "lm", PrivateKey: pemKey(t, k)})
+		if err != nil {
+			t.Fatalf("%s: error creating signer: %v", name, err)
+		}
+
+		b, err := s.Sign(msg)
+		if err != nil {
+			t.Fatalf("%s: error signing: %v", name, err)
+		}
+		if err := verifyDKIM(b, k.Public()); err != nil {
+			t.Fatalf("%s: error verifying signature: %v", name, err)
+		}
+
+		// Tampering with a signed header or the body fails the verification.
+		if err := verifyDKIM(bytes.Replace(b, []byte("Hello   there"), []byte("Hi"), 1), k.Public()); err == nil {
+			t.Errorf("%s: expected a modified subject to fail the verification", name)
+		}
+		if err := verifyDKIM(bytes.Replace(b, []byte("world"), []byte("there"), 1), k.Public()); err == nil {
+			t.Errorf("%s: expected a modified body to fail the verification", name)
+		}
+	}
+}
+
+func TestPushSigned(t *testing.T) {
+	srv := newTestSMTPServer(t)
+
+	e, err := New(Server{
+		AuthProtocol: "none",
+		TLSType:      "none",
+		Opt: smtppool.Opt{
+			Host:            "127.0.0.1",
+			Port:            srv.port(),
+			MaxConns:        2,
+			PoolWaitTimeout: time.Second * 2,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	keys := testDKIMKeys(t)
+	if err := e.SetDKIMKeys(DKIMKey{Domain: "listmonk.app", Selector: "lm", PrivateKey: pemKey(t, keys["rsa"])}); err != nil {
+		t.Fatal(err)
+	}
+
+	const num = 5
+	for i := 0; i < num; i++ {
+		err := e.Push(models.Message{
+			From:        "Listmonk <noreply@listmonk.app>",
+			To:          []string{"subscriber@example.org"},
+			Subject:     fmt.Sprintf("Hello %d", i),
+			ContentType: "html",
+			Body:        []byte("<p>Hello world</p>"),
+			AltBody:     []byte("Hello world"),
+		})
+		if err != nil {
+			t.Fatalf("error pushing message: %v", err)
+		}
+	}
+
+	srv.mut.Lock()
+	defer srv.mut.Unlock()
+
+	if len(srv.msgs) != num {
+		t.Fatalf("expected %d messages, got %d", num, len(srv.msgs))
+	}
+	for i, m := range srv.msgs {
+		if err := verifyDKIM(m, keys["rsa"].Public()); err != nil {
+			t.Errorf("message %d: error verifying the received message: %v", i, err)
+		}
+	}
+
+	// The messages are sent over a pooled connection.
+	if srv.conns != 1 {
+		t.Errorf("expected the messages to be sent over 1 connection, got %d", srv.conns)
+	}
+}
@@ -2,11 +2,16 @@ package email
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"net/smtp"
 	"net/textproto"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/knadh/listmonk/models"
 	"github.com/knadh/smtppool"
@@ -17,8 +22,15 @@ const (
 	hdrReturnPath = "Return-Path"
 	hdrBcc        = "Bcc"
 	hdrCc         = "Cc"
+
+	// Number of consecutive connection errors after which a server is taken out
+	// of rotation.
+	breakerThreshold = 3
 )
 
+// Interval at which a server that's out of rotation is probed until it recovers.
+var breakerProbe = time.Second * 30
+
 // Server represents an SMTP server's credentials.
 type Server struct {
 	Username      string            `json:"username"`
@@ -28,16 +40,52 @@ type Server struct {
 	TLSSkipVerify bool              `json:"tls_skip_verify"`
 	EmailHeaders  map[string]string `json:"email_headers"`
 
+	// Weight of the server in the rotation relative to the other servers.
+	// eg: with weights 7 and 3, 70% of the messages are sent via the first server.
+	Weight int `json:"weight"`
+
 	// Rest of the options are embedded directly from the smtppool lib.
 	// The JSON tag is for config unmarshal to work.
 	smtppool.Opt `json:",squash"`
 
 	pool *smtppool.Pool
+	raw  *rawPool
+	b    *breaker
+}
+
+// breaker is the circuit breaker state of a server.
+type breaker struct {
+	mut       sync.Mutex
+	errs      int
+	down      bool
+	downSince time.Time
+	lastErr   string
+
+	// Total messages sent and failed via the server.
+	sent   uint64
+	failed uint64
+}
+
+// ServerHealth represents the health of an SMTP server in the rotation.
+type ServerHealth struct {
+	Host      string     `json:"host"`
+	Port      int        `json:"port"`
+	Username  string     `json:"username"`
+	Weight    int        `json:"weight"`
+	Healthy   bool       `json:"healthy"`
+	Errors    int        `json:"errors"`
+	DownSince *time.Time `json:"down_since"`
+	LastError string     `json:"last_error"`
+	Sent      uint64     `json:"sent"`
+	Failed    uint64     `json:"failed"`
 }
 
 // Emailer is the SMTP e-mail messenger.
 type Emailer struct {
 	servers []*Server
+
+	// DKIM signers by the sending (From) domain.
+	dkim map[string]*DKIMSigner
 }
 
 // New returns an SMTP e-mail Messenger backend with the given SMTP servers.
@@ -48,6 +96,10 @@ func New(servers ...Server) (*Emailer, error) {
 
 	for _, srv := range servers {
 		s := srv
+		if s.Weight < 1 {
+			s.Weight = 1
+		}
+
 		var auth smtp.Auth
 		switch s.AuthProtocol {
 		case "cram":
@@ -83,12 +135,30 @@ func New(servers ...Server) (*Emailer, error) {
 		}
 
 		s.pool = pool
+		s.raw = newRawPool(&s)
+		s.b = &breaker{}
 		e.servers = append(e.servers, &s)
 	}
 
 	return e, nil
 }
 
+// SetDKIMKeys sets the keys with which messages are DKIM signed based on the
+// domain of their From address. Messages from other domains aren't signed.
+func (e *Emailer) SetDKIMKeys(keys ...DKIMKey) error {
+	dkim := make(map[string]*DKIMSigner, len(keys))
+	for _, k := range keys {
+		s, err := NewDKIMSigner(k)
+		if err != nil {
+			return err
+		}
+		dkim[s.domain] = s
+	}
+
+	e.dkim = dkim
+	return nil
+}
+
 // Name returns the Server's name.
 func (e *Emailer) Name() string {
 	return emName
@@ -96,17 +166,7 @@ func (e *Emailer) Name() string {
 
 // Push pushes a message to the server.
 func (e *Emailer) Push(m models.Message) error {
-	// If there are more than one SMTP servers, send to a random
-	// one from the list.
-	var (
-		ln  = len(e.servers)
-		srv *Server
-	)
-	if ln > 1 {
-		srv = e.servers[rand.Intn(ln)]
-	} else {
-		srv = e.servers[0]
-	}
+	srv := e.pickServer()
 
 	// Are there attachments?
 	var files []smtppool.Attachment
@@ -175,7 +235,214 @@ func (e *Emailer) Push(m models.Message) error {
 		}
 	}
 
-	return srv.pool.Send(em)
+	var (
+		err error
+		d   = e.dkim[addrDomain(em.From)]
+	)
+	if len(m.AMPBody) > 0 && len(em.HTML) > 0 {
+		err = srv.sendAMP(em, m.AMPBody, d)
+	} else if d != nil {
+		err = srv.sendSigned(em, d)
+	} else {
+		err = srv.smtpPool().Send(em)
+	}
+	srv.recordResult(err)
+
+	return err
+}
+
+// sendSigned renders a message, DKIM signs it, and sends it.
+func (s *Server) sendSigned(em smtppool.Email, d *DKIMSigner) error {
+	b, err := em.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return s.sendRendered(em, b, d)
+}
+
+// sendAMP renders a message with an AMP body, DKIM signs it if there's a
+// signer, and sends it.
+func (s *Server) sendAMP(em smtppool.Email, amp []byte, d *DKIMSigner) error {
+	b, err := renderAMP(em, amp)
+	if err != nil {
+		return err
+	}
+
+	return s.sendRendered(em, b, d)
+}
+
+// sendRendered DKIM signs a rendered message if there's a signer and sends it
+// to the message's recipients.
+func (s *Server) sendRendered(em smtppool.Email, b []byte, d *DKIMSigner) error {
+	if d != nil {
+		var err error
+		if b, err = d.Sign(b); err != nil {
+			return err
+		}
+	}
+
+	sender := em.Sender
+	if sender == "" {
+		sender = em.From
+	}
+	from, err := parseAddrs([]string{sender})
+	if err != nil {
+		return err
+	}
+
+	to, err := parseAddrs(em.To, em.Cc, em.Bcc)
+	if err != nil {
+		return err
+	}
+
+	return s.raw.send(from[0], to, b)
+}
+
+// Health returns the health of all the SMTP servers.
+func (e *Emailer) Health() []ServerHealth {
+	out := make([]ServerHealth, 0, len(e.servers))
+	for _, s := range e.servers {
+		s.b.mut.Lock()
+		h := ServerHealth{
+			Host:      s.Host,
+			Port:      s.Port,
+			Username:  s.Username,
+			Weight:    s.Weight,
+			Healthy:   !s.b.down,
+			Errors:    s.b.errs,
+			LastError: s.b.lastErr,
+			Sent:      s.b.sent,
+			Failed:    s.b.failed,
+		}
+		if s.b.down {
+			t := s.b.downSince
+			h.DownSince = &t
+		}
+		s.b.mut.Unlock()
+
+		out = append(out, h)
+	}
+
+	return out
+}
+
+// pickServer picks a random server from the healthy servers proportional to
+// their weights. If none of the servers are healthy, all of them are considered.
+func (e *Emailer) pickServer() *Server {
+	if len(e.servers) == 1 {
+		return e.servers[0]
+	}
+
+	var (
+		healthy = make([]*Server, 0, len(e.servers))
+		total   = 0
+	)
+	for _, s := range e.servers {
+		s.b.mut.Lock()
+		down := s.b.down
+		s.b.mut.Unlock()
+
+		if !down {
+			healthy = append(healthy, s)
+			total += s.Weight
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = e.servers
+		total = 0
+		for _, s := range healthy {
+			total += s.Weight
+		}
+	}
+
+	n := rand.Intn(total)
+	for _, s := range healthy {
+		if n < s.Weight {
+			return s
+		}
+		n -= s.Weight
+	}
+
+	return healthy[len(healthy)-1]
+}
+
+// recordResult updates the server's circuit breaker with the result of a send.
+// SMTP responses (eg: a rejected recipient) mean that the server is reachable and
+// only connection errors count towards tripping the breaker. On tripping,
+// the server is taken out of rotation and is probed until it's reachable again.
+func (s *Server) recordResult(err error) {
+	s.b.mut.Lock()
+	defer s.b.mut.Unlock()
+
+	if err == nil {
+		s.b.sent++
+	} else {
+		s.b.failed++
+	}
+
+	var smtpErr *textproto.Error
+	if err == nil || errors.As(err, &smtpErr) {
+		s.b.errs = 0
+		return
+	}
+
+	s.b.errs++
+	s.b.lastErr = err.Error()
+	if s.b.errs < breakerThreshold || s.b.down {
+		return
+	}
+
+	s.b.down = true
+	s.b.downSince = time.Now()
+	go s.probe()
+}
+
+// probe periodically checks if the server accepts connections and puts it
+// back into rotation when it does.
+func (s *Server) probe() {
+	addr := net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+	for {
+		time.Sleep(breakerProbe)
+
+		conn, err := net.DialTimeout("tcp", addr, breakerProbe)
+		if err != nil {
+			s.b.mut.Lock()
+			s.b.lastErr = err.Error()
+			s.b.mut.Unlock()
+			continue
+		}
+		conn.Close()
+
+		// smtppool doesn't free the slots of connections that fail to dial, so the
+		// server's pool may have been exhausted by the errors. Replace it.
+		pool, err := smtppool.New(s.Opt)
+		if err != nil {
+			s.b.mut.Lock()
+			s.b.lastErr = err.Error()
+			s.b.mut.Unlock()
+			continue
+		}
+
+		s.b.mut.Lock()
+		old := s.pool
+		s.pool = pool
+		s.b.down = false
+		s.b.errs = 0
+		s.b.mut.Unlock()
+
+		// Closing a pool waits for all of its connections to be freed, which never
+		// happens with the leaked slots.
+		go old.Close()
+		return
+	}
+}
+
+// smtpPool returns the server's SMTP pool, which is replaced on recovering.
+func (s *Server) smtpPool() *smtppool.Pool {
+	s.b.mut.Lock()
+	defer s.b.mut.Unlock()
+	return s.pool
 }
 
 // Flush flushes the message queue to the server.
@@ -186,7 +453,17 @@ func (e *Emailer) Flush() error {
 // Close closes the SMTP pools.
 func (e *Emailer) Close() error {
 	for _, s := range e.servers {
-		s.pool.Close()
+		s.b.mut.Lock()
+		pool, down := s.pool, s.b.down
+		s.b.mut.Unlock()
+
+		// The pool of a server that's down may never be freed (see probe()).
+		if down {
+			go pool.Close()
+		} else {
+			pool.Close()
+		}
+		s.raw.close()
 	}
 	return nil
 }
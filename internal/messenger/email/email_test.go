@@ -0,0 +1,160 @@
+package email
+
+import (
+	"math"
+	"net"
+	"net/textproto"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/knadh/smtppool"
+)
+
+func testServer(port, weight int) Server {
+	return Server{
+		AuthProtocol: "none",
+		TLSType:      "none",
+		Weight:       weight,
+		Opt: smtppool.Opt{
+			Host:            "127.0.0.1",
+			Port:            port,
+			MaxConns:        1,
+			PoolWaitTimeout: time.Second * 2,
+		},
+	}
+}
+
+// freePort returns a local port that nothing listens on.
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func testMessage() models.Message {
+	return models.Message{
+		From:        "Listmonk <noreply@listmonk.app>",
+		To:          []string{"subscriber@example.org"},
+		Subject:     "Hello",
+		ContentType: "plain",
+		Body:        []byte("Hello world"),
+	}
+}
+
+func TestWeightedServers(t *testing.T) {
+	e, err := New(testServer(1025, 7), testServer(1026, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	const num = 20000
+	counts := map[*Server]int{}
+	for i := 0; i < num; i++ {
+		counts[e.pickServer()]++
+	}
+
+	for _, s := range e.servers {
+		share := float64(counts[s]) / num
+		if exp := float64(s.Weight) / 10; math.Abs(share-exp) > 0.02 {
+			t.Errorf("expected server with weight %d to get %.2f of the messages, got %.2f", s.Weight, exp, share)
+		}
+	}
+
+	// A server that's down gets none of the messages.
+	e.servers[0].b.down = true
+	for i := 0; i < 100; i++ {
+		if s := e.pickServer(); s != e.servers[1] {
+			t.Fatal("expected the server that's down to be out of rotation")
+		}
+	}
+
+	// With all of them down, all of them are used.
+	e.servers[1].b.down = true
+	counts = map[*Server]int{}
+	for i := 0; i < 1000; i++ {
+		counts[e.pickServer()]++
+	}
+	if len(counts) != 2 {
+		t.Errorf("expected all servers to be used when all of them are down, got %d", len(counts))
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	probe := breakerProbe
+	breakerProbe = time.Millisecond * 50
+	defer func() { breakerProbe = probe }()
+
+	var (
+		good = newTestSMTPServer(t)
+		port = freePort(t)
+	)
+	e, err := New(testServer(port, 1), testServer(good.port(), 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	dead := e.servers[0]
+	for i := 0; i < breakerThreshold; i++ {
+		if err := dead.pool.Send(smtppool.Email{From: "noreply@listmonk.app", To: []string{"subscriber@example.org"}, Text: []byte("hi")}); err == nil {
+			t.Fatal("expected an error sending via a server that's down")
+		} else {
+			dead.recordResult(err)
+		}
+	}
+
+	h := e.Health()
+	if h[0].Healthy || h[0].DownSince == nil || h[0].Failed != breakerThreshold || h[0].LastError == "" {
+		t.Fatalf("expected the server to be tripped after %d connection errors, got %+v", breakerThreshold, h[0])
+	}
+	if !h[1].Healthy {
+		t.Fatalf("expected the other server to be healthy, got %+v", h[1])
+	}
+
+	// Messages are sent via the healthy server while the other is down.
+	for i := 0; i < 5; i++ {
+		if err := e.Push(testMessage()); err != nil {
+			t.Fatalf("error pushing message: %v", err)
+		}
+	}
+	if h := e.Health(); h[1].Sent != 5 || h[0].Sent != 0 {
+		t.Errorf("expected the messages to be sent via the healthy server, got %+v", h)
+	}
+
+	// The server is back in rotation once the probe reaches it.
+	newTestSMTPServerAt(t, net.JoinHostPort(dead.Host, strconv.Itoa(port)))
+	deadline := time.Now().Add(time.Second * 2)
+	for !e.Health()[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the server to recover after the probe")
+		}
+		time.Sleep(breakerProbe)
+	}
+	if h := e.Health(); h[0].Errors != 0 || h[0].DownSince != nil {
+		t.Errorf("expected the breaker to be reset on recovery, got %+v", h[0])
+	}
+	if err := dead.smtpPool().Send(smtppool.Email{From: "noreply@listmonk.app", To: []string{"subscriber@example.org"}, Text: []byte("hi")}); err != nil {
+		t.Errorf("error sending via the recovered server: %v", err)
+	}
+}
+
+func TestBreakerSMTPErrors(t *testing.T) {
+	s := &Server{b: &breaker{}}
+
+	// SMTP responses mean that the server is reachable and don't trip the breaker.
+	for i := 0; i < breakerThreshold*2; i++ {
+		s.recordResult(&textproto.Error{Code: 550, Msg: "rejected"})
+	}
+	if s.b.down || s.b.errs != 0 || s.b.failed != breakerThreshold*2 {
+		t.Errorf("expected SMTP errors to not trip the breaker, got %+v", s.b)
+	}
+}
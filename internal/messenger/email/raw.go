@@ -0,0 +1,246 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+)
+
+// rawPool is a pool of reusable SMTP connections to a server for sending pre-rendered
+// messages. smtppool renders messages itself on sending, which would break their DKIM
+// signatures, and hence, signed (and AMP) messages are sent via this pool, which uses
+// the same options as the server's smtppool.
+type rawPool struct {
+	srv *Server
+
+	// Idle connections, and the slots for the open connections that are
+	// limited to MaxConns.
+	conns chan *rawConn
+	slots chan struct{}
+}
+
+type rawConn struct {
+	c *smtp.Client
+
+	// When the connection was last used. Connections idle for longer
+	// than the IdleTimeout are closed instead of being reused.
+	lastActivity time.Time
+}
+
+var errRawPoolTimeout = errors.New("timed out waiting for a free SMTP connection")
+
+func newRawPool(s *Server) *rawPool {
+	n := s.MaxConns
+	if n < 1 {
+		n = 1
+	}
+
+	return &rawPool{
+		srv:   s,
+		conns: make(chan *rawConn, n),
+		slots: make(chan struct{}, n),
+	}
+}
+
+// send sends a raw message using a connection from the pool. On a connection
+// error, the message is retried on a new connection. SMTP errors, eg: a rejected
+// recipient, aren't retried.
+func (p *rawPool) send(from string, to []string, msg []byte) error {
+	retries := p.srv.MaxMessageRetries
+	if retries < 1 {
+		retries = 2
+	}
+
+	var lastErr error
+	for i := 0; i < retries; i++ {
+		c, err := p.borrow()
+		if err != nil {
+			return err
+		}
+
+		err = c.send(from, to, msg)
+		p.put(c, err)
+		if err == nil {
+			return nil
+		}
+
+		lastErr = err
+		if _, ok := err.(*textproto.Error); ok {
+			return err
+		}
+	}
+
+	return lastErr
+}
+
+// put returns a connection to the pool after resetting the session. Connections
+// that have had errors other than SMTP errors are discarded.
+func (p *rawPool) put(c *rawConn, lastErr error) {
+	if lastErr != nil {
+		if _, ok := lastErr.(*textproto.Error); !ok {
+			p.discard(c)
+			return
+		}
+	}
+
+	// Reset the session as some servers reject a new transaction on a
+	// connection with "sender already specified" errors.
+	if err := c.c.Reset(); err != nil {
+		p.discard(c)
+		return
+	}
+
+	c.lastActivity = time.Now()
+	p.conns <- c
+}
+
+// borrow returns an idle connection from the pool, or if there are none, a new
+// connection if the pool isn't full, failing which, it waits for a connection
+// to be returned.
+func (p *rawPool) borrow() (*rawConn, error) {
+	for {
+		select {
+		case c := <-p.conns:
+			if p.isIdle(c) {
+				p.discard(c)
+				continue
+			}
+			return c, nil
+		default:
+		}
+		break
+	}
+
+	timeout := p.srv.PoolWaitTimeout
+	if timeout < time.Second {
+		timeout = time.Second * 2
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case c := <-p.conns:
+		return c, nil
+	case p.slots <- struct{}{}:
+		c, err := p.dial(timeout)
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+		return c, nil
+	case <-t.C:
+		return nil, errRawPoolTimeout
+	}
+}
+
+// discard closes a connection and frees its slot in the pool.
+func (p *rawPool) discard(c *rawConn) {
+	c.c.Close()
+	<-p.slots
+}
+
+func (p *rawPool) isIdle(c *rawConn) bool {
+	return p.srv.IdleTimeout >= time.Second && time.Since(c.lastActivity) > p.srv.IdleTimeout
+}
+
+// close closes the idle connections in the pool.
+func (p *rawPool) close() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.c.Quit()
+			<-p.slots
+		default:
+			return
+		}
+	}
+}
+
+// dial opens a new connection to the server and authenticates.
+func (p *rawPool) dial(timeout time.Duration) (*rawConn, error) {
+	var (
+		s      = p.srv
+		addr   = net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+		dialer = &net.Dialer{Timeout: timeout}
+		conn   net.Conn
+		err    error
+	)
+	if s.SSL {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, s.TLSConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, s.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := p.hello(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return &rawConn{c: c, lastActivity: time.Now()}, nil
+}
+
+// hello greets the server, upgrades the connection with STARTTLS if
+// configured, and authenticates.
+func (p *rawPool) hello(c *smtp.Client) error {
+	s := p.srv
+	if s.HelloHostname != "" {
+		if err := c.Hello(s.HelloHostname); err != nil {
+			return err
+		}
+	}
+
+	if !s.SSL && s.TLSConfig != nil {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(s.TLSConfig); err != nil {
+				return err
+			}
+		}
+	}
+
+	if s.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			if err := c.Auth(s.Auth); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// send sends a raw message to the recipients on the connection.
+func (c *rawConn) send(from string, to []string, msg []byte) error {
+	if err := c.c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
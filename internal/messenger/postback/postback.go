@@ -12,17 +12,30 @@ import (
 	"github.com/knadh/listmonk/models"
 )
 
-// postback is the payload that's posted as JSON to the HTTP Postback server.
+// postback is the payload (envelope) that's posted as JSON to the HTTP Postback
+// server for every message. The server should respond with a 2xx status on
+// accepting the message. Any other response is treated as a send failure.
+//
+//	{
+//	  "subject": "", "from_email": "", "content_type": "html|plain|...", "body": "",
+//	  "headers": {"X-Header": ["value"]},
+//	  "recipients": [{"uuid": "", "email": "", "name": "", "attribs": {}, "status": ""}],
+//	  "campaign": {"uuid": "", "name": "", "from_email": "", "headers": [], "tags": []},
+//	  "attachments": [{"name": "", "header": {}, "content": "base64"}]
+//	}
+//
+// campaign is null for non-campaign (eg: transactional) messages.
 //
 //easyjson:json
 type postback struct {
-	Subject     string       `json:"subject"`
-	FromEmail   string       `json:"from_email"`
-	ContentType string       `json:"content_type"`
-	Body        string       `json:"body"`
-	Recipients  []recipient  `json:"recipients"`
-	Campaign    *campaign    `json:"campaign"`
-	Attachments []attachment `json:"attachments"`
+	Subject     string               `json:"subject"`
+	FromEmail   string               `json:"from_email"`
+	ContentType string               `json:"content_type"`
+	Body        string               `json:"body"`
+	Headers     textproto.MIMEHeader `json:"headers"`
+	Recipients  []recipient          `json:"recipients"`
+	Campaign    *campaign            `json:"campaign"`
+	Attachments []attachment         `json:"attachments"`
 }
 
 type campaign struct {
@@ -54,7 +67,7 @@ type Options struct {
 	Password string        `json:"password"`
 	RootURL  string        `json:"root_url"`
 	MaxConns int           `json:"max_conns"`
-	Retries  int           `json:"retries"`
+	Retries  int           `json:"max_msg_retries"`
 	Timeout  time.Duration `json:"timeout"`
 }
 
@@ -100,6 +113,7 @@ func (p *Postback) Push(m models.Message) error {
 		FromEmail:   m.From,
 		ContentType: m.ContentType,
 		Body:        string(m.Body),
+		Headers:     m.Headers,
 		Recipients: []recipient{{
 			UUID:    m.Subscriber.UUID,
 			Email:   m.Subscriber.Email,
@@ -138,7 +152,13 @@ func (p *Postback) Push(m models.Message) error {
 		return err
 	}
 
-	return p.exec(http.MethodPost, p.o.RootURL, b, nil)
+	// Retry on network errors and 5xx responses.
+	for n := 0; ; n++ {
+		code, err := p.exec(http.MethodPost, p.o.RootURL, b, nil)
+		if err == nil || n >= p.o.Retries || (code > 0 && code < 500) {
+			return err
+		}
+	}
 }
 
 // Flush flushes the message queue to the server.
@@ -152,7 +172,8 @@ func (p *Postback) Close() error {
 	return nil
 }
 
-func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header) error {
+// exec makes the HTTP request and returns the response status code.
+func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header) (int, error) {
 	var (
 		err      error
 		postBody io.Reader
@@ -165,7 +186,7 @@ func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header
 
 	req, err := http.NewRequest(method, rURL, postBody)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if headers != nil {
@@ -194,7 +215,7 @@ func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header
 
 	r, err := p.c.Do(req)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer func() {
 		// Drain and close the body to let the Transport reuse the connection
@@ -202,9 +223,9 @@ func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header
 		r.Body.Close()
 	}()
 
-	if r.StatusCode != http.StatusOK {
-		return fmt.Errorf("non-OK response from Postback server: %d", r.StatusCode)
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return r.StatusCode, fmt.Errorf("non-OK response from Postback server: %d", r.StatusCode)
 	}
 
-	return nil
+	return r.StatusCode, nil
 }
@@ -46,6 +46,43 @@ func easyjsonDf11841fDecodeGithubComKnadhListmonkInternalMessengerPostback(in *j
 			out.ContentType = string(in.String())
 		case "body":
 			out.Body = string(in.String())
+		case "headers":
+			if in.IsNull() {
+				in.Skip()
+			} else {
+				in.Delim('{')
+				out.Headers = make(textproto.MIMEHeader)
+				for !in.IsDelim('}') {
+					key := string(in.String())
+					in.WantColon()
+					var v20 []string
+					if in.IsNull() {
+						in.Skip()
+						v20 = nil
+					} else {
+						in.Delim('[')
+						if v20 == nil {
+							if !in.IsDelim(']') {
+								v20 = make([]string, 0, 4)
+							} else {
+								v20 = []string{}
+							}
+						} else {
+							v20 = (v20)[:0]
+						}
+						for !in.IsDelim(']') {
+							var v21 string
+							v21 = string(in.String())
+							v20 = append(v20, v21)
+							in.WantComma()
+						}
+						in.Delim(']')
+					}
+					(out.Headers)[key] = v20
+					in.WantComma()
+				}
+				in.Delim('}')
+			}
 		case "recipients":
 			if in.IsNull() {
 				in.Skip()
@@ -136,6 +173,38 @@ func easyjsonDf11841fEncodeGithubComKnadhListmonkInternalMessengerPostback(out *
 		out.RawString(prefix)
 		out.String(string(in.Body))
 	}
+	{
+		const prefix string = ",\"headers\":"
+		out.RawString(prefix)
+		if in.Headers == nil && (out.Flags&jwriter.NilMapAsEmpty) == 0 {
+			out.RawString(`null`)
+		} else {
+			out.RawByte('{')
+			v22First := true
+			for v22Name, v22Value := range in.Headers {
+				if v22First {
+					v22First = false
+				} else {
+					out.RawByte(',')
+				}
+				out.String(string(v22Name))
+				out.RawByte(':')
+				if v22Value == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+					out.RawString("null")
+				} else {
+					out.RawByte('[')
+					for v23, v24 := range v22Value {
+						if v23 > 0 {
+							out.RawByte(',')
+						}
+						out.String(string(v24))
+					}
+					out.RawByte(']')
+				}
+			}
+			out.RawByte('}')
+		}
+	}
 	{
 		const prefix string = ",\"recipients\":"
 		out.RawString(prefix)
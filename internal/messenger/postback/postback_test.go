@@ -0,0 +1,191 @@
+package postback
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// testServer is a postback server that records the envelopes posted to it and
+// responds with the given status codes in order, and then, with 200.
+type testServer struct {
+	srv   *httptest.Server
+	reqs  []map[string]interface{}
+	auth  []string
+	codes []int
+	mut   sync.Mutex
+}
+
+func newTestServer(t *testing.T, codes ...int) *testServer {
+	t.Helper()
+
+	s := &testServer{codes: codes}
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+
+		var env map[string]interface{}
+		if err := json.Unmarshal(b, &env); err != nil || r.Method != http.MethodPost ||
+			r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.mut.Lock()
+		defer s.mut.Unlock()
+
+		s.reqs = append(s.reqs, env)
+		s.auth = append(s.auth, r.Header.Get("Authorization"))
+
+		code := http.StatusOK
+		if len(s.codes) > 0 {
+			code, s.codes = s.codes[0], s.codes[1:]
+		}
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(s.srv.Close)
+
+	return s
+}
+
+func newTestPostback(t *testing.T, s *testServer, retries int) *Postback {
+	t.Helper()
+
+	p, err := New(Options{
+		Name:     "webhook",
+		Username: "listmonk",
+		Password: "secret",
+		RootURL:  s.srv.URL,
+		MaxConns: 2,
+		Retries:  retries,
+		Timeout:  time.Second * 5,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+
+	return p
+}
+
+func testMessage() models.Message {
+	h := textproto.MIMEHeader{}
+	h.Set("X-Campaign", "welcome")
+
+	return models.Message{
+		From:        "listmonk <noreply@listmonk.app>",
+		To:          []string{"subscriber@listmonk.app"},
+		Subject:     "Hello",
+		ContentType: "html",
+		Body:        []byte("<p>Hello</p>"),
+		Headers:     h,
+		Subscriber: models.Subscriber{
+			UUID:    "sub-uuid",
+			Email:   "subscriber@listmonk.app",
+			Name:    "Subscriber",
+			Status:  models.SubscriberStatusEnabled,
+			Attribs: models.JSON{"city": "Bengaluru"},
+		},
+		Campaign: &models.Campaign{
+			UUID:      "camp-uuid",
+			Name:      "Welcome",
+			FromEmail: "listmonk <noreply@listmonk.app>",
+			Tags:      []string{"onboarding"},
+		},
+		Attachments: []models.Attachment{{Name: "file.txt", Content: []byte("file")}},
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	s := newTestServer(t)
+	p := newTestPostback(t, s, 0)
+
+	if err := p.Push(testMessage()); err != nil {
+		t.Fatalf("error pushing message: %v", err)
+	}
+	if len(s.reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(s.reqs))
+	}
+	if s.auth[0] != "Basic bGlzdG1vbms6c2VjcmV0" {
+		t.Errorf("expected basic auth, got %q", s.auth[0])
+	}
+
+	env := s.reqs[0]
+	for _, k := range []string{"subject", "from_email", "content_type", "body", "headers", "recipients", "campaign", "attachments"} {
+		if _, ok := env[k]; !ok {
+			t.Errorf("expected the envelope to have %s", k)
+		}
+	}
+	if env["subject"] != "Hello" || env["from_email"] != "listmonk <noreply@listmonk.app>" ||
+		env["content_type"] != "html" || env["body"] != "<p>Hello</p>" {
+		t.Errorf("unexpected message fields: %v", env)
+	}
+
+	if h, _ := env["headers"].(map[string]interface{}); h == nil || h["X-Campaign"].([]interface{})[0] != "welcome" {
+		t.Errorf("expected the message headers, got %v", env["headers"])
+	}
+
+	rcpts, _ := env["recipients"].([]interface{})
+	if len(rcpts) != 1 {
+		t.Fatalf("expected 1 recipient, got %v", env["recipients"])
+	}
+	r := rcpts[0].(map[string]interface{})
+	if r["uuid"] != "sub-uuid" || r["email"] != "subscriber@listmonk.app" || r["status"] != "enabled" ||
+		r["attribs"].(map[string]interface{})["city"] != "Bengaluru" {
+		t.Errorf("unexpected recipient: %v", r)
+	}
+
+	if c, _ := env["campaign"].(map[string]interface{}); c == nil || c["uuid"] != "camp-uuid" || c["name"] != "Welcome" {
+		t.Errorf("unexpected campaign: %v", env["campaign"])
+	}
+
+	// Attachment content is base64.
+	files, _ := env["attachments"].([]interface{})
+	if len(files) != 1 || files[0].(map[string]interface{})["content"] != "ZmlsZQ==" {
+		t.Errorf("unexpected attachments: %v", env["attachments"])
+	}
+
+	// Non-campaign messages have a null campaign.
+	m := testMessage()
+	m.Campaign = nil
+	if err := p.Push(m); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := s.reqs[1]["campaign"]; !ok || v != nil {
+		t.Errorf("expected a null campaign, got %v", v)
+	}
+}
+
+func TestResponseCodes(t *testing.T) {
+	cases := []struct {
+		name    string
+		codes   []int
+		retries int
+		fail    bool
+		reqs    int
+	}{
+		{"2xx is a success", []int{http.StatusAccepted}, 2, false, 1},
+		{"4xx fails without retries", []int{http.StatusBadRequest}, 2, true, 1},
+		{"5xx is retried", []int{http.StatusBadGateway, http.StatusServiceUnavailable}, 2, false, 3},
+		{"5xx fails after the retries", []int{500, 500, 500}, 2, true, 3},
+	}
+
+	for _, c := range cases {
+		s := newTestServer(t, c.codes...)
+		p := newTestPostback(t, s, c.retries)
+
+		err := p.Push(testMessage())
+		if (err != nil) != c.fail {
+			t.Errorf("%s: expected failure=%v, got %v", c.name, c.fail, err)
+		}
+		if len(s.reqs) != c.reqs {
+			t.Errorf("%s: expected %d requests, got %d", c.name, c.reqs, len(s.reqs))
+		}
+	}
+}
@@ -0,0 +1,203 @@
+// Package sms implements a messenger that sends messages as SMS via a generic
+// HTTP SMS gateway. The recipient's phone number is picked up from the
+// subscriber's attributes.
+package sms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// Message is the payload that's posted as JSON to the SMS gateway.
+type Message struct {
+	From           string `json:"from"`
+	To             string `json:"to"`
+	Body           string `json:"body"`
+	SubscriberUUID string `json:"subscriber_uuid"`
+	CampaignUUID   string `json:"campaign_uuid,omitempty"`
+}
+
+// Options represents the SMS gateway options.
+type Options struct {
+	Name        string        `json:"name"`
+	GatewayURL  string        `json:"gateway_url"`
+	Username    string        `json:"username"`
+	Password    string        `json:"password"`
+	From        string        `json:"from"`
+	PhoneAttrib string        `json:"phone_attrib"`
+	MaxConns    int           `json:"max_conns"`
+	Timeout     time.Duration `json:"timeout"`
+}
+
+// SMS represents the SMS messenger.
+type SMS struct {
+	authStr string
+	o       Options
+	c       *http.Client
+
+	// Optional callback that's invoked with a hard bounce when the gateway
+	// rejects a message for a subscriber.
+	onBounce func(models.Bounce)
+}
+
+var (
+	reHTMLTags = regexp.MustCompile(`(?s)<(style|script)[^>]*>.*?</(style|script)>|<[^>]+>`)
+	reSpaces   = regexp.MustCompile(`[ \t]+`)
+	reNewlines = regexp.MustCompile(`\n\s*\n+`)
+)
+
+// New returns a new instance of the SMS messenger. onBounce is optional.
+func New(o Options, onBounce func(models.Bounce)) (*SMS, error) {
+	if o.GatewayURL == "" {
+		return nil, errors.New("no gateway URL")
+	}
+	if o.PhoneAttrib == "" {
+		o.PhoneAttrib = "phone"
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 5
+	}
+
+	authStr := ""
+	if o.Username != "" && o.Password != "" {
+		authStr = fmt.Sprintf("Basic %s", base64.StdEncoding.EncodeToString(
+			[]byte(o.Username+":"+o.Password)))
+	}
+
+	return &SMS{
+		authStr:  authStr,
+		o:        o,
+		onBounce: onBounce,
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       o.Timeout,
+			},
+		},
+	}, nil
+}
+
+// Name returns the messenger's name.
+func (s *SMS) Name() string {
+	return s.o.Name
+}
+
+// Push sends a message to the subscriber's phone number via the gateway.
+// Subscribers without a phone number are skipped. The
+// plain text alt body of the message is sent if there's one, or else, the body
+// with the HTML stripped. 4xx responses from the gateway (other than 429) are
+// treated as permanent failures and are reported as hard bounces.
+func (s *SMS) Push(m models.Message) error {
+	phone, _ := m.Subscriber.Attribs[s.o.PhoneAttrib].(string)
+	phone = strings.TrimSpace(phone)
+	if phone == "" {
+		return nil
+	}
+
+	body := string(m.AltBody)
+	if body == "" {
+		body = string(m.Body)
+		if m.ContentType != models.CampaignContentTypePlain {
+			body = htmlToText(body)
+		}
+	}
+
+	msg := Message{
+		From:           s.o.From,
+		To:             phone,
+		Body:           body,
+		SubscriberUUID: m.Subscriber.UUID,
+	}
+	if m.Campaign != nil {
+		msg.CampaignUUID = m.Campaign.UUID
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	code, err := s.post(b)
+	if err != nil {
+		if code >= 400 && code < 500 && code != http.StatusTooManyRequests && s.onBounce != nil {
+			meta, _ := json.Marshal(map[string]interface{}{"to": phone, "status": code})
+			s.onBounce(models.Bounce{
+				SubscriberUUID: m.Subscriber.UUID,
+				CampaignUUID:   msg.CampaignUUID,
+				Type:           models.BounceTypeHard,
+				Source:         s.o.Name,
+				Meta:           json.RawMessage(meta),
+				CreatedAt:      time.Now(),
+			})
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Flush flushes the message queue to the server.
+func (s *SMS) Flush() error {
+	return nil
+}
+
+// Close closes idle HTTP connections.
+func (s *SMS) Close() error {
+	s.c.CloseIdleConnections()
+	return nil
+}
+
+// post posts the message to the gateway and returns the HTTP status code.
+// Non 2xx responses are errors.
+func (s *SMS) post(b []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, s.o.GatewayURL, bytes.NewReader(b))
+	if err != nil {
+		return 0, err
+	}
+
+	req.Header.Set("User-Agent", "listmonk")
+	req.Header.Set("Content-Type", "application/json")
+	if s.authStr != "" {
+		req.Header.Set("Authorization", s.authStr)
+	}
+
+	r, err := s.c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		// Drain and close the body to let the Transport reuse the connection
+		io.Copy(io.Discard, r.Body)
+		r.Body.Close()
+	}()
+
+	if r.StatusCode < 200 || r.StatusCode > 299 {
+		return r.StatusCode, fmt.Errorf("non-OK response from SMS gateway: %d", r.StatusCode)
+	}
+
+	return r.StatusCode, nil
+}
+
+// htmlToText strips HTML tags from a message body and collapses whitespace.
+func htmlToText(s string) string {
+	s = reHTMLTags.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = reSpaces.ReplaceAllString(s, " ")
+	s = reNewlines.ReplaceAllString(s, "\n\n")
+
+	return strings.TrimSpace(s)
+}
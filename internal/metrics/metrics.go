@@ -0,0 +1,200 @@
+// Package metrics implements a minimal set of counters and histograms and
+// a writer for exposing them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// OtherLabel is the label value against which the counts of a CounterVec
+// are recorded once it has reached its maximum number of label values.
+const OtherLabel = "other"
+
+// CounterVec is a set of counters by a single label. To keep the cardinality
+// of the label in check, the number of distinct label values is capped, beyond which,
+// counts are recorded against OtherLabel.
+type CounterVec struct {
+	max  int
+	vals map[string]*atomic.Uint64
+	mut  sync.RWMutex
+}
+
+// Histogram is a cumulative histogram with fixed bucket upper bounds.
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+
+	// Sum of the observations stored as float64 bits.
+	sum atomic.Uint64
+}
+
+// NewCounterVec returns a CounterVec that records at most max label values.
+func NewCounterVec(max int) *CounterVec {
+	if max < 1 {
+		max = 1
+	}
+	return &CounterVec{max: max, vals: make(map[string]*atomic.Uint64)}
+}
+
+// Add adds n to the counter of the given label value.
+func (c *CounterVec) Add(label string, n uint64) {
+	c.mut.RLock()
+	v, ok := c.vals[label]
+	c.mut.RUnlock()
+	if ok {
+		v.Add(n)
+		return
+	}
+
+	c.mut.Lock()
+	defer c.mut.Unlock()
+
+	if v, ok = c.vals[label]; !ok {
+		if len(c.vals) >= c.max {
+			label = OtherLabel
+		}
+		if v, ok = c.vals[label]; !ok {
+			v = &atomic.Uint64{}
+			c.vals[label] = v
+		}
+	}
+	v.Add(n)
+}
+
+// Inc increments the counter of the given label value.
+func (c *CounterVec) Inc(label string) {
+	c.Add(label, 1)
+}
+
+// Values returns the current counts by label value.
+func (c *CounterVec) Values() map[string]uint64 {
+	c.mut.RLock()
+	defer c.mut.RUnlock()
+
+	out := make(map[string]uint64, len(c.vals))
+	for l, v := range c.vals {
+		out[l] = v.Load()
+	}
+	return out
+}
+
+// NewHistogram returns a histogram with the given (ascending) bucket upper bounds.
+func NewHistogram(bounds ...float64) *Histogram {
+	b := append([]float64{}, bounds...)
+	sort.Float64s(b)
+
+	return &Histogram{bounds: b, counts: make([]atomic.Uint64, len(b))}
+}
+
+// Observe records an observation.
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			break
+		}
+	}
+}
+
+// Writer writes metrics in the Prometheus text exposition format. The samples
+// of a metric should be written one after the other.
+type Writer struct {
+	buf  bytes.Buffer
+	seen map[string]bool
+}
+
+// NewWriter returns a new Writer.
+func NewWriter() *Writer {
+	return &Writer{seen: make(map[string]bool)}
+}
+
+// Counter writes a counter sample. labels are label name and value pairs.
+func (w *Writer) Counter(name, help string, v float64, labels ...string) {
+	w.header(name, help, "counter")
+	w.sample(name, v, labels)
+}
+
+// Gauge writes a gauge sample. labels are label name and value pairs.
+func (w *Writer) Gauge(name, help string, v float64, labels ...string) {
+	w.header(name, help, "gauge")
+	w.sample(name, v, labels)
+}
+
+// CounterVec writes the counters of a CounterVec with the given label name,
+// sorted by the label values.
+func (w *Writer) CounterVec(name, help, label string, c *CounterVec) {
+	vals := c.Values()
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	w.header(name, help, "counter")
+	for _, k := range keys {
+		w.sample(name, float64(vals[k]), []string{label, k})
+	}
+}
+
+// Histogram writes a histogram's buckets, sum, and count.
+func (w *Writer) Histogram(name, help string, h *Histogram) {
+	w.header(name, help, "histogram")
+
+	var cum uint64
+	for i, b := range h.bounds {
+		cum += h.counts[i].Load()
+		w.sample(name+"_bucket", float64(cum), []string{"le", strconv.FormatFloat(b, 'g', -1, 64)})
+	}
+
+	n := h.count.Load()
+	w.sample(name+"_bucket", float64(n), []string{"le", "+Inf"})
+	w.sample(name+"_sum", math.Float64frombits(h.sum.Load()), nil)
+	w.sample(name+"_count", float64(n), nil)
+}
+
+// Bytes returns the written metrics.
+func (w *Writer) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+func (w *Writer) header(name, help, typ string) {
+	if w.seen[name] {
+		return
+	}
+	w.seen[name] = true
+
+	w.buf.WriteString("# HELP " + name + " " + escHelp.Replace(help) + "\n")
+	w.buf.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+func (w *Writer) sample(name string, v float64, labels []string) {
+	w.buf.WriteString(name)
+	if len(labels) > 1 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.buf.WriteString(labels[i] + `="` + escLabel.Replace(labels[i+1]) + `"`)
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteString(" " + strconv.FormatFloat(v, 'g', -1, 64) + "\n")
+}
+
+var (
+	escHelp  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	escLabel = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
@@ -0,0 +1,645 @@
+package migrations
+
+import (
+	"log"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/knadh/koanf/v2"
+	"github.com/knadh/stuffbin"
+)
+
+// V4_0_0 performs the DB migrations.
+func V4_0_0(db *sqlx.DB, fs stuffbin.FileSystem, ko *koanf.Koanf, lo *log.Logger) error {
+	// Insert new preference settings.
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES
+		('app.max_subscriber_messages', '0'),
+		('app.message_throttle', '0'),
+		('app.inline_css', 'false'),
+		('privacy.track_views', 'true'),
+		('privacy.domain_allowlist', '[]'),
+		('privacy.block_disposable_domains', 'false'),
+		('privacy.privacy_mode', 'false'),
+		('privacy.unsubscribe_confirm', 'true'),
+		('privacy.unsubscribe_all_lists', 'false'),
+		('app.optin_reminder_interval', '"48h"'),
+		('app.optin_reminder_max', '0'),
+		('app.optin_reminder_purge', 'false'),
+		('app.archived_subscriber_retention', '"720h"'),
+		('app.unconfirmed_subscriber_retention', '"0"'),
+		('app.unsubscribed_subscriber_retention', '"0"'),
+		('app.engagement_open_weight', '1'),
+		('app.engagement_click_weight', '3'),
+		('app.engagement_half_life', '"720h"'),
+		('app.campaign_trigger_max_recipients', '1000'),
+		('app.subscriber_attribs_schema', '""'),
+		('app.campaign_variant_sample_size', '20'),
+		('app.campaign_variant_sample_window', '"4h"'),
+		('app.recurring_campaign_catchup', '"once"'),
+		('app.send_window_timezone', '"UTC"'),
+		('app.max_campaign_versions', '20'),
+		('app.sandbox_enabled', 'false'),
+		('app.sandbox_email', '""'),
+		('app.allow_protected_headers', 'false'),
+		('app.campaign_approval', 'false'),
+		('app.utm_source', '""'),
+		('app.utm_medium', '""'),
+		('app.utm_campaign', '""'),
+		('app.utm_content', '""'),
+		('security.captcha_provider', '"hcaptcha"'),
+		('security.captcha_strict', 'true'),
+		('security.public_rate_limit_enabled', 'false'),
+		('security.public_rate_limit_requests', '20'),
+		('security.public_rate_limit_window', '"1m"'),
+		('security.trusted_proxy_header', '""'),
+		('security.unsubscribe_secret', '""'),
+		('upload.image_variant_widths', '[320, 640, 1280]'),
+		('upload.s3.url_mode', '"auto"'),
+		('bounce.rules', '[]'),
+		('bounce.sparkpost', '{"enabled": false, "username": "", "password": ""}'),
+		('sms', '{"enabled": false, "name": "sms", "gateway_url": "", "username": "", "password": "", "from": "", "phone_attrib": "phone", "max_conns": 10, "timeout": "5s"}'),
+		('dkim', '{"enabled": false, "keys": []}')
+		ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`ALTER TABLE lists ADD COLUMN IF NOT EXISTS max_subscriber_messages INT NULL`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`ALTER TABLE subscriber_lists ADD COLUMN IF NOT EXISTS optin_reminders INT NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS subscriber_sends (
+		    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+		    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_sub_sends_sub_id ON subscriber_sends(subscriber_id, created_at);
+		CREATE INDEX IF NOT EXISTS idx_sub_sends_date ON subscriber_sends(created_at);
+	`); err != nil {
+		return err
+	}
+
+	// Add the subscriber archive (soft delete) field.
+	if _, err := db.Exec(`
+		ALTER TABLE subscribers ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP WITH TIME ZONE NULL;
+		CREATE INDEX IF NOT EXISTS idx_subs_archived_at ON subscribers(archived_at) WHERE archived_at IS NOT NULL;
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`ALTER TABLE subscribers ADD COLUMN IF NOT EXISTS engagement_score REAL NOT NULL DEFAULT 0`); err != nil {
+		return err
+	}
+
+	// Add A/B subject variant tables and fields.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS variant_sample_ends_at TIMESTAMP WITH TIME ZONE NULL;
+
+		CREATE TABLE IF NOT EXISTS campaign_variants (
+		    id               SERIAL PRIMARY KEY,
+		    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    subject          TEXT NOT NULL,
+		    weight           INT NOT NULL DEFAULT 1,
+		    sent             INT NOT NULL DEFAULT 0,
+		    winner           BOOLEAN NOT NULL DEFAULT false,
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+		    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_camp_variants_camp_id ON campaign_variants(campaign_id);
+
+		ALTER TABLE campaign_views ADD COLUMN IF NOT EXISTS variant_id INTEGER NULL REFERENCES campaign_variants(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		CREATE INDEX IF NOT EXISTS idx_views_variant_id ON campaign_views(variant_id) WHERE variant_id IS NOT NULL;
+
+		ALTER TABLE link_clicks ADD COLUMN IF NOT EXISTS variant_id INTEGER NULL REFERENCES campaign_variants(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		CREATE INDEX IF NOT EXISTS idx_clicks_variant_id ON link_clicks(variant_id) WHERE variant_id IS NOT NULL;
+	`); err != nil {
+		return err
+	}
+
+	// Add recurring campaign fields.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS recurrence TEXT NULL;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS recurrence_active BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS recurrence_next_at TIMESTAMP WITH TIME ZONE NULL;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS recurrence_parent_id INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		CREATE INDEX IF NOT EXISTS idx_camps_recurrence_next_at ON campaigns(recurrence_next_at) WHERE recurrence_active = true;
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_camps_recurrence_run ON campaigns(recurrence_parent_id, send_at) WHERE recurrence_parent_id IS NOT NULL;
+	`); err != nil {
+		return err
+	}
+
+	// Add the campaign send window fields.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS send_window_start INT NULL CHECK (send_window_start >= 0 AND send_window_start <= 23);
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS send_window_end INT NULL CHECK (send_window_end >= 1 AND send_window_end <= 24);
+	`); err != nil {
+		return err
+	}
+
+	// Add the campaign content version history table.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS campaign_versions (
+		    id               BIGSERIAL PRIMARY KEY,
+		    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    version          INT NOT NULL,
+		    author           TEXT NOT NULL DEFAULT '',
+		    subject          TEXT NOT NULL,
+		    body             TEXT NOT NULL,
+		    altbody          TEXT NULL,
+		    content_type     content_type NOT NULL DEFAULT 'richtext',
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+		    UNIQUE(campaign_id, version)
+		);
+	`); err != nil {
+		return err
+	}
+
+	// Add indexes for range scans on campaign analytics time series.
+	if _, err := db.Exec(`
+		CREATE INDEX IF NOT EXISTS idx_views_camp_date ON campaign_views(campaign_id, created_at);
+		CREATE INDEX IF NOT EXISTS idx_clicks_camp_date ON link_clicks(campaign_id, created_at);
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS body_html TEXT NULL`); err != nil {
+		return err
+	}
+
+	// Add the reusable template partial type.
+	if _, err := db.Exec(`ALTER TYPE template_type ADD VALUE IF NOT EXISTS 'partial'`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`ALTER TABLE lists ADD COLUMN IF NOT EXISTS template_id INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL ON UPDATE CASCADE`); err != nil {
+		return err
+	}
+
+	// Add media folders.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS media_folders (
+		    id               SERIAL PRIMARY KEY,
+		    name             TEXT NOT NULL UNIQUE,
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		ALTER TABLE media ADD COLUMN IF NOT EXISTS folder_id INTEGER NULL REFERENCES media_folders(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		ALTER TABLE media ADD COLUMN IF NOT EXISTS size BIGINT NOT NULL DEFAULT 0;
+		CREATE INDEX IF NOT EXISTS idx_media_folder_id ON media(folder_id);
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`ALTER TABLE media ADD COLUMN IF NOT EXISTS variants JSONB NOT NULL DEFAULT '[]'`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS bounce_rule_actions (
+		    id               SERIAL PRIMARY KEY,
+		    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    type             bounce_type NOT NULL,
+		    action           TEXT NOT NULL,
+		    num_bounces      INTEGER NOT NULL DEFAULT 0,
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_bounce_rule_actions_sub_id ON bounce_rule_actions(subscriber_id, type);
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS webhooks (
+		    id               SERIAL PRIMARY KEY,
+		    name             TEXT NOT NULL,
+		    url              TEXT NOT NULL,
+		    secret           TEXT NOT NULL DEFAULT '',
+		    events           TEXT[] NOT NULL DEFAULT '{}',
+		    enabled          BOOLEAN NOT NULL DEFAULT true,
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+		    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE TABLE IF NOT EXISTS webhook_failures (
+		    id               BIGSERIAL PRIMARY KEY,
+		    webhook_id       INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    event            TEXT NOT NULL,
+		    payload          JSONB NOT NULL DEFAULT '{}',
+		    error            TEXT NOT NULL DEFAULT '',
+		    attempts         INT NOT NULL DEFAULT 0,
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_webhook_failures_hook_id ON webhook_failures(webhook_id);
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+		    IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'tx_status') THEN
+		        CREATE TYPE tx_status AS ENUM ('queued', 'sent', 'failed');
+		    END IF;
+		END$$;
+		CREATE TABLE IF NOT EXISTS tx_messages (
+		    id               BIGSERIAL PRIMARY KEY,
+		    uuid             uuid NOT NULL UNIQUE,
+		    subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+		    template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL ON UPDATE CASCADE,
+		    subject          TEXT NOT NULL DEFAULT '',
+		    status           tx_status NOT NULL DEFAULT 'queued',
+		    attempts         INT NOT NULL DEFAULT 0,
+		    error            TEXT NOT NULL DEFAULT '',
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+		    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_tx_messages_sub_id ON tx_messages(subscriber_id);
+	`); err != nil {
+		return err
+	}
+
+	// Store queued tx messages for retrying them and picking them up after a restart.
+	if _, err := db.Exec(`
+		ALTER TABLE tx_messages ADD COLUMN IF NOT EXISTS message JSONB NULL;
+		ALTER TABLE tx_messages ADD COLUMN IF NOT EXISTS retry_at TIMESTAMP WITH TIME ZONE NULL;
+		CREATE INDEX IF NOT EXISTS idx_tx_messages_retry ON tx_messages(retry_at) WHERE status = 'queued';
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS segments (
+		    id               SERIAL PRIMARY KEY,
+		    name             TEXT NOT NULL,
+		    query            TEXT NOT NULL,
+		    list_ids         INTEGER[] NOT NULL DEFAULT '{}',
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+		    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS segment_id INTEGER NULL REFERENCES segments(id) ON DELETE SET NULL ON UPDATE CASCADE;
+	`); err != nil {
+		return err
+	}
+
+	// Cached list subscriber counts.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS list_subscriber_counts (
+		    list_id          INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    status           subscription_status NOT NULL,
+		    subscriber_count INTEGER NOT NULL DEFAULT 0,
+		    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+		    PRIMARY KEY (list_id, status)
+		);
+
+		CREATE TABLE IF NOT EXISTS list_counts_queue (
+		    list_id          INTEGER NOT NULL PRIMARY KEY,
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+
+		CREATE OR REPLACE FUNCTION queue_list_counts() RETURNS TRIGGER AS $$
+		BEGIN
+		    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+		        INSERT INTO list_counts_queue (list_id)
+		            SELECT DISTINCT list_id FROM new_rows WHERE list_id IS NOT NULL ORDER BY list_id
+		            ON CONFLICT (list_id) DO NOTHING;
+		    END IF;
+		    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+		        INSERT INTO list_counts_queue (list_id)
+		            SELECT DISTINCT list_id FROM old_rows WHERE list_id IS NOT NULL ORDER BY list_id
+		            ON CONFLICT (list_id) DO NOTHING;
+		    END IF;
+		    RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		CREATE OR REPLACE FUNCTION queue_archived_list_counts() RETURNS TRIGGER AS $$
+		BEGIN
+		    INSERT INTO list_counts_queue (list_id)
+		        SELECT DISTINCT subscriber_lists.list_id FROM new_rows
+		        INNER JOIN old_rows ON (old_rows.id = new_rows.id)
+		        INNER JOIN subscriber_lists ON (subscriber_lists.subscriber_id = new_rows.id)
+		        WHERE old_rows.archived_at IS DISTINCT FROM new_rows.archived_at
+		        ORDER BY subscriber_lists.list_id
+		        ON CONFLICT (list_id) DO NOTHING;
+		    RETURN NULL;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS trg_sub_lists_insert_counts ON subscriber_lists;
+		CREATE TRIGGER trg_sub_lists_insert_counts AFTER INSERT ON subscriber_lists
+		    REFERENCING NEW TABLE AS new_rows FOR EACH STATEMENT EXECUTE FUNCTION queue_list_counts();
+		DROP TRIGGER IF EXISTS trg_sub_lists_update_counts ON subscriber_lists;
+		CREATE TRIGGER trg_sub_lists_update_counts AFTER UPDATE ON subscriber_lists
+		    REFERENCING OLD TABLE AS old_rows NEW TABLE AS new_rows FOR EACH STATEMENT EXECUTE FUNCTION queue_list_counts();
+		DROP TRIGGER IF EXISTS trg_sub_lists_delete_counts ON subscriber_lists;
+		CREATE TRIGGER trg_sub_lists_delete_counts AFTER DELETE ON subscriber_lists
+		    REFERENCING OLD TABLE AS old_rows FOR EACH STATEMENT EXECUTE FUNCTION queue_list_counts();
+		DROP TRIGGER IF EXISTS trg_subs_archive_counts ON subscribers;
+		CREATE TRIGGER trg_subs_archive_counts AFTER UPDATE ON subscribers
+		    REFERENCING OLD TABLE AS old_rows NEW TABLE AS new_rows FOR EACH STATEMENT EXECUTE FUNCTION queue_archived_list_counts();
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS subscriber_tombstones (
+		    hash             TEXT NOT NULL PRIMARY KEY,
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS suppressions (
+		    email            TEXT NOT NULL PRIMARY KEY,
+		    blocked          INTEGER NOT NULL DEFAULT 0,
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+		    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+
+		CREATE OR REPLACE FUNCTION suppress_subscriber() RETURNS TRIGGER AS $$
+		BEGIN
+		    UPDATE suppressions SET blocked = blocked + 1, updated_at = NOW() WHERE email = LOWER(NEW.email);
+		    IF FOUND THEN
+		        NEW.status := 'blocklisted';
+		    END IF;
+		    RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;
+
+		DROP TRIGGER IF EXISTS trg_subs_suppress ON subscribers;
+		CREATE TRIGGER trg_subs_suppress BEFORE INSERT ON subscribers
+		    FOR EACH ROW EXECUTE FUNCTION suppress_subscriber();
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS import_checkpoints (
+		    hash             TEXT NOT NULL PRIMARY KEY,
+		    filename         TEXT NOT NULL,
+		    line             INTEGER NOT NULL DEFAULT 0,
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+		    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_import_checkpoints_filename ON import_checkpoints(filename);
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS archived BOOLEAN NOT NULL DEFAULT false;
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS parent_id INTEGER NULL REFERENCES lists(id) ON DELETE SET NULL ON UPDATE CASCADE;
+		CREATE INDEX IF NOT EXISTS idx_lists_parent_id ON lists(parent_id);
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS list_group_id INTEGER NULL REFERENCES lists(id) ON DELETE SET NULL ON UPDATE CASCADE;
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE subscriber_lists ADD COLUMN IF NOT EXISTS reconfirm_by TIMESTAMP WITH TIME ZONE NULL;
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS priority SMALLINT NOT NULL DEFAULT 0 CHECK (priority >= 0 AND priority <= 10);
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS unsubscribe_header BOOLEAN NULL;
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS amp_body TEXT NULL;
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS inline_css BOOLEAN NULL;
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS track_views BOOLEAN NOT NULL DEFAULT true;
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS track_views BOOLEAN NOT NULL DEFAULT true;
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS from_email TEXT NOT NULL DEFAULT '';
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS from_name TEXT NOT NULL DEFAULT '';
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`ALTER TABLE lists ADD COLUMN IF NOT EXISTS language TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+
+	// Add triggered campaign runs and their recipients.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS triggered BOOLEAN NOT NULL DEFAULT false;
+
+		CREATE TABLE IF NOT EXISTS campaign_recipients (
+		    campaign_id    INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    subscriber_id  INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+		    PRIMARY KEY (campaign_id, subscriber_id)
+		);
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS notify_emails TEXT[] NOT NULL DEFAULT '{}';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS notify_webhook_id INTEGER NULL;
+	`); err != nil {
+		return err
+	}
+
+	// Add subscriber attribute field definitions.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS attrib_fields (
+		    id               SERIAL PRIMARY KEY,
+		    name             TEXT NOT NULL UNIQUE,
+		    type             TEXT NOT NULL,
+		    label            TEXT NOT NULL DEFAULT '',
+		    required         BOOLEAN NOT NULL DEFAULT false,
+		    options          TEXT[] NOT NULL DEFAULT '{}',
+		    default_value    JSONB NOT NULL DEFAULT 'null',
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+		    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+	`); err != nil {
+		return err
+	}
+
+	// Add per-recipient delivery records of campaigns being processed.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS campaign_deliveries (
+		    campaign_id    INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    subscriber_id  INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+		    PRIMARY KEY (campaign_id, subscriber_id)
+		);
+	`); err != nil {
+		return err
+	}
+
+	// Add the deferred subscribers of campaigns being processed.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS campaign_deferrals (
+		    campaign_id    INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    subscriber_id  INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    copies         INTEGER NOT NULL DEFAULT 1,
+		    retry_at       TIMESTAMP WITH TIME ZONE NOT NULL,
+
+		    PRIMARY KEY (campaign_id, subscriber_id)
+		);
+		CREATE INDEX IF NOT EXISTS idx_camp_deferrals_retry ON campaign_deferrals(campaign_id, retry_at);
+	`); err != nil {
+		return err
+	}
+
+	// Add the stored responses of transactional API requests with idempotency keys.
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS tx_idempotency_keys (
+		    scope            TEXT NOT NULL,
+		    key              TEXT NOT NULL,
+		    request_hash     TEXT NOT NULL,
+		    status           INT NOT NULL DEFAULT 0,
+		    response         BYTEA NOT NULL DEFAULT '',
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+		    PRIMARY KEY (scope, key)
+		);
+		CREATE INDEX IF NOT EXISTS idx_tx_idempotency_keys_created_at ON tx_idempotency_keys(created_at);
+	`); err != nil {
+		return err
+	}
+
+	// Add the recipient exclusions and per-list copies of campaigns.
+	if _, err := db.Exec(`
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS exclude_list_ids INTEGER[] NOT NULL DEFAULT '{}';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS exclude_campaign_ids INTEGER[] NOT NULL DEFAULT '{}';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS per_list_copies BOOLEAN NOT NULL DEFAULT false;
+	`); err != nil {
+		return err
+	}
+
+	// Add the preheader (preview text) of campaigns.
+	if _, err := db.Exec(`ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS preheader TEXT NULL;`); err != nil {
+		return err
+	}
+
+	// Add the campaign approval workflow.
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+		    IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'campaign_approval_status') THEN
+		        CREATE TYPE campaign_approval_status AS ENUM ('none', 'pending', 'approved', 'rejected');
+		    END IF;
+		END$$;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS approval_status campaign_approval_status NOT NULL DEFAULT 'none';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS approval_reason TEXT NOT NULL DEFAULT '';
+		CREATE TABLE IF NOT EXISTS campaign_approvals (
+		    id               BIGSERIAL PRIMARY KEY,
+		    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+		    status           campaign_approval_status NOT NULL,
+		    actor            TEXT NOT NULL DEFAULT '',
+		    reason           TEXT NOT NULL DEFAULT '',
+		    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_camp_approvals_camp_id ON campaign_approvals(campaign_id);
+	`); err != nil {
+		return err
+	}
+
+	// Add the campaign revision for detecting concurrent edits.
+	if _, err := db.Exec(`ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS revision INT NOT NULL DEFAULT 0;`); err != nil {
+		return err
+	}
+
+	// Add the campaign UTM params.
+	if _, err := db.Exec(`ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS utm JSONB NOT NULL DEFAULT '{}';`); err != nil {
+		return err
+	}
+
+	// Index subscriber attributes for containment lookups of structured searches.
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_subs_attribs ON subscribers USING GIN (attribs jsonb_path_ops);`); err != nil {
+		return err
+	}
+
+	// Recreate the materialized views to exclude archived subscribers from counts.
+	if _, err := db.Exec(`
+		DROP MATERIALIZED VIEW IF EXISTS mat_dashboard_counts;
+		CREATE MATERIALIZED VIEW IF NOT EXISTS mat_dashboard_counts AS
+		    WITH subs AS (
+		        SELECT COUNT(*) AS num, status FROM subscribers GROUP BY status
+		    )
+		    SELECT NOW() AS updated_at,
+		        JSON_BUILD_OBJECT(
+		            'subscribers', JSON_BUILD_OBJECT(
+		                'total', (SELECT SUM(num) FROM subs),
+		                'blocklisted', (SELECT num FROM subs WHERE status='blocklisted'),
+		                'archived', (SELECT COUNT(*) FROM subscribers WHERE archived_at IS NOT NULL),
+		                'orphans', (
+		                    SELECT COUNT(id) FROM subscribers
+		                    LEFT JOIN subscriber_lists ON (subscribers.id = subscriber_lists.subscriber_id)
+		                    WHERE subscriber_lists.subscriber_id IS NULL
+		                )
+		            ),
+		            'lists', JSON_BUILD_OBJECT(
+		                'total', (SELECT COUNT(*) FROM lists),
+		                'private', (SELECT COUNT(*) FROM lists WHERE type='private'),
+		                'public', (SELECT COUNT(*) FROM lists WHERE type='public'),
+		                'optin_single', (SELECT COUNT(*) FROM lists WHERE optin='single'),
+		                'optin_double', (SELECT COUNT(*) FROM lists WHERE optin='double')
+		            ),
+		            'campaigns', JSON_BUILD_OBJECT(
+		                'total', (SELECT COUNT(*) FROM campaigns),
+		                'by_status', (
+		                    SELECT JSON_OBJECT_AGG (status, num) FROM
+		                    (SELECT status, COUNT(*) AS num FROM campaigns GROUP BY status) r
+		                )
+		            ),
+		            'messages', (SELECT SUM(sent) AS messages FROM campaigns)
+		        ) AS data;
+		CREATE UNIQUE INDEX IF NOT EXISTS mat_dashboard_stats_idx ON mat_dashboard_counts (updated_at);
+
+		DROP MATERIALIZED VIEW IF EXISTS mat_list_subscriber_stats;
+		CREATE MATERIALIZED VIEW IF NOT EXISTS mat_list_subscriber_stats AS
+		    SELECT NOW() AS updated_at, lists.id AS list_id, subscriber_lists.status, COUNT(*) AS subscriber_count FROM lists
+		    LEFT JOIN subscriber_lists ON (
+		        subscriber_lists.list_id = lists.id AND
+		        -- Exclude archived subscribers.
+		        NOT EXISTS (SELECT 1 FROM subscribers WHERE subscribers.id = subscriber_lists.subscriber_id AND subscribers.archived_at IS NOT NULL)
+		    )
+		    GROUP BY lists.id, subscriber_lists.status
+		    UNION ALL
+		    SELECT NOW() AS updated_at, 0 AS list_id, NULL AS status, COUNT(*) AS subscriber_count FROM subscribers WHERE archived_at IS NULL;
+		CREATE UNIQUE INDEX IF NOT EXISTS mat_list_subscriber_stats_idx ON mat_list_subscriber_stats (list_id, status);
+	`); err != nil {
+		return err
+	}
+
+	return nil
+}
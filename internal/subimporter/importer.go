@@ -1,4 +1,5 @@
-// Package subimporter implements a bulk ZIP/CSV importer of subscribers.
+// Package subimporter implements a bulk ZIP/CSV importer of subscribers,
+// and an importer of lists from other listmonk instances via their APIs.
 // It implements a simple queue for buffering imports and committing records
 // to DB along with ZIP and CSV handling utilities. It is meant to be used as
 // a singleton as each Importer instance is stateful, where it keeps track of
@@ -9,8 +10,10 @@ package subimporter
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -21,11 +24,14 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gofrs/uuid/v5"
+	"github.com/knadh/listmonk/internal/domains"
 	"github.com/knadh/listmonk/internal/i18n"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 )
 
 const (
@@ -48,16 +54,31 @@ const (
 	ModeBlocklist = "blocklist"
 )
 
+// Column mapping fields and transforms.
+const (
+	FieldEmail        = "email"
+	FieldName         = "name"
+	FieldAttributes   = "attributes"
+	FieldAttribPrefix = "attribs."
+
+	TransformTrim           = "trim"
+	TransformLowercase      = "lowercase"
+	TransformLowercaseEmail = "lowercase-email"
+	TransformParseDate      = "parse-date"
+
+	// Max number of row errors retained in the import status.
+	maxRowErrors = 1000
+)
+
 // Importer represents the bulk CSV subscriber import system.
 type Importer struct {
-	opt                   Options
-	db                    *sql.DB
-	i18n                  *i18n.I18n
-	domainBlocklist       map[string]bool
-	hasBlocklistWildcards bool
-
-	stop   chan bool
-	status Status
+	opt  Options
+	db   *sql.DB
+	i18n *i18n.I18n
+
+	stop     chan bool
+	rollback bool
+	status   Status
 	sync.RWMutex
 }
 
@@ -66,10 +87,21 @@ type Options struct {
 	UpsertStmt         *sql.Stmt
 	BlocklistStmt      *sql.Stmt
 	UpdateListDateStmt *sql.Stmt
+	DeleteSubsStmt     *sql.Stmt
 	NotifCB            models.AdminNotifCallback
 
-	// Lookup table for blocklisted domains.
-	DomainBlocklist []string
+	// Import checkpoints that record the last committed line of a file (by its hash)
+	// so that a re-import of an interrupted file resumes from there.
+	GetCheckpointStmt          *sql.Stmt
+	UpsertCheckpointStmt       *sql.Stmt
+	DeleteCheckpointStmt       *sql.Stmt
+	DeleteStaleCheckpointsStmt *sql.Stmt
+
+	// Domain block and allow rules that subscribers' e-mails are checked against.
+	DomainRules *domains.Rules
+
+	// Optional compiled JSON schema to validate subscriber attributes against.
+	AttribsSchema *jsonschema.Schema
 }
 
 // Session represents a single import session.
@@ -78,6 +110,18 @@ type Session struct {
 	subQueue chan SubReq
 	log      *log.Logger
 
+	// SHA-256 hash of the CSV being imported, and whether the import was stopped
+	// before the whole file was read. stopped is set before subQueue is closed.
+	// failed is set if the source failed after subscribers were queued, which
+	// are still committed but the import is marked as failed.
+	hash    string
+	stopped bool
+	failed  bool
+
+	// IDs of the subscribers newly created (not updated) in the session
+	// that are deleted if the import is cancelled with a rollback.
+	created []int64
+
 	opt SessionOpt
 }
 
@@ -89,6 +133,36 @@ type SessionOpt struct {
 	Overwrite bool   `json:"overwrite"`
 	Delim     string `json:"delim"`
 	ListIDs   []int  `json:"lists"`
+
+	// Skip validating attributes against the attribute schema.
+	SkipAttribsValidation bool `json:"skip_attribs_validation"`
+
+	// Optional mapping of CSV columns to subscriber fields. If it's empty,
+	// the email, name, and attributes columns are imported.
+	Mapping []ColumnMap `json:"mapping"`
+}
+
+// ColumnMap maps a CSV column to a subscriber field.
+type ColumnMap struct {
+	// Name of the column in the CSV header.
+	Column string `json:"column"`
+
+	// email, name, attributes (a JSON object of attributes), or attribs.<key>
+	// to import the column's value as the attribute key.
+	Field string `json:"field"`
+
+	// Optional transforms applied to the value in order.
+	// trim, lowercase, lowercase-email, parse-date.
+	Transforms []string `json:"transforms"`
+
+	// Index of the column in the CSV.
+	idx int
+}
+
+// RowError represents a CSV row that was skipped or that errored during an import.
+type RowError struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
 }
 
 // Status represents statistics from an ongoing import session.
@@ -97,7 +171,19 @@ type Status struct {
 	Total    int    `json:"total"`
 	Imported int    `json:"imported"`
 	Status   string `json:"status"`
-	logBuf   *bytes.Buffer
+
+	// Rows skipped for not matching the header (eg: column count) and rows
+	// skipped for having invalid values, and the reasons (capped at maxRowErrors).
+	Skipped int        `json:"skipped"`
+	Errored int        `json:"errored"`
+	Errors  []RowError `json:"errors"`
+
+	// If the import was resumed from a checkpoint of an earlier attempt to import
+	// the same file, the offset is the line up to which rows were already imported.
+	Resumed bool `json:"resumed"`
+	Offset  int  `json:"offset"`
+
+	logBuf *bytes.Buffer
 }
 
 // SubReq is a wrapper over the Subscriber model.
@@ -106,6 +192,12 @@ type SubReq struct {
 	Lists          []int    `json:"lists"`
 	ListUUIDs      []string `json:"list_uuids"`
 	PreconfirmSubs bool     `json:"preconfirm_subscriptions"`
+
+	// Line of the subscriber in the CSV, or the subscriber's ID on a remote instance.
+	line int
+
+	// Optional subscription status that overrides the session's.
+	subStatus string
 }
 
 type importStatusTpl struct {
@@ -125,31 +217,28 @@ var (
 		"name":       true,
 		"attributes": true}
 
+	// Date formats that the parse-date transform accepts.
+	dateLayouts = []string{
+		time.RFC3339,
+		"2006-01-02 15:04:05",
+		"2006-01-02",
+		"2006/01/02",
+		"01/02/2006",
+		"02-Jan-2006",
+		"Jan 2, 2006",
+	}
+
 	regexCleanStr = regexp.MustCompile("[[:^ascii:]]")
 )
 
 // New returns a new instance of Importer.
 func New(opt Options, db *sql.DB, i *i18n.I18n) *Importer {
 	im := Importer{
-		opt:             opt,
-		db:              db,
-		i18n:            i,
-		domainBlocklist: make(map[string]bool, len(opt.DomainBlocklist)),
-		status:          Status{Status: StatusNone, logBuf: bytes.NewBuffer(nil)},
-		stop:            make(chan bool, 1),
-	}
-
-	// Domain blocklist.
-	for _, d := range opt.DomainBlocklist {
-		im.domainBlocklist[d] = true
-
-		// Domains with *. as the subdomain prefix, strip that
-		// and add the full domain to the blocklist as well.
-		// eg: *.example.com => example.com
-		if strings.Contains(d, "*.") {
-			im.hasBlocklistWildcards = true
-			im.domainBlocklist[strings.TrimPrefix(d, "*.")] = true
-		}
+		opt:    opt,
+		db:     db,
+		i18n:   i,
+		status: Status{Status: StatusNone, logBuf: bytes.NewBuffer(nil)},
+		stop:   make(chan bool, 1),
 	}
 
 	return &im
@@ -165,9 +254,17 @@ func (im *Importer) NewSession(opt SessionOpt) (*Session, error) {
 	im.Lock()
 	im.status = Status{Status: StatusImporting,
 		Name:   opt.Filename,
+		Errors: []RowError{},
 		logBuf: bytes.NewBuffer(nil)}
+	im.rollback = false
 	im.Unlock()
 
+	// Discard a stop signal that arrived after the last session had read its file.
+	select {
+	case <-im.stop:
+	default:
+	}
+
 	s := &Session{
 		im:       im,
 		log:      log.New(im.status.logBuf, "", log.Ldate|log.Ltime|log.Lshortfile),
@@ -188,6 +285,11 @@ func (im *Importer) GetStats() Status {
 		Status:   im.status.Status,
 		Total:    im.status.Total,
 		Imported: im.status.Imported,
+		Skipped:  im.status.Skipped,
+		Errored:  im.status.Errored,
+		Errors:   append([]RowError{}, im.status.Errors...),
+		Resumed:  im.status.Resumed,
+		Offset:   im.status.Offset,
 	}
 }
 
@@ -235,6 +337,28 @@ func (im *Importer) incrementImportCount(n int) {
 	im.Unlock()
 }
 
+// skipRow records a row that was skipped for not matching the CSV header.
+func (im *Importer) skipRow(line int, reason string) {
+	im.Lock()
+	im.status.Skipped++
+	im.addRowError(line, reason)
+	im.Unlock()
+}
+
+// errorRow records a row that was skipped for having invalid values.
+func (im *Importer) errorRow(line int, reason string) {
+	im.Lock()
+	im.status.Errored++
+	im.addRowError(line, reason)
+	im.Unlock()
+}
+
+func (im *Importer) addRowError(line int, reason string) {
+	if len(im.status.Errors) < maxRowErrors {
+		im.status.Errors = append(im.status.Errors, RowError{Line: line, Reason: reason})
+	}
+}
+
 // sendNotif sends admin notifications for import completions.
 func (im *Importer) sendNotif(status string) error {
 	var (
@@ -257,11 +381,12 @@ func (im *Importer) sendNotif(status string) error {
 // invoked as a goroutine.
 func (s *Session) Start() {
 	var (
-		tx    *sql.Tx
-		stmt  *sql.Stmt
-		err   error
-		total = 0
-		cur   = 0
+		tx       *sql.Tx
+		stmt     *sql.Stmt
+		err      error
+		total    = 0
+		cur      = 0
+		lastLine = 0
 
 		listIDs = make([]int, len(s.opt.ListIDs))
 	)
@@ -293,21 +418,35 @@ func (s *Session) Start() {
 			break
 		}
 
+		var (
+			id       int64
+			inserted bool
+			subUUID  string
+		)
 		if s.opt.Mode == ModeSubscribe {
-			_, err = stmt.Exec(uu, sub.Email, sub.Name, sub.Attribs, pq.Array(listIDs), s.opt.SubStatus, s.opt.Overwrite)
+			subStatus := s.opt.SubStatus
+			if sub.subStatus != "" {
+				subStatus = sub.subStatus
+			}
+			err = stmt.QueryRow(uu, sub.Email, sub.Name, sub.Attribs, pq.Array(listIDs), subStatus, s.opt.Overwrite).Scan(&subUUID, &id, &inserted)
 		} else if s.opt.Mode == ModeBlocklist {
-			_, err = stmt.Exec(uu, sub.Email, sub.Name, sub.Attribs)
+			err = stmt.QueryRow(uu, sub.Email, sub.Name, sub.Attribs).Scan(&id, &inserted)
 		}
 		if err != nil {
 			s.log.Printf("error executing insert: %v", err)
 			tx.Rollback()
 			break
 		}
+		if inserted {
+			s.created = append(s.created, id)
+		}
+		lastLine = sub.line
 		cur++
 		total++
 
 		// Batch size is met. Commit.
 		if cur%commitBatchSize == 0 {
+			s.saveCheckpoint(tx, lastLine)
 			if err := tx.Commit(); err != nil {
 				tx.Rollback()
 				s.log.Printf("error committing to DB: %v", err)
@@ -320,18 +459,26 @@ func (s *Session) Start() {
 		}
 	}
 
-	// Queue's closed and there's nothing left to commit.
-	if cur == 0 {
-		s.im.setStatus(StatusFinished)
-		s.log.Printf("imported finished")
-		if _, err := s.im.opt.UpdateListDateStmt.Exec(pq.Array(listIDs)); err != nil {
-			s.log.Printf("error updating lists date: %v", err)
+	// The import was cancelled. Discard the uncommitted batch and delete
+	// the subscribers created so far.
+	if s.stopped && s.im.shouldRollback() {
+		if cur > 0 {
+			tx.Rollback()
 		}
+		s.rollback()
+		s.im.setStatus(StatusFinished)
 		s.im.sendNotif(StatusFinished)
 		return
 	}
 
+	// Queue's closed and there's nothing left to commit.
+	if cur == 0 {
+		s.finish(listIDs)
+		return
+	}
+
 	// Queue's closed and there are records left to commit.
+	s.saveCheckpoint(tx, lastLine)
 	if err := tx.Commit(); err != nil {
 		tx.Rollback()
 		s.im.setStatus(StatusFailed)
@@ -341,12 +488,25 @@ func (s *Session) Start() {
 	}
 
 	s.im.incrementImportCount(cur)
-	s.im.setStatus(StatusFinished)
-	s.log.Printf("imported finished")
+	s.finish(listIDs)
+}
+
+// finish marks the session as finished, or failed if the source failed, once
+// all the queued subscribers are committed.
+func (s *Session) finish(listIDs []int) {
+	s.finishCheckpoint()
+
+	status := StatusFinished
+	if s.failed {
+		status = StatusFailed
+	}
+	s.im.setStatus(status)
+	s.log.Printf("imported %s", status)
+
 	if _, err := s.im.opt.UpdateListDateStmt.Exec(pq.Array(listIDs)); err != nil {
 		s.log.Printf("error updating lists date: %v", err)
 	}
-	s.im.sendNotif(StatusFinished)
+	s.im.sendNotif(status)
 }
 
 // Stop stops an active import session.
@@ -354,6 +514,64 @@ func (s *Session) Stop() {
 	close(s.subQueue)
 }
 
+// saveCheckpoint records the last line in the transaction batch as the file's
+// checkpoint in the same transaction.
+func (s *Session) saveCheckpoint(tx *sql.Tx, line int) {
+	if s.hash == "" || s.im.opt.UpsertCheckpointStmt == nil {
+		return
+	}
+
+	if _, err := tx.Stmt(s.im.opt.UpsertCheckpointStmt).Exec(s.opt.Filename, s.hash, line); err != nil {
+		s.log.Printf("error saving import checkpoint: %v", err)
+	}
+}
+
+// finishCheckpoint deletes the file's checkpoint once the whole file has been
+// imported. If the import was stopped, the checkpoint is retained so that
+// a re-import of the file resumes from it.
+func (s *Session) finishCheckpoint() {
+	if s.stopped {
+		s.log.Printf("import stopped. Re-importing the same source will resume from where it stopped")
+		return
+	}
+	s.deleteCheckpoint()
+}
+
+func (s *Session) deleteCheckpoint() {
+	if s.hash == "" || s.im.opt.DeleteCheckpointStmt == nil {
+		return
+	}
+
+	if _, err := s.im.opt.DeleteCheckpointStmt.Exec(s.hash); err != nil {
+		s.log.Printf("error deleting import checkpoint: %v", err)
+	}
+}
+
+// rollback deletes the subscribers that were newly created in the session and
+// the file's checkpoint. Existing subscribers that were updated by the import
+// are not reverted.
+func (s *Session) rollback() {
+	s.log.Printf("rolling back import. deleting %d new subscribers", len(s.created))
+
+	for i := 0; i < len(s.created); i += commitBatchSize {
+		end := i + commitBatchSize
+		if end > len(s.created) {
+			end = len(s.created)
+		}
+
+		if _, err := s.im.opt.DeleteSubsStmt.Exec(pq.Array(s.created[i:end]), pq.StringArray{}); err != nil {
+			s.log.Printf("error deleting imported subscribers: %v", err)
+			return
+		}
+	}
+	s.deleteCheckpoint()
+
+	s.im.Lock()
+	s.im.status.Imported = 0
+	s.im.Unlock()
+	s.log.Printf("import rolled back")
+}
+
 // ExtractZIP takes a ZIP file's path and extracts all .csv files in it to
 // a temporary directory, and returns the name of the temp directory and the
 // list of extracted .csv files.
@@ -457,8 +675,10 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 
 	// Count the total number of lines in the file. This doesn't distinguish
 	// between "blank" and non "blank" lines, and is only used to derive
-	// the progress percentage for the frontend.
-	numLines, err := countLines(f)
+	// the progress percentage for the frontend. The file is hashed in the
+	// same pass to look up checkpoints of earlier attempts.
+	h := sha256.New()
+	numLines, err := countLines(io.TeeReader(f, h))
 	if err != nil {
 		s.log.Printf("error counting lines in '%s': '%v'", srcPath, err)
 		return err
@@ -468,6 +688,9 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 		return errors.New("empty file")
 	}
 
+	s.hash = hex.EncodeToString(h.Sum(nil))
+	offset := s.getCheckpoint()
+
 	s.im.Lock()
 	// Exclude the header from count.
 	s.im.status.Total = numLines - 1
@@ -485,17 +708,21 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 		return err
 	}
 
-	hdrKeys := s.mapCSVHeaders(csvHdr, csvHeaders)
-	// email is a required header.
-	if _, ok := hdrKeys["email"]; !ok {
-		s.log.Printf("'email' column not found in '%s'", srcPath)
-		return errors.New("'email' column not found")
+	mapping, err := s.mapColumns(csvHdr)
+	if err != nil {
+		s.log.Printf("error mapping columns in '%s': %v", srcPath, err)
+		return err
 	}
 
-	var (
-		lnHdr = len(hdrKeys)
-		i     = 0
-	)
+	// The minimum number of columns a row should have.
+	lnHdr := 0
+	for _, c := range mapping {
+		if c.idx+1 > lnHdr {
+			lnHdr = c.idx + 1
+		}
+	}
+
+	i := 0
 	for {
 		i++
 
@@ -503,6 +730,7 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 		select {
 		case <-s.im.stop:
 			failed = false
+			s.stopped = true
 			close(s.subQueue)
 			s.log.Println("stop request received")
 			return nil
@@ -512,9 +740,17 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 		cols, err := rd.Read()
 		if err == io.EOF {
 			break
-		} else if err != nil {
+		}
+
+		// Skip the lines already imported in an earlier attempt.
+		if i <= offset {
+			continue
+		}
+
+		if err != nil {
 			if err, ok := err.(*csv.ParseError); ok && err.Err == csv.ErrFieldCount {
 				s.log.Printf("skipping line %d. %v", i, err)
+				s.im.skipRow(i, err.Error())
 				continue
 			} else {
 				s.log.Printf("error reading CSV '%s'", err)
@@ -525,53 +761,268 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 		lnCols := len(cols)
 		if lnCols < lnHdr {
 			s.log.Printf("skipping line %d. column count (%d) does not match minimum header count (%d)", i, lnCols, lnHdr)
+			s.im.skipRow(i, fmt.Sprintf("column count (%d) does not match minimum header count (%d)", lnCols, lnHdr))
 			continue
 		}
 
-		// Iterate the key map and based on the indices mapped earlier,
-		// form a map of key: csv_value, eg: email: user@user.com.
-		row := make(map[string]string, lnCols)
-		for key := range hdrKeys {
-			row[key] = cols[hdrKeys[key]]
+		sub, err := s.makeSub(i, cols, mapping)
+		if err != nil {
+			s.log.Printf("skipping line %d: %s: %v", i, sub.Email, err)
+			s.im.errorRow(i, err.Error())
+			continue
 		}
 
-		sub := SubReq{}
-		sub.Email = row["email"]
+		// Send the subscriber to the queue.
+		sub.line = i
+		s.subQueue <- sub
+	}
 
-		if v, ok := row["name"]; ok {
-			sub.Name = v
+	close(s.subQueue)
+	failed = false
+	return nil
+}
+
+// getCheckpoint returns the last imported line of the file from the checkpoint
+// of an earlier attempt to import it, if any. If the file has changed since
+// (a file with the same name but a different hash), its old checkpoint is
+// discarded and the file is imported from the beginning.
+func (s *Session) getCheckpoint() int {
+	if s.im.opt.GetCheckpointStmt == nil {
+		return 0
+	}
+
+	if res, err := s.im.opt.DeleteStaleCheckpointsStmt.Exec(s.opt.Filename, s.hash); err != nil {
+		s.log.Printf("error deleting stale import checkpoints: %v", err)
+	} else if n, _ := res.RowsAffected(); n > 0 {
+		s.log.Printf("'%s' has changed since the last import attempt. importing from the beginning", s.opt.Filename)
+	}
+
+	var line int
+	if err := s.im.opt.GetCheckpointStmt.QueryRow(s.hash).Scan(&line); err != nil {
+		if err != sql.ErrNoRows {
+			s.log.Printf("error fetching import checkpoint: %v", err)
 		}
+		return 0
+	}
+
+	s.log.Printf("resuming import from line %d", line+1)
+	s.im.Lock()
+	s.im.status.Resumed = true
+	s.im.status.Offset = line
+	s.im.Unlock()
+
+	return line
+}
 
-		sub, err = s.im.ValidateFields(sub)
+// makeSub prepares a subscriber from a CSV row with the column mapping.
+func (s *Session) makeSub(line int, cols []string, mapping []ColumnMap) (SubReq, error) {
+	var (
+		sub     = SubReq{}
+		attribs = models.JSON{}
+	)
+	for _, c := range mapping {
+		v, err := applyTransforms(cols[c.idx], c.Transforms)
 		if err != nil {
-			s.log.Printf("skipping line %d: %s: %v", i, sub.Email, err)
-			continue
+			return sub, fmt.Errorf("column '%s': %v", c.Column, err)
 		}
 
-		// JSON attributes.
-		if len(row["attributes"]) > 0 {
-			var (
-				attribs models.JSON
-				b       = []byte(row["attributes"])
-			)
-			if err := json.Unmarshal(b, &attribs); err != nil {
-				s.log.Printf("skipping invalid attributes JSON on line %d for '%s': %v", i, sub.Email, err)
-			} else {
-				sub.Attribs = attribs
+		switch {
+		case c.Field == FieldEmail:
+			sub.Email = v
+		case c.Field == FieldName:
+			sub.Name = v
+		case c.Field == FieldAttributes:
+			if len(v) == 0 {
+				continue
+			}
+
+			var a models.JSON
+			if err := json.Unmarshal([]byte(v), &a); err != nil {
+				s.log.Printf("skipping invalid attributes JSON on line %d for '%s': %v", line, sub.Email, err)
+				continue
 			}
+			for k, val := range a {
+				attribs[k] = val
+			}
+		case strings.HasPrefix(c.Field, FieldAttribPrefix):
+			attribs[strings.TrimPrefix(c.Field, FieldAttribPrefix)] = v
 		}
+	}
 
-		// Send the subscriber to the queue.
-		s.subQueue <- sub
+	sub, err := s.im.ValidateFields(sub)
+	if err != nil {
+		return sub, err
+	}
+
+	if len(attribs) > 0 {
+		if err := s.validateAttribs(attribs); err != nil {
+			return sub, fmt.Errorf("attributes do not match the schema: %v", err)
+		}
+		sub.Attribs = attribs
+	}
+
+	return sub, nil
+}
+
+// mapColumns maps the session's column mapping to the column positions in the CSV
+// header. Mapped columns should exist in the header. Columns in the header that
+// aren't mapped are logged. If the session doesn't have a mapping, the known
+// email, name, and attributes columns are mapped.
+func (s *Session) mapColumns(csvHdr []string) ([]ColumnMap, error) {
+	if len(s.opt.Mapping) == 0 {
+		hdrKeys := s.mapCSVHeaders(csvHdr, csvHeaders)
+
+		// email is a required header.
+		if _, ok := hdrKeys["email"]; !ok {
+			return nil, errors.New("'email' column not found")
+		}
+
+		out := make([]ColumnMap, 0, len(hdrKeys))
+		for h, idx := range hdrKeys {
+			out = append(out, ColumnMap{Column: h, Field: h, idx: idx})
+		}
+		return out, nil
+	}
+
+	// Position of the columns in the header. Clean the string of non-ASCII characters (BOM etc.).
+	pos := make(map[string]int, len(csvHdr))
+	for i, h := range csvHdr {
+		pos[strings.TrimSpace(regexCleanStr.ReplaceAllString(h, ""))] = i
+	}
+
+	var (
+		out    = make([]ColumnMap, 0, len(s.opt.Mapping))
+		mapped = make(map[string]bool, len(s.opt.Mapping))
+	)
+	for _, c := range s.opt.Mapping {
+		idx, ok := pos[c.Column]
+		if !ok {
+			return nil, fmt.Errorf("mapped column '%s' not found in the header", c.Column)
+		}
+
+		c.idx = idx
+		out = append(out, c)
+		mapped[c.Column] = true
+	}
+
+	var unmapped []string
+	for _, h := range csvHdr {
+		h = strings.TrimSpace(regexCleanStr.ReplaceAllString(h, ""))
+		if !mapped[h] {
+			unmapped = append(unmapped, h)
+		}
+	}
+	if len(unmapped) > 0 {
+		s.log.Printf("ignoring unmapped columns: %s", strings.Join(unmapped, ", "))
+	}
+
+	return out, nil
+}
+
+// ValidateMapping validates a column mapping. There should be exactly one column
+// mapped to email, and the fields should be unique.
+func ValidateMapping(mapping []ColumnMap) error {
+	if len(mapping) == 0 {
+		return nil
+	}
+
+	var (
+		fields   = make(map[string]bool, len(mapping))
+		hasEmail = false
+	)
+	for _, c := range mapping {
+		if c.Column == "" {
+			return errors.New("empty column name in mapping")
+		}
+
+		switch {
+		case c.Field == FieldEmail:
+			hasEmail = true
+		case c.Field == FieldName, c.Field == FieldAttributes:
+		case strings.HasPrefix(c.Field, FieldAttribPrefix) && len(c.Field) > len(FieldAttribPrefix):
+		default:
+			return fmt.Errorf("invalid field '%s' for column '%s'", c.Field, c.Column)
+		}
+
+		if fields[c.Field] {
+			return fmt.Errorf("field '%s' is mapped more than once", c.Field)
+		}
+		fields[c.Field] = true
+
+		for _, t := range c.Transforms {
+			switch t {
+			case TransformTrim, TransformLowercase, TransformLowercaseEmail, TransformParseDate:
+			default:
+				return fmt.Errorf("invalid transform '%s' for column '%s'", t, c.Column)
+			}
+		}
+	}
+
+	if !hasEmail {
+		return errors.New("no column is mapped to 'email'")
 	}
 
-	close(s.subQueue)
-	failed = false
 	return nil
 }
 
-// Stop sends a signal to stop the existing import.
-func (im *Importer) Stop() {
+// applyTransforms applies the given transforms to a CSV value in order.
+func applyTransforms(v string, transforms []string) (string, error) {
+	for _, t := range transforms {
+		switch t {
+		case TransformTrim:
+			v = strings.TrimSpace(v)
+		case TransformLowercase:
+			v = strings.ToLower(v)
+		case TransformLowercaseEmail:
+			v = strings.ToLower(strings.TrimSpace(v))
+		case TransformParseDate:
+			d, err := parseDate(strings.TrimSpace(v))
+			if err != nil {
+				return "", err
+			}
+			v = d.Format(time.RFC3339)
+		}
+	}
+
+	return v, nil
+}
+
+// parseDate parses a date in one of the known layouts.
+func parseDate(v string) (time.Time, error) {
+	for _, l := range dateLayouts {
+		if t, err := time.Parse(l, v); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unknown date format: '%s'", v)
+}
+
+// validateAttribs validates the given attributes against the attribute schema
+// if one is set and validation isn't disabled for the session.
+func (s *Session) validateAttribs(attribs models.JSON) error {
+	if s.im.opt.AttribsSchema == nil || s.opt.SkipAttribsValidation {
+		return nil
+	}
+
+	// Round trip through JSON so that the values are of the types that
+	// the validator expects.
+	b, err := json.Marshal(attribs)
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	return s.im.opt.AttribsSchema.Validate(v)
+}
+
+// Stop sends a signal to stop the existing import. If rollback is true, the
+// subscribers created by the import are deleted. Otherwise, the records imported
+// so far are retained along with a checkpoint to resume the import from.
+func (im *Importer) Stop(rollback bool) {
 	if im.getStatus() != StatusImporting {
 		im.Lock()
 		im.status = Status{Status: StatusNone}
@@ -579,6 +1030,12 @@ func (im *Importer) Stop() {
 		return
 	}
 
+	// The flag is set before the signal is sent as the session
+	// checks it as soon as it receives the signal.
+	im.Lock()
+	im.rollback = rollback
+	im.Unlock()
+
 	select {
 	case im.stop <- true:
 		im.setStatus(StatusStopping)
@@ -586,9 +1043,32 @@ func (im *Importer) Stop() {
 	}
 }
 
-// SanitizeEmail validates and sanitizes an e-mail string and returns the lowercased,
-// e-mail component of an e-mail string.
+// shouldRollback returns true if the import was stopped with a rollback.
+func (im *Importer) shouldRollback() bool {
+	im.RLock()
+	defer im.RUnlock()
+	return im.rollback
+}
+
+// SanitizeEmail validates and sanitizes a subscriber's e-mail string and returns the
+// lowercased, e-mail component of an e-mail string. The e-mail's domain is checked
+// against the domain rules.
 func (im *Importer) SanitizeEmail(email string) (string, error) {
+	em, err := im.ParseEmail(email)
+	if err != nil {
+		return "", err
+	}
+
+	if err := im.opt.DomainRules.Check(em); err != nil {
+		return "", errors.New(im.i18n.T("subscribers.domainBlocklisted"))
+	}
+
+	return em, nil
+}
+
+// ParseEmail validates and sanitizes an e-mail string and returns the lowercased,
+// e-mail component of an e-mail string without checking the domain rules.
+func (im *Importer) ParseEmail(email string) (string, error) {
 	email = strings.ToLower(strings.TrimSpace(email))
 
 	// Since `mail.ParseAddress` parses an email address which can also contain optional name component
@@ -599,33 +1079,6 @@ func (im *Importer) SanitizeEmail(email string) (string, error) {
 		return "", errors.New(im.i18n.T("subscribers.invalidEmail"))
 	}
 
-	// Check if the e-mail's domain is blocklisted. The e-mail domain and blocklist config
-	// are always lowercase.
-	d := strings.Split(em.Address, "@")
-	if len(d) == 2 {
-		domain := d[1]
-
-		// Check the domain as-is.
-		if _, ok := im.domainBlocklist[domain]; ok {
-			return "", errors.New(im.i18n.T("subscribers.domainBlocklisted"))
-		}
-
-		// If there are wildcards in the blocklist and the email domain has a subdomain, check that.
-		if im.hasBlocklistWildcards && strings.Count(domain, ".") > 1 {
-			parts := strings.Split(domain, ".")
-
-			// Replace the first part of the subdomain with * and check if that exists in the blocklist.
-			// Eg: test.mail.example.com => *.mail.example.com
-			parts[0] = "*"
-			domain = strings.Join(parts, ".")
-
-			if _, ok := im.domainBlocklist[domain]; ok {
-				return "", errors.New(im.i18n.T("subscribers.domainBlocklisted"))
-			}
-		}
-
-	}
-
 	return em.Address, nil
 }
 
@@ -0,0 +1,307 @@
+package subimporter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	// remotePerPage is the number of subscribers fetched from the source
+	// instance in a single request.
+	remotePerPage = 500
+
+	// Max number of retries of a request that's rate limited or fails with a
+	// server error, and the maximum time to wait between retries.
+	remoteMaxRetries = 8
+	remoteMaxWait    = time.Minute * 2
+
+	remoteTimeout = time.Second * 30
+)
+
+// RemoteOpt represents the source of an import from another listmonk instance.
+type RemoteOpt struct {
+	// Root URL of the source instance, eg: https://listmonk.mysite.com
+	URL string `json:"url"`
+
+	// API credentials on the source instance.
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// ID of the list on the source instance.
+	ListID int `json:"list_id"`
+
+	// Optional subscription status of the list's subscribers to import,
+	// eg: confirmed. If it's empty, all subscribers who haven't unsubscribed
+	// from the list are imported.
+	SubStatus string `json:"subscription_status"`
+}
+
+// Remote fetches lists and subscribers from another listmonk instance via its API.
+type Remote struct {
+	opt    RemoteOpt
+	client *http.Client
+	log    func(format string, v ...interface{})
+}
+
+type remoteResp struct {
+	Data json.RawMessage `json:"data"`
+}
+
+type remoteSubs struct {
+	Results []remoteSub `json:"results"`
+	Total   int         `json:"total"`
+}
+
+type remoteSub struct {
+	ID      int         `json:"id"`
+	Email   string      `json:"email"`
+	Name    string      `json:"name"`
+	Attribs models.JSON `json:"attribs"`
+	Status  string      `json:"status"`
+	Lists   []struct {
+		ID                 int    `json:"id"`
+		SubscriptionStatus string `json:"subscription_status"`
+	} `json:"lists"`
+}
+
+// NewRemote returns a new Remote source.
+func NewRemote(opt RemoteOpt) (*Remote, error) {
+	u, err := url.Parse(opt.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errors.New("invalid source URL")
+	}
+	if opt.ListID < 1 {
+		return nil, errors.New("invalid source list ID")
+	}
+	opt.URL = strings.TrimRight(opt.URL, "/")
+
+	return &Remote{
+		opt:    opt,
+		client: &http.Client{Timeout: remoteTimeout},
+		log:    func(string, ...interface{}) {},
+	}, nil
+}
+
+// Name returns the name of the import of the remote list as the source
+// URL and list ID, which also identifies the import's checkpoint.
+func (r *Remote) Name() string {
+	return fmt.Sprintf("%s/lists/%d", r.opt.URL, r.opt.ListID)
+}
+
+// GetList fetches the list from the source instance.
+func (r *Remote) GetList() (models.List, error) {
+	var out models.List
+	if err := r.get(fmt.Sprintf("/api/lists/%d", r.opt.ListID), nil, &out); err != nil {
+		return out, err
+	}
+
+	return out, nil
+}
+
+// getSubs fetches a page of the list's subscribers whose IDs are greater than afterID.
+// Subscribers are paged by their IDs instead of page numbers so that subscribers
+// that are added or deleted on the source instance during an import don't shift pages.
+func (r *Remote) getSubs(afterID int) (remoteSubs, error) {
+	q := url.Values{}
+	q.Set("list_id", strconv.Itoa(r.opt.ListID))
+	q.Set("query", fmt.Sprintf("subscribers.id > %d", afterID))
+	q.Set("order_by", "id")
+	q.Set("order", "asc")
+	q.Set("page", "1")
+	q.Set("per_page", strconv.Itoa(remotePerPage))
+	if r.opt.SubStatus != "" {
+		q.Set("subscription_status", r.opt.SubStatus)
+	}
+
+	var out remoteSubs
+	err := r.get("/api/subscribers", q, &out)
+	return out, err
+}
+
+// get makes a GET request to the source instance's API and unmarshals the
+// response's data into out. Requests that are rate limited (429) or that fail
+// with a server error are retried after the Retry-After duration sent by the source,
+// or with an exponential backoff.
+func (r *Remote) get(path string, q url.Values, out interface{}) error {
+	u := r.opt.URL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+
+	wait := time.Second
+	for n := 0; ; n++ {
+		req, err := http.NewRequest(http.MethodGet, u, nil)
+		if err != nil {
+			return err
+		}
+		req.SetBasicAuth(r.opt.Username, r.opt.Password)
+		req.Header.Set("Accept", "application/json")
+
+		retry := false
+		resp, err := r.client.Do(req)
+		if err != nil {
+			retry = true
+		} else {
+			retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+			if retry {
+				if d, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+					wait = d
+				}
+				err = fmt.Errorf("source returned %s", resp.Status)
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}
+
+		if retry {
+			if n >= remoteMaxRetries {
+				return err
+			}
+			if wait > remoteMaxWait {
+				wait = remoteMaxWait
+			}
+
+			r.log("error fetching %s: %v. retrying in %v", path, err, wait)
+			time.Sleep(wait)
+			wait *= 2
+			continue
+		}
+
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			b, _ := io.ReadAll(io.LimitReader(resp.Body, 1000))
+			return fmt.Errorf("source returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+		}
+
+		var res remoteResp
+		if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+			return fmt.Errorf("error decoding source response: %v", err)
+		}
+
+		return json.Unmarshal(res.Data, out)
+	}
+}
+
+// parseRetryAfter parses a Retry-After header that's either in seconds or an HTTP date.
+func parseRetryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+	if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+
+	return 0, false
+}
+
+// LoadRemote pages through the subscribers of the list on a remote listmonk instance
+// and queues them for import with their attributes and subscription statuses.
+// Blocklisted subscribers and subscribers who have unsubscribed from the list
+// are skipped.
+//
+// The ID of the last subscriber that's committed is checkpointed like the lines
+// of a CSV, and importing the same remote list again resumes from there.
+func (s *Session) LoadRemote(r *Remote) error {
+	if s.im.isDone() {
+		return ErrIsImporting
+	}
+
+	r.log = s.log.Printf
+
+	h := sha256.Sum256([]byte(r.Name()))
+	s.hash = hex.EncodeToString(h[:])
+	lastID := s.getCheckpoint()
+
+	for {
+		res, err := r.getSubs(lastID)
+		if err != nil {
+			// The subscribers queued so far are committed and checkpointed
+			// so that the import can be resumed.
+			s.log.Printf("error fetching subscribers from '%s': %v", r.opt.URL, err)
+			s.failed = true
+			s.stopped = true
+			close(s.subQueue)
+			return err
+		}
+
+		// The total is the number of subscribers left to import.
+		s.im.Lock()
+		if s.im.status.Total == 0 {
+			s.im.status.Total = res.Total
+		}
+		s.im.Unlock()
+
+		for _, rs := range res.Results {
+			// Check for the stop signal.
+			select {
+			case <-s.im.stop:
+				s.stopped = true
+				close(s.subQueue)
+				s.log.Println("stop request received")
+				return nil
+			default:
+			}
+
+			lastID = rs.ID
+
+			status := ""
+			for _, l := range rs.Lists {
+				if l.ID == r.opt.ListID {
+					status = l.SubscriptionStatus
+					break
+				}
+			}
+
+			if rs.Status == models.SubscriberStatusBlockListed {
+				s.im.skipRow(rs.ID, "blocklisted")
+				continue
+			}
+			if status == "" || status == models.SubscriptionStatusUnsubscribed {
+				s.im.skipRow(rs.ID, "unsubscribed")
+				continue
+			}
+
+			sub, err := s.im.ValidateFields(SubReq{Subscriber: models.Subscriber{Email: rs.Email, Name: rs.Name}})
+			if err != nil {
+				s.log.Printf("skipping subscriber %d: %s: %v", rs.ID, rs.Email, err)
+				s.im.errorRow(rs.ID, err.Error())
+				continue
+			}
+
+			if len(rs.Attribs) > 0 {
+				if err := s.validateAttribs(rs.Attribs); err != nil {
+					s.log.Printf("skipping subscriber %d: %s: attributes do not match the schema: %v", rs.ID, rs.Email, err)
+					s.im.errorRow(rs.ID, fmt.Sprintf("attributes do not match the schema: %v", err))
+					continue
+				}
+				sub.Attribs = rs.Attribs
+			}
+
+			// Send the subscriber to the queue.
+			sub.line = rs.ID
+			sub.subStatus = status
+			s.subQueue <- sub
+		}
+
+		if len(res.Results) < remotePerPage {
+			break
+		}
+	}
+
+	close(s.subQueue)
+	return nil
+}
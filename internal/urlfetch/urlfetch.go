@@ -0,0 +1,97 @@
+// Package urlfetch provides an HTTP client for fetching user supplied URLs that
+// refuses to connect to loopback, private, link-local, and other non-public
+// addresses so that it can't be used to make requests to internal services.
+package urlfetch
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// Max number of redirects that are followed.
+const maxRedirects = 5
+
+// Non-public networks that aren't covered by the net.IP checks.
+var blockedNets = func() []*net.IPNet {
+	var out []*net.IPNet
+	for _, s := range []string{
+		"0.0.0.0/8",     // "This" network.
+		"100.64.0.0/10", // Carrier-grade NAT.
+		"192.0.0.0/24",  // IETF protocol assignments.
+		"198.18.0.0/15", // Benchmarking.
+		"240.0.0.0/4",   // Reserved.
+		"64:ff9b::/96",  // NAT64, which can map to private IPv4 addresses.
+	} {
+		_, n, _ := net.ParseCIDR(s)
+		out = append(out, n)
+	}
+	return out
+}()
+
+// NewClient returns an HTTP client that only connects to public addresses. URLs are
+// fetched directly, and not via any configured proxy, so that the addresses that are
+// dialed can be checked.
+func NewClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout: timeout,
+				Control: checkAddr,
+			}).DialContext,
+			TLSHandshakeTimeout: time.Second * 10,
+			MaxIdleConns:        10,
+			IdleConnTimeout:     time.Second * 90,
+		},
+		CheckRedirect: checkRedirect,
+	}
+}
+
+// IsPublicIP returns true if an IP is a public unicast address.
+func IsPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsMulticast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// checkAddr is the dialer's Control func that runs on the resolved address that's
+// about to be connected to, and hence, it also covers hostnames that resolve to
+// non-public addresses and redirects to them.
+func checkAddr(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || !IsPublicIP(ip) {
+		return fmt.Errorf("connecting to the address %s is not allowed", host)
+	}
+
+	return nil
+}
+
+// checkRedirect allows a limited number of redirects to http(s) URLs.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxRedirects {
+		return errors.New("too many redirects")
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return errors.New("invalid redirect URL. Only http(s) URLs are allowed")
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package urlfetch
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	cases := []struct {
+		ip  string
+		exp bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::1", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"224.0.0.1", false},
+	}
+
+	for _, c := range cases {
+		if got := IsPublicIP(net.ParseIP(c.ip)); got != c.exp {
+			t.Errorf("%s: expected %v, got %v", c.ip, c.exp, got)
+		}
+	}
+}
+
+func TestClientBlocksPrivate(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secret"))
+	}))
+	defer srv.Close()
+
+	c := NewClient(time.Second * 5)
+
+	// The test server listens on loopback, which the client mustn't connect to.
+	if _, err := c.Get(srv.URL); err == nil {
+		t.Fatal("expected fetching from a loopback address to fail")
+	}
+
+	u, _ := url.Parse(srv.URL)
+	_, port, _ := net.SplitHostPort(u.Host)
+	if _, err := c.Get("http://localhost:" + port); err == nil {
+		t.Fatal("expected fetching from a hostname that resolves to loopback to fail")
+	}
+}
+
+func TestCheckRedirect(t *testing.T) {
+	req := func(u string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, u, nil)
+		return r
+	}
+
+	if err := checkRedirect(req("https://site.com/file.pdf"), []*http.Request{req("https://site.com")}); err != nil {
+		t.Errorf("expected an https redirect to be allowed, got %v", err)
+	}
+	if err := checkRedirect(req("file:///etc/passwd"), []*http.Request{req("https://site.com")}); err == nil {
+		t.Error("expected a redirect to a file URL to fail")
+	}
+
+	via := make([]*http.Request, maxRedirects)
+	for i := range via {
+		via[i] = req("https://site.com")
+	}
+	if err := checkRedirect(req("https://site.com/file.pdf"), via); err == nil {
+		t.Error("expected too many redirects to fail")
+	}
+}
@@ -0,0 +1,228 @@
+// Package webhook delivers signed JSON event notifications (eg: subscriber.created)
+// to the outbound webhook endpoints registered in listmonk. Failed deliveries are
+// retried with exponential backoff and the ones that fail permanently are handed to
+// the store to be recorded.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	// HeaderSignature is the header that carries the hex encoded HMAC-SHA256
+	// signature of the request body signed with the webhook's secret.
+	HeaderSignature = "X-Listmonk-Signature"
+	HeaderEvent     = "X-Listmonk-Event"
+)
+
+// Opt represents the webhook delivery options.
+type Opt struct {
+	// Number of concurrent delivery workers.
+	Workers int
+
+	// Max number of delivery attempts after which a delivery is recorded as failed.
+	MaxAttempts int
+
+	// Delay before the first retry. It's doubled after every attempt.
+	Backoff time.Duration
+
+	// HTTP request timeout.
+	Timeout time.Duration
+
+	// Max number of deliveries that can be queued.
+	QueueSize int
+}
+
+// Store represents the functions required to record permanently failed deliveries.
+type Store interface {
+	RecordWebhookFailure(f models.WebhookFailure) error
+}
+
+// Payload is the JSON body posted to webhook endpoints.
+type Payload struct {
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// Manager dispatches events to the webhooks subscribed to them.
+type Manager struct {
+	opt   Opt
+	store Store
+	log   *log.Logger
+
+	hooks []models.Webhook
+	mut   sync.RWMutex
+
+	queue  chan delivery
+	client *http.Client
+}
+
+type delivery struct {
+	hook    models.Webhook
+	event   string
+	body    []byte
+	attempt int
+}
+
+// New returns a new instance of the webhook manager.
+func New(opt Opt, s Store, l *log.Logger) *Manager {
+	if opt.Workers < 1 {
+		opt.Workers = 2
+	}
+	if opt.MaxAttempts < 1 {
+		opt.MaxAttempts = 5
+	}
+	if opt.Backoff < time.Second {
+		opt.Backoff = time.Second * 2
+	}
+	if opt.Timeout < time.Second {
+		opt.Timeout = time.Second * 10
+	}
+	if opt.QueueSize < 1 {
+		opt.QueueSize = 5000
+	}
+
+	return &Manager{
+		opt:    opt,
+		store:  s,
+		log:    l,
+		queue:  make(chan delivery, opt.QueueSize),
+		client: &http.Client{Timeout: opt.Timeout},
+	}
+}
+
+// Load replaces the webhooks that events are dispatched to.
+func (m *Manager) Load(hooks []models.Webhook) {
+	m.mut.Lock()
+	m.hooks = hooks
+	m.mut.Unlock()
+}
+
+// Run starts the delivery workers.
+func (m *Manager) Run() {
+	for i := 0; i < m.opt.Workers; i++ {
+		go m.worker()
+	}
+}
+
+// Emit queues the event for delivery to all the enabled webhooks that are
+// subscribed to it, and to the enabled webhooks of the optional hookIDs
+// irrespective of their subscriptions. It doesn't block, and if the queue
+// is full, the event is dropped.
+func (m *Manager) Emit(event string, data interface{}, hookIDs ...int) {
+	m.mut.RLock()
+	var hooks []models.Webhook
+	for _, h := range m.hooks {
+		if !h.Enabled {
+			continue
+		}
+
+		ok := h.HasEvent(event)
+		for _, id := range hookIDs {
+			if id == h.ID {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			hooks = append(hooks, h)
+		}
+	}
+	m.mut.RUnlock()
+
+	if len(hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(Payload{Event: event, Timestamp: time.Now(), Data: data})
+	if err != nil {
+		m.log.Printf("error marshalling webhook event %s: %v", event, err)
+		return
+	}
+
+	for _, h := range hooks {
+		m.push(delivery{hook: h, event: event, body: body, attempt: 1})
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of the body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *Manager) push(d delivery) {
+	select {
+	case m.queue <- d:
+	default:
+		m.log.Printf("webhook queue is full. dropping %s event for webhook %d", d.event, d.hook.ID)
+	}
+}
+
+func (m *Manager) worker() {
+	for d := range m.queue {
+		err := m.send(d)
+		if err == nil {
+			continue
+		}
+
+		// Retry with exponential backoff.
+		if d.attempt < m.opt.MaxAttempts {
+			wait := m.opt.Backoff * time.Duration(1<<(d.attempt-1))
+			d.attempt++
+			time.AfterFunc(wait, func() { m.push(d) })
+			continue
+		}
+
+		m.log.Printf("webhook %d (%s) failed after %d attempts: %v", d.hook.ID, d.event, d.attempt, err)
+		if err := m.store.RecordWebhookFailure(models.WebhookFailure{
+			WebhookID: d.hook.ID,
+			Event:     d.event,
+			Payload:   json.RawMessage(d.body),
+			Error:     err.Error(),
+			Attempts:  d.attempt,
+		}); err != nil {
+			m.log.Printf("error recording webhook failure: %v", err)
+		}
+	}
+}
+
+// send posts a delivery to the webhook's endpoint. Non 2xx responses are errors.
+func (m *Manager) send(d delivery) error {
+	req, err := http.NewRequest(http.MethodPost, d.hook.URL, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "listmonk")
+	req.Header.Set(HeaderEvent, d.event)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(d.hook.Secret, d.body))
+
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("non 2xx response: %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -7,19 +7,25 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"net/mail"
 	"net/textproto"
 	"regexp"
 	"strings"
+	"sync"
 	txttpl "text/template"
+	"text/template/parse"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
 	"github.com/lib/pq"
 	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/extension"
+	extast "github.com/yuin/goldmark/extension/ast"
 	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/text"
 	null "gopkg.in/volatiletech/null.v6"
 )
 
@@ -42,6 +48,7 @@ const (
 	CampaignStatusPaused        = "paused"
 	CampaignStatusFinished      = "finished"
 	CampaignStatusCancelled     = "cancelled"
+	MaxCampaignPriority         = 10
 	CampaignTypeRegular         = "regular"
 	CampaignTypeOptin           = "optin"
 	CampaignContentTypeRichtext = "richtext"
@@ -49,6 +56,12 @@ const (
 	CampaignContentTypeMarkdown = "markdown"
 	CampaignContentTypePlain    = "plain"
 
+	// Campaign approval.
+	CampaignApprovalNone     = "none"
+	CampaignApprovalPending  = "pending"
+	CampaignApprovalApproved = "approved"
+	CampaignApprovalRejected = "rejected"
+
 	// List.
 	ListTypePrivate = "private"
 	ListTypePublic  = "public"
@@ -70,6 +83,7 @@ const (
 	// Headers attached to e-mails for bounce tracking.
 	EmailHeaderSubscriberUUID = "X-Listmonk-Subscriber"
 	EmailHeaderCampaignUUID   = "X-Listmonk-Campaign"
+	EmailHeaderTest           = "X-Listmonk-Test"
 
 	// Standard e-mail headers.
 	EmailHeaderDate        = "Date"
@@ -83,15 +97,100 @@ const (
 	BounceTypeSoft      = "soft"
 	BounceTypeComplaint = "complaint"
 
+	// Bounce rule actions.
+	BounceRuleActionBlocklist = "blocklist"
+	BounceRuleActionRemove    = "remove"
+
+	// Outbound webhook events.
+	EventSubscriberCreated      = "subscriber.created"
+	EventSubscriberConfirmed    = "subscriber.confirmed"
+	EventSubscriberUnsubscribed = "subscriber.unsubscribed"
+	EventSubscriberBounced      = "subscriber.bounced"
+	EventCampaignSent           = "campaign.sent"
+	EventCampaignEnded          = "campaign.ended"
+
+	// Campaign end notification statuses.
+	CampaignEndCompleted = "completed"
+	CampaignEndCancelled = "cancelled"
+
+	// Transactional message delivery statuses.
+	TxStatusQueued = "queued"
+	TxStatusSent   = "sent"
+	TxStatusFailed = "failed"
+
 	// Templates.
 	TemplateTypeCampaign = "campaign"
 	TemplateTypeTx       = "tx"
+	TemplateTypePartial  = "partial"
+
+	// PartialTplPrefix is the prefix with which partials are referenced in
+	// other templates, eg: {{ template "partials/header" . }}
+	PartialTplPrefix = "partials/"
+
+	// Campaign deliverability diagnostic checks.
+	DiagCheckSPF         = "spf"
+	DiagCheckDKIM        = "dkim"
+	DiagCheckDMARC       = "dmarc"
+	DiagCheckSpamWords   = "spam_words"
+	DiagCheckLinks       = "links"
+	DiagCheckImages      = "images"
+	DiagCheckUnsubscribe = "unsubscribe"
+
+	// Diagnostic check results.
+	DiagStatusPass    = "pass"
+	DiagStatusWarn    = "warn"
+	DiagStatusFail    = "fail"
+	DiagStatusSkipped = "skipped"
+
+	// Subscriber activity event types.
+	ActivityCreated      = "created"
+	ActivityUpdated      = "updated"
+	ActivitySubscribed   = "subscribed"
+	ActivityUnsubscribed = "unsubscribed"
+	ActivityReceived     = "received"
+	ActivityView         = "view"
+	ActivityClick        = "click"
+	ActivityBounce       = "bounce"
+
+	// Subscriber attribute field types.
+	AttribFieldString = "string"
+	AttribFieldNumber = "number"
+	AttribFieldDate   = "date"
+	AttribFieldBool   = "bool"
+	AttribFieldEnum   = "enum"
 )
 
+// AttribFieldTypes is the list of subscriber attribute field types.
+var AttribFieldTypes = []string{AttribFieldString, AttribFieldNumber, AttribFieldDate, AttribFieldBool, AttribFieldEnum}
+
+// DiagChecks is the list of campaign deliverability diagnostic checks in the order they're run.
+var DiagChecks = []string{DiagCheckSPF, DiagCheckDKIM, DiagCheckDMARC, DiagCheckSpamWords,
+	DiagCheckLinks, DiagCheckImages, DiagCheckUnsubscribe}
+
+// ActivityTypes is the list of subscriber activity event types.
+var ActivityTypes = []string{ActivityCreated, ActivityUpdated, ActivitySubscribed, ActivityUnsubscribed,
+	ActivityReceived, ActivityView, ActivityClick, ActivityBounce}
+
 // Headers represents an array of string maps used to represent SMTP, HTTP headers etc.
 // similar to url.Values{}
 type Headers []map[string]string
 
+// ProtectedHeaders are message headers that are set by listmonk and can't be
+// overridden by custom campaign and transactional message headers unless allowed.
+var ProtectedHeaders = map[string]bool{
+	"To":                        true,
+	"From":                      true,
+	"Subject":                   true,
+	"Date":                      true,
+	"Message-Id":                true,
+	"Mime-Version":              true,
+	"Content-Type":              true,
+	"Content-Transfer-Encoding": true,
+	EmailHeaderCampaignUUID:     true,
+	EmailHeaderSubscriberUUID:   true,
+	EmailHeaderTest:             true,
+}
+
 // regTplFunc represents contains a regular expression for wrapping and
 // substituting a Go template function from the user's shorthand to a full
 // function call.
@@ -165,6 +264,11 @@ type Subscriber struct {
 	Attribs JSON           `db:"attribs" json:"attribs"`
 	Status  string         `db:"status" json:"status"`
 	Lists   types.JSONText `db:"lists" json:"lists"`
+
+	ArchivedAt null.Time `db:"archived_at" json:"archived_at"`
+
+	// 0-100 score computed from recent views and clicks.
+	EngagementScore float64 `db:"engagement_score" json:"engagement_score"`
 }
 type subLists struct {
 	SubscriberID int            `db:"subscriber_id"`
@@ -179,6 +283,52 @@ type Subscription struct {
 	Meta                  json.RawMessage `db:"meta" json:"meta"`
 }
 
+// Suppression is an e-mail on the global suppression list, which is blocklisted
+// whether or not it exists as a subscriber.
+type Suppression struct {
+	Email string `db:"email" json:"email"`
+
+	// Number of times a subscriber with the e-mail was blocklisted on insertion.
+	Blocked   int       `db:"blocked" json:"blocked"`
+	CreatedAt null.Time `db:"created_at" json:"created_at"`
+}
+
+// SuppressionStats represents the size of the global suppression list and the
+// number of subscriber insertions (subscriptions, imports) it has blocked.
+type SuppressionStats struct {
+	Total   int `db:"total" json:"total"`
+	Blocked int `db:"blocked" json:"blocked"`
+}
+
+// DomainRules are the rules that the domains of subscribers' e-mails are checked
+// against on subscription and on sending campaigns. Rules are exact domains
+// (example.com) or wildcards (*.example.com) that also match all subdomains.
+type DomainRules struct {
+	Blocklist []string `json:"blocklist"`
+
+	// If there are allow rules, only domains that match them are allowed.
+	Allowlist []string `json:"allowlist"`
+
+	// Block the built-in list of disposable e-mail domains.
+	BlockDisposable bool `json:"block_disposable"`
+}
+
+// SubscriberErasure represents the number of records removed or anonymized
+// on erasing a subscriber.
+type SubscriberErasure struct {
+	SubscriberID int `db:"-" json:"subscriber_id"`
+
+	// Deleted.
+	Subscriptions int `db:"subscriptions" json:"subscriptions_deleted"`
+	Bounces       int `db:"bounces" json:"bounces_deleted"`
+	BounceActions int `db:"bounce_actions" json:"bounce_actions_deleted"`
+
+	// Detached from the subscriber, retaining the aggregate stats.
+	CampaignViews int `db:"campaign_views" json:"campaign_views_anonymized"`
+	LinkClicks    int `db:"link_clicks" json:"link_clicks_anonymized"`
+	TxMessages    int `db:"tx_messages" json:"tx_messages_anonymized"`
+}
+
 // SubscriberExportProfile represents a subscriber's collated data in JSON for export.
 type SubscriberExportProfile struct {
 	Email         string          `db:"email" json:"-"`
@@ -206,6 +356,9 @@ type SubscriberExport struct {
 	Name    string `db:"name" json:"name"`
 	Attribs string `db:"attribs" json:"attribs"`
 	Status  string `db:"status" json:"status"`
+
+	// JSON array of list subscriptions with their statuses. Only in the full export format.
+	Lists json.RawMessage `db:"-" json:"lists,omitempty"`
 }
 
 // List represents a mailing list.
@@ -222,6 +375,31 @@ type List struct {
 	SubscriberCounts StringIntMap   `db:"subscriber_statuses" json:"subscriber_statuses"`
 	SubscriberID     int            `db:"subscriber_id" json:"-"`
 
+	// When the cached subscriber counts of the list were last computed.
+	SubscriberCountsUpdatedAt null.Time `db:"subscriber_counts_updated_at" json:"subscriber_counts_updated_at"`
+
+	// Optional override of the global per-subscriber rolling message cap.
+	MaxSubscriberMessages null.Int `db:"max_subscriber_messages" json:"max_subscriber_messages"`
+
+	// Optional default template for campaigns on the list that don't specify one.
+	TemplateID null.Int `db:"template_id" json:"template_id"`
+
+	// Archived lists are excluded from list pickers and public subscription forms.
+	Archived bool `db:"archived" json:"archived"`
+
+	// Optional parent list (group) that the list belongs to.
+	ParentID null.Int `db:"parent_id" json:"parent_id"`
+
+	// Whether views of campaigns sent to the list are tracked.
+	TrackViews bool `db:"track_views" json:"track_views"`
+
+	// Optional sending identity of single-list campaigns that don't have a from_email.
+	FromEmail string `db:"from_email" json:"from_email"`
+	FromName  string `db:"from_name" json:"from_name"`
+
+	// Optional language of the public pages and e-mails of the list's subscribers.
+	Language string `db:"language" json:"language"`
+
 	// This is only relevant when querying the lists of a subscriber.
 	SubscriptionStatus    string    `db:"subscription_status" json:"subscription_status,omitempty"`
 	SubscriptionCreatedAt null.Time `db:"subscription_created_at" json:"subscription_created_at,omitempty"`
@@ -232,6 +410,13 @@ type List struct {
 	Total int `db:"total" json:"-"`
 }
 
+// ListGroup represents a list with its child lists.
+type ListGroup struct {
+	List
+
+	Lists []List `json:"lists"`
+}
+
 // Campaign represents an e-mail campaign.
 type Campaign struct {
 	Base
@@ -244,6 +429,7 @@ type Campaign struct {
 	FromEmail         string          `db:"from_email" json:"from_email"`
 	Body              string          `db:"body" json:"body"`
 	AltBody           null.String     `db:"altbody" json:"altbody"`
+	BodyHTML          null.String     `db:"body_html" json:"body_html"`
 	SendAt            null.Time       `db:"send_at" json:"send_at"`
 	Status            string          `db:"status" json:"status"`
 	ContentType       string          `db:"content_type" json:"content_type"`
@@ -256,12 +442,90 @@ type Campaign struct {
 	ArchiveTemplateID int             `db:"archive_template_id" json:"archive_template_id"`
 	ArchiveMeta       json.RawMessage `db:"archive_meta" json:"archive_meta"`
 
+	// End of the A/B subject variant sample window, if the sample has been sent.
+	VariantSampleEndsAt null.Time `db:"variant_sample_ends_at" json:"variant_sample_ends_at"`
+
+	// Cron expression and state of a recurring campaign, and the recurring campaign
+	// a campaign was cloned from.
+	Recurrence         null.String `db:"recurrence" json:"recurrence"`
+	RecurrenceActive   bool        `db:"recurrence_active" json:"recurrence_active"`
+	RecurrenceNextAt   null.Time   `db:"recurrence_next_at" json:"recurrence_next_at"`
+	RecurrenceParentID null.Int    `db:"recurrence_parent_id" json:"recurrence_parent_id"`
+
+	// Optional saved segment that the subscribers are filtered by when sending.
+	SegmentID null.Int `db:"segment_id" json:"segment_id"`
+
+	// Optional list group whose lists are sent to in addition to the campaign's lists.
+	ListGroupID null.Int `db:"list_group_id" json:"list_group_id"`
+
+	// Send priority (0 - MaxCampaignPriority). On every turn, the manager fetches
+	// priority + 1 batches of subscribers of a campaign.
+	Priority int `db:"priority" json:"priority"`
+
+	// Whether the List-Unsubscribe headers are added to the campaign's messages.
+	// If it's not set, the global privacy.unsubscribe_header setting applies.
+	UnsubscribeHeader null.Bool `db:"unsubscribe_header" json:"unsubscribe_header"`
+
+	// Whether the CSS in the body's <style> blocks is inlined before sending.
+	// If it's not set, the global app.inline_css setting applies.
+	InlineCSS null.Bool `db:"inline_css" json:"inline_css"`
+
+	// Whether views are tracked. See CampaignMeta.ViewsTracked for the effective value.
+	TrackViews bool `db:"track_views" json:"track_views"`
+
+	// The sending identity of the campaign's list if it targets a single list.
+	// See From() for the effective From address.
+	ListFromEmail string `db:"list_from_email" json:"list_from_email"`
+	ListFromName  string `db:"list_from_name" json:"list_from_name"`
+
+	// Whether the campaign is a triggered run that's sent only to the recipients
+	// it was triggered with.
+	Triggered bool `db:"triggered" json:"triggered"`
+
+	// Optional e-mails and webhook that are notified when the campaign ends, in
+	// addition to the global notification e-mails and webhooks.
+	NotifyEmails    pq.StringArray `db:"notify_emails" json:"notify_emails"`
+	NotifyWebhookID null.Int       `db:"notify_webhook_id" json:"notify_webhook_id"`
+
+	// Optional lists whose subscribers, and campaigns whose recipients, are
+	// excluded from the campaign when it's sent.
+	ExcludeListIDs     pq.Int64Array `db:"exclude_list_ids" json:"exclude_list_ids"`
+	ExcludeCampaignIDs pq.Int64Array `db:"exclude_campaign_ids" json:"exclude_campaign_ids"`
+
+	// Whether a subscriber on multiple target lists is sent a copy per list.
+	// By default, every subscriber is sent a single message.
+	PerListCopies bool `db:"per_list_copies" json:"per_list_copies"`
+
+	// Optional preview text that e-mail clients show after the subject. It's
+	// inserted as hidden text at the top of the body and may have template expressions.
+	Preheader null.String `db:"preheader" json:"preheader"`
+
+	// Approval status of the campaign (none, pending, approved, rejected) and
+	// the reason given for the last rejection.
+	ApprovalStatus string `db:"approval_status" json:"approval_status"`
+	ApprovalReason string `db:"approval_reason" json:"approval_reason"`
+
+	// Revision of the campaign's content, incremented on every change. Updates
+	// carry the revision they're based on and are rejected if it's stale.
+	Revision int `db:"revision" json:"revision"`
+
+	// UTM params that are added to the campaign's tracked links.
+	UTM CampaignUTM `db:"utm" json:"utm"`
+
+	// Optional AMP for Email body that's sent as a text/x-amp-html alternative
+	// alongside the HTML and plain text bodies.
+	AMPBody null.String `db:"amp_body" json:"amp_body"`
+
+	CampaignSendWindow
+
 	// TemplateBody is joined in from templates by the next-campaigns query.
 	TemplateBody        string             `db:"template_body" json:"-"`
 	ArchiveTemplateBody string             `db:"archive_template_body" json:"-"`
 	Tpl                 *template.Template `json:"-"`
 	SubjectTpl          *txttpl.Template   `json:"-"`
+	PreheaderTpl        *txttpl.Template   `json:"-"`
 	AltBodyTpl          *template.Template `json:"-"`
+	AMPTpl              *template.Template `json:"-"`
 
 	// List of media (attachment) IDs obtained from the next-campaign query
 	// while sending a campaign.
@@ -274,6 +538,204 @@ type Campaign struct {
 	Total int `db:"total" json:"-"`
 }
 
+// CampaignEnd represents the final stats of a campaign that has finished
+// (completed) or has been cancelled, that are sent in end notifications.
+type CampaignEnd struct {
+	ID        int       `json:"id"`
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	Status    string    `json:"status"`
+	ToSend    int       `json:"to_send"`
+	Sent      int       `json:"sent"`
+	Failed    int       `json:"failed"`
+	StartedAt null.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+
+	// Duration since the campaign started, in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// CampaignSendWindow represents the window of hours, in a subscriber's local time zone,
+// during which a campaign's messages may be sent to the subscriber. The start hour is
+// inclusive and the end hour is exclusive. The window wraps around midnight if start > end.
+type CampaignSendWindow struct {
+	Start null.Int `db:"send_window_start" json:"send_window_start"`
+	End   null.Int `db:"send_window_end" json:"send_window_end"`
+}
+
+// IsSet returns true if the send window is set.
+func (w CampaignSendWindow) IsSet() bool {
+	return w.Start.Valid && w.End.Valid && w.Start.Int != w.End.Int
+}
+
+// Contains returns true if the given time falls within the send window in its location.
+func (w CampaignSendWindow) Contains(t time.Time) bool {
+	if !w.IsSet() {
+		return true
+	}
+
+	var (
+		h     = t.Hour()
+		start = int(w.Start.Int)
+		end   = int(w.End.Int)
+	)
+	if start < end {
+		return h >= start && h < end
+	}
+
+	return h >= start || h < end
+}
+
+// Next returns the earliest time at or after t, in its location, that falls within
+// the send window, that is, t itself or the start of the window's next slot.
+func (w CampaignSendWindow) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+
+	next := time.Date(t.Year(), t.Month(), t.Day(), int(w.Start.Int), 0, 0, 0, t.Location())
+	if !next.After(t) {
+		next = time.Date(t.Year(), t.Month(), t.Day()+1, int(w.Start.Int), 0, 0, 0, t.Location())
+	}
+
+	return next
+}
+
+// SubscriberSendCount represents the number of campaign messages sent to a subscriber
+// in the rolling 24 hour window of the per-subscriber message cap.
+type SubscriberSendCount struct {
+	SubscriberID int       `db:"subscriber_id"`
+	Count        int       `db:"count"`
+	FirstAt      time.Time `db:"first_at"`
+}
+
+// CampaignDeferral represents the deferred messages of a campaign to a subscriber
+// that are retried at RetryAt.
+type CampaignDeferral struct {
+	SubscriberID int
+	Copies       int
+	RetryAt      time.Time
+}
+
+// CampaignVersion represents a snapshot of a campaign's content.
+type CampaignVersion struct {
+	ID          int64       `db:"id" json:"id"`
+	CampaignID  int         `db:"campaign_id" json:"campaign_id"`
+	Version     int         `db:"version" json:"version"`
+	Author      string      `db:"author" json:"author"`
+	Subject     string      `db:"subject" json:"subject"`
+	Body        string      `db:"body" json:"body"`
+	AltBody     null.String `db:"altbody" json:"altbody"`
+	ContentType string      `db:"content_type" json:"content_type"`
+	CreatedAt   null.Time   `db:"created_at" json:"created_at"`
+}
+
+// CampaignUTM represents the UTM params that are added to the tracked links of a
+// campaign. The values may have template expressions, eg: {{ .Campaign.Name }}.
+type CampaignUTM struct {
+	Source   string `json:"source"`
+	Medium   string `json:"medium"`
+	Campaign string `json:"campaign"`
+	Content  string `json:"content"`
+}
+
+// WithDefaults returns the UTM params with the empty ones set to the defaults.
+func (u CampaignUTM) WithDefaults(d CampaignUTM) CampaignUTM {
+	if u.Source == "" {
+		u.Source = d.Source
+	}
+	if u.Medium == "" {
+		u.Medium = d.Medium
+	}
+	if u.Campaign == "" {
+		u.Campaign = d.Campaign
+	}
+	if u.Content == "" {
+		u.Content = d.Content
+	}
+	return u
+}
+
+// Params returns the non-empty UTM params as query param name and value pairs.
+func (u CampaignUTM) Params() [][2]string {
+	var out [][2]string
+	for _, p := range [][2]string{
+		{"utm_source", u.Source},
+		{"utm_medium", u.Medium},
+		{"utm_campaign", u.Campaign},
+		{"utm_content", u.Content},
+	} {
+		if p[1] != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Compile returns the non-empty UTM params with the values that have
+// template expressions compiled.
+func (u CampaignUTM) Compile(f template.FuncMap) ([]UTMParamTpl, error) {
+	var out []UTMParamTpl
+	for _, p := range u.Params() {
+		tpl, err := compileText(p[1], p[0], f)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, UTMParamTpl{Name: p[0], Value: p[1], Tpl: tpl})
+	}
+	return out, nil
+}
+
+// UTMParamTpl is a compiled UTM param. If the value is a template, Tpl is set.
+type UTMParamTpl struct {
+	Name  string
+	Value string
+	Tpl   *txttpl.Template
+}
+
+// Scan implements the sql.Scanner interface.
+func (u *CampaignUTM) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, u)
+	case string:
+		return json.Unmarshal([]byte(src), u)
+	case nil:
+		return nil
+	}
+	return fmt.Errorf("could not not decode type %T -> %T", src, u)
+}
+
+// Value implements the driver.Valuer interface.
+func (u CampaignUTM) Value() (driver.Value, error) {
+	return json.Marshal(u)
+}
+
+// CampaignApproval represents an entry in a campaign's approval audit log.
+type CampaignApproval struct {
+	ID         int64     `db:"id" json:"id"`
+	CampaignID int       `db:"campaign_id" json:"campaign_id"`
+	Status     string    `db:"status" json:"status"`
+	Actor      string    `db:"actor" json:"actor"`
+	Reason     string    `db:"reason" json:"reason"`
+	CreatedAt  null.Time `db:"created_at" json:"created_at"`
+}
+
+// CampaignVariant represents an A/B test subject line variant of a campaign.
+type CampaignVariant struct {
+	Base
+
+	CampaignID int    `db:"campaign_id" json:"campaign_id"`
+	Subject    string `db:"subject" json:"subject"`
+	Weight     int    `db:"weight" json:"weight"`
+	Winner     bool   `db:"winner" json:"winner"`
+	Sent       int    `db:"sent" json:"sent"`
+	Views      int    `db:"views" json:"views"`
+	Clicks     int    `db:"clicks" json:"clicks"`
+
+	SubjectTpl *txttpl.Template `db:"-" json:"-"`
+}
+
 // CampaignMeta contains fields tracking a campaign's progress.
 type CampaignMeta struct {
 	CampaignID int `db:"campaign_id" json:"-"`
@@ -281,6 +743,10 @@ type CampaignMeta struct {
 	Clicks     int `db:"clicks" json:"clicks"`
 	Bounces    int `db:"bounces" json:"bounces"`
 
+	// Whether views are effectively tracked, that is, tracking is enabled globally,
+	// on the campaign, and on all of its lists. If it's not, Views is meaningless.
+	ViewsTracked bool `db:"views_tracked" json:"views_tracked"`
+
 	// This is a list of {list_id, name} pairs unlike Subscriber.Lists[]
 	// because lists can be deleted after a campaign is finished, resulting
 	// in null lists data to be returned. For that reason, campaign_lists maintains
@@ -294,6 +760,23 @@ type CampaignMeta struct {
 	Sent      int       `db:"sent" json:"sent"`
 }
 
+// DiagnosticReport is the result of the pre-send deliverability checks of a campaign.
+type DiagnosticReport struct {
+	CampaignID int `json:"campaign_id"`
+
+	// The worst status among the checks that were run.
+	Status string            `json:"status"`
+	Checks []DiagnosticCheck `json:"checks"`
+}
+
+// DiagnosticCheck is the result of a single deliverability check.
+type DiagnosticCheck struct {
+	Name    string   `json:"name"`
+	Status  string   `json:"status"`
+	Message string   `json:"message"`
+	Details []string `json:"details"`
+}
+
 type CampaignStats struct {
 	ID        int       `db:"id" json:"id"`
 	Status    string    `db:"status" json:"status"`
@@ -311,6 +794,26 @@ type CampaignAnalyticsCount struct {
 	Timestamp  time.Time `db:"timestamp" json:"timestamp"`
 }
 
+// AnalyticsPoint is a single bucket in a campaign analytics time series.
+type AnalyticsPoint struct {
+	Timestamp time.Time `db:"timestamp" json:"timestamp"`
+	Count     int       `db:"count" json:"count"`
+}
+
+// LinkStat represents the click stats of a tracked URL in a campaign.
+type LinkStat struct {
+	UUID         string `db:"uuid" json:"uuid"`
+	URL          string `db:"url" json:"url"`
+	Clicks       int    `db:"clicks" json:"clicks"`
+	UniqueClicks int    `db:"unique_clicks" json:"unique_clicks"`
+}
+
+// BounceTypeCount represents the number of bounces of a bounce type.
+type BounceTypeCount struct {
+	Type  string `db:"type" json:"type"`
+	Count int    `db:"count" json:"count"`
+}
+
 type CampaignAnalyticsLink struct {
 	URL   string `db:"url" json:"url"`
 	Count int    `db:"count" json:"count"`
@@ -335,6 +838,21 @@ type Template struct {
 	Tpl        *template.Template `json:"-"`
 }
 
+// TemplateVar describes a variable or function that's available in campaign
+// templates, eg: for autocompletion in editors.
+type TemplateVar struct {
+	// Name of the variable, eg: Subscriber.Name.
+	Name string `json:"name"`
+
+	// Template expression that inserts the variable, eg: {{ .Subscriber.Name }}.
+	Expr string `json:"expr"`
+
+	// subscriber, campaign, attrib, or func.
+	Group       string `json:"group"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
 // Bounce represents a single bounce event.
 type Bounce struct {
 	ID        int             `db:"id" json:"id"`
@@ -356,6 +874,165 @@ type Bounce struct {
 	Total int `db:"total" json:"-"`
 }
 
+// ActivityEvent represents a single event in a subscriber's activity timeline.
+type ActivityEvent struct {
+	Type      string    `db:"type" json:"type"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+
+	// The campaign (received, view, click, bounce) or the list (subscribed,
+	// unsubscribed) of the event, if any.
+	CampaignID   null.Int    `db:"campaign_id" json:"campaign_id"`
+	CampaignName null.String `db:"campaign_name" json:"campaign_name"`
+	ListID       null.Int    `db:"list_id" json:"list_id"`
+	ListName     null.String `db:"list_name" json:"list_name"`
+
+	// Event specific details, eg: the URL of a click or the type of a bounce.
+	Meta json.RawMessage `db:"meta" json:"meta"`
+
+	// Pseudofield for getting the total number of events
+	// in searches and queries.
+	Total int `db:"total" json:"-"`
+}
+
+// BounceRule represents a rule that acts on subscribers who have bounced Count
+// times with bounces of Type within the Window duration.
+type BounceRule struct {
+	Type   string `json:"type"`
+	Count  int    `json:"count"`
+	Window string `json:"window"`
+	Action string `json:"action"`
+}
+
+// WebhookEvents is the list of events that webhooks can subscribe to.
+var WebhookEvents = []string{
+	EventSubscriberCreated,
+	EventSubscriberConfirmed,
+	EventSubscriberUnsubscribed,
+	EventSubscriberBounced,
+	EventCampaignSent,
+	EventCampaignEnded,
+}
+
+// AttribField represents the definition of a typed subscriber attribute, which
+// subscriber attributes are validated against. Attributes without definitions are freeform.
+type AttribField struct {
+	Base
+
+	Name     string `db:"name" json:"name"`
+	Type     string `db:"type" json:"type"`
+	Label    string `db:"label" json:"label"`
+	Required bool   `db:"required" json:"required"`
+
+	// Allowed values of enum fields.
+	Options pq.StringArray `db:"options" json:"options"`
+
+	// Optional value that's set when the attribute is absent. JSON null if there's none.
+	Default types.JSONText `db:"default_value" json:"default"`
+}
+
+// Operators of attribute filters in structured subscriber searches.
+const (
+	// Attribute equals, or doesn't equal, the value, which can be a string, number,
+	// bool, or null. Compared as JSON, so "1" doesn't equal 1. Absent attributes
+	// don't equal any value.
+	AttribOpEq  = "eq"
+	AttribOpNeq = "neq"
+
+	// Attribute is a number greater than, greater than or equal to, less than,
+	// or less than or equal to the value, which should be a number. Attributes
+	// that aren't numbers don't match.
+	AttribOpGt  = "gt"
+	AttribOpGte = "gte"
+	AttribOpLt  = "lt"
+	AttribOpLte = "lte"
+
+	// Attribute contains the value, which should be a string, case insensitively.
+	// Non-string attributes are matched by their JSON text, eg: true.
+	AttribOpContains = "contains"
+
+	// Attribute is, or isn't, present. There's no value.
+	AttribOpExists    = "exists"
+	AttribOpNotExists = "not_exists"
+)
+
+// SubscriberSearch represents a structured subscriber search that's safe to expose
+// in place of arbitrary SQL expressions. Filters that are set are combined with AND.
+type SubscriberSearch struct {
+	// Case insensitive substrings of the e-mail and name.
+	Email string `json:"email"`
+	Name  string `json:"name"`
+
+	// Subscribers who are on any of the lists, optionally with the given
+	// subscription status (unconfirmed, confirmed, unsubscribed).
+	ListIDs            []int  `json:"list_ids"`
+	SubscriptionStatus string `json:"subscription_status"`
+
+	// Subscriber status: enabled, disabled, or blocklisted.
+	Status string `json:"status"`
+
+	Attribs []AttribFilter `json:"attribs"`
+
+	// Subscribers created on or after CreatedFrom and before CreatedTo.
+	CreatedFrom null.Time `json:"created_from"`
+	CreatedTo   null.Time `json:"created_to"`
+}
+
+// AttribFilter is a comparison of a subscriber attribute in a SubscriberSearch.
+type AttribFilter struct {
+	// Attribute key. Nested keys are separated by dots, eg: location.city.
+	Key string `json:"key"`
+
+	// One of the AttribOp* operators.
+	Op    string      `json:"op"`
+	Value interface{} `json:"value"`
+}
+
+// Segment represents a saved subscriber query that campaigns can target.
+type Segment struct {
+	Base
+
+	Name  string `db:"name" json:"name"`
+	Query string `db:"query" json:"query"`
+
+	// Optional lists that the subscribers matching the query have to be on.
+	ListIDs pq.Int64Array `db:"list_ids" json:"list_ids"`
+}
+
+// Webhook represents an outbound webhook endpoint that events are posted to.
+type Webhook struct {
+	ID        int            `db:"id" json:"id"`
+	Name      string         `db:"name" json:"name"`
+	URL       string         `db:"url" json:"url"`
+	Secret    string         `db:"secret" json:"secret,omitempty"`
+	Events    pq.StringArray `db:"events" json:"events"`
+	Enabled   bool           `db:"enabled" json:"enabled"`
+	CreatedAt null.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt null.Time      `db:"updated_at" json:"updated_at"`
+}
+
+// WebhookFailure represents a webhook delivery that failed after all retries.
+type WebhookFailure struct {
+	ID        int64           `db:"id" json:"id"`
+	WebhookID int             `db:"webhook_id" json:"webhook_id"`
+	Event     string          `db:"event" json:"event"`
+	Payload   json.RawMessage `db:"payload" json:"payload"`
+	Error     string          `db:"error" json:"error"`
+	Attempts  int             `db:"attempts" json:"attempts"`
+	CreatedAt null.Time       `db:"created_at" json:"created_at"`
+
+	Total int `db:"total" json:"-"`
+}
+
+// HasEvent checks if the webhook is subscribed to the given event.
+func (w Webhook) HasEvent(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
 // Message is the message pushed to a Messenger.
 type Message struct {
 	From        string
@@ -364,6 +1041,7 @@ type Message struct {
 	ContentType string
 	Body        []byte
 	AltBody     []byte
+	AMPBody     []byte
 	Headers     textproto.MIMEHeader
 	Attachments []Attachment
 
@@ -374,6 +1052,9 @@ type Message struct {
 
 	// Messenger is the messenger backend to use: email|postback.
 	Messenger string
+
+	// UUID of the queued transactional message whose delivery status is tracked, if any.
+	TxUUID string
 }
 
 // Attachment represents a file or blob attachment that can be
@@ -400,7 +1081,10 @@ type TxMessage struct {
 	ContentType string                 `json:"content_type"`
 	Messenger   string                 `json:"messenger"`
 
-	// File attachments added from multi-part form data.
+	// Attachments referenced by URL or media ID, or base64 encoded inline.
+	AttachmentRefs []TxAttachment `json:"attachments"`
+
+	// File attachments added from multi-part form data and AttachmentRefs.
 	Attachments []Attachment `json:"-"`
 
 	Subject    string             `json:"-"`
@@ -409,14 +1093,86 @@ type TxMessage struct {
 	SubjectTpl *txttpl.Template   `json:"-"`
 }
 
-// markdown is a global instance of Markdown parser and renderer.
+// TxBatch represents a tx message sent to multiple recipients with their own
+// template data and attachments.
+type TxBatch struct {
+	TemplateID  int           `json:"template_id"`
+	FromEmail   string        `json:"from_email"`
+	Headers     Headers       `json:"headers"`
+	ContentType string        `json:"content_type"`
+	Messenger   string        `json:"messenger"`
+	Recipients  []TxRecipient `json:"recipients"`
+}
+
+// TxRecipient is a recipient in a tx batch. Data is available in the template as {{ .Tx.Data }}.
+type TxRecipient struct {
+	SubscriberEmail string                 `json:"subscriber_email"`
+	Data            map[string]interface{} `json:"data"`
+	Attachments     []TxAttachment         `json:"attachments"`
+
+	// Attachments decoded from Attachments.
+	Files []Attachment `json:"-"`
+}
+
+// TxAttachment is a file attachment in a JSON tx request. The file is either
+// base64 encoded in Content, or is fetched from URL or the media library (MediaID).
+type TxAttachment struct {
+	Name        string `json:"name"`
+	ContentType string `json:"content_type"`
+	Content     []byte `json:"content"`
+	URL         string `json:"url"`
+	MediaID     int    `json:"media_id"`
+}
+
+// TxBatchResult is the result of sending a tx batch message to a recipient.
+type TxBatchResult struct {
+	SubscriberEmail string `json:"subscriber_email"`
+	Success         bool   `json:"success"`
+	MessageID       string `json:"message_id,omitempty"`
+	Error           string `json:"error,omitempty"`
+}
+
+// TxMessageStatus represents the delivery status of a transactional message
+// sent in the queued mode.
+type TxMessageStatus struct {
+	ID           int64     `db:"id" json:"-"`
+	UUID         string    `db:"uuid" json:"uuid"`
+	SubscriberID null.Int  `db:"subscriber_id" json:"subscriber_id"`
+	TemplateID   null.Int  `db:"template_id" json:"template_id"`
+	Subject      string    `db:"subject" json:"subject"`
+	Status       string    `db:"status" json:"status"`
+	Attempts     int       `db:"attempts" json:"attempts"`
+	Error        string    `db:"error" json:"error"`
+	CreatedAt    null.Time `db:"created_at" json:"created_at"`
+	UpdatedAt    null.Time `db:"updated_at" json:"updated_at"`
+}
+
+// QueuedTxMessage is a queued transactional message that's stored for retrying.
+type QueuedTxMessage struct {
+	UUID     string
+	Attempts int
+	Message  Message
+}
+
+// TxIdempotencyKey represents the stored response of a transactional API
+// request made with an idempotency key.
+type TxIdempotencyKey struct {
+	Scope       string    `db:"scope"`
+	Key         string    `db:"key"`
+	RequestHash string    `db:"request_hash"`
+	Status      int       `db:"status"`
+	Response    []byte    `db:"response"`
+	CreatedAt   null.Time `db:"created_at"`
+}
+
+// markdown is a global instance of Markdown parser and renderer. Raw HTML
+// and links with unsafe protocols (eg: javascript:) are not rendered.
 var markdown = goldmark.New(
 	goldmark.WithParserOptions(
 		parser.WithAutoHeadingID(),
 	),
 	goldmark.WithRendererOptions(
 		html.WithXHTML(),
-		html.WithUnsafe(),
 	),
 	goldmark.WithExtensions(
 		extension.Table,
@@ -521,6 +1277,7 @@ func (camps Campaigns) LoadStats(stmt *sqlx.Stmt) error {
 			camps[i].Views = c.Views
 			camps[i].Clicks = c.Clicks
 			camps[i].Bounces = c.Bounces
+			camps[i].ViewsTracked = c.ViewsTracked
 			camps[i].Media = c.Media
 		}
 	}
@@ -528,23 +1285,98 @@ func (camps Campaigns) LoadStats(stmt *sqlx.Stmt) error {
 	return nil
 }
 
+// From returns the effective From address of the campaign, which is its own
+// from_email, or in its absence, the sending identity of its list if it targets
+// a single list, or in the absence of that, the given global default.
+func (c *Campaign) From(global string) string {
+	if c.FromEmail != "" {
+		return c.FromEmail
+	}
+
+	if c.ListFromEmail != "" {
+		if c.ListFromName == "" {
+			return c.ListFromEmail
+		}
+		return (&mail.Address{Name: c.ListFromName, Address: c.ListFromEmail}).String()
+	}
+
+	return global
+}
+
+// ValidValue returns true if the given (JSON decoded) attribute value is
+// of the field's type.
+func (f AttribField) ValidValue(v interface{}) bool {
+	switch f.Type {
+	case AttribFieldString:
+		_, ok := v.(string)
+		return ok
+
+	case AttribFieldNumber:
+		switch v.(type) {
+		case float64, float32, int, int64, json.Number:
+			return true
+		}
+
+	case AttribFieldBool:
+		_, ok := v.(bool)
+		return ok
+
+	case AttribFieldDate:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		if _, err := time.Parse(time.RFC3339, s); err == nil {
+			return true
+		}
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+
+	case AttribFieldEnum:
+		s, ok := v.(string)
+		if !ok {
+			return false
+		}
+		for _, o := range f.Options {
+			if o == s {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// DefaultValue returns the decoded default value of the field, if it has one.
+func (f AttribField) DefaultValue() (interface{}, bool) {
+	if len(f.Default) == 0 {
+		return nil, false
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(f.Default, &v); err != nil || v == nil {
+		return nil, false
+	}
+
+	return v, true
+}
+
 // CompileTemplate compiles a campaign body template into its base
 // template and sets the resultant template to Campaign.Tpl.
 func (c *Campaign) CompileTemplate(f template.FuncMap) error {
 	// If the subject line has a template string, compile it.
-	if strings.Contains(c.Subject, "{{") {
-		subj := c.Subject
-		for _, r := range regTplFuncs {
-			subj = r.regExp.ReplaceAllString(subj, r.replace)
-		}
+	subjTpl, err := compileSubject(c.Subject, f)
+	if err != nil {
+		return err
+	}
+	c.SubjectTpl = subjTpl
 
-		var txtFuncs map[string]interface{} = f
-		subjTpl, err := txttpl.New(ContentTpl).Funcs(txtFuncs).Parse(subj)
-		if err != nil {
-			return fmt.Errorf("error compiling subject: %v", err)
-		}
-		c.SubjectTpl = subjTpl
+	// If the preheader has a template string, compile it.
+	preTpl, err := compileText(c.Preheader.String, "preheader", f)
+	if err != nil {
+		return err
 	}
+	c.PreheaderTpl = preTpl
 
 	// Compile the base template.
 	body := c.TemplateBody
@@ -557,12 +1389,20 @@ func (c *Campaign) CompileTemplate(f template.FuncMap) error {
 	}
 
 	// If the format is markdown, convert Markdown to HTML.
+	altBody := c.AltBody.String
 	if c.ContentType == CampaignContentTypeMarkdown {
-		var b bytes.Buffer
-		if err := markdown.Convert([]byte(c.Body), &b); err != nil {
+		b, err := MarkdownToHTML(c.Body)
+		if err != nil {
 			return err
 		}
-		body = b.String()
+		body = b
+
+		// Generate the plain text alt body from the Markdown source if there isn't one.
+		if altBody == "" {
+			if altBody, err = MarkdownToText(c.Body); err != nil {
+				return err
+			}
+		}
 	} else {
 		body = c.Body
 	}
@@ -581,10 +1421,16 @@ func (c *Campaign) CompileTemplate(f template.FuncMap) error {
 	if err != nil {
 		return fmt.Errorf("error inserting child template: %v", err)
 	}
+
+	// Add the partials referenced by the template and the body.
+	if err := addPartials(out, c.TemplateBody, body); err != nil {
+		return err
+	}
 	c.Tpl = out
 
-	if strings.Contains(c.AltBody.String, "{{") {
-		b := c.AltBody.String
+	// Generated alt bodies are always compiled as they may contain template expressions.
+	if strings.Contains(altBody, "{{") || altBody != c.AltBody.String {
+		b := altBody
 		for _, r := range regTplFuncs {
 			b = r.regExp.ReplaceAllString(b, r.replace)
 		}
@@ -595,9 +1441,94 @@ func (c *Campaign) CompileTemplate(f template.FuncMap) error {
 		c.AltBodyTpl = bTpl
 	}
 
+	// Compile the AMP body, if there's one.
+	if c.AMPBody.String != "" {
+		tpl, err := compileAMP(c.AMPBody.String, f)
+		if err != nil {
+			return err
+		}
+		c.AMPTpl = tpl
+	}
+
 	return nil
 }
 
+// compileAMP compiles an AMP body. Shorthand @TrackLink links are left untracked
+// as AMP validators and clients reject rewritten links in some components.
+// {{ TrackLink }} may still be used explicitly.
+func compileAMP(body string, f template.FuncMap) (*template.Template, error) {
+	body = regexpAMPTrackLink.ReplaceAllString(body, "$1")
+	for _, r := range regTplFuncs {
+		body = r.regExp.ReplaceAllString(body, r.replace)
+	}
+
+	tpl, err := template.New(ContentTpl).Funcs(f).Parse(body)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling AMP message: %v", err)
+	}
+
+	return tpl, nil
+}
+
+// ValidateAMP does a minimal validation of an AMP for Email document by checking
+// for the presence of the required boilerplate. It does not validate the
+// components used in the document.
+func ValidateAMP(body string) error {
+	b := strings.ToLower(body)
+	if !strings.HasPrefix(strings.TrimSpace(b), "<!doctype html>") {
+		return errors.New("AMP body should begin with <!doctype html>")
+	}
+
+	if !regexpAMPHTML.MatchString(b) {
+		return errors.New("AMP body should have an <html ⚡4email> or <html amp4email> tag")
+	}
+
+	for _, s := range ampBoilerplate {
+		if !strings.Contains(b, s) {
+			return fmt.Errorf("AMP body is missing the required boilerplate: %s", s)
+		}
+	}
+
+	return nil
+}
+
+// CompileSubject compiles the variant's subject line if it has a template
+// string and sets the resultant template to CampaignVariant.SubjectTpl.
+func (v *CampaignVariant) CompileSubject(f template.FuncMap) error {
+	tpl, err := compileSubject(v.Subject, f)
+	if err != nil {
+		return err
+	}
+	v.SubjectTpl = tpl
+	return nil
+}
+
+// compileSubject compiles a subject line into a text template. If the
+// subject has no template strings, nil is returned.
+func compileSubject(subj string, f template.FuncMap) (*txttpl.Template, error) {
+	return compileText(subj, "subject", f)
+}
+
+// compileText compiles a plain text template string, eg: a subject, if it has
+// template expressions. name is used in the error.
+func compileText(s, name string, f template.FuncMap) (*txttpl.Template, error) {
+	if !strings.Contains(s, "{{") {
+		return nil, nil
+	}
+
+	for _, r := range regTplFuncs {
+		s = r.regExp.ReplaceAllString(s, r.replace)
+	}
+
+	var txtFuncs map[string]interface{} = f
+	tpl, err := txttpl.New(ContentTpl).Funcs(txtFuncs).Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("error compiling %s: %v", name, err)
+	}
+
+	return tpl, nil
+}
+
 // ConvertContent converts a campaign's body from one format to another,
 // for example, Markdown to HTML.
 func (c *Campaign) ConvertContent(from, to string) (string, error) {
@@ -610,11 +1541,11 @@ func (c *Campaign) ConvertContent(from, to string) (string, error) {
 	var out string
 	if from == CampaignContentTypeMarkdown &&
 		(to == CampaignContentTypeHTML || to == CampaignContentTypeRichtext) {
-		var b bytes.Buffer
-		if err := markdown.Convert([]byte(c.Body), &b); err != nil {
+		b, err := MarkdownToHTML(c.Body)
+		if err != nil {
 			return out, err
 		}
-		out = b.String()
+		out = b
 	} else {
 		return out, errors.New("unknown formats to convert")
 	}
@@ -622,6 +1553,124 @@ func (c *Campaign) ConvertContent(from, to string) (string, error) {
 	return out, nil
 }
 
+var regexpMultiNewlines = regexp.MustCompile(`\n{3,}`)
+
+var (
+	regexpAMPTrackLink = regexp.MustCompile(`(https?://.+?)@TrackLink`)
+	regexpAMPHTML      = regexp.MustCompile(`<html[^>]*\s(⚡4email|amp4email)[\s>=]`)
+
+	// Boilerplate required in AMP for Email documents (lowercased).
+	ampBoilerplate = []string{
+		`<meta charset="utf-8"`,
+		`<script async src="https://cdn.ampproject.org/v0.js"></script>`,
+		`<style amp4email-boilerplate>body{visibility:hidden}</style>`,
+	}
+)
+
+// MarkdownToHTML renders a Markdown string to HTML.
+func MarkdownToHTML(src string) (string, error) {
+	var b bytes.Buffer
+	if err := markdown.Convert([]byte(src), &b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// MarkdownToText renders a Markdown string to plain text, preserving the
+// structure of paragraphs, lists, and links (as "text (url)"). This produces
+// a more readable plain text alternative than stripping tags off the HTML.
+func MarkdownToText(src string) (string, error) {
+	var (
+		source = []byte(src)
+		doc    = markdown.Parser().Parse(text.NewReader(source))
+		b      strings.Builder
+	)
+
+	err := ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		switch v := n.(type) {
+		case *ast.Text:
+			if entering {
+				b.Write(v.Segment.Value(source))
+				if v.SoftLineBreak() || v.HardLineBreak() {
+					b.WriteByte('\n')
+				}
+			}
+		case *ast.String:
+			if entering {
+				b.Write(v.Value)
+			}
+		case *ast.AutoLink:
+			if entering {
+				b.Write(v.URL(source))
+			}
+			return ast.WalkSkipChildren, nil
+		case *ast.Link:
+			if !entering {
+				fmt.Fprintf(&b, " (%s)", v.Destination)
+			}
+		case *ast.Image:
+			if !entering {
+				fmt.Fprintf(&b, " (%s)", v.Destination)
+			}
+		case *ast.CodeBlock, *ast.FencedCodeBlock:
+			if entering {
+				lines := n.Lines()
+				for i := 0; i < lines.Len(); i++ {
+					seg := lines.At(i)
+					b.Write(seg.Value(source))
+				}
+				b.WriteByte('\n')
+			}
+			return ast.WalkSkipChildren, nil
+		case *ast.HTMLBlock, *ast.RawHTML:
+			return ast.WalkSkipChildren, nil
+		case *ast.ThematicBreak:
+			if entering {
+				b.WriteString("---\n\n")
+			}
+		case *ast.ListItem:
+			if entering {
+				if l, ok := n.Parent().(*ast.List); ok && l.IsOrdered() {
+					idx := l.Start
+					for s := n.PreviousSibling(); s != nil; s = s.PreviousSibling() {
+						idx++
+					}
+					fmt.Fprintf(&b, "%d. ", idx)
+				} else {
+					b.WriteString("- ")
+				}
+			}
+		case *extast.TaskCheckBox:
+			if entering {
+				if v.IsChecked {
+					b.WriteString("[x] ")
+				} else {
+					b.WriteString("[ ] ")
+				}
+			}
+		case *extast.TableCell:
+			if !entering && n.NextSibling() != nil {
+				b.WriteString(" | ")
+			}
+		case *extast.TableHeader, *extast.TableRow, *ast.TextBlock:
+			if !entering {
+				b.WriteByte('\n')
+			}
+		case *ast.Paragraph, *ast.Heading, *ast.List, *extast.Table:
+			if !entering {
+				b.WriteString("\n\n")
+			}
+		}
+
+		return ast.WalkContinue, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(regexpMultiNewlines.ReplaceAllString(b.String(), "\n\n")) + "\n", nil
+}
+
 // Compile compiles a template body and subject (only for tx templates) and
 // caches the templat references to be executed later.
 func (t *Template) Compile(f template.FuncMap) error {
@@ -629,6 +1678,13 @@ func (t *Template) Compile(f template.FuncMap) error {
 	if err != nil {
 		return fmt.Errorf("error compiling transactional template: %v", err)
 	}
+
+	// A partial can't include itself, which is checked in SetPartials().
+	if t.Type != TemplateTypePartial {
+		if err := addPartials(tpl, t.Body); err != nil {
+			return err
+		}
+	}
 	t.Tpl = tpl
 
 	// If the subject line has a template string, compile it.
@@ -645,6 +1701,211 @@ func (t *Template) Compile(f template.FuncMap) error {
 	return nil
 }
 
+// partials is the global set of reusable template partials that are made
+// available to campaign and transactional templates. They are parsed into
+// templates when they're compiled and not when they're saved, so that changes
+// to a partial are reflected in all the templates that use it.
+var partials struct {
+	sync.RWMutex
+
+	// name => body.
+	bodies map[string]string
+
+	// name => names of the partials the partial references.
+	refs map[string][]string
+}
+
+// SetPartials replaces the global set of template partials (name => body).
+func SetPartials(p map[string]string) error {
+	refs, err := partialsRefs(p)
+	if err != nil {
+		return err
+	}
+
+	partials.Lock()
+	partials.bodies = p
+	partials.refs = refs
+	partials.Unlock()
+
+	return nil
+}
+
+// ValidatePartials checks a set of template partials (name => body) for invalid
+// syntax and circular includes, eg: a includes b which includes a.
+func ValidatePartials(p map[string]string) error {
+	_, err := partialsRefs(p)
+	return err
+}
+
+// partialsRefs validates a set of partials and returns the names of the
+// partials that each partial references.
+func partialsRefs(p map[string]string) (map[string][]string, error) {
+	refs := make(map[string][]string, len(p))
+	for name, body := range p {
+		r, err := partialRefs(name, body)
+		if err != nil {
+			return nil, fmt.Errorf("error compiling partial %s: %v", name, err)
+		}
+		refs[name] = r
+	}
+
+	// Detect cycles with a depth-first search over the includes.
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(p))
+
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		path = append(path, name)
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("circular partial include: %s", strings.Join(path, " -> "))
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		for _, r := range refs[name] {
+			if err := visit(r, path); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+
+		return nil
+	}
+
+	for name := range p {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return refs, nil
+}
+
+// addPartials parses all the partials that are referenced by the given
+// template bodies, directly or via other partials, into the template.
+func addPartials(tpl *template.Template, bodies ...string) error {
+	return walkPartials(bodies, func(name, body string) error {
+		for _, r := range regTplFuncs {
+			body = r.regExp.ReplaceAllString(body, r.replace)
+		}
+		if _, err := tpl.New(PartialTplPrefix + name).Parse(body); err != nil {
+			return fmt.Errorf("error compiling partial %s: %v", name, err)
+		}
+		return nil
+	})
+}
+
+// PartialBodies returns the raw bodies of all the partials that are referenced
+// by the given template bodies, directly or via other partials.
+func PartialBodies(bodies ...string) ([]string, error) {
+	var out []string
+	err := walkPartials(bodies, func(name, body string) error {
+		out = append(out, body)
+		return nil
+	})
+
+	return out, err
+}
+
+// walkPartials calls fn once for every existing partial that's referenced by the
+// given template bodies, directly or via other partials.
+func walkPartials(bodies []string, fn func(name, body string) error) error {
+	var names []string
+	for _, b := range bodies {
+		r, err := partialRefs("", b)
+		if err != nil {
+			return err
+		}
+		names = append(names, r...)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	partials.RLock()
+	defer partials.RUnlock()
+
+	done := map[string]bool{}
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+		if done[name] {
+			continue
+		}
+		done[name] = true
+
+		// Templates referencing non-existent partials fail on execution.
+		body, ok := partials.bodies[name]
+		if !ok {
+			continue
+		}
+
+		if err := fn(name, body); err != nil {
+			return err
+		}
+
+		names = append(names, partials.refs[name]...)
+	}
+
+	return nil
+}
+
+// partialRefs returns the names of the partials (without the prefix) that are
+// referenced in a template body via {{ template "partials/name" }}.
+func partialRefs(name, body string) ([]string, error) {
+	if !strings.Contains(body, PartialTplPrefix) {
+		return nil, nil
+	}
+
+	tr := parse.New(name)
+	tr.Mode = parse.SkipFuncCheck
+
+	trees := map[string]*parse.Tree{}
+	if _, err := tr.Parse(body, "", "", trees); err != nil {
+		return nil, err
+	}
+
+	var (
+		out  []string
+		walk func(n parse.Node)
+	)
+	walk = func(n parse.Node) {
+		switch v := n.(type) {
+		case *parse.ListNode:
+			if v == nil {
+				return
+			}
+			for _, c := range v.Nodes {
+				walk(c)
+			}
+		case *parse.IfNode:
+			walk(v.List)
+			walk(v.ElseList)
+		case *parse.RangeNode:
+			walk(v.List)
+			walk(v.ElseList)
+		case *parse.WithNode:
+			walk(v.List)
+			walk(v.ElseList)
+		case *parse.TemplateNode:
+			if strings.HasPrefix(v.Name, PartialTplPrefix) {
+				out = append(out, strings.TrimPrefix(v.Name, PartialTplPrefix))
+			}
+		}
+	}
+
+	for _, t := range trees {
+		walk(t.Root)
+	}
+
+	return out, nil
+}
+
 func (m *TxMessage) Render(sub Subscriber, tpl *Template) error {
 	data := struct {
 		Subscriber Subscriber
@@ -702,6 +1963,44 @@ func (s Subscriber) LastName() string {
 	return s.Name
 }
 
+// Validate checks that the header names are valid RFC 5322 field names, that the
+// values don't contain line breaks, and unless allowProtected is set, that none of
+// the ProtectedHeaders are overridden.
+func (h Headers) Validate(allowProtected bool) error {
+	for _, set := range h {
+		for k, v := range set {
+			if k == "" || strings.IndexFunc(k, func(r rune) bool { return r < 33 || r > 126 || r == ':' }) != -1 {
+				return fmt.Errorf("invalid header name: %q", k)
+			}
+			if strings.ContainsAny(v, "\r\n") {
+				return fmt.Errorf("invalid value for header %s", k)
+			}
+			if !allowProtected && ProtectedHeaders[textproto.CanonicalMIMEHeaderKey(k)] {
+				return fmt.Errorf("header %s can't be overridden", k)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Merge merges the headers into the given message headers. The headers replace
+// the message headers of the same name, and repeated headers are added as
+// multiple values.
+func (h Headers) Merge(dst textproto.MIMEHeader) {
+	merged := make(map[string]bool)
+	for _, set := range h {
+		for k, v := range set {
+			k = textproto.CanonicalMIMEHeaderKey(k)
+			if !merged[k] {
+				dst.Del(k)
+				merged[k] = true
+			}
+			dst.Add(k, v)
+		}
+	}
+}
+
 // Scan implements the sql.Scanner interface.
 func (h *Headers) Scan(src interface{}) error {
 	var b []byte
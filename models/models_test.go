@@ -0,0 +1,78 @@
+package models
+
+import (
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+func TestHeadersValidate(t *testing.T) {
+	cases := []struct {
+		name           string
+		h              Headers
+		allowProtected bool
+		ok             bool
+	}{
+		{"custom headers", Headers{{"X-SES-CONFIGURATION-SET": "marketing"}, {"List-ID": "<news.listmonk.app>"}}, false, true},
+		{"empty name", Headers{{"": "value"}}, false, false},
+		{"space in name", Headers{{"X Header": "value"}}, false, false},
+		{"colon in name", Headers{{"X-Header:": "value"}}, false, false},
+		{"line break in value", Headers{{"X-Header": "value\r\nBcc: someone@example.org"}}, false, false},
+		{"protected header", Headers{{"From": "someone@example.org"}}, false, false},
+		{"protected header in any case", Headers{{"subject": "Hi"}}, false, false},
+		{"listmonk header", Headers{{EmailHeaderCampaignUUID: "uuid"}}, false, false},
+		{"allowed protected header", Headers{{"From": "someone@example.org"}}, true, true},
+		{"invalid header with protected allowed", Headers{{"X Header": "value"}}, true, false},
+	}
+
+	for _, c := range cases {
+		if err := c.h.Validate(c.allowProtected); (err == nil) != c.ok {
+			t.Errorf("%s: expected valid=%v, got %v", c.name, c.ok, err)
+		}
+	}
+}
+
+func TestHeadersMerge(t *testing.T) {
+	h := textproto.MIMEHeader{}
+	h.Set("List-Unsubscribe", "<https://listmonk.app/unsub>")
+	h.Set(EmailHeaderSubscriberUUID, "uuid")
+
+	Headers{
+		{"x-ses-configuration-set": "marketing"},
+		{"List-Unsubscribe": "<mailto:unsub@listmonk.app>"},
+		{"X-Tag": "a"},
+		{"X-Tag": "b"},
+	}.Merge(h)
+
+	exp := textproto.MIMEHeader{
+		"X-Ses-Configuration-Set": {"marketing"},
+		"List-Unsubscribe":        {"<mailto:unsub@listmonk.app>"},
+		"X-Tag":                   {"a", "b"},
+		EmailHeaderSubscriberUUID: {"uuid"},
+	}
+	if !reflect.DeepEqual(h, exp) {
+		t.Errorf("expected %v, got %v", exp, h)
+	}
+}
+
+func TestCampaignFrom(t *testing.T) {
+	const global = "listmonk <noreply@listmonk.app>"
+
+	cases := []struct {
+		name string
+		c    Campaign
+		exp  string
+	}{
+		{"campaign over list", Campaign{FromEmail: "News <news@listmonk.app>", ListFromEmail: "brand@listmonk.app", ListFromName: "Brand"}, "News <news@listmonk.app>"},
+		{"list with a name", Campaign{ListFromEmail: "brand@listmonk.app", ListFromName: "Brand"}, `"Brand" <brand@listmonk.app>`},
+		{"list without a name", Campaign{ListFromEmail: "brand@listmonk.app"}, "brand@listmonk.app"},
+		{"list name without an e-mail", Campaign{ListFromName: "Brand"}, global},
+		{"global", Campaign{}, global},
+	}
+
+	for _, c := range cases {
+		if got := c.c.From(global); got != c.exp {
+			t.Errorf("%s: expected %q, got %q", c.name, c.exp, got)
+		}
+	}
+}
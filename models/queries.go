@@ -4,9 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
 )
 
 // Queries contains all prepared SQL queries.
@@ -22,32 +24,63 @@ type Queries struct {
 	GetSubscriberLists              *sqlx.Stmt `query:"get-subscriber-lists"`
 	GetSubscriptions                *sqlx.Stmt `query:"get-subscriptions"`
 	GetSubscriberListsLazy          *sqlx.Stmt `query:"get-subscriber-lists-lazy"`
+	GetSubscriberActivity           *sqlx.Stmt `query:"get-subscriber-activity"`
 	UpdateSubscriber                *sqlx.Stmt `query:"update-subscriber"`
 	UpdateSubscriberWithLists       *sqlx.Stmt `query:"update-subscriber-with-lists"`
 	BlocklistSubscribers            *sqlx.Stmt `query:"blocklist-subscribers"`
 	AddSubscribersToLists           *sqlx.Stmt `query:"add-subscribers-to-lists"`
 	DeleteSubscriptions             *sqlx.Stmt `query:"delete-subscriptions"`
+	GetOptinReminderSubscriptions   *sqlx.Stmt `query:"get-optin-reminder-subscriptions"`
+	UpdateOptinReminders            *sqlx.Stmt `query:"update-optin-reminders"`
+	DeleteExpiredOptinSubscriptions *sqlx.Stmt `query:"delete-expired-optin-subscriptions"`
 	DeleteUnconfirmedSubscriptions  *sqlx.Stmt `query:"delete-unconfirmed-subscriptions"`
 	ConfirmSubscriptionOptin        *sqlx.Stmt `query:"confirm-subscription-optin"`
 	UnsubscribeSubscribersFromLists *sqlx.Stmt `query:"unsubscribe-subscribers-from-lists"`
 	DeleteSubscribers               *sqlx.Stmt `query:"delete-subscribers"`
 	DeleteBlocklistedSubscribers    *sqlx.Stmt `query:"delete-blocklisted-subscribers"`
+	ArchiveSubscribers              *sqlx.Stmt `query:"archive-subscribers"`
+	RestoreSubscribers              *sqlx.Stmt `query:"restore-subscribers"`
+	DeleteArchivedSubscribers       *sqlx.Stmt `query:"delete-archived-subscribers"`
+	DeleteStaleSubscribers          *sqlx.Stmt `query:"delete-stale-subscribers"`
+	GetEngagementEvents             *sqlx.Stmt `query:"get-engagement-events"`
+	UpdateEngagementScores          *sqlx.Stmt `query:"update-engagement-scores"`
+	ResetEngagementScores           *sqlx.Stmt `query:"reset-engagement-scores"`
+	GetDuplicateSubscribers         *sqlx.Stmt `query:"get-duplicate-subscribers"`
+	MergeSubscriberLists            *sqlx.Stmt `query:"merge-subscriber-lists"`
+	MergeSubscriberActivity         *sqlx.Stmt `query:"merge-subscriber-activity"`
+	MergeSubscriberAttribs          *sqlx.Stmt `query:"merge-subscriber-attribs"`
 	DeleteOrphanSubscribers         *sqlx.Stmt `query:"delete-orphan-subscribers"`
 	UnsubscribeByCampaign           *sqlx.Stmt `query:"unsubscribe-by-campaign"`
 	ExportSubscriberData            *sqlx.Stmt `query:"export-subscriber-data"`
+	GetSubscriptionsForExport       *sqlx.Stmt `query:"get-subscriptions-for-export"`
+	ExportSubscriberDossier         *sqlx.Stmt `query:"export-subscriber-dossier"`
+	GetSubscriberForErasure         *sqlx.Stmt `query:"get-subscriber-for-erasure"`
+	AnonymizeSubscriberActivity     *sqlx.Stmt `query:"anonymize-subscriber-activity"`
+	EraseSubscriberData             *sqlx.Stmt `query:"erase-subscriber-data"`
+
+	InsertSuppressions  *sqlx.Stmt `query:"insert-suppressions"`
+	GetSuppressions     *sqlx.Stmt `query:"get-suppressions"`
+	GetSuppressionStats *sqlx.Stmt `query:"get-suppression-stats"`
 
 	// Non-prepared arbitrary subscriber queries.
 	QuerySubscribers                       string     `query:"query-subscribers"`
 	QuerySubscribersCount                  string     `query:"query-subscribers-count"`
+	SearchSubscribers                      string     `query:"search-subscribers"`
+	SearchSubscribersCount                 string     `query:"search-subscribers-count"`
 	QuerySubscribersCountAll               *sqlx.Stmt `query:"query-subscribers-count-all"`
 	QuerySubscribersForExport              string     `query:"query-subscribers-for-export"`
 	QuerySubscribersTpl                    string     `query:"query-subscribers-template"`
 	DeleteSubscribersByQuery               string     `query:"delete-subscribers-by-query"`
 	AddSubscribersToListsByQuery           string     `query:"add-subscribers-to-lists-by-query"`
 	BlocklistSubscribersByQuery            string     `query:"blocklist-subscribers-by-query"`
+	UnblocklistSubscribersByQuery          string     `query:"unblocklist-subscribers-by-query"`
 	DeleteSubscriptionsByQuery             string     `query:"delete-subscriptions-by-query"`
 	UnsubscribeSubscribersFromListsByQuery string     `query:"unsubscribe-subscribers-from-lists-by-query"`
 
+	StartListReconfirmation          *sqlx.Stmt `query:"start-list-reconfirmation"`
+	GetListReconfirmationSubscribers *sqlx.Stmt `query:"get-list-reconfirmation-subscribers"`
+	ExpireReconfirmations            *sqlx.Stmt `query:"expire-reconfirmations"`
+
 	CreateList      *sqlx.Stmt `query:"create-list"`
 	QueryLists      string     `query:"query-lists"`
 	GetLists        *sqlx.Stmt `query:"get-lists"`
@@ -56,6 +89,16 @@ type Queries struct {
 	UpdateListsDate *sqlx.Stmt `query:"update-lists-date"`
 	DeleteLists     *sqlx.Stmt `query:"delete-lists"`
 
+	UpdateListTemplate *sqlx.Stmt `query:"update-list-template"`
+	UpdateListArchived *sqlx.Stmt `query:"update-list-archived"`
+	UpdateListParent   *sqlx.Stmt `query:"update-list-parent"`
+	GetListGroupIDs    *sqlx.Stmt `query:"get-list-group-ids"`
+
+	UpdateListTrackViews *sqlx.Stmt `query:"update-list-track-views"`
+
+	GetQueuedListCounts         *sqlx.Stmt `query:"get-queued-list-counts"`
+	RefreshListSubscriberCounts *sqlx.Stmt `query:"refresh-list-subscriber-counts"`
+
 	CreateCampaign        *sqlx.Stmt `query:"create-campaign"`
 	QueryCampaigns        string     `query:"query-campaigns"`
 	GetCampaign           *sqlx.Stmt `query:"get-campaign"`
@@ -71,30 +114,91 @@ type Queries struct {
 	GetCampaignClickCounts     *sqlx.Stmt `query:"get-campaign-click-counts"`
 	GetCampaignLinkCounts      *sqlx.Stmt `query:"get-campaign-link-counts"`
 	GetCampaignBounceCounts    *sqlx.Stmt `query:"get-campaign-bounce-counts"`
+	GetCampaignViewSeries      *sqlx.Stmt `query:"get-campaign-view-series"`
+	GetCampaignClickSeries     *sqlx.Stmt `query:"get-campaign-click-series"`
 	DeleteCampaignViews        *sqlx.Stmt `query:"delete-campaign-views"`
 	DeleteCampaignLinkClicks   *sqlx.Stmt `query:"delete-campaign-link-clicks"`
 
 	NextCampaigns            *sqlx.Stmt `query:"next-campaigns"`
 	NextCampaignSubscribers  *sqlx.Stmt `query:"next-campaign-subscribers"`
+	GetCampaignMessageCap    *sqlx.Stmt `query:"get-campaign-message-cap"`
+	GetSubscriberSendCounts  *sqlx.Stmt `query:"get-subscriber-send-counts"`
+	GetExcludedSubscribers   *sqlx.Stmt `query:"get-excluded-subscribers"`
+	RecordSubscriberSends    *sqlx.Stmt `query:"record-subscriber-sends"`
+	RecordCampaignDeliveries *sqlx.Stmt `query:"record-campaign-deliveries"`
+	DeleteCampaignDeliveries *sqlx.Stmt `query:"delete-campaign-deliveries"`
+	DeferCampaignSubscribers *sqlx.Stmt `query:"defer-campaign-subscribers"`
+	NextCampaignDeferrals    *sqlx.Stmt `query:"next-campaign-deferrals"`
+	GetCampaignNextDeferral  *sqlx.Stmt `query:"get-campaign-next-deferral"`
+	DeleteCampaignDeferrals  *sqlx.Stmt `query:"delete-campaign-deferrals"`
 	GetOneCampaignSubscriber *sqlx.Stmt `query:"get-one-campaign-subscriber"`
 	UpdateCampaign           *sqlx.Stmt `query:"update-campaign"`
 	UpdateCampaignStatus     *sqlx.Stmt `query:"update-campaign-status"`
 	UpdateCampaignCounts     *sqlx.Stmt `query:"update-campaign-counts"`
+	UpdateCampaignCheckpoint *sqlx.Stmt `query:"update-campaign-checkpoint"`
 	UpdateCampaignArchive    *sqlx.Stmt `query:"update-campaign-archive"`
 	RegisterCampaignView     *sqlx.Stmt `query:"register-campaign-view"`
 	DeleteCampaign           *sqlx.Stmt `query:"delete-campaign"`
 
+	UpdateCampaignRecurrence  *sqlx.Stmt `query:"update-campaign-recurrence"`
+	GetDueRecurringCampaigns  *sqlx.Stmt `query:"get-due-recurring-campaigns"`
+	SetCampaignRecurrenceNext *sqlx.Stmt `query:"set-campaign-recurrence-next-at"`
+	CloneRecurringCampaign    *sqlx.Stmt `query:"clone-recurring-campaign"`
+
+	CloneCampaign                *sqlx.Stmt `query:"clone-campaign"`
+	GetCampaignTriggerRecipients string     `query:"get-campaign-trigger-recipients"`
+	CloneTriggeredCampaign       *sqlx.Stmt `query:"clone-triggered-campaign"`
+
+	UpdateCampaignSegment          *sqlx.Stmt `query:"update-campaign-segment"`
+	UpdateCampaignListGroup        *sqlx.Stmt `query:"update-campaign-list-group"`
+	UpdateCampaignPriority         *sqlx.Stmt `query:"update-campaign-priority"`
+	UpdateCampaignUnsubHeader      *sqlx.Stmt `query:"update-campaign-unsubscribe-header"`
+	UpdateCampaignInlineCSS        *sqlx.Stmt `query:"update-campaign-inline-css"`
+	UpdateCampaignTrackViews       *sqlx.Stmt `query:"update-campaign-track-views"`
+	UpdateCampaignNotify           *sqlx.Stmt `query:"update-campaign-notify"`
+	GetCampaignSegment             *sqlx.Stmt `query:"get-campaign-segment"`
+	NextCampaignSegmentSubscribers string     `query:"next-campaign-segment-subscribers"`
+
+	UpdateCampaignBodyHTML *sqlx.Stmt `query:"update-campaign-body-html"`
+
+	GetCampaignSendWindow    *sqlx.Stmt `query:"get-campaign-send-window"`
+	UpdateCampaignSendWindow *sqlx.Stmt `query:"update-campaign-send-window"`
+
+	InsertCampaignVersion  *sqlx.Stmt `query:"insert-campaign-version"`
+	GetCampaignVersions    *sqlx.Stmt `query:"get-campaign-versions"`
+	RestoreCampaignVersion *sqlx.Stmt `query:"restore-campaign-version"`
+
+	UpdateCampaignBody     *sqlx.Stmt `query:"update-campaign-body"`
+	UpdateCampaignApproval *sqlx.Stmt `query:"update-campaign-approval"`
+	GetCampaignApprovals   *sqlx.Stmt `query:"get-campaign-approvals"`
+
+	GetCampaignVariants         *sqlx.Stmt `query:"get-campaign-variants"`
+	DeleteCampaignVariants      *sqlx.Stmt `query:"delete-campaign-variants"`
+	ResetCampaignApproval       *sqlx.Stmt `query:"reset-campaign-approval"`
+	InsertCampaignVariant       *sqlx.Stmt `query:"insert-campaign-variant"`
+	UpdateCampaignVariantCounts *sqlx.Stmt `query:"update-campaign-variant-counts"`
+	EndCampaignVariantSample    *sqlx.Stmt `query:"end-campaign-variant-sample"`
+	PickCampaignVariantWinner   *sqlx.Stmt `query:"pick-campaign-variant-winner"`
+
 	InsertMedia *sqlx.Stmt `query:"insert-media"`
 	GetMedia    *sqlx.Stmt `query:"get-media"`
 	QueryMedia  *sqlx.Stmt `query:"query-media"`
 	DeleteMedia *sqlx.Stmt `query:"delete-media"`
 
+	MoveMedia         *sqlx.Stmt `query:"move-media"`
+	GetMediaFolders   *sqlx.Stmt `query:"get-media-folders"`
+	CreateMediaFolder *sqlx.Stmt `query:"create-media-folder"`
+	DeleteMediaFolder *sqlx.Stmt `query:"delete-media-folder"`
+
 	CreateTemplate     *sqlx.Stmt `query:"create-template"`
 	GetTemplates       *sqlx.Stmt `query:"get-templates"`
 	UpdateTemplate     *sqlx.Stmt `query:"update-template"`
 	SetDefaultTemplate *sqlx.Stmt `query:"set-default-template"`
 	DeleteTemplate     *sqlx.Stmt `query:"delete-template"`
 
+	GetCampaignLinkStats   *sqlx.Stmt `query:"get-campaign-link-stats"`
+	GetCampaignBounceTypes *sqlx.Stmt `query:"get-campaign-bounce-types"`
+
 	CreateLink        *sqlx.Stmt `query:"create-link"`
 	RegisterLinkClick *sqlx.Stmt `query:"register-link-click"`
 
@@ -103,10 +207,46 @@ type Queries struct {
 
 	// GetStats *sqlx.Stmt `query:"get-stats"`
 	RecordBounce              *sqlx.Stmt `query:"record-bounce"`
+	GetBounceRuleBounces      *sqlx.Stmt `query:"get-bounce-rule-bounces"`
+	GetBounceRuleActions      *sqlx.Stmt `query:"get-bounce-rule-actions"`
+	ApplyBounceRule           *sqlx.Stmt `query:"apply-bounce-rule"`
 	QueryBounces              string     `query:"query-bounces"`
 	DeleteBounces             *sqlx.Stmt `query:"delete-bounces"`
 	DeleteBouncesBySubscriber *sqlx.Stmt `query:"delete-bounces-by-subscriber"`
 	GetDBInfo                 string     `query:"get-db-info"`
+
+	GetWebhooks          *sqlx.Stmt `query:"get-webhooks"`
+	InsertWebhook        *sqlx.Stmt `query:"insert-webhook"`
+	DeleteWebhook        *sqlx.Stmt `query:"delete-webhook"`
+	InsertWebhookFailure *sqlx.Stmt `query:"insert-webhook-failure"`
+	QueryWebhookFailures *sqlx.Stmt `query:"query-webhook-failures"`
+
+	GetAttribFields   *sqlx.Stmt `query:"get-attrib-fields"`
+	CreateAttribField *sqlx.Stmt `query:"create-attrib-field"`
+	UpdateAttribField *sqlx.Stmt `query:"update-attrib-field"`
+	DeleteAttribField *sqlx.Stmt `query:"delete-attrib-field"`
+
+	InsertTxMessage *sqlx.Stmt `query:"insert-tx-message"`
+	UpdateTxMessage *sqlx.Stmt `query:"update-tx-message"`
+	NextTxMessages  *sqlx.Stmt `query:"next-tx-messages"`
+	GetTxMessage    *sqlx.Stmt `query:"get-tx-message"`
+
+	ClaimTxIdempotencyKey          *sqlx.Stmt `query:"claim-tx-idempotency-key"`
+	GetTxIdempotencyKey            *sqlx.Stmt `query:"get-tx-idempotency-key"`
+	UpdateTxIdempotencyKey         *sqlx.Stmt `query:"update-tx-idempotency-key"`
+	DeleteTxIdempotencyKey         *sqlx.Stmt `query:"delete-tx-idempotency-key"`
+	DeleteExpiredTxIdempotencyKeys *sqlx.Stmt `query:"delete-expired-tx-idempotency-keys"`
+
+	GetSegments       *sqlx.Stmt `query:"get-segments"`
+	InsertSegment     *sqlx.Stmt `query:"insert-segment"`
+	UpdateSegment     *sqlx.Stmt `query:"update-segment"`
+	DeleteSegment     *sqlx.Stmt `query:"delete-segment"`
+	CheckSegmentQuery string     `query:"check-segment-query"`
+
+	GetImportCheckpoint          *sqlx.Stmt `query:"get-import-checkpoint"`
+	UpsertImportCheckpoint       *sqlx.Stmt `query:"upsert-import-checkpoint"`
+	DeleteImportCheckpoint       *sqlx.Stmt `query:"delete-import-checkpoint"`
+	DeleteStaleImportCheckpoints *sqlx.Stmt `query:"delete-stale-import-checkpoints"`
 }
 
 // CompileSubscriberQueryTpl takes an arbitrary WHERE expressions
@@ -133,6 +273,58 @@ func (q *Queries) CompileSubscriberQueryTpl(exp string, db *sqlx.DB) (string, er
 	return stmt, nil
 }
 
+// ExecSubQueryTplBatches is like ExecSubQueryTpl, but executes the query template in
+// batches of batchSize subscribers with a pause of wait between them so that locks
+// aren't held on the tables for long. The template should expect $3=the ID after which
+// the batch starts and $4=the batch size, and return the last ID in the batch (last_id),
+// which is NULL when there are no more subscribers, and the IDs of the subscribers it
+// changed (ids). fn, if set, is called with the changed IDs of every batch. It returns
+// the number of subscribers changed.
+func (q *Queries) ExecSubQueryTplBatches(exp, tpl string, listIDs []int, db *sqlx.DB, batchSize int, wait time.Duration, fn func([]int)) (int, error) {
+	filterExp, err := q.CompileSubscriberQueryTpl(exp, db)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(listIDs) == 0 {
+		listIDs = []int{}
+	}
+
+	var (
+		stmt   = fmt.Sprintf(tpl, filterExp)
+		total  = 0
+		lastID = 0
+	)
+	for {
+		var res struct {
+			LastID null.Int      `db:"last_id"`
+			IDs    pq.Int64Array `db:"ids"`
+		}
+		if err := db.Get(&res, stmt, false, pq.Array(listIDs), lastID, batchSize); err != nil {
+			return total, err
+		}
+		if !res.LastID.Valid {
+			break
+		}
+
+		if len(res.IDs) > 0 {
+			total += len(res.IDs)
+			if fn != nil {
+				ids := make([]int, len(res.IDs))
+				for i, id := range res.IDs {
+					ids[i] = int(id)
+				}
+				fn(ids)
+			}
+		}
+
+		lastID = res.LastID.Int
+		time.Sleep(wait)
+	}
+
+	return total, nil
+}
+
 // compileSubscriberQueryTpl takes an arbitrary WHERE expressions and a subscriber
 // query template that depends on the filter (eg: delete by query, blocklist by query etc.)
 // combines and executes them.
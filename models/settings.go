@@ -26,6 +26,60 @@ type Settings struct {
 	AppMessageSlidingWindowDuration string `json:"app.message_sliding_window_duration"`
 	AppMessageSlidingWindowRate     int    `json:"app.message_sliding_window_rate"`
 
+	AppMaxSubscriberMessages int `json:"app.max_subscriber_messages"`
+
+	// Global messages per second across all workers. 0 disables the throttle.
+	AppMessageThrottle int `json:"app.message_throttle"`
+
+	// Inline the CSS in the <style> blocks of campaign bodies onto the elements'
+	// style attributes before sending. Campaigns can override it.
+	AppInlineCSS bool `json:"app.inline_css"`
+
+	AppOptinReminderInterval string `json:"app.optin_reminder_interval"`
+	AppOptinReminderMax      int    `json:"app.optin_reminder_max"`
+	AppOptinReminderPurge    bool   `json:"app.optin_reminder_purge"`
+
+	AppArchivedSubscriberRetention string `json:"app.archived_subscriber_retention"`
+
+	// Periods after which subscribers who remain unconfirmed, or who unsubscribed, and
+	// have no other active subscriptions are deleted. 0 disables either.
+	AppUnconfirmedSubscriberRetention  string `json:"app.unconfirmed_subscriber_retention"`
+	AppUnsubscribedSubscriberRetention string `json:"app.unsubscribed_subscriber_retention"`
+
+	// Subscriber engagement score weights of a view and a click, and the
+	// half-life over which the weight of an event decays.
+	AppEngagementOpenWeight  float64 `json:"app.engagement_open_weight"`
+	AppEngagementClickWeight float64 `json:"app.engagement_click_weight"`
+	AppEngagementHalfLife    string  `json:"app.engagement_half_life"`
+
+	// Max number of recipients that a campaign can be triggered with in one request.
+	AppCampaignTriggerMaxRecipients int `json:"app.campaign_trigger_max_recipients"`
+
+	AppSubscriberAttribsSchema string `json:"app.subscriber_attribs_schema"`
+
+	AppCampaignVariantSampleSize   int    `json:"app.campaign_variant_sample_size"`
+	AppCampaignVariantSampleWindow string `json:"app.campaign_variant_sample_window"`
+
+	AppRecurringCampaignCatchup string `json:"app.recurring_campaign_catchup"`
+	AppSendWindowTimezone       string `json:"app.send_window_timezone"`
+
+	AppMaxCampaignVersions int `json:"app.max_campaign_versions"`
+
+	// Whether campaigns have to be approved before they're started or scheduled.
+	AppCampaignApproval bool `json:"app.campaign_approval"`
+
+	// Default UTM params added to the tracked links of campaigns that don't set them.
+	AppUTMSource   string `json:"app.utm_source"`
+	AppUTMMedium   string `json:"app.utm_medium"`
+	AppUTMCampaign string `json:"app.utm_campaign"`
+	AppUTMContent  string `json:"app.utm_content"`
+
+	AppSandboxEnabled bool   `json:"app.sandbox_enabled"`
+	AppSandboxEmail   string `json:"app.sandbox_email"`
+
+	// Allow custom campaign and tx message headers to override models.ProtectedHeaders.
+	AppAllowProtectedHeaders bool `json:"app.allow_protected_headers"`
+
 	PrivacyIndividualTracking bool     `json:"privacy.individual_tracking"`
 	PrivacyUnsubHeader        bool     `json:"privacy.unsubscribe_header"`
 	PrivacyAllowBlocklist     bool     `json:"privacy.allow_blocklist"`
@@ -35,10 +89,28 @@ type Settings struct {
 	PrivacyExportable         []string `json:"privacy.exportable"`
 	PrivacyRecordOptinIP      bool     `json:"privacy.record_optin_ip"`
 	DomainBlocklist           []string `json:"privacy.domain_blocklist"`
+	DomainAllowlist           []string `json:"privacy.domain_allowlist"`
+	BlockDisposableDomains    bool     `json:"privacy.block_disposable_domains"`
+	PrivacyUnsubConfirm       bool     `json:"privacy.unsubscribe_confirm"`
+	PrivacyUnsubAllLists      bool     `json:"privacy.unsubscribe_all_lists"`
+
+	// Global view (open) tracking. Lists and campaigns can only disable it further.
+	PrivacyTrackViews bool `json:"privacy.track_views"`
+
+	// In the privacy mode, click identifiers (eg: gclid, fbclid) are stripped from
+	// tracked links and recorded IPs are anonymized.
+	PrivacyMode bool `json:"privacy.privacy_mode"`
 
-	SecurityEnableCaptcha bool   `json:"security.enable_captcha"`
-	SecurityCaptchaKey    string `json:"security.captcha_key"`
-	SecurityCaptchaSecret string `json:"security.captcha_secret"`
+	SecurityEnableCaptcha   bool   `json:"security.enable_captcha"`
+	SecurityCaptchaKey      string `json:"security.captcha_key"`
+	SecurityCaptchaSecret   string `json:"security.captcha_secret"`
+	SecurityCaptchaProvider string `json:"security.captcha_provider"`
+	SecurityCaptchaStrict   bool   `json:"security.captcha_strict"`
+
+	SecurityPublicRateLimitEnabled  bool   `json:"security.public_rate_limit_enabled"`
+	SecurityPublicRateLimitRequests int    `json:"security.public_rate_limit_requests"`
+	SecurityPublicRateLimitWindow   string `json:"security.public_rate_limit_window"`
+	SecurityTrustedProxyHeader      string `json:"security.trusted_proxy_header"`
 
 	UploadProvider             string   `json:"upload.provider"`
 	UploadExtensions           []string `json:"upload.extensions"`
@@ -54,6 +126,9 @@ type Settings struct {
 	UploadS3BucketPath         string   `json:"upload.s3.bucket_path"`
 	UploadS3BucketType         string   `json:"upload.s3.bucket_type"`
 	UploadS3Expiry             string   `json:"upload.s3.expiry"`
+	UploadS3URLMode            string   `json:"upload.s3.url_mode"`
+
+	UploadImageVariantWidths []int `json:"upload.image_variant_widths"`
 
 	SMTP []struct {
 		UUID          string              `json:"uuid"`
@@ -71,6 +146,7 @@ type Settings struct {
 		WaitTimeout   string              `json:"wait_timeout"`
 		TLSType       string              `json:"tls_type"`
 		TLSSkipVerify bool                `json:"tls_skip_verify"`
+		Weight        int                 `json:"weight"`
 	} `json:"smtp"`
 
 	Messengers []struct {
@@ -85,12 +161,39 @@ type Settings struct {
 		MaxMsgRetries int    `json:"max_msg_retries"`
 	} `json:"messengers"`
 
+	SMS struct {
+		Enabled     bool   `json:"enabled"`
+		Name        string `json:"name"`
+		GatewayURL  string `json:"gateway_url"`
+		Username    string `json:"username"`
+		Password    string `json:"password,omitempty"`
+		From        string `json:"from"`
+		PhoneAttrib string `json:"phone_attrib"`
+		MaxConns    int    `json:"max_conns"`
+		Timeout     string `json:"timeout"`
+	} `json:"sms"`
+
+	// DKIM keys with which e-mails are signed, by the domain of their From address.
+	DKIM struct {
+		Enabled bool `json:"enabled"`
+		Keys    []struct {
+			Domain     string   `json:"domain"`
+			Selector   string   `json:"selector"`
+			PrivateKey string   `json:"private_key,omitempty"`
+			Headers    []string `json:"headers"`
+		} `json:"keys"`
+	} `json:"dkim"`
+
 	BounceEnabled        bool `json:"bounce.enabled"`
 	BounceEnableWebhooks bool `json:"bounce.webhooks_enabled"`
 	BounceActions        map[string]struct {
 		Count  int    `json:"count"`
 		Action string `json:"action"`
 	} `json:"bounce.actions"`
+
+	// Rules that act on subscribers with repeated bounces within a time window.
+	BounceRules []BounceRule `json:"bounce.rules"`
+
 	SESEnabled      bool   `json:"bounce.ses_enabled"`
 	SendgridEnabled bool   `json:"bounce.sendgrid_enabled"`
 	SendgridKey     string `json:"bounce.sendgrid_key"`
@@ -99,6 +202,11 @@ type Settings struct {
 		Username string `json:"username"`
 		Password string `json:"password"`
 	} `json:"bounce.postmark"`
+	BounceSparkPost struct {
+		Enabled  bool   `json:"enabled"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	} `json:"bounce.sparkpost"`
 	BounceBoxes []struct {
 		UUID          string `json:"uuid"`
 		Enabled       bool   `json:"enabled"`
@@ -109,6 +217,7 @@ type Settings struct {
 		ReturnPath    string `json:"return_path"`
 		Username      string `json:"username"`
 		Password      string `json:"password,omitempty"`
+		Folder        string `json:"folder"`
 		TLSEnabled    bool   `json:"tls_enabled"`
 		TLSSkipVerify bool   `json:"tls_skip_verify"`
 		ScanInterval  string `json:"scan_interval"`
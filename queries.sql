@@ -74,6 +74,45 @@ SELECT lists.*,
     WHERE CASE WHEN $3 = TRUE THEN TRUE ELSE subscriber_lists.status IS NOT NULL END
     ORDER BY subscriber_lists.status;
 
+-- name: get-subscriber-activity
+-- Returns the activity events of a subscriber ($1) of the given types ($2), latest first,
+-- merged from the subscriber's record, subscriptions, campaign sends (only recorded
+-- when app.max_subscriber_messages is enabled), views, clicks, and bounces.
+-- Only the latest profile change is known from the subscriber's updated_at. Every source
+-- is looked up by its subscriber_id index and unrequested types are skipped altogether.
+WITH events AS (
+    SELECT 'created' AS type, NULL::INT AS campaign_id, NULL::INT AS list_id, '{}'::JSONB AS meta, created_at
+        FROM subscribers WHERE id = $1 AND 'created' = ANY($2::TEXT[])
+    UNION ALL
+    SELECT 'updated', NULL, NULL, '{}', updated_at
+        FROM subscribers WHERE id = $1 AND updated_at > created_at AND 'updated' = ANY($2::TEXT[])
+    UNION ALL
+    SELECT 'subscribed', NULL, list_id, JSONB_BUILD_OBJECT('status', status), created_at
+        FROM subscriber_lists WHERE subscriber_id = $1 AND 'subscribed' = ANY($2::TEXT[])
+    UNION ALL
+    SELECT 'unsubscribed', NULL, list_id, '{}', updated_at
+        FROM subscriber_lists WHERE subscriber_id = $1 AND status = 'unsubscribed' AND 'unsubscribed' = ANY($2::TEXT[])
+    UNION ALL
+    SELECT 'received', campaign_id, NULL, '{}', created_at
+        FROM subscriber_sends WHERE subscriber_id = $1 AND 'received' = ANY($2::TEXT[])
+    UNION ALL
+    SELECT 'view', campaign_id, NULL, '{}', created_at
+        FROM campaign_views WHERE subscriber_id = $1 AND 'view' = ANY($2::TEXT[])
+    UNION ALL
+    SELECT 'click', link_clicks.campaign_id, NULL, JSONB_BUILD_OBJECT('url', links.url), link_clicks.created_at
+        FROM link_clicks INNER JOIN links ON (links.id = link_clicks.link_id)
+        WHERE link_clicks.subscriber_id = $1 AND 'click' = ANY($2::TEXT[])
+    UNION ALL
+    SELECT 'bounce', campaign_id, NULL, JSONB_BUILD_OBJECT('type', type, 'source', source), created_at
+        FROM bounces WHERE subscriber_id = $1 AND 'bounce' = ANY($2::TEXT[])
+)
+SELECT COUNT(*) OVER () AS total, events.type, events.created_at, events.meta,
+    events.campaign_id, campaigns.name AS campaign_name, events.list_id, lists.name AS list_name
+    FROM events
+    LEFT JOIN campaigns ON (campaigns.id = events.campaign_id)
+    LEFT JOIN lists ON (lists.id = events.list_id)
+    ORDER BY events.created_at DESC OFFSET $3 LIMIT (CASE WHEN $4 < 1 THEN NULL ELSE $4 END);
+
 -- name: insert-subscriber
 WITH sub AS (
     INSERT INTO subscribers (uuid, email, name, status, attribs)
@@ -90,7 +129,7 @@ subs AS (
     VALUES(
         (SELECT id FROM sub),
         UNNEST(ARRAY(SELECT id FROM listIDs)),
-        (CASE WHEN $4='blocklisted' THEN 'unsubscribed'::subscription_status ELSE $8::subscription_status END)
+        (CASE WHEN (SELECT status FROM sub)='blocklisted' THEN 'unsubscribed'::subscription_status ELSE $8::subscription_status END)
     )
     ON CONFLICT (subscriber_id, list_id) DO UPDATE
         SET updated_at=NOW(),
@@ -104,7 +143,8 @@ SELECT id from sub;
 
 -- name: upsert-subscriber
 -- Upserts a subscriber where existing subscribers get their names and attributes overwritten.
--- If $7 = true, update values, otherwise, skip.
+-- If $7 = true, update values, otherwise, skip. Blocklisted (eg: suppressed) subscribers
+-- are added to the lists as unsubscribed.
 WITH sub AS (
     INSERT INTO subscribers as s (uuid, email, name, attribs, status)
     VALUES($1, $2, $3, $4, 'enabled')
@@ -113,15 +153,18 @@ WITH sub AS (
         name=(CASE WHEN $7 THEN $3 ELSE s.name END),
         attribs=(CASE WHEN $7 THEN $4 ELSE s.attribs END),
         updated_at=NOW()
-    RETURNING uuid, id
+    RETURNING uuid, id, status, (xmax = 0) AS inserted
+),
+subStatus AS (
+    SELECT (CASE WHEN (SELECT status FROM sub)='blocklisted' THEN 'unsubscribed'::subscription_status ELSE $6::subscription_status END) AS status
 ),
 subs AS (
     INSERT INTO subscriber_lists (subscriber_id, list_id, status)
-    VALUES((SELECT id FROM sub), UNNEST($5::INT[]), $6)
+    VALUES((SELECT id FROM sub), UNNEST($5::INT[]), (SELECT status FROM subStatus))
     ON CONFLICT (subscriber_id, list_id) DO UPDATE
-    SET updated_at=NOW(), status=(CASE WHEN $7 THEN $6 ELSE subscriber_lists.status END)
+    SET updated_at=NOW(), status=(CASE WHEN $7 THEN (SELECT status FROM subStatus) ELSE subscriber_lists.status END)
 )
-SELECT uuid, id from sub;
+SELECT uuid, id, inserted from sub;
 
 -- name: upsert-blocklist-subscriber
 -- Upserts a subscriber where the update will only set the status to blocklisted
@@ -132,10 +175,13 @@ WITH sub AS (
     INSERT INTO subscribers (uuid, email, name, attribs, status)
     VALUES($1, $2, $3, $4, 'blocklisted')
     ON CONFLICT (email) DO UPDATE SET status='blocklisted', updated_at=NOW()
-    RETURNING id
+    RETURNING id, (xmax = 0) AS inserted
+),
+subs AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
+        WHERE subscriber_id = (SELECT id FROM sub)
 )
-UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
-    WHERE subscriber_id = (SELECT id FROM sub);
+SELECT id, inserted FROM sub;
 
 -- name: update-subscriber
 UPDATE subscribers SET
@@ -195,6 +241,170 @@ DELETE FROM subscribers WHERE status = 'blocklisted';
 DELETE FROM subscribers a WHERE NOT EXISTS
     (SELECT 1 FROM subscriber_lists b WHERE b.subscriber_id = a.id);
 
+-- name: archive-subscribers
+-- Soft deletes subscribers. Archived subscribers are excluded from campaigns
+-- and list counts until they are restored or purged.
+UPDATE subscribers SET archived_at=NOW(), updated_at=NOW() WHERE id = ANY($1::INT[]) AND archived_at IS NULL;
+
+-- name: restore-subscribers
+UPDATE subscribers SET archived_at=NULL, updated_at=NOW() WHERE id = ANY($1::INT[]) AND archived_at IS NOT NULL;
+
+-- name: delete-archived-subscribers
+DELETE FROM subscribers WHERE archived_at IS NOT NULL AND archived_at < $1;
+
+-- name: delete-stale-subscribers
+-- Deletes a batch of up to $4 subscribers (above subscriber ID $3) all of whose subscriptions
+-- are either unconfirmed double opt-in subscriptions created before $1 or unsubscriptions
+-- made before $2. A NULL $1 or $2 disables the respective rule. Subscribers with any confirmed
+-- or single opt-in subscription are never deleted, and neither are blocklisted subscribers
+-- so that they remain blocklisted. Returns the counts deleted and the last deleted ID.
+WITH stale AS (
+    SELECT sl.subscriber_id AS id, BOOL_OR(sl.status = 'unconfirmed') AS unconfirmed
+    FROM subscriber_lists sl
+    INNER JOIN lists ON (lists.id = sl.list_id)
+    INNER JOIN subscribers ON (subscribers.id = sl.subscriber_id AND subscribers.status != 'blocklisted')
+    WHERE sl.subscriber_id > $3
+    GROUP BY sl.subscriber_id
+    HAVING BOOL_AND(
+        ($1::TIMESTAMP WITH TIME ZONE IS NOT NULL AND sl.status = 'unconfirmed' AND lists.optin = 'double' AND sl.created_at < $1)
+        OR ($2::TIMESTAMP WITH TIME ZONE IS NOT NULL AND sl.status = 'unsubscribed' AND sl.updated_at < $2)
+    )
+    ORDER BY sl.subscriber_id
+    LIMIT $4
+),
+del AS (
+    DELETE FROM subscribers WHERE id IN (SELECT id FROM stale) RETURNING id
+)
+SELECT COUNT(*) FILTER (WHERE stale.unconfirmed) AS unconfirmed,
+    COUNT(*) FILTER (WHERE NOT stale.unconfirmed) AS unsubscribed,
+    COALESCE(MAX(stale.id), 0) AS last_id
+    FROM del INNER JOIN stale ON (stale.id = del.id);
+
+-- name: get-engagement-events
+-- Gets the views and clicks within the last $3 seconds of the next $2 subscribers
+-- after the ID $1 who have any, ordered by subscriber.
+WITH subs AS (
+    SELECT id FROM (
+        SELECT subscriber_id AS id FROM campaign_views
+            WHERE subscriber_id > $1 AND created_at > NOW() - MAKE_INTERVAL(secs => $3)
+        UNION
+        SELECT subscriber_id AS id FROM link_clicks
+            WHERE subscriber_id > $1 AND created_at > NOW() - MAKE_INTERVAL(secs => $3)
+    ) s ORDER BY id LIMIT $2
+)
+SELECT subscriber_id, 'view' AS type, created_at FROM campaign_views
+    WHERE subscriber_id IN (SELECT id FROM subs) AND created_at > NOW() - MAKE_INTERVAL(secs => $3)
+UNION ALL
+SELECT subscriber_id, 'click' AS type, created_at FROM link_clicks
+    WHERE subscriber_id IN (SELECT id FROM subs) AND created_at > NOW() - MAKE_INTERVAL(secs => $3)
+ORDER BY subscriber_id;
+
+-- name: update-engagement-scores
+-- Updates the engagement scores ($2) of the subscribers ($1) whose scores have changed.
+UPDATE subscribers SET engagement_score = s.score FROM UNNEST($1::INT[], $2::REAL[]) AS s(id, score)
+    WHERE subscribers.id = s.id AND subscribers.engagement_score != s.score;
+
+-- name: reset-engagement-scores
+-- Resets the engagement scores of subscribers who have no views or clicks within
+-- the last $1 seconds.
+UPDATE subscribers SET engagement_score = 0 WHERE engagement_score != 0
+    AND NOT EXISTS (SELECT 1 FROM campaign_views WHERE subscriber_id = subscribers.id AND created_at > NOW() - MAKE_INTERVAL(secs => $1))
+    AND NOT EXISTS (SELECT 1 FROM link_clicks WHERE subscriber_id = subscribers.id AND created_at > NOW() - MAKE_INTERVAL(secs => $1));
+
+-- name: insert-suppressions
+-- Adds (lowercased) e-mails to the global suppression list and blocklists the existing
+-- subscribers with them, unsubscribing them from all lists. Returns the number of
+-- e-mails that weren't already on the list.
+WITH emails AS (
+    SELECT DISTINCT e AS email FROM UNNEST($1::TEXT[]) e
+),
+ins AS (
+    INSERT INTO suppressions (email) SELECT email FROM emails
+    ON CONFLICT (email) DO NOTHING
+    RETURNING email
+),
+subs AS (
+    UPDATE subscribers SET status='blocklisted', updated_at=NOW()
+    WHERE LOWER(email) = ANY(SELECT email FROM emails) AND status != 'blocklisted'
+    RETURNING id
+),
+subLists AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
+    WHERE subscriber_id = ANY(SELECT id FROM subs)
+)
+SELECT COUNT(*) FROM ins;
+
+-- name: get-suppressions
+-- Returns a batch of the global suppression list, the suppressed e-mails and the e-mails
+-- of blocklisted subscribers, after the e-mail $1 (keyset pagination).
+SELECT * FROM (
+    SELECT email, blocked, created_at FROM suppressions
+    UNION ALL
+    SELECT LOWER(email), 0, updated_at FROM subscribers WHERE status = 'blocklisted'
+        AND NOT EXISTS (SELECT 1 FROM suppressions WHERE suppressions.email = LOWER(subscribers.email))
+) s WHERE email > $1 ORDER BY email LIMIT $2;
+
+-- name: get-suppression-stats
+SELECT
+    (SELECT COUNT(*) FROM suppressions) +
+    (SELECT COUNT(*) FROM subscribers WHERE status = 'blocklisted'
+        AND NOT EXISTS (SELECT 1 FROM suppressions WHERE suppressions.email = LOWER(subscribers.email))) AS total,
+    (SELECT COALESCE(SUM(blocked), 0) FROM suppressions) AS blocked;
+
+-- name: get-duplicate-subscribers
+-- Get subscribers that share the same non-empty value at the given attribs JSON path,
+-- ordered by the value so that duplicates are grouped together.
+SELECT subscribers.*, attribs #>> $1::TEXT[] AS dedupe_key FROM subscribers
+    WHERE (attribs #>> $1::TEXT[]) IN (
+        SELECT attribs #>> $1::TEXT[] FROM subscribers
+        WHERE COALESCE(attribs #>> $1::TEXT[], '') != ''
+        GROUP BY 1 HAVING COUNT(*) > 1
+    )
+    ORDER BY dedupe_key, created_at, id;
+
+-- name: merge-subscriber-lists
+-- Copy the list subscriptions of the duplicate subscribers ($2) to the primary subscriber ($1).
+-- Where multiple subscriptions to the same list exist, unsubscribed takes precedence
+-- over confirmed, which takes precedence over unconfirmed.
+INSERT INTO subscriber_lists (subscriber_id, list_id, meta, status, created_at)
+    (SELECT DISTINCT ON (list_id) $1, list_id, meta, status, created_at FROM subscriber_lists
+        WHERE subscriber_id = ANY(ARRAY[$1::INT] || $2::INT[])
+        ORDER BY list_id,
+            (CASE status WHEN 'unsubscribed' THEN 0 WHEN 'confirmed' THEN 1 ELSE 2 END),
+            created_at)
+    ON CONFLICT (subscriber_id, list_id) DO UPDATE
+    SET status=EXCLUDED.status, created_at=LEAST(subscriber_lists.created_at, EXCLUDED.created_at), updated_at=NOW();
+
+-- name: merge-subscriber-activity
+-- Reassign the campaign views, link clicks, and sends of the duplicate subscribers ($2)
+-- to the primary subscriber ($1).
+WITH views AS (
+    UPDATE campaign_views SET subscriber_id=$1 WHERE subscriber_id = ANY($2::INT[])
+),
+sends AS (
+    UPDATE subscriber_sends SET subscriber_id=$1 WHERE subscriber_id = ANY($2::INT[])
+)
+UPDATE link_clicks SET subscriber_id=$1 WHERE subscriber_id = ANY($2::INT[]);
+
+-- name: merge-subscriber-attribs
+-- Union the attribs of the primary subscriber ($1) and the duplicates ($2) on to the primary,
+-- where the primary's top level keys take precedence over the duplicates', and retain
+-- the earliest created_at.
+WITH subs AS (
+    SELECT * FROM subscribers WHERE id = ANY(ARRAY[$1::INT] || $2::INT[])
+),
+merged AS (
+    SELECT COALESCE(JSONB_OBJECT_AGG(key, value), '{}') AS attribs FROM (
+        SELECT DISTINCT ON (key) key, value FROM subs, JSONB_EACH(subs.attribs)
+        ORDER BY key, (subs.id = $1) DESC, subs.created_at, subs.id
+    ) a
+)
+UPDATE subscribers SET
+    attribs=(SELECT attribs FROM merged),
+    created_at=(SELECT MIN(created_at) FROM subs),
+    updated_at=NOW()
+    WHERE id = $1;
+
 -- name: blocklist-subscribers
 WITH b AS (
     UPDATE subscribers SET status='blocklisted', updated_at=NOW()
@@ -219,7 +429,7 @@ WITH subID AS (
 listIDs AS (
     SELECT id FROM lists WHERE uuid = ANY($2::UUID[])
 )
-UPDATE subscriber_lists SET status='confirmed', meta=meta || $3, updated_at=NOW()
+UPDATE subscriber_lists SET status='confirmed', meta=meta || $3, reconfirm_by=NULL, updated_at=NOW()
     WHERE subscriber_id = (SELECT id FROM subID) AND list_id = ANY(SELECT id FROM listIDs);
 
 -- name: unsubscribe-subscribers-from-lists
@@ -236,10 +446,17 @@ UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
 -- Unsubscribes a subscriber given a campaign UUID (from all the lists in the campaign) and the subscriber UUID.
 -- If $3 is TRUE, then all subscriptions of the subscriber is blocklisted
 -- and all existing subscriptions, irrespective of lists, unsubscribed.
+-- If $4 is TRUE, all existing subscriptions are unsubscribed without blocklisting.
 WITH lists AS (
     SELECT list_id FROM campaign_lists
     LEFT JOIN campaigns ON (campaign_lists.campaign_id = campaigns.id)
     WHERE campaigns.uuid = $1
+    UNION
+    -- The lists of the list group that the campaign targets, as the campaign is sent
+    -- to them. Archived lists are included as they may have been archived since.
+    SELECT lists.id AS list_id FROM lists
+    INNER JOIN campaigns ON (campaigns.list_group_id IN (lists.id, lists.parent_id))
+    WHERE campaigns.uuid = $1
 ),
 sub AS (
     UPDATE subscribers SET status = (CASE WHEN $3 IS TRUE THEN 'blocklisted' ELSE status END)
@@ -247,8 +464,8 @@ sub AS (
 )
 UPDATE subscriber_lists SET status = 'unsubscribed', updated_at=NOW() WHERE
     subscriber_id = (SELECT id FROM sub) AND status != 'unsubscribed' AND
-    -- If $3 is false, unsubscribe from the campaign's lists, otherwise all lists.
-    CASE WHEN $3 IS FALSE THEN list_id = ANY(SELECT list_id FROM lists) ELSE list_id != 0 END;
+    -- If $3 and $4 are false, unsubscribe from the campaign's lists, otherwise all lists.
+    CASE WHEN $3 IS FALSE AND $4 IS FALSE THEN list_id = ANY(SELECT list_id FROM lists) ELSE list_id != 0 END;
 
 -- name: delete-unconfirmed-subscriptions
 WITH optins AS (
@@ -257,6 +474,52 @@ WITH optins AS (
 DELETE FROM subscriber_lists
     WHERE status = 'unconfirmed' AND list_id IN (SELECT id FROM optins) AND created_at < $1;
 
+-- name: get-optin-reminder-subscriptions
+-- Returns a batch of subscribers (above subscriber ID $3) with unconfirmed double opt-in
+-- subscriptions that haven't been updated (subscribed or reminded) since $1 and have
+-- received fewer than $2 reminders, along with the IDs of such lists.
+SELECT subscriber_lists.subscriber_id, ARRAY_AGG(subscriber_lists.list_id)::INT[] AS list_ids FROM subscriber_lists
+    INNER JOIN lists ON (lists.id = subscriber_lists.list_id AND lists.optin = 'double')
+    INNER JOIN subscribers ON (subscribers.id = subscriber_lists.subscriber_id AND subscribers.status != 'blocklisted')
+    WHERE subscriber_lists.status = 'unconfirmed' AND subscriber_lists.updated_at < $1
+    AND subscriber_lists.optin_reminders < $2 AND subscriber_lists.subscriber_id > $3
+    GROUP BY subscriber_lists.subscriber_id
+    ORDER BY subscriber_lists.subscriber_id LIMIT $4;
+
+-- name: update-optin-reminders
+UPDATE subscriber_lists SET optin_reminders = optin_reminders + 1, updated_at = NOW()
+    WHERE subscriber_id = $1 AND list_id = ANY($2::INT[]) AND status = 'unconfirmed';
+
+-- name: delete-expired-optin-subscriptions
+-- Deletes unconfirmed double opt-in subscriptions that have received $2 reminders
+-- and haven't been confirmed since the last one ($1).
+WITH optins AS (
+    SELECT id FROM lists WHERE optin = 'double'
+)
+DELETE FROM subscriber_lists
+    WHERE status = 'unconfirmed' AND list_id IN (SELECT id FROM optins)
+    AND optin_reminders >= $2 AND updated_at < $1
+    -- Subscriptions pending re-confirmation are unsubscribed at their deadline instead.
+    AND reconfirm_by IS NULL;
+
+-- name: start-list-reconfirmation
+-- Marks the confirmed subscriptions of a list as pending re-confirmation by the deadline ($2).
+UPDATE subscriber_lists SET status='unconfirmed', reconfirm_by=$2, optin_reminders=0, updated_at=NOW()
+    WHERE list_id = $1 AND status = 'confirmed';
+
+-- name: get-list-reconfirmation-subscribers
+-- Returns a batch of subscriber IDs (above $2) with subscriptions to a list ($1) pending re-confirmation.
+SELECT subscriber_lists.subscriber_id FROM subscriber_lists
+    INNER JOIN subscribers ON (subscribers.id = subscriber_lists.subscriber_id AND subscribers.status != 'blocklisted')
+    WHERE subscriber_lists.list_id = $1 AND subscriber_lists.status = 'unconfirmed'
+    AND subscriber_lists.reconfirm_by IS NOT NULL AND subscriber_lists.subscriber_id > $2
+    ORDER BY subscriber_lists.subscriber_id LIMIT $3;
+
+-- name: expire-reconfirmations
+-- Unsubscribes subscriptions that weren't re-confirmed by their deadline.
+UPDATE subscriber_lists SET status='unsubscribed', reconfirm_by=NULL, updated_at=NOW()
+    WHERE reconfirm_by IS NOT NULL AND reconfirm_by <= NOW() AND status = 'unconfirmed';
+
 -- privacy
 -- name: export-subscriber-data
 WITH prof AS (
@@ -324,6 +587,19 @@ SELECT COUNT(*) AS total FROM subscribers
     )
     WHERE (CARDINALITY($1) = 0 OR subscriber_lists.list_id = ANY($1::INT[])) %s;
 
+-- name: search-subscribers
+-- raw: true
+-- Structured subscriber search. %query% = parameterized conditions built from
+-- models.SubscriberSearch, %order% = order by field and direction,
+-- %offset% and %limit% = placeholders of the args that follow the conditions' args.
+SELECT subscribers.* FROM subscribers WHERE TRUE %query%
+    ORDER BY %order% OFFSET %offset% LIMIT (CASE WHEN %limit%::INT < 1 THEN NULL ELSE %limit%::INT END);
+
+-- name: search-subscribers-count
+-- raw: true
+-- Replica of search-subscribers for obtaining the results count.
+SELECT COUNT(*) AS total FROM subscribers WHERE TRUE %query%;
+
 -- name: query-subscribers-count-all
 -- Cached query for getting the "all" subscriber count without arbitrary conditions.
 SELECT COALESCE(SUM(subscriber_count), 0) AS total FROM mat_list_subscriber_stats
@@ -356,6 +632,117 @@ SELECT subscribers.id,
     %query%
     ORDER BY subscribers.id ASC LIMIT (CASE WHEN $5 < 1 THEN NULL ELSE $5 END);
 
+-- name: export-subscriber-dossier
+-- Complete data of a subscriber (regardless of status) for data subject access requests.
+-- Campaigns received are the campaigns sent to the subscriber's lists that have processed
+-- the subscriber's ID (campaigns are sent in the order of subscriber IDs), and the ones viewed.
+WITH prof AS (
+    SELECT id, uuid, email, name, attribs, status, created_at, updated_at FROM subscribers WHERE email = LOWER($1)
+),
+subs AS (
+    SELECT lists.id, lists.uuid, lists.name, lists.type, subscriber_lists.status AS subscription_status,
+        subscriber_lists.meta, subscriber_lists.created_at, subscriber_lists.updated_at
+    FROM subscriber_lists
+    JOIN lists ON (lists.id = subscriber_lists.list_id)
+    WHERE subscriber_lists.subscriber_id = (SELECT id FROM prof)
+    ORDER BY lists.id
+),
+camps AS (
+    SELECT id, uuid, name, subject, started_at FROM campaigns
+    WHERE (
+        status IN ('running', 'paused', 'finished', 'cancelled')
+        AND last_subscriber_id >= (SELECT id FROM prof)
+        AND id IN (SELECT campaign_id FROM campaign_lists WHERE list_id IN
+            (SELECT list_id FROM subscriber_lists WHERE subscriber_id = (SELECT id FROM prof)))
+    )
+    OR id IN (SELECT campaign_id FROM campaign_views WHERE subscriber_id = (SELECT id FROM prof))
+    ORDER BY id
+),
+views AS (
+    SELECT campaign_views.campaign_id, campaigns.name AS campaign, campaign_views.created_at FROM campaign_views
+    LEFT JOIN campaigns ON (campaigns.id = campaign_views.campaign_id)
+    WHERE campaign_views.subscriber_id = (SELECT id FROM prof)
+    ORDER BY campaign_views.id
+),
+clicks AS (
+    SELECT link_clicks.campaign_id, campaigns.name AS campaign, links.url, link_clicks.created_at FROM link_clicks
+    LEFT JOIN links ON (links.id = link_clicks.link_id)
+    LEFT JOIN campaigns ON (campaigns.id = link_clicks.campaign_id)
+    WHERE link_clicks.subscriber_id = (SELECT id FROM prof)
+    ORDER BY link_clicks.id
+),
+bnc AS (
+    SELECT bounces.campaign_id, campaigns.name AS campaign, bounces.type, bounces.source, bounces.meta, bounces.created_at FROM bounces
+    LEFT JOIN campaigns ON (campaigns.id = bounces.campaign_id)
+    WHERE bounces.subscriber_id = (SELECT id FROM prof)
+    ORDER BY bounces.id
+)
+SELECT JSON_BUILD_OBJECT(
+    'profile', (SELECT ROW_TO_JSON(t) FROM prof t),
+    'subscriptions', COALESCE((SELECT JSON_AGG(t) FROM subs t), '[]'),
+    'campaigns', COALESCE((SELECT JSON_AGG(t) FROM camps t), '[]'),
+    'campaign_views', COALESCE((SELECT JSON_AGG(t) FROM views t), '[]'),
+    'link_clicks', COALESCE((SELECT JSON_AGG(t) FROM clicks t), '[]'),
+    'bounces', COALESCE((SELECT JSON_AGG(t) FROM bnc t), '[]')
+) AS data FROM prof;
+
+-- name: get-subscriber-for-erasure
+SELECT id FROM subscribers WHERE email = LOWER($1) FOR UPDATE;
+
+-- name: anonymize-subscriber-activity
+-- Detaches the subscriber from campaign views, link clicks, and transactional messages
+-- so that the aggregate campaign stats are retained after the subscriber is erased.
+WITH views AS (
+    UPDATE campaign_views SET subscriber_id = NULL WHERE subscriber_id = $1 RETURNING 1
+),
+clicks AS (
+    UPDATE link_clicks SET subscriber_id = NULL WHERE subscriber_id = $1 RETURNING 1
+),
+tx AS (
+    UPDATE tx_messages SET subscriber_id = NULL WHERE subscriber_id = $1 RETURNING 1
+)
+SELECT (SELECT COUNT(*) FROM views) AS campaign_views,
+    (SELECT COUNT(*) FROM clicks) AS link_clicks,
+    (SELECT COUNT(*) FROM tx) AS tx_messages;
+
+-- name: erase-subscriber-data
+-- Deletes the subscriber's subscriptions, bounces, and bounce actions and records
+-- a tombstone with the hash ($2) of the subscriber's e-mail.
+WITH subs AS (
+    DELETE FROM subscriber_lists WHERE subscriber_id = $1 RETURNING 1
+),
+bnc AS (
+    DELETE FROM bounces WHERE subscriber_id = $1 RETURNING 1
+),
+actions AS (
+    DELETE FROM bounce_rule_actions WHERE subscriber_id = $1 RETURNING 1
+),
+tomb AS (
+    INSERT INTO subscriber_tombstones (hash) VALUES($2)
+    ON CONFLICT (hash) DO UPDATE SET created_at = NOW()
+)
+SELECT (SELECT COUNT(*) FROM subs) AS subscriptions,
+    (SELECT COUNT(*) FROM bnc) AS bounces,
+    (SELECT COUNT(*) FROM actions) AS bounce_actions;
+
+-- name: get-subscriptions-for-export
+-- Returns all list subscriptions of the given subscribers with their statuses for the full export.
+-- subscribed_at is when the subscription was created and status_updated_at is when its status last changed.
+SELECT subscriber_lists.subscriber_id,
+    JSON_AGG(JSON_BUILD_OBJECT(
+        'id', lists.id,
+        'uuid', lists.uuid,
+        'name', lists.name,
+        'subscription_status', subscriber_lists.status,
+        'meta', subscriber_lists.meta,
+        'subscribed_at', subscriber_lists.created_at,
+        'status_updated_at', subscriber_lists.updated_at
+    ) ORDER BY lists.id) AS lists
+FROM subscriber_lists
+JOIN lists ON (lists.id = subscriber_lists.list_id)
+WHERE subscriber_lists.subscriber_id = ANY($1::INT[])
+GROUP BY subscriber_lists.subscriber_id;
+
 -- name: query-subscribers-template
 -- raw: true
 -- This raw query is reused in multiple queries (blocklist, add to list, delete)
@@ -382,13 +769,41 @@ DELETE FROM subscribers WHERE id=ANY(SELECT id FROM subs);
 
 -- name: blocklist-subscribers-by-query
 -- raw: true
+-- Blocklists a batch of at most $4 subscribers matching the query whose IDs are after $3
+-- and unsubscribes them from their lists. Returns the last ID in the batch (NULL if there
+-- are no more subscribers) and the IDs of the subscribers who were blocklisted.
 WITH subs AS (%s),
+batch AS (
+    SELECT DISTINCT id FROM subs WHERE id > $3 ORDER BY id LIMIT $4
+),
 b AS (
     UPDATE subscribers SET status='blocklisted', updated_at=NOW()
-    WHERE id = ANY(SELECT id FROM subs)
+    WHERE id = ANY(SELECT id FROM batch) AND status != 'blocklisted'
+    RETURNING id
+),
+u AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
+    WHERE subscriber_id = ANY(SELECT id FROM batch) AND status != 'unsubscribed'
 )
-UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
-    WHERE subscriber_id = ANY(SELECT id FROM subs);
+SELECT (SELECT MAX(id) FROM batch) AS last_id, ARRAY(SELECT id FROM b) AS ids;
+
+-- name: unblocklist-subscribers-by-query
+-- raw: true
+-- Enables a batch of at most $4 blocklisted subscribers matching the query whose IDs are
+-- after $3. Their subscriptions remain unsubscribed. Subscribers whose e-mails are on the
+-- suppression list stay blocklisted. Returns the last ID in the batch (NULL if there are
+-- no more subscribers) and the IDs of the subscribers who were unblocklisted.
+WITH subs AS (%s),
+batch AS (
+    SELECT DISTINCT id FROM subs WHERE id > $3 ORDER BY id LIMIT $4
+),
+b AS (
+    UPDATE subscribers SET status='enabled', updated_at=NOW()
+    WHERE id = ANY(SELECT id FROM batch) AND status = 'blocklisted'
+    AND NOT EXISTS (SELECT 1 FROM suppressions WHERE email = LOWER(subscribers.email))
+    RETURNING id
+)
+SELECT (SELECT MAX(id) FROM batch) AS last_id, ARRAY(SELECT id FROM b) AS ids;
 
 -- name: add-subscribers-to-lists-by-query
 -- raw: true
@@ -412,7 +827,17 @@ UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
 
 -- lists
 -- name: get-lists
-SELECT * FROM lists WHERE (CASE WHEN $1 = '' THEN 1=1 ELSE type=$1::list_type END)
+WITH statuses AS (
+    SELECT list_id,
+        COALESCE(JSONB_OBJECT_AGG(status, subscriber_count) FILTER (WHERE subscriber_count > 0), '{}') AS subscriber_statuses,
+        MIN(updated_at) AS subscriber_counts_updated_at
+    FROM list_subscriber_counts
+    GROUP BY list_id
+)
+SELECT lists.*, COALESCE(ss.subscriber_statuses, '{}') AS subscriber_statuses, ss.subscriber_counts_updated_at
+    FROM lists LEFT JOIN statuses ss ON (ss.list_id = lists.id)
+    WHERE (CASE WHEN $1 = '' THEN 1=1 ELSE type=$1::list_type END)
+    AND ($3 OR NOT archived)
     ORDER BY CASE WHEN $2 = 'id' THEN id END, CASE WHEN $2 = 'name' THEN name END;
 
 -- name: query-lists
@@ -427,18 +852,43 @@ WITH ls AS (
     AND ($4 = '' OR type = $4::list_type)
     AND ($5 = '' OR optin = $5::list_optin)
     AND (CARDINALITY($6::VARCHAR(100)[]) = 0 OR $6 <@ tags)
+    AND ($9 OR NOT archived)
     OFFSET $7 LIMIT (CASE WHEN $8 < 1 THEN NULL ELSE $8 END)
 ),
 statuses AS (
     SELECT
         list_id,
-        COALESCE(JSONB_OBJECT_AGG(status, subscriber_count) FILTER (WHERE status IS NOT NULL), '{}') AS subscriber_statuses
-    FROM mat_list_subscriber_stats
+        COALESCE(JSONB_OBJECT_AGG(status, subscriber_count) FILTER (WHERE subscriber_count > 0), '{}') AS subscriber_statuses,
+        MIN(updated_at) AS subscriber_counts_updated_at
+    FROM list_subscriber_counts
     GROUP BY list_id
 )
-SELECT ls.*, COALESCE(ss.subscriber_statuses, '{}') AS subscriber_statuses
+SELECT ls.*, COALESCE(ss.subscriber_statuses, '{}') AS subscriber_statuses, ss.subscriber_counts_updated_at
     FROM ls LEFT JOIN statuses ss ON (ls.id = ss.list_id) ORDER BY %order%;
 
+-- name: get-queued-list-counts
+-- Dequeues the lists whose subscriptions have changed since their counts were last computed.
+DELETE FROM list_counts_queue RETURNING list_id;
+
+-- name: refresh-list-subscriber-counts
+-- Recomputes the per-status subscriber counts of the given lists, or all lists if $1 is true.
+-- Archived subscribers are excluded.
+WITH ids AS (
+    SELECT id FROM lists WHERE $1 OR id = ANY($2::INT[])
+),
+counts AS (
+    SELECT list_id, status, COUNT(*) AS num FROM subscriber_lists
+    WHERE list_id IN (SELECT id FROM ids)
+    AND NOT EXISTS (SELECT 1 FROM subscribers WHERE subscribers.id = subscriber_lists.subscriber_id AND subscribers.archived_at IS NOT NULL)
+    GROUP BY list_id, status
+)
+INSERT INTO list_subscriber_counts (list_id, status, subscriber_count, updated_at)
+    SELECT ids.id, s.status, COALESCE(counts.num, 0), NOW()
+    FROM ids CROSS JOIN UNNEST(ENUM_RANGE(NULL::subscription_status)) AS s(status)
+    LEFT JOIN counts ON (counts.list_id = ids.id AND counts.status = s.status)
+ON CONFLICT (list_id, status) DO UPDATE
+    SET subscriber_count = EXCLUDED.subscriber_count, updated_at = EXCLUDED.updated_at;
+
 -- name: get-lists-by-optin
 -- Can have a list of IDs or a list of UUIDs.
 SELECT * FROM lists WHERE (CASE WHEN $1 != '' THEN optin=$1::list_optin ELSE TRUE END) AND
@@ -447,7 +897,21 @@ SELECT * FROM lists WHERE (CASE WHEN $1 != '' THEN optin=$1::list_optin ELSE TRU
     END) ORDER BY name;
 
 -- name: create-list
-INSERT INTO lists (uuid, name, type, optin, tags, description) VALUES($1, $2, $3, $4, $5, $6) RETURNING id;
+INSERT INTO lists (uuid, name, type, optin, tags, description, max_subscriber_messages, parent_id, from_email, from_name, language)
+    VALUES($1, $2, $3, $4, $5, $6, $7, NULLIF($8::INT, 0), $9, $10, $11) RETURNING id;
+
+-- name: update-list-parent
+UPDATE lists SET parent_id=NULLIF($2::INT, 0), updated_at=NOW() WHERE id = $1;
+
+-- name: get-list-group-ids
+-- Returns the IDs of a list group, that is, the list and its child lists.
+SELECT id FROM lists WHERE id = $1 OR parent_id = $1 ORDER BY id;
+
+-- name: update-list-template
+UPDATE lists SET template_id=NULLIF($2::INT, 0), updated_at=NOW() WHERE id = $1;
+
+-- name: update-list-track-views
+UPDATE lists SET track_views=$2, updated_at=NOW() WHERE id = $1;
 
 -- name: update-list
 UPDATE lists SET
@@ -456,9 +920,16 @@ UPDATE lists SET
     optin=(CASE WHEN $4 != '' THEN $4::list_optin ELSE optin END),
     tags=$5::VARCHAR(100)[],
     description=(CASE WHEN $6 != '' THEN $6 ELSE description END),
+    max_subscriber_messages=$7,
+    from_email=$8,
+    from_name=$9,
+    language=$10,
     updated_at=NOW()
 WHERE id = $1;
 
+-- name: update-list-archived
+UPDATE lists SET archived=$2, updated_at=NOW() WHERE id = $1;
+
 -- name: update-lists-date
 UPDATE lists SET updated_at=NOW() WHERE id = ANY($1);
 
@@ -493,14 +964,24 @@ counts AS (
         (CASE WHEN campLists.optin = 'double' THEN subscriber_lists.status = 'confirmed' ELSE true END)
     )
     WHERE subscriber_lists.list_id=ANY($14::INT[])
-    AND subscribers.status='enabled'
+    AND subscribers.status='enabled' AND subscribers.archived_at IS NULL
+    -- Exclude the subscribers on the exclusion lists and the recipients of the excluded campaigns.
+    AND NOT EXISTS (
+        SELECT 1 FROM subscriber_lists ex WHERE ex.subscriber_id = subscribers.id
+        AND ex.list_id = ANY(COALESCE($21::INT[], '{}')) AND ex.status != 'unsubscribed'
+    )
+    AND NOT EXISTS (
+        SELECT 1 FROM campaign_deliveries cd WHERE cd.subscriber_id = subscribers.id
+        AND cd.campaign_id = ANY(COALESCE($22::INT[], '{}'))
+    )
 ),
 camp AS (
-    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, headers, tags, messenger, template_id, to_send, max_subscriber_id, archive, archive_slug, archive_template_id, archive_meta)
+    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, headers, tags, messenger, template_id, to_send, max_subscriber_id, archive, archive_slug, archive_template_id, archive_meta, amp_body, exclude_list_ids, exclude_campaign_ids, per_list_copies, preheader, utm)
         SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12,
             (SELECT id FROM tpl), (SELECT to_send FROM counts),
             (SELECT max_sub_id FROM counts), $15, $16,
-            (CASE WHEN $17 = 0 THEN (SELECT id FROM tpl) ELSE $17 END), $18
+            (CASE WHEN $17 = 0 THEN (SELECT id FROM tpl) ELSE $17 END), $18,
+            NULLIF($20, ''), COALESCE($21::INT[], '{}'), COALESCE($22::INT[], '{}'), $23, NULLIF($24, ''), COALESCE($25, '{}')
         RETURNING id
 ),
 med AS (
@@ -522,9 +1003,9 @@ SELECT id FROM camp;
 -- with every resultant row.
 SELECT  c.id, c.uuid, c.name, c.subject, c.from_email,
         c.messenger, c.started_at, c.to_send, c.sent, c.type,
-        c.body, c.altbody, c.send_at, c.headers, c.status, c.content_type, c.tags,
+        c.body, c.altbody, c.amp_body, c.send_at, c.headers, c.status, c.content_type, c.tags,
         c.template_id, c.archive, c.archive_slug, c.archive_template_id, c.archive_meta,
-        c.created_at, c.updated_at,
+        c.priority, c.approval_status, c.approval_reason, c.revision, c.utm, c.created_at, c.updated_at,
         COUNT(*) OVER () AS total,
         (
             SELECT COALESCE(ARRAY_TO_JSON(ARRAY_AGG(l)), '[]') FROM (
@@ -542,12 +1023,20 @@ ORDER BY %order% OFFSET $5 LIMIT (CASE WHEN $6 < 1 THEN NULL ELSE $6 END);
 
 -- name: get-campaign
 SELECT campaigns.*,
-    COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body
+    COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body,
+    COALESCE(listFrom.from_email, '') AS list_from_email, COALESCE(listFrom.from_name, '') AS list_from_name
     FROM campaigns
     LEFT JOIN templates ON (
         CASE WHEN $4 = 'default' THEN templates.id = campaigns.template_id
         ELSE templates.id = campaigns.archive_template_id END
     )
+    LEFT JOIN LATERAL (
+        -- The sending identity of the campaign's list if it targets a single list.
+        SELECT lists.from_email, lists.from_name FROM campaign_lists
+        INNER JOIN lists ON (lists.id = campaign_lists.list_id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND campaigns.list_group_id IS NULL
+        AND (SELECT COUNT(*) FROM campaign_lists cl WHERE cl.campaign_id = campaigns.id) = 1
+    ) listFrom ON TRUE
     WHERE CASE
             WHEN $1 > 0 THEN campaigns.id = $1
             WHEN $3 != '' THEN campaigns.archive_slug = $3
@@ -592,19 +1081,29 @@ bounces AS (
     SELECT campaign_id, COUNT(campaign_id) as num FROM bounces
     WHERE campaign_id = ANY($1)
     GROUP BY campaign_id
+),
+tracked AS (
+    -- Views are tracked if tracking is enabled on the campaign and all of its lists.
+    SELECT id AS campaign_id, (track_views AND NOT EXISTS (
+        SELECT 1 FROM campaign_lists INNER JOIN lists ON (lists.id = campaign_lists.list_id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND NOT lists.track_views
+    )) AS tracked FROM campaigns
+    WHERE id = ANY($1)
 )
 SELECT id as campaign_id,
     COALESCE(v.num, 0) AS views,
     COALESCE(c.num, 0) AS clicks,
     COALESCE(b.num, 0) AS bounces,
     COALESCE(l.lists, '[]') AS lists,
-    COALESCE(m.media, '[]') AS media
+    COALESCE(m.media, '[]') AS media,
+    COALESCE(t.tracked, false) AS views_tracked
 FROM (SELECT id FROM UNNEST($1) AS id) x
 LEFT JOIN lists AS l ON (l.campaign_id = id)
 LEFT JOIN media AS m ON (m.campaign_id = id)
 LEFT JOIN views AS v ON (v.campaign_id = id)
 LEFT JOIN clicks AS c ON (c.campaign_id = id)
 LEFT JOIN bounces AS b ON (b.campaign_id = id)
+LEFT JOIN tracked AS t ON (t.campaign_id = id)
 ORDER BY ARRAY_POSITION($1, id);
 
 -- name: get-campaign-for-preview
@@ -623,7 +1122,7 @@ WHERE campaigns.id = $1;
 -- name: get-campaign-status
 SELECT id, status, to_send, sent, started_at, updated_at
     FROM campaigns
-    WHERE status=$1;
+    WHERE status = ANY($1::campaign_status[]);
 
 -- name: next-campaigns
 -- Retreives campaigns that are running (or scheduled and the time's up) and need
@@ -634,17 +1133,32 @@ SELECT id, status, to_send, sent, started_at, updated_at
 -- a campaign. This is used to fetch and slice subscribers for the campaign in next-campaign-subscribers.
 WITH camps AS (
     -- Get all running campaigns and their template bodies (if the template's deleted, the default template body instead)
-    SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body
+    SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body,
+        COALESCE(listFrom.from_email, '') AS list_from_email, COALESCE(listFrom.from_name, '') AS list_from_name
     FROM campaigns
     LEFT JOIN templates ON (templates.id = campaigns.template_id)
+    LEFT JOIN LATERAL (
+        -- The sending identity of the campaign's list if it targets a single list.
+        SELECT lists.from_email, lists.from_name FROM campaign_lists
+        INNER JOIN lists ON (lists.id = campaign_lists.list_id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND campaigns.list_group_id IS NULL
+        AND (SELECT COUNT(*) FROM campaign_lists cl WHERE cl.campaign_id = campaigns.id) = 1
+    ) listFrom ON TRUE
     WHERE (status='running' OR (status='scheduled' AND NOW() >= campaigns.send_at))
     AND NOT(campaigns.id = ANY($1::INT[]))
+    -- Skip campaigns whose A/B variant sample has been sent and are waiting for the sample window to end.
+    AND (campaigns.variant_sample_ends_at IS NULL OR campaigns.variant_sample_ends_at <= NOW())
 ),
 campLists AS (
     -- Get the list_ids and their optin statuses for the campaigns found in the previous step.
-    SELECT lists.id AS list_id, campaign_id, optin FROM lists
+    SELECT lists.id AS list_id, campaign_id, optin, lists.track_views FROM lists
     INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
     WHERE campaign_lists.campaign_id = ANY(SELECT id FROM camps)
+    UNION
+    -- The (non-archived) lists of the list groups that the campaigns target.
+    SELECT lists.id AS list_id, camps.id AS campaign_id, optin, lists.track_views FROM lists
+    INNER JOIN camps ON (camps.list_group_id IN (lists.id, lists.parent_id))
+    WHERE NOT lists.archived
 ),
 campMedia AS (
     -- Get the list_ids and their optin statuses for the campaigns found in the previous step.
@@ -656,12 +1170,32 @@ counts AS (
     -- For each campaign above, get the total number of subscribers and the max_subscriber_id
     -- across all its lists.
     SELECT id AS campaign_id,
-                 COUNT(DISTINCT(subscriber_lists.subscriber_id)) AS to_send,
+                 (CASE WHEN BOOL_OR(camps.per_list_copies) THEN COUNT(subscriber_lists.subscriber_id)
+                     ELSE COUNT(DISTINCT(subscriber_lists.subscriber_id)) END) AS to_send,
                  COALESCE(MAX(subscriber_lists.subscriber_id), 0) AS max_subscriber_id
     FROM camps
     LEFT JOIN campLists ON (campLists.campaign_id = camps.id)
     LEFT JOIN subscriber_lists ON (
         subscriber_lists.list_id = campLists.list_id AND
+
+        -- Exclude archived subscribers.
+        NOT EXISTS (SELECT 1 FROM subscribers WHERE subscribers.id = subscriber_lists.subscriber_id AND subscribers.archived_at IS NOT NULL) AND
+
+        -- Exclude the subscribers on the campaign's exclusion lists and the recipients of its excluded campaigns.
+        NOT EXISTS (
+            SELECT 1 FROM subscriber_lists ex WHERE ex.subscriber_id = subscriber_lists.subscriber_id
+            AND ex.list_id = ANY(camps.exclude_list_ids) AND ex.status != 'unsubscribed'
+        ) AND
+        NOT EXISTS (
+            SELECT 1 FROM campaign_deliveries cd WHERE cd.subscriber_id = subscriber_lists.subscriber_id
+            AND cd.campaign_id = ANY(camps.exclude_campaign_ids)
+        ) AND
+
+        -- Triggered runs are only sent to their recipients.
+        (NOT camps.triggered OR EXISTS (
+            SELECT 1 FROM campaign_recipients WHERE campaign_recipients.campaign_id = camps.id
+            AND campaign_recipients.subscriber_id = subscriber_lists.subscriber_id
+        )) AND
         (CASE
             -- For optin campaigns, only e-mail 'unconfirmed' subscribers belonging to 'double' optin lists.
             WHEN camps.type = 'optin' THEN subscriber_lists.status = 'unconfirmed' AND campLists.optin = 'double'
@@ -692,7 +1226,13 @@ u AS (
     FROM (SELECT * FROM counts) co
     WHERE ca.id = co.campaign_id
 )
-SELECT camps.*, campMedia.media_id FROM camps LEFT JOIN campMedia ON (campMedia.campaign_id = camps.id);
+SELECT camps.*, campMedia.media_id,
+    -- Views are tracked if tracking is enabled on the campaign and all of its lists.
+    (camps.track_views AND NOT EXISTS (
+        SELECT 1 FROM campLists WHERE campLists.campaign_id = camps.id AND NOT campLists.track_views
+    )) AS views_tracked
+    FROM camps LEFT JOIN campMedia ON (campMedia.campaign_id = camps.id)
+    ORDER BY camps.priority DESC, camps.id;
 
 -- name: get-campaign-analytics-unique-counts
 WITH intval AS (
@@ -719,6 +1259,17 @@ SELECT campaign_id, COUNT(*) AS "count", DATE_TRUNC((SELECT * FROM intval), crea
     WHERE campaign_id=ANY($1) AND created_at >= $2 AND created_at <= $3
     GROUP BY campaign_id, "timestamp" ORDER BY "timestamp" ASC;
 
+-- name: get-campaign-analytics-series
+-- raw: true
+-- Bucket the views or clicks (%s) of a single campaign into intervals ($4 = hour|day)
+-- of the time zone $5. The date range is applied on the raw created_at column
+-- so that the (campaign_id, created_at) index is used for a range scan.
+SELECT DATE_TRUNC($4::TEXT, created_at AT TIME ZONE $5::TEXT) AT TIME ZONE $5::TEXT AS "timestamp",
+    COUNT(*) AS "count"
+    FROM %s
+    WHERE campaign_id = $1 AND created_at >= $2 AND created_at < $3
+    GROUP BY 1 ORDER BY 1 ASC;
+
 -- name: get-campaign-bounce-counts
 WITH intval AS (
     -- For intervals < a week, aggregate counts hourly, otherwise daily.
@@ -743,12 +1294,17 @@ SELECT COUNT(%s) AS "count", url
 -- (last_subscriber_id). Every fetch updates the checkpoint and the sent count, which means
 -- every fetch returns a new batch of subscribers until all rows are exhausted.
 WITH camps AS (
-    SELECT last_subscriber_id, max_subscriber_id, type FROM campaigns WHERE id = $1 AND status='running'
+    SELECT last_subscriber_id, max_subscriber_id, type, triggered
+    FROM campaigns WHERE id = $1 AND status='running'
 ),
 campLists AS (
     SELECT lists.id AS list_id, optin FROM lists
     LEFT JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
     WHERE campaign_lists.campaign_id = $1
+    UNION
+    -- The (non-archived) lists of the list group that the campaign targets.
+    SELECT id AS list_id, optin FROM lists
+    WHERE (SELECT list_group_id FROM campaigns WHERE id = $1) IN (id, parent_id) AND NOT archived
 ),
 subIDs AS (
     SELECT DISTINCT ON (subscriber_lists.subscriber_id) subscriber_id, list_id, status FROM subscriber_lists
@@ -758,28 +1314,108 @@ subIDs AS (
         list_id = ANY((SELECT ARRAY_AGG(list_id) FROM campLists)::INT[]) AND
         status != 'unsubscribed' AND
         subscriber_id > (SELECT last_subscriber_id FROM camps) AND
-        subscriber_id <= (SELECT max_subscriber_id FROM camps)
+        subscriber_id <= (SELECT max_subscriber_id FROM camps) AND
+        -- Triggered runs are only sent to their recipients.
+        (NOT (SELECT triggered FROM camps) OR subscriber_id IN (
+            SELECT subscriber_id FROM campaign_recipients WHERE campaign_id = $1
+        )) AND
+        -- Skip subscribers who have already been sent the campaign before it was
+        -- resumed from an earlier checkpoint.
+        NOT EXISTS (
+            SELECT 1 FROM campaign_deliveries WHERE campaign_id = $1 AND campaign_deliveries.subscriber_id = subscriber_lists.subscriber_id
+        )
     ORDER BY subscriber_id LIMIT $2
 ),
 subs AS (
-    SELECT subscribers.* FROM subIDs
-    LEFT JOIN campLists ON (campLists.list_id = subIDs.list_id)
+    -- A row for every qualifying subscription of a subscriber on multiple target
+    -- lists. The manager sends a single message, or if the campaign sends per-list
+    -- copies, a message for every row.
+    SELECT DISTINCT ON (subscribers.id, sl.list_id)
+        subscribers.* FROM subIDs
+    INNER JOIN subscriber_lists sl ON (sl.subscriber_id = subIDs.subscriber_id)
+    INNER JOIN campLists ON (campLists.list_id = sl.list_id)
     INNER JOIN subscribers ON (
         subscribers.status != 'blocklisted' AND
+        subscribers.archived_at IS NULL AND
         subscribers.id = subIDs.subscriber_id AND
+        NOT EXISTS (SELECT 1 FROM suppressions WHERE suppressions.email = LOWER(subscribers.email)) AND
 
         (CASE
             -- For optin campaigns, only e-mail 'unconfirmed' subscribers.
-            WHEN (SELECT type FROM camps) = 'optin' THEN subIDs.status = 'unconfirmed' AND campLists.optin = 'double'
+            WHEN (SELECT type FROM camps) = 'optin' THEN sl.status = 'unconfirmed' AND campLists.optin = 'double'
 
             -- For regular campaigns with double optin lists, only e-mail 'confirmed' subscribers.
-            WHEN campLists.optin = 'double' THEN subIDs.status = 'confirmed'
+            WHEN campLists.optin = 'double' THEN sl.status = 'confirmed'
 
             -- For regular campaigns with non-double optin lists, e-mail everyone
             -- except unsubscribed subscribers.
-            ELSE subIDs.status != 'unsubscribed'
+            ELSE sl.status != 'unsubscribed'
         END)
     )
+    ORDER BY subscribers.id, sl.list_id
+),
+u AS (
+    UPDATE campaigns
+    SET last_subscriber_id = (SELECT MAX(id) FROM subs), updated_at = NOW()
+    WHERE (SELECT COUNT(id) FROM subs) > 0 AND id=$1
+)
+SELECT * FROM subs;
+
+-- name: next-campaign-segment-subscribers
+-- raw: true
+-- Same as next-campaign-subscribers, but for campaigns targeting a segment, where the
+-- subscribers additionally have to match the segment's query (%query%) and be on one
+-- of the segment's lists ($3), if any. The segment is evaluated on every fetch.
+WITH camps AS (
+    SELECT last_subscriber_id, max_subscriber_id, type, triggered
+    FROM campaigns WHERE id = $1 AND status='running'
+),
+campLists AS (
+    SELECT lists.id AS list_id, optin FROM lists
+    LEFT JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+    WHERE campaign_lists.campaign_id = $1
+    UNION
+    -- The (non-archived) lists of the list group that the campaign targets.
+    SELECT id AS list_id, optin FROM lists
+    WHERE (SELECT list_group_id FROM campaigns WHERE id = $1) IN (id, parent_id) AND NOT archived
+),
+subIDs AS (
+    SELECT DISTINCT ON (subscriber_lists.subscriber_id) subscriber_id, list_id, status FROM subscriber_lists
+    WHERE
+        list_id = ANY((SELECT ARRAY_AGG(list_id) FROM campLists)::INT[]) AND
+        status != 'unsubscribed' AND
+        subscriber_id > (SELECT last_subscriber_id FROM camps) AND
+        subscriber_id <= (SELECT max_subscriber_id FROM camps) AND
+        (NOT (SELECT triggered FROM camps) OR subscriber_id IN (
+            SELECT subscriber_id FROM campaign_recipients WHERE campaign_id = $1
+        )) AND
+        subscriber_id IN (SELECT subscribers.id FROM subscribers WHERE %query%) AND
+        (CARDINALITY($3::INT[]) = 0 OR subscriber_id IN (
+            SELECT sl.subscriber_id FROM subscriber_lists sl WHERE sl.list_id = ANY($3::INT[]) AND sl.status != 'unsubscribed'
+        )) AND
+        NOT EXISTS (
+            SELECT 1 FROM campaign_deliveries WHERE campaign_id = $1 AND campaign_deliveries.subscriber_id = subscriber_lists.subscriber_id
+        )
+    ORDER BY subscriber_id LIMIT $2
+),
+subs AS (
+    SELECT DISTINCT ON (subscribers.id, sl.list_id)
+        subscribers.* FROM subIDs
+    INNER JOIN subscriber_lists sl ON (sl.subscriber_id = subIDs.subscriber_id)
+    INNER JOIN campLists ON (campLists.list_id = sl.list_id)
+    INNER JOIN subscribers ON (
+        subscribers.status != 'blocklisted' AND
+        subscribers.archived_at IS NULL AND
+        subscribers.id = subIDs.subscriber_id AND
+        NOT EXISTS (SELECT 1 FROM suppressions WHERE suppressions.email = LOWER(subscribers.email)) AND
+
+        (CASE
+            WHEN (SELECT type FROM camps) = 'optin' THEN sl.status = 'unconfirmed' AND campLists.optin = 'double'
+            WHEN campLists.optin = 'double' THEN sl.status = 'confirmed'
+            ELSE sl.status != 'unsubscribed'
+        END)
+    )
+    ORDER BY subscribers.id, sl.list_id
 ),
 u AS (
     UPDATE campaigns
@@ -794,16 +1430,165 @@ DELETE FROM campaign_views WHERE created_at < $1;
 -- name: delete-campaign-link-clicks
 DELETE FROM link_clicks WHERE created_at < $1;
 
+-- name: get-campaign-message-cap
+-- Returns the per-subscriber rolling message cap of a campaign, which is the lowest override
+-- on the campaign's lists and the lists of its list group, or in the absence of any, the global
+-- cap ($2). A cap of 0 disables it. track is whether sends have to be recorded at all, that is,
+-- if the cap is enabled globally or on any list.
+WITH caps AS (
+    SELECT lists.max_subscriber_messages AS num FROM campaign_lists
+    INNER JOIN lists ON (lists.id = campaign_lists.list_id)
+    WHERE campaign_lists.campaign_id = $1
+    UNION ALL
+    SELECT max_subscriber_messages FROM lists
+    WHERE (SELECT list_group_id FROM campaigns WHERE id = $1) IN (id, parent_id)
+)
+SELECT COALESCE((SELECT MIN(num) FROM caps), $2) AS num,
+    ($2 > 0 OR EXISTS (SELECT 1 FROM lists WHERE max_subscriber_messages > 0)) AS track;
+
+-- name: get-excluded-subscribers
+-- Returns the subscribers ($1) who are on any of the exclusion lists ($2) or who are
+-- recipients of any of the excluded campaigns ($3).
+SELECT id FROM UNNEST($1::INT[]) id WHERE
+    EXISTS (
+        SELECT 1 FROM subscriber_lists WHERE subscriber_id = id
+        AND list_id = ANY($2::INT[]) AND status != 'unsubscribed'
+    ) OR
+    EXISTS (
+        SELECT 1 FROM campaign_deliveries WHERE subscriber_id = id AND campaign_id = ANY($3::INT[])
+    );
+
+-- name: get-subscriber-send-counts
+-- Returns the number of campaign messages sent to the given subscribers in the last
+-- 24 hours and when the earliest of them was sent.
+SELECT subscriber_id, COUNT(*) AS count, MIN(created_at) AS first_at FROM subscriber_sends
+    WHERE subscriber_id = ANY($1::INT[]) AND created_at > NOW() - INTERVAL '24 hours'
+    GROUP BY subscriber_id;
+
+-- name: defer-campaign-subscribers
+-- Defers the messages ($3 copies) of a campaign to the given subscribers ($2)
+-- till the given retry times ($4, unix timestamps).
+INSERT INTO campaign_deferrals (campaign_id, subscriber_id, copies, retry_at)
+    SELECT $1, UNNEST($2::INT[]), UNNEST($3::INT[]), TO_TIMESTAMP(UNNEST($4::BIGINT[]))
+    ON CONFLICT (campaign_id, subscriber_id) DO UPDATE SET copies = EXCLUDED.copies, retry_at = EXCLUDED.retry_at;
+
+-- name: next-campaign-deferrals
+-- Leases a batch of a campaign's deferred subscribers who are due to be retried by pushing
+-- their retry times by $3 seconds and returns them, once for every message copy. The deferrals
+-- are deleted once the messages have been processed, failing which, eg: on a shutdown, the
+-- subscribers are retried after the lease. The deferrals of subscribers who have since been
+-- blocklisted, archived, unsubscribed from the campaign's lists, or sent the campaign are deleted.
+WITH campLists AS (
+    SELECT list_id FROM campaign_lists WHERE campaign_id = $1 AND list_id IS NOT NULL
+    UNION
+    SELECT id FROM lists WHERE (SELECT list_group_id FROM campaigns WHERE id = $1) IN (id, parent_id)
+),
+deferrals AS (
+    SELECT d.subscriber_id, (
+        subscribers.status != 'blocklisted' AND subscribers.archived_at IS NULL AND EXISTS (
+            SELECT 1 FROM subscriber_lists sl WHERE sl.subscriber_id = d.subscriber_id
+            AND sl.list_id IN (SELECT list_id FROM campLists) AND sl.status != 'unsubscribed'
+        ) AND NOT EXISTS (
+            SELECT 1 FROM campaign_deliveries cd WHERE cd.campaign_id = $1 AND cd.subscriber_id = d.subscriber_id
+        )
+    ) AS ok
+    FROM campaign_deferrals d
+    INNER JOIN subscribers ON (subscribers.id = d.subscriber_id)
+    WHERE d.campaign_id = $1 AND d.retry_at <= NOW()
+    ORDER BY d.subscriber_id LIMIT $2
+),
+del AS (
+    DELETE FROM campaign_deferrals WHERE campaign_id = $1
+    AND subscriber_id = ANY(SELECT subscriber_id FROM deferrals WHERE NOT ok)
+),
+leased AS (
+    UPDATE campaign_deferrals SET retry_at = NOW() + MAKE_INTERVAL(secs => $3)
+    WHERE campaign_id = $1 AND subscriber_id = ANY(SELECT subscriber_id FROM deferrals WHERE ok)
+    RETURNING subscriber_id, copies
+)
+SELECT subscribers.* FROM leased
+    INNER JOIN subscribers ON (subscribers.id = leased.subscriber_id)
+    CROSS JOIN GENERATE_SERIES(1, leased.copies)
+    ORDER BY subscribers.id;
+
+-- name: get-campaign-next-deferral
+-- Returns the earliest retry time of a campaign's deferred subscribers, if there are any.
+SELECT MIN(retry_at) FROM campaign_deferrals WHERE campaign_id = $1;
+
+-- name: delete-campaign-deferrals
+DELETE FROM campaign_deferrals WHERE campaign_id = $1 AND subscriber_id = ANY($2::INT[]);
+
+-- name: record-subscriber-sends
+-- Records campaign messages sent to subscribers and prunes records that are
+-- older than the 24 hour window.
+WITH del AS (
+    DELETE FROM subscriber_sends WHERE created_at < NOW() - INTERVAL '24 hours'
+)
+INSERT INTO subscriber_sends (subscriber_id, campaign_id) SELECT UNNEST($2::INT[]), $1;
+
+-- name: record-campaign-deliveries
+-- Records the subscribers to whom a campaign's messages have been sent.
+INSERT INTO campaign_deliveries (campaign_id, subscriber_id)
+    SELECT $1, UNNEST($2::INT[])
+    ON CONFLICT DO NOTHING;
+
+-- name: delete-campaign-deliveries
+-- Deletes a batch ($2) of the delivery records of the campaigns that ended before $1,
+-- except the ones of campaigns whose recipients are excluded by a campaign that's yet
+-- to end. Returns the number of records deleted.
+WITH camps AS (
+    SELECT id FROM campaigns WHERE status IN ('finished', 'cancelled') AND updated_at < $1
+    AND NOT EXISTS (
+        SELECT 1 FROM campaigns c WHERE c.status NOT IN ('finished', 'cancelled')
+        AND campaigns.id = ANY(c.exclude_campaign_ids)
+    )
+),
+del AS (
+    DELETE FROM campaign_deliveries WHERE (campaign_id, subscriber_id) IN (
+        SELECT campaign_id, subscriber_id FROM campaign_deliveries
+        WHERE campaign_id = ANY(SELECT id FROM camps) LIMIT $2
+    )
+    RETURNING 1
+)
+SELECT COUNT(*) FROM del;
+
 -- name: get-one-campaign-subscriber
 SELECT * FROM subscribers
 LEFT JOIN subscriber_lists ON (subscribers.id = subscriber_lists.subscriber_id AND subscriber_lists.status != 'unsubscribed')
-WHERE subscriber_lists.list_id=ANY(
+WHERE subscribers.archived_at IS NULL AND subscriber_lists.list_id=ANY(
     SELECT list_id FROM campaign_lists where campaign_id=$1 AND list_id IS NOT NULL
 )
 ORDER BY RANDOM() LIMIT 1;
 
 -- name: update-campaign
-WITH camp AS (
+WITH changed AS (
+    -- Whether the content or the audience of the campaign changes. Name, tags,
+    -- and the schedule can be changed without approving the campaign again.
+    SELECT (
+        subject IS DISTINCT FROM $3
+        OR from_email IS DISTINCT FROM $4
+        OR body IS DISTINCT FROM $5
+        OR altbody IS DISTINCT FROM NULLIF($6, '')
+        OR content_type IS DISTINCT FROM $7::content_type
+        OR headers IS DISTINCT FROM $10::JSONB
+        OR messenger IS DISTINCT FROM $12
+        OR template_id IS DISTINCT FROM $13::INT
+        OR archive IS DISTINCT FROM $15::BOOLEAN
+        OR archive_template_id IS DISTINCT FROM $17::INT
+        OR archive_meta IS DISTINCT FROM $18::JSONB
+        OR amp_body IS DISTINCT FROM NULLIF($20, '')
+        OR exclude_list_ids IS DISTINCT FROM COALESCE($21::INT[], '{}')
+        OR exclude_campaign_ids IS DISTINCT FROM COALESCE($22::INT[], '{}')
+        OR per_list_copies IS DISTINCT FROM $23::BOOLEAN
+        OR preheader IS DISTINCT FROM NULLIF($24, '')
+        OR utm IS DISTINCT FROM COALESCE($27::JSONB, '{}')
+        OR ARRAY(SELECT list_id FROM campaign_lists WHERE campaign_id = $1 AND list_id IS NOT NULL ORDER BY list_id)
+            IS DISTINCT FROM ARRAY(SELECT id FROM lists WHERE id = ANY($14::INT[]) ORDER BY id)
+        OR ARRAY(SELECT media_id FROM campaign_media WHERE campaign_id = $1 AND media_id IS NOT NULL ORDER BY media_id)
+            IS DISTINCT FROM ARRAY(SELECT id FROM media WHERE id = ANY($19::INT[]) ORDER BY id)
+    ) AS yes FROM campaigns WHERE id = $1
+),
+camp AS (
     UPDATE campaigns SET
         name=$2,
         subject=$3,
@@ -812,7 +1597,10 @@ WITH camp AS (
         altbody=(CASE WHEN $6 = '' THEN NULL ELSE $6 END),
         content_type=$7::content_type,
         send_at=$8::TIMESTAMP WITH TIME ZONE,
-        status=(CASE WHEN NOT $9 THEN 'draft' ELSE status END),
+        -- If the content or audience changes, the campaign has to be approved again,
+        -- and if approvals are required ($25), it's unscheduled.
+        status=(CASE WHEN NOT $9 OR ($25 AND status = 'scheduled' AND (SELECT yes FROM changed)) THEN 'draft' ELSE status END),
+        approval_status=(CASE WHEN (SELECT yes FROM changed) THEN 'none' ELSE approval_status END),
         headers=$10,
         tags=$11::VARCHAR(100)[],
         messenger=$12,
@@ -821,25 +1609,48 @@ WITH camp AS (
         archive_slug=$16,
         archive_template_id=$17,
         archive_meta=$18,
+        amp_body=NULLIF($20, ''),
+        exclude_list_ids=COALESCE($21::INT[], '{}'),
+        exclude_campaign_ids=COALESCE($22::INT[], '{}'),
+        per_list_copies=$23,
+        preheader=NULLIF($24, ''),
+        utm=COALESCE($27, '{}'),
+        revision=revision+1,
         updated_at=NOW()
-    WHERE id = $1 RETURNING id
+    -- If the update is based on a revision ($26), the campaign is only updated if it's
+    -- still at that revision. Otherwise, nothing is changed and no rows are returned.
+    -- Updates without a revision, eg: from older API clients, aren't checked.
+    WHERE id = $1 AND ($26::INT IS NULL OR revision = $26) RETURNING id
 ),
 clists AS (
     -- Reset list relationships
-    DELETE FROM campaign_lists WHERE campaign_id = $1 AND NOT(list_id = ANY($14))
+    DELETE FROM campaign_lists WHERE campaign_id = (SELECT id FROM camp) AND NOT(list_id = ANY($14))
 ),
 med AS (
-    DELETE FROM campaign_media WHERE campaign_id = $1
+    DELETE FROM campaign_media WHERE campaign_id = (SELECT id FROM camp)
     AND ( media_id IS NULL or NOT(media_id = ANY($19))) RETURNING media_id
 ),
 medi AS (
     INSERT INTO campaign_media (campaign_id, media_id, filename)
-        (SELECT $1 AS campaign_id, id, filename FROM media WHERE id=ANY($19::INT[]))
+        (SELECT camp.id AS campaign_id, media.id, filename FROM media, camp WHERE media.id=ANY($19::INT[]))
         ON CONFLICT (campaign_id, media_id) DO NOTHING
+),
+clistsi AS (
+    INSERT INTO campaign_lists (campaign_id, list_id, list_name)
+        (SELECT camp.id as campaign_id, lists.id, name FROM lists, camp WHERE lists.id=ANY($14::INT[]))
+        ON CONFLICT (campaign_id, list_id) DO UPDATE SET list_name = EXCLUDED.list_name
 )
-INSERT INTO campaign_lists (campaign_id, list_id, list_name)
-    (SELECT $1 as campaign_id, id, name FROM lists WHERE id=ANY($14::INT[]))
-    ON CONFLICT (campaign_id, list_id) DO UPDATE SET list_name = EXCLUDED.list_name;
+SELECT id FROM camp;
+
+-- name: update-campaign-body
+-- Auto-saves the body ($2) of a campaign if it's still at the revision ($3) that
+-- the body is based on, or if there's no revision, and returns the new revision. The changed content has to be
+-- approved again, and if approvals are required ($4), a scheduled campaign is unscheduled.
+UPDATE campaigns SET body=$2, revision=revision+1,
+    approval_status=(CASE WHEN body IS DISTINCT FROM $2 THEN 'none' ELSE approval_status END),
+    status=(CASE WHEN $4 AND status = 'scheduled' AND body IS DISTINCT FROM $2 THEN 'draft' ELSE status END),
+    updated_at=NOW()
+    WHERE id = $1 AND ($3::INT IS NULL OR revision = $3) RETURNING revision;
 
 -- name: update-campaign-counts
 UPDATE campaigns SET
@@ -849,6 +1660,9 @@ UPDATE campaigns SET
     updated_at=NOW()
 WHERE id=$1;
 
+-- name: update-campaign-checkpoint
+UPDATE campaigns SET last_subscriber_id=$2, updated_at=NOW() WHERE id=$1;
+
 -- name: update-campaign-status
 UPDATE campaigns SET status=$2, updated_at=NOW() WHERE id = $1;
 
@@ -865,13 +1679,343 @@ UPDATE campaigns SET
 DELETE FROM campaigns WHERE id=$1;
 
 -- name: register-campaign-view
+-- Views aren't recorded if view tracking is disabled on the campaign or any of its lists.
 WITH view AS (
     SELECT campaigns.id as campaign_id, subscribers.id AS subscriber_id FROM campaigns
     LEFT JOIN subscribers ON (CASE WHEN $2::TEXT != '' THEN subscribers.uuid = $2::UUID ELSE FALSE END)
-    WHERE campaigns.uuid = $1
+    WHERE campaigns.uuid = $1 AND campaigns.track_views AND NOT EXISTS (
+        SELECT 1 FROM campaign_lists INNER JOIN lists ON (lists.id = campaign_lists.list_id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND NOT lists.track_views
+    )
 )
-INSERT INTO campaign_views (campaign_id, subscriber_id)
-    VALUES((SELECT campaign_id FROM view), (SELECT subscriber_id FROM view));
+INSERT INTO campaign_views (campaign_id, subscriber_id, variant_id)
+    VALUES((SELECT campaign_id FROM view), (SELECT subscriber_id FROM view),
+        (SELECT id FROM campaign_variants WHERE id = $3 AND campaign_id = (SELECT campaign_id FROM view)));
+
+-- name: update-campaign-recurrence
+UPDATE campaigns SET recurrence=NULLIF($2, ''), recurrence_active=$3, recurrence_next_at=$4, updated_at=NOW() WHERE id = $1;
+
+-- name: update-campaign-segment
+-- A change has to be approved again, and if approvals are required ($3), a scheduled
+-- campaign is unscheduled.
+UPDATE campaigns SET segment_id=NULLIF($2, 0),
+    approval_status=(CASE WHEN segment_id IS DISTINCT FROM NULLIF($2, 0) THEN 'none' ELSE approval_status END),
+    status=(CASE WHEN $3 AND status = 'scheduled' AND segment_id IS DISTINCT FROM NULLIF($2, 0) THEN 'draft' ELSE status END),
+    updated_at=NOW() WHERE id = $1;
+
+-- name: update-campaign-list-group
+-- A change has to be approved again, and if approvals are required ($3), a scheduled
+-- campaign is unscheduled.
+UPDATE campaigns SET list_group_id=NULLIF($2, 0),
+    approval_status=(CASE WHEN list_group_id IS DISTINCT FROM NULLIF($2, 0) THEN 'none' ELSE approval_status END),
+    status=(CASE WHEN $3 AND status = 'scheduled' AND list_group_id IS DISTINCT FROM NULLIF($2, 0) THEN 'draft' ELSE status END),
+    updated_at=NOW() WHERE id = $1;
+
+-- name: update-campaign-priority
+-- A change has to be approved again, and if approvals are required ($3), a scheduled
+-- campaign is unscheduled.
+UPDATE campaigns SET priority=$2,
+    approval_status=(CASE WHEN priority IS DISTINCT FROM $2 THEN 'none' ELSE approval_status END),
+    status=(CASE WHEN $3 AND status = 'scheduled' AND priority IS DISTINCT FROM $2 THEN 'draft' ELSE status END),
+    updated_at=NOW() WHERE id = $1;
+
+-- name: update-campaign-unsubscribe-header
+-- A change has to be approved again, and if approvals are required ($3), a scheduled
+-- campaign is unscheduled.
+UPDATE campaigns SET unsubscribe_header=$2,
+    approval_status=(CASE WHEN unsubscribe_header IS DISTINCT FROM $2 THEN 'none' ELSE approval_status END),
+    status=(CASE WHEN $3 AND status = 'scheduled' AND unsubscribe_header IS DISTINCT FROM $2 THEN 'draft' ELSE status END),
+    updated_at=NOW() WHERE id = $1;
+
+-- name: update-campaign-inline-css
+-- A change has to be approved again, and if approvals are required ($3), a scheduled
+-- campaign is unscheduled.
+UPDATE campaigns SET inline_css=$2,
+    approval_status=(CASE WHEN inline_css IS DISTINCT FROM $2 THEN 'none' ELSE approval_status END),
+    status=(CASE WHEN $3 AND status = 'scheduled' AND inline_css IS DISTINCT FROM $2 THEN 'draft' ELSE status END),
+    updated_at=NOW() WHERE id = $1;
+
+-- name: update-campaign-track-views
+UPDATE campaigns SET track_views=$2, updated_at=NOW() WHERE id = $1;
+
+-- name: update-campaign-notify
+UPDATE campaigns SET notify_emails=$2, notify_webhook_id=NULLIF($3, 0), updated_at=NOW() WHERE id = $1;
+
+-- name: get-campaign-segment
+SELECT segments.* FROM campaigns
+    INNER JOIN segments ON (segments.id = campaigns.segment_id)
+    WHERE campaigns.id = $1;
+
+-- name: get-due-recurring-campaigns
+SELECT * FROM campaigns WHERE recurrence_active = true AND recurrence_next_at <= $1 ORDER BY recurrence_next_at;
+
+-- name: set-campaign-recurrence-next-at
+UPDATE campaigns SET recurrence_next_at=$2 WHERE id = $1;
+
+-- name: clone-recurring-campaign
+-- Clones the recurring campaign ($1) into a new campaign that's scheduled to be sent at
+-- the trigger time ($3) and sets the next trigger time ($4) on the recurring campaign.
+-- A trigger time is only ever cloned once. In that case, no rows are returned.
+-- If approvals are required ($5), clones of unapproved campaigns are created as drafts.
+WITH tpl AS (
+    SELECT * FROM campaigns WHERE id = $1 AND recurrence_active = true
+),
+camp AS (
+    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, body_html, send_at, status,
+        headers, tags, messenger, template_id, to_send, max_subscriber_id, archive, archive_template_id, archive_meta,
+        recurrence_parent_id, send_window_start, send_window_end, segment_id, list_group_id, priority,
+        unsubscribe_header, amp_body, inline_css, track_views, exclude_list_ids, exclude_campaign_ids, per_list_copies, preheader,
+        approval_status, utm)
+        SELECT $2, type, name || ' / ' || TO_CHAR($3::TIMESTAMP WITH TIME ZONE, 'YYYY-MM-DD HH24:MI'),
+            subject, from_email, body, altbody, content_type, body_html, $3,
+            (CASE WHEN $5 AND approval_status != 'approved' THEN 'draft' ELSE 'scheduled' END)::campaign_status,
+            headers, tags, messenger, template_id, 0, 0, archive, archive_template_id, archive_meta,
+            id, send_window_start, send_window_end, segment_id, list_group_id, priority,
+            unsubscribe_header, amp_body, inline_css, track_views, exclude_list_ids, exclude_campaign_ids, per_list_copies, preheader,
+            approval_status, utm
+        FROM tpl
+    ON CONFLICT (recurrence_parent_id, send_at) WHERE recurrence_parent_id IS NOT NULL DO NOTHING
+    RETURNING id
+),
+lists AS (
+    INSERT INTO campaign_lists (campaign_id, list_id, list_name)
+        SELECT camp.id, list_id, list_name FROM campaign_lists, camp WHERE campaign_id = $1 AND list_id IS NOT NULL
+),
+med AS (
+    INSERT INTO campaign_media (campaign_id, media_id, filename)
+        SELECT camp.id, media_id, filename FROM campaign_media, camp WHERE campaign_id = $1
+),
+vars AS (
+    INSERT INTO campaign_variants (campaign_id, subject, weight)
+        SELECT camp.id, subject, weight FROM campaign_variants, camp WHERE campaign_id = $1
+),
+u AS (
+    UPDATE campaigns SET recurrence_next_at=$4 WHERE id = (SELECT id FROM tpl)
+)
+SELECT id FROM camp;
+
+-- name: clone-campaign
+-- Clones a campaign ($1) into a new draft campaign named $3, optionally overriding its
+-- subject ($4), template ($5), and lists ($6), which then replace the campaign's lists
+-- and list group. The send time and send window are only copied if $7 is true.
+-- Stats, the archive slug, and the recurrence are not copied.
+WITH src AS (
+    SELECT * FROM campaigns WHERE id = $1
+),
+camp AS (
+    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, body_html, send_at, status,
+        headers, tags, messenger, template_id, to_send, max_subscriber_id, archive, archive_template_id, archive_meta,
+        send_window_start, send_window_end, segment_id, list_group_id, priority,
+        unsubscribe_header, amp_body, inline_css, track_views, exclude_list_ids, exclude_campaign_ids, per_list_copies, preheader, utm)
+        SELECT $2, type, $3, COALESCE(NULLIF($4, ''), subject), from_email, body, altbody, content_type, body_html,
+            (CASE WHEN $7 THEN send_at END), 'draft',
+            headers, tags, messenger, COALESCE(NULLIF($5::INT, 0), template_id), 0, 0, archive, archive_template_id, archive_meta,
+            (CASE WHEN $7 THEN send_window_start END), (CASE WHEN $7 THEN send_window_end END), segment_id,
+            (CASE WHEN CARDINALITY($6::INT[]) = 0 THEN list_group_id END), priority,
+            unsubscribe_header, amp_body, inline_css, track_views, exclude_list_ids, exclude_campaign_ids, per_list_copies, preheader, utm
+        FROM src
+    RETURNING id
+),
+campLists AS (
+    INSERT INTO campaign_lists (campaign_id, list_id, list_name)
+        SELECT camp.id, list_id, list_name FROM campaign_lists, camp
+            WHERE CARDINALITY($6::INT[]) = 0 AND campaign_id = $1 AND list_id IS NOT NULL
+        UNION ALL
+        SELECT camp.id, lists.id, lists.name FROM lists, camp WHERE lists.id = ANY($6::INT[])
+),
+med AS (
+    INSERT INTO campaign_media (campaign_id, media_id, filename)
+        SELECT camp.id, media_id, filename FROM campaign_media, camp WHERE campaign_id = $1
+),
+vars AS (
+    INSERT INTO campaign_variants (campaign_id, subject, weight)
+        SELECT camp.id, subject, weight FROM campaign_variants, camp WHERE campaign_id = $1
+)
+SELECT id FROM camp;
+
+-- name: get-campaign-trigger-recipients
+-- raw: true
+-- Returns the IDs of the subscribers on a campaign's ($1) lists who match the given
+-- e-mails ($2), if any, and the query (%query%), to be sent a triggered run of the
+-- campaign. At most $3 IDs are returned.
+WITH campLists AS (
+    SELECT list_id FROM campaign_lists WHERE campaign_id = $1 AND list_id IS NOT NULL
+    UNION
+    SELECT id AS list_id FROM lists
+    WHERE (SELECT list_group_id FROM campaigns WHERE id = $1) IN (id, parent_id) AND NOT archived
+)
+SELECT DISTINCT subscribers.id FROM subscribers
+    INNER JOIN subscriber_lists ON (subscriber_lists.subscriber_id = subscribers.id)
+    WHERE subscriber_lists.list_id = ANY((SELECT ARRAY_AGG(list_id) FROM campLists)::INT[])
+    AND subscriber_lists.status != 'unsubscribed'
+    AND subscribers.status != 'blocklisted'
+    AND subscribers.archived_at IS NULL
+    AND (CARDINALITY($2::TEXT[]) = 0 OR LOWER(subscribers.email) = ANY($2::TEXT[]))
+    AND %query%
+    ORDER BY subscribers.id LIMIT $3;
+
+-- name: clone-triggered-campaign
+-- Clones a draft campaign ($1) into a new running campaign that's only sent to the
+-- given subscribers ($3). If the campaign isn't a draft, no rows are returned.
+-- Triggered runs are not published to the archive.
+WITH tpl AS (
+    SELECT * FROM campaigns WHERE id = $1 AND status = 'draft'
+),
+camp AS (
+    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, body_html, status,
+        headers, tags, messenger, template_id, to_send, max_subscriber_id, archive, archive_template_id, archive_meta,
+        send_window_start, send_window_end, segment_id, list_group_id, priority,
+        unsubscribe_header, amp_body, inline_css, track_views, triggered, exclude_list_ids, exclude_campaign_ids, per_list_copies, preheader,
+        approval_status, utm)
+        SELECT $2, type, name || ' / ' || TO_CHAR(NOW(), 'YYYY-MM-DD HH24:MI:SS'),
+            subject, from_email, body, altbody, content_type, body_html, 'running',
+            headers, tags, messenger, template_id, 0, 0, false, archive_template_id, archive_meta,
+            send_window_start, send_window_end, segment_id, list_group_id, priority,
+            unsubscribe_header, amp_body, inline_css, track_views, true, exclude_list_ids, exclude_campaign_ids, per_list_copies, preheader,
+            approval_status, utm
+        FROM tpl
+    RETURNING id
+),
+lists AS (
+    INSERT INTO campaign_lists (campaign_id, list_id, list_name)
+        SELECT camp.id, list_id, list_name FROM campaign_lists, camp WHERE campaign_id = $1 AND list_id IS NOT NULL
+),
+med AS (
+    INSERT INTO campaign_media (campaign_id, media_id, filename)
+        SELECT camp.id, media_id, filename FROM campaign_media, camp WHERE campaign_id = $1
+),
+vars AS (
+    INSERT INTO campaign_variants (campaign_id, subject, weight)
+        SELECT camp.id, subject, weight FROM campaign_variants, camp WHERE campaign_id = $1
+),
+recips AS (
+    INSERT INTO campaign_recipients (campaign_id, subscriber_id)
+        SELECT camp.id, UNNEST($3::INT[]) FROM camp
+)
+SELECT id FROM camp;
+
+-- name: update-campaign-approval
+-- Sets the approval status ($2) and reason ($3) of a campaign ($1) whose approval status
+-- is one of $5, and records it in the audit log with the user ($4) who made the change.
+WITH camp AS (
+    UPDATE campaigns SET approval_status=$2, approval_reason=$3, updated_at=NOW()
+    WHERE id = $1 AND approval_status = ANY($5::campaign_approval_status[])
+    RETURNING id
+)
+INSERT INTO campaign_approvals (campaign_id, status, actor, reason)
+    SELECT id, $2, $4, $3 FROM camp;
+
+-- name: get-campaign-approvals
+-- Retrieves a campaign's approval audit log, latest first.
+SELECT * FROM campaign_approvals WHERE campaign_id = $1 ORDER BY id DESC;
+
+-- name: update-campaign-body-html
+UPDATE campaigns SET body_html=$2 WHERE id = $1;
+
+-- name: get-campaign-send-window
+SELECT send_window_start, send_window_end FROM campaigns WHERE id = $1;
+
+-- name: update-campaign-send-window
+-- A change has to be approved again, and if approvals are required ($4), a scheduled
+-- campaign is unscheduled.
+WITH changed AS (
+    SELECT (send_window_start IS DISTINCT FROM $2 OR send_window_end IS DISTINCT FROM $3) AS yes
+        FROM campaigns WHERE id = $1
+)
+UPDATE campaigns SET send_window_start=$2, send_window_end=$3,
+    approval_status=(CASE WHEN (SELECT yes FROM changed) THEN 'none' ELSE approval_status END),
+    status=(CASE WHEN $4 AND status = 'scheduled' AND (SELECT yes FROM changed) THEN 'draft' ELSE status END),
+    updated_at=NOW() WHERE id = $1;
+
+-- name: insert-campaign-version
+-- Snapshot the current content of a campaign as a new version if it differs from
+-- the latest version, and prune the oldest versions beyond the max count ($3).
+WITH camp AS (
+    SELECT id, subject, body, altbody, content_type FROM campaigns WHERE id = $1
+),
+last AS (
+    SELECT * FROM campaign_versions WHERE campaign_id = $1 ORDER BY version DESC LIMIT 1
+),
+ins AS (
+    INSERT INTO campaign_versions (campaign_id, version, author, subject, body, altbody, content_type)
+        SELECT camp.id, COALESCE((SELECT version FROM last), 0) + 1, $2,
+            camp.subject, camp.body, camp.altbody, camp.content_type FROM camp
+        WHERE NOT EXISTS (
+            SELECT 1 FROM last WHERE last.subject = camp.subject AND last.body = camp.body
+                AND last.altbody IS NOT DISTINCT FROM camp.altbody AND last.content_type = camp.content_type
+        )
+    RETURNING version
+)
+DELETE FROM campaign_versions WHERE campaign_id = $1 AND version <= (SELECT version FROM ins) - $3;
+
+-- name: get-campaign-versions
+SELECT * FROM campaign_versions WHERE campaign_id = $1 ORDER BY version DESC;
+
+-- name: restore-campaign-version
+-- Restore the content of a campaign from a version. The stats are left untouched.
+-- The changed content has to be approved again, and if approvals are required ($3),
+-- a scheduled campaign is unscheduled.
+UPDATE campaigns c SET subject=v.subject, body=v.body, altbody=v.altbody,
+    content_type=v.content_type, approval_status='none', revision=c.revision+1,
+    status=(CASE WHEN $3 AND c.status = 'scheduled' THEN 'draft' ELSE c.status END),
+    updated_at=NOW()
+    FROM campaign_versions v WHERE c.id = $1 AND v.campaign_id = $1 AND v.version = $2;
+
+-- name: get-campaign-variants
+-- Get the subject variants of a campaign along with their unique view and click counts.
+-- Views and clicks without a subscriber (individual tracking disabled) are counted as is.
+SELECT v.*,
+    (SELECT COUNT(DISTINCT subscriber_id) + COUNT(*) FILTER (WHERE subscriber_id IS NULL)
+        FROM campaign_views WHERE variant_id = v.id) AS views,
+    (SELECT COUNT(DISTINCT subscriber_id) + COUNT(*) FILTER (WHERE subscriber_id IS NULL)
+        FROM link_clicks WHERE variant_id = v.id) AS clicks
+    FROM campaign_variants v WHERE campaign_id = $1 ORDER BY v.id;
+
+-- name: delete-campaign-variants
+WITH c AS (
+    UPDATE campaigns SET variant_sample_ends_at=NULL, updated_at=NOW() WHERE id = $1
+)
+DELETE FROM campaign_variants WHERE campaign_id = $1;
+
+-- name: reset-campaign-approval
+-- Reset the approval of a campaign whose content has changed, and if approvals are
+-- required ($2), unschedule it.
+UPDATE campaigns SET approval_status='none',
+    status=(CASE WHEN $2 AND status = 'scheduled' THEN 'draft' ELSE status END),
+    updated_at=NOW() WHERE id = $1;
+
+-- name: insert-campaign-variant
+INSERT INTO campaign_variants (campaign_id, subject, weight) VALUES($1, $2, $3) RETURNING id;
+
+-- name: update-campaign-variant-counts
+-- Increment the sent counts of the given variants ($2) of a campaign by the given counts ($3).
+UPDATE campaign_variants AS v SET sent = v.sent + c.num, updated_at=NOW()
+    FROM (SELECT * FROM UNNEST($2::INT[], $3::INT[])) AS c(id, num)
+    WHERE v.id = c.id AND v.campaign_id = $1;
+
+-- name: end-campaign-variant-sample
+UPDATE campaigns SET variant_sample_ends_at=$2, updated_at=NOW() WHERE id = $1;
+
+-- name: pick-campaign-variant-winner
+-- Pick the variant with the highest open rate as the winner and set its subject on the campaign
+-- to be sent to the remaining subscribers. Ties go to the variant that was created first.
+WITH stats AS (
+    SELECT v.id, v.subject,
+        (SELECT COUNT(DISTINCT subscriber_id) + COUNT(*) FILTER (WHERE subscriber_id IS NULL)
+            FROM campaign_views WHERE variant_id = v.id)::FLOAT / GREATEST(v.sent, 1) AS rate
+    FROM campaign_variants v WHERE campaign_id = $1
+),
+w AS (
+    SELECT id, subject FROM stats ORDER BY rate DESC, id LIMIT 1
+),
+v AS (
+    UPDATE campaign_variants SET winner=(id = (SELECT id FROM w)), updated_at=NOW() WHERE campaign_id = $1
+),
+c AS (
+    UPDATE campaigns SET subject=(SELECT subject FROM w), updated_at=NOW()
+    WHERE id = $1 AND EXISTS (SELECT 1 FROM w)
+)
+SELECT * FROM campaign_variants WHERE id = (SELECT id FROM w);
 
 -- users
 -- name: get-users
@@ -937,32 +2081,72 @@ SELECT id FROM tpl;
 
 -- media
 -- name: insert-media
-INSERT INTO media (uuid, filename, thumb, content_type, provider, meta, created_at) VALUES($1, $2, $3, $4, $5, $6, NOW()) RETURNING id;
+INSERT INTO media (uuid, filename, thumb, content_type, provider, meta, folder_id, size, variants, created_at)
+    VALUES($1, $2, $3, $4, $5, $6, NULLIF($7::INT, 0), $8, $9, NOW()) RETURNING id;
 
 -- name: query-media
+-- $5 = folder ID. NULL returns media in all folders and 0 returns media not in any folder.
 SELECT COUNT(*) OVER () AS total, * FROM media
-    WHERE ($1 = '' OR filename ILIKE $1) AND provider=$2 ORDER BY created_at DESC OFFSET $3 LIMIT $4;
+    WHERE ($1 = '' OR filename ILIKE $1) AND provider=$2
+    AND ($5::INT IS NULL OR (CASE WHEN $5 = 0 THEN folder_id IS NULL ELSE folder_id = $5 END))
+    ORDER BY created_at DESC OFFSET $3 LIMIT $4;
+
+-- name: move-media
+UPDATE media SET folder_id=NULLIF($2::INT, 0) WHERE id = ANY($1::INT[]);
+
+-- name: get-media-folders
+-- Folders with the number and total size of the media in them.
+SELECT f.*, COUNT(m.id) AS num_media, COALESCE(SUM(m.size), 0) AS total_size
+    FROM media_folders f
+    LEFT JOIN media m ON (m.folder_id = f.id AND m.provider = $1)
+    WHERE ($2 = 0 OR f.id = $2)
+    GROUP BY f.id ORDER BY f.name;
+
+-- name: create-media-folder
+INSERT INTO media_folders (name) VALUES($1) RETURNING id;
+
+-- name: delete-media-folder
+-- Media in the folder are moved out of it (folder_id is set to NULL).
+DELETE FROM media_folders WHERE id = $1;
 
 -- name: get-media
 SELECT * FROM media WHERE CASE WHEN $1 > 0 THEN id = $1 ELSE uuid = $2 END;
 
 -- name: delete-media
-DELETE FROM media WHERE id=$1 RETURNING filename;
+DELETE FROM media WHERE id=$1 RETURNING *;
 
 -- links
 -- name: create-link
 INSERT INTO links (uuid, url) VALUES($1, $2) ON CONFLICT (url) DO UPDATE SET url=EXCLUDED.url RETURNING uuid;
 
+-- name: get-campaign-link-stats
+-- Per-URL click stats of a campaign. URLs are unique in links, so a URL that
+-- appears multiple times in a campaign's body is counted as a single link.
+-- Clicks without a subscriber (individual tracking disabled) are counted as unique.
+SELECT links.uuid, links.url, COUNT(*) AS clicks,
+    COUNT(DISTINCT link_clicks.subscriber_id) + COUNT(*) FILTER (WHERE link_clicks.subscriber_id IS NULL) AS unique_clicks
+    FROM link_clicks
+    JOIN links ON (links.id = link_clicks.link_id)
+    WHERE link_clicks.campaign_id = $1
+    GROUP BY links.id ORDER BY clicks DESC, links.url ASC;
+
+-- name: get-campaign-bounce-types
+-- Bounce counts of a campaign by bounce type.
+SELECT type, COUNT(*) AS "count" FROM bounces
+    WHERE campaign_id = $1
+    GROUP BY type ORDER BY "count" DESC;
+
 -- name: register-link-click
 WITH link AS(
     SELECT id, url FROM links WHERE uuid = $1
 )
-INSERT INTO link_clicks (campaign_id, subscriber_id, link_id) VALUES(
+INSERT INTO link_clicks (campaign_id, subscriber_id, link_id, variant_id) VALUES(
     (SELECT id FROM campaigns WHERE uuid = $2),
     (SELECT id FROM subscribers WHERE
         (CASE WHEN $3::TEXT != '' THEN subscribers.uuid = $3::UUID ELSE FALSE END)
     ),
-    (SELECT id FROM link)
+    (SELECT id FROM link),
+    (SELECT id FROM campaign_variants WHERE id = $4 AND campaign_id = (SELECT id FROM campaigns WHERE uuid = $2))
 ) RETURNING (SELECT url FROM link);
 
 -- name: get-dashboard-charts
@@ -979,6 +2163,132 @@ UPDATE settings AS s SET value = c.value
     -- For each key in the incoming JSON map, update the row with the key and its value.
     FROM(SELECT * FROM JSONB_EACH($1)) AS c(key, value) WHERE s.key = c.key;
 
+-- webhooks
+-- name: get-webhooks
+SELECT * FROM webhooks WHERE ($1 = 0 OR id = $1) ORDER BY id;
+
+-- name: insert-webhook
+INSERT INTO webhooks (name, url, secret, events, enabled) VALUES($1, $2, $3, $4, $5) RETURNING id;
+
+-- name: delete-webhook
+DELETE FROM webhooks WHERE id = $1;
+
+-- name: insert-webhook-failure
+INSERT INTO webhook_failures (webhook_id, event, payload, error, attempts) VALUES($1, $2, $3, $4, $5);
+
+-- name: query-webhook-failures
+SELECT COUNT(*) OVER () AS total, * FROM webhook_failures
+    WHERE ($1 = 0 OR webhook_id = $1) ORDER BY id DESC OFFSET $2 LIMIT $3;
+
+-- attrib fields
+-- name: get-attrib-fields
+SELECT * FROM attrib_fields WHERE ($1 = 0 OR id = $1) ORDER BY id;
+
+-- name: create-attrib-field
+INSERT INTO attrib_fields (name, type, label, required, options, default_value)
+    VALUES($1, $2, $3, $4, $5, $6) RETURNING id;
+
+-- name: update-attrib-field
+UPDATE attrib_fields SET
+    name=$2,
+    type=$3,
+    label=$4,
+    required=$5,
+    options=$6,
+    default_value=$7,
+    updated_at=NOW()
+WHERE id = $1;
+
+-- name: delete-attrib-field
+DELETE FROM attrib_fields WHERE id = $1;
+
+-- tx messages
+-- name: insert-tx-message
+-- Records a queued tx message ($5) that's sent right away, and if it isn't by $6,
+-- eg: on a crash, is picked up again by next-tx-messages.
+INSERT INTO tx_messages (uuid, subscriber_id, template_id, subject, message, retry_at)
+    VALUES($1, NULLIF($2, 0), NULLIF($3, 0), $4, $5, TO_TIMESTAMP($6));
+
+-- name: update-tx-message
+-- Updates the status of a tx message and the time ($5) at which a queued message is
+-- retried. The message is only retained till it's sent or fails.
+UPDATE tx_messages SET status=$2, attempts=$3, error=$4, retry_at=$5,
+    message=(CASE WHEN $2::tx_status = 'queued' THEN message ELSE NULL END),
+    updated_at=NOW()
+    WHERE uuid = $1;
+
+-- name: next-tx-messages
+-- Leases a batch ($1) of queued tx messages that are due to be retried, or were never
+-- sent, eg: on a crash, by pushing their retry times by $2 seconds and returns them.
+UPDATE tx_messages SET retry_at = NOW() + MAKE_INTERVAL(secs => $2)
+    WHERE id IN (
+        SELECT id FROM tx_messages
+        WHERE status = 'queued' AND message IS NOT NULL AND retry_at <= NOW()
+        ORDER BY retry_at LIMIT $1
+        FOR UPDATE SKIP LOCKED
+    )
+    RETURNING uuid, attempts, message;
+
+-- name: get-tx-message
+SELECT id, uuid, subscriber_id, template_id, subject, status, attempts, error, created_at, updated_at
+    FROM tx_messages WHERE uuid = $1;
+
+-- name: claim-tx-idempotency-key
+-- Claims a key for processing a request. A key that has expired (created before $4),
+-- or that's been stuck in processing (created before $5), eg: on a crash, is reclaimed.
+-- Returns no rows if the key is held.
+INSERT INTO tx_idempotency_keys (scope, key, request_hash) VALUES($1, $2, $3)
+    ON CONFLICT (scope, key) DO UPDATE SET request_hash=$3, status=0, response='', created_at=NOW()
+    WHERE tx_idempotency_keys.created_at < $4 OR (tx_idempotency_keys.status = 0 AND tx_idempotency_keys.created_at < $5)
+    RETURNING TRUE;
+
+-- name: get-tx-idempotency-key
+SELECT * FROM tx_idempotency_keys WHERE scope = $1 AND key = $2;
+
+-- name: update-tx-idempotency-key
+UPDATE tx_idempotency_keys SET status=$3, response=$4 WHERE scope = $1 AND key = $2;
+
+-- name: delete-tx-idempotency-key
+DELETE FROM tx_idempotency_keys WHERE scope = $1 AND key = $2;
+
+-- name: delete-expired-tx-idempotency-keys
+DELETE FROM tx_idempotency_keys WHERE created_at < $1;
+
+-- segments
+-- name: get-segments
+SELECT * FROM segments WHERE ($1 = 0 OR id = $1) ORDER BY name;
+
+-- name: insert-segment
+INSERT INTO segments (name, query, list_ids) VALUES($1, $2, $3) RETURNING id;
+
+-- name: update-segment
+UPDATE segments SET name=$2, query=$3, list_ids=$4, updated_at=NOW() WHERE id = $1;
+
+-- name: delete-segment
+-- Segments targeted by campaigns that haven't finished are not deleted.
+DELETE FROM segments WHERE id = $1 AND NOT EXISTS (
+    SELECT 1 FROM campaigns WHERE segment_id = $1 AND status NOT IN ('finished', 'cancelled')
+);
+
+-- name: check-segment-query
+-- raw: true
+-- Dry run of a segment's query (%query%) to validate it.
+SELECT subscribers.id FROM subscribers WHERE %query% LIMIT 0;
+
+-- name: get-import-checkpoint
+SELECT line FROM import_checkpoints WHERE hash = $1;
+
+-- name: upsert-import-checkpoint
+INSERT INTO import_checkpoints (filename, hash, line) VALUES($1, $2, $3)
+    ON CONFLICT (hash) DO UPDATE SET filename=$1, line=$3, updated_at=NOW();
+
+-- name: delete-import-checkpoint
+DELETE FROM import_checkpoints WHERE hash = $1;
+
+-- name: delete-stale-import-checkpoints
+-- Deletes the checkpoints of a file with the given name that has since changed (different hash).
+DELETE FROM import_checkpoints WHERE filename = $1 AND hash != $2;
+
 -- name: record-bounce
 -- Insert a bounce and count the bounces for the subscriber and either unsubscribe them,
 WITH sub AS (
@@ -1010,6 +2320,41 @@ bounce AS (
 DELETE FROM subscribers
     WHERE $9 = 'delete' AND (SELECT num FROM num) >= $8 AND id = (SELECT id FROM sub);
 
+-- name: get-bounce-rule-bounces
+-- Gets the bounces within the last $1 seconds that the bounce rules are evaluated against.
+SELECT subscriber_id, type, campaign_id, created_at FROM bounces
+    WHERE created_at > NOW() - MAKE_INTERVAL(secs => $1) ORDER BY id;
+
+-- name: get-bounce-rule-actions
+-- Gets the time of the last bounce rule action, by bounce type and action, on each
+-- subscriber who has bounced within the last $1 seconds.
+SELECT subscriber_id, type, action, MAX(created_at) AS created_at FROM bounce_rule_actions
+    WHERE subscriber_id IN (SELECT subscriber_id FROM bounces WHERE created_at > NOW() - MAKE_INTERVAL(secs => $1))
+    GROUP BY subscriber_id, type, action;
+
+-- name: apply-bounce-rule
+-- Applies the action $3 of a bounce rule to the subscriber $1 who has $4 bounces of
+-- type $2. 'blocklist' blocklists the subscriber and 'remove' removes them from the
+-- lists of the campaigns ($5) that bounced. If the action changed anything, it's
+-- recorded in bounce_rule_actions. Returns the number of actions recorded (0 or 1).
+WITH block AS (
+    UPDATE subscribers SET status='blocklisted', updated_at=NOW()
+    WHERE $3 = 'blocklist' AND id = $1 AND status != 'blocklisted'
+    RETURNING id
+),
+rem AS (
+    DELETE FROM subscriber_lists
+    WHERE $3 = 'remove' AND subscriber_id = $1
+        AND list_id IN (SELECT list_id FROM campaign_lists WHERE campaign_id = ANY($5::INT[]))
+    RETURNING subscriber_id AS id
+),
+acted AS (
+    INSERT INTO bounce_rule_actions (subscriber_id, type, action, num_bounces)
+        SELECT $1, $2::bounce_type, $3, $4 WHERE EXISTS (SELECT id FROM block UNION ALL SELECT id FROM rem)
+    RETURNING 1
+)
+SELECT COUNT(*) FROM acted;
+
 -- name: query-bounces
 SELECT COUNT(*) OVER () AS total,
     bounces.id,
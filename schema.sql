@@ -6,7 +6,9 @@ DROP TYPE IF EXISTS campaign_status CASCADE; CREATE TYPE campaign_status AS ENUM
 DROP TYPE IF EXISTS campaign_type CASCADE; CREATE TYPE campaign_type AS ENUM ('regular', 'optin');
 DROP TYPE IF EXISTS content_type CASCADE; CREATE TYPE content_type AS ENUM ('richtext', 'html', 'plain', 'markdown');
 DROP TYPE IF EXISTS bounce_type CASCADE; CREATE TYPE bounce_type AS ENUM ('soft', 'hard', 'complaint');
-DROP TYPE IF EXISTS template_type CASCADE; CREATE TYPE template_type AS ENUM ('campaign', 'tx');
+DROP TYPE IF EXISTS template_type CASCADE; CREATE TYPE template_type AS ENUM ('campaign', 'tx', 'partial');
+DROP TYPE IF EXISTS tx_status CASCADE; CREATE TYPE tx_status AS ENUM ('queued', 'sent', 'failed');
+DROP TYPE IF EXISTS campaign_approval_status CASCADE; CREATE TYPE campaign_approval_status AS ENUM ('none', 'pending', 'approved', 'rejected');
 
 -- subscribers
 DROP TABLE IF EXISTS subscribers CASCADE;
@@ -18,6 +20,12 @@ CREATE TABLE subscribers (
     attribs         JSONB NOT NULL DEFAULT '{}',
     status          subscriber_status NOT NULL DEFAULT 'enabled',
 
+    -- Soft deleted (archived) subscribers are purged after a retention period.
+    archived_at     TIMESTAMP WITH TIME ZONE NULL,
+
+    -- 0-100 score from the subscriber's recent views and clicks, refreshed periodically.
+    engagement_score REAL NOT NULL DEFAULT 0,
+
     created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
@@ -25,6 +33,23 @@ DROP INDEX IF EXISTS idx_subs_email; CREATE UNIQUE INDEX idx_subs_email ON subsc
 DROP INDEX IF EXISTS idx_subs_status; CREATE INDEX idx_subs_status ON subscribers(status);
 DROP INDEX IF EXISTS idx_subs_created_at; CREATE INDEX idx_subs_created_at ON subscribers(created_at);
 DROP INDEX IF EXISTS idx_subs_updated_at; CREATE INDEX idx_subs_updated_at ON subscribers(updated_at);
+DROP INDEX IF EXISTS idx_subs_archived_at; CREATE INDEX idx_subs_archived_at ON subscribers(archived_at) WHERE archived_at IS NOT NULL;
+DROP INDEX IF EXISTS idx_subs_attribs; CREATE INDEX idx_subs_attribs ON subscribers USING GIN (attribs jsonb_path_ops);
+
+-- templates
+DROP TABLE IF EXISTS templates CASCADE;
+CREATE TABLE templates (
+    id              SERIAL PRIMARY KEY,
+    name            TEXT NOT NULL,
+    type            template_type NOT NULL DEFAULT 'campaign',
+    subject         TEXT NOT NULL,
+    body            TEXT NOT NULL,
+    is_default      BOOLEAN NOT NULL DEFAULT false,
+
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+CREATE UNIQUE INDEX ON templates (is_default) WHERE is_default = true;
 
 -- lists
 DROP TABLE IF EXISTS lists CASCADE;
@@ -37,11 +62,35 @@ CREATE TABLE lists (
     tags            VARCHAR(100)[],
     description     TEXT NOT NULL DEFAULT '',
 
+    -- Optional override of the app.max_subscriber_messages setting.
+    max_subscriber_messages INT NULL,
+
+    -- Optional default template for campaigns on the list that don't have one.
+    template_id     INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- Archived lists are hidden from list pickers and public forms but retain their subscriptions.
+    archived        BOOLEAN NOT NULL DEFAULT false,
+
+    -- Optional parent list (group) that the list belongs to. Groups are one level deep.
+    parent_id       INTEGER NULL REFERENCES lists(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- Whether campaign views (opens) are tracked. Campaigns on a list with tracking
+    -- disabled aren't tracked.
+    track_views     BOOLEAN NOT NULL DEFAULT true,
+
+    -- Optional sending identity of single-list campaigns that don't have a from_email.
+    from_email      TEXT NOT NULL DEFAULT '',
+    from_name       TEXT NOT NULL DEFAULT '',
+
+    -- Optional language (i18n code) of the public pages and e-mails of the list's subscribers.
+    language        TEXT NOT NULL DEFAULT '',
+
     created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 DROP INDEX IF EXISTS idx_lists_type; CREATE INDEX idx_lists_type ON lists(type);
 DROP INDEX IF EXISTS idx_lists_optin; CREATE INDEX idx_lists_optin ON lists(optin);
+DROP INDEX IF EXISTS idx_lists_parent_id; CREATE INDEX idx_lists_parent_id ON lists(parent_id);
 DROP INDEX IF EXISTS idx_lists_name; CREATE INDEX idx_lists_name ON lists(name);
 DROP INDEX IF EXISTS idx_lists_created_at; CREATE INDEX idx_lists_created_at ON lists(created_at);
 DROP INDEX IF EXISTS idx_lists_updated_at; CREATE INDEX idx_lists_updated_at ON lists(updated_at);
@@ -54,6 +103,13 @@ CREATE TABLE subscriber_lists (
     meta               JSONB NOT NULL DEFAULT '{}',
     status             subscription_status NOT NULL DEFAULT 'unconfirmed',
 
+    -- Number of opt-in confirmation reminders sent for an unconfirmed subscription.
+    optin_reminders    INT NOT NULL DEFAULT 0,
+
+    -- Deadline by which a subscription pending re-confirmation has to be confirmed
+    -- again, after which it's unsubscribed.
+    reconfirm_by       TIMESTAMP WITH TIME ZONE NULL,
+
     created_at         TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at         TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
 
@@ -63,20 +119,18 @@ DROP INDEX IF EXISTS idx_sub_lists_sub_id; CREATE INDEX idx_sub_lists_sub_id ON
 DROP INDEX IF EXISTS idx_sub_lists_list_id; CREATE INDEX idx_sub_lists_list_id ON subscriber_lists(list_id);
 DROP INDEX IF EXISTS idx_sub_lists_status; CREATE INDEX idx_sub_lists_status ON subscriber_lists(status);
 
--- templates
-DROP TABLE IF EXISTS templates CASCADE;
-CREATE TABLE templates (
-    id              SERIAL PRIMARY KEY,
-    name            TEXT NOT NULL,
-    type            template_type NOT NULL DEFAULT 'campaign',
-    subject         TEXT NOT NULL,
-    body            TEXT NOT NULL,
-    is_default      BOOLEAN NOT NULL DEFAULT false,
+-- segments are saved subscriber queries that campaigns can target.
+DROP TABLE IF EXISTS segments CASCADE;
+CREATE TABLE segments (
+    id               SERIAL PRIMARY KEY,
+    name             TEXT NOT NULL,
+    query            TEXT NOT NULL,
 
-    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+    -- Optional lists that the subscribers matching the query have to be on.
+    list_ids         INTEGER[] NOT NULL DEFAULT '{}',
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
-CREATE UNIQUE INDEX ON templates (is_default) WHERE is_default = true;
 
 
 -- campaigns
@@ -90,6 +144,12 @@ CREATE TABLE campaigns (
     body             TEXT NOT NULL,
     altbody          TEXT NULL,
     content_type     content_type NOT NULL DEFAULT 'richtext',
+
+    -- Optional AMP for Email body that's sent as a text/x-amp-html part.
+    amp_body         TEXT NULL,
+
+    -- Rendered HTML of the body for Markdown campaigns.
+    body_html        TEXT NULL,
     send_at          TIMESTAMP WITH TIME ZONE,
     headers          JSONB NOT NULL DEFAULT '[]',
     status           campaign_status NOT NULL DEFAULT 'draft',
@@ -115,6 +175,74 @@ CREATE TABLE campaigns (
     archive_template_id INTEGER REFERENCES templates(id) ON DELETE SET DEFAULT DEFAULT 1,
     archive_meta        JSONB NOT NULL DEFAULT '{}',
 
+    -- A/B subject variant testing. Once the sample of subscribers has been sent
+    -- the variants, the winning variant is picked and sent to the remaining
+    -- subscribers after this time.
+    variant_sample_ends_at TIMESTAMP WITH TIME ZONE NULL,
+
+    -- Recurring campaigns. A recurring campaign is a template that's cloned into a
+    -- new campaign (recurrence_parent_id) at every trigger of its cron expression.
+    recurrence           TEXT NULL,
+    recurrence_active    BOOLEAN NOT NULL DEFAULT false,
+    recurrence_next_at   TIMESTAMP WITH TIME ZONE NULL,
+    recurrence_parent_id INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- Optional window of hours (start inclusive, end exclusive) in the subscriber's
+    -- local time zone during which messages may be sent. Wraps around midnight if start > end.
+    send_window_start    INT NULL CHECK (send_window_start >= 0 AND send_window_start <= 23),
+    send_window_end      INT NULL CHECK (send_window_end >= 1 AND send_window_end <= 24),
+
+    -- Optional saved segment that the campaign's subscribers are filtered by at the time of sending.
+    segment_id           INTEGER NULL REFERENCES segments(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- Optional list group whose lists are sent to in addition to the campaign's lists.
+    list_group_id        INTEGER NULL REFERENCES lists(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- Send priority. Running campaigns are sent to in proportion to their priority + 1.
+    priority             SMALLINT NOT NULL DEFAULT 0 CHECK (priority >= 0 AND priority <= 10),
+
+    -- Whether to add the List-Unsubscribe headers. NULL follows privacy.unsubscribe_header.
+    unsubscribe_header   BOOLEAN NULL,
+
+    -- Whether to inline the CSS in the body's <style> blocks. NULL follows app.inline_css.
+    inline_css           BOOLEAN NULL,
+
+    -- Whether views (opens) are tracked with a pixel. The most restrictive of this, the
+    -- campaign's lists' track_views, and privacy.track_views applies.
+    track_views          BOOLEAN NOT NULL DEFAULT true,
+
+    -- Whether the campaign is a triggered run of a draft campaign that's sent only
+    -- to its recipients in campaign_recipients.
+    triggered            BOOLEAN NOT NULL DEFAULT false,
+
+    -- Optional e-mails and webhook that are notified when the campaign finishes or is
+    -- cancelled, in addition to app.notify_emails and the webhooks subscribed to campaign.ended.
+    notify_emails        TEXT[] NOT NULL DEFAULT '{}',
+    notify_webhook_id    INTEGER NULL,
+
+    -- Optional lists whose subscribers, and campaigns whose recipients, are
+    -- excluded from the campaign.
+    exclude_list_ids     INTEGER[] NOT NULL DEFAULT '{}',
+    exclude_campaign_ids INTEGER[] NOT NULL DEFAULT '{}',
+
+    -- Whether a subscriber on multiple target lists is sent a copy per list
+    -- instead of a single message.
+    per_list_copies      BOOLEAN NOT NULL DEFAULT false,
+
+    -- Optional preview text shown by e-mail clients after the subject.
+    preheader            TEXT NULL,
+
+    -- If app.campaign_approval is enabled, only approved campaigns can be started or scheduled.
+    -- The reason is that of the last rejection. Editing a campaign resets its approval.
+    approval_status      campaign_approval_status NOT NULL DEFAULT 'none',
+    approval_reason      TEXT NOT NULL DEFAULT '',
+
+    -- Incremented on every change to the campaign's content to detect concurrent edits.
+    revision             INT NOT NULL DEFAULT 0,
+
+    -- UTM params (source, medium, campaign, content) added to the campaign's tracked links.
+    utm                  JSONB NOT NULL DEFAULT '{}',
+
     started_at       TIMESTAMP WITH TIME ZONE,
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
@@ -123,6 +251,8 @@ DROP INDEX IF EXISTS idx_camps_status; CREATE INDEX idx_camps_status ON campaign
 DROP INDEX IF EXISTS idx_camps_name; CREATE INDEX idx_camps_name ON campaigns(name);
 DROP INDEX IF EXISTS idx_camps_created_at; CREATE INDEX idx_camps_created_at ON campaigns(created_at);
 DROP INDEX IF EXISTS idx_camps_updated_at; CREATE INDEX idx_camps_updated_at ON campaigns(updated_at);
+DROP INDEX IF EXISTS idx_camps_recurrence_next_at; CREATE INDEX idx_camps_recurrence_next_at ON campaigns(recurrence_next_at) WHERE recurrence_active = true;
+DROP INDEX IF EXISTS idx_camps_recurrence_run; CREATE UNIQUE INDEX idx_camps_recurrence_run ON campaigns(recurrence_parent_id, send_at) WHERE recurrence_parent_id IS NOT NULL;
 
 
 DROP TABLE IF EXISTS campaign_lists CASCADE;
@@ -139,6 +269,60 @@ CREATE UNIQUE INDEX ON campaign_lists (campaign_id, list_id);
 DROP INDEX IF EXISTS idx_camp_lists_camp_id; CREATE INDEX idx_camp_lists_camp_id ON campaign_lists(campaign_id);
 DROP INDEX IF EXISTS idx_camp_lists_list_id; CREATE INDEX idx_camp_lists_list_id ON campaign_lists(list_id);
 
+-- The recipients of triggered campaign runs, resolved at the time of the trigger.
+DROP TABLE IF EXISTS campaign_recipients CASCADE;
+CREATE TABLE campaign_recipients (
+    campaign_id    INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id  INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    PRIMARY KEY (campaign_id, subscriber_id)
+);
+
+-- A/B test subject line variants of a campaign.
+DROP TABLE IF EXISTS campaign_variants CASCADE;
+CREATE TABLE campaign_variants (
+    id               SERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subject          TEXT NOT NULL,
+
+    -- Relative weight with which the variant is assigned to subscribers in the sample.
+    weight           INT NOT NULL DEFAULT 1,
+    sent             INT NOT NULL DEFAULT 0,
+    winner           BOOLEAN NOT NULL DEFAULT false,
+
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_camp_variants_camp_id; CREATE INDEX idx_camp_variants_camp_id ON campaign_variants(campaign_id);
+
+-- audit log of campaign approval requests, approvals, and rejections.
+DROP TABLE IF EXISTS campaign_approvals CASCADE;
+CREATE TABLE campaign_approvals (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    status           campaign_approval_status NOT NULL,
+    actor            TEXT NOT NULL DEFAULT '',
+    reason           TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_camp_approvals_camp_id; CREATE INDEX idx_camp_approvals_camp_id ON campaign_approvals(campaign_id);
+
+-- campaign content version history.
+DROP TABLE IF EXISTS campaign_versions CASCADE;
+CREATE TABLE campaign_versions (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    version          INT NOT NULL,
+    author           TEXT NOT NULL DEFAULT '',
+    subject          TEXT NOT NULL,
+    body             TEXT NOT NULL,
+    altbody          TEXT NULL,
+    content_type     content_type NOT NULL DEFAULT 'richtext',
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE(campaign_id, version)
+);
+
 DROP TABLE IF EXISTS campaign_views CASCADE;
 CREATE TABLE campaign_views (
     id               BIGSERIAL PRIMARY KEY,
@@ -146,13 +330,60 @@ CREATE TABLE campaign_views (
 
     -- Subscribers may be deleted, but the view counts should remain.
     subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- The subject variant that the subscriber was sent, if any.
+    variant_id       INTEGER NULL REFERENCES campaign_variants(id) ON DELETE SET NULL ON UPDATE CASCADE,
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 DROP INDEX IF EXISTS idx_views_camp_id; CREATE INDEX idx_views_camp_id ON campaign_views(campaign_id);
 DROP INDEX IF EXISTS idx_views_subscriber_id; CREATE INDEX idx_views_subscriber_id ON campaign_views(subscriber_id);
 DROP INDEX IF EXISTS idx_views_date; CREATE INDEX idx_views_date ON campaign_views((TIMEZONE('UTC', created_at)::DATE));
+DROP INDEX IF EXISTS idx_views_camp_date; CREATE INDEX idx_views_camp_date ON campaign_views(campaign_id, created_at);
+DROP INDEX IF EXISTS idx_views_variant_id; CREATE INDEX idx_views_variant_id ON campaign_views(variant_id) WHERE variant_id IS NOT NULL;
+
+-- Campaign messages sent to subscribers. This is only recorded when the per-subscriber
+-- rolling message cap (app.max_subscriber_messages) is enabled globally or on any list.
+DROP TABLE IF EXISTS subscriber_sends CASCADE;
+CREATE TABLE subscriber_sends (
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_sub_sends_sub_id; CREATE INDEX idx_sub_sends_sub_id ON subscriber_sends(subscriber_id, created_at);
+DROP INDEX IF EXISTS idx_sub_sends_date; CREATE INDEX idx_sub_sends_date ON subscriber_sends(created_at);
+
+-- Subscribers to whom the messages of a campaign have been sent. They're skipped when
+-- the campaign is resumed from an earlier checkpoint, eg: after a shutdown with messages
+-- still queued, and by campaigns that exclude the campaign's recipients.
+DROP TABLE IF EXISTS campaign_deliveries CASCADE;
+CREATE TABLE campaign_deliveries (
+    campaign_id    INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id  INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    PRIMARY KEY (campaign_id, subscriber_id)
+);
+
+-- Subscribers whose campaign messages have been deferred, eg: on hitting the per-subscriber
+-- message cap, and are retried at retry_at. copies is the number of messages (per-list copies).
+DROP TABLE IF EXISTS campaign_deferrals CASCADE;
+CREATE TABLE campaign_deferrals (
+    campaign_id    INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id  INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    copies         INTEGER NOT NULL DEFAULT 1,
+    retry_at       TIMESTAMP WITH TIME ZONE NOT NULL,
+
+    PRIMARY KEY (campaign_id, subscriber_id)
+);
+DROP INDEX IF EXISTS idx_camp_deferrals_retry; CREATE INDEX idx_camp_deferrals_retry ON campaign_deferrals(campaign_id, retry_at);
 
 -- media
+DROP TABLE IF EXISTS media_folders CASCADE;
+CREATE TABLE media_folders (
+    id               SERIAL PRIMARY KEY,
+    name             TEXT NOT NULL UNIQUE,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 DROP TABLE IF EXISTS media CASCADE;
 CREATE TABLE media (
     id               SERIAL PRIMARY KEY,
@@ -162,8 +393,16 @@ CREATE TABLE media (
     content_type     TEXT NOT NULL DEFAULT 'application/octet-stream',
     thumb            TEXT NOT NULL,
     meta             JSONB NOT NULL DEFAULT '{}',
+
+    -- Moving media between folders only changes folder_id and not the stored files.
+    folder_id        INTEGER NULL REFERENCES media_folders(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    size             BIGINT NOT NULL DEFAULT 0,
+
+    -- Resized variants of images, eg: [{"width": 320, "filename": "320w_file.jpg"}].
+    variants         JSONB NOT NULL DEFAULT '[]',
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
+DROP INDEX IF EXISTS idx_media_folder_id; CREATE INDEX idx_media_folder_id ON media(folder_id);
 
 -- campaign_media
 DROP TABLE IF EXISTS campaign_media CASCADE;
@@ -197,12 +436,17 @@ CREATE TABLE link_clicks (
 
     -- Subscribers may be deleted, but the link counts should remain.
     subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- The subject variant that the subscriber was sent, if any.
+    variant_id       INTEGER NULL REFERENCES campaign_variants(id) ON DELETE SET NULL ON UPDATE CASCADE,
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 DROP INDEX IF EXISTS idx_clicks_camp_id; CREATE INDEX idx_clicks_camp_id ON link_clicks(campaign_id);
 DROP INDEX IF EXISTS idx_clicks_link_id; CREATE INDEX idx_clicks_link_id ON link_clicks(link_id);
 DROP INDEX IF EXISTS idx_clicks_sub_id; CREATE INDEX idx_clicks_sub_id ON link_clicks(subscriber_id);
 DROP INDEX IF EXISTS idx_clicks_date; CREATE INDEX idx_clicks_date ON link_clicks((TIMEZONE('UTC', created_at)::DATE));
+DROP INDEX IF EXISTS idx_clicks_camp_date; CREATE INDEX idx_clicks_camp_date ON link_clicks(campaign_id, created_at);
+DROP INDEX IF EXISTS idx_clicks_variant_id; CREATE INDEX idx_clicks_variant_id ON link_clicks(variant_id) WHERE variant_id IS NOT NULL;
 
 -- settings
 DROP TABLE IF EXISTS settings CASCADE;
@@ -225,6 +469,33 @@ INSERT INTO settings (key, value) VALUES
     ('app.message_sliding_window', 'false'),
     ('app.message_sliding_window_duration', '"1h"'),
     ('app.message_sliding_window_rate', '10000'),
+    ('app.max_subscriber_messages', '0'),
+    ('app.message_throttle', '0'),
+    ('app.inline_css', 'false'),
+    ('app.optin_reminder_interval', '"48h"'),
+    ('app.optin_reminder_max', '0'),
+    ('app.optin_reminder_purge', 'false'),
+    ('app.archived_subscriber_retention', '"720h"'),
+    ('app.unconfirmed_subscriber_retention', '"0"'),
+    ('app.unsubscribed_subscriber_retention', '"0"'),
+    ('app.engagement_open_weight', '1'),
+    ('app.engagement_click_weight', '3'),
+    ('app.engagement_half_life', '"720h"'),
+    ('app.campaign_trigger_max_recipients', '1000'),
+    ('app.subscriber_attribs_schema', '""'),
+    ('app.campaign_variant_sample_size', '20'),
+    ('app.campaign_variant_sample_window', '"4h"'),
+    ('app.recurring_campaign_catchup', '"once"'),
+    ('app.send_window_timezone', '"UTC"'),
+    ('app.max_campaign_versions', '20'),
+    ('app.sandbox_enabled', 'false'),
+    ('app.sandbox_email', '""'),
+    ('app.allow_protected_headers', 'false'),
+    ('app.campaign_approval', 'false'),
+    ('app.utm_source', '""'),
+    ('app.utm_medium', '""'),
+    ('app.utm_campaign', '""'),
+    ('app.utm_content', '""'),
     ('app.cache_slow_queries', 'false'),
     ('app.cache_slow_queries_interval', '"0 3 * * *"'),
     ('app.enable_public_archive', 'true'),
@@ -242,10 +513,23 @@ INSERT INTO settings (key, value) VALUES
     ('privacy.allow_preferences', 'true'),
     ('privacy.exportable', '["profile", "subscriptions", "campaign_views", "link_clicks"]'),
     ('privacy.domain_blocklist', '[]'),
+    ('privacy.domain_allowlist', '[]'),
+    ('privacy.block_disposable_domains', 'false'),
     ('privacy.record_optin_ip', 'false'),
+    ('privacy.track_views', 'true'),
+    ('privacy.privacy_mode', 'false'),
+    ('privacy.unsubscribe_confirm', 'true'),
+    ('privacy.unsubscribe_all_lists', 'false'),
     ('security.enable_captcha', 'false'),
     ('security.captcha_key', '""'),
     ('security.captcha_secret', '""'),
+    ('security.unsubscribe_secret', '""'),
+    ('security.captcha_provider', '"hcaptcha"'),
+    ('security.captcha_strict', 'true'),
+    ('security.public_rate_limit_enabled', 'false'),
+    ('security.public_rate_limit_requests', '20'),
+    ('security.public_rate_limit_window', '"1m"'),
+    ('security.trusted_proxy_header', '""'),
     ('upload.provider', '"filesystem"'),
     ('upload.max_file_size', '5000'),
     ('upload.extensions', '["jpg","jpeg","png","gif","svg","*"]'),
@@ -261,17 +545,23 @@ INSERT INTO settings (key, value) VALUES
     ('upload.s3.bucket_path', '"/"'),
     ('upload.s3.bucket_type', '"public"'),
     ('upload.s3.expiry', '"167h"'),
+    ('upload.s3.url_mode', '"auto"'),
+    ('upload.image_variant_widths', '[320, 640, 1280]'),
     ('smtp',
-        '[{"enabled":true, "host":"smtp.yoursite.com","port":25,"auth_protocol":"cram","username":"username","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_type":"STARTTLS","tls_skip_verify":false,"email_headers":[]},
-          {"enabled":false, "host":"smtp.gmail.com","port":465,"auth_protocol":"login","username":"username@gmail.com","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_type":"TLS","tls_skip_verify":false,"email_headers":[]}]'),
+        '[{"enabled":true, "host":"smtp.yoursite.com","port":25,"auth_protocol":"cram","username":"username","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_type":"STARTTLS","tls_skip_verify":false,"email_headers":[],"weight":1},
+          {"enabled":false, "host":"smtp.gmail.com","port":465,"auth_protocol":"login","username":"username@gmail.com","password":"password","hello_hostname":"","max_conns":10,"idle_timeout":"15s","wait_timeout":"5s","max_msg_retries":2,"tls_type":"TLS","tls_skip_verify":false,"email_headers":[],"weight":1}]'),
     ('messengers', '[]'),
+    ('sms', '{"enabled": false, "name": "sms", "gateway_url": "", "username": "", "password": "", "from": "", "phone_attrib": "phone", "max_conns": 10, "timeout": "5s"}'),
+    ('dkim', '{"enabled": false, "keys": []}'),
     ('bounce.enabled', 'false'),
     ('bounce.webhooks_enabled', 'false'),
     ('bounce.actions', '{"soft": {"count": 2, "action": "none"}, "hard": {"count": 1, "action": "blocklist"}, "complaint" : {"count": 1, "action": "blocklist"}}'),
+    ('bounce.rules', '[]'),
     ('bounce.ses_enabled', 'false'),
     ('bounce.sendgrid_enabled', 'false'),
     ('bounce.sendgrid_key', '""'),
     ('bounce.postmark', '{"enabled": false, "username": "", "password": ""}'),
+    ('bounce.sparkpost', '{"enabled": false, "username": "", "password": ""}'),
     ('bounce.mailboxes',
         '[{"enabled":false, "type": "pop", "host":"pop.yoursite.com","port":995,"auth_protocol":"userpass","username":"username","password":"password","return_path": "bounce@listmonk.yoursite.com","scan_interval":"15m","tls_enabled":true,"tls_skip_verify":false}]'),
     ('appearance.admin.custom_css', '""'),
@@ -295,6 +585,209 @@ DROP INDEX IF EXISTS idx_bounces_camp_id; CREATE INDEX idx_bounces_camp_id ON bo
 DROP INDEX IF EXISTS idx_bounces_source; CREATE INDEX idx_bounces_source ON bounces(source);
 DROP INDEX IF EXISTS idx_bounces_date; CREATE INDEX idx_bounces_date ON bounces((TIMEZONE('UTC', created_at)::DATE));
 
+-- webhooks
+DROP TABLE IF EXISTS webhooks CASCADE;
+CREATE TABLE webhooks (
+    id               SERIAL PRIMARY KEY,
+    name             TEXT NOT NULL,
+    url              TEXT NOT NULL,
+
+    -- Secret with which the payloads are signed (HMAC-SHA256).
+    secret           TEXT NOT NULL DEFAULT '',
+    events           TEXT[] NOT NULL DEFAULT '{}',
+    enabled          BOOLEAN NOT NULL DEFAULT true,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- attrib_fields are typed definitions of subscriber attributes.
+DROP TABLE IF EXISTS attrib_fields CASCADE;
+CREATE TABLE attrib_fields (
+    id               SERIAL PRIMARY KEY,
+    name             TEXT NOT NULL UNIQUE,
+    type             TEXT NOT NULL,
+    label            TEXT NOT NULL DEFAULT '',
+    required         BOOLEAN NOT NULL DEFAULT false,
+
+    -- Allowed values of enum fields.
+    options          TEXT[] NOT NULL DEFAULT '{}',
+    default_value    JSONB NOT NULL DEFAULT 'null',
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- webhook_failures is the dead-letter log of webhook deliveries that failed after all retries.
+DROP TABLE IF EXISTS webhook_failures CASCADE;
+CREATE TABLE webhook_failures (
+    id               BIGSERIAL PRIMARY KEY,
+    webhook_id       INTEGER NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    event            TEXT NOT NULL,
+    payload          JSONB NOT NULL DEFAULT '{}',
+    error            TEXT NOT NULL DEFAULT '',
+    attempts         INT NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_webhook_failures_hook_id; CREATE INDEX idx_webhook_failures_hook_id ON webhook_failures(webhook_id);
+
+-- tx_messages tracks the delivery status of transactional messages sent in the queued mode.
+DROP TABLE IF EXISTS tx_messages CASCADE;
+CREATE TABLE tx_messages (
+    id               BIGSERIAL PRIMARY KEY,
+    uuid             uuid NOT NULL UNIQUE,
+    subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    subject          TEXT NOT NULL DEFAULT '',
+    status           tx_status NOT NULL DEFAULT 'queued',
+    attempts         INT NOT NULL DEFAULT 0,
+    error            TEXT NOT NULL DEFAULT '',
+
+    -- The rendered message that's kept till it's sent or fails, and the time at which
+    -- a queued message is (re)tried.
+    message          JSONB NULL,
+    retry_at         TIMESTAMP WITH TIME ZONE NULL,
+
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_tx_messages_sub_id; CREATE INDEX idx_tx_messages_sub_id ON tx_messages(subscriber_id);
+DROP INDEX IF EXISTS idx_tx_messages_retry; CREATE INDEX idx_tx_messages_retry ON tx_messages(retry_at) WHERE status = 'queued';
+
+-- tx_idempotency_keys stores the responses of transactional API requests made with an
+-- Idempotency-Key header for replaying on retries. scope is the user making the request.
+-- status is the HTTP status of the response and 0 while the request is being processed.
+DROP TABLE IF EXISTS tx_idempotency_keys CASCADE;
+CREATE TABLE tx_idempotency_keys (
+    scope            TEXT NOT NULL,
+    key              TEXT NOT NULL,
+    request_hash     TEXT NOT NULL,
+    status           INT NOT NULL DEFAULT 0,
+    response         BYTEA NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    PRIMARY KEY (scope, key)
+);
+DROP INDEX IF EXISTS idx_tx_idempotency_keys_created_at; CREATE INDEX idx_tx_idempotency_keys_created_at ON tx_idempotency_keys(created_at);
+
+-- bounce_rule_actions records the actions taken on subscribers by bounce rules.
+DROP TABLE IF EXISTS bounce_rule_actions CASCADE;
+CREATE TABLE bounce_rule_actions (
+    id               SERIAL PRIMARY KEY,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    type             bounce_type NOT NULL,
+    action           TEXT NOT NULL,
+
+    -- Number of bounces within the rule's window that triggered the action.
+    num_bounces      INTEGER NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_bounce_rule_actions_sub_id; CREATE INDEX idx_bounce_rule_actions_sub_id ON bounce_rule_actions(subscriber_id, type);
+
+-- list_subscriber_counts caches the number of subscribers per list and subscription status.
+-- Changes to subscriptions (and subscriber archival) queue the affected lists in
+-- list_counts_queue via triggers, and a background worker recomputes their counts.
+DROP TABLE IF EXISTS list_subscriber_counts CASCADE;
+CREATE TABLE list_subscriber_counts (
+    list_id          INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    status           subscription_status NOT NULL,
+    subscriber_count INTEGER NOT NULL DEFAULT 0,
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (list_id, status)
+);
+
+DROP TABLE IF EXISTS list_counts_queue CASCADE;
+CREATE TABLE list_counts_queue (
+    list_id          INTEGER NOT NULL PRIMARY KEY,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE OR REPLACE FUNCTION queue_list_counts() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        INSERT INTO list_counts_queue (list_id)
+            SELECT DISTINCT list_id FROM new_rows WHERE list_id IS NOT NULL ORDER BY list_id
+            ON CONFLICT (list_id) DO NOTHING;
+    END IF;
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        INSERT INTO list_counts_queue (list_id)
+            SELECT DISTINCT list_id FROM old_rows WHERE list_id IS NOT NULL ORDER BY list_id
+            ON CONFLICT (list_id) DO NOTHING;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION queue_archived_list_counts() RETURNS TRIGGER AS $$
+BEGIN
+    INSERT INTO list_counts_queue (list_id)
+        SELECT DISTINCT subscriber_lists.list_id FROM new_rows
+        INNER JOIN old_rows ON (old_rows.id = new_rows.id)
+        INNER JOIN subscriber_lists ON (subscriber_lists.subscriber_id = new_rows.id)
+        WHERE old_rows.archived_at IS DISTINCT FROM new_rows.archived_at
+        ORDER BY subscriber_lists.list_id
+        ON CONFLICT (list_id) DO NOTHING;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_sub_lists_insert_counts ON subscriber_lists;
+CREATE TRIGGER trg_sub_lists_insert_counts AFTER INSERT ON subscriber_lists
+    REFERENCING NEW TABLE AS new_rows FOR EACH STATEMENT EXECUTE FUNCTION queue_list_counts();
+DROP TRIGGER IF EXISTS trg_sub_lists_update_counts ON subscriber_lists;
+CREATE TRIGGER trg_sub_lists_update_counts AFTER UPDATE ON subscriber_lists
+    REFERENCING OLD TABLE AS old_rows NEW TABLE AS new_rows FOR EACH STATEMENT EXECUTE FUNCTION queue_list_counts();
+DROP TRIGGER IF EXISTS trg_sub_lists_delete_counts ON subscriber_lists;
+CREATE TRIGGER trg_sub_lists_delete_counts AFTER DELETE ON subscriber_lists
+    REFERENCING OLD TABLE AS old_rows FOR EACH STATEMENT EXECUTE FUNCTION queue_list_counts();
+DROP TRIGGER IF EXISTS trg_subs_archive_counts ON subscribers;
+CREATE TRIGGER trg_subs_archive_counts AFTER UPDATE ON subscribers
+    REFERENCING OLD TABLE AS old_rows NEW TABLE AS new_rows FOR EACH STATEMENT EXECUTE FUNCTION queue_archived_list_counts();
+
+-- subscriber_tombstones records the SHA-256 hashes of the e-mails of erased subscribers.
+DROP TABLE IF EXISTS subscriber_tombstones CASCADE;
+CREATE TABLE subscriber_tombstones (
+    hash             TEXT NOT NULL PRIMARY KEY,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- suppressions is the global suppression list of (lowercased) e-mails that are blocklisted
+-- whether or not they exist as subscribers. Subscribers that are inserted with a suppressed
+-- e-mail are blocklisted by the trg_subs_suppress trigger.
+DROP TABLE IF EXISTS suppressions CASCADE;
+CREATE TABLE suppressions (
+    email            TEXT NOT NULL PRIMARY KEY,
+
+    -- Number of inserts of subscribers (subscriptions, imports) with the e-mail that were blocklisted.
+    blocked          INTEGER NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE OR REPLACE FUNCTION suppress_subscriber() RETURNS TRIGGER AS $$
+BEGIN
+    UPDATE suppressions SET blocked = blocked + 1, updated_at = NOW() WHERE email = LOWER(NEW.email);
+    IF FOUND THEN
+        NEW.status := 'blocklisted';
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS trg_subs_suppress ON subscribers;
+CREATE TRIGGER trg_subs_suppress BEFORE INSERT ON subscribers
+    FOR EACH ROW EXECUTE FUNCTION suppress_subscriber();
+
+-- import_checkpoints records the last committed line of interrupted imports so that
+-- re-importing the same file (identified by its SHA-256 hash) resumes from there.
+DROP TABLE IF EXISTS import_checkpoints CASCADE;
+CREATE TABLE import_checkpoints (
+    hash             TEXT NOT NULL PRIMARY KEY,
+    filename         TEXT NOT NULL,
+    line             INTEGER NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_import_checkpoints_filename; CREATE INDEX idx_import_checkpoints_filename ON import_checkpoints(filename);
+
 
 
 -- materialized views
@@ -310,6 +803,7 @@ CREATE MATERIALIZED VIEW mat_dashboard_counts AS
             'subscribers', JSON_BUILD_OBJECT(
                 'total', (SELECT SUM(num) FROM subs),
                 'blocklisted', (SELECT num FROM subs WHERE status='blocklisted'),
+                'archived', (SELECT COUNT(*) FROM subscribers WHERE archived_at IS NOT NULL),
                 'orphans', (
                     SELECT COUNT(id) FROM subscribers
                     LEFT JOIN subscriber_lists ON (subscribers.id = subscriber_lists.subscriber_id)
@@ -374,8 +868,12 @@ DROP INDEX IF EXISTS mat_dashboard_charts_idx; CREATE UNIQUE INDEX mat_dashboard
 DROP MATERIALIZED VIEW IF EXISTS mat_list_subscriber_stats;
 CREATE MATERIALIZED VIEW mat_list_subscriber_stats AS
     SELECT NOW() AS updated_at, lists.id AS list_id, subscriber_lists.status, COUNT(*) AS subscriber_count FROM lists
-    LEFT JOIN subscriber_lists ON (subscriber_lists.list_id = lists.id)
+    LEFT JOIN subscriber_lists ON (
+        subscriber_lists.list_id = lists.id AND
+        -- Exclude archived subscribers.
+        NOT EXISTS (SELECT 1 FROM subscribers WHERE subscribers.id = subscriber_lists.subscriber_id AND subscribers.archived_at IS NOT NULL)
+    )
     GROUP BY lists.id, subscriber_lists.status
     UNION ALL
-    SELECT NOW() AS updated_at, 0 AS list_id, NULL AS status, COUNT(*) AS subscriber_count FROM subscribers;
+    SELECT NOW() AS updated_at, 0 AS list_id, NULL AS status, COUNT(*) AS subscriber_count FROM subscribers WHERE archived_at IS NULL;
 DROP INDEX IF EXISTS mat_list_subscriber_stats_idx; CREATE UNIQUE INDEX mat_list_subscriber_stats_idx ON mat_list_subscriber_stats (list_id, status);